@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"gopkg.in/gomail.v2"
+)
+
+var (
+	// Email configuration - loaded from config.json
+	smtpHost     string
+	smtpPort     int
+	smtpUsername string
+	smtpPassword string
+	fromEmail    string
+	publicURL    string
+
+	// Email templates for different languages
+	emailTemplates EmailTemplates
+)
+
+// Configuration structure, the same as reset_password's plus the public URL of this service
+// for the unsubscribe links
+type Config struct {
+	SMTP struct {
+		Host      string `json:"host"`
+		Port      int    `json:"port"`
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+		FromEmail string `json:"from_email"`
+	} `json:"smtp"`
+	App struct {
+		PublicURL string `json:"public_url"`
+	} `json:"app"`
+}
+
+// Email template structure. Every text is a text/template over ReminderTemplateData.
+type EmailTemplate struct {
+	SubjectDueSoon  string `json:"subject_due_soon"`
+	SubjectDueToday string `json:"subject_due_today"`
+	SubjectDigest   string `json:"subject_digest"`
+	Greeting        string `json:"greeting"`
+	DueSoon         string `json:"due_soon"`
+	DueToday        string `json:"due_today"`
+	DigestIntro     string `json:"digest_intro"`
+	ButtonText      string `json:"button_text"`
+	Footer          string `json:"footer"`
+	Unsubscribe     string `json:"unsubscribe"`
+	Unsubscribed    string `json:"unsubscribed"`
+}
+
+// Email templates collection
+type EmailTemplates struct {
+	Templates map[string]EmailTemplate `json:"templates"`
+}
+
+// Template data for one reminder, or for the digest as a whole
+type ReminderTemplateData struct {
+	UserName string
+	Name     string
+	Amount   string
+	DueDate  string
+	Count    int
+}
+
+// The link of the button: opens the bills screen of the app
+const appBillsLink = "herobudget://bills"
+
+// smtpConfigured reports whether real SMTP settings were loaded; with the placeholder
+// defaults no reminders are sent
+func smtpConfigured() bool {
+	return smtpHost != "smtp.example.com"
+}
+
+// loadConfig reads config.json from the working directory. Without SMTP settings there, the
+// SMTP account of reset_password is used, so the credentials live in one place.
+func loadConfig() {
+	smtpHost = "smtp.example.com"
+	smtpPort = 587
+	smtpUsername = "your-email@example.com"
+	fromEmail = "your-email@example.com"
+	publicURL = "http://localhost:8101"
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Failed to get current directory: %v", err)
+	}
+
+	config, err := readConfig(filepath.Join(cwd, "config.json"))
+	if err != nil {
+		log.Printf("Error reading config file: %v, using defaults", err)
+	}
+	if config.App.PublicURL != "" {
+		publicURL = strings.TrimSuffix(config.App.PublicURL, "/")
+	}
+	if config.SMTP.Host == "" {
+		shared, err := readConfig(filepath.Join(cwd, "..", "reset_password", "config.json"))
+		if err != nil {
+			log.Printf("Error reading reset_password config file: %v, using defaults", err)
+		}
+		config.SMTP = shared.SMTP
+	}
+	if config.SMTP.Host == "" {
+		log.Println("SMTP configuration not found, using default values")
+		return
+	}
+
+	smtpHost = config.SMTP.Host
+	smtpPort = config.SMTP.Port
+	smtpUsername = config.SMTP.Username
+	smtpPassword = config.SMTP.Password
+	fromEmail = config.SMTP.FromEmail
+	log.Println("Configuration loaded successfully")
+}
+
+// readConfig parses a config file; a missing file is an empty configuration
+func readConfig(path string) (Config, error) {
+	var config Config
+	configFile, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(configFile, &config); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+func loadEmailTemplates() {
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Failed to get current directory: %v", err)
+	}
+
+	templatesPath := filepath.Join(cwd, "email_templates.json")
+	templatesFile, err := os.ReadFile(templatesPath)
+	if err != nil {
+		log.Fatalf("Error reading email templates file: %v", err)
+	}
+
+	if err := json.Unmarshal(templatesFile, &emailTemplates); err != nil {
+		log.Fatalf("Error parsing email templates file: %v", err)
+	}
+
+	log.Printf("Email templates loaded for %d languages", len(emailTemplates.Templates))
+}
+
+// Get template for language, fallback to English if not found
+func getEmailTemplate(language string) EmailTemplate {
+	// Normalize language code (e.g., "en-US" -> "en")
+	lang := strings.ToLower(strings.Split(strings.ReplaceAll(language, "_", "-"), "-")[0])
+
+	if template, exists := emailTemplates.Templates[lang]; exists {
+		return template
+	}
+
+	if template, exists := emailTemplates.Templates["en"]; exists {
+		return template
+	}
+
+	log.Printf("No templates found, using hardcoded English fallback")
+	return EmailTemplate{
+		SubjectDueSoon:  "Hero Budget - {{.Name}} is due on {{.DueDate}}",
+		SubjectDueToday: "Hero Budget - {{.Name}} is due today",
+		SubjectDigest:   "Hero Budget - {{.Count}} bills due soon",
+		Greeting:        "Hello {{.UserName}},",
+		DueSoon:         "{{.Name}} ({{.Amount}}) is due on {{.DueDate}}.",
+		DueToday:        "{{.Name}} ({{.Amount}}) is due today and is still unpaid.",
+		DigestIntro:     "These bills are due soon:",
+		ButtonText:      "Open Hero Budget",
+		Footer:          "You receive this email because bill reminders are enabled in Hero Budget.",
+		Unsubscribe:     "Unsubscribe from bill reminders",
+		Unsubscribed:    "You will no longer receive bill reminders. You can turn them back on in the app.",
+	}
+}
+
+// render executes one of the texts of a template, falling back to the raw text if it is invalid
+func render(text string, data ReminderTemplateData) string {
+	tmpl, err := template.New("text").Parse(text)
+	if err != nil {
+		log.Printf("Error parsing email template %q: %v", text, err)
+		return text
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Printf("Error executing email template %q: %v", text, err)
+		return text
+	}
+	return buf.String()
+}
+
+// reminderData is the template data of a reminder. With escape the values go into HTML.
+func reminderData(userName string, r reminder, escape bool) ReminderTemplateData {
+	data := ReminderTemplateData{
+		UserName: userName,
+		Name:     r.Name,
+		Amount:   fmt.Sprintf("%.2f", r.Amount),
+		DueDate:  r.DueDate.Format("2006-01-02"),
+	}
+	if escape {
+		data.UserName, data.Name = html.EscapeString(data.UserName), html.EscapeString(data.Name)
+	}
+	return data
+}
+
+func unsubscribeLink(token string) string {
+	return fmt.Sprintf("%s/bill-reminders/unsubscribe?token=%s", publicURL, token)
+}
+
+// sendReminderEmail sends one email with the given reminders: a single reminder, or the
+// digest of the day when there are several
+func sendReminderEmail(toEmail, userName, language, token string, reminders []reminder) error {
+	if toEmail == "" {
+		return fmt.Errorf("cannot send reminder email: email address is empty")
+	}
+	if userName == "" {
+		userName = "there"
+	}
+	emailTemplate := getEmailTemplate(language)
+
+	var subject, intro string
+	if len(reminders) == 1 {
+		subject = emailTemplate.SubjectDueSoon
+		if reminders[0].Kind == ReminderDue {
+			subject = emailTemplate.SubjectDueToday
+		}
+		subject = render(subject, reminderData(userName, reminders[0], false))
+	} else {
+		subject = render(emailTemplate.SubjectDigest, ReminderTemplateData{UserName: userName, Count: len(reminders)})
+		intro = fmt.Sprintf(`<p style="margin-bottom: 10px; color: #4A154B;">%s</p>`,
+			render(emailTemplate.DigestIntro, ReminderTemplateData{Count: len(reminders)}))
+	}
+
+	var items strings.Builder
+	for _, r := range reminders {
+		text := emailTemplate.DueSoon
+		if r.Kind == ReminderDue {
+			text = emailTemplate.DueToday
+		}
+		fmt.Fprintf(&items, `<li style="margin-bottom: 8px;">%s</li>`, render(text, reminderData(userName, r, true)))
+	}
+
+	link := unsubscribeLink(token)
+	greeting := render(emailTemplate.Greeting, ReminderTemplateData{UserName: html.EscapeString(userName)})
+
+	emailBody := fmt.Sprintf(`
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>%s</title>
+</head>
+<body style="font-family: Arial, sans-serif; max-width: 600px; margin: 0 auto; padding: 20px; color: #333333;">
+    <div style="background-color: #F8E7FA; background: linear-gradient(135deg, #F8E7FA 0%%, #E6D0F0 100%%); border-radius: 12px; padding: 35px; box-shadow: 0 4px 8px rgba(0, 0, 0, 0.1);">
+        <p style="margin-bottom: 20px; font-size: 18px; color: #4A154B; font-weight: 500;">%s</p>
+        %s
+        <ul style="color: #4A154B; padding-left: 20px;">%s</ul>
+        <p style="text-align: center; margin: 30px 0;">
+            <a href="%s" style="background-color: #6A1B9A; color: white; padding: 12px 30px; text-decoration: none; border-radius: 8px; font-weight: bold; display: inline-block; box-shadow: 0 3px 5px rgba(106, 27, 154, 0.3);">%s</a>
+        </p>
+    </div>
+    <p style="color: #777777; font-size: 12px; text-align: center; margin-top: 20px;">
+        %s<br>
+        <a href="%s" style="color: #777777;">%s</a>
+    </p>
+</body>
+</html>
+`,
+		html.EscapeString(subject),
+		greeting,
+		intro,
+		items.String(),
+		appBillsLink,
+		emailTemplate.ButtonText,
+		emailTemplate.Footer,
+		link,
+		emailTemplate.Unsubscribe,
+	)
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", fromEmail)
+	m.SetHeader("To", toEmail)
+	m.SetHeader("Subject", subject)
+	m.SetHeader("List-Unsubscribe", "<"+link+">")
+	m.SetBody("text/html", emailBody)
+
+	d := gomail.NewDialer(smtpHost, smtpPort, smtpUsername, smtpPassword)
+	if err := d.DialAndSend(m); err != nil {
+		return fmt.Errorf("failed to send reminder email: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"hero_budget_backend/common"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Preferences are a user's reminder settings. DaysBefore is the default lead time of the
+// first reminder; each bill can override it (see BillReminder).
+type Preferences struct {
+	UserID     string `json:"user_id"`
+	Enabled    bool   `json:"enabled"`
+	DaysBefore int    `json:"days_before"` // 0 sends no reminder before the due date
+	OnDueDate  bool   `json:"on_due_date"` // Remind again on the due date if still unpaid
+	Digest     bool   `json:"digest"`      // One email per day with every reminder instead of one per bill
+	token      string
+}
+
+// BillReminder overrides the user's lead time for one bill
+type BillReminder struct {
+	UserID     string `json:"user_id"`
+	BillID     int    `json:"bill_id"`
+	DaysBefore *int   `json:"days_before"` // null goes back to the user's default
+}
+
+type ApiResponse struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Reminder kinds: the first reminder some days before the due date, and the one on the day
+const (
+	ReminderBefore = "before"
+	ReminderDue    = "due"
+)
+
+const (
+	defaultDaysBefore = 3
+	maxDaysBefore     = 30
+)
+
+var db *sql.DB
+
+func init() {
+	// SMTP settings and the localized templates, as in reset_password
+	loadConfig()
+	loadEmailTemplates()
+
+	var err error
+
+	// Get the current working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Failed to get current directory: %v", err)
+	}
+
+	// Construct absolute path to the database file
+	dbPath := filepath.Join(cwd, "..", "google_auth", "users.db")
+	log.Printf("Using database at: %s", dbPath)
+
+	// Open the database connection
+	db, err = sql.Open("sqlite3", dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	// Test the connection
+	if err = db.Ping(); err != nil {
+		log.Fatalf("Failed to ping database: %v", err)
+	}
+
+	if err := createTablesIfNotExist(db); err != nil {
+		log.Fatalf("Failed to create reminder tables: %v", err)
+	}
+
+	log.Println("Bill Reminders - Database connection established successfully")
+}
+
+func createTablesIfNotExist(db *sql.DB) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS bill_reminder_preferences (
+			user_id TEXT PRIMARY KEY,
+			enabled BOOLEAN NOT NULL DEFAULT 1,
+			days_before INTEGER NOT NULL DEFAULT 3,
+			on_due_date BOOLEAN NOT NULL DEFAULT 1,
+			digest BOOLEAN NOT NULL DEFAULT 0,
+			unsubscribe_token TEXT NOT NULL UNIQUE,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS bill_reminder_overrides (
+			bill_id INTEGER PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			days_before INTEGER NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		// One row per reminder sent: the unique key is what keeps the hourly job, a restart or
+		// a second instance from sending the same reminder twice
+		`CREATE TABLE IF NOT EXISTS bill_reminders_sent (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			bill_id INTEGER NOT NULL,
+			occurrence_key TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(bill_id, occurrence_key, kind)
+		)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	// Reminders are for what is left to pay of each occurrence
+	if err := common.EnsureBillPaymentAmountColumns(db); err != nil {
+		return err
+	}
+	return common.EnsureOutboxTable(db)
+}
+
+func main() {
+	http.HandleFunc("/bill-reminders/preferences", corsMiddleware(handlePreferences))
+	http.HandleFunc("/bill-reminders/bill", corsMiddleware(handleBillReminder))
+	http.HandleFunc("/bill-reminders/unsubscribe", handleUnsubscribe)
+	http.HandleFunc("/health", corsMiddleware(handleHealth))
+
+	go runReminderJob(context.Background(), reminderCheckInterval)
+
+	port := 8101
+	log.Printf("Bill Reminders service started on :%d", port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+}
+
+func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	sendSuccessResponse(w, "Bill Reminders service is running", nil)
+}
+
+func sendSuccessResponse(w http.ResponseWriter, message string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ApiResponse{
+		Success: true,
+		Message: message,
+		Data:    data,
+	})
+}
+
+func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ApiResponse{
+		Success: false,
+		Message: message,
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+)
+
+// UpdatePreferencesRequest changes only the fields that are present
+type UpdatePreferencesRequest struct {
+	UserID     string `json:"user_id"`
+	Enabled    *bool  `json:"enabled"`
+	DaysBefore *int   `json:"days_before"`
+	OnDueDate  *bool  `json:"on_due_date"`
+	Digest     *bool  `json:"digest"`
+}
+
+func handlePreferences(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		userID := r.URL.Query().Get("user_id")
+		if userID == "" {
+			sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+			return
+		}
+		prefs, err := userPreferences(db, userID)
+		if err != nil {
+			log.Printf("Error fetching preferences: %v", err)
+			sendErrorResponse(w, "Error fetching preferences", http.StatusInternalServerError)
+			return
+		}
+		sendSuccessResponse(w, "Preferences fetched successfully", prefs)
+
+	case "POST":
+		var req UpdatePreferencesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.UserID == "" {
+			sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+			return
+		}
+		if req.DaysBefore != nil && (*req.DaysBefore < 0 || *req.DaysBefore > maxDaysBefore) {
+			sendErrorResponse(w, fmt.Sprintf("Days before must be between 0 and %d", maxDaysBefore), http.StatusBadRequest)
+			return
+		}
+
+		prefs, err := userPreferences(db, req.UserID)
+		if err != nil {
+			log.Printf("Error fetching preferences: %v", err)
+			sendErrorResponse(w, "Error fetching preferences", http.StatusInternalServerError)
+			return
+		}
+		if req.Enabled != nil {
+			prefs.Enabled = *req.Enabled
+		}
+		if req.DaysBefore != nil {
+			prefs.DaysBefore = *req.DaysBefore
+		}
+		if req.OnDueDate != nil {
+			prefs.OnDueDate = *req.OnDueDate
+		}
+		if req.Digest != nil {
+			prefs.Digest = *req.Digest
+		}
+		_, err = db.Exec(`
+			UPDATE bill_reminder_preferences SET enabled = ?, days_before = ?, on_due_date = ?, digest = ?,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE user_id = ?
+		`, prefs.Enabled, prefs.DaysBefore, prefs.OnDueDate, prefs.Digest, prefs.UserID)
+		if err != nil {
+			log.Printf("Error saving preferences: %v", err)
+			sendErrorResponse(w, "Error saving preferences", http.StatusInternalServerError)
+			return
+		}
+		sendSuccessResponse(w, "Preferences saved successfully", prefs)
+
+	default:
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleBillReminder sets the lead time of one bill, or removes it with days_before null
+func handleBillReminder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req BillReminder
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" || req.BillID == 0 {
+		sendErrorResponse(w, "User ID and bill ID are required", http.StatusBadRequest)
+		return
+	}
+	if req.DaysBefore != nil && (*req.DaysBefore < 0 || *req.DaysBefore > maxDaysBefore) {
+		sendErrorResponse(w, fmt.Sprintf("Days before must be between 0 and %d", maxDaysBefore), http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM bills WHERE id = ? AND user_id = ?)`, req.BillID, req.UserID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error fetching bill: %v", err)
+		sendErrorResponse(w, "Error fetching bill", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		sendErrorResponse(w, "Bill not found", http.StatusNotFound)
+		return
+	}
+
+	if req.DaysBefore == nil {
+		_, err = db.Exec(`DELETE FROM bill_reminder_overrides WHERE bill_id = ?`, req.BillID)
+	} else {
+		_, err = db.Exec(`
+			INSERT INTO bill_reminder_overrides (bill_id, user_id, days_before) VALUES (?, ?, ?)
+			ON CONFLICT(bill_id) DO UPDATE SET days_before = excluded.days_before, updated_at = CURRENT_TIMESTAMP
+		`, req.BillID, req.UserID, *req.DaysBefore)
+	}
+	if err != nil {
+		log.Printf("Error saving bill reminder: %v", err)
+		sendErrorResponse(w, "Error saving bill reminder", http.StatusInternalServerError)
+		return
+	}
+	sendSuccessResponse(w, "Bill reminder saved successfully", req)
+}
+
+// handleUnsubscribe is the link at the bottom of every reminder. It disables the user's
+// reminders and answers with a page in their language; they can be enabled again from the app.
+func handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	var locale string
+	err := db.QueryRow(`
+		SELECT COALESCE(u.locale, '') FROM bill_reminder_preferences p
+		LEFT JOIN users u ON CAST(u.id AS TEXT) = p.user_id
+		WHERE p.unsubscribe_token = ?
+	`, token).Scan(&locale)
+	if token == "" || err == sql.ErrNoRows {
+		http.Error(w, "Invalid unsubscribe link", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		_, err = db.Exec(`
+			UPDATE bill_reminder_preferences SET enabled = 0, updated_at = CURRENT_TIMESTAMP WHERE unsubscribe_token = ?
+		`, token)
+	}
+	if err != nil {
+		log.Printf("Error unsubscribing from bill reminders: %v", err)
+		http.Error(w, "Error unsubscribing", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><meta name="viewport" content="width=device-width, initial-scale=1.0"><title>Hero Budget</title></head>
+<body style="font-family: Arial, sans-serif; max-width: 600px; margin: 40px auto; padding: 20px; color: #4A154B; text-align: center;">
+    <p>%s</p>
+</body>
+</html>
+`, html.EscapeString(getEmailTemplate(locale).Unsubscribed))
+}
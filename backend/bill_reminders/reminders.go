@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+// How often reminders are checked. Each user's day starts at a different time depending on
+// their time zone, so this runs hourly rather than daily.
+const reminderCheckInterval = time.Hour
+
+// Reminders go out from this hour of the user's day, not at midnight
+const reminderHour = 8
+
+// reminder is an unpaid occurrence of a bill that is due for a reminder
+type reminder struct {
+	common.UnpaidBillOccurrence
+	Kind string
+}
+
+// billEvents are the domain events after which a bill can be due for a reminder
+var billEvents = []string{common.EventBillCreated, common.EventBillUpdated}
+
+// runReminderJob sends the reminders that are due each interval until ctx is cancelled,
+// starting right away so reminders missed while the service was down go out on start.
+// Bills added or rescheduled in between get theirs through the notifications subscriber.
+func runReminderJob(ctx context.Context, interval time.Duration) {
+	if !smtpConfigured() {
+		log.Println("SMTP not configured. Bill reminders are disabled.")
+		return
+	}
+
+	dispatcher := common.NewDispatcher(db)
+	dispatcher.Subscribe("notifications", remindForEvent, billEvents...)
+	go dispatcher.Run(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := sendAllReminders(); err != nil {
+			log.Printf("Error sending bill reminders: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// remindForEvent sends the user's due reminders right after a bill changes, so a bill added
+// the day before it is due is not left waiting for the next run
+func remindForEvent(event common.DomainEvent) error {
+	_, err := sendUserReminders(event.UserID, common.UserNow(db, event.UserID))
+	return err
+}
+
+// sendAllReminders runs sendUserReminders for every user with unpaid bills
+func sendAllReminders() error {
+	rows, err := db.Query(`SELECT DISTINCT user_id FROM bills WHERE paid = 0`)
+	if err != nil {
+		return fmt.Errorf("error fetching users with unpaid bills: %v", err)
+	}
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning user: %v", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error fetching users with unpaid bills: %v", err)
+	}
+
+	for _, userID := range userIDs {
+		if _, err := sendUserReminders(userID, common.UserNow(db, userID)); err != nil {
+			log.Printf("Error sending bill reminders to user %s: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// sendUserReminders sends the user's reminders that are due at now, the user's local time,
+// and returns how many emails were sent. Each reminder is recorded before it is sent and the
+// record is removed if sending fails, so it is sent once and retried on the next run.
+func sendUserReminders(userID string, now time.Time) (int, error) {
+	if now.Hour() < reminderHour {
+		return 0, nil
+	}
+
+	var email, name, locale string
+	err := db.QueryRow(`SELECT COALESCE(email, ''), COALESCE(name, ''), COALESCE(locale, '') FROM users WHERE id = ?`,
+		userID).Scan(&email, &name, &locale)
+	if err == sql.ErrNoRows || (err == nil && email == "") {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error fetching user: %v", err)
+	}
+
+	prefs, err := userPreferences(db, userID)
+	if err != nil {
+		return 0, err
+	}
+	if !prefs.Enabled {
+		return 0, nil
+	}
+
+	var claimed []reminder
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		reminders, err := dueReminders(tx, prefs, common.DateOnly(now))
+		if err != nil {
+			return err
+		}
+		claimed, err = claimReminders(tx, userID, reminders)
+		return err
+	})
+	if err != nil || len(claimed) == 0 {
+		return 0, err
+	}
+
+	batches := [][]reminder{claimed}
+	if !prefs.Digest {
+		batches = batches[:0]
+		for _, r := range claimed {
+			batches = append(batches, []reminder{r})
+		}
+	}
+
+	sent := 0
+	for _, batch := range batches {
+		if err := sendReminderEmail(email, name, locale, prefs.token, batch); err != nil {
+			log.Printf("Error sending bill reminder to user %s: %v", userID, err)
+			if err := releaseReminders(userID, batch); err != nil {
+				log.Printf("Error releasing bill reminders of user %s: %v", userID, err)
+			}
+			continue
+		}
+		sent++
+	}
+	log.Printf("Sent %d bill reminder emails to user %s", sent, userID)
+	return sent, nil
+}
+
+// dueReminders returns the reminders due today: the first one when the due date is within
+// the bill's lead time, and the second one on the due date. A reminder missed on its day,
+// e.g. for a bill added the day before it is due, still goes out while it is in time.
+func dueReminders(q common.DBTX, prefs Preferences, today time.Time) ([]reminder, error) {
+	overrides, err := billOverrides(q, prefs.UserID)
+	if err != nil {
+		return nil, err
+	}
+	horizon := prefs.DaysBefore
+	for _, days := range overrides {
+		horizon = max(horizon, days)
+	}
+
+	occurrences, err := common.UnpaidBillOccurrences(q, prefs.UserID, today, today.AddDate(0, 0, horizon))
+	if err != nil {
+		return nil, err
+	}
+
+	var reminders []reminder
+	for _, occurrence := range occurrences {
+		if occurrence.Overdue() {
+			continue
+		}
+		daysBefore := prefs.DaysBefore
+		if days, ok := overrides[occurrence.BillID]; ok {
+			daysBefore = days
+		}
+		daysLeft := int(occurrence.DueDate.Sub(today).Hours() / 24)
+		switch {
+		case daysLeft == 0 && prefs.OnDueDate:
+			reminders = append(reminders, reminder{occurrence, ReminderDue})
+		case daysLeft > 0 && daysLeft <= daysBefore:
+			reminders = append(reminders, reminder{occurrence, ReminderBefore})
+		}
+	}
+	return reminders, nil
+}
+
+// claimReminders records the reminders as sent and returns those that had not been sent yet
+func claimReminders(q common.DBTX, userID string, reminders []reminder) ([]reminder, error) {
+	var claimed []reminder
+	for _, r := range reminders {
+		result, err := q.Exec(`
+			INSERT OR IGNORE INTO bill_reminders_sent (user_id, bill_id, occurrence_key, kind) VALUES (?, ?, ?, ?)
+		`, userID, r.BillID, r.Key, r.Kind)
+		if err != nil {
+			return nil, fmt.Errorf("error recording bill reminder: %v", err)
+		}
+		if inserted, _ := result.RowsAffected(); inserted > 0 {
+			claimed = append(claimed, r)
+		}
+	}
+	return claimed, nil
+}
+
+// releaseReminders removes the records of reminders that could not be sent
+func releaseReminders(userID string, reminders []reminder) error {
+	return common.WithTx(db, func(tx *sql.Tx) error {
+		for _, r := range reminders {
+			_, err := tx.Exec(`
+				DELETE FROM bill_reminders_sent WHERE user_id = ? AND bill_id = ? AND occurrence_key = ? AND kind = ?
+			`, userID, r.BillID, r.Key, r.Kind)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// userPreferences returns the user's preferences, creating the defaults and the unsubscribe
+// token the first time
+func userPreferences(q common.DBTX, userID string) (Preferences, error) {
+	token, err := newUnsubscribeToken()
+	if err != nil {
+		return Preferences{}, err
+	}
+	_, err = q.Exec(`
+		INSERT OR IGNORE INTO bill_reminder_preferences (user_id, days_before, unsubscribe_token) VALUES (?, ?, ?)
+	`, userID, defaultDaysBefore, token)
+	if err != nil {
+		return Preferences{}, fmt.Errorf("error creating reminder preferences: %v", err)
+	}
+
+	prefs := Preferences{UserID: userID}
+	err = q.QueryRow(`
+		SELECT enabled, days_before, on_due_date, digest, unsubscribe_token
+		FROM bill_reminder_preferences WHERE user_id = ?
+	`, userID).Scan(&prefs.Enabled, &prefs.DaysBefore, &prefs.OnDueDate, &prefs.Digest, &prefs.token)
+	if err != nil {
+		return prefs, fmt.Errorf("error fetching reminder preferences: %v", err)
+	}
+	return prefs, nil
+}
+
+// billOverrides returns the lead time of the user's bills that override the default
+func billOverrides(q common.DBTX, userID string) (map[int]int, error) {
+	rows, err := q.Query(`SELECT bill_id, days_before FROM bill_reminder_overrides WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching bill reminder overrides: %v", err)
+	}
+	defer rows.Close()
+
+	overrides := map[int]int{}
+	for rows.Next() {
+		var billID, days int
+		if err := rows.Scan(&billID, &days); err != nil {
+			return nil, fmt.Errorf("error scanning bill reminder override: %v", err)
+		}
+		overrides[billID] = days
+	}
+	return overrides, rows.Err()
+}
+
+func newUnsubscribeToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating unsubscribe token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpSink is a local SMTP server that accepts every message and keeps it
+type smtpSink struct {
+	mu       sync.Mutex
+	messages []*mail.Message
+	bodies   []string
+}
+
+func startSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start SMTP sink: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sink := &smtpSink{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+
+	// Point the mailer at the sink, without authentication
+	smtpHost, smtpPort = "127.0.0.1", listener.Addr().(*net.TCPAddr).Port
+	smtpUsername, smtpPassword, fromEmail = "", "", "reminders@example.com"
+	return sink
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP sink")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data bytes.Buffer
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			s.keep(data.Bytes())
+			reply("250 OK")
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *smtpSink) keep(data []byte) {
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	var body io.Reader = message.Body
+	if message.Header.Get("Content-Transfer-Encoding") == "quoted-printable" {
+		body = quotedprintable.NewReader(body)
+	}
+	decoded, _ := io.ReadAll(body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, message)
+	s.bodies = append(s.bodies, string(decoded))
+}
+
+// subjects returns the decoded subjects of the messages received since the last call
+func (s *smtpSink) subjects() ([]string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var subjects []string
+	for _, message := range s.messages {
+		subject, _ := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+		subjects = append(subjects, subject)
+	}
+	bodies := s.bodies
+	s.messages, s.bodies = nil, nil
+	return subjects, bodies
+}
+
+func setupReminderDB(t *testing.T) *sql.DB {
+	t.Helper()
+	testDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+
+	statements := []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT, name TEXT, locale TEXT, timezone TEXT)`,
+		`CREATE TABLE bills (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, name TEXT, amount REAL,
+			due_date TEXT, paid BOOLEAN DEFAULT 0, recurring BOOLEAN DEFAULT 0, scheduled BOOLEAN DEFAULT 0,
+			category TEXT, icon TEXT, start_date TEXT, payment_day INTEGER DEFAULT 0, duration_months INTEGER DEFAULT 1,
+			regularity TEXT DEFAULT 'monthly', business_day_adjustment TEXT, payment_method TEXT DEFAULT 'bank')`,
+		`CREATE TABLE bill_payments (id INTEGER PRIMARY KEY AUTOINCREMENT, bill_id INTEGER, user_id TEXT,
+			year_month TEXT, due_date TEXT, paid BOOLEAN DEFAULT 0, payment_method TEXT)`,
+		`INSERT INTO users (email, name, locale) VALUES ('ana@example.com', 'Ana', 'es-ES')`,
+	}
+	for _, statement := range statements {
+		if _, err := testDB.Exec(statement); err != nil {
+			t.Fatalf("Failed to create schema: %v", err)
+		}
+	}
+	if err := createTablesIfNotExist(testDB); err != nil {
+		t.Fatalf("Failed to create reminder tables: %v", err)
+	}
+	return testDB
+}
+
+func addTestBill(t *testing.T, name, dueDate string) int {
+	t.Helper()
+	result, err := db.Exec(`INSERT INTO bills (user_id, name, amount, due_date, start_date) VALUES ('1', ?, 50, ?, ?)`,
+		name, dueDate, dueDate)
+	if err != nil {
+		t.Fatalf("Failed to add bill: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+func post(t *testing.T, handler http.HandlerFunc, body interface{}) {
+	t.Helper()
+	payload, _ := json.Marshal(body)
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("POST", "/", bytes.NewBuffer(payload)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRemindersAreSentOnceInTheUserLanguage(t *testing.T) {
+	sink := startSMTPSink(t)
+	db = setupReminderDB(t)
+
+	addTestBill(t, "Rent", "2025-06-13")
+	addTestBill(t, "Water", "2025-06-10")
+	gym := addTestBill(t, "Gym", "2025-06-15")
+	addTestBill(t, "Internet", "2025-06-16")
+	addTestBill(t, "Phone", "2025-06-01")
+	fiveDays := 5
+	post(t, handleBillReminder, BillReminder{UserID: "1", BillID: gym, DaysBefore: &fiveDays})
+
+	at := func(date string, hour int) time.Time {
+		day, _ := time.Parse("2006-01-02", date)
+		return day.Add(time.Duration(hour) * time.Hour)
+	}
+	send := func(now time.Time) int {
+		sent, err := sendUserReminders("1", now)
+		if err != nil {
+			t.Fatalf("Failed to send reminders: %v", err)
+		}
+		return sent
+	}
+
+	// Nothing before the reminder hour of the user's day
+	if sent := send(at("2025-06-10", 6)); sent != 0 {
+		t.Errorf("Expected no reminders before %d:00, got %d", reminderHour, sent)
+	}
+
+	// Rent 3 days ahead (the default), Gym 5 days ahead (its own lead time) and Water on its
+	// due date; Internet is not due yet and the overdue Phone bill gets no reminder
+	if sent := send(at("2025-06-10", 9)); sent != 3 {
+		t.Fatalf("Expected 3 reminder emails, got %d", sent)
+	}
+	subjects, bodies := sink.subjects()
+	want := []string{
+		"Hero Budget - Water vence hoy",
+		"Hero Budget - Rent vence el 2025-06-13",
+		"Hero Budget - Gym vence el 2025-06-15",
+	}
+	if strings.Join(subjects, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected subjects %q, got %q", want, subjects)
+	}
+	prefs, _ := userPreferences(db, "1")
+	if len(bodies) == 0 || !strings.Contains(bodies[0], unsubscribeLink(prefs.token)) {
+		t.Errorf("Expected the unsubscribe link in the email")
+	}
+	if sent := send(at("2025-06-10", 10)); sent != 0 {
+		t.Errorf("Expected the reminders to be sent once, got %d more", sent)
+	}
+
+	// With the digest, Rent on its due date and Internet 3 days ahead go in one email
+	enabled := true
+	post(t, handlePreferences, UpdatePreferencesRequest{UserID: "1", Digest: &enabled})
+	if sent := send(at("2025-06-13", 9)); sent != 1 {
+		t.Fatalf("Expected one digest email, got %d", sent)
+	}
+	subjects, bodies = sink.subjects()
+	if len(subjects) != 1 || subjects[0] != "Hero Budget - 2 facturas vencen pronto" ||
+		!strings.Contains(bodies[0], "Rent") || !strings.Contains(bodies[0], "Internet") {
+		t.Errorf("Expected a digest with Rent and Internet, got %q", subjects)
+	}
+
+	// After unsubscribing, Gym on its due date is not reminded
+	rr := httptest.NewRecorder()
+	handleUnsubscribe(rr, httptest.NewRequest("GET", "/bill-reminders/unsubscribe?token="+prefs.token, nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Ya no recibirás") {
+		t.Fatalf("Expected the unsubscribe page in Spanish, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if sent := send(at("2025-06-15", 9)); sent != 0 {
+		t.Errorf("Expected no reminders after unsubscribing, got %d", sent)
+	}
+}
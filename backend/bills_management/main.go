@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
+
+	"hero_budget_backend/common"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -32,6 +36,13 @@ type Bill struct {
 	PaymentMethod  string  `json:"payment_method"`
 	CreatedAt      string  `json:"created_at"`
 	UpdatedAt      string  `json:"updated_at"`
+	Version        int     `json:"version"`
+	ETag           string  `json:"etag,omitempty"`
+
+	// Weekend handling of due dates: "", "following", "preceding" or "modified_following"
+	BusinessDayAdjustment string `json:"business_day_adjustment"`
+	// Payments are generated from the recurrence (regularity may be a preset or an RRULE)
+	Scheduled bool `json:"scheduled"`
 }
 
 type UpdateBillRequest struct {
@@ -39,13 +50,18 @@ type UpdateBillRequest struct {
 	BillID         int     `json:"bill_id"`
 	Name           string  `json:"name,omitempty"`
 	Amount         float64 `json:"amount,omitempty"`
+	DueDate        string  `json:"due_date,omitempty"`
 	StartDate      string  `json:"start_date,omitempty"`
-	PaymentDay     int     `json:"payment_day,omitempty"`
+	PaymentDay     int     `json:"payment_day,omitempty"` // -1 for the last day of the month
 	DurationMonths int     `json:"duration_months,omitempty"`
+	OpenEnded      bool    `json:"open_ended,omitempty"` // Clears the duration so the bill never ends
 	Regularity     string  `json:"regularity,omitempty"`
 	Category       string  `json:"category,omitempty"`
 	Icon           string  `json:"icon,omitempty"`
 	PaymentMethod  string  `json:"payment_method,omitempty"`
+	// Pointer so that "" can clear the adjustment
+	BusinessDayAdjustment *string `json:"business_day_adjustment,omitempty"`
+	Version               int     `json:"version,omitempty"` // Optional precondition, same as If-Match
 }
 
 type DeleteBillRequest struct {
@@ -69,6 +85,22 @@ func init() {
 
 	fmt.Printf("Using database at: %s\n", dbPath)
 	createTablesIfNotExist()
+
+	// Table used to replay responses of retried requests
+	if err := common.EnsureIdempotencyTable(db); err != nil {
+		log.Fatalf("Failed to create idempotency_keys table: %v", err)
+	}
+
+	// Ledger from which the period balance tables are projected
+	if err := common.EnsureLedgerTable(db); err != nil {
+		log.Fatalf("Failed to create balance ledger: %v", err)
+	}
+
+	// Domain events written in the same transaction as each change
+	if err := common.EnsureOutboxTable(db); err != nil {
+		log.Fatalf("Failed to create outbox: %v", err)
+	}
+
 	log.Println("Database connection established successfully")
 }
 
@@ -76,7 +108,8 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -90,12 +123,16 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 func main() {
 	// Set up CORS middleware and routes
 	http.HandleFunc("/bills", corsMiddleware(handleFetchBills))
-	http.HandleFunc("/bills/add", corsMiddleware(handleAddBill))
-	http.HandleFunc("/bills/pay", corsMiddleware(handlePayBill))
-	http.HandleFunc("/bills/update", corsMiddleware(handleUpdateBill))
-	http.HandleFunc("/bills/delete", corsMiddleware(handleDeleteBill))
+	http.HandleFunc("/bills/add", corsMiddleware(common.WithIdempotency(db, handleAddBill)))
+	http.HandleFunc("/bills/pay", corsMiddleware(common.WithIdempotency(db, handlePayBill)))
+	http.HandleFunc("/bills/occurrence/amount", corsMiddleware(common.WithIdempotency(db, handleSetOccurrenceAmount)))
+	http.HandleFunc("/bills/update", corsMiddleware(common.WithIdempotency(db, handleUpdateBill)))
+	http.HandleFunc("/bills/delete", corsMiddleware(common.WithIdempotency(db, handleDeleteBill)))
 	http.HandleFunc("/bills/upcoming", corsMiddleware(handleGetUpcomingBills))
 
+	// Keeps the overdue flags current for users who are not reading their bills
+	go runOverdueJob(context.Background(), overdueCheckInterval)
+
 	fmt.Println("Bills Management service started on :8091")
 	log.Fatal(http.ListenAndServe(":8091", nil))
 }
@@ -134,6 +171,7 @@ func createTablesIfNotExist() {
 	CREATE TABLE IF NOT EXISTS bill_payments (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		bill_id INTEGER NOT NULL,
+		user_id TEXT NOT NULL,
 		year_month TEXT NOT NULL,
 		paid BOOLEAN DEFAULT 0,
 		payment_date TEXT,
@@ -151,6 +189,19 @@ func createTablesIfNotExist() {
 	// Add bill_id column to expenses if it doesn't exist
 	alterExpensesTable := `ALTER TABLE expenses ADD COLUMN bill_id INTEGER;`
 	db.Exec(alterExpensesTable) // Ignore error if column already exists
+
+	// Each payment of a period, partial or not, is an expense linked to the period's bill_payments row
+	alterExpensesPayment := `ALTER TABLE expenses ADD COLUMN bill_payment_id INTEGER;`
+	db.Exec(alterExpensesPayment) // Ignore error if column already exists
+
+	// Bill payment expenses are linked to their category like any other expense
+	if err := common.EnsureCategoryIDColumn(db, "expenses"); err != nil {
+		log.Printf("Error adding category_id column to expenses: %v", err)
+	}
+
+	// Add version column used for optimistic concurrency on updates
+	alterBillsVersion := `ALTER TABLE bills ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`
+	db.Exec(alterBillsVersion) // Ignore error if column already exists
 }
 
 // Basic handlers
@@ -161,6 +212,7 @@ func handleFetchBills(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	refreshBillOccurrences(userID)
 	bills, err := fetchBills(userID)
 	if err != nil {
 		sendErrorResponse(w, "Error fetching bills", http.StatusInternalServerError)
@@ -183,12 +235,15 @@ func handleAddBill(w http.ResponseWriter, r *http.Request) {
 		Amount         float64 `json:"amount"`
 		DueDate        string  `json:"due_date"`
 		StartDate      string  `json:"start_date"`
-		PaymentDay     int     `json:"payment_day"`
+		PaymentDay     int     `json:"payment_day"` // -1 for the last day of the month
 		DurationMonths int     `json:"duration_months"`
-		Regularity     string  `json:"regularity"`
+		OpenEnded      bool    `json:"open_ended"` // The bill repeats until it is deleted
+		Regularity     string  `json:"regularity"` // Preset (weekly ... annual) or an RRULE
 		Category       string  `json:"category"`
 		Icon           string  `json:"icon"`
 		PaymentMethod  string  `json:"payment_method"`
+		// "following", "preceding" or "modified_following" to move due dates off weekends
+		BusinessDayAdjustment string `json:"business_day_adjustment"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&addRequest)
@@ -230,32 +285,54 @@ func handleAddBill(w http.ResponseWriter, r *http.Request) {
 		addRequest.StartDate = addRequest.DueDate
 	}
 	if addRequest.PaymentDay == 0 {
-		addRequest.PaymentDay = 1
-	}
-	if addRequest.DurationMonths == 0 {
-		addRequest.DurationMonths = 1
+		if startDate, err := time.Parse("2006-01-02", addRequest.StartDate); err == nil {
+			addRequest.PaymentDay = startDate.Day()
+		} else {
+			addRequest.PaymentDay = 1
+		}
 	}
 	if addRequest.Regularity == "" {
 		addRequest.Regularity = "monthly"
 	}
-
-	// Insert into database
-	result, err := db.Exec(`
-		INSERT INTO bills (user_id, name, amount, due_date, paid, overdue, overdue_days, recurring, category, icon, start_date, payment_day, duration_months, regularity, payment_method)
-		VALUES (?, ?, ?, ?, 0, 0, 0, 1, ?, ?, ?, ?, ?, ?, ?)
-	`, addRequest.UserID, addRequest.Name, addRequest.Amount, addRequest.DueDate, addRequest.Category, addRequest.Icon, addRequest.StartDate, addRequest.PaymentDay, addRequest.DurationMonths, addRequest.Regularity, addRequest.PaymentMethod)
-
-	if err != nil {
-		log.Printf("Error adding bill: %v", err)
-		sendErrorResponse(w, "Error adding bill", http.StatusInternalServerError)
+	if addRequest.OpenEnded {
+		addRequest.DurationMonths = 0
+	} else if addRequest.DurationMonths == 0 {
+		// Rules with COUNT or UNTIL end by themselves
+		if rule, err := common.ParseRecurrence(addRequest.Regularity); err != nil || !rule.Bounded() {
+			addRequest.DurationMonths = 1
+		}
+	}
+	if _, err := common.BillSchedule(addRequest.StartDate, addRequest.PaymentDay, addRequest.DurationMonths,
+		addRequest.Regularity, addRequest.BusinessDayAdjustment); err != nil {
+		sendErrorResponse(w, "Invalid schedule: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Get the ID of the newly created bill
-	billID, err := result.LastInsertId()
+	// Insert the bill, its first payments and its event in one transaction
+	var billID int64
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(`
+			INSERT INTO bills (user_id, name, amount, due_date, paid, overdue, overdue_days, recurring, category, icon, start_date, payment_day, duration_months, regularity, payment_method, business_day_adjustment, scheduled)
+			VALUES (?, ?, ?, ?, 0, 0, 0, 1, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+		`, addRequest.UserID, addRequest.Name, addRequest.Amount, addRequest.DueDate, addRequest.Category, addRequest.Icon, addRequest.StartDate, addRequest.PaymentDay, addRequest.DurationMonths, addRequest.Regularity, addRequest.PaymentMethod, addRequest.BusinessDayAdjustment)
+		if err != nil {
+			return fmt.Errorf("error inserting bill: %v", err)
+		}
+
+		// Get the ID of the newly created bill
+		if billID, err = result.LastInsertId(); err != nil {
+			return fmt.Errorf("error getting bill ID: %v", err)
+		}
+
+		// Payments are created up to the expansion horizon and reserve their amount
+		if err := common.ExpandBill(tx, billID, common.BillHorizon(tx, addRequest.UserID)); err != nil {
+			return err
+		}
+		return common.PublishEvent(tx, common.EventBillCreated, addRequest.UserID, billID, addRequest)
+	})
 	if err != nil {
-		log.Printf("Error getting bill ID: %v", err)
-		sendErrorResponse(w, "Error getting bill ID", http.StatusInternalServerError)
+		log.Printf("Error adding bill: %v", err)
+		sendErrorResponse(w, "Error adding bill", common.TxErrorStatus(err))
 		return
 	}
 
@@ -277,15 +354,14 @@ func handleAddBill(w http.ResponseWriter, r *http.Request) {
 		"overdue":         false,
 		"overdue_days":    0,
 		"recurring":       true,
+		"scheduled":       true,
+
+		"business_day_adjustment": addRequest.BusinessDayAdjustment,
 	}
 
 	sendSuccessResponse(w, "Bill added successfully", billData)
 }
 
-func handlePayBill(w http.ResponseWriter, r *http.Request) {
-	sendSuccessResponse(w, "Pay bill endpoint available", map[string]string{"status": "available"})
-}
-
 func handleUpdateBill(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -309,11 +385,127 @@ func handleUpdateBill(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sendSuccessResponse(w, "Bill update endpoint working", map[string]interface{}{
-		"bill_id": updateRequest.BillID,
-		"user_id": updateRequest.UserID,
-		"status":  "endpoint_active",
+	// Optional precondition from If-Match or the version field
+	expectedVersion, hasPrecondition, err := common.ExpectedVersion(r, updateRequest.Version)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bill, err := fetchBillByID(updateRequest.BillID, updateRequest.UserID)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Bill not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching bill: %v", err)
+		sendErrorResponse(w, "Error fetching bill", http.StatusInternalServerError)
+		return
+	}
+
+	if hasPrecondition && bill.Version != expectedVersion {
+		sendConflictResponse(w, bill)
+		return
+	}
+
+	// Only overwrite the fields provided in the request
+	if updateRequest.Name != "" {
+		bill.Name = updateRequest.Name
+	}
+	if updateRequest.Amount > 0 {
+		bill.Amount = updateRequest.Amount
+	}
+	if updateRequest.DueDate != "" {
+		bill.DueDate = updateRequest.DueDate
+	}
+	if updateRequest.StartDate != "" {
+		bill.StartDate = updateRequest.StartDate
+	}
+	if updateRequest.PaymentDay != 0 {
+		bill.PaymentDay = updateRequest.PaymentDay
+	}
+	if updateRequest.DurationMonths > 0 {
+		bill.DurationMonths = updateRequest.DurationMonths
+	}
+	if updateRequest.OpenEnded {
+		bill.DurationMonths = 0
+	}
+	if updateRequest.Regularity != "" {
+		bill.Regularity = updateRequest.Regularity
+	}
+	if updateRequest.BusinessDayAdjustment != nil {
+		bill.BusinessDayAdjustment = *updateRequest.BusinessDayAdjustment
+	}
+	if updateRequest.Category != "" {
+		bill.Category = updateRequest.Category
+	}
+	if updateRequest.Icon != "" {
+		bill.Icon = updateRequest.Icon
+	}
+	if updateRequest.PaymentMethod != "" {
+		if updateRequest.PaymentMethod != "cash" && updateRequest.PaymentMethod != "bank" {
+			sendErrorResponse(w, "Valid payment method (cash or bank) is required", http.StatusBadRequest)
+			return
+		}
+		bill.PaymentMethod = updateRequest.PaymentMethod
+	}
+	if _, err := billSchedule(*bill); err != nil {
+		sendErrorResponse(w, "Invalid schedule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The bill and the reservations of its pending payments change together
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(`
+			UPDATE bills
+			SET name = ?, amount = ?, due_date = ?, start_date = ?, payment_day = ?, duration_months = ?,
+			    regularity = ?, category = ?, icon = ?, payment_method = ?, business_day_adjustment = ?,
+			    version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ? AND user_id = ? AND (? = 0 OR COALESCE(version, 1) = ?)
+		`, bill.Name, bill.Amount, bill.DueDate, bill.StartDate, bill.PaymentDay, bill.DurationMonths,
+			bill.Regularity, bill.Category, bill.Icon, bill.PaymentMethod, bill.BusinessDayAdjustment,
+			bill.ID, bill.UserID, expectedVersion, expectedVersion)
+		if err != nil {
+			return fmt.Errorf("error updating bill: %v", err)
+		}
+		if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+			return sql.ErrNoRows
+		}
+
+		// Pending payments follow the new schedule and reserve the new amount and method
+		if bill.Scheduled {
+			if err := common.RescheduleBill(tx, bill.UserID, int64(bill.ID), common.BillHorizon(tx, bill.UserID)); err != nil {
+				return fmt.Errorf("error rescheduling bill payments: %v", err)
+			}
+		} else if err := common.ReserveBillPayments(tx, bill.UserID, int64(bill.ID)); err != nil {
+			return fmt.Errorf("error updating bill reservations in balances: %v", err)
+		}
+		return common.PublishEvent(tx, common.EventBillUpdated, bill.UserID, int64(bill.ID), bill)
 	})
+	if err == sql.ErrNoRows {
+		// Another request won the race between our read and our write
+		if current, fetchErr := fetchBillByID(bill.ID, bill.UserID); fetchErr == nil {
+			sendConflictResponse(w, current)
+			return
+		}
+		sendErrorResponse(w, "Bill not found or already deleted", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating bill: %v", err)
+		sendErrorResponse(w, "Error updating bill", common.TxErrorStatus(err))
+		return
+	}
+
+	updatedBill, err := fetchBillByID(bill.ID, bill.UserID)
+	if err != nil {
+		log.Printf("Error fetching updated bill: %v", err)
+		sendSuccessResponse(w, "Bill updated successfully", bill)
+		return
+	}
+
+	w.Header().Set("ETag", updatedBill.ETag)
+	sendSuccessResponse(w, "Bill updated successfully", updatedBill)
 }
 
 func handleDeleteBill(w http.ResponseWriter, r *http.Request) {
@@ -354,33 +546,40 @@ func handleDeleteBill(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete related bill_payments first
-	deletePaymentsQuery := "DELETE FROM bill_payments WHERE bill_id = ?"
-	_, err = db.Exec(deletePaymentsQuery, deleteRequest.BillID)
-	if err != nil {
-		log.Printf("Error deleting bill payments: %v", err)
-		sendErrorResponse(w, "Error deleting bill payments", http.StatusInternalServerError)
-		return
-	}
+	// The bill, its monthly payments and their reservations are removed together
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		// Release the amounts reserved by its monthly payments before deleting them
+		if err := common.ReleaseBillPayments(tx, deleteRequest.UserID, int64(deleteRequest.BillID)); err != nil {
+			return fmt.Errorf("error releasing bill payments from balances: %v", err)
+		}
 
-	// Delete the bill
-	deleteBillQuery := "DELETE FROM bills WHERE id = ? AND user_id = ?"
-	result, err := db.Exec(deleteBillQuery, deleteRequest.BillID, deleteRequest.UserID)
-	if err != nil {
-		log.Printf("Error deleting bill: %v", err)
-		sendErrorResponse(w, "Error deleting bill", http.StatusInternalServerError)
-		return
-	}
+		// Delete related bill_payments first
+		if _, err := tx.Exec("DELETE FROM bill_payments WHERE bill_id = ?", deleteRequest.BillID); err != nil {
+			return fmt.Errorf("error deleting bill payments: %v", err)
+		}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		log.Printf("Error getting rows affected: %v", err)
-		sendErrorResponse(w, "Error verifying deletion", http.StatusInternalServerError)
+		// Delete the bill
+		result, err := tx.Exec("DELETE FROM bills WHERE id = ? AND user_id = ?", deleteRequest.BillID, deleteRequest.UserID)
+		if err != nil {
+			return fmt.Errorf("error deleting bill: %v", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("error verifying deletion: %v", err)
+		}
+		if rowsAffected == 0 {
+			return sql.ErrNoRows
+		}
+		return common.PublishEvent(tx, common.EventBillDeleted, deleteRequest.UserID, int64(deleteRequest.BillID),
+			map[string]interface{}{"bill_id": deleteRequest.BillID})
+	})
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Bill not found or already deleted", http.StatusNotFound)
 		return
 	}
-
-	if rowsAffected == 0 {
-		sendErrorResponse(w, "Bill not found or already deleted", http.StatusNotFound)
+	if err != nil {
+		log.Printf("Error deleting bill: %v", err)
+		sendErrorResponse(w, "Error deleting bill", common.TxErrorStatus(err))
 		return
 	}
 
@@ -391,10 +590,6 @@ func handleDeleteBill(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func handleGetUpcomingBills(w http.ResponseWriter, r *http.Request) {
-	sendSuccessResponse(w, "Upcoming bills endpoint available", map[string]string{"status": "available"})
-}
-
 // Helper functions
 func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
@@ -406,6 +601,19 @@ func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// sendConflictResponse returns 409 with the current server copy of a stale update
+func sendConflictResponse(w http.ResponseWriter, current *Bill) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", current.ETag)
+	w.WriteHeader(http.StatusConflict)
+	response := ApiResponse{
+		Success: false,
+		Message: "Bill was modified by another request",
+		Data:    current,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
 func sendSuccessResponse(w http.ResponseWriter, message string, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	response := ApiResponse{
@@ -416,12 +624,43 @@ func sendSuccessResponse(w http.ResponseWriter, message string, data interface{}
 	json.NewEncoder(w).Encode(response)
 }
 
-func fetchBills(userID string) ([]Bill, error) {
-	query := `
-		SELECT id, user_id, name, amount, COALESCE(due_date, start_date), start_date, payment_day, 
+// billColumns is the column list shared by every bill query, in scanBill order
+const billColumns = `id, user_id, name, amount, COALESCE(due_date, start_date), start_date, payment_day, 
 		       duration_months, regularity, paid, overdue, overdue_days, 
 		       recurring, category, icon, COALESCE(payment_method, 'cash'), 
-		       COALESCE(created_at, ''), COALESCE(updated_at, '')
+		       COALESCE(business_day_adjustment, ''), COALESCE(scheduled, 0),
+		       COALESCE(created_at, ''), COALESCE(updated_at, ''), COALESCE(version, 1)`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBill(row rowScanner) (Bill, error) {
+	var bill Bill
+	err := row.Scan(
+		&bill.ID, &bill.UserID, &bill.Name, &bill.Amount, &bill.DueDate,
+		&bill.StartDate, &bill.PaymentDay, &bill.DurationMonths, &bill.Regularity,
+		&bill.Paid, &bill.Overdue, &bill.OverdueDays, &bill.Recurring,
+		&bill.Category, &bill.Icon, &bill.PaymentMethod, &bill.BusinessDayAdjustment, &bill.Scheduled,
+		&bill.CreatedAt, &bill.UpdatedAt,
+		&bill.Version,
+	)
+	bill.ETag = common.ETag(bill.Version)
+	return bill, err
+}
+
+func fetchBillByID(billID int, userID string) (*Bill, error) {
+	row := db.QueryRow(`SELECT `+billColumns+` FROM bills WHERE id = ? AND user_id = ?`, billID, userID)
+	bill, err := scanBill(row)
+	if err != nil {
+		return nil, err
+	}
+	return &bill, nil
+}
+
+func fetchBills(userID string) ([]Bill, error) {
+	query := `
+		SELECT ` + billColumns + `
 		FROM bills 
 		WHERE user_id = ? 
 		ORDER BY id ASC
@@ -435,13 +674,7 @@ func fetchBills(userID string) ([]Bill, error) {
 
 	var bills []Bill
 	for rows.Next() {
-		var bill Bill
-		err := rows.Scan(
-			&bill.ID, &bill.UserID, &bill.Name, &bill.Amount, &bill.DueDate,
-			&bill.StartDate, &bill.PaymentDay, &bill.DurationMonths, &bill.Regularity,
-			&bill.Paid, &bill.Overdue, &bill.OverdueDays, &bill.Recurring,
-			&bill.Category, &bill.Icon, &bill.PaymentMethod, &bill.CreatedAt, &bill.UpdatedAt,
-		)
+		bill, err := scanBill(rows)
 		if err != nil {
 			log.Printf("Error scanning bill: %v", err)
 			continue
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// How often the payments and overdue flags of every user's bills are refreshed. Each user's
+// day starts at a different time depending on their time zone, so this runs hourly rather than daily.
+const overdueCheckInterval = time.Hour
+
+// runOverdueJob refreshes every user's bills each interval until ctx is cancelled, starting
+// right away so bills that fell due while the service was down are flagged on start. Reading
+// bills refreshes them too; this keeps them current for users who are not reading them, and
+// for the services that only read the stored rows.
+func runOverdueJob(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := refreshAllBills(); err != nil {
+			log.Printf("Error refreshing overdue bills: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshAllBills runs refreshBillOccurrences for every user with unpaid bills or with bills
+// still flagged as overdue
+func refreshAllBills() error {
+	rows, err := db.Query(`SELECT DISTINCT user_id FROM bills WHERE paid = 0 OR overdue = 1`)
+	if err != nil {
+		return fmt.Errorf("error fetching users with unpaid bills: %v", err)
+	}
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning user: %v", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error fetching users with unpaid bills: %v", err)
+	}
+
+	for _, userID := range userIDs {
+		refreshBillOccurrences(userID)
+	}
+	return nil
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+// PayBillRequest pays one occurrence of a bill, in full or in part
+type PayBillRequest struct {
+	UserID        string  `json:"user_id"`
+	BillID        int     `json:"bill_id"`
+	YearMonth     string  `json:"year_month,omitempty"`     // Occurrence key to pay, defaults to the oldest unpaid one
+	Amount        float64 `json:"amount,omitempty"`         // Defaults to what is left; less leaves the occurrence partially paid
+	PaymentMethod string  `json:"payment_method,omitempty"` // "cash" or "bank", defaults to the bill's
+	PaymentDate   string  `json:"payment_date,omitempty"`   // Defaults to today in the user's time zone
+	Description   string  `json:"description,omitempty"`
+}
+
+// OccurrenceBalance is what is due and what has been paid of one occurrence of a bill. The
+// occurrence counts as paid once the payments cover the amount due.
+type OccurrenceBalance struct {
+	AmountDue       float64 `json:"amount_due"`
+	PaidAmount      float64 `json:"paid_amount"`
+	RemainingAmount float64 `json:"remaining_amount"`
+	OccurrencePaid  bool    `json:"occurrence_paid"`
+}
+
+// BillPaymentResult is returned by /bills/pay
+type BillPaymentResult struct {
+	Bill          *Bill   `json:"bill"`
+	YearMonth     string  `json:"year_month"`
+	PaymentDate   string  `json:"payment_date"`
+	PaymentMethod string  `json:"payment_method"`
+	Amount        float64 `json:"amount"` // Amount of this payment
+	ExpenseID     int64   `json:"expense_id"`
+	OccurrenceBalance
+}
+
+// OccurrenceAmountRequest sets the amount of one occurrence of a bill, e.g. this month's
+// electricity bill, instead of the bill's amount
+type OccurrenceAmountRequest struct {
+	UserID    string   `json:"user_id"`
+	BillID    int      `json:"bill_id"`
+	YearMonth string   `json:"year_month"`
+	Amount    *float64 `json:"amount"` // null goes back to the bill's amount
+}
+
+// OccurrenceAmountResult is returned by /bills/occurrence/amount
+type OccurrenceAmountResult struct {
+	BillID    int    `json:"bill_id"`
+	YearMonth string `json:"year_month"`
+	OccurrenceBalance
+}
+
+// UpcomingBill is one unpaid occurrence of a bill
+type UpcomingBill struct {
+	BillID        int     `json:"bill_id"`
+	Name          string  `json:"name"`
+	Category      string  `json:"category"`
+	Icon          string  `json:"icon"`
+	Amount        float64 `json:"amount"` // What is left to pay
+	AmountDue     float64 `json:"amount_due"`
+	PaidAmount    float64 `json:"paid_amount"`
+	YearMonth     string  `json:"year_month"`
+	DueDate       string  `json:"due_date"`
+	PaymentMethod string  `json:"payment_method"`
+	Overdue       bool    `json:"overdue"`
+	OverdueDays   int     `json:"overdue_days"`
+	DaysUntilDue  int     `json:"days_until_due"`
+}
+
+// UpcomingBillsResult lists the unpaid occurrences due up to the end of the window, overdue ones first
+type UpcomingBillsResult struct {
+	Bills        []UpcomingBill `json:"bills"`
+	TotalAmount  float64        `json:"total_amount"`
+	OverdueCount int            `json:"overdue_count"`
+	Until        string         `json:"until"`
+}
+
+// Default number of days ahead covered by /bills/upcoming
+const defaultUpcomingDays = 30
+
+var errPeriodOutsideSchedule = fmt.Errorf("period is outside the bill's schedule")
+
+func handlePayBill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payRequest PayBillRequest
+	if err := json.NewDecoder(r.Body).Decode(&payRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if payRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if payRequest.BillID <= 0 {
+		sendErrorResponse(w, "Valid bill ID is required", http.StatusBadRequest)
+		return
+	}
+	if payRequest.PaymentMethod != "" && payRequest.PaymentMethod != "cash" && payRequest.PaymentMethod != "bank" {
+		sendErrorResponse(w, "Valid payment method (cash or bank) is required", http.StatusBadRequest)
+		return
+	}
+	if payRequest.Amount < 0 {
+		sendErrorResponse(w, "Amount must be greater than 0", http.StatusBadRequest)
+		return
+	}
+	if payRequest.YearMonth != "" && !validOccurrenceKey(payRequest.YearMonth) {
+		sendErrorResponse(w, "Invalid year_month format. Use YYYY-MM, or YYYY-MM-DD for weekly bills", http.StatusBadRequest)
+		return
+	}
+	if payRequest.PaymentDate == "" {
+		payRequest.PaymentDate = common.UserToday(db, payRequest.UserID)
+	}
+	paymentDate, err := time.Parse("2006-01-02", payRequest.PaymentDate)
+	if err != nil {
+		sendErrorResponse(w, "Invalid payment date format. Use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	bill, err := fetchBillByID(payRequest.BillID, payRequest.UserID)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Bill not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching bill: %v", err)
+		sendErrorResponse(w, "Error fetching bill", http.StatusInternalServerError)
+		return
+	}
+	schedule, err := billSchedule(*bill)
+	if err != nil {
+		log.Printf("Error reading schedule of bill %d: %v", bill.ID, err)
+		sendErrorResponse(w, "Bill has an invalid schedule", http.StatusUnprocessableEntity)
+		return
+	}
+
+	paymentMethod := payRequest.PaymentMethod
+	if paymentMethod == "" {
+		paymentMethod = bill.PaymentMethod
+	}
+	if paymentMethod != "cash" && paymentMethod != "bank" {
+		sendErrorResponse(w, "Valid payment method (cash or bank) is required", http.StatusBadRequest)
+		return
+	}
+	description := payRequest.Description
+	if description == "" {
+		description = fmt.Sprintf("Bill payment: %s", bill.Name)
+	}
+
+	result := BillPaymentResult{
+		YearMonth:     payRequest.YearMonth,
+		PaymentDate:   payRequest.PaymentDate,
+		PaymentMethod: paymentMethod,
+	}
+
+	// The period, its expense and the balances change together
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		// Statement and loan bills are paid where the statement or the installment is settled too
+		if err := common.CheckBillPayableDirectly(tx, bill.ID, bill.UserID); err != nil {
+			return err
+		}
+
+		var err error
+		if result.YearMonth, err = resolveOccurrence(tx, bill, schedule, result.YearMonth); err != nil {
+			return err
+		}
+
+		// Release what this payment covers of the amount reserved for the period. The period
+		// stays unpaid until the payments cover its amount.
+		payment, err := common.PayBillOccurrenceTx(tx, bill.ID, bill.UserID, result.YearMonth, payRequest.Amount,
+			result.PaymentDate, paymentMethod)
+		if err != nil {
+			return err
+		}
+		result.Amount = payment.Amount
+		result.OccurrenceBalance = occurrenceBalance(payment)
+
+		// Paying an overdue period changes how late the bill is, or clears it
+		if _, err := common.RefreshBillOverdue(tx, bill.UserID); err != nil {
+			return fmt.Errorf("error updating overdue status: %v", err)
+		}
+
+		// Bills created in a batch count as spent on their due date; the expense replaces that entry
+		if err := common.RemoveLedgerEntries(tx, bill.UserID, common.LedgerSourceBill, int64(bill.ID)); err != nil {
+			return fmt.Errorf("error updating balances: %v", err)
+		}
+
+		// The money actually leaves the account as an expense linked to the bill and, like
+		// any other expense, to its category
+		categoryID, err := common.ResolveCategoryID(tx, bill.UserID, "expense", bill.Category)
+		if err != nil {
+			return err
+		}
+		expenseResult, err := tx.Exec(`
+			INSERT INTO expenses (user_id, amount, date, category, category_id, payment_method, description, bill_id, bill_payment_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, bill.UserID, result.Amount, result.PaymentDate, bill.Category, categoryID, paymentMethod, description, bill.ID, payment.PaymentID)
+		if err != nil {
+			return fmt.Errorf("error creating bill expense: %v", err)
+		}
+		if result.ExpenseID, err = expenseResult.LastInsertId(); err != nil {
+			return fmt.Errorf("error getting expense ID: %v", err)
+		}
+		err = common.ReplaceLedgerEntries(tx, bill.UserID, common.LedgerSourceExpense, result.ExpenseID, common.LedgerEntry{
+			Date: paymentDate, Kind: common.LedgerExpense, PaymentMethod: paymentMethod, Amount: result.Amount,
+		})
+		if err != nil {
+			return fmt.Errorf("error updating balances: %v", err)
+		}
+
+		return common.PublishEvent(tx, common.EventExpenseCreated, bill.UserID, result.ExpenseID, map[string]interface{}{
+			"amount":         result.Amount,
+			"date":           result.PaymentDate,
+			"category":       bill.Category,
+			"payment_method": paymentMethod,
+			"description":    description,
+			"bill_id":        bill.ID,
+		})
+	})
+	switch {
+	case err == common.ErrBillAlreadyPaid:
+		sendErrorResponse(w, "Bill is already paid for this period", http.StatusConflict)
+		return
+	case err == common.ErrStatementBill || err == common.ErrLoanBill:
+		sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	case err == common.ErrBillOverpayment:
+		sendErrorResponse(w, "Amount exceeds what is left to pay for this period", http.StatusUnprocessableEntity)
+		return
+	case err == errPeriodOutsideSchedule:
+		sendErrorResponse(w, "Period is outside the bill's schedule", http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("Error paying bill %d: %v", bill.ID, err)
+		sendErrorResponse(w, "Error paying bill", common.TxErrorStatus(err))
+		return
+	}
+
+	if result.Bill, err = fetchBillByID(bill.ID, bill.UserID); err != nil {
+		log.Printf("Error fetching paid bill: %v", err)
+		result.Bill = bill
+	}
+	log.Printf("Bill %d paid for %s with %s: %.2f, %.2f left", bill.ID, result.YearMonth, paymentMethod,
+		result.Amount, result.RemainingAmount)
+	if !result.OccurrencePaid {
+		sendSuccessResponse(w, "Bill partially paid successfully", result)
+		return
+	}
+	sendSuccessResponse(w, "Bill paid successfully", result)
+}
+
+// handleSetOccurrenceAmount changes the amount due of one occurrence of a bill. If what has
+// already been paid covers the new amount, the occurrence becomes paid.
+func handleSetOccurrenceAmount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req OccurrenceAmountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if req.BillID <= 0 {
+		sendErrorResponse(w, "Valid bill ID is required", http.StatusBadRequest)
+		return
+	}
+	if !validOccurrenceKey(req.YearMonth) {
+		sendErrorResponse(w, "Invalid year_month format. Use YYYY-MM, or YYYY-MM-DD for weekly bills", http.StatusBadRequest)
+		return
+	}
+	if req.Amount != nil && *req.Amount <= 0 {
+		sendErrorResponse(w, "Amount must be greater than 0", http.StatusBadRequest)
+		return
+	}
+
+	bill, err := fetchBillByID(req.BillID, req.UserID)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Bill not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching bill: %v", err)
+		sendErrorResponse(w, "Error fetching bill", http.StatusInternalServerError)
+		return
+	}
+	schedule, err := billSchedule(*bill)
+	if err != nil {
+		log.Printf("Error reading schedule of bill %d: %v", bill.ID, err)
+		sendErrorResponse(w, "Bill has an invalid schedule", http.StatusUnprocessableEntity)
+		return
+	}
+
+	result := OccurrenceAmountResult{BillID: bill.ID, YearMonth: req.YearMonth}
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		// The amount of a statement or loan bill follows the statement or the installment
+		if err := common.CheckBillPayableDirectly(tx, bill.ID, bill.UserID); err != nil {
+			return err
+		}
+		if _, err := resolveOccurrence(tx, bill, schedule, req.YearMonth); err != nil {
+			return err
+		}
+		payment, err := common.SetBillOccurrenceAmountTx(tx, bill.ID, bill.UserID, req.YearMonth, req.Amount,
+			common.UserToday(tx, bill.UserID))
+		if err != nil {
+			return err
+		}
+		result.OccurrenceBalance = occurrenceBalance(payment)
+		// Lowering the amount of an overdue period can settle it
+		_, err = common.RefreshBillOverdue(tx, bill.UserID)
+		return err
+	})
+	switch {
+	case err == common.ErrBillAlreadyPaid:
+		sendErrorResponse(w, "Bill is already paid for this period", http.StatusConflict)
+		return
+	case err == common.ErrStatementBill || err == common.ErrLoanBill:
+		sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	case err == errPeriodOutsideSchedule:
+		sendErrorResponse(w, "Period is outside the bill's schedule", http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("Error setting the amount of bill %d for %s: %v", bill.ID, req.YearMonth, err)
+		sendErrorResponse(w, "Error updating bill amount", common.TxErrorStatus(err))
+		return
+	}
+
+	sendSuccessResponse(w, "Bill amount updated successfully", result)
+}
+
+// resolveOccurrence returns the key of the occurrence to pay or change: key if it is in the
+// bill's schedule, or the oldest unpaid occurrence if key is empty. Scheduled bills create
+// missing payments themselves; older bills get the row here, on first use.
+func resolveOccurrence(tx *sql.Tx, bill *Bill, schedule common.Schedule, key string) (string, error) {
+	var occurrence common.Occurrence
+	var ok bool
+	if key == "" {
+		paid, err := paidPeriods(tx, bill.ID)
+		if err != nil {
+			return "", err
+		}
+		if occurrence, ok = nextUnpaidOccurrence(schedule, paid); !ok {
+			return "", common.ErrBillAlreadyPaid
+		}
+	} else if occurrence, ok = schedule.Find(key); !ok {
+		return "", errPeriodOutsideSchedule
+	}
+
+	if !bill.Scheduled {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO bill_payments (bill_id, user_id, year_month, due_date, paid, payment_method)
+			VALUES (?, ?, ?, ?, 0, ?)
+		`, bill.ID, bill.UserID, occurrence.Key, occurrence.DateString(), bill.PaymentMethod)
+		if err != nil {
+			return "", fmt.Errorf("error creating bill payment record: %v", err)
+		}
+	}
+	return occurrence.Key, nil
+}
+
+func occurrenceBalance(payment common.BillOccurrencePayment) OccurrenceBalance {
+	return OccurrenceBalance{
+		AmountDue:       payment.AmountDue,
+		PaidAmount:      payment.PaidAmount,
+		RemainingAmount: payment.Remaining(),
+		OccurrencePaid:  payment.Paid,
+	}
+}
+
+// validOccurrenceKey reports whether key is a month (YYYY-MM) or, for weekly and daily
+// bills, a date (YYYY-MM-DD)
+func validOccurrenceKey(key string) bool {
+	_, monthErr := time.Parse("2006-01", key)
+	_, dateErr := time.Parse("2006-01-02", key)
+	return monthErr == nil || dateErr == nil
+}
+
+func handleGetUpcomingBills(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	days := defaultUpcomingDays
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			sendErrorResponse(w, "days must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+
+	refreshBillOccurrences(userID)
+	today, _ := time.Parse("2006-01-02", common.UserToday(db, userID))
+	result, err := upcomingBills(userID, today, today.AddDate(0, 0, days))
+	if err != nil {
+		log.Printf("Error fetching upcoming bills: %v", err)
+		sendErrorResponse(w, "Error fetching upcoming bills", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Upcoming bills fetched successfully", result)
+}
+
+// upcomingBills returns every unpaid occurrence of the user's bills due on or before until.
+// Periods due before today are flagged as overdue.
+func upcomingBills(userID string, today, until time.Time) (UpcomingBillsResult, error) {
+	result := UpcomingBillsResult{Bills: []UpcomingBill{}, Until: until.Format("2006-01-02")}
+
+	bills, err := fetchBills(userID)
+	if err != nil {
+		return result, err
+	}
+
+	for _, bill := range bills {
+		if bill.Paid {
+			continue
+		}
+		schedule, err := billSchedule(bill)
+		if err != nil {
+			log.Printf("Skipping bill %d with an invalid schedule: %v", bill.ID, err)
+			continue
+		}
+		paid, err := paidPeriods(db, bill.ID)
+		if err != nil {
+			return result, err
+		}
+		pending, err := pendingPeriods(bill.ID)
+		if err != nil {
+			return result, err
+		}
+
+		for _, occurrence := range schedule.Occurrences(time.Time{}, until) {
+			yearMonth, due := occurrence.Key, occurrence.Date
+			if paid[yearMonth] {
+				continue
+			}
+
+			upcoming := UpcomingBill{
+				BillID:        bill.ID,
+				Name:          bill.Name,
+				Category:      bill.Category,
+				Icon:          bill.Icon,
+				AmountDue:     bill.Amount,
+				YearMonth:     yearMonth,
+				DueDate:       due.Format("2006-01-02"),
+				PaymentMethod: bill.PaymentMethod,
+				DaysUntilDue:  int(due.Sub(today).Hours() / 24),
+			}
+			if period, ok := pending[yearMonth]; ok {
+				if period.paymentMethod != "" {
+					upcoming.PaymentMethod = period.paymentMethod
+				}
+				if period.amount.Valid {
+					upcoming.AmountDue = period.amount.Float64
+				}
+				upcoming.PaidAmount = period.paidAmount
+			}
+			upcoming.Amount = math.Max(upcoming.AmountDue-upcoming.PaidAmount, 0)
+			if due.Before(today) {
+				upcoming.Overdue = true
+				upcoming.OverdueDays = -upcoming.DaysUntilDue
+				result.OverdueCount++
+			}
+			result.Bills = append(result.Bills, upcoming)
+			result.TotalAmount += upcoming.Amount
+		}
+	}
+
+	sort.SliceStable(result.Bills, func(i, j int) bool {
+		return result.Bills[i].DueDate < result.Bills[j].DueDate
+	})
+	return result, nil
+}
+
+// billSchedule builds the recurrence of a bill. Bills created before schedules existed
+// always have at least one payment, so their duration is never open-ended.
+func billSchedule(bill Bill) (common.Schedule, error) {
+	start := bill.StartDate
+	if start == "" {
+		start = bill.DueDate
+	}
+	months := bill.DurationMonths
+	if !bill.Scheduled && months < 1 {
+		months = 1
+	}
+	return common.BillSchedule(start, bill.PaymentDay, months, bill.Regularity, bill.BusinessDayAdjustment)
+}
+
+// nextUnpaidOccurrence returns the oldest occurrence not yet paid, or false if all are
+func nextUnpaidOccurrence(schedule common.Schedule, paid map[string]bool) (common.Occurrence, bool) {
+	var next common.Occurrence
+	found := false
+	schedule.Walk(func(occurrence common.Occurrence) bool {
+		if !paid[occurrence.Key] {
+			next, found = occurrence, true
+		}
+		return !found
+	})
+	return next, found
+}
+
+// refreshBillOccurrences creates the payments of the user's scheduled bills up to the horizon
+// and brings their overdue flags up to date before they are read. A failure only delays them,
+// so it is logged and the read goes on.
+func refreshBillOccurrences(userID string) {
+	err := common.WithTx(db, func(tx *sql.Tx) error {
+		if err := common.ExpandBillOccurrences(tx, userID, common.BillHorizon(tx, userID)); err != nil {
+			return err
+		}
+		_, err := common.RefreshBillOverdue(tx, userID)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error refreshing bill payments for user %s: %v", userID, err)
+	}
+}
+
+// paidPeriods returns the periods of the bill that are already paid
+func paidPeriods(q common.DBTX, billID int) (map[string]bool, error) {
+	rows, err := q.Query(`SELECT year_month FROM bill_payments WHERE bill_id = ? AND paid = 1`, billID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching bill payments: %v", err)
+	}
+	defer rows.Close()
+
+	paid := map[string]bool{}
+	for rows.Next() {
+		var yearMonth string
+		if err := rows.Scan(&yearMonth); err != nil {
+			return nil, fmt.Errorf("error scanning bill payment: %v", err)
+		}
+		paid[yearMonth] = true
+	}
+	return paid, rows.Err()
+}
+
+// pendingPeriod is what is stored for an unpaid period of a bill
+type pendingPeriod struct {
+	paymentMethod string
+	amount        sql.NullFloat64 // The period's own amount, if it differs from the bill's
+	paidAmount    float64         // Partial payments so far
+}
+
+// pendingPeriods returns the stored payment method and amounts of each pending period of the bill
+func pendingPeriods(billID int) (map[string]pendingPeriod, error) {
+	rows, err := db.Query(`
+		SELECT year_month, COALESCE(payment_method, ''), amount, COALESCE(paid_amount, 0)
+		FROM bill_payments WHERE bill_id = ? AND paid = 0
+	`, billID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching bill payments: %v", err)
+	}
+	defer rows.Close()
+
+	periods := map[string]pendingPeriod{}
+	for rows.Next() {
+		var yearMonth string
+		var period pendingPeriod
+		if err := rows.Scan(&yearMonth, &period.paymentMethod, &period.amount, &period.paidAmount); err != nil {
+			return nil, fmt.Errorf("error scanning bill payment: %v", err)
+		}
+		periods[yearMonth] = period
+	}
+	return periods, rows.Err()
+}
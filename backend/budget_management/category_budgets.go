@@ -0,0 +1,408 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+// CategoryBudgetRequest sets the limit of an expense category for a period type.
+// A zero or negative amount removes the limit.
+type CategoryBudgetRequest struct {
+	UserID     string  `json:"user_id"`
+	CategoryID int     `json:"category_id"`
+	Period     string  `json:"period"` // daily, weekly, monthly, quarterly, semiannual, annual
+	Amount     float64 `json:"amount"`
+}
+
+// CategoryBudgetProgress is the status of a category with a limit in the requested period.
+// A category's spending includes that of its subcategories.
+type CategoryBudgetProgress struct {
+	CategoryID          int     `json:"category_id"`
+	Name                string  `json:"name"`
+	Emoji               string  `json:"emoji"`
+	ParentID            int     `json:"parent_id,omitempty"`
+	Limit               float64 `json:"limit"`
+	Spent               float64 `json:"spent"`
+	Remaining           float64 `json:"remaining"`
+	PercentUsed         float64 `json:"percent_used"`
+	DailyRate           float64 `json:"daily_rate"`
+	Projected           float64 `json:"projected"` // Estimated spending at the end of the period at the current daily pace
+	OverBudget          bool    `json:"over_budget"`
+	ProjectedOverBudget bool    `json:"projected_over_budget"`
+}
+
+type CategoryBudgetsResponse struct {
+	UserID      string                   `json:"user_id"`
+	Period      string                   `json:"period"`
+	StartDate   string                   `json:"start_date"`
+	EndDate     string                   `json:"end_date"`
+	DaysElapsed int                      `json:"days_elapsed"`
+	DaysTotal   int                      `json:"days_total"`
+	TotalLimit  float64                  `json:"total_limit"`
+	TotalSpent  float64                  `json:"total_spent"`
+	Categories  []CategoryBudgetProgress `json:"categories"`
+}
+
+// budgetCategory is an expense category of the user with its direct spending in the period
+type budgetCategory struct {
+	id       int
+	name     string
+	emoji    string
+	parentID int
+	spent    float64
+}
+
+func createCategoryBudgetsTable() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS category_budgets (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			category_id INTEGER NOT NULL,
+			period TEXT NOT NULL,
+			amount REAL NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (user_id, category_id, period)
+		)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create category_budgets table: %v", err)
+	}
+
+	// categories_management adds the hierarchy and the expense links on startup; repeat it
+	// here in case this service starts first (duplicate column errors are ignored)
+	db.Exec(`ALTER TABLE categories ADD COLUMN parent_id INTEGER`)
+	db.Exec(`ALTER TABLE expenses ADD COLUMN category_id INTEGER`)
+}
+
+func handleCategoryBudgets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "monthly"
+	}
+
+	asOf := common.DateOnly(common.UserNow(db, userID))
+	if date := r.URL.Query().Get("date"); date != "" {
+		parsed, err := parseBudgetDate(date)
+		if err != nil {
+			sendErrorResponse(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		asOf = parsed
+	}
+
+	progress, err := fetchCategoryBudgets(userID, period, asOf)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "invalid period") {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error fetching category budgets: %v", err)
+		sendErrorResponse(w, "Error fetching category budgets", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Category budgets fetched successfully", progress)
+}
+
+func handleSetCategoryBudget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var budgetRequest CategoryBudgetRequest
+	if err := json.NewDecoder(r.Body).Decode(&budgetRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if budgetRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if budgetRequest.CategoryID <= 0 {
+		sendErrorResponse(w, "Category ID is required", http.StatusBadRequest)
+		return
+	}
+	if budgetRequest.Period == "" {
+		budgetRequest.Period = "monthly"
+	}
+	if _, _, err := budgetPeriodRange(common.DefaultPeriodSettings, budgetRequest.Period, time.Now()); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var categoryType string
+	err := db.QueryRow(`SELECT type FROM categories WHERE id = ? AND user_id = ?`,
+		budgetRequest.CategoryID, budgetRequest.UserID).Scan(&categoryType)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching category: %v", err)
+		sendErrorResponse(w, "Error fetching category", http.StatusInternalServerError)
+		return
+	}
+	if categoryType != "expense" {
+		sendErrorResponse(w, "Budgets can only be set on expense categories", http.StatusBadRequest)
+		return
+	}
+
+	if budgetRequest.Amount <= 0 {
+		_, err = db.Exec(`DELETE FROM category_budgets WHERE user_id = ? AND category_id = ? AND period = ?`,
+			budgetRequest.UserID, budgetRequest.CategoryID, budgetRequest.Period)
+		if err != nil {
+			log.Printf("Error removing category budget: %v", err)
+			sendErrorResponse(w, "Error removing category budget", http.StatusInternalServerError)
+			return
+		}
+		sendSuccessResponse(w, "Category budget removed", budgetRequest)
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO category_budgets (user_id, category_id, period, amount)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, category_id, period) DO UPDATE SET
+			amount = excluded.amount,
+			updated_at = CURRENT_TIMESTAMP
+	`, budgetRequest.UserID, budgetRequest.CategoryID, budgetRequest.Period, budgetRequest.Amount)
+	if err != nil {
+		log.Printf("Error saving category budget: %v", err)
+		sendErrorResponse(w, "Error saving category budget", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Category budget saved", budgetRequest)
+}
+
+// fetchCategoryBudgets calculates the progress of each category with a limit in the period that contains asOf
+func fetchCategoryBudgets(userID, period string, asOf time.Time) (*CategoryBudgetsResponse, error) {
+	settings, err := common.LoadPeriodSettings(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := budgetPeriodRange(settings, period, asOf)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &CategoryBudgetsResponse{
+		UserID:     userID,
+		Period:     period,
+		StartDate:  start.Format("2006-01-02"),
+		EndDate:    end.Format("2006-01-02"),
+		DaysTotal:  daysBetween(start, end),
+		Categories: []CategoryBudgetProgress{},
+	}
+
+	// Days elapsed, including the requested day
+	today := time.Date(asOf.Year(), asOf.Month(), asOf.Day(), 0, 0, 0, 0, time.UTC)
+	switch {
+	case today.Before(start):
+		response.DaysElapsed = 0
+	case today.After(end):
+		response.DaysElapsed = response.DaysTotal
+	default:
+		response.DaysElapsed = daysBetween(start, today)
+	}
+
+	// Within the period only spending up to the requested day counts, so the projection
+	// uses the same stretch as the days elapsed
+	spentUntil := response.EndDate
+	if !today.After(end) && !today.Before(start) {
+		spentUntil = today.Format("2006-01-02")
+	}
+
+	categories, err := loadBudgetCategories(userID, response.StartDate, spentUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT category_id, amount FROM category_budgets WHERE user_id = ? AND period = ?`, userID, period)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var categoryID int
+		var limit float64
+		if err := rows.Scan(&categoryID, &limit); err != nil {
+			return nil, err
+		}
+		category, ok := categories[categoryID]
+		if !ok {
+			continue
+		}
+
+		item := CategoryBudgetProgress{
+			CategoryID: category.id,
+			Name:       category.name,
+			Emoji:      category.emoji,
+			ParentID:   category.parentID,
+			Limit:      limit,
+			Spent:      roundBudgetAmount(subtreeSpent(categories, categoryID)),
+		}
+		item.Remaining = roundBudgetAmount(item.Limit - item.Spent)
+		if item.Limit > 0 {
+			item.PercentUsed = roundBudgetAmount(item.Spent / item.Limit * 100)
+		}
+		item.Projected = item.Spent
+		if response.DaysElapsed > 0 && response.DaysElapsed < response.DaysTotal {
+			item.DailyRate = roundBudgetAmount(item.Spent / float64(response.DaysElapsed))
+			item.Projected = roundBudgetAmount(item.Spent / float64(response.DaysElapsed) * float64(response.DaysTotal))
+		} else if response.DaysElapsed > 0 {
+			item.DailyRate = roundBudgetAmount(item.Spent / float64(response.DaysElapsed))
+		}
+		item.OverBudget = item.Spent > item.Limit
+		item.ProjectedOverBudget = item.Projected > item.Limit
+
+		response.TotalLimit += item.Limit
+		response.TotalSpent += item.Spent
+		response.Categories = append(response.Categories, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	response.TotalLimit = roundBudgetAmount(response.TotalLimit)
+	response.TotalSpent = roundBudgetAmount(response.TotalSpent)
+	sort.Slice(response.Categories, func(i, j int) bool {
+		return response.Categories[i].PercentUsed > response.Categories[j].PercentUsed
+	})
+	return response, nil
+}
+
+// loadBudgetCategories reads the user's expense categories with the amount spent directly in each
+// one between startDate and endDate. Expenses without a category_id yet are matched by name.
+func loadBudgetCategories(userID, startDate, endDate string) (map[int]*budgetCategory, error) {
+	rows, err := db.Query(`
+		SELECT id, name, emoji, COALESCE(parent_id, 0) FROM categories
+		WHERE user_id = ? AND type = 'expense'
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := map[int]*budgetCategory{}
+	byName := map[string]*budgetCategory{}
+	for rows.Next() {
+		category := &budgetCategory{}
+		if err := rows.Scan(&category.id, &category.name, &category.emoji, &category.parentID); err != nil {
+			return nil, err
+		}
+		category.emoji = decodeBudgetEmoji(category.emoji)
+		categories[category.id] = category
+		if _, exists := byName[strings.ToLower(category.name)]; !exists {
+			byName[strings.ToLower(category.name)] = category
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	spending, err := db.Query(`
+		SELECT COALESCE(category_id, 0), category, COALESCE(SUM(amount), 0) FROM expenses
+		WHERE user_id = ? AND date >= ? AND date <= ?
+		GROUP BY COALESCE(category_id, 0), category
+	`, userID, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+	defer spending.Close()
+
+	for spending.Next() {
+		var categoryID int
+		var name string
+		var amount float64
+		if err := spending.Scan(&categoryID, &name, &amount); err != nil {
+			return nil, err
+		}
+		if category, ok := categories[categoryID]; ok {
+			category.spent += amount
+		} else if category, ok := byName[strings.ToLower(name)]; ok {
+			category.spent += amount
+		}
+	}
+	return categories, spending.Err()
+}
+
+// subtreeSpent adds up the spending of the category and all of its descendants
+func subtreeSpent(categories map[int]*budgetCategory, rootID int) float64 {
+	total := 0.0
+	for id, category := range categories {
+		for current, depth := category, 0; current != nil && depth <= len(categories); depth++ {
+			if current.id == rootID {
+				total += categories[id].spent
+				break
+			}
+			current = categories[current.parentID]
+		}
+	}
+	return total
+}
+
+// budgetPeriodRange returns the first and last day of the period that contains date,
+// using the user's month and week start
+func budgetPeriodRange(settings common.PeriodSettings, period string, date time.Time) (time.Time, time.Time, error) {
+	switch period {
+	case "daily", "weekly", "monthly", "quarterly", "semiannual", "annual":
+		start, end := settings.Range(period, date)
+		return start, end, nil
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid period: %s", period)
+	}
+}
+
+// parseBudgetDate accepts a full date or a month (YYYY-MM)
+func parseBudgetDate(value string) (time.Time, error) {
+	if parsed, err := time.Parse("2006-01-02", value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse("2006-01", value)
+}
+
+// daysBetween counts the days from start to end, both included
+func daysBetween(start, end time.Time) int {
+	return int(end.Sub(start).Hours()/24) + 1
+}
+
+func roundBudgetAmount(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+// decodeBudgetEmoji undoes the "BASE64:" encoding categories_management uses to store emojis
+func decodeBudgetEmoji(encoded string) string {
+	if !strings.HasPrefix(encoded, "BASE64:") {
+		return encoded
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, "BASE64:"))
+	if err != nil {
+		return encoded
+	}
+	return string(decoded)
+}
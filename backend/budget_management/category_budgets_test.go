@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func setCategoryBudget(t *testing.T, categoryID int, amount float64) int {
+	t.Helper()
+	status, _ := postBudget(handleSetCategoryBudget, CategoryBudgetRequest{UserID: "1", CategoryID: categoryID, Period: "monthly", Amount: amount})
+	return status
+}
+
+func budgetProgress(t *testing.T, asOf string) (*CategoryBudgetsResponse, map[int]CategoryBudgetProgress) {
+	t.Helper()
+	date, _ := time.Parse("2006-01-02", asOf)
+	response, err := fetchCategoryBudgets("1", "monthly", date)
+	if err != nil {
+		t.Fatalf("Failed to fetch category budgets: %v", err)
+	}
+	byID := map[int]CategoryBudgetProgress{}
+	for _, item := range response.Categories {
+		byID[item.CategoryID] = item
+	}
+	return response, byID
+}
+
+func TestCategoryBudgetProgress(t *testing.T) {
+	setupBudgetDB(t)
+	transport := addBudgetCategory(t, "Transport", "expense", 0)
+	fuel := addBudgetCategory(t, "Fuel", "expense", transport)
+	addBudgetCategory(t, "Parking", "expense", transport)
+	food := addBudgetCategory(t, "Food", "expense", 0)
+	salary := addBudgetCategory(t, "Salary", "income", 0)
+
+	for _, limit := range []struct {
+		categoryID int
+		amount     float64
+		status     int
+	}{{transport, 300, http.StatusOK}, {fuel, 50, http.StatusOK}, {food, 100, http.StatusOK}, {salary, 100, http.StatusBadRequest}, {9999, 100, http.StatusNotFound}} {
+		if status := setCategoryBudget(t, limit.categoryID, limit.amount); status != limit.status {
+			t.Errorf("Setting a limit on category %d: expected status %d, got %d", limit.categoryID, limit.status, status)
+		}
+	}
+
+	// Parking has no category_id yet and is matched by name; the 20th is after the requested day
+	addBudgetExpense(t, "2025-02-03", 120, fuel, "Fuel", 0, 0)
+	addBudgetExpense(t, "2025-02-10", 30, 0, "parking", 0, 0)
+	addBudgetExpense(t, "2025-02-05", 60, food, "Food", 0, 0)
+	addBudgetExpense(t, "2025-02-20", 40, food, "Food", 0, 0)
+	addBudgetExpense(t, "2025-01-27", 20, food, "Food", 0, 0)
+
+	response, progress := budgetProgress(t, "2025-02-14")
+	if response.StartDate != "2025-02-01" || response.EndDate != "2025-02-28" || response.DaysElapsed != 14 || response.DaysTotal != 28 {
+		t.Errorf("Expected day 14 of 28 in February, got %s..%s day %d of %d",
+			response.StartDate, response.EndDate, response.DaysElapsed, response.DaysTotal)
+	}
+
+	// Transport adds up its subcategories and is projected right on its limit
+	if item := progress[transport]; item.Spent != 150 || item.Remaining != 150 || item.PercentUsed != 50 ||
+		item.DailyRate != 10.71 || item.Projected != 300 || item.OverBudget || item.ProjectedOverBudget {
+		t.Errorf("Unexpected transport progress: %+v", item)
+	}
+	if item := progress[fuel]; item.Spent != 120 || item.PercentUsed != 240 || !item.OverBudget || item.ParentID != transport {
+		t.Errorf("Expected fuel over its limit, got %+v", item)
+	}
+	if item := progress[food]; item.Spent != 60 || item.Projected != 120 || item.OverBudget || !item.ProjectedOverBudget {
+		t.Errorf("Expected food to be projected over its limit, got %+v", item)
+	}
+	if response.TotalLimit != 450 || response.TotalSpent != 330 {
+		t.Errorf("Expected 330 spent of 450, got %.2f of %.2f", response.TotalSpent, response.TotalLimit)
+	}
+	if len(response.Categories) != 3 || response.Categories[0].CategoryID != fuel || response.Categories[2].CategoryID != transport {
+		t.Errorf("Expected the categories sorted by percentage used, got %+v", response.Categories)
+	}
+
+	// The next month starts from zero
+	if response, progress := budgetProgress(t, "2025-03-10"); progress[food].Spent != 0 || response.DaysElapsed != 10 {
+		t.Errorf("Expected nothing spent on day 10 of March, got %.2f on day %d", progress[food].Spent, response.DaysElapsed)
+	}
+
+	// A zero limit removes it
+	if status := setCategoryBudget(t, fuel, 0); status != http.StatusOK {
+		t.Fatalf("Expected removing the fuel limit to succeed, got status %d", status)
+	}
+	if _, progress := budgetProgress(t, "2025-02-14"); len(progress) != 2 {
+		t.Errorf("Expected two limits left, got %+v", progress)
+	}
+}
+
+func TestCategoryBudgetFollowsTheMonthStartDay(t *testing.T) {
+	setupBudgetDB(t)
+	food := addBudgetCategory(t, "Food", "expense", 0)
+	if status := setCategoryBudget(t, food, 100); status != http.StatusOK {
+		t.Fatalf("Expected the limit to be saved, got status %d", status)
+	}
+	if _, err := db.Exec(`INSERT INTO user_period_settings (user_id, month_start_day, week_start_day) VALUES ('1', 25, 1)`); err != nil {
+		t.Fatalf("Failed to save period settings: %v", err)
+	}
+	addBudgetExpense(t, "2025-01-24", 50, food, "Food", 0, 0)
+	addBudgetExpense(t, "2025-01-27", 20, food, "Food", 0, 0)
+	addBudgetExpense(t, "2025-02-05", 60, food, "Food", 0, 0)
+
+	// February runs from the 25th of January to the 24th of February
+	response, progress := budgetProgress(t, "2025-02-14")
+	if response.StartDate != "2025-01-25" || response.EndDate != "2025-02-24" || response.DaysElapsed != 21 || response.DaysTotal != 31 {
+		t.Errorf("Expected day 21 of 31 from the 25th, got %s..%s day %d of %d",
+			response.StartDate, response.EndDate, response.DaysElapsed, response.DaysTotal)
+	}
+	if item := progress[food]; item.Spent != 80 || item.Projected != 118.1 || !item.ProjectedOverBudget {
+		t.Errorf("Expected 80 spent and projected over the limit, got %+v", item)
+	}
+
+	// The budget period is only validated against the known period types
+	if _, err := fetchCategoryBudgets("1", "fortnightly", time.Now()); err == nil {
+		t.Errorf("Expected an unknown period to be rejected")
+	}
+}
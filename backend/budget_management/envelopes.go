@@ -0,0 +1,646 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+// Envelope mode (zero-based budgeting), opt-in per user. Income goes into
+// "ready to assign", the user splits it into per-category envelopes every month and expenses
+// drain them. Each envelope's balance carries over to the next month, negative ones too,
+// which have to be covered by moving money from another envelope.
+//
+// It is a separate accounting view from money_flow_sync's from_previous: it does not touch the
+// balance tables and is calculated from envelope_transfers, incomes, expenses and paid bills.
+
+// readyToAssignID representa "ready to assign" en envelope_transfers
+const readyToAssignID = 0
+
+type EnvelopeModeRequest struct {
+	UserID          string   `json:"user_id"`
+	StartMonth      string   `json:"start_month,omitempty"`      // YYYY-MM, defaults to the current month
+	StartingBalance *float64 `json:"starting_balance,omitempty"` // Defaults to the cash and bank balance at the end of the previous month
+}
+
+type EnvelopeSettings struct {
+	UserID          string  `json:"user_id"`
+	Enabled         bool    `json:"enabled"`
+	StartMonth      string  `json:"start_month"`
+	StartingBalance float64 `json:"starting_balance"`
+}
+
+// EnvelopeAssignRequest assigns money from "ready to assign" to an envelope. A negative amount returns it.
+type EnvelopeAssignRequest struct {
+	UserID     string  `json:"user_id"`
+	Month      string  `json:"month"` // YYYY-MM
+	CategoryID int     `json:"category_id"`
+	Amount     float64 `json:"amount"`
+}
+
+type EnvelopeMoveRequest struct {
+	UserID         string  `json:"user_id"`
+	Month          string  `json:"month"` // YYYY-MM
+	FromCategoryID int     `json:"from_category_id"`
+	ToCategoryID   int     `json:"to_category_id"`
+	Amount         float64 `json:"amount"`
+	Note           string  `json:"note,omitempty"`
+}
+
+type Envelope struct {
+	CategoryID  int     `json:"category_id"`
+	Name        string  `json:"name"`
+	Emoji       string  `json:"emoji"`
+	CarriedOver float64 `json:"carried_over"` // Balance carried over from the previous month
+	Assigned    float64 `json:"assigned"`
+	Activity    float64 `json:"activity"` // Spent in the month (positive)
+	Available   float64 `json:"available"`
+	Overspent   bool    `json:"overspent"`
+}
+
+type EnvelopeMonth struct {
+	UserID         string     `json:"user_id"`
+	Month          string     `json:"month"`
+	ReadyToAssign  float64    `json:"ready_to_assign"`
+	Income         float64    `json:"income"`
+	Assigned       float64    `json:"assigned"`
+	Activity       float64    `json:"activity"`
+	Available      float64    `json:"available"`
+	OverspentTotal float64    `json:"overspent_total"` // Sum of the negative envelopes, still to be covered
+	OverAssigned   bool       `json:"over_assigned"`   // More was assigned than was available
+	Envelopes      []Envelope `json:"envelopes"`
+}
+
+var errEnvelopeModeDisabled = fmt.Errorf("envelope mode is not enabled for this user")
+
+func createEnvelopeTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS envelope_settings (
+			user_id TEXT PRIMARY KEY,
+			enabled BOOLEAN NOT NULL DEFAULT 1,
+			start_month TEXT NOT NULL,
+			starting_balance REAL NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create envelope_settings table: %v", err)
+	}
+
+	// Each assignment or move is a row; 0 is "ready to assign"
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS envelope_transfers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			month TEXT NOT NULL,
+			from_category_id INTEGER NOT NULL,
+			to_category_id INTEGER NOT NULL,
+			amount REAL NOT NULL,
+			note TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create envelope_transfers table: %v", err)
+	}
+	db.Exec(`CREATE INDEX IF NOT EXISTS idx_envelope_transfers_user_month ON envelope_transfers(user_id, month)`)
+
+	// bills_management links bill payments to their expenses on startup; repeat it here in case
+	// this service starts first (duplicate column errors are ignored)
+	db.Exec(`ALTER TABLE expenses ADD COLUMN bill_id INTEGER`)
+	db.Exec(`ALTER TABLE expenses ADD COLUMN bill_payment_id INTEGER`)
+}
+
+func handleEnableEnvelopes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var modeRequest EnvelopeModeRequest
+	if err := json.NewDecoder(r.Body).Decode(&modeRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if modeRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	settings, err := fetchEnvelopeSettings(modeRequest.UserID)
+	if err != nil && err != errEnvelopeModeDisabled {
+		log.Printf("Error fetching envelope settings: %v", err)
+		sendErrorResponse(w, "Error fetching envelope settings", http.StatusInternalServerError)
+		return
+	}
+
+	// Enabling it again keeps the start month and the previous assignments
+	if settings == nil || modeRequest.StartMonth != "" || modeRequest.StartingBalance != nil {
+		startMonth := modeRequest.StartMonth
+		if startMonth == "" {
+			startMonth = currentEnvelopeMonth(modeRequest.UserID)
+		}
+		start, err := time.Parse("2006-01", startMonth)
+		if err != nil {
+			sendErrorResponse(w, "Invalid start_month, expected YYYY-MM", http.StatusBadRequest)
+			return
+		}
+
+		var startingBalance float64
+		if modeRequest.StartingBalance != nil {
+			startingBalance = *modeRequest.StartingBalance
+		} else {
+			previous := start.AddDate(0, -1, 0).Format("2006-01")
+			err = db.QueryRow(`
+				SELECT COALESCE(balance_cash_amount, 0) + COALESCE(balance_bank_amount, 0)
+				FROM monthly_cash_bank_balance WHERE user_id = ? AND year_month = ?
+			`, modeRequest.UserID, previous).Scan(&startingBalance)
+			if err != nil && err != sql.ErrNoRows {
+				log.Printf("Error fetching starting balance: %v", err)
+			}
+		}
+
+		settings = &EnvelopeSettings{UserID: modeRequest.UserID, StartMonth: startMonth, StartingBalance: roundBudgetAmount(startingBalance)}
+	}
+	settings.Enabled = true
+
+	_, err = db.Exec(`
+		INSERT INTO envelope_settings (user_id, enabled, start_month, starting_balance)
+		VALUES (?, 1, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			enabled = 1,
+			start_month = excluded.start_month,
+			starting_balance = excluded.starting_balance,
+			updated_at = CURRENT_TIMESTAMP
+	`, settings.UserID, settings.StartMonth, settings.StartingBalance)
+	if err != nil {
+		log.Printf("Error enabling envelope mode: %v", err)
+		sendErrorResponse(w, "Error enabling envelope mode", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Envelope mode enabled", settings)
+}
+
+func handleDisableEnvelopes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var modeRequest EnvelopeModeRequest
+	if err := json.NewDecoder(r.Body).Decode(&modeRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if modeRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	// Assignments are kept in case the user enables it again
+	if _, err := db.Exec(`UPDATE envelope_settings SET enabled = 0, updated_at = CURRENT_TIMESTAMP WHERE user_id = ?`,
+		modeRequest.UserID); err != nil {
+		log.Printf("Error disabling envelope mode: %v", err)
+		sendErrorResponse(w, "Error disabling envelope mode", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Envelope mode disabled", nil)
+}
+
+func handleFetchEnvelopes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = currentEnvelopeMonth(userID)
+	}
+	if _, err := time.Parse("2006-01", month); err != nil {
+		sendErrorResponse(w, "Invalid month, expected YYYY-MM", http.StatusBadRequest)
+		return
+	}
+
+	envelopeMonth, status, err := loadEnvelopeMonth(userID, month)
+	if err != nil {
+		if status >= http.StatusInternalServerError {
+			log.Printf("Error fetching envelopes: %v", err)
+			sendErrorResponse(w, "Error fetching envelopes", status)
+			return
+		}
+		sendErrorResponse(w, err.Error(), status)
+		return
+	}
+
+	sendSuccessResponse(w, "Envelopes fetched successfully", envelopeMonth)
+}
+
+func handleAssignEnvelope(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var assignRequest EnvelopeAssignRequest
+	if err := json.NewDecoder(r.Body).Decode(&assignRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if assignRequest.Amount == 0 {
+		sendErrorResponse(w, "Amount must not be zero", http.StatusBadRequest)
+		return
+	}
+
+	// Assigning is moving from "ready to assign"; a negative amount returns it
+	from, to, amount := readyToAssignID, assignRequest.CategoryID, assignRequest.Amount
+	if amount < 0 {
+		from, to, amount = assignRequest.CategoryID, readyToAssignID, -amount
+	}
+
+	month, status, err := recordEnvelopeTransfer(common.EventEnvelopeAssigned, assignRequest.UserID, assignRequest.Month,
+		assignRequest.CategoryID, from, to, amount, "")
+	if err != nil {
+		if status >= http.StatusInternalServerError {
+			log.Printf("Error assigning to envelope: %v", err)
+			sendErrorResponse(w, "Error assigning to envelope", status)
+			return
+		}
+		sendErrorResponse(w, err.Error(), status)
+		return
+	}
+
+	sendSuccessResponse(w, "Money assigned to envelope", month)
+}
+
+func handleMoveEnvelope(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var moveRequest EnvelopeMoveRequest
+	if err := json.NewDecoder(r.Body).Decode(&moveRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if moveRequest.Amount <= 0 {
+		sendErrorResponse(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if moveRequest.FromCategoryID <= 0 || moveRequest.ToCategoryID <= 0 || moveRequest.FromCategoryID == moveRequest.ToCategoryID {
+		sendErrorResponse(w, "Two different envelopes are required", http.StatusBadRequest)
+		return
+	}
+
+	// Validate the source; the destination is validated inside recordEnvelopeTransfer
+	if err := checkEnvelopeCategory(moveRequest.UserID, moveRequest.FromCategoryID); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	month, status, err := recordEnvelopeTransfer(common.EventEnvelopeMoved, moveRequest.UserID, moveRequest.Month, moveRequest.ToCategoryID,
+		moveRequest.FromCategoryID, moveRequest.ToCategoryID, moveRequest.Amount, moveRequest.Note)
+	if err != nil {
+		if status >= http.StatusInternalServerError {
+			log.Printf("Error moving money between envelopes: %v", err)
+			sendErrorResponse(w, "Error moving money between envelopes", status)
+			return
+		}
+		sendErrorResponse(w, err.Error(), status)
+		return
+	}
+
+	sendSuccessResponse(w, "Money moved between envelopes", month)
+}
+
+// currentEnvelopeMonth is the user's current month, based on their time zone and month start day
+func currentEnvelopeMonth(userID string) string {
+	periodSettings, _ := common.LoadPeriodSettings(db, userID)
+	return periodSettings.Identifier(common.UserNow(db, userID), "monthly")
+}
+
+// recordEnvelopeTransfer validates and saves a move along with its event and returns the updated month
+func recordEnvelopeTransfer(eventType, userID, month string, categoryID, from, to int, amount float64, note string) (*EnvelopeMonth, int, error) {
+	if userID == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("User ID is required")
+	}
+	if month == "" {
+		month = currentEnvelopeMonth(userID)
+	}
+	if _, err := time.Parse("2006-01", month); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid month, expected YYYY-MM")
+	}
+
+	settings, err := fetchEnvelopeSettings(userID)
+	if err == errEnvelopeModeDisabled {
+		return nil, http.StatusConflict, err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if month < settings.StartMonth {
+		return nil, http.StatusBadRequest, fmt.Errorf("month is before the envelope start month %s", settings.StartMonth)
+	}
+	if err := checkEnvelopeCategory(userID, categoryID); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(`
+			INSERT INTO envelope_transfers (user_id, month, from_category_id, to_category_id, amount, note)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, userID, month, from, to, roundBudgetAmount(amount), note)
+		if err != nil {
+			return err
+		}
+		transferID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		return common.PublishEvent(tx, eventType, userID, transferID, map[string]interface{}{
+			"month":            month,
+			"from_category_id": from,
+			"to_category_id":   to,
+			"amount":           roundBudgetAmount(amount),
+			"note":             note,
+		})
+	})
+	if err != nil {
+		return nil, common.TxErrorStatus(err), err
+	}
+
+	return loadEnvelopeMonth(userID, month)
+}
+
+// checkEnvelopeCategory checks that the envelope is one of the user's expense categories
+func checkEnvelopeCategory(userID string, categoryID int) error {
+	if categoryID <= 0 {
+		return fmt.Errorf("Category ID is required")
+	}
+	var categoryType string
+	err := db.QueryRow(`SELECT type FROM categories WHERE id = ? AND user_id = ?`, categoryID, userID).Scan(&categoryType)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("category %d not found", categoryID)
+	}
+	if err != nil {
+		return err
+	}
+	if categoryType != "expense" {
+		return fmt.Errorf("envelopes can only hold expense categories")
+	}
+	return nil
+}
+
+func fetchEnvelopeSettings(userID string) (*EnvelopeSettings, error) {
+	settings := &EnvelopeSettings{UserID: userID}
+	err := db.QueryRow(`
+		SELECT enabled, start_month, starting_balance FROM envelope_settings WHERE user_id = ?
+	`, userID).Scan(&settings.Enabled, &settings.StartMonth, &settings.StartingBalance)
+	if err == sql.ErrNoRows {
+		return nil, errEnvelopeModeDisabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !settings.Enabled {
+		return settings, errEnvelopeModeDisabled
+	}
+	return settings, nil
+}
+
+// loadEnvelopeMonth walks the months from the start of envelope mode up to month, carrying over
+// each envelope's balance and what is left to assign
+func loadEnvelopeMonth(userID, month string) (*EnvelopeMonth, int, error) {
+	settings, err := fetchEnvelopeSettings(userID)
+	if err == errEnvelopeModeDisabled {
+		return nil, http.StatusConflict, err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if month < settings.StartMonth {
+		return nil, http.StatusBadRequest, fmt.Errorf("month is before the envelope start month %s", settings.StartMonth)
+	}
+
+	envelopeMonth, err := buildEnvelopeMonth(settings, month)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return envelopeMonth, http.StatusOK, nil
+}
+
+func buildEnvelopeMonth(settings *EnvelopeSettings, month string) (*EnvelopeMonth, error) {
+	userID := settings.UserID
+	start, _ := time.Parse("2006-01", settings.StartMonth)
+	target, _ := time.Parse("2006-01", month)
+
+	// Months follow the user's month start day
+	periodSettings, err := common.LoadPeriodSettings(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	firstDay, _ := periodSettings.Range("monthly", start)
+	_, lastDay := periodSettings.Range("monthly", target)
+	startDate, endDate := firstDay.Format("2006-01-02"), lastDay.Format("2006-01-02")
+	monthOf := func(date string) string {
+		parsed, err := time.Parse("2006-01-02", date[:min(len(date), 10)])
+		if err != nil {
+			return ""
+		}
+		return periodSettings.Identifier(parsed, "monthly")
+	}
+
+	envelopes := map[int]*Envelope{}
+	byName := map[string]*Envelope{}
+	rows, err := db.Query(`SELECT id, name, emoji FROM categories WHERE user_id = ? AND type = 'expense'`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		envelope := &Envelope{}
+		if err := rows.Scan(&envelope.CategoryID, &envelope.Name, &envelope.Emoji); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		envelope.Emoji = decodeBudgetEmoji(envelope.Emoji)
+		envelopes[envelope.CategoryID] = envelope
+		if _, exists := byName[strings.ToLower(envelope.Name)]; !exists {
+			byName[strings.ToLower(envelope.Name)] = envelope
+		}
+	}
+	rows.Close()
+
+	// Moves per month and envelope: money in minus money out
+	assigned := map[string]map[int]float64{}
+	rows, err = db.Query(`
+		SELECT month, from_category_id, to_category_id, amount FROM envelope_transfers
+		WHERE user_id = ? AND month >= ? AND month <= ?
+	`, userID, settings.StartMonth, month)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var transferMonth string
+		var from, to int
+		var amount float64
+		if err := rows.Scan(&transferMonth, &from, &to, &amount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if assigned[transferMonth] == nil {
+			assigned[transferMonth] = map[int]float64{}
+		}
+		assigned[transferMonth][from] -= amount
+		assigned[transferMonth][to] += amount
+	}
+	rows.Close()
+
+	// Expenses per month and envelope. Each bill payment made from bills_management has its own
+	// expense, so partial payments land in the month they were made. Other expenses linked to a
+	// bill (loan interest) are part of the bill payment counted below.
+	activity := map[string]map[int]float64{}
+	addActivity := func(activityMonth string, categoryID int, categoryName string, amount float64) {
+		envelope, ok := envelopes[categoryID]
+		if !ok {
+			envelope, ok = byName[strings.ToLower(categoryName)]
+		}
+		if !ok {
+			return
+		}
+		if activity[activityMonth] == nil {
+			activity[activityMonth] = map[int]float64{}
+		}
+		activity[activityMonth][envelope.CategoryID] += amount
+	}
+
+	rows, err = db.Query(`
+		SELECT date, COALESCE(category_id, 0), category, SUM(amount) FROM expenses
+		WHERE user_id = ? AND date >= ? AND date <= ? AND (bill_id IS NULL OR bill_payment_id IS NOT NULL)
+		GROUP BY date, COALESCE(category_id, 0), category
+	`, userID, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var expenseDate, name string
+		var categoryID int
+		var amount float64
+		if err := rows.Scan(&expenseDate, &categoryID, &name, &amount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		addActivity(monthOf(expenseDate), categoryID, name, amount)
+	}
+	rows.Close()
+
+	// Bill payments without an expense of their own (loans, payments made before the link
+	// existed) count in the month they were paid, or in their own month if the date is unknown
+	rows, err = db.Query(`
+		SELECT COALESCE(bp.payment_date, ''), substr(bp.year_month, 1, 7), b.category,
+			CASE WHEN bp.paid_amount > 0 THEN bp.paid_amount ELSE COALESCE(bp.amount, b.amount) END
+		FROM bill_payments bp
+		JOIN bills b ON b.id = bp.bill_id
+		WHERE bp.user_id = ? AND (bp.paid = 1 OR bp.paid_amount > 0)
+			AND NOT EXISTS (SELECT 1 FROM expenses e WHERE e.bill_payment_id = bp.id)
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var paymentDate, billMonth, name string
+		var amount float64
+		if err := rows.Scan(&paymentDate, &billMonth, &name, &amount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if paymentDate != "" {
+			billMonth = monthOf(paymentDate)
+		}
+		addActivity(billMonth, 0, name, amount)
+	}
+	rows.Close()
+
+	// Income per month
+	income := map[string]float64{}
+	rows, err = db.Query(`
+		SELECT date, SUM(amount) FROM incomes
+		WHERE user_id = ? AND date >= ? AND date <= ?
+		GROUP BY date
+	`, userID, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var incomeDate string
+		var amount float64
+		if err := rows.Scan(&incomeDate, &amount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		income[monthOf(incomeDate)] += amount
+	}
+	rows.Close()
+
+	// Carry over month by month
+	readyToAssign := settings.StartingBalance
+	available := map[int]float64{}
+	for current := start; !current.After(target); current = current.AddDate(0, 1, 0) {
+		key := current.Format("2006-01")
+		readyToAssign += income[key] + assigned[key][readyToAssignID]
+
+		for id, envelope := range envelopes {
+			carried := available[id]
+			available[id] = carried + assigned[key][id] - activity[key][id]
+			if key == month {
+				envelope.CarriedOver = roundBudgetAmount(carried)
+				envelope.Assigned = roundBudgetAmount(assigned[key][id])
+				envelope.Activity = roundBudgetAmount(activity[key][id])
+				envelope.Available = roundBudgetAmount(available[id])
+				envelope.Overspent = envelope.Available < 0
+			}
+		}
+	}
+
+	result := &EnvelopeMonth{
+		UserID:        userID,
+		Month:         month,
+		ReadyToAssign: roundBudgetAmount(readyToAssign),
+		Income:        roundBudgetAmount(income[month]),
+		Envelopes:     []Envelope{},
+	}
+	for _, envelope := range envelopes {
+		result.Assigned += envelope.Assigned
+		result.Activity += envelope.Activity
+		result.Available += envelope.Available
+		if envelope.Available < 0 {
+			result.OverspentTotal += envelope.Available
+		}
+		result.Envelopes = append(result.Envelopes, *envelope)
+	}
+	result.Assigned = roundBudgetAmount(result.Assigned)
+	result.Activity = roundBudgetAmount(result.Activity)
+	result.Available = roundBudgetAmount(result.Available)
+	result.OverspentTotal = roundBudgetAmount(result.OverspentTotal)
+	result.OverAssigned = result.ReadyToAssign < 0
+
+	sort.Slice(result.Envelopes, func(i, j int) bool {
+		return result.Envelopes[i].Name < result.Envelopes[j].Name
+	})
+	return result, nil
+}
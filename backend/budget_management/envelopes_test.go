@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"hero_budget_backend/common"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func setupBudgetDB(t *testing.T) {
+	t.Helper()
+	testDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+	db = testDB
+
+	statements := []string{
+		`CREATE TABLE categories (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT NOT NULL, name TEXT NOT NULL,
+			type TEXT NOT NULL, emoji TEXT NOT NULL DEFAULT '📁')`,
+		`CREATE TABLE expenses (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, amount REAL, date TEXT,
+			category TEXT, payment_method TEXT DEFAULT 'bank', description TEXT)`,
+		`CREATE TABLE incomes (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, amount REAL, date TEXT,
+			category TEXT, payment_method TEXT DEFAULT 'bank', description TEXT)`,
+		`CREATE TABLE bills (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, name TEXT, amount REAL, category TEXT)`,
+		`CREATE TABLE bill_payments (id INTEGER PRIMARY KEY AUTOINCREMENT, bill_id INTEGER, user_id TEXT,
+			year_month TEXT, paid BOOLEAN DEFAULT 0, payment_date TEXT, payment_method TEXT)`,
+		`CREATE TABLE user_period_settings (user_id TEXT PRIMARY KEY, month_start_day INTEGER NOT NULL DEFAULT 1,
+			week_start_day INTEGER NOT NULL DEFAULT 1)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Failed to create schema: %v", err)
+		}
+	}
+	createCategoryBudgetsTable()
+	createEnvelopeTables()
+	for _, ensure := range []func(db *sql.DB) error{common.EnsureBillPaymentAmountColumns, common.EnsureOutboxTable} {
+		if err := ensure(db); err != nil {
+			t.Fatalf("Failed to prepare test database: %v", err)
+		}
+	}
+}
+
+func addBudgetCategory(t *testing.T, name, categoryType string, parentID int) int {
+	t.Helper()
+	result, err := db.Exec(`INSERT INTO categories (user_id, name, type, parent_id) VALUES ('1', ?, ?, NULLIF(?, 0))`,
+		name, categoryType, parentID)
+	if err != nil {
+		t.Fatalf("Failed to add category %s: %v", name, err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+// addBudgetExpense adds an expense of user 1; billID and paymentID link it to a bill payment when non-zero
+func addBudgetExpense(t *testing.T, date string, amount float64, categoryID int, category string, billID, paymentID int64) {
+	t.Helper()
+	_, err := db.Exec(`INSERT INTO expenses (user_id, amount, date, category, category_id, bill_id, bill_payment_id)
+		VALUES ('1', ?, ?, ?, NULLIF(?, 0), NULLIF(?, 0), NULLIF(?, 0))`, amount, date, category, categoryID, billID, paymentID)
+	if err != nil {
+		t.Fatalf("Failed to add expense: %v", err)
+	}
+}
+
+func postBudget(handler http.HandlerFunc, body interface{}) (int, *EnvelopeMonth) {
+	payload, _ := json.Marshal(body)
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("POST", "/", bytes.NewBuffer(payload)))
+
+	var response struct {
+		Data *EnvelopeMonth `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	return rr.Code, response.Data
+}
+
+func fetchEnvelopeMonth(t *testing.T, month string) *EnvelopeMonth {
+	t.Helper()
+	envelopeMonth, _, err := loadEnvelopeMonth("1", month)
+	if err != nil {
+		t.Fatalf("Failed to load %s: %v", month, err)
+	}
+	return envelopeMonth
+}
+
+func envelopeOf(t *testing.T, month *EnvelopeMonth, categoryID int) Envelope {
+	t.Helper()
+	for _, envelope := range month.Envelopes {
+		if envelope.CategoryID == categoryID {
+			return envelope
+		}
+	}
+	t.Fatalf("Envelope %d not found in %s", categoryID, month.Month)
+	return Envelope{}
+}
+
+func TestEnvelopesCarryOverAndAssignments(t *testing.T) {
+	setupBudgetDB(t)
+	groceries := addBudgetCategory(t, "Groceries", "expense", 0)
+	rent := addBudgetCategory(t, "Rent", "expense", 0)
+	fun := addBudgetCategory(t, "Fun", "expense", 0)
+	salary := addBudgetCategory(t, "Salary", "income", 0)
+
+	startingBalance := 1000.0
+	if status, _ := postBudget(handleEnableEnvelopes, EnvelopeModeRequest{UserID: "1", StartMonth: "2025-01", StartingBalance: &startingBalance}); status != http.StatusOK {
+		t.Fatalf("Expected envelope mode to be enabled, got status %d", status)
+	}
+
+	// Assigning takes from "ready to assign" and a negative amount gives it back
+	for _, assignment := range []struct {
+		categoryID int
+		amount     float64
+	}{{groceries, 300}, {rent, 500}, {rent, -100}} {
+		if status, _ := postBudget(handleAssignEnvelope, EnvelopeAssignRequest{UserID: "1", Month: "2025-01",
+			CategoryID: assignment.categoryID, Amount: assignment.amount}); status != http.StatusOK {
+			t.Fatalf("Expected assigning %.2f to succeed, got status %d", assignment.amount, status)
+		}
+	}
+	addBudgetExpense(t, "2025-01-10", 350, groceries, "Groceries", 0, 0)
+	if _, err := db.Exec(`INSERT INTO incomes (user_id, amount, date, category) VALUES ('1', 600, '2025-02-05', 'Salary')`); err != nil {
+		t.Fatalf("Failed to add income: %v", err)
+	}
+
+	january := fetchEnvelopeMonth(t, "2025-01")
+	if january.ReadyToAssign != 300 || january.Assigned != 700 || january.OverAssigned {
+		t.Errorf("January: expected 300 ready to assign after assigning 700, got %.2f and %.2f", january.ReadyToAssign, january.Assigned)
+	}
+	if envelope := envelopeOf(t, january, rent); envelope.Assigned != 400 || envelope.Available != 400 {
+		t.Errorf("Expected 400 in the rent envelope, got %+v", envelope)
+	}
+	if envelope := envelopeOf(t, january, groceries); envelope.Activity != 350 || envelope.Available != -50 || !envelope.Overspent {
+		t.Errorf("Expected the groceries envelope overspent by 50, got %+v", envelope)
+	}
+	if january.OverspentTotal != -50 {
+		t.Errorf("Expected -50 still to be covered, got %.2f", january.OverspentTotal)
+	}
+
+	// The negative balance carries over and has to be covered with next month's money
+	_, february := postBudget(handleAssignEnvelope, EnvelopeAssignRequest{UserID: "1", Month: "2025-02", CategoryID: groceries, Amount: 200})
+	if february == nil {
+		t.Fatalf("Expected the February month back from the assignment")
+	}
+	if envelope := envelopeOf(t, february, groceries); envelope.CarriedOver != -50 || envelope.Available != 150 || envelope.Overspent {
+		t.Errorf("Expected -50 carried over and 150 available in groceries, got %+v", envelope)
+	}
+	if envelope := envelopeOf(t, february, rent); envelope.CarriedOver != 400 || envelope.Available != 400 {
+		t.Errorf("Expected the rent envelope to carry over 400, got %+v", envelope)
+	}
+	if february.Income != 600 || february.ReadyToAssign != 700 {
+		t.Errorf("February: expected 600 of income and 700 ready to assign, got %.2f and %.2f", february.Income, february.ReadyToAssign)
+	}
+
+	// Assigning more than is ready is allowed but flagged
+	_, february = postBudget(handleAssignEnvelope, EnvelopeAssignRequest{UserID: "1", Month: "2025-02", CategoryID: fun, Amount: 900})
+	if february == nil || february.ReadyToAssign != -200 || !february.OverAssigned {
+		t.Errorf("Expected February to be over-assigned by 200, got %+v", february)
+	}
+
+	for _, invalid := range []struct {
+		name    string
+		request EnvelopeAssignRequest
+		status  int
+	}{
+		{"income category", EnvelopeAssignRequest{UserID: "1", Month: "2025-02", CategoryID: salary, Amount: 10}, http.StatusBadRequest},
+		{"zero amount", EnvelopeAssignRequest{UserID: "1", Month: "2025-02", CategoryID: fun}, http.StatusBadRequest},
+		{"before the start month", EnvelopeAssignRequest{UserID: "1", Month: "2024-12", CategoryID: fun, Amount: 10}, http.StatusBadRequest},
+		{"mode not enabled", EnvelopeAssignRequest{UserID: "2", Month: "2025-02", CategoryID: fun, Amount: 10}, http.StatusConflict},
+	} {
+		if status, _ := postBudget(handleAssignEnvelope, invalid.request); status != invalid.status {
+			t.Errorf("%s: expected status %d, got %d", invalid.name, invalid.status, status)
+		}
+	}
+}
+
+func TestEnvelopeBillActivityFollowsThePayment(t *testing.T) {
+	setupBudgetDB(t)
+	rent := addBudgetCategory(t, "Rent", "expense", 0)
+	loans := addBudgetCategory(t, "Loans", "expense", 0)
+	groceries := addBudgetCategory(t, "Groceries", "expense", 0)
+
+	// Months run from the 25th: February is 2025-01-25 to 2025-02-24
+	if _, err := db.Exec(`INSERT INTO user_period_settings (user_id, month_start_day, week_start_day) VALUES ('1', 25, 1)`); err != nil {
+		t.Fatalf("Failed to save period settings: %v", err)
+	}
+	startingBalance := 0.0
+	if status, _ := postBudget(handleEnableEnvelopes, EnvelopeModeRequest{UserID: "1", StartMonth: "2025-02", StartingBalance: &startingBalance}); status != http.StatusOK {
+		t.Fatalf("Expected envelope mode to be enabled, got status %d", status)
+	}
+
+	// March's rent is paid in two parts, each with its own expense, on both sides of the 25th
+	result, _ := db.Exec(`INSERT INTO bills (user_id, name, amount, category) VALUES ('1', 'Rent', 500, 'Rent')`)
+	rentBill, _ := result.LastInsertId()
+	result, _ = db.Exec(`INSERT INTO bill_payments (bill_id, user_id, year_month, paid, payment_date, amount, paid_amount)
+		VALUES (?, '1', '2025-03', 1, '2025-02-26', 500, 500)`, rentBill)
+	rentPayment, _ := result.LastInsertId()
+	addBudgetExpense(t, "2025-02-20", 200, rent, "Rent", rentBill, rentPayment)
+	addBudgetExpense(t, "2025-02-26", 300, rent, "Rent", rentBill, rentPayment)
+
+	// A loan installment has no expense of its own; its interest expense is part of it
+	result, _ = db.Exec(`INSERT INTO bills (user_id, name, amount, category) VALUES ('1', 'Car loan', 150, 'Loans')`)
+	loanBill, _ := result.LastInsertId()
+	db.Exec(`INSERT INTO bill_payments (bill_id, user_id, year_month, paid, payment_date) VALUES (?, '1', '2025-03', 1, '2025-02-10')`, loanBill)
+	addBudgetExpense(t, "2025-02-10", 20, loans, "Loans", loanBill, 0)
+
+	// The 26th of January is already February; the 24th is before envelope mode started
+	addBudgetExpense(t, "2025-01-26", 80, groceries, "Groceries", 0, 0)
+	addBudgetExpense(t, "2025-01-24", 999, groceries, "Groceries", 0, 0)
+
+	february := fetchEnvelopeMonth(t, "2025-02")
+	for _, want := range []struct {
+		name       string
+		categoryID int
+		activity   float64
+	}{{"rent", rent, 200}, {"loans", loans, 150}, {"groceries", groceries, 80}} {
+		if envelope := envelopeOf(t, february, want.categoryID); envelope.Activity != want.activity {
+			t.Errorf("February %s: expected %.2f of activity, got %.2f", want.name, want.activity, envelope.Activity)
+		}
+	}
+	march := fetchEnvelopeMonth(t, "2025-03")
+	if envelope := envelopeOf(t, march, rent); envelope.Activity != 300 || envelope.Available != -500 {
+		t.Errorf("March rent: expected 300 of activity and -500 available, got %+v", envelope)
+	}
+	if envelope := envelopeOf(t, march, loans); envelope.Activity != 0 {
+		t.Errorf("March loans: expected the installment to stay in February, got %.2f", envelope.Activity)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"path/filepath"
 	"time"
 
+	"hero_budget_backend/common"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -117,12 +119,34 @@ func createTablesIfNotExist() {
 			log.Println("Added total_income column to budget table")
 		}
 	}
+
+	// Per-category limits
+	createCategoryBudgetsTable()
+
+	// Envelope mode
+	createEnvelopeTables()
+	if err := common.EnsureIdempotencyTable(db); err != nil {
+		log.Fatalf("Failed to create idempotency table: %v", err)
+	}
+	if err := common.EnsureBillPaymentAmountColumns(db); err != nil {
+		log.Fatalf("Failed to add bill payment amount columns: %v", err)
+	}
+	if err := common.EnsureOutboxTable(db); err != nil {
+		log.Fatalf("Failed to create outbox table: %v", err)
+	}
 }
 
 func main() {
 	// Set up CORS middleware and routes
 	http.HandleFunc("/budget/fetch", corsMiddleware(handleFetchBudget))
-	http.HandleFunc("/budget/update", corsMiddleware(handleUpdateBudget))
+	http.HandleFunc("/budget/update", corsMiddleware(common.WithIdempotency(db, handleUpdateBudget)))
+	http.HandleFunc("/budget/categories", corsMiddleware(handleCategoryBudgets))
+	http.HandleFunc("/budget/categories/set", corsMiddleware(common.WithIdempotency(db, handleSetCategoryBudget)))
+	http.HandleFunc("/budget/envelopes", corsMiddleware(handleFetchEnvelopes))
+	http.HandleFunc("/budget/envelopes/enable", corsMiddleware(common.WithIdempotency(db, handleEnableEnvelopes)))
+	http.HandleFunc("/budget/envelopes/disable", corsMiddleware(common.WithIdempotency(db, handleDisableEnvelopes)))
+	http.HandleFunc("/budget/envelopes/assign", corsMiddleware(common.WithIdempotency(db, handleAssignEnvelope)))
+	http.HandleFunc("/budget/envelopes/move", corsMiddleware(common.WithIdempotency(db, handleMoveEnvelope)))
 
 	port := 8088
 	log.Printf("Budget Management service started on :%d", port)
@@ -134,7 +158,7 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// Set headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
 
 		// If it's OPTIONS, return with just the headers (preflight request)
 		if r.Method == "OPTIONS" {
@@ -216,7 +240,7 @@ func handleUpdateBudget(w http.ResponseWriter, r *http.Request) {
 	budget := BudgetData{
 		UserID:          updateRequest.UserID,
 		Period:          updateRequest.Period,
-		Date:            time.Now().Format("2006-01-02"),
+		Date:            common.UserToday(db, updateRequest.UserID),
 		TotalAmount:     totalAvailable,
 		RemainingAmount: remainingAmount,
 		SpentAmount:     updateRequest.SpentAmount,
@@ -265,7 +289,7 @@ func fetchBudgetData(userID, period string) (BudgetData, error) {
 		// Return default values if no data found
 		budget.UserID = userID
 		budget.Period = period
-		budget.Date = time.Now().Format("2006-01-02")
+		budget.Date = common.UserToday(db, userID)
 		budget.TotalAmount = 0
 		budget.RemainingAmount = 0
 		budget.SpentAmount = 0
@@ -300,7 +324,7 @@ func getPreviousPeriodData(userID, currentPeriod string) (string, float64) {
 	var previousPeriod string
 	var queryDateCondition string
 
-	now := time.Now()
+	now := common.UserNow(db, userID)
 
 	switch currentPeriod {
 	case "daily":
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// billOccurrence is one unpaid occurrence of a bill
+type billOccurrence struct {
+	BillID        int
+	Name          string
+	Category      string
+	Icon          string
+	Recurring     bool
+	Key           string // year_month in bill_payments
+	DueDate       time.Time
+	Amount        float64 // What is left to pay
+	PaymentMethod string
+	OverdueDays   int // Days since the due date, 0 while it is not overdue
+}
+
+// unpaidBillOccurrences mirrors common.UnpaidBillOccurrences, which this module cannot import,
+// from the stored rows: the occurrences are the unpaid bill_payments rows, which bills_management
+// keeps created three months ahead for scheduled bills, and a bill without any row (a batch
+// bill) counts once, on its due date. The amount of a row is its own amount, or the bill's, less
+// what has been paid of it. They are returned oldest first, due on or before until,
+// with the overdue days counted against today, the user's current day.
+func unpaidBillOccurrences(userID string, today, until time.Time) ([]billOccurrence, error) {
+	rows, err := db.Query(`
+		SELECT b.id, b.name, MAX(COALESCE(bp.amount, b.amount) - COALESCE(bp.paid_amount, 0), 0),
+		       COALESCE(NULLIF(bp.payment_method, ''), b.payment_method, 'bank'),
+		       COALESCE(b.category, ''), COALESCE(b.icon, ''), COALESCE(b.recurring, 0), bp.year_month,
+		       COALESCE(bp.due_date, ''), COALESCE(b.payment_day, 0), COALESCE(NULLIF(b.start_date, ''), b.due_date, '')
+		FROM bill_payments bp
+		JOIN bills b ON b.id = bp.bill_id
+		WHERE b.user_id = ? AND b.paid = 0 AND bp.paid = 0
+		UNION ALL
+		SELECT b.id, b.name, b.amount, COALESCE(b.payment_method, 'bank'),
+		       COALESCE(b.category, ''), COALESCE(b.icon, ''), COALESCE(b.recurring, 0), substr(b.due_date, 1, 7),
+		       b.due_date, 0, b.due_date
+		FROM bills b
+		WHERE b.user_id = ? AND b.paid = 0 AND b.due_date IS NOT NULL
+		  AND NOT EXISTS (SELECT 1 FROM bill_payments bp WHERE bp.bill_id = b.id)
+	`, userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unpaid bills: %v", err)
+	}
+	defer rows.Close()
+
+	occurrences := []billOccurrence{}
+	for rows.Next() {
+		var o billOccurrence
+		var dueDate, startDate string
+		var paymentDay int
+		err := rows.Scan(&o.BillID, &o.Name, &o.Amount, &o.PaymentMethod, &o.Category, &o.Icon, &o.Recurring,
+			&o.Key, &dueDate, &paymentDay, &startDate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan bill: %v", err)
+		}
+
+		o.DueDate, err = occurrenceDueDate(o.Key, dueDate, paymentDay, startDate)
+		if err != nil {
+			log.Printf("Warning: skipping occurrence %s of bill %d: %v", o.Key, o.BillID, err)
+			continue
+		}
+		if o.DueDate.After(until) {
+			continue
+		}
+		if o.DueDate.Before(today) {
+			o.OverdueDays = int(today.Sub(o.DueDate).Hours() / 24)
+		}
+		occurrences = append(occurrences, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query unpaid bills: %v", err)
+	}
+
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].DueDate.Before(occurrences[j].DueDate)
+	})
+	return occurrences, nil
+}
+
+// occurrenceDueDate returns the stored due date of an occurrence or, for payments created
+// before due dates were stored, the bill's payment day within the occurrence's month
+// (0 is the day of the start date, -1 the last day of the month), as common does
+func occurrenceDueDate(key, dueDate string, paymentDay int, startDate string) (time.Time, error) {
+	if dueDate != "" {
+		return time.Parse("2006-01-02", dueDate[:min(len(dueDate), 10)])
+	}
+	if len(key) == len("2006-01-02") {
+		return time.Parse("2006-01-02", key)
+	}
+
+	month, err := time.Parse("2006-01", key)
+	if err != nil {
+		return month, err
+	}
+	lastDay := month.AddDate(0, 1, -1).Day()
+	day := paymentDay
+	if day == 0 {
+		start, err := time.Parse("2006-01-02", startDate[:min(len(startDate), 10)])
+		if err != nil {
+			return start, err
+		}
+		day = start.Day()
+	}
+	if day < 0 || day > lastDay {
+		day = lastDay
+	}
+	return time.Date(month.Year(), month.Month(), day, 0, 0, 0, 0, time.UTC), nil
+}
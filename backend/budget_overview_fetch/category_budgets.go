@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"math"
+	"strings"
+)
+
+// OverBudgetCategory is an expense category whose spending in the period exceeds its limit.
+// Limits are managed by budget_management (/budget/categories).
+type OverBudgetCategory struct {
+	CategoryID  int     `json:"category_id"`
+	Name        string  `json:"name"`
+	Emoji       string  `json:"emoji"`
+	Limit       float64 `json:"limit"`
+	Spent       float64 `json:"spent"`
+	Exceeded    float64 `json:"exceeded"`
+	PercentUsed float64 `json:"percent_used"`
+}
+
+type overviewCategory struct {
+	name     string
+	emoji    string
+	parentID int
+	spent    float64
+}
+
+// fetchOverBudgetCategories returns the categories over their limit for the period.
+// A category's spending includes its subcategories, as in /budget/categories.
+func fetchOverBudgetCategories(userID, period, date string) []OverBudgetCategory {
+	overBudget := []OverBudgetCategory{}
+
+	startDate, endDate, err := calculatePeriodDateRangeWithBase(loadPeriodSettings(userID), period, date)
+	if err != nil {
+		log.Printf("Error calculating date range for category budgets: %v", err)
+		return overBudget
+	}
+
+	// The table only exists once budget_management has created it
+	limits := map[int]float64{}
+	rows, err := db.Query(`SELECT category_id, amount FROM category_budgets WHERE user_id = ? AND period = ?`, userID, period)
+	if err != nil {
+		return overBudget
+	}
+	for rows.Next() {
+		var categoryID int
+		var amount float64
+		if rows.Scan(&categoryID, &amount) == nil {
+			limits[categoryID] = amount
+		}
+	}
+	rows.Close()
+	if len(limits) == 0 {
+		return overBudget
+	}
+
+	categories := map[int]*overviewCategory{}
+	byName := map[string]*overviewCategory{}
+	rows, err = db.Query(`
+		SELECT id, name, emoji, COALESCE(parent_id, 0) FROM categories
+		WHERE user_id = ? AND type = 'expense'
+	`, userID)
+	if err != nil {
+		log.Printf("Error fetching categories for budgets: %v", err)
+		return overBudget
+	}
+	for rows.Next() {
+		var id int
+		category := &overviewCategory{}
+		if rows.Scan(&id, &category.name, &category.emoji, &category.parentID) != nil {
+			continue
+		}
+		categories[id] = category
+		if _, exists := byName[strings.ToLower(category.name)]; !exists {
+			byName[strings.ToLower(category.name)] = category
+		}
+	}
+	rows.Close()
+
+	rows, err = db.Query(`
+		SELECT COALESCE(category_id, 0), category, COALESCE(SUM(amount), 0) FROM expenses
+		WHERE user_id = ? AND date >= ? AND date <= ?
+		GROUP BY COALESCE(category_id, 0), category
+	`, userID, startDate, endDate)
+	if err != nil {
+		log.Printf("Error fetching category spending: %v", err)
+		return overBudget
+	}
+	for rows.Next() {
+		var categoryID int
+		var name string
+		var amount float64
+		if rows.Scan(&categoryID, &name, &amount) != nil {
+			continue
+		}
+		if category, ok := categories[categoryID]; ok {
+			category.spent += amount
+		} else if category, ok := byName[strings.ToLower(name)]; ok {
+			category.spent += amount
+		}
+	}
+	rows.Close()
+
+	for categoryID, limit := range limits {
+		category, ok := categories[categoryID]
+		if !ok {
+			continue
+		}
+
+		// Spending of the category and all its descendants
+		spent := 0.0
+		for _, candidate := range categories {
+			current := candidate
+			for depth := 0; current != nil && depth <= len(categories); depth++ {
+				if current == category {
+					spent += candidate.spent
+					break
+				}
+				current = categories[current.parentID]
+			}
+		}
+		spent = math.Round(spent*100) / 100
+
+		if spent > limit {
+			item := OverBudgetCategory{
+				CategoryID: categoryID,
+				Name:       category.name,
+				Emoji:      decodeCategoryEmoji(category.emoji),
+				Limit:      limit,
+				Spent:      spent,
+				Exceeded:   math.Round((spent-limit)*100) / 100,
+			}
+			if limit > 0 {
+				item.PercentUsed = math.Round(spent/limit*10000) / 100
+			}
+			overBudget = append(overBudget, item)
+		}
+	}
+
+	return overBudget
+}
+
+// decodeCategoryEmoji undoes the "BASE64:" encoding used by categories_management
+func decodeCategoryEmoji(encoded string) string {
+	if !strings.HasPrefix(encoded, "BASE64:") {
+		return encoded
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, "BASE64:"))
+	if err != nil {
+		return encoded
+	}
+	return string(decoded)
+}
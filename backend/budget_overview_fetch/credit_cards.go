@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"math"
+)
+
+// fetchCreditCardSpending returns the credit card purchases made within the period.
+// They count as spending when made, although they only leave the bank when the statement is paid.
+func fetchCreditCardSpending(userID, period, date string) float64 {
+	startDate, endDate, err := calculatePeriodDateRangeWithBase(loadPeriodSettings(userID), period, date)
+	if err != nil {
+		log.Printf("Error calculating date range for card spending: %v", err)
+		return 0
+	}
+
+	var spending float64
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0) FROM expenses
+		WHERE user_id = ? AND payment_method = 'credit_card' AND date >= ? AND date <= ?
+	`, userID, startDate, endDate).Scan(&spending)
+	if err != nil {
+		log.Printf("Error fetching credit card spending: %v", err)
+		return 0
+	}
+
+	return spending
+}
+
+// fetchCreditCardDebt returns the outstanding credit card debt: purchases minus statement payments
+func fetchCreditCardDebt(userID string) float64 {
+	var purchases, payments float64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0) FROM expenses
+		WHERE user_id = ? AND payment_method = 'credit_card'
+	`, userID).Scan(&purchases)
+	if err != nil {
+		log.Printf("Error fetching credit card purchases: %v", err)
+		return 0
+	}
+
+	// The statements table only exists once cash_bank_management has created it
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(paid_amount), 0) FROM credit_card_statements WHERE user_id = ?
+	`, userID).Scan(&payments)
+	if err != nil {
+		payments = 0
+	}
+
+	return math.Round((purchases-payments)*100) / 100
+}
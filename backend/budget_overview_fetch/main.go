@@ -32,6 +32,8 @@ type BudgetOverview struct {
 	CashBankDistribution CashBankDistribution `json:"cash_bank_distribution"`
 	SavingsData          SavingsData          `json:"savings_data"`
 	AvailableBalance     float64              `json:"available_balance"`
+	CreditCardDebt       float64              `json:"credit_card_debt"` // Outstanding card debt, not yet paid from the bank
+	OverBudgetCategories []OverBudgetCategory `json:"over_budget_categories"`
 }
 
 // MoneyFlow represents money flow from previous period
@@ -80,6 +82,7 @@ type CashBankDistribution struct {
 	BankAmount  float64 `json:"bank_amount"`
 	BankPercent float64 `json:"bank_percent"`
 	TotalAmount float64 `json:"total_amount"`
+	CardDebt    float64 `json:"credit_card_debt"`
 }
 
 // SavingsData represents savings information
@@ -107,6 +110,8 @@ type Transaction struct {
 	OverdueDays   *int    `json:"overdue_days,omitempty"` // For bills (pointer to handle null)
 	Recurring     *bool   `json:"recurring,omitempty"`    // For bills (pointer to handle null)
 	Icon          string  `json:"icon,omitempty"`         // For bills
+
+	OccurrenceKey string `json:"occurrence_key,omitempty"` // For bills, the period the due date belongs to
 }
 
 // TransactionRequest represents the request structure for transaction queries
@@ -243,7 +248,8 @@ func handleBudgetOverview(w http.ResponseWriter, r *http.Request) {
 
 	if request.Date == "" {
 		// Default to current date/period
-		request.Date = formatDateForPeriod(time.Now(), request.Period)
+		settings := loadPeriodSettings(request.UserID)
+		request.Date = settings.identifier(settings.now(), request.Period)
 	}
 
 	// Fetch budget overview data
@@ -413,8 +419,12 @@ func calculateBudgetOverview(data *BalanceData, period, date, userID string) *Bu
 	// Calculate spent amount from actual expenses only (not including bills)
 	spentAmount := data.ExpenseBankAmount + data.ExpenseCashAmount
 
+	// Credit card purchases count as spending when made, even if the statement is still unpaid
+	cardSpending := fetchCreditCardSpending(userID, period, date)
+	spentAmount += cardSpending
+
 	// Calculate combined expense including both expenses and bills
-	combinedExpense := data.ExpenseBankAmount + data.ExpenseCashAmount + data.BillBankAmount + data.BillCashAmount
+	combinedExpense := data.ExpenseBankAmount + data.ExpenseCashAmount + data.BillBankAmount + data.BillCashAmount + cardSpending
 
 	// Calculate available balance
 	availableBalance := totalIncome - combinedExpense
@@ -426,8 +436,8 @@ func calculateBudgetOverview(data *BalanceData, period, date, userID string) *Bu
 	log.Printf("🧮 Budget calculation breakdown for period %s, date %s:", period, date)
 	log.Printf("   💰 Total Income: %.2f (Bank: %.2f + Cash: %.2f)",
 		totalIncome, data.IncomeBankAmount, data.IncomeCashAmount)
-	log.Printf("   💸 Spent Amount (expenses only): %.2f (Bank: %.2f + Cash: %.2f)",
-		spentAmount, data.ExpenseBankAmount, data.ExpenseCashAmount)
+	log.Printf("   💸 Spent Amount (expenses only): %.2f (Bank: %.2f + Cash: %.2f + Card: %.2f)",
+		spentAmount, data.ExpenseBankAmount, data.ExpenseCashAmount, cardSpending)
 	log.Printf("   🏷️ Bills Amount: %.2f (Bank: %.2f + Cash: %.2f)",
 		data.BillBankAmount+data.BillCashAmount, data.BillBankAmount, data.BillCashAmount)
 	log.Printf("   📊 Combined Expense (expenses + bills): %.2f", combinedExpense)
@@ -470,6 +480,10 @@ func calculateBudgetOverview(data *BalanceData, period, date, userID string) *Bu
 	// Calculate cash/bank distribution based on current balances
 	cashBankDistribution := calculateCashBankDistribution(data)
 
+	// Card debt is shown apart from cash and bank
+	creditCardDebt := fetchCreditCardDebt(userID)
+	cashBankDistribution.CardDebt = creditCardDebt
+
 	// Get savings data
 	savingsData := getSavingsDataFromDB(userID, remainingAmount, period)
 
@@ -489,6 +503,8 @@ func calculateBudgetOverview(data *BalanceData, period, date, userID string) *Bu
 		CashBankDistribution: cashBankDistribution,
 		SavingsData:          savingsData,
 		AvailableBalance:     availableBalance,
+		CreditCardDebt:       creditCardDebt,
+		OverBudgetCategories: fetchOverBudgetCategories(userID, period, date),
 	}
 }
 
@@ -906,7 +922,7 @@ func handleTransactionHistory(w http.ResponseWriter, r *http.Request) {
 
 	// Calculate date range if period is specified
 	if request.Period != "" && request.StartDate == "" && request.EndDate == "" {
-		startDate, endDate, err := calculatePeriodDateRangeWithBase(request.Period, request.Date)
+		startDate, endDate, err := calculatePeriodDateRangeWithBase(loadPeriodSettings(request.UserID), request.Period, request.Date)
 		if err != nil {
 			log.Printf("Error calculating period date range: %v", err)
 			sendErrorResponse(w, "Invalid period specified", http.StatusBadRequest)
@@ -949,7 +965,7 @@ func handleUpcomingBills(w http.ResponseWriter, r *http.Request) {
 
 	// Calculate date range if period is specified
 	if request.Period != "" && request.StartDate == "" && request.EndDate == "" {
-		startDate, endDate, err := calculatePeriodDateRangeWithBase(request.Period, request.Date)
+		startDate, endDate, err := calculatePeriodDateRangeWithBase(loadPeriodSettings(request.UserID), request.Period, request.Date)
 		if err != nil {
 			log.Printf("Error calculating period date range: %v", err)
 			sendErrorResponse(w, "Invalid period specified", http.StatusBadRequest)
@@ -972,11 +988,12 @@ func handleUpcomingBills(w http.ResponseWriter, r *http.Request) {
 
 // calculatePeriodDateRange calculates start and end dates for a given period
 func calculatePeriodDateRange(period string) (string, string, error) {
-	return calculatePeriodDateRangeWithBase(period, "")
+	return calculatePeriodDateRangeWithBase(defaultPeriodSettings, period, "")
 }
 
-// calculatePeriodDateRangeWithBase calculates start and end dates for a given period with optional base date
-func calculatePeriodDateRangeWithBase(period, baseDate string) (string, string, error) {
+// calculatePeriodDateRangeWithBase calculates start and end dates for a given period with optional base date,
+// following the user's month and week start
+func calculatePeriodDateRangeWithBase(settings periodSettings, period, baseDate string) (string, string, error) {
 	var baseTime time.Time
 	var err error
 
@@ -985,49 +1002,17 @@ func calculatePeriodDateRangeWithBase(period, baseDate string) (string, string,
 		baseTime, err = parseDateString(baseDate, period)
 		if err != nil {
 			log.Printf("Error parsing base date %s for period %s: %v", baseDate, period, err)
-			baseTime = time.Now()
+			baseTime = settings.now()
 		}
 	} else {
-		baseTime = time.Now()
+		baseTime = settings.now()
 	}
 
-	var startDate, endDate time.Time
-
-	switch period {
-	case "daily":
-		startDate = time.Date(baseTime.Year(), baseTime.Month(), baseTime.Day(), 0, 0, 0, 0, baseTime.Location())
-		endDate = startDate.AddDate(0, 0, 1).Add(-time.Second)
-	case "weekly":
-		// Start of week (Monday) for the base date
-		weekday := int(baseTime.Weekday())
-		if weekday == 0 {
-			weekday = 7 // Sunday = 7
-		}
-		startDate = baseTime.AddDate(0, 0, -(weekday - 1))
-		startDate = time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, startDate.Location())
-		endDate = startDate.AddDate(0, 0, 7).Add(-time.Second)
-	case "monthly":
-		startDate = time.Date(baseTime.Year(), baseTime.Month(), 1, 0, 0, 0, 0, baseTime.Location())
-		endDate = startDate.AddDate(0, 1, 0).Add(-time.Second)
-	case "quarterly":
-		quarter := ((baseTime.Month() - 1) / 3) + 1
-		startMonth := (quarter-1)*3 + 1
-		startDate = time.Date(baseTime.Year(), time.Month(startMonth), 1, 0, 0, 0, 0, baseTime.Location())
-		endDate = startDate.AddDate(0, 3, 0).Add(-time.Second)
-	case "semiannual":
-		var startMonth time.Month
-		if baseTime.Month() <= 6 {
-			startMonth = 1
-		} else {
-			startMonth = 7
-		}
-		startDate = time.Date(baseTime.Year(), startMonth, 1, 0, 0, 0, 0, baseTime.Location())
-		endDate = startDate.AddDate(0, 6, 0).Add(-time.Second)
-	case "annual":
-		startDate = time.Date(baseTime.Year(), 1, 1, 0, 0, 0, 0, baseTime.Location())
-		endDate = startDate.AddDate(1, 0, 0).Add(-time.Second)
-	default:
-		return "", "", fmt.Errorf("invalid period: %s", period)
+	// parseDateString returns the first calendar day of the labelled period, which always
+	// falls inside the user's cycle with the same label
+	startDate, endDate, err := settings.dateRange(period, baseTime)
+	if err != nil {
+		return "", "", err
 	}
 
 	return startDate.Format("2006-01-02"), endDate.Format("2006-01-02"), nil
@@ -1210,86 +1195,68 @@ func fetchTransactionHistory(request TransactionRequest) (*TransactionHistoryRes
 	}, nil
 }
 
-// fetchUpcomingBills retrieves upcoming (unpaid) bills from the database
+// fetchUpcomingBills lists the unpaid occurrences of the user's bills due in the requested
+// range, each flagged as overdue from its due date and the user's current day, so the counters
+// are right even between runs of the bills_management overdue job. Overdue occurrences are
+// listed whatever the start date, since they are still owed. Without an end date the list
+// covers the next month.
 func fetchUpcomingBills(request TransactionRequest) (*UpcomingBillsResponse, error) {
-	// Build the WHERE clause for filtering
-	whereConditions := []string{"user_id = ?", "paid = 0"}
-	args := []interface{}{request.UserID}
-
-	// Add date range filter
-	if request.StartDate != "" && request.EndDate != "" {
-		whereConditions = append(whereConditions, "due_date BETWEEN ? AND ?")
-		args = append(args, request.StartDate, request.EndDate)
-	} else if request.StartDate != "" {
-		whereConditions = append(whereConditions, "due_date >= ?")
-		args = append(args, request.StartDate)
-	} else if request.EndDate != "" {
-		whereConditions = append(whereConditions, "due_date <= ?")
-		args = append(args, request.EndDate)
+	// Due dates are calendar days, compared against today in the user's time zone
+	now := loadPeriodSettings(request.UserID).now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	weekFromNow := today.AddDate(0, 0, 7)
+	monthFromNow := today.AddDate(0, 1, 0)
+
+	until := monthFromNow
+	if request.EndDate != "" {
+		var err error
+		if until, err = time.Parse("2006-01-02", request.EndDate); err != nil {
+			return nil, fmt.Errorf("invalid end date %s: %v", request.EndDate, err)
+		}
 	}
-
-	// Build the query
-	query := fmt.Sprintf(`
-		SELECT 
-			id, name, amount, due_date, paid, overdue, overdue_days, recurring, category, icon
-		FROM bills 
-		WHERE %s 
-		ORDER BY due_date ASC`, strings.Join(whereConditions, " AND "))
-
-	rows, err := db.Query(query, args...)
+	occurrences, err := unpaidBillOccurrences(request.UserID, today, until)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query upcoming bills: %v", err)
+		return nil, err
 	}
-	defer rows.Close()
 
-	var bills []Transaction
+	bills := []Transaction{}
 	var overdue, upcoming, thisWeek, thisMonth int
-	now := time.Now()
-	weekFromNow := now.AddDate(0, 0, 7)
-	monthFromNow := now.AddDate(0, 1, 0)
-
-	for rows.Next() {
-		var t Transaction
-		var paid, overdueFlag, recurring bool
-		var overdueDays int
-
-		err := rows.Scan(
-			&t.ID, &t.Name, &t.Amount, &t.Date, &paid, &overdueFlag, &overdueDays,
-			&recurring, &t.Category, &t.Icon,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan bill: %v", err)
-		}
-
-		// Set transaction type and bill-specific fields
-		t.Type = "bill"
-		t.PaymentMethod = "cash" // Default value since bills table doesn't have payment_method
-		t.Paid = &paid
-		t.Overdue = &overdueFlag
-		t.Recurring = &recurring
-		t.OverdueDays = &overdueDays
-
-		// Parse due date for categorization
-		dueDate, err := time.Parse("2006-01-02", t.Date)
-		if err != nil {
-			log.Printf("Warning: failed to parse due date %s: %v", t.Date, err)
+	for _, occurrence := range occurrences {
+		dueDate := occurrence.DueDate.Format("2006-01-02")
+		isOverdue := occurrence.OverdueDays > 0
+		if !isOverdue && request.StartDate != "" && dueDate < request.StartDate {
 			continue
 		}
 
+		paid, recurring, overdueDays := false, occurrence.Recurring, occurrence.OverdueDays
+		bills = append(bills, Transaction{
+			ID:            occurrence.BillID,
+			Type:          "bill",
+			Amount:        occurrence.Amount,
+			Date:          dueDate,
+			Category:      occurrence.Category,
+			PaymentMethod: occurrence.PaymentMethod,
+			Name:          occurrence.Name,
+			Paid:          &paid,
+			Overdue:       &isOverdue,
+			OverdueDays:   &overdueDays,
+			Recurring:     &recurring,
+			Icon:          occurrence.Icon,
+			OccurrenceKey: occurrence.Key,
+		})
+
 		// Categorize bills
-		if overdueFlag {
+		if isOverdue {
 			overdue++
 		} else {
 			upcoming++
-			if dueDate.Before(weekFromNow) {
+			if occurrence.DueDate.Before(weekFromNow) {
 				thisWeek++
 			}
-			if dueDate.Before(monthFromNow) {
+			if occurrence.DueDate.Before(monthFromNow) {
 				thisMonth++
 			}
 		}
-
-		bills = append(bills, t)
 	}
 
 	return &UpcomingBillsResponse{
@@ -1360,46 +1327,43 @@ func fetchPaidBillsAmount(userID, period, date string) (float64, float64, error)
 	return bankAmount, cashAmount, nil
 }
 
-// fetchUnpaidBillsAmount retrieves the total amount of unpaid bills for a specific period and date
+// fetchUnpaidBillsAmount retrieves what is left to pay of the unpaid bill occurrences due in a
+// specific period and date, split by payment method. Occurrences with their own amount and
+// partially paid ones count for what is still due.
 func fetchUnpaidBillsAmount(userID, period, date string) (float64, float64, error) {
 	var bankAmount, cashAmount float64
-	var dateCondition string
 
-	// Build date condition based on period type (same logic as paid bills)
 	switch period {
-	case "daily":
-		dateCondition = "due_date = ?"
-	case "weekly":
-		dateCondition = "strftime('%Y-%W', due_date) = ?"
-	case "monthly":
-		dateCondition = "strftime('%Y-%m', due_date) = ?"
-	case "quarterly":
-		dateCondition = "strftime('%Y', due_date) || '-' || CASE WHEN CAST(strftime('%m', due_date) AS INTEGER) BETWEEN 1 AND 3 THEN '1' WHEN CAST(strftime('%m', due_date) AS INTEGER) BETWEEN 4 AND 6 THEN '2' WHEN CAST(strftime('%m', due_date) AS INTEGER) BETWEEN 7 AND 9 THEN '3' ELSE '4' END = ?"
-	case "semiannual":
-		dateCondition = "strftime('%Y', due_date) || '-' || CASE WHEN CAST(strftime('%m', due_date) AS INTEGER) BETWEEN 1 AND 6 THEN '1' ELSE '2' END = ?"
-	case "annual":
-		dateCondition = "strftime('%Y', due_date) = ?"
+	case "daily", "weekly", "monthly", "quarterly", "semiannual", "annual":
 	default:
-		dateCondition = "strftime('%Y-%m', due_date) = ?"
+		period = "monthly"
+	}
+	baseTime, err := parseDateString(date, period)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid date %s for period %s: %v", date, period, err)
+	}
+	settings := loadPeriodSettings(userID)
+	startDate, endDate, err := settings.dateRange(period, baseTime)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	query := fmt.Sprintf(`
-		SELECT 
-			COALESCE(SUM(CASE WHEN payment_method = 'bank' THEN amount ELSE 0 END), 0) as bank_amount,
-			COALESCE(SUM(CASE WHEN payment_method = 'cash' THEN amount ELSE 0 END), 0) as cash_amount
-		FROM bills 
-		WHERE user_id = ? AND paid = 0 AND %s
-	`, dateCondition)
-
-	row := db.QueryRow(query, userID, date)
-	err := row.Scan(&bankAmount, &cashAmount)
-
+	now := settings.now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	occurrences, err := unpaidBillOccurrences(userID, today, endDate)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, 0, nil
-		}
 		return 0, 0, fmt.Errorf("failed to fetch unpaid bills: %v", err)
 	}
+	for _, occurrence := range occurrences {
+		if occurrence.DueDate.Before(startDate) {
+			continue
+		}
+		if occurrence.PaymentMethod == "cash" {
+			cashAmount += occurrence.Amount
+		} else {
+			bankAmount += occurrence.Amount
+		}
+	}
 
 	log.Printf("⏳ Unpaid bills for %s %s: Bank=%.2f, Cash=%.2f", period, date, bankAmount, cashAmount)
 	return bankAmount, cashAmount, nil
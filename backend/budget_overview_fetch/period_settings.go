@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// periodSettings mirrors common.PeriodSettings and common.UserLocation, which this module
+// cannot import. A month starting on day 25 runs from the 25th to the 24th and is labelled
+// with the month it ends in; quarters, halves and years are built from those months. Weeks
+// start on weekStartDay and are identified by the ISO week of their Monday.
+type periodSettings struct {
+	monthStartDay int
+	weekStartDay  time.Weekday
+	location      *time.Location // user's time zone; nil means the server's
+}
+
+// defaultPeriodSettings are calendar months and ISO weeks
+var defaultPeriodSettings = periodSettings{monthStartDay: 1, weekStartDay: time.Monday}
+
+// loadPeriodSettings reads the user's settings from user_period_settings and their time zone
+// from users, falling back to the defaults
+func loadPeriodSettings(userID string) periodSettings {
+	settings := defaultPeriodSettings
+	var weekStart int
+	err := db.QueryRow(`
+		SELECT month_start_day, week_start_day FROM user_period_settings WHERE user_id = ?
+	`, userID).Scan(&settings.monthStartDay, &weekStart)
+	if err == nil {
+		settings.weekStartDay = time.Weekday(weekStart)
+	} else {
+		if !strings.Contains(err.Error(), "no rows") && !strings.Contains(err.Error(), "no such table") {
+			log.Printf("Error fetching period settings for user %s: %v", userID, err)
+		}
+		settings = defaultPeriodSettings
+	}
+
+	var timezone sql.NullString
+	if db.QueryRow(`SELECT timezone FROM users WHERE id = ?`, userID).Scan(&timezone) == nil && timezone.Valid {
+		if location, err := time.LoadLocation(timezone.String); err == nil && timezone.String != "" {
+			settings.location = location
+		}
+	}
+	return settings
+}
+
+// now returns the current time in the user's time zone
+func (s periodSettings) now() time.Time {
+	if s.location == nil {
+		return time.Now()
+	}
+	return time.Now().In(s.location)
+}
+
+// isDefault reports whether the user has calendar months and ISO weeks
+func (s periodSettings) isDefault() bool {
+	return s.monthStartDay == defaultPeriodSettings.monthStartDay && s.weekStartDay == defaultPeriodSettings.weekStartDay
+}
+
+// monthLabel returns the first day of the month that labels the cycle containing date
+func (s periodSettings) monthLabel(date time.Time) time.Time {
+	label := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if s.monthStartDay > 1 && date.Day() >= s.monthStartDay {
+		label = label.AddDate(0, 1, 0)
+	}
+	return label
+}
+
+// cycleStart returns the first day of the cycle labelled with label's month
+func (s periodSettings) cycleStart(label time.Time) time.Time {
+	if s.monthStartDay > 1 {
+		return time.Date(label.Year(), label.Month()-1, s.monthStartDay, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(label.Year(), label.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// weekStart returns the first day of the week containing date
+func (s periodSettings) weekStart(date time.Time) time.Time {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	offset := (int(day.Weekday()) - int(s.weekStartDay) + 7) % 7
+	return day.AddDate(0, 0, -offset)
+}
+
+// identifier returns the period identifier stored in the *_cash_bank_balance tables
+func (s periodSettings) identifier(date time.Time, period string) string {
+	if s.isDefault() {
+		return formatDateForPeriod(date, period)
+	}
+
+	label := s.monthLabel(date)
+	switch period {
+	case "daily":
+		return date.Format("2006-01-02")
+	case "weekly":
+		start := s.weekStart(date)
+		monday := start.AddDate(0, 0, (int(time.Monday)-int(start.Weekday())+7)%7)
+		year, week := monday.ISOWeek()
+		return fmt.Sprintf("%d-%02d", year, week)
+	case "quarterly":
+		return fmt.Sprintf("%d-Q%d", label.Year(), (int(label.Month())-1)/3+1)
+	case "semiannual":
+		return fmt.Sprintf("%d-H%d", label.Year(), (int(label.Month())-1)/6+1)
+	case "annual":
+		return label.Format("2006")
+	default:
+		return label.Format("2006-01")
+	}
+}
+
+// dateRange returns the first and last day of the period containing date
+func (s periodSettings) dateRange(period string, date time.Time) (time.Time, time.Time, error) {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	label := s.monthLabel(day)
+
+	var firstMonth time.Time
+	var months int
+	switch period {
+	case "daily":
+		return day, day, nil
+	case "weekly":
+		start := s.weekStart(day)
+		return start, start.AddDate(0, 0, 6), nil
+	case "monthly":
+		firstMonth, months = label, 1
+	case "quarterly":
+		firstMonth = time.Date(label.Year(), time.Month((int(label.Month())-1)/3*3+1), 1, 0, 0, 0, 0, time.UTC)
+		months = 3
+	case "semiannual":
+		firstMonth = time.Date(label.Year(), time.Month((int(label.Month())-1)/6*6+1), 1, 0, 0, 0, 0, time.UTC)
+		months = 6
+	case "annual":
+		firstMonth, months = time.Date(label.Year(), 1, 1, 0, 0, 0, 0, time.UTC), 12
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid period: %s", period)
+	}
+
+	return s.cycleStart(firstMonth), s.cycleStart(firstMonth.AddDate(0, months, 0)).AddDate(0, 0, -1), nil
+}
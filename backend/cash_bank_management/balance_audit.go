@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"hero_budget_backend/common"
+)
+
+// RebuildBalancesRequest selects the users to audit; an empty user_id audits every user.
+// Without apply the drifted rows are only reported.
+type RebuildBalancesRequest struct {
+	UserID string `json:"user_id"`
+	Apply  bool   `json:"apply"`
+}
+
+// handleRebuildBalances recomputes the period balance tables from the raw movements and
+// reports, and optionally repairs, every row that drifted
+func handleRebuildBalances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request RebuildBalancesRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	report, err := common.AuditPeriodBalances(db, request.UserID, request.Apply)
+	if err != nil {
+		log.Printf("Error rebuilding period balances: %v", err)
+		sendErrorResponse(w, "Error rebuilding period balances", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Period balances audited for %d users: %d drifted rows (apply=%t)", report.Users, len(report.Drifts), report.Applied)
+	message := fmt.Sprintf("%d drifted rows found", len(report.Drifts))
+	if report.Applied {
+		message = fmt.Sprintf("%d drifted rows repaired", len(report.Drifts))
+	}
+	sendSuccessResponse(w, message, report)
+}
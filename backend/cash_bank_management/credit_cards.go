@@ -0,0 +1,719 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+// Credit cards are liability accounts: purchases count as expenses when they are made,
+// but money only leaves the bank when the cycle's statement is paid
+type CreditCard struct {
+	ID              int     `json:"id"`
+	UserID          string  `json:"user_id"`
+	Name            string  `json:"name"`
+	CreditLimit     float64 `json:"credit_limit"`
+	ClosingDay      int     `json:"closing_day"`
+	DueDay          int     `json:"due_day"`
+	CurrentDebt     float64 `json:"current_debt"`
+	CycleSpend      float64 `json:"cycle_spend"`
+	NextClosing     string  `json:"next_closing"`
+	AvailableCredit float64 `json:"available_credit"`
+}
+
+type CreditCardStatement struct {
+	ID             int     `json:"id"`
+	CardID         int     `json:"card_id"`
+	UserID         string  `json:"user_id"`
+	PeriodStart    string  `json:"period_start"`
+	PeriodEnd      string  `json:"period_end"`
+	DueDate        string  `json:"due_date"`
+	PurchasesCount int     `json:"purchases_count"`
+	Balance        float64 `json:"balance"`
+	PaidAmount     float64 `json:"paid_amount"`
+	Status         string  `json:"status"` // "open", "paid"
+	BillID         int     `json:"bill_id,omitempty"`
+	PaidAt         string  `json:"paid_at,omitempty"`
+}
+
+type AddCreditCardRequest struct {
+	UserID      string  `json:"user_id"`
+	Name        string  `json:"name"`
+	CreditLimit float64 `json:"credit_limit"`
+	ClosingDay  int     `json:"closing_day"`
+	DueDay      int     `json:"due_day"`
+}
+
+type CreditCardPurchaseRequest struct {
+	UserID      string  `json:"user_id"`
+	CardID      int     `json:"card_id"`
+	Amount      float64 `json:"amount"`
+	Date        string  `json:"date"`
+	Category    string  `json:"category"`
+	Description string  `json:"description,omitempty"`
+}
+
+// Errors of a statement payment that are not caused by the database
+var (
+	errStatementAlreadyPaid = errors.New("statement is already paid")
+	errStatementOverpayment = errors.New("amount exceeds the outstanding balance")
+	errStatementChanged     = errors.New("statement was paid by another request, fetch it again")
+)
+
+type PayStatementRequest struct {
+	UserID        string  `json:"user_id"`
+	StatementID   int     `json:"statement_id"`
+	Amount        float64 `json:"amount,omitempty"` // Defaults to the outstanding balance
+	Date          string  `json:"date,omitempty"`
+	PaymentMethod string  `json:"payment_method,omitempty"` // Defaults to "bank"
+}
+
+func createCreditCardTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS credit_cards (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			credit_limit REAL NOT NULL DEFAULT 0,
+			closing_day INTEGER NOT NULL,
+			due_day INTEGER NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create credit_cards table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS credit_card_statements (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			card_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			period_start TEXT NOT NULL,
+			period_end TEXT NOT NULL,
+			due_date TEXT NOT NULL,
+			purchases_count INTEGER NOT NULL DEFAULT 0,
+			balance REAL NOT NULL DEFAULT 0,
+			paid_amount REAL NOT NULL DEFAULT 0,
+			status TEXT NOT NULL DEFAULT 'open',
+			bill_id INTEGER,
+			paid_at TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(card_id, period_end),
+			FOREIGN KEY (card_id) REFERENCES credit_cards (id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create credit_card_statements table: %v", err)
+	}
+
+	// Card purchases are stored as expenses linked to the card
+	if _, err := db.Exec(`ALTER TABLE expenses ADD COLUMN credit_card_id INTEGER`); err != nil {
+		log.Printf("Note: credit_card_id column not added to expenses: %v", err)
+	}
+	if err := common.EnsureCategoryIDColumn(db, "expenses"); err != nil {
+		log.Printf("Note: category_id column not added to expenses: %v", err)
+	}
+
+	// Balance ledger and statement payment columns in the period tables
+	if err := common.EnsureLedgerTable(db); err != nil {
+		log.Printf("Error creating balance ledger: %v", err)
+	}
+
+	// Domain events written in the same transaction as each change
+	if err := common.EnsureOutboxTable(db); err != nil {
+		log.Printf("Error creating outbox: %v", err)
+	}
+}
+
+// cycleClosingDate returns the closing date of the cycle that contains date
+func cycleClosingDate(date time.Time, closingDay int) time.Time {
+	closing := time.Date(date.Year(), date.Month(), closingDay, 0, 0, 0, 0, time.UTC)
+	if date.Day() > closingDay {
+		closing = closing.AddDate(0, 1, 0)
+	}
+	return closing
+}
+
+// statementDueDate returns the due date of the statement closed on closing: the first dueDay after the closing date
+func statementDueDate(closing time.Time, dueDay int) time.Time {
+	due := time.Date(closing.Year(), closing.Month(), dueDay, 0, 0, 0, 0, time.UTC)
+	if !due.After(closing) {
+		due = due.AddDate(0, 1, 0)
+	}
+	return due
+}
+
+func handleAddCreditCard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var addRequest AddCreditCardRequest
+	if err := json.NewDecoder(r.Body).Decode(&addRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if addRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if addRequest.Name == "" {
+		sendErrorResponse(w, "Card name is required", http.StatusBadRequest)
+		return
+	}
+	if addRequest.ClosingDay < 1 || addRequest.ClosingDay > 28 {
+		sendErrorResponse(w, "Closing day must be between 1 and 28", http.StatusBadRequest)
+		return
+	}
+	if addRequest.DueDay < 1 || addRequest.DueDay > 28 {
+		sendErrorResponse(w, "Due day must be between 1 and 28", http.StatusBadRequest)
+		return
+	}
+	if addRequest.CreditLimit < 0 {
+		sendErrorResponse(w, "Credit limit must be greater than or equal to 0", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO credit_cards (user_id, name, credit_limit, closing_day, due_day)
+		VALUES (?, ?, ?, ?, ?)
+	`, addRequest.UserID, addRequest.Name, addRequest.CreditLimit, addRequest.ClosingDay, addRequest.DueDay)
+	if err != nil {
+		log.Printf("Error adding credit card: %v", err)
+		sendErrorResponse(w, "Error adding credit card", http.StatusInternalServerError)
+		return
+	}
+	cardID, _ := result.LastInsertId()
+
+	card, err := fetchCreditCard(int(cardID), addRequest.UserID)
+	if err != nil {
+		log.Printf("Error fetching credit card: %v", err)
+		sendErrorResponse(w, "Error fetching credit card", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Credit card added successfully", card)
+}
+
+func handleFetchCreditCards(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := generateDueStatements(userID, common.UserNow(db, userID)); err != nil {
+		log.Printf("Error generating credit card statements: %v", err)
+	}
+
+	rows, err := db.Query(`SELECT id FROM credit_cards WHERE user_id = ? ORDER BY id ASC`, userID)
+	if err != nil {
+		log.Printf("Error fetching credit cards: %v", err)
+		sendErrorResponse(w, "Error fetching credit cards", http.StatusInternalServerError)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	cards := []CreditCard{}
+	for _, id := range ids {
+		card, err := fetchCreditCard(id, userID)
+		if err != nil {
+			log.Printf("Error fetching credit card %d: %v", id, err)
+			continue
+		}
+		cards = append(cards, *card)
+	}
+
+	sendSuccessResponse(w, "Credit cards fetched successfully", cards)
+}
+
+func handleCreditCardPurchase(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var purchaseRequest CreditCardPurchaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&purchaseRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if purchaseRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if purchaseRequest.Amount <= 0 {
+		sendErrorResponse(w, "Amount must be greater than 0", http.StatusBadRequest)
+		return
+	}
+	if purchaseRequest.Category == "" {
+		sendErrorResponse(w, "Category is required", http.StatusBadRequest)
+		return
+	}
+	if purchaseRequest.Date == "" {
+		purchaseRequest.Date = common.UserToday(db, purchaseRequest.UserID)
+	}
+	if _, err := time.Parse("2006-01-02", purchaseRequest.Date); err != nil {
+		sendErrorResponse(w, "Date must use the YYYY-MM-DD format", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := fetchCreditCard(purchaseRequest.CardID, purchaseRequest.UserID); err != nil {
+		sendErrorResponse(w, "Credit card not found", http.StatusNotFound)
+		return
+	}
+
+	// The purchase is an expense from today, but it does not touch cash or bank. A cycle whose
+	// statement is already closed would never bill it, so those dates are rejected.
+	var expenseID int64
+	err := common.WithTx(db, func(tx *sql.Tx) error {
+		if err := common.CheckCardPurchaseDate(tx, int64(purchaseRequest.CardID), purchaseRequest.Date); err != nil {
+			return err
+		}
+		categoryID, err := common.ResolveCategoryID(tx, purchaseRequest.UserID, "expense", purchaseRequest.Category)
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec(`
+			INSERT INTO expenses (user_id, amount, date, category, category_id, payment_method, description, credit_card_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, purchaseRequest.UserID, purchaseRequest.Amount, purchaseRequest.Date, purchaseRequest.Category, categoryID,
+			common.PaymentMethodCreditCard, purchaseRequest.Description, purchaseRequest.CardID)
+		if err != nil {
+			return err
+		}
+		if expenseID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+		return common.PublishEvent(tx, common.EventExpenseCreated, purchaseRequest.UserID, expenseID,
+			map[string]interface{}{
+				"amount":         purchaseRequest.Amount,
+				"date":           purchaseRequest.Date,
+				"category":       purchaseRequest.Category,
+				"description":    purchaseRequest.Description,
+				"payment_method": common.PaymentMethodCreditCard,
+				"credit_card_id": purchaseRequest.CardID,
+			})
+	})
+	if err == common.ErrCardCycleClosed {
+		sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding credit card purchase: %v", err)
+		sendErrorResponse(w, "Error adding credit card purchase", common.TxErrorStatus(err))
+		return
+	}
+
+	sendSuccessResponse(w, "Credit card purchase added successfully", map[string]interface{}{
+		"expense_id":     expenseID,
+		"card_id":        purchaseRequest.CardID,
+		"amount":         purchaseRequest.Amount,
+		"date":           purchaseRequest.Date,
+		"category":       purchaseRequest.Category,
+		"payment_method": common.PaymentMethodCreditCard,
+	})
+}
+
+func handleFetchCreditCardStatements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	cardID, err := strconv.Atoi(r.URL.Query().Get("card_id"))
+	if err != nil || cardID <= 0 {
+		sendErrorResponse(w, "Valid card ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := generateDueStatements(userID, common.UserNow(db, userID)); err != nil {
+		log.Printf("Error generating credit card statements: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT id, card_id, user_id, period_start, period_end, due_date, purchases_count, balance,
+		       paid_amount, status, COALESCE(bill_id, 0), COALESCE(paid_at, '')
+		FROM credit_card_statements
+		WHERE user_id = ? AND card_id = ?
+		ORDER BY period_end DESC
+	`, userID, cardID)
+	if err != nil {
+		log.Printf("Error fetching statements: %v", err)
+		sendErrorResponse(w, "Error fetching statements", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	statements := []CreditCardStatement{}
+	for rows.Next() {
+		var statement CreditCardStatement
+		if err := rows.Scan(&statement.ID, &statement.CardID, &statement.UserID, &statement.PeriodStart,
+			&statement.PeriodEnd, &statement.DueDate, &statement.PurchasesCount, &statement.Balance,
+			&statement.PaidAmount, &statement.Status, &statement.BillID, &statement.PaidAt); err != nil {
+			log.Printf("Error scanning statement: %v", err)
+			continue
+		}
+		statements = append(statements, statement)
+	}
+
+	sendSuccessResponse(w, "Statements fetched successfully", statements)
+}
+
+func handlePayCreditCardStatement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payRequest PayStatementRequest
+	if err := json.NewDecoder(r.Body).Decode(&payRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if payRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if payRequest.PaymentMethod == "" {
+		payRequest.PaymentMethod = "bank"
+	}
+	if payRequest.PaymentMethod != "cash" && payRequest.PaymentMethod != "bank" {
+		sendErrorResponse(w, "Payment method must be 'cash' or 'bank'", http.StatusBadRequest)
+		return
+	}
+	if payRequest.Date == "" {
+		payRequest.Date = common.UserToday(db, payRequest.UserID)
+	}
+	paymentDate, err := time.Parse("2006-01-02", payRequest.Date)
+	if err != nil {
+		sendErrorResponse(w, "Date must use the YYYY-MM-DD format", http.StatusBadRequest)
+		return
+	}
+
+	// The statement is read and paid in the same transaction, so two concurrent payments cannot
+	// both pass the outstanding check
+	var amount, balance, outstanding, newPaid float64
+	var newStatus string
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		amount, newStatus = payRequest.Amount, "open"
+		var paidAmount float64
+		var status string
+		var billID sql.NullInt64
+		err := tx.QueryRow(`
+			SELECT balance, paid_amount, status, bill_id FROM credit_card_statements
+			WHERE id = ? AND user_id = ?
+		`, payRequest.StatementID, payRequest.UserID).Scan(&balance, &paidAmount, &status, &billID)
+		if err != nil {
+			return err
+		}
+
+		outstanding = math.Round((balance-paidAmount)*100) / 100
+		if status == "paid" || outstanding <= 0 {
+			return errStatementAlreadyPaid
+		}
+		if amount <= 0 {
+			amount = outstanding
+		}
+		if amount > outstanding {
+			return errStatementOverpayment
+		}
+
+		newPaid = paidAmount + amount
+		if newPaid >= balance-0.005 {
+			newStatus = "paid"
+		}
+
+		// Only applies if no other payment got in first
+		result, err := tx.Exec(`
+			UPDATE credit_card_statements
+			SET paid_amount = paid_amount + ?, status = ?, paid_at = CASE WHEN ? = 'paid' THEN ? ELSE paid_at END
+			WHERE id = ? AND user_id = ? AND paid_amount + ? <= balance + 0.005 AND status != 'paid'
+		`, amount, newStatus, newStatus, payRequest.Date, payRequest.StatementID, payRequest.UserID, amount)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return errStatementChanged
+		}
+
+		if newStatus == "paid" && billID.Valid {
+			// Close the bill generated for the statement
+			_, err = tx.Exec(`UPDATE bills SET paid = 1, overdue = 0, overdue_days = 0, version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ?`,
+				billID.Int64, payRequest.UserID)
+			if err == nil {
+				_, err = tx.Exec(`UPDATE bill_payments SET paid = 1, payment_date = ?, payment_method = ? WHERE bill_id = ?`,
+					payRequest.Date, payRequest.PaymentMethod, billID.Int64)
+			}
+		}
+		// This is when the money actually leaves the account
+		if err == nil {
+			err = common.PostLedgerEntries(tx, payRequest.UserID, common.LedgerEntry{
+				SourceType:    common.LedgerSourceCardStatement,
+				SourceID:      int64(payRequest.StatementID),
+				Date:          paymentDate,
+				Kind:          common.LedgerCardPayment,
+				PaymentMethod: payRequest.PaymentMethod,
+				Amount:        amount,
+			})
+		}
+		if err == nil && newStatus == "paid" && billID.Valid {
+			// Payments of the statement bill stop reserving their amount
+			err = common.ReserveBillPayments(tx, payRequest.UserID, billID.Int64)
+		}
+		if err == nil {
+			err = addTransactionTx(tx, payRequest.UserID, "credit_card_payment", amount, payRequest.Date)
+		}
+		if err == nil {
+			err = common.PublishEvent(tx, common.EventCardStatementPaid, payRequest.UserID, int64(payRequest.StatementID),
+				map[string]interface{}{
+					"amount":         amount,
+					"payment_method": payRequest.PaymentMethod,
+					"date":           payRequest.Date,
+					"paid_amount":    newPaid,
+					"status":         newStatus,
+				})
+		}
+		return err
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		sendErrorResponse(w, "Statement not found", http.StatusNotFound)
+		return
+	case err == errStatementAlreadyPaid || err == errStatementChanged:
+		sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	case err == errStatementOverpayment:
+		sendErrorResponse(w, fmt.Sprintf("Amount exceeds the outstanding balance of %.2f", outstanding), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("Error paying statement: %v", err)
+		sendErrorResponse(w, "Error paying statement", common.TxErrorStatus(err))
+		return
+	}
+
+	sendSuccessResponse(w, "Statement payment registered successfully", map[string]interface{}{
+		"statement_id": payRequest.StatementID,
+		"paid_amount":  newPaid,
+		"outstanding":  math.Max(0, math.Round((balance-newPaid)*100)/100),
+		"status":       newStatus,
+	})
+}
+
+func fetchCreditCard(cardID int, userID string) (*CreditCard, error) {
+	var card CreditCard
+	err := db.QueryRow(`
+		SELECT id, user_id, name, credit_limit, closing_day, due_day
+		FROM credit_cards WHERE id = ? AND user_id = ?
+	`, cardID, userID).Scan(&card.ID, &card.UserID, &card.Name, &card.CreditLimit, &card.ClosingDay, &card.DueDay)
+	if err != nil {
+		return nil, err
+	}
+
+	now := common.UserNow(db, userID)
+	closing := cycleClosingDate(now, card.ClosingDay)
+	cycleStart := closing.AddDate(0, -1, 1)
+	card.NextClosing = closing.Format("2006-01-02")
+
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0) FROM expenses
+		WHERE user_id = ? AND credit_card_id = ? AND date >= ? AND date <= ?
+	`, userID, cardID, cycleStart.Format("2006-01-02"), closing.Format("2006-01-02")).Scan(&card.CycleSpend)
+	if err != nil {
+		return nil, err
+	}
+
+	card.CurrentDebt, err = fetchCardDebt(userID, cardID)
+	if err != nil {
+		return nil, err
+	}
+	card.AvailableCredit = math.Max(0, card.CreditLimit-card.CurrentDebt)
+
+	return &card, nil
+}
+
+// fetchCardDebt returns the outstanding debt: purchases made minus statement payments.
+// With cardID 0 it adds up all of the user's cards.
+func fetchCardDebt(userID string, cardID int) (float64, error) {
+	var purchases, payments float64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0) FROM expenses
+		WHERE user_id = ? AND credit_card_id IS NOT NULL AND (? = 0 OR credit_card_id = ?)
+	`, userID, cardID, cardID).Scan(&purchases)
+	if err != nil {
+		return 0, err
+	}
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(paid_amount), 0) FROM credit_card_statements
+		WHERE user_id = ? AND (? = 0 OR card_id = ?)
+	`, userID, cardID, cardID).Scan(&payments)
+	if err != nil {
+		return 0, err
+	}
+	return math.Round((purchases-payments)*100) / 100, nil
+}
+
+// generateDueStatements closes every cycle of the user's cards that ended by now,
+// generating the statement summary and its bill in bills
+func generateDueStatements(userID string, now time.Time) error {
+	rows, err := db.Query(`SELECT id, name, closing_day, due_day, COALESCE(created_at, '') FROM credit_cards WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	type cardCycle struct {
+		id, closingDay, dueDay int
+		name, createdAt        string
+	}
+	var cards []cardCycle
+	for rows.Next() {
+		var c cardCycle
+		if err := rows.Scan(&c.id, &c.name, &c.closingDay, &c.dueDay, &c.createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		cards = append(cards, c)
+	}
+	rows.Close()
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for _, c := range cards {
+		// First cycle to close: the one after the last statement, or the one of the oldest purchase
+		var lastEnd, firstPurchase sql.NullString
+		db.QueryRow(`SELECT MAX(period_end) FROM credit_card_statements WHERE card_id = ?`, c.id).Scan(&lastEnd)
+		db.QueryRow(`SELECT MIN(date) FROM expenses WHERE user_id = ? AND credit_card_id = ?`, userID, c.id).Scan(&firstPurchase)
+
+		var closing time.Time
+		if lastEnd.Valid {
+			end, err := time.Parse("2006-01-02", lastEnd.String)
+			if err != nil {
+				return err
+			}
+			closing = end.AddDate(0, 1, 0)
+		} else if firstPurchase.Valid {
+			first, err := time.Parse("2006-01-02", firstPurchase.String)
+			if err != nil {
+				return err
+			}
+			closing = cycleClosingDate(first, c.closingDay)
+		} else {
+			continue
+		}
+
+		// Only cycles whose closing date has passed are closed
+		for closing.Before(today) {
+			if err := createStatement(userID, c.id, c.name, c.dueDay, closing); err != nil {
+				return err
+			}
+			closing = closing.AddDate(0, 1, 0)
+		}
+	}
+
+	return nil
+}
+
+func createStatement(userID string, cardID int, cardName string, dueDay int, closing time.Time) error {
+	periodStart := closing.AddDate(0, -1, 1).Format("2006-01-02")
+	periodEnd := closing.Format("2006-01-02")
+	dueDate := statementDueDate(closing, dueDay)
+
+	return common.WithTx(db, func(tx *sql.Tx) error {
+		var count int
+		var balance float64
+		err := tx.QueryRow(`
+			SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM expenses
+			WHERE user_id = ? AND credit_card_id = ? AND date >= ? AND date <= ?
+		`, userID, cardID, periodStart, periodEnd).Scan(&count, &balance)
+		if err != nil {
+			return err
+		}
+
+		status := "open"
+		if balance <= 0 {
+			status = "paid"
+		}
+
+		result, err := tx.Exec(`
+			INSERT OR IGNORE INTO credit_card_statements
+				(card_id, user_id, period_start, period_end, due_date, purchases_count, balance, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, cardID, userID, periodStart, periodEnd, dueDate.Format("2006-01-02"), count, balance, status)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return nil // Another process already generated this statement
+		}
+		statementID, _ := result.LastInsertId()
+
+		// Statement bill, so it shows up with the rest of the pending payments
+		if balance > 0 {
+			billResult, err := tx.Exec(`
+				INSERT INTO bills (user_id, name, amount, due_date, paid, overdue, overdue_days, recurring, category, icon, start_date, payment_day, duration_months, regularity, payment_method)
+				VALUES (?, ?, ?, ?, 0, 0, 0, 0, 'credit_card', '💳', ?, ?, 1, 'monthly', 'bank')
+			`, userID, fmt.Sprintf("%s statement %s", cardName, closing.Format("2006-01")), balance,
+				dueDate.Format("2006-01-02"), dueDate.Format("2006-01-02"), dueDate.Day())
+			if err != nil {
+				return fmt.Errorf("error creating statement bill: %v", err)
+			}
+			billID, _ := billResult.LastInsertId()
+
+			_, err = tx.Exec(`
+				INSERT OR IGNORE INTO bill_payments (bill_id, user_id, year_month, paid, payment_method) VALUES (?, ?, ?, 0, 'bank')
+			`, billID, userID, dueDate.Format("2006-01"))
+			if err != nil {
+				return fmt.Errorf("error creating statement bill payment: %v", err)
+			}
+
+			// Like any pending bill, it reserves its amount in the month it is due
+			if err := common.ReserveBillPayments(tx, userID, billID); err != nil {
+				return fmt.Errorf("error reserving statement bill: %v", err)
+			}
+
+			if _, err := tx.Exec(`UPDATE credit_card_statements SET bill_id = ? WHERE id = ?`, billID, statementID); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Generated credit card statement %s..%s for card %d: %.2f", periodStart, periodEnd, cardID, balance)
+		return common.PublishEvent(tx, common.EventCardStatementClosed, userID, statementID, map[string]interface{}{
+			"card_id":      cardID,
+			"period_start": periodStart,
+			"period_end":   periodEnd,
+			"due_date":     dueDate.Format("2006-01-02"),
+			"balance":      balance,
+		})
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+func setupCreditCardTables(t *testing.T) {
+	setupReconciliationTables(t)
+	_, err := testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS bills (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			amount REAL NOT NULL,
+			due_date TEXT,
+			start_date TEXT NOT NULL,
+			payment_day INTEGER NOT NULL,
+			duration_months INTEGER NOT NULL,
+			regularity TEXT NOT NULL DEFAULT 'monthly',
+			paid BOOLEAN DEFAULT 0,
+			overdue BOOLEAN DEFAULT 0,
+			overdue_days INTEGER DEFAULT 0,
+			recurring BOOLEAN DEFAULT 1,
+			category TEXT DEFAULT 'general',
+			icon TEXT DEFAULT '💳',
+			payment_method TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create bills table: %v", err)
+	}
+	// expenses did not exist yet when createCreditCardTables ran
+	testDB.Exec(`ALTER TABLE expenses ADD COLUMN credit_card_id INTEGER`)
+	if err := common.EnsureCategoryIDColumn(testDB, "expenses"); err != nil {
+		t.Fatalf("Failed to add category_id column: %v", err)
+	}
+	for _, ensure := range []func(db *sql.DB) error{common.EnsureBillScheduleColumns, common.EnsureBillPaymentAmountColumns, common.EnsureVersionColumns} {
+		if err := ensure(testDB); err != nil {
+			t.Fatalf("Failed to add bill columns: %v", err)
+		}
+	}
+}
+
+func postCreditCard(t *testing.T, handler http.HandlerFunc, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	return rr.Code, response.Data
+}
+
+// cardStatement returns the id, balance, paid_amount, status and bill_id of the statement closed on periodEnd
+func cardStatement(t *testing.T, cardID int64, periodEnd string) (int, float64, float64, string, int64) {
+	t.Helper()
+	var id int
+	var balance, paid float64
+	var status string
+	var billID int64
+	err := testDB.QueryRow(`
+		SELECT id, balance, paid_amount, status, COALESCE(bill_id, 0) FROM credit_card_statements
+		WHERE card_id = ? AND period_end = ?
+	`, cardID, periodEnd).Scan(&id, &balance, &paid, &status, &billID)
+	if err != nil {
+		t.Fatalf("Failed to read the statement closed on %s: %v", periodEnd, err)
+	}
+	return id, balance, paid, status, billID
+}
+
+func TestCreditCardStatementCycles(t *testing.T) {
+	setupCreditCardTables(t)
+	userID := fmt.Sprintf("test_card_cycles_%d", time.Now().UnixNano())
+	card, _ := testDB.Exec(`INSERT INTO credit_cards (user_id, name, closing_day, due_day) VALUES (?, 'Visa', 15, 5)`, userID)
+	cardID, _ := card.LastInsertId()
+
+	for _, purchase := range []struct {
+		date   string
+		amount float64
+	}{{"2024-01-10", 80}, {"2024-01-20", 40}, {"2024-02-14", 30}} {
+		status, _ := postCreditCard(t, handleCreditCardPurchase, CreditCardPurchaseRequest{
+			UserID: userID, CardID: int(cardID), Amount: purchase.amount, Date: purchase.date, Category: "Food",
+		})
+		if status != http.StatusOK {
+			t.Fatalf("Expected the purchase of %s to succeed, got status %d", purchase.date, status)
+		}
+	}
+
+	// Each cycle ends on the closing day and is due on the next due day
+	now := time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC)
+	if err := generateDueStatements(userID, now); err != nil {
+		t.Fatalf("Failed to generate statements: %v", err)
+	}
+	for _, want := range []struct {
+		periodEnd string
+		balance   float64
+	}{{"2024-01-15", 80}, {"2024-02-15", 70}} {
+		_, balance, _, status, billID := cardStatement(t, cardID, want.periodEnd)
+		if balance != want.balance || status != "open" || billID == 0 {
+			t.Errorf("Statement closed on %s: expected %.2f open with a bill, got %.2f %s bill %d",
+				want.periodEnd, want.balance, balance, status, billID)
+		}
+	}
+	var dueDate string
+	testDB.QueryRow(`SELECT due_date FROM credit_card_statements WHERE card_id = ? AND period_end = '2024-02-15'`, cardID).Scan(&dueDate)
+	if dueDate != "2024-03-05" {
+		t.Errorf("Expected the February statement due on 2024-03-05, got %s", dueDate)
+	}
+
+	// A purchase backdated into a closed cycle would never be billed
+	status, _ := postCreditCard(t, handleCreditCardPurchase, CreditCardPurchaseRequest{
+		UserID: userID, CardID: int(cardID), Amount: 25, Date: "2024-02-01", Category: "Food",
+	})
+	if status != http.StatusConflict {
+		t.Errorf("Expected a purchase in a closed cycle to be rejected, got status %d", status)
+	}
+	status, _ = postCreditCard(t, handleCreditCardPurchase, CreditCardPurchaseRequest{
+		UserID: userID, CardID: int(cardID), Amount: 25, Date: "2024-02-16", Category: "Food",
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected a purchase in the open cycle to succeed, got status %d", status)
+	}
+
+	// It lands on the next statement, and generating again does not duplicate anything
+	now = time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC)
+	for run := 0; run < 2; run++ {
+		if err := generateDueStatements(userID, now); err != nil {
+			t.Fatalf("Failed to generate statements: %v", err)
+		}
+	}
+	if _, balance, _, _, _ := cardStatement(t, cardID, "2024-03-15"); balance != 25 {
+		t.Errorf("Expected the March statement to bill the 25 purchase, got %.2f", balance)
+	}
+	var statements int
+	testDB.QueryRow(`SELECT COUNT(*) FROM credit_card_statements WHERE card_id = ?`, cardID).Scan(&statements)
+	if statements != 3 {
+		t.Errorf("Expected 3 statements, got %d", statements)
+	}
+	debt, err := fetchCardDebt(userID, int(cardID))
+	if err != nil || debt != 175 {
+		t.Errorf("Expected 175 of debt, got %.2f, %v", debt, err)
+	}
+}
+
+func TestPayCreditCardStatement(t *testing.T) {
+	setupCreditCardTables(t)
+	userID := fmt.Sprintf("test_card_payments_%d", time.Now().UnixNano())
+	card, _ := testDB.Exec(`INSERT INTO credit_cards (user_id, name, closing_day, due_day) VALUES (?, 'Visa', 15, 5)`, userID)
+	cardID, _ := card.LastInsertId()
+	for _, date := range []string{"2024-01-10", "2024-01-20"} {
+		if status, _ := postCreditCard(t, handleCreditCardPurchase, CreditCardPurchaseRequest{
+			UserID: userID, CardID: int(cardID), Amount: 90, Date: date, Category: "Food",
+		}); status != http.StatusOK {
+			t.Fatalf("Expected the purchase to succeed, got status %d", status)
+		}
+	}
+	if err := generateDueStatements(userID, time.Date(2024, 2, 20, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("Failed to generate statements: %v", err)
+	}
+	januaryID, _, _, _, billID := cardStatement(t, cardID, "2024-01-15")
+	februaryID, _, _, _, _ := cardStatement(t, cardID, "2024-02-15")
+
+	pay := func(statementID int, amount float64) (int, map[string]interface{}) {
+		return postCreditCard(t, handlePayCreditCardStatement, PayStatementRequest{
+			UserID: userID, StatementID: statementID, Amount: amount, Date: "2024-02-01",
+		})
+	}
+
+	// Partial payment, overpayment, the rest, and a payment of a paid statement
+	steps := []struct {
+		amount float64
+		status int
+		paid   float64
+	}{{30, http.StatusOK, 30}, {61, http.StatusBadRequest, 30}, {0, http.StatusOK, 90}, {10, http.StatusConflict, 90}}
+	for _, step := range steps {
+		status, _ := pay(januaryID, step.amount)
+		_, _, paid, _, _ := cardStatement(t, cardID, "2024-01-15")
+		if status != step.status || paid != step.paid {
+			t.Errorf("Paying %.2f: expected status %d and %.2f paid, got %d and %.2f", step.amount, step.status, step.paid, status, paid)
+		}
+	}
+	var billPaid bool
+	testDB.QueryRow(`SELECT paid FROM bills WHERE id = ?`, billID).Scan(&billPaid)
+	if !billPaid {
+		t.Errorf("Expected the statement bill to be closed")
+	}
+	if status, _ := pay(9999999, 10); status != http.StatusNotFound {
+		t.Errorf("Expected an unknown statement to return 404, got %d", status)
+	}
+
+	// Two concurrent payments of the whole balance: only one of them is applied
+	var wg sync.WaitGroup
+	statuses := make([]int, 2)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i], _ = pay(februaryID, 90)
+		}(i)
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+		}
+	}
+	_, _, paid, status, _ := cardStatement(t, cardID, "2024-02-15")
+	var outflows float64
+	testDB.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM cash_bank_transactions WHERE user_id = ? AND transaction_type = 'credit_card_payment'`,
+		userID).Scan(&outflows)
+	if succeeded != 1 || paid != 90 || status != "paid" || outflows != 180 {
+		t.Errorf("Expected one payment of 90, got statuses %v, %.2f paid (%s) and %.2f paid out", statuses, paid, status, outflows)
+	}
+}
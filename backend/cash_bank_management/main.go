@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
 	"time"
 
+	"hero_budget_backend/common"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -22,6 +25,8 @@ type CashBankDistribution struct {
 	BankAmount   float64 `json:"bank_amount"`
 	BankPercent  float64 `json:"bank_percent"`
 	MonthlyTotal float64 `json:"monthly_total"`
+	// Outstanding credit card debt, kept apart from cash and bank
+	CreditCardDebt float64 `json:"credit_card_debt"`
 }
 
 type TransferRequest struct {
@@ -73,6 +78,11 @@ func init() {
 	// Create tables if they don't exist
 	createTablesIfNotExist()
 
+	// Table used to replay responses of retried requests
+	if err := common.EnsureIdempotencyTable(db); err != nil {
+		log.Fatalf("Failed to create idempotency_keys table: %v", err)
+	}
+
 	log.Println("Database connection established successfully")
 }
 
@@ -144,7 +154,7 @@ func createTablesIfNotExist() {
 	db.Exec("CREATE INDEX IF NOT EXISTS idx_monthly_cash_bank_balance_user ON monthly_cash_bank_balance(user_id)")
 	db.Exec("CREATE INDEX IF NOT EXISTS idx_monthly_cash_bank_balance_month ON monthly_cash_bank_balance(year_month)")
 
-	// Create daily_cash_bank_balance table (requerida por updateAllPeriodTables)
+	// Create daily_cash_bank_balance table (projected from the balance ledger)
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS daily_cash_bank_balance (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -292,15 +302,41 @@ func createTablesIfNotExist() {
 	if err != nil {
 		log.Fatalf("Failed to create annual_cash_bank_balance table: %v", err)
 	}
+
+	// Create reconciliation tables and transaction status columns
+	createReconciliationTables()
+
+	// Create credit card tables
+	createCreditCardTables()
+
+	// Create holdings tables used by the net worth series
+	createNetWorthTables()
 }
 
 func main() {
 	// Set up CORS middleware and routes
 	http.HandleFunc("/cash-bank/distribution", corsMiddleware(handleFetchDistribution))
-	http.HandleFunc("/cash-bank/cash/update", corsMiddleware(handleUpdateCash))
-	http.HandleFunc("/cash-bank/bank/update", corsMiddleware(handleUpdateBank))
-	http.HandleFunc("/transfer/cash-to-bank", corsMiddleware(handleCashToBankTransfer))
-	http.HandleFunc("/transfer/bank-to-cash", corsMiddleware(handleBankToCashTransfer))
+	http.HandleFunc("/cash-bank/cash/update", corsMiddleware(common.WithIdempotency(db, handleUpdateCash)))
+	http.HandleFunc("/cash-bank/bank/update", corsMiddleware(common.WithIdempotency(db, handleUpdateBank)))
+	http.HandleFunc("/transfer/cash-to-bank", corsMiddleware(common.WithIdempotency(db, handleCashToBankTransfer)))
+	http.HandleFunc("/transfer/bank-to-cash", corsMiddleware(common.WithIdempotency(db, handleBankToCashTransfer)))
+	http.HandleFunc("/reconciliation/start", corsMiddleware(common.WithIdempotency(db, handleStartReconciliation)))
+	http.HandleFunc("/reconciliation", corsMiddleware(handleFetchReconciliation))
+	http.HandleFunc("/reconciliation/tick", corsMiddleware(common.WithIdempotency(db, handleTickReconciliation)))
+	http.HandleFunc("/reconciliation/finish", corsMiddleware(common.WithIdempotency(db, handleFinishReconciliation)))
+	http.HandleFunc("/credit-cards", corsMiddleware(handleFetchCreditCards))
+	http.HandleFunc("/credit-cards/add", corsMiddleware(common.WithIdempotency(db, handleAddCreditCard)))
+	http.HandleFunc("/credit-cards/purchase", corsMiddleware(common.WithIdempotency(db, handleCreditCardPurchase)))
+	http.HandleFunc("/credit-cards/statements", corsMiddleware(handleFetchCreditCardStatements))
+	http.HandleFunc("/credit-cards/statements/pay", corsMiddleware(common.WithIdempotency(db, handlePayCreditCardStatement)))
+	http.HandleFunc("/holdings", corsMiddleware(handleFetchHoldings))
+	http.HandleFunc("/holdings/add", corsMiddleware(common.WithIdempotency(db, handleAddHolding)))
+	http.HandleFunc("/holdings/update", corsMiddleware(common.WithIdempotency(db, handleUpdateHolding)))
+	http.HandleFunc("/holdings/delete", corsMiddleware(common.WithIdempotency(db, handleDeleteHolding)))
+	http.HandleFunc("/holdings/valuations", corsMiddleware(handleFetchHoldingValuations))
+	http.HandleFunc("/holdings/valuations/add", corsMiddleware(common.WithIdempotency(db, handleAddHoldingValuation)))
+	http.HandleFunc("/net-worth", corsMiddleware(handleFetchNetWorth))
+	http.HandleFunc("/cash-bank/admin/rebuild-balances", common.RequireAdmin(handleRebuildBalances))
 
 	port := 8090
 	log.Printf("Cash Bank Management service started on :%d", port)
@@ -312,7 +348,7 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// Set headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
 
 		// If it's OPTIONS, return with just the headers (preflight request)
 		if r.Method == "OPTIONS" {
@@ -346,6 +382,13 @@ func handleFetchDistribution(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Card debt is reported separately, it does not reduce cash or bank until paid
+	if debt, err := fetchCardDebt(userID, 0); err != nil {
+		log.Printf("Error fetching credit card debt: %v", err)
+	} else {
+		distribution.CreditCardDebt = debt
+	}
+
 	// Return cash bank distribution data as JSON
 	sendSuccessResponse(w, "Cash bank distribution fetched successfully", distribution)
 }
@@ -375,6 +418,13 @@ func handleUpdateCash(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Load the ledger first so the correction is measured against the balance it projects
+	if err := common.EnsureUserLedger(db, updateRequest.UserID); err != nil {
+		log.Printf("Error loading balance ledger: %v", err)
+		sendErrorResponse(w, "Error fetching current distribution", http.StatusInternalServerError)
+		return
+	}
+
 	// Get current distribution
 	distribution, err := fetchCashBankDistribution(updateRequest.UserID)
 	if err != nil {
@@ -383,6 +433,9 @@ func handleUpdateCash(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The ledger receives the difference, so rebuilding the balances keeps the correction
+	previousCashAmount := distribution.CashAmount
+
 	// Update cash amount
 	distribution.CashAmount = updateRequest.Amount
 	distribution.MonthlyTotal = distribution.CashAmount + distribution.BankAmount
@@ -396,21 +449,25 @@ func handleUpdateCash(w http.ResponseWriter, r *http.Request) {
 		distribution.BankPercent = 0
 	}
 
-	// Save the updated distribution
-	err = updateCashBankDistribution(distribution)
+	// Post the correction and its history entry together
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		if err := addAdjustment(tx, updateRequest.UserID, common.AdjustmentCash, updateRequest.Amount-previousCashAmount, updateRequest.Date); err != nil {
+			return err
+		}
+		if err := updateLegacyCashBank(tx, distribution); err != nil {
+			return err
+		}
+		if err := addTransactionTx(tx, updateRequest.UserID, "cash_update", updateRequest.Amount, updateRequest.Date); err != nil {
+			return err
+		}
+		return common.PublishEvent(tx, common.EventCashBankAdjusted, updateRequest.UserID, 0, distribution)
+	})
 	if err != nil {
 		log.Printf("Error updating cash amount: %v", err)
-		sendErrorResponse(w, "Error updating cash amount", http.StatusInternalServerError)
+		sendErrorResponse(w, "Error updating cash amount", common.TxErrorStatus(err))
 		return
 	}
 
-	// Add transaction to history
-	err = addTransaction(updateRequest.UserID, "cash_update", updateRequest.Amount, updateRequest.Date)
-	if err != nil {
-		log.Printf("Error adding transaction to history: %v", err)
-		// Continue despite the error
-	}
-
 	// Return success response
 	sendSuccessResponse(w, "Cash amount updated successfully", distribution)
 }
@@ -440,6 +497,13 @@ func handleUpdateBank(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Load the ledger first so the correction is measured against the balance it projects
+	if err := common.EnsureUserLedger(db, updateRequest.UserID); err != nil {
+		log.Printf("Error loading balance ledger: %v", err)
+		sendErrorResponse(w, "Error fetching current distribution", http.StatusInternalServerError)
+		return
+	}
+
 	// Get current distribution
 	distribution, err := fetchCashBankDistribution(updateRequest.UserID)
 	if err != nil {
@@ -448,6 +512,9 @@ func handleUpdateBank(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The ledger receives the difference, so rebuilding the balances keeps the correction
+	previousBankAmount := distribution.BankAmount
+
 	// Update bank amount
 	distribution.BankAmount = updateRequest.Amount
 	distribution.MonthlyTotal = distribution.CashAmount + distribution.BankAmount
@@ -461,21 +528,29 @@ func handleUpdateBank(w http.ResponseWriter, r *http.Request) {
 		distribution.BankPercent = 0
 	}
 
-	// Save the updated distribution
-	err = updateCashBankDistribution(distribution)
+	// Post the correction and its history entry together. The adjustment shows up in the next
+	// /reconciliation, where it can be explained with the transactions it stands for.
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		if delta := updateRequest.Amount - previousBankAmount; delta != 0 {
+			log.Printf("Manual bank update for user %s differs from tracked balance by %.2f", updateRequest.UserID, delta)
+		}
+		if err := addAdjustment(tx, updateRequest.UserID, common.AdjustmentBank, updateRequest.Amount-previousBankAmount, updateRequest.Date); err != nil {
+			return err
+		}
+		if err := updateLegacyCashBank(tx, distribution); err != nil {
+			return err
+		}
+		if err := addTransactionTx(tx, updateRequest.UserID, "bank_update", updateRequest.Amount, updateRequest.Date); err != nil {
+			return err
+		}
+		return common.PublishEvent(tx, common.EventCashBankAdjusted, updateRequest.UserID, 0, distribution)
+	})
 	if err != nil {
 		log.Printf("Error updating bank amount: %v", err)
-		sendErrorResponse(w, "Error updating bank amount", http.StatusInternalServerError)
+		sendErrorResponse(w, "Error updating bank amount", common.TxErrorStatus(err))
 		return
 	}
 
-	// Add transaction to history
-	err = addTransaction(updateRequest.UserID, "bank_update", updateRequest.Amount, updateRequest.Date)
-	if err != nil {
-		log.Printf("Error adding transaction to history: %v", err)
-		// Continue despite the error
-	}
-
 	// Return success response
 	sendSuccessResponse(w, "Bank amount updated successfully", distribution)
 }
@@ -529,21 +604,19 @@ func handleCashToBankTransfer(w http.ResponseWriter, r *http.Request) {
 		distribution.BankPercent = (distribution.BankAmount / distribution.MonthlyTotal) * 100
 	}
 
-	// Save the updated distribution
-	err = updateCashBankDistribution(distribution)
+	// Record the transfer in one transaction; the ledger moves the balances
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		if err := updateLegacyCashBank(tx, distribution); err != nil {
+			return err
+		}
+		return addTransfer(tx, transferRequest.UserID, common.TransferCashToBank, transferRequest.Amount, transferRequest.Date)
+	})
 	if err != nil {
-		log.Printf("Error updating distribution after transfer: %v", err)
-		sendErrorResponse(w, "Error processing transfer", http.StatusInternalServerError)
+		log.Printf("Error processing transfer: %v", err)
+		sendErrorResponse(w, "Error processing transfer", common.TxErrorStatus(err))
 		return
 	}
 
-	// Add transaction to history
-	err = addTransaction(transferRequest.UserID, "cash_to_bank", transferRequest.Amount, transferRequest.Date)
-	if err != nil {
-		log.Printf("Error adding transaction to history: %v", err)
-		// Continue despite the error
-	}
-
 	// Return success response
 	sendSuccessResponse(w, "Cash to bank transfer successful", distribution)
 }
@@ -597,21 +670,19 @@ func handleBankToCashTransfer(w http.ResponseWriter, r *http.Request) {
 		distribution.BankPercent = (distribution.BankAmount / distribution.MonthlyTotal) * 100
 	}
 
-	// Save the updated distribution
-	err = updateCashBankDistribution(distribution)
+	// Record the transfer in one transaction; the ledger moves the balances
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		if err := updateLegacyCashBank(tx, distribution); err != nil {
+			return err
+		}
+		return addTransfer(tx, transferRequest.UserID, common.TransferBankToCash, transferRequest.Amount, transferRequest.Date)
+	})
 	if err != nil {
-		log.Printf("Error updating distribution after transfer: %v", err)
-		sendErrorResponse(w, "Error processing transfer", http.StatusInternalServerError)
+		log.Printf("Error processing transfer: %v", err)
+		sendErrorResponse(w, "Error processing transfer", common.TxErrorStatus(err))
 		return
 	}
 
-	// Add transaction to history
-	err = addTransaction(transferRequest.UserID, "bank_to_cash", transferRequest.Amount, transferRequest.Date)
-	if err != nil {
-		log.Printf("Error adding transaction to history: %v", err)
-		// Continue despite the error
-	}
-
 	// Return success response
 	sendSuccessResponse(w, "Bank to cash transfer successful", distribution)
 }
@@ -620,11 +691,15 @@ func fetchCashBankDistribution(userID string) (CashBankDistribution, error) {
 	var distribution CashBankDistribution
 	distribution.UserID = userID
 
-	// Get current month in format YYYY-MM
-	currentMonth := time.Now().Format("2006-01")
+	// Get current month in format YYYY-MM, following the user's month start
+	settings, err := common.LoadPeriodSettings(db, userID)
+	if err != nil {
+		return distribution, err
+	}
+	currentMonth := settings.Identifier(common.UserNow(db, userID), "monthly")
 
 	// Query monthly_cash_bank_balance data from database for current month
-	err := db.QueryRow(`
+	err = db.QueryRow(`
 		SELECT year_month, balance_cash_amount, balance_bank_amount, total_balance
 		FROM monthly_cash_bank_balance
 		WHERE user_id = ? AND year_month = ?
@@ -654,7 +729,7 @@ func fetchCashBankDistribution(userID string) (CashBankDistribution, error) {
 
 		if err == sql.ErrNoRows {
 			// Return default values if no data found
-			now := time.Now()
+			now := common.UserNow(db, userID)
 			distribution.Month = now.Format("January 2006")
 			distribution.CashAmount = 0
 			distribution.CashPercent = 0
@@ -681,203 +756,156 @@ func fetchCashBankDistribution(userID string) (CashBankDistribution, error) {
 	return distribution, nil
 }
 
-func updateCashBankDistribution(distribution CashBankDistribution) error {
-	// Get current date and time periods
-	now := time.Now()
-	currentDate := now.Format("2006-01-02")
-	currentMonth := now.Format("2006-01")
-	currentWeek := getWeekPeriod(now)
-	currentQuarter := getQuarterPeriod(now)
-	currentSemiannual := getSemiannualPeriod(now)
-	currentYear := now.Format("2006")
-
-	// Update all period tables
-	err := updateAllPeriodTables(distribution, currentDate, currentMonth, currentWeek, currentQuarter, currentSemiannual, currentYear)
-	if err != nil {
-		return err
-	}
-
-	// Also update the legacy cash_bank table for backward compatibility
+// updateLegacyCashBank keeps the legacy cash_bank table, still read by other services, in line
+// with the distribution. The period tables are only written through the balance ledger.
+func updateLegacyCashBank(q common.DBTX, distribution CashBankDistribution) error {
 	var legacyCount int
-	err2 := db.QueryRow(`
+	err := q.QueryRow(`
 		SELECT COUNT(*) 
 		FROM cash_bank 
 		WHERE user_id = ?
 	`, distribution.UserID).Scan(&legacyCount)
+	if err != nil {
+		return err
+	}
 
-	if err2 == nil {
-		if legacyCount > 0 {
-			// Update existing cash_bank entry
-			db.Exec(`
-				UPDATE cash_bank
-				SET month = ?,
-					cash_amount = ?,
-					cash_percent = ?,
-					bank_amount = ?,
-					bank_percent = ?,
-					monthly_total = ?,
-					updated_at = CURRENT_TIMESTAMP
-				WHERE user_id = ?
-			`,
-				distribution.Month,
-				distribution.CashAmount,
-				distribution.CashPercent,
-				distribution.BankAmount,
-				distribution.BankPercent,
-				distribution.MonthlyTotal,
-				distribution.UserID,
-			)
-		} else {
-			// Insert new cash_bank entry
-			db.Exec(`
-				INSERT INTO cash_bank (
-					user_id, month, cash_amount, cash_percent, bank_amount, bank_percent, monthly_total
-				) VALUES (?, ?, ?, ?, ?, ?, ?)
-			`,
-				distribution.UserID,
-				distribution.Month,
-				distribution.CashAmount,
-				distribution.CashPercent,
-				distribution.BankAmount,
-				distribution.BankPercent,
-				distribution.MonthlyTotal,
-			)
-		}
+	if legacyCount > 0 {
+		// Update existing cash_bank entry
+		_, err = q.Exec(`
+			UPDATE cash_bank
+			SET month = ?,
+				cash_amount = ?,
+				cash_percent = ?,
+				bank_amount = ?,
+				bank_percent = ?,
+				monthly_total = ?,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE user_id = ?
+		`,
+			distribution.Month,
+			distribution.CashAmount,
+			distribution.CashPercent,
+			distribution.BankAmount,
+			distribution.BankPercent,
+			distribution.MonthlyTotal,
+			distribution.UserID,
+		)
+	} else {
+		// Insert new cash_bank entry
+		_, err = q.Exec(`
+			INSERT INTO cash_bank (
+				user_id, month, cash_amount, cash_percent, bank_amount, bank_percent, monthly_total
+			) VALUES (?, ?, ?, ?, ?, ?, ?)
+		`,
+			distribution.UserID,
+			distribution.Month,
+			distribution.CashAmount,
+			distribution.CashPercent,
+			distribution.BankAmount,
+			distribution.BankPercent,
+			distribution.MonthlyTotal,
+		)
 	}
 
 	return err
 }
 
-// Helper functions for period calculations
-func getWeekPeriod(t time.Time) string {
-	year, week := t.ISOWeek()
-	return fmt.Sprintf("%d-%02d", year, week)
+func addTransaction(userID, transactionType string, amount float64, date string) error {
+	return addTransactionTx(db, userID, transactionType, amount, date)
 }
 
-func getQuarterPeriod(t time.Time) string {
-	quarter := (int(t.Month())-1)/3 + 1
-	return fmt.Sprintf("%d-%d", t.Year(), quarter)
-}
+// addTransactionTx records a history entry using either the database or an open transaction
+func addTransactionTx(q common.DBTX, userID, transactionType string, amount float64, date string) error {
+	_, err := q.Exec(`
+		INSERT INTO cash_bank_transactions (
+			user_id, transaction_type, amount, date
+		) VALUES (?, ?, ?, ?)
+	`,
+		userID,
+		transactionType,
+		amount,
+		date,
+	)
 
-func getSemiannualPeriod(t time.Time) string {
-	semiannual := (int(t.Month())-1)/6 + 1
-	return fmt.Sprintf("%d-%d", t.Year(), semiannual)
+	return err
 }
 
-// Update all period tables with the new cash/bank distribution
-func updateAllPeriodTables(distribution CashBankDistribution, currentDate, currentMonth, currentWeek, currentQuarter, currentSemiannual, currentYear string) error {
-	// Update daily_cash_bank_balance
-	err := updatePeriodTable("daily_cash_bank_balance", "date", currentDate, distribution)
-	if err != nil {
-		log.Printf("Error updating daily_cash_bank_balance: %v", err)
-		return err
+// addTransfer records a cash/bank transfer in the history and posts it to the balance ledger,
+// so that rebuilding the period tables from raw data keeps it
+func addTransfer(q common.DBTX, userID, transferType string, amount float64, date string) error {
+	if date == "" {
+		date = common.UserToday(q, userID)
 	}
-
-	// Update weekly_cash_bank_balance
-	err = updatePeriodTable("weekly_cash_bank_balance", "year_week", currentWeek, distribution)
+	transferDate, err := time.Parse("2006-01-02", date[:min(len(date), 10)])
 	if err != nil {
-		log.Printf("Error updating weekly_cash_bank_balance: %v", err)
-		return err
+		return fmt.Errorf("invalid transfer date %q: %v", date, err)
 	}
-
-	// Update monthly_cash_bank_balance
-	err = updatePeriodTable("monthly_cash_bank_balance", "year_month", currentMonth, distribution)
+	entries, err := common.TransferLedgerEntries(transferType, transferDate, amount)
 	if err != nil {
-		log.Printf("Error updating monthly_cash_bank_balance: %v", err)
 		return err
 	}
 
-	// Update quarterly_cash_bank_balance
-	err = updatePeriodTable("quarterly_cash_bank_balance", "year_quarter", currentQuarter, distribution)
+	result, err := q.Exec(`
+		INSERT INTO cash_bank_transactions (
+			user_id, transaction_type, amount, date
+		) VALUES (?, ?, ?, ?)
+	`, userID, transferType, amount, date)
 	if err != nil {
-		log.Printf("Error updating quarterly_cash_bank_balance: %v", err)
 		return err
 	}
-
-	// Update semiannual_cash_bank_balance
-	err = updatePeriodTable("semiannual_cash_bank_balance", "year_half", currentSemiannual, distribution)
+	transferID, err := result.LastInsertId()
 	if err != nil {
-		log.Printf("Error updating semiannual_cash_bank_balance: %v", err)
 		return err
 	}
 
-	// Update annual_cash_bank_balance
-	err = updatePeriodTable("annual_cash_bank_balance", "year", currentYear, distribution)
-	if err != nil {
-		log.Printf("Error updating annual_cash_bank_balance: %v", err)
+	if err := common.ReplaceLedgerEntries(q, userID, common.LedgerSourceTransfer, transferID, entries...); err != nil {
 		return err
 	}
-
-	return nil
+	return common.PublishEvent(q, common.EventTransferMade, userID, transferID, map[string]interface{}{
+		"transfer_type": transferType,
+		"amount":        amount,
+		"date":          date,
+	})
 }
 
-// Generic function to update any period table
-func updatePeriodTable(tableName, periodColumn, periodValue string, distribution CashBankDistribution) error {
-	// Check if entry exists
-	var count int
-	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE user_id = ? AND %s = ?`, tableName, periodColumn)
-	err := db.QueryRow(query, distribution.UserID, periodValue).Scan(&count)
+// addAdjustment records a manual correction of the cash or bank balance as the signed difference
+// with the tracked balance and posts it to the balance ledger, so rebuilding the period tables keeps it
+func addAdjustment(q common.DBTX, userID, adjustmentType string, delta float64, date string) error {
+	delta = math.Round(delta*100) / 100
+	if delta == 0 {
+		return nil
+	}
+	if date == "" {
+		date = common.UserToday(q, userID)
+	}
+	adjustmentDate, err := time.Parse("2006-01-02", date[:min(len(date), 10)])
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid adjustment date %q: %v", date, err)
 	}
-
-	if count > 0 {
-		// Update existing entry
-		updateQuery := fmt.Sprintf(`
-			UPDATE %s
-			SET cash_amount = ?,
-				bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-				total_balance = ?,
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND %s = ?
-		`, tableName, periodColumn)
-
-		_, err = db.Exec(updateQuery,
-			distribution.CashAmount,
-			distribution.BankAmount,
-			distribution.CashAmount,
-			distribution.BankAmount,
-			distribution.MonthlyTotal,
-			distribution.UserID,
-			periodValue,
-		)
-	} else {
-		// Insert new entry
-		insertQuery := fmt.Sprintf(`
-			INSERT INTO %s (
-				user_id, %s, cash_amount, bank_amount, balance_cash_amount, balance_bank_amount, total_balance
-			) VALUES (?, ?, ?, ?, ?, ?, ?)
-		`, tableName, periodColumn)
-
-		_, err = db.Exec(insertQuery,
-			distribution.UserID,
-			periodValue,
-			distribution.CashAmount,
-			distribution.BankAmount,
-			distribution.CashAmount,
-			distribution.BankAmount,
-			distribution.MonthlyTotal,
-		)
+	account := "bank"
+	if adjustmentType == common.AdjustmentCash {
+		account = "cash"
 	}
 
-	return err
-}
-
-func addTransaction(userID, transactionType string, amount float64, date string) error {
-	_, err := db.Exec(`
+	result, err := q.Exec(`
 		INSERT INTO cash_bank_transactions (
 			user_id, transaction_type, amount, date
 		) VALUES (?, ?, ?, ?)
-	`,
-		userID,
-		transactionType,
-		amount,
-		date,
-	)
+	`, userID, adjustmentType, delta, date)
+	if err != nil {
+		return err
+	}
+	adjustmentID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
 
-	return err
+	return common.ReplaceLedgerEntries(q, userID, common.LedgerSourceAdjustment, adjustmentID, common.LedgerEntry{
+		Date:          adjustmentDate,
+		Kind:          common.LedgerAdjustment,
+		PaymentMethod: account,
+		Amount:        delta,
+	})
 }
 
 func sendSuccessResponse(w http.ResponseWriter, message string, data interface{}) {
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+// Holding is a manually tracked asset (investments, property, vehicles) or liability,
+// whose value is known from dated snapshots
+type Holding struct {
+	ID           int     `json:"id"`
+	UserID       string  `json:"user_id"`
+	Name         string  `json:"name"`
+	Kind         string  `json:"kind"`     // "asset", "liability"
+	Category     string  `json:"category"` // "investment", "property", "vehicle", "loan", "other"
+	CurrentValue float64 `json:"current_value"`
+	ValuedAt     string  `json:"valued_at,omitempty"`
+	CreatedAt    string  `json:"created_at"`
+}
+
+type HoldingValuation struct {
+	ID        int     `json:"id"`
+	HoldingID int     `json:"holding_id"`
+	Date      string  `json:"date"`
+	Value     float64 `json:"value"`
+}
+
+type AddHoldingRequest struct {
+	UserID   string  `json:"user_id"`
+	Name     string  `json:"name"`
+	Kind     string  `json:"kind"`
+	Category string  `json:"category"`
+	Value    float64 `json:"value"`
+	Date     string  `json:"date,omitempty"`
+}
+
+type UpdateHoldingRequest struct {
+	UserID    string `json:"user_id"`
+	HoldingID int    `json:"holding_id"`
+	Name      string `json:"name,omitempty"`
+	Category  string `json:"category,omitempty"`
+}
+
+type HoldingValuationRequest struct {
+	UserID    string  `json:"user_id"`
+	HoldingID int     `json:"holding_id"`
+	Value     float64 `json:"value"`
+	Date      string  `json:"date,omitempty"`
+}
+
+// NetWorthPoint is the net worth at the end of a period
+type NetWorthPoint struct {
+	Period         string  `json:"period"`
+	EndDate        string  `json:"end_date"`
+	Cash           float64 `json:"cash"`
+	Bank           float64 `json:"bank"`
+	Assets         float64 `json:"assets"`
+	Liabilities    float64 `json:"liabilities"`
+	CreditCardDebt float64 `json:"credit_card_debt"`
+	LoanBalance    float64 `json:"loan_balance"`
+	TotalAssets    float64 `json:"total_assets"`
+	TotalDebt      float64 `json:"total_debt"`
+	NetWorth       float64 `json:"net_worth"`
+}
+
+type NetWorthResponse struct {
+	UserID  string          `json:"user_id"`
+	Period  string          `json:"period"`
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Current *NetWorthPoint  `json:"current,omitempty"`
+	Change  float64         `json:"change"`
+	Series  []NetWorthPoint `json:"series"`
+}
+
+var validHoldingKinds = map[string]bool{"asset": true, "liability": true}
+
+func createNetWorthTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS holdings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			category TEXT NOT NULL DEFAULT 'other',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create holdings table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS holding_valuations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			holding_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			date TEXT NOT NULL,
+			value REAL NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(holding_id, date),
+			FOREIGN KEY (holding_id) REFERENCES holdings (id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create holding_valuations table: %v", err)
+	}
+}
+
+func handleFetchHoldings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT h.id, h.user_id, h.name, h.kind, h.category, COALESCE(h.created_at, ''),
+		       COALESCE(v.value, 0), COALESCE(v.date, '')
+		FROM holdings h
+		LEFT JOIN holding_valuations v ON v.id = (
+			SELECT id FROM holding_valuations WHERE holding_id = h.id ORDER BY date DESC, id DESC LIMIT 1
+		)
+		WHERE h.user_id = ?
+		ORDER BY h.kind ASC, h.name ASC
+	`, userID)
+	if err != nil {
+		log.Printf("Error fetching holdings: %v", err)
+		sendErrorResponse(w, "Error fetching holdings", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	holdings := []Holding{}
+	for rows.Next() {
+		var h Holding
+		if err := rows.Scan(&h.ID, &h.UserID, &h.Name, &h.Kind, &h.Category, &h.CreatedAt, &h.CurrentValue, &h.ValuedAt); err != nil {
+			log.Printf("Error scanning holding: %v", err)
+			continue
+		}
+		holdings = append(holdings, h)
+	}
+
+	sendSuccessResponse(w, "Holdings fetched successfully", holdings)
+}
+
+func handleAddHolding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var addRequest AddHoldingRequest
+	if err := json.NewDecoder(r.Body).Decode(&addRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if addRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if addRequest.Name == "" {
+		sendErrorResponse(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if !validHoldingKinds[addRequest.Kind] {
+		sendErrorResponse(w, "Kind must be 'asset' or 'liability'", http.StatusBadRequest)
+		return
+	}
+	if addRequest.Value < 0 {
+		sendErrorResponse(w, "Value must be greater than or equal to 0", http.StatusBadRequest)
+		return
+	}
+	if addRequest.Category == "" {
+		addRequest.Category = "other"
+	}
+	if addRequest.Date == "" {
+		addRequest.Date = common.UserToday(db, addRequest.UserID)
+	}
+	if _, err := time.Parse("2006-01-02", addRequest.Date); err != nil {
+		sendErrorResponse(w, "Invalid date format. Use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		sendErrorResponse(w, "Error starting transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO holdings (user_id, name, kind, category) VALUES (?, ?, ?, ?)
+	`, addRequest.UserID, addRequest.Name, addRequest.Kind, addRequest.Category)
+	if err == nil {
+		holdingID, _ := result.LastInsertId()
+		_, err = tx.Exec(`
+			INSERT INTO holding_valuations (holding_id, user_id, date, value) VALUES (?, ?, ?, ?)
+		`, holdingID, addRequest.UserID, addRequest.Date, addRequest.Value)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err == nil {
+			sendSuccessResponse(w, "Holding added successfully", Holding{
+				ID:           int(holdingID),
+				UserID:       addRequest.UserID,
+				Name:         addRequest.Name,
+				Kind:         addRequest.Kind,
+				Category:     addRequest.Category,
+				CurrentValue: addRequest.Value,
+				ValuedAt:     addRequest.Date,
+			})
+			return
+		}
+	}
+
+	log.Printf("Error adding holding: %v", err)
+	sendErrorResponse(w, "Error adding holding", http.StatusInternalServerError)
+}
+
+func handleUpdateHolding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var updateRequest UpdateHoldingRequest
+	if err := json.NewDecoder(r.Body).Decode(&updateRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if updateRequest.UserID == "" || updateRequest.HoldingID <= 0 {
+		sendErrorResponse(w, "User ID and holding ID are required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE holdings
+		SET name = COALESCE(NULLIF(?, ''), name),
+		    category = COALESCE(NULLIF(?, ''), category),
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND user_id = ?
+	`, updateRequest.Name, updateRequest.Category, updateRequest.HoldingID, updateRequest.UserID)
+	if err != nil {
+		log.Printf("Error updating holding: %v", err)
+		sendErrorResponse(w, "Error updating holding", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		sendErrorResponse(w, "Holding not found", http.StatusNotFound)
+		return
+	}
+
+	sendSuccessResponse(w, "Holding updated successfully", nil)
+}
+
+func handleDeleteHolding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var deleteRequest UpdateHoldingRequest
+	if err := json.NewDecoder(r.Body).Decode(&deleteRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if deleteRequest.UserID == "" || deleteRequest.HoldingID <= 0 {
+		sendErrorResponse(w, "User ID and holding ID are required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		sendErrorResponse(w, "Error starting transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM holdings WHERE id = ? AND user_id = ?`, deleteRequest.HoldingID, deleteRequest.UserID)
+	if err != nil {
+		log.Printf("Error deleting holding: %v", err)
+		sendErrorResponse(w, "Error deleting holding", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		sendErrorResponse(w, "Holding not found", http.StatusNotFound)
+		return
+	}
+	// SQLite does not enforce ON DELETE CASCADE without PRAGMA foreign_keys
+	_, err = tx.Exec(`DELETE FROM holding_valuations WHERE holding_id = ?`, deleteRequest.HoldingID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error deleting holding valuations: %v", err)
+		sendErrorResponse(w, "Error deleting holding", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Holding deleted successfully", nil)
+}
+
+func handleFetchHoldingValuations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	holdingID, _ := strconv.Atoi(r.URL.Query().Get("holding_id"))
+	if userID == "" || holdingID <= 0 {
+		sendErrorResponse(w, "User ID and holding ID are required", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, holding_id, date, value FROM holding_valuations
+		WHERE holding_id = ? AND user_id = ?
+		ORDER BY date ASC
+	`, holdingID, userID)
+	if err != nil {
+		log.Printf("Error fetching valuations: %v", err)
+		sendErrorResponse(w, "Error fetching valuations", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	valuations := []HoldingValuation{}
+	for rows.Next() {
+		var v HoldingValuation
+		if err := rows.Scan(&v.ID, &v.HoldingID, &v.Date, &v.Value); err != nil {
+			log.Printf("Error scanning valuation: %v", err)
+			continue
+		}
+		valuations = append(valuations, v)
+	}
+
+	sendSuccessResponse(w, "Valuations fetched successfully", valuations)
+}
+
+// handleAddHoldingValuation records the value on a date; an existing snapshot
+// for that date is replaced
+func handleAddHoldingValuation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var valuationRequest HoldingValuationRequest
+	if err := json.NewDecoder(r.Body).Decode(&valuationRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if valuationRequest.UserID == "" || valuationRequest.HoldingID <= 0 {
+		sendErrorResponse(w, "User ID and holding ID are required", http.StatusBadRequest)
+		return
+	}
+	if valuationRequest.Value < 0 {
+		sendErrorResponse(w, "Value must be greater than or equal to 0", http.StatusBadRequest)
+		return
+	}
+	if valuationRequest.Date == "" {
+		valuationRequest.Date = common.UserToday(db, valuationRequest.UserID)
+	}
+	if _, err := time.Parse("2006-01-02", valuationRequest.Date); err != nil {
+		sendErrorResponse(w, "Invalid date format. Use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	var exists int
+	err := db.QueryRow(`SELECT COUNT(*) FROM holdings WHERE id = ? AND user_id = ?`,
+		valuationRequest.HoldingID, valuationRequest.UserID).Scan(&exists)
+	if err != nil || exists == 0 {
+		sendErrorResponse(w, "Holding not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO holding_valuations (holding_id, user_id, date, value) VALUES (?, ?, ?, ?)
+		ON CONFLICT(holding_id, date) DO UPDATE SET value = excluded.value
+	`, valuationRequest.HoldingID, valuationRequest.UserID, valuationRequest.Date, valuationRequest.Value)
+	if err != nil {
+		log.Printf("Error saving valuation: %v", err)
+		sendErrorResponse(w, "Error saving valuation", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Valuation saved successfully", HoldingValuation{
+		HoldingID: valuationRequest.HoldingID,
+		Date:      valuationRequest.Date,
+		Value:     valuationRequest.Value,
+	})
+}
+
+// handleFetchNetWorth returns the net worth series by period.
+// Parameters: user_id, period (monthly, quarterly, semiannual, annual), from and to (YYYY-MM-DD).
+func handleFetchNetWorth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	userID := query.Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	period := query.Get("period")
+	if period == "" {
+		period = "monthly"
+	}
+	if period == "yearly" {
+		period = "annual"
+	}
+	months, ok := netWorthPeriodMonths[period]
+	if !ok {
+		sendErrorResponse(w, "Period must be monthly, quarterly, semiannual or annual", http.StatusBadRequest)
+		return
+	}
+
+	to := common.DateOnly(common.UserNow(db, userID))
+	if value := query.Get("to"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			sendErrorResponse(w, "Invalid 'to' date format. Use YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		to = parsed
+	}
+	// Defaults to the last 12 periods
+	from := periodStart(to, months).AddDate(0, -11*months, 0)
+	if value := query.Get("from"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			sendErrorResponse(w, "Invalid 'from' date format. Use YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		from = parsed
+	}
+	if from.After(to) {
+		sendErrorResponse(w, "'from' must be before 'to'", http.StatusBadRequest)
+		return
+	}
+
+	response := NetWorthResponse{
+		UserID: userID,
+		Period: period,
+		From:   from.Format("2006-01-02"),
+		To:     to.Format("2006-01-02"),
+		Series: []NetWorthPoint{},
+	}
+
+	for start := periodStart(from, months); !start.After(to); start = start.AddDate(0, months, 0) {
+		end := start.AddDate(0, months, -1)
+		if end.After(to) {
+			end = to
+		}
+		point, err := netWorthAt(userID, end)
+		if err != nil {
+			log.Printf("Error calculating net worth at %s: %v", end.Format("2006-01-02"), err)
+			sendErrorResponse(w, "Error calculating net worth", http.StatusInternalServerError)
+			return
+		}
+		point.Period = netWorthPeriodLabel(start, period)
+		response.Series = append(response.Series, point)
+	}
+
+	if n := len(response.Series); n > 0 {
+		response.Current = &response.Series[n-1]
+		response.Change = roundAmount(response.Series[n-1].NetWorth - response.Series[0].NetWorth)
+	}
+
+	sendSuccessResponse(w, "Net worth fetched successfully", response)
+}
+
+var netWorthPeriodMonths = map[string]int{"monthly": 1, "quarterly": 3, "semiannual": 6, "annual": 12}
+
+// periodStart returns the first day of the months-long period that contains date
+func periodStart(date time.Time, months int) time.Time {
+	month := (int(date.Month())-1)/months*months + 1
+	return time.Date(date.Year(), time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// netWorthPeriodLabel uses the same identifiers as the period balance tables
+func netWorthPeriodLabel(start time.Time, period string) string {
+	switch period {
+	case "quarterly":
+		return fmt.Sprintf("%d-Q%d", start.Year(), (int(start.Month())-1)/3+1)
+	case "semiannual":
+		return fmt.Sprintf("%d-H%d", start.Year(), (int(start.Month())-1)/6+1)
+	case "annual":
+		return start.Format("2006")
+	default:
+		return start.Format("2006-01")
+	}
+}
+
+// netWorthAt calculates the net worth at the end of day end
+func netWorthAt(userID string, end time.Time) (NetWorthPoint, error) {
+	endDate := end.Format("2006-01-02")
+	point := NetWorthPoint{EndDate: endDate}
+
+	// Cash and bank: last monthly balance recorded up to that month
+	err := db.QueryRow(`
+		SELECT COALESCE(balance_cash_amount, 0), COALESCE(balance_bank_amount, 0)
+		FROM monthly_cash_bank_balance
+		WHERE user_id = ? AND year_month <= ?
+		ORDER BY year_month DESC LIMIT 1
+	`, userID, end.Format("2006-01")).Scan(&point.Cash, &point.Bank)
+	if err != nil && err != sql.ErrNoRows {
+		return point, err
+	}
+
+	// Manual assets and liabilities: latest valuation of each one up to the date
+	rows, err := db.Query(`
+		SELECT h.kind, v.value
+		FROM holdings h
+		JOIN holding_valuations v ON v.id = (
+			SELECT id FROM holding_valuations
+			WHERE holding_id = h.id AND date <= ?
+			ORDER BY date DESC, id DESC LIMIT 1
+		)
+		WHERE h.user_id = ?
+	`, endDate, userID)
+	if err != nil {
+		return point, err
+	}
+	for rows.Next() {
+		var kind string
+		var value float64
+		if err := rows.Scan(&kind, &value); err != nil {
+			rows.Close()
+			return point, err
+		}
+		if kind == "liability" {
+			point.Liabilities += value
+		} else {
+			point.Assets += value
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return point, err
+	}
+
+	point.CreditCardDebt = cardDebtAt(userID, endDate)
+	point.LoanBalance = loanBalanceAt(userID, endDate)
+
+	point.Cash = roundAmount(point.Cash)
+	point.Bank = roundAmount(point.Bank)
+	point.Assets = roundAmount(point.Assets)
+	point.Liabilities = roundAmount(point.Liabilities)
+	point.TotalAssets = roundAmount(point.Cash + point.Bank + point.Assets)
+	point.TotalDebt = roundAmount(point.Liabilities + point.CreditCardDebt + point.LoanBalance)
+	point.NetWorth = roundAmount(point.TotalAssets - point.TotalDebt)
+	return point, nil
+}
+
+// cardDebtAt is the card debt on a date. Partial payments have no date,
+// so they are attributed to the statement closing date.
+func cardDebtAt(userID, endDate string) float64 {
+	var purchases, payments float64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0) FROM expenses
+		WHERE user_id = ? AND credit_card_id IS NOT NULL AND date <= ?
+	`, userID, endDate).Scan(&purchases)
+	if err != nil {
+		return 0
+	}
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(paid_amount), 0) FROM credit_card_statements
+		WHERE user_id = ? AND COALESCE(paid_at, period_end) <= ?
+	`, userID, endDate).Scan(&payments)
+	if err != nil {
+		payments = 0
+	}
+	return math.Max(0, roundAmount(purchases-payments))
+}
+
+// loanBalanceAt is the outstanding loan principal on a date. loans_management creates
+// the tables, so if they do not exist yet there is no debt.
+func loanBalanceAt(userID, endDate string) float64 {
+	var principal, repaid float64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(principal), 0) FROM loans WHERE user_id = ? AND start_date <= ?
+	`, userID, endDate).Scan(&principal)
+	if err != nil {
+		if !strings.Contains(err.Error(), "no such table") {
+			log.Printf("Error fetching loans: %v", err)
+		}
+		return 0
+	}
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(i.principal), 0)
+		FROM loan_installments i
+		JOIN loans l ON l.id = i.loan_id
+		WHERE i.user_id = ? AND i.paid = 1 AND i.paid_date <= ? AND l.start_date <= ?
+	`, userID, endDate, endDate).Scan(&repaid)
+	if err != nil {
+		repaid = 0
+	}
+	return math.Max(0, roundAmount(principal-repaid))
+}
+
+func roundAmount(value float64) float64 {
+	return math.Round(value*100) / 100
+}
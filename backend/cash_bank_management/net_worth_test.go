@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNetWorthSeries(t *testing.T) {
+	userID := fmt.Sprintf("test_networth_%d", time.Now().UnixNano())
+
+	for _, month := range []struct {
+		yearMonth  string
+		cash, bank float64
+	}{{"2024-01", 100, 1000}, {"2024-03", 200, 1500}} {
+		_, err := testDB.Exec(`
+			INSERT INTO monthly_cash_bank_balance (user_id, year_month, balance_cash_amount, balance_bank_amount)
+			VALUES (?, ?, ?, ?)
+		`, userID, month.yearMonth, month.cash, month.bank)
+		if err != nil {
+			t.Fatalf("Failed to insert monthly balance: %v", err)
+		}
+	}
+
+	car, _ := testDB.Exec(`INSERT INTO holdings (user_id, name, kind, category) VALUES (?, 'Car', 'asset', 'vehicle')`, userID)
+	carID, _ := car.LastInsertId()
+	testDB.Exec(`INSERT INTO holding_valuations (holding_id, user_id, date, value) VALUES (?, ?, '2024-01-10', 9000), (?, ?, '2024-03-01', 8500)`,
+		carID, userID, carID, userID)
+	debt, _ := testDB.Exec(`INSERT INTO holdings (user_id, name, kind, category) VALUES (?, 'Family loan', 'liability', 'loan')`, userID)
+	debtID, _ := debt.LastInsertId()
+	testDB.Exec(`INSERT INTO holding_valuations (holding_id, user_id, date, value) VALUES (?, ?, '2024-02-15', 2000)`, debtID, userID)
+
+	req := httptest.NewRequest("GET", "/net-worth?user_id="+userID+"&period=monthly&from=2024-01-01&to=2024-03-31", nil)
+	rr := httptest.NewRecorder()
+	handleFetchNetWorth(rr, req)
+
+	var response struct {
+		Success bool             `json:"success"`
+		Data    NetWorthResponse `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || !response.Success {
+		t.Fatalf("Expected a successful response, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	expected := []struct {
+		period   string
+		netWorth float64
+	}{
+		{"2024-01", 100 + 1000 + 9000},
+		{"2024-02", 100 + 1000 + 9000 - 2000}, // February carries January's balance forward
+		{"2024-03", 200 + 1500 + 8500 - 2000},
+	}
+	if len(response.Data.Series) != len(expected) {
+		t.Fatalf("Expected %d points, got %d", len(expected), len(response.Data.Series))
+	}
+	for i, want := range expected {
+		got := response.Data.Series[i]
+		if got.Period != want.period || got.NetWorth != want.netWorth {
+			t.Errorf("Point %d: expected %s = %.2f, got %s = %.2f", i, want.period, want.netWorth, got.Period, got.NetWorth)
+		}
+	}
+	if response.Data.Change != -1900 {
+		t.Errorf("Expected change of -1900, got %.2f", response.Data.Change)
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+// Statement reconciliation structures
+type ReconciliationSession struct {
+	ID               int     `json:"id"`
+	UserID           string  `json:"user_id"`
+	Account          string  `json:"account"` // "cash" or "bank"
+	StatementDate    string  `json:"statement_date"`
+	StatementBalance float64 `json:"statement_balance"`
+	OpeningBalance   float64 `json:"opening_balance"`
+	ClearedBalance   float64 `json:"cleared_balance"`
+	Difference       float64 `json:"difference"`
+	Status           string  `json:"status"` // "open", "finished" or "cancelled"
+	AdjustmentType   string  `json:"adjustment_type,omitempty"`
+	AdjustmentID     int     `json:"adjustment_id,omitempty"`
+	CreatedAt        string  `json:"created_at,omitempty"`
+	FinishedAt       string  `json:"finished_at,omitempty"`
+}
+
+type ReconciliationTransaction struct {
+	ID          int     `json:"id"`
+	Type        string  `json:"type"`   // "income", "expense", "transfer", "adjustment" or "card_payment"
+	Amount      float64 `json:"amount"` // Signed for transfers and adjustments: negative when the money leaves the account
+	Date        string  `json:"date"`
+	Category    string  `json:"category"`
+	Description string  `json:"description,omitempty"`
+	Status      string  `json:"status"`
+	Ticked      bool    `json:"ticked"`
+}
+
+type ReconciliationDetail struct {
+	Session      ReconciliationSession       `json:"session"`
+	Transactions []ReconciliationTransaction `json:"transactions"`
+}
+
+type StartReconciliationRequest struct {
+	UserID           string  `json:"user_id"`
+	Account          string  `json:"account"`
+	StatementDate    string  `json:"statement_date"`
+	StatementBalance float64 `json:"statement_balance"`
+}
+
+type TickReconciliationRequest struct {
+	UserID          string `json:"user_id"`
+	SessionID       int    `json:"session_id"`
+	TransactionType string `json:"transaction_type"`
+	TransactionID   int    `json:"transaction_id"`
+	Cleared         bool   `json:"cleared"`
+}
+
+type FinishReconciliationRequest struct {
+	UserID         string `json:"user_id"`
+	SessionID      int    `json:"session_id"`
+	PostAdjustment bool   `json:"post_adjustment"`
+}
+
+// Category of the adjustment transaction that books the remaining difference
+const reconciliationAdjustmentCategory = "Reconciliation adjustment"
+
+// Candidate transaction types; transfers, manual adjustments and card statement payments have no
+// status column, so their status comes from the sessions they were ticked in
+var reconciliationTypes = map[string]bool{"income": true, "expense": true, "transfer": true, "adjustment": true, "card_payment": true}
+
+// reconciliationCandidatesSQL lists every movement of cash or bank that can appear on a statement:
+// incomes, expenses, transfers between both accounts, manual balance adjustments and credit card
+// statement payments. It matches
+// the sources the balance ledger is built from, so a reconciled account agrees with its balance.
+const reconciliationCandidatesSQL = `
+	SELECT c.id, c.type, c.amount, c.date, c.category, c.description, c.payment_method, c.user_id,
+	       COALESCE(c.status, CASE
+	           WHEN EXISTS (SELECT 1 FROM reconciliation_items i JOIN reconciliation_sessions rs ON rs.id = i.session_id
+	                        WHERE i.transaction_type = c.type AND i.transaction_id = c.id
+	                          AND rs.user_id = c.user_id AND rs.account = c.payment_method AND rs.status = 'finished') THEN 'reconciled'
+	           WHEN EXISTS (SELECT 1 FROM reconciliation_items i JOIN reconciliation_sessions rs ON rs.id = i.session_id
+	                        WHERE i.transaction_type = c.type AND i.transaction_id = c.id
+	                          AND rs.user_id = c.user_id AND rs.account = c.payment_method AND rs.status = 'open') THEN 'cleared'
+	           ELSE 'pending' END) AS status
+	FROM (
+		SELECT id, 'income' AS type, amount, date, category, description, COALESCE(status, 'pending') AS status, payment_method, user_id FROM incomes
+		UNION ALL
+		SELECT id, 'expense' AS type, amount, date, category, description, COALESCE(status, 'pending') AS status, payment_method, user_id FROM expenses
+		UNION ALL
+		SELECT t.id, 'transfer', CASE WHEN (t.transaction_type = '` + common.TransferCashToBank + `') = (m.method = 'cash') THEN -t.amount ELSE t.amount END,
+		       t.date, 'Transfer', t.transaction_type, NULL, m.method, t.user_id
+		FROM cash_bank_transactions t CROSS JOIN (SELECT 'cash' AS method UNION ALL SELECT 'bank') m
+		WHERE t.transaction_type IN ('` + common.TransferCashToBank + `', '` + common.TransferBankToCash + `')
+		UNION ALL
+		SELECT id, 'adjustment', amount, date, 'Balance adjustment', transaction_type, NULL,
+		       CASE WHEN transaction_type = '` + common.AdjustmentCash + `' THEN 'cash' ELSE 'bank' END, user_id
+		FROM cash_bank_transactions
+		WHERE transaction_type IN ('` + common.AdjustmentCash + `', '` + common.AdjustmentBank + `')
+		UNION ALL
+		SELECT s.id, 'card_payment', s.paid_amount, COALESCE(s.paid_at, s.due_date), 'Credit card', 'Statement ' || s.period_end, NULL,
+		       COALESCE((SELECT payment_method FROM bill_payments WHERE bill_id = s.bill_id LIMIT 1), 'bank'), s.user_id
+		FROM credit_card_statements s
+		WHERE s.paid_amount > 0
+	) c
+`
+
+func createReconciliationTables() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS reconciliation_sessions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			account TEXT NOT NULL,
+			statement_date TEXT NOT NULL,
+			statement_balance REAL NOT NULL,
+			opening_balance REAL NOT NULL DEFAULT 0,
+			status TEXT NOT NULL DEFAULT 'open',
+			difference REAL NOT NULL DEFAULT 0,
+			adjustment_type TEXT,
+			adjustment_id INTEGER,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			finished_at TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create reconciliation_sessions table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS reconciliation_items (
+			session_id INTEGER NOT NULL,
+			transaction_type TEXT NOT NULL,
+			transaction_id INTEGER NOT NULL,
+			PRIMARY KEY (session_id, transaction_type, transaction_id),
+			FOREIGN KEY (session_id) REFERENCES reconciliation_sessions (id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create reconciliation_items table: %v", err)
+	}
+
+	// Pending/cleared/reconciled status of incomes and expenses
+	if err := common.EnsureTransactionStatusColumns(db); err != nil {
+		log.Printf("Error adding status columns: %v", err)
+	}
+}
+
+func handleStartReconciliation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var startRequest StartReconciliationRequest
+	if err := json.NewDecoder(r.Body).Decode(&startRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if startRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if startRequest.Account != "cash" && startRequest.Account != "bank" {
+		sendErrorResponse(w, "Account must be 'cash' or 'bank'", http.StatusBadRequest)
+		return
+	}
+	if _, err := time.Parse("2006-01-02", startRequest.StatementDate); err != nil {
+		sendErrorResponse(w, "Statement date must use the YYYY-MM-DD format", http.StatusBadRequest)
+		return
+	}
+
+	// Only one open session per account
+	var openID int
+	err := db.QueryRow(`
+		SELECT id FROM reconciliation_sessions
+		WHERE user_id = ? AND account = ? AND status = 'open'
+	`, startRequest.UserID, startRequest.Account).Scan(&openID)
+	if err == nil {
+		sendErrorResponse(w, fmt.Sprintf("There is already an open reconciliation (%d) for this account", openID), http.StatusConflict)
+		return
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("Error checking open reconciliation: %v", err)
+		sendErrorResponse(w, "Error checking open reconciliation", http.StatusInternalServerError)
+		return
+	}
+
+	// The opening balance is the closing balance of the last finished reconciliation
+	var openingBalance float64
+	err = db.QueryRow(`
+		SELECT statement_balance FROM reconciliation_sessions
+		WHERE user_id = ? AND account = ? AND status = 'finished'
+		ORDER BY statement_date DESC, id DESC LIMIT 1
+	`, startRequest.UserID, startRequest.Account).Scan(&openingBalance)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error fetching opening balance: %v", err)
+		sendErrorResponse(w, "Error fetching opening balance", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO reconciliation_sessions (user_id, account, statement_date, statement_balance, opening_balance)
+		VALUES (?, ?, ?, ?, ?)
+	`, startRequest.UserID, startRequest.Account, startRequest.StatementDate, startRequest.StatementBalance, openingBalance)
+	if err != nil {
+		log.Printf("Error creating reconciliation session: %v", err)
+		sendErrorResponse(w, "Error creating reconciliation session", http.StatusInternalServerError)
+		return
+	}
+	sessionID, _ := result.LastInsertId()
+
+	// Transactions already marked as cleared start ticked
+	_, err = db.Exec(`
+		INSERT OR IGNORE INTO reconciliation_items (session_id, transaction_type, transaction_id)
+		SELECT ?, 'income', id FROM incomes
+		WHERE user_id = ? AND payment_method = ? AND date <= ? AND COALESCE(status, 'pending') = 'cleared'
+		UNION ALL
+		SELECT ?, 'expense', id FROM expenses
+		WHERE user_id = ? AND payment_method = ? AND date <= ? AND COALESCE(status, 'pending') = 'cleared'
+	`, sessionID, startRequest.UserID, startRequest.Account, startRequest.StatementDate,
+		sessionID, startRequest.UserID, startRequest.Account, startRequest.StatementDate)
+	if err != nil {
+		log.Printf("Error preselecting cleared transactions: %v", err)
+	}
+
+	detail, err := fetchReconciliationDetail(int(sessionID), startRequest.UserID)
+	if err != nil {
+		log.Printf("Error fetching reconciliation session: %v", err)
+		sendErrorResponse(w, "Error fetching reconciliation session", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Reconciliation started successfully", detail)
+}
+
+func handleFetchReconciliation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	sessionID, err := strconv.Atoi(r.URL.Query().Get("session_id"))
+	if err != nil || sessionID <= 0 {
+		sendErrorResponse(w, "Valid session ID is required", http.StatusBadRequest)
+		return
+	}
+
+	detail, err := fetchReconciliationDetail(sessionID, userID)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Reconciliation session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching reconciliation session: %v", err)
+		sendErrorResponse(w, "Error fetching reconciliation session", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Reconciliation fetched successfully", detail)
+}
+
+func handleTickReconciliation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var tickRequest TickReconciliationRequest
+	if err := json.NewDecoder(r.Body).Decode(&tickRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if tickRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if !reconciliationTypes[tickRequest.TransactionType] {
+		sendErrorResponse(w, "Transaction type must be 'income', 'expense', 'transfer', 'adjustment' or 'card_payment'", http.StatusBadRequest)
+		return
+	}
+
+	session, err := fetchReconciliationSession(tickRequest.SessionID, tickRequest.UserID)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Reconciliation session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching reconciliation session: %v", err)
+		sendErrorResponse(w, "Error fetching reconciliation session", http.StatusInternalServerError)
+		return
+	}
+	if session.Status != "open" {
+		sendErrorResponse(w, "Reconciliation session is not open", http.StatusConflict)
+		return
+	}
+
+	// The transaction must belong to the account and not be reconciled yet
+	var status string
+	err = db.QueryRow(`
+		SELECT status FROM (`+reconciliationCandidatesSQL+`) t
+		WHERE t.type = ? AND t.id = ? AND t.user_id = ? AND t.payment_method = ? AND t.date <= ?
+	`, tickRequest.TransactionType, tickRequest.TransactionID, tickRequest.UserID, session.Account, session.StatementDate).Scan(&status)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Transaction not found for this account and statement period", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching transaction: %v", err)
+		sendErrorResponse(w, "Error fetching transaction", http.StatusInternalServerError)
+		return
+	}
+	if status == common.StatusReconciled {
+		sendErrorResponse(w, common.ErrTransactionLocked.Error(), http.StatusConflict)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		sendErrorResponse(w, "Error starting transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	newStatus := common.StatusPending
+	if tickRequest.Cleared {
+		newStatus = common.StatusCleared
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO reconciliation_items (session_id, transaction_type, transaction_id)
+			VALUES (?, ?, ?)
+		`, session.ID, tickRequest.TransactionType, tickRequest.TransactionID)
+	} else {
+		_, err = tx.Exec(`
+			DELETE FROM reconciliation_items
+			WHERE session_id = ? AND transaction_type = ? AND transaction_id = ?
+		`, session.ID, tickRequest.TransactionType, tickRequest.TransactionID)
+	}
+	if err == nil && (tickRequest.TransactionType == "income" || tickRequest.TransactionType == "expense") {
+		_, err = tx.Exec(fmt.Sprintf(`UPDATE %ss SET status = ?, version = COALESCE(version, 1) + 1 WHERE id = ? AND user_id = ?`, tickRequest.TransactionType),
+			newStatus, tickRequest.TransactionID, tickRequest.UserID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error updating reconciliation item: %v", err)
+		sendErrorResponse(w, "Error updating reconciliation item", http.StatusInternalServerError)
+		return
+	}
+
+	detail, err := fetchReconciliationDetail(session.ID, tickRequest.UserID)
+	if err != nil {
+		log.Printf("Error fetching reconciliation session: %v", err)
+		sendErrorResponse(w, "Error fetching reconciliation session", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Reconciliation item updated successfully", detail)
+}
+
+func handleFinishReconciliation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var finishRequest FinishReconciliationRequest
+	if err := json.NewDecoder(r.Body).Decode(&finishRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if finishRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	detail, err := fetchReconciliationDetail(finishRequest.SessionID, finishRequest.UserID)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Reconciliation session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching reconciliation session: %v", err)
+		sendErrorResponse(w, "Error fetching reconciliation session", http.StatusInternalServerError)
+		return
+	}
+	session := detail.Session
+	if session.Status != "open" {
+		sendErrorResponse(w, "Reconciliation session is not open", http.StatusConflict)
+		return
+	}
+
+	hasDifference := math.Abs(session.Difference) >= 0.005
+	if hasDifference && !finishRequest.PostAdjustment {
+		sendErrorResponse(w, fmt.Sprintf("Statement does not balance, difference is %.2f. Tick more transactions or post an adjustment", session.Difference), http.StatusConflict)
+		return
+	}
+
+	// Locking, the adjustment and closing the session are committed together
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		// Lock the ticked rows; the other candidate types are locked by the finished session itself
+		for _, table := range []string{"incomes", "expenses"} {
+			transactionType := table[:len(table)-1]
+			_, err := tx.Exec(fmt.Sprintf(`
+				UPDATE %s SET status = ?, version = COALESCE(version, 1) + 1
+				WHERE user_id = ? AND id IN (
+					SELECT transaction_id FROM reconciliation_items
+					WHERE session_id = ? AND transaction_type = ?
+				)
+			`, table), common.StatusReconciled, finishRequest.UserID, session.ID, transactionType)
+			if err != nil {
+				return fmt.Errorf("error locking reconciled %s: %v", table, err)
+			}
+		}
+
+		// Post the remaining difference as an adjustment transaction
+		adjustmentType := ""
+		adjustmentID := int64(0)
+		if hasDifference {
+			statementDate, _ := time.Parse("2006-01-02", session.StatementDate)
+			amount := math.Abs(session.Difference)
+			adjustmentType = "income"
+			if session.Difference < 0 {
+				adjustmentType = "expense"
+			}
+
+			result, err := tx.Exec(fmt.Sprintf(`
+				INSERT INTO %ss (user_id, amount, date, category, payment_method, description, status)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+			`, adjustmentType), finishRequest.UserID, amount, session.StatementDate, reconciliationAdjustmentCategory,
+				session.Account, fmt.Sprintf("Statement reconciliation %d", session.ID), common.StatusReconciled)
+			if err == nil {
+				adjustmentID, err = result.LastInsertId()
+			}
+			if err == nil {
+				_, err = tx.Exec(`
+					INSERT INTO reconciliation_items (session_id, transaction_type, transaction_id) VALUES (?, ?, ?)
+				`, session.ID, adjustmentType, adjustmentID)
+			}
+			if err == nil {
+				err = common.ReplaceLedgerEntries(tx, finishRequest.UserID, adjustmentType, adjustmentID, common.LedgerEntry{
+					Date: statementDate, Kind: adjustmentType, PaymentMethod: session.Account, Amount: amount,
+				})
+			}
+			if err == nil {
+				// Subscribers see the adjustment as one more income or expense
+				event := common.EventIncomeCreated
+				if adjustmentType == "expense" {
+					event = common.EventExpenseCreated
+				}
+				err = common.PublishEvent(tx, event, finishRequest.UserID, adjustmentID, map[string]interface{}{
+					"amount":         amount,
+					"date":           session.StatementDate,
+					"category":       reconciliationAdjustmentCategory,
+					"payment_method": session.Account,
+					"reconciliation": session.ID,
+				})
+			}
+			if err != nil {
+				return fmt.Errorf("error posting reconciliation adjustment: %v", err)
+			}
+		}
+
+		_, err := tx.Exec(`
+			UPDATE reconciliation_sessions
+			SET status = 'finished', difference = ?, adjustment_type = NULLIF(?, ''), adjustment_id = NULLIF(?, 0),
+			    finished_at = CURRENT_TIMESTAMP
+			WHERE id = ? AND user_id = ?
+		`, session.Difference, adjustmentType, adjustmentID, session.ID, finishRequest.UserID)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error finishing reconciliation: %v", err)
+		sendErrorResponse(w, "Error finishing reconciliation", common.TxErrorStatus(err))
+		return
+	}
+
+	finished, err := fetchReconciliationDetail(session.ID, finishRequest.UserID)
+	if err != nil {
+		log.Printf("Error fetching reconciliation session: %v", err)
+		sendErrorResponse(w, "Error fetching reconciliation session", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Reconciliation finished successfully", finished)
+}
+
+func fetchReconciliationSession(sessionID int, userID string) (*ReconciliationSession, error) {
+	var session ReconciliationSession
+	var adjustmentType, finishedAt sql.NullString
+	var adjustmentID sql.NullInt64
+
+	err := db.QueryRow(`
+		SELECT id, user_id, account, statement_date, statement_balance, opening_balance, status,
+		       difference, adjustment_type, adjustment_id, COALESCE(created_at, ''), finished_at
+		FROM reconciliation_sessions
+		WHERE id = ? AND user_id = ?
+	`, sessionID, userID).Scan(
+		&session.ID, &session.UserID, &session.Account, &session.StatementDate, &session.StatementBalance,
+		&session.OpeningBalance, &session.Status, &session.Difference, &adjustmentType, &adjustmentID,
+		&session.CreatedAt, &finishedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	session.AdjustmentType = adjustmentType.String
+	session.AdjustmentID = int(adjustmentID.Int64)
+	session.FinishedAt = finishedAt.String
+	return &session, nil
+}
+
+// fetchReconciliationDetail loads a session with its candidate transactions and recomputes
+// the cleared balance and the difference with the statement
+func fetchReconciliationDetail(sessionID int, userID string) (*ReconciliationDetail, error) {
+	session, err := fetchReconciliationSession(sessionID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open session: the account's transactions up to the statement date not reconciled yet.
+	// Closed session: the transactions reconciled in it.
+	query := `
+		SELECT t.id, t.type, t.amount, t.date, t.category, COALESCE(t.description, ''), t.status,
+		       CASE WHEN ri.transaction_id IS NULL THEN 0 ELSE 1 END
+		FROM (` + reconciliationCandidatesSQL + `) t
+		LEFT JOIN reconciliation_items ri
+			ON ri.session_id = ? AND ri.transaction_type = t.type AND ri.transaction_id = t.id
+		WHERE t.user_id = ? AND t.payment_method = ?
+	`
+	args := []interface{}{session.ID, userID, session.Account}
+	if session.Status == "open" {
+		query += ` AND t.date <= ? AND t.status != 'reconciled'`
+		args = append(args, session.StatementDate)
+	} else {
+		query += ` AND ri.transaction_id IS NOT NULL`
+	}
+	query += ` ORDER BY t.date ASC, t.id ASC`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []ReconciliationTransaction{}
+	cleared := session.OpeningBalance
+	for rows.Next() {
+		var transaction ReconciliationTransaction
+		var ticked int
+		if err := rows.Scan(&transaction.ID, &transaction.Type, &transaction.Amount, &transaction.Date,
+			&transaction.Category, &transaction.Description, &transaction.Status, &ticked); err != nil {
+			return nil, err
+		}
+		transaction.Ticked = ticked == 1
+		if transaction.Ticked {
+			switch transaction.Type {
+			case "income", "transfer", "adjustment":
+				cleared += transaction.Amount
+			default:
+				cleared -= transaction.Amount
+			}
+		}
+		transactions = append(transactions, transaction)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	session.ClearedBalance = math.Round(cleared*100) / 100
+	if session.Status == "open" {
+		session.Difference = math.Round((session.StatementBalance-cleared)*100) / 100
+	}
+
+	return &ReconciliationDetail{Session: *session, Transactions: transactions}, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+func setupReconciliationTables(t *testing.T) {
+	for _, table := range []string{"incomes", "expenses"} {
+		_, err := testDB.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id TEXT NOT NULL,
+				amount REAL NOT NULL,
+				date TEXT NOT NULL,
+				category TEXT NOT NULL,
+				payment_method TEXT NOT NULL,
+				description TEXT,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)
+		`, table))
+		if err != nil {
+			t.Fatalf("Failed to create %s table: %v", table, err)
+		}
+	}
+	// Card statement payments read their payment method from the statement bill
+	_, err := testDB.Exec(`
+		CREATE TABLE IF NOT EXISTS bill_payments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			bill_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			year_month TEXT NOT NULL,
+			paid BOOLEAN DEFAULT 0,
+			payment_date TEXT,
+			payment_method TEXT
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create bill_payments table: %v", err)
+	}
+	if err := common.EnsureTransactionStatusColumns(testDB); err != nil {
+		t.Fatalf("Failed to add status columns: %v", err)
+	}
+	if err := common.EnsureVersionColumns(testDB); err != nil {
+		t.Fatalf("Failed to add version columns: %v", err)
+	}
+}
+
+func postReconciliation(t *testing.T, handler http.HandlerFunc, body interface{}) (int, ReconciliationDetail) {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+
+	var response struct {
+		Success bool                 `json:"success"`
+		Message string               `json:"message"`
+		Data    ReconciliationDetail `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	return rr.Code, response.Data
+}
+
+func TestReconciliationWorkflow(t *testing.T) {
+	setupReconciliationTables(t)
+	userID := fmt.Sprintf("test_reconcile_%d", time.Now().UnixNano())
+
+	income, _ := testDB.Exec(`INSERT INTO incomes (user_id, amount, date, category, payment_method) VALUES (?, 1000, '2024-03-01', 'Salary', 'bank')`, userID)
+	incomeID, _ := income.LastInsertId()
+	expense, _ := testDB.Exec(`INSERT INTO expenses (user_id, amount, date, category, payment_method) VALUES (?, 200, '2024-03-05', 'Food', 'bank')`, userID)
+	expenseID, _ := expense.LastInsertId()
+	// Outside the statement period, must not be offered
+	testDB.Exec(`INSERT INTO expenses (user_id, amount, date, category, payment_method) VALUES (?, 50, '2024-04-02', 'Food', 'bank')`, userID)
+
+	status, detail := postReconciliation(t, handleStartReconciliation, StartReconciliationRequest{
+		UserID:           userID,
+		Account:          "bank",
+		StatementDate:    "2024-03-31",
+		StatementBalance: 790,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected start to succeed, got status %d", status)
+	}
+	if len(detail.Transactions) != 2 {
+		t.Fatalf("Expected 2 candidate transactions, got %d", len(detail.Transactions))
+	}
+	sessionID := detail.Session.ID
+
+	for _, tick := range []struct {
+		transactionType string
+		id              int64
+	}{{"income", incomeID}, {"expense", expenseID}} {
+		status, detail = postReconciliation(t, handleTickReconciliation, TickReconciliationRequest{
+			UserID:          userID,
+			SessionID:       sessionID,
+			TransactionType: tick.transactionType,
+			TransactionID:   int(tick.id),
+			Cleared:         true,
+		})
+		if status != http.StatusOK {
+			t.Fatalf("Expected tick to succeed, got status %d", status)
+		}
+	}
+	if detail.Session.ClearedBalance != 800 || detail.Session.Difference != -10 {
+		t.Errorf("Expected cleared 800 and difference -10, got %.2f and %.2f",
+			detail.Session.ClearedBalance, detail.Session.Difference)
+	}
+
+	// A remaining difference requires an explicit adjustment
+	status, _ = postReconciliation(t, handleFinishReconciliation, FinishReconciliationRequest{UserID: userID, SessionID: sessionID})
+	if status != http.StatusConflict {
+		t.Errorf("Expected finishing an unbalanced session to fail with 409, got %d", status)
+	}
+
+	status, detail = postReconciliation(t, handleFinishReconciliation, FinishReconciliationRequest{
+		UserID:         userID,
+		SessionID:      sessionID,
+		PostAdjustment: true,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected finish with adjustment to succeed, got status %d", status)
+	}
+	if detail.Session.Status != "finished" || detail.Session.AdjustmentType != "expense" {
+		t.Errorf("Expected finished session with expense adjustment, got %s/%s",
+			detail.Session.Status, detail.Session.AdjustmentType)
+	}
+
+	var adjustment float64
+	testDB.QueryRow(`SELECT amount FROM expenses WHERE id = ?`, detail.Session.AdjustmentID).Scan(&adjustment)
+	if adjustment != 10 {
+		t.Errorf("Expected adjustment expense of 10, got %.2f", adjustment)
+	}
+
+	if err := common.CheckNotReconciled(testDB, "income", int(incomeID), userID); err != common.ErrTransactionLocked {
+		t.Errorf("Expected reconciled income to be locked, got %v", err)
+	}
+}
+
+func TestReconciliationIncludesTransfersAndCardPayments(t *testing.T) {
+	setupReconciliationTables(t)
+	userID := fmt.Sprintf("test_reconcile_transfers_%d", time.Now().UnixNano())
+
+	testDB.Exec(`INSERT INTO incomes (user_id, amount, date, category, payment_method) VALUES (?, 1000, '2024-03-01', 'Salary', 'bank')`, userID)
+	testDB.Exec(`INSERT INTO cash_bank_transactions (user_id, transaction_type, amount, date) VALUES (?, ?, 200, '2024-03-02')`, userID, common.TransferCashToBank)
+	testDB.Exec(`INSERT INTO cash_bank_transactions (user_id, transaction_type, amount, date) VALUES (?, ?, 50, '2024-03-03')`, userID, common.TransferBankToCash)
+	// History rows that are not transfers are not movements of their own
+	testDB.Exec(`INSERT INTO cash_bank_transactions (user_id, transaction_type, amount, date) VALUES (?, 'credit_card_payment', 300, '2024-03-20')`, userID)
+	card, _ := testDB.Exec(`INSERT INTO credit_cards (user_id, name, closing_day, due_day) VALUES (?, 'Visa', 28, 20)`, userID)
+	cardID, _ := card.LastInsertId()
+	testDB.Exec(`
+		INSERT INTO credit_card_statements (card_id, user_id, period_start, period_end, due_date, balance, paid_amount, status, paid_at)
+		VALUES (?, ?, '2024-02-01', '2024-02-29', '2024-03-20', 300, 300, 'paid', '2024-03-20')
+	`, cardID, userID)
+
+	status, detail := postReconciliation(t, handleStartReconciliation, StartReconciliationRequest{
+		UserID:           userID,
+		Account:          "bank",
+		StatementDate:    "2024-03-31",
+		StatementBalance: 850,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected start to succeed, got status %d", status)
+	}
+	if len(detail.Transactions) != 4 {
+		t.Fatalf("Expected income, both transfers and the card payment as candidates, got %+v", detail.Transactions)
+	}
+
+	for _, transaction := range detail.Transactions {
+		status, detail = postReconciliation(t, handleTickReconciliation, TickReconciliationRequest{
+			UserID:          userID,
+			SessionID:       detail.Session.ID,
+			TransactionType: transaction.Type,
+			TransactionID:   transaction.ID,
+			Cleared:         true,
+		})
+		if status != http.StatusOK {
+			t.Fatalf("Expected ticking the %s to succeed, got status %d", transaction.Type, status)
+		}
+	}
+	if detail.Session.ClearedBalance != 850 || detail.Session.Difference != 0 {
+		t.Fatalf("Expected cleared 850 and no difference, got %.2f and %.2f",
+			detail.Session.ClearedBalance, detail.Session.Difference)
+	}
+
+	status, detail = postReconciliation(t, handleFinishReconciliation, FinishReconciliationRequest{UserID: userID, SessionID: detail.Session.ID})
+	if status != http.StatusOK || detail.Session.AdjustmentType != "" {
+		t.Fatalf("Expected finish without adjustment, got status %d and adjustment %q", status, detail.Session.AdjustmentType)
+	}
+
+	// The transfers are reconciled on the bank side only; cash still sees them with the opposite sign
+	status, detail = postReconciliation(t, handleStartReconciliation, StartReconciliationRequest{
+		UserID:           userID,
+		Account:          "cash",
+		StatementDate:    "2024-03-31",
+		StatementBalance: -150,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected cash start to succeed, got status %d", status)
+	}
+	if len(detail.Transactions) != 2 || detail.Transactions[0].Amount != -200 || detail.Transactions[1].Amount != 50 {
+		t.Errorf("Expected both transfers as cash candidates with -200 and 50, got %+v", detail.Transactions)
+	}
+}
+
+func TestManualBankUpdateIsPostedAsAdjustment(t *testing.T) {
+	setupReconciliationTables(t)
+	userID := fmt.Sprintf("test_bank_adjustment_%d", time.Now().UnixNano())
+	today := time.Now().Format("2006-01-02")
+
+	for _, amount := range []float64{500, 450} {
+		payload, _ := json.Marshal(UpdateAmountRequest{UserID: userID, Amount: amount, Date: today})
+		rr := httptest.NewRecorder()
+		handleUpdateBank(rr, httptest.NewRequest("POST", "/cash-bank/bank/update", bytes.NewBuffer(payload)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected bank update to %.2f to succeed, got status %d", amount, rr.Code)
+		}
+	}
+
+	// Rebuilding the balances from their sources must keep the correction
+	if err := common.RebuildPeriodBalances(testDB, userID); err != nil {
+		t.Fatalf("Failed to rebuild balances: %v", err)
+	}
+	distribution, err := fetchCashBankDistribution(userID)
+	if err != nil {
+		t.Fatalf("Failed to fetch distribution: %v", err)
+	}
+	if distribution.BankAmount != 450 {
+		t.Errorf("Expected the bank balance to stay at 450 after a rebuild, got %.2f", distribution.BankAmount)
+	}
+
+	// Both differences are offered to the next bank reconciliation
+	status, detail := postReconciliation(t, handleStartReconciliation, StartReconciliationRequest{
+		UserID:           userID,
+		Account:          "bank",
+		StatementDate:    today,
+		StatementBalance: 450,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected start to succeed, got status %d", status)
+	}
+	if len(detail.Transactions) != 2 || detail.Transactions[0].Amount != 500 || detail.Transactions[1].Amount != -50 {
+		t.Errorf("Expected adjustments of 500 and -50, got %+v", detail.Transactions)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"hero_budget_backend/common"
+)
+
+type ResetDefaultCategoriesRequest struct {
+	UserID string `json:"user_id"`
+	Locale string `json:"locale,omitempty"` // Defaults to the user's stored locale
+}
+
+// handleResetDefaultCategories creates the missing default categories again and restores the
+// original name and emoji of those that were changed. The user's own categories are kept.
+func handleResetDefaultCategories(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resetRequest ResetDefaultCategoriesRequest
+	if err := json.NewDecoder(r.Body).Decode(&resetRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if resetRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	locale := resetRequest.Locale
+	if locale == "" {
+		err := db.QueryRow(`SELECT COALESCE(locale, '') FROM users WHERE id = ?`, resetRequest.UserID).Scan(&locale)
+		if err == sql.ErrNoRows {
+			sendErrorResponse(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error fetching user locale: %v", err)
+			sendErrorResponse(w, "Error fetching user locale", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	result, err := common.ResetDefaultCategories(db, resetRequest.UserID, locale)
+	if err != nil {
+		log.Printf("Error resetting default categories: %v", err)
+		sendErrorResponse(w, "Error resetting default categories", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, fmt.Sprintf("Default categories reset (%s)", result.Language), result)
+}
+
+// handleApplyDefaultCategories rolls the current default sets in default_categories/ out to every
+// user. "version" has to be bumped in the file for the change to apply.
+// Only the categories the user has not renamed are updated.
+func handleApplyDefaultCategories(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	summary, err := common.ApplyDefaultCategoryUpdates(db)
+	if err != nil {
+		log.Printf("Error applying default category updates: %v", err)
+		sendErrorResponse(w, "Error applying default category updates", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Default categories applied: %d users updated, %d up to date", summary.Users, summary.Skipped)
+	sendSuccessResponse(w, fmt.Sprintf("Default categories applied to %d users", summary.Users), summary)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"hero_budget_backend/common"
+)
+
+type MoveCategoryRequest struct {
+	UserID     string `json:"user_id"`
+	CategoryID int    `json:"category_id"`
+	ParentID   int    `json:"parent_id"`         // 0 makes it a root category
+	Version    int    `json:"version,omitempty"` // Optional precondition, same as If-Match
+}
+
+// CategoryTotal is the amount of a category in the report. Amount is what was recorded
+// directly in it and Total also includes all of its subcategories.
+type CategoryTotal struct {
+	CategoryID int             `json:"category_id"`
+	Name       string          `json:"name"`
+	Emoji      string          `json:"emoji"`
+	ParentID   int             `json:"parent_id,omitempty"`
+	Amount     float64         `json:"amount"`
+	Total      float64         `json:"total"`
+	Count      int             `json:"count"`
+	Children   []CategoryTotal `json:"children,omitempty"`
+}
+
+type CategoryReport struct {
+	UserID     string          `json:"user_id"`
+	Type       string          `json:"type"`
+	StartDate  string          `json:"start_date,omitempty"`
+	EndDate    string          `json:"end_date,omitempty"`
+	Total      float64         `json:"total"`
+	Categories []CategoryTotal `json:"categories"`
+}
+
+// transactionTables maps each category type to the transaction table that uses it
+var transactionTables = map[string]string{"expense": "expenses", "income": "incomes"}
+
+// ensureHierarchyColumns adds parent_id to categories and category_id to incomes and expenses.
+// Duplicate column errors are ignored.
+func ensureHierarchyColumns(db *sql.DB) error {
+	if _, err := db.Exec(`ALTER TABLE categories ADD COLUMN parent_id INTEGER`); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return fmt.Errorf("error adding parent_id to categories: %v", err)
+	}
+	db.Exec(`CREATE INDEX IF NOT EXISTS idx_categories_parent ON categories(user_id, parent_id)`)
+
+	for _, table := range transactionTables {
+		if !tableExists(db, table) {
+			continue
+		}
+		_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN category_id INTEGER`, table))
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return fmt.Errorf("error adding category_id to %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+func tableExists(q *sql.DB, table string) bool {
+	var name string
+	err := q.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&name)
+	return err == nil
+}
+
+// buildCategoryTree nests the flat list under its parents, keeping the order by name.
+// A category whose parent is not in the list (e.g. filtered out by type) is treated as a root.
+func buildCategoryTree(categories []Category) []Category {
+	byID := make(map[int]int, len(categories))
+	for i, category := range categories {
+		byID[category.ID] = i
+	}
+
+	childrenOf := make(map[int][]int)
+	var roots []int
+	for i, category := range categories {
+		if _, ok := byID[category.ParentID]; category.ParentID > 0 && ok {
+			childrenOf[category.ParentID] = append(childrenOf[category.ParentID], i)
+		} else {
+			roots = append(roots, i)
+		}
+	}
+
+	var build func(index int, depth int) Category
+	build = func(index int, depth int) Category {
+		node := categories[index]
+		node.Children = nil
+		// Guard against cycles in corrupt data
+		if depth > len(categories) {
+			return node
+		}
+		for _, child := range childrenOf[node.ID] {
+			node.Children = append(node.Children, build(child, depth+1))
+		}
+		return node
+	}
+
+	tree := make([]Category, 0, len(roots))
+	for _, index := range roots {
+		tree = append(tree, build(index, 0))
+	}
+	return tree
+}
+
+func hasChildren(categoryID int) bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM categories WHERE parent_id = ?`, categoryID).Scan(&count)
+	return count > 0
+}
+
+// isDescendant reports whether candidate is in the subtree of categoryID (itself included)
+func isDescendant(candidate, categoryID int, userID string) (bool, error) {
+	current := candidate
+	for steps := 0; current > 0; steps++ {
+		if current == categoryID {
+			return true, nil
+		}
+		if steps > 1000 {
+			return true, fmt.Errorf("category hierarchy contains a cycle")
+		}
+		err := db.QueryRow(`SELECT COALESCE(parent_id, 0) FROM categories WHERE id = ? AND user_id = ?`,
+			current, userID).Scan(&current)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func handleMoveCategory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var moveRequest MoveCategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&moveRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if moveRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if moveRequest.CategoryID <= 0 || moveRequest.ParentID < 0 {
+		sendErrorResponse(w, "Valid category ID is required", http.StatusBadRequest)
+		return
+	}
+
+	expectedVersion, hasPrecondition, err := common.ExpectedVersion(r, moveRequest.Version)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	category, err := fetchCategoryByID(moveRequest.CategoryID, moveRequest.UserID)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching category: %v", err)
+		sendErrorResponse(w, "Error fetching category", http.StatusInternalServerError)
+		return
+	}
+	if hasPrecondition && category.Version != expectedVersion {
+		sendConflictResponse(w, category)
+		return
+	}
+
+	if moveRequest.ParentID > 0 {
+		parent, err := fetchCategoryByID(moveRequest.ParentID, moveRequest.UserID)
+		if err == sql.ErrNoRows {
+			sendErrorResponse(w, "Parent category not found", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Error fetching parent category: %v", err)
+			sendErrorResponse(w, "Error fetching parent category", http.StatusInternalServerError)
+			return
+		}
+		if parent.Type != category.Type {
+			sendErrorResponse(w, "Subcategory type must match its parent", http.StatusBadRequest)
+			return
+		}
+		// A category cannot hang from itself or from one of its subcategories
+		cycle, err := isDescendant(parent.ID, category.ID, moveRequest.UserID)
+		if err != nil {
+			log.Printf("Error checking category hierarchy: %v", err)
+		}
+		if cycle {
+			sendErrorResponse(w, "A category cannot be moved under itself or one of its subcategories", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var parentID interface{}
+	if moveRequest.ParentID > 0 {
+		parentID = moveRequest.ParentID
+	}
+	result, err := db.Exec(
+		`UPDATE categories SET parent_id = ?, version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+		 WHERE id = ? AND user_id = ? AND (? = 0 OR COALESCE(version, 1) = ?)`,
+		parentID, category.ID, moveRequest.UserID, expectedVersion, expectedVersion,
+	)
+	if err != nil {
+		log.Printf("Error moving category: %v", err)
+		sendErrorResponse(w, "Error moving category", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		if current, fetchErr := fetchCategoryByID(category.ID, moveRequest.UserID); fetchErr == nil {
+			sendConflictResponse(w, current)
+			return
+		}
+		sendErrorResponse(w, common.ErrVersionConflict.Error(), http.StatusConflict)
+		return
+	}
+
+	movedCategory, err := fetchCategoryByID(category.ID, moveRequest.UserID)
+	if err != nil {
+		log.Printf("Error fetching moved category: %v", err)
+		sendErrorResponse(w, "Error fetching moved category", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", movedCategory.ETag)
+	sendSuccessResponse(w, "Category moved successfully", movedCategory)
+}
+
+// handleCategoryReport adds up the transactions per category and rolls each subcategory up into its parents.
+// Parameters: user_id, type (expense by default), optional start_date and end_date (YYYY-MM-DD).
+func handleCategoryReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	userID := query.Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	categoryType := query.Get("type")
+	if categoryType == "" {
+		categoryType = "expense"
+	}
+	if _, ok := transactionTables[categoryType]; !ok {
+		sendErrorResponse(w, "Category type must be 'income' or 'expense'", http.StatusBadRequest)
+		return
+	}
+
+	report, err := buildCategoryReport(userID, categoryType, query.Get("start_date"), query.Get("end_date"))
+	if err != nil {
+		log.Printf("Error building category report: %v", err)
+		sendErrorResponse(w, "Error building category report", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Category report generated successfully", report)
+}
+
+func buildCategoryReport(userID, categoryType, startDate, endDate string) (*CategoryReport, error) {
+	categories, err := fetchCategories(userID, categoryType)
+	if err != nil {
+		return nil, err
+	}
+
+	type sum struct {
+		amount float64
+		count  int
+	}
+	sums := make(map[int]sum)
+	table := transactionTables[categoryType]
+	if tableExists(db, table) {
+		// Transactions that other services store with the name only (bill payments,
+		// installments, card purchases) are grouped with the category of that name, without writing anything
+		rows, err := db.Query(fmt.Sprintf(`
+			SELECT resolved_id, COALESCE(SUM(amount), 0), COUNT(*)
+			FROM (
+				SELECT t.amount, COALESCE(t.category_id, (
+					SELECT c.id FROM categories c
+					WHERE c.user_id = t.user_id AND c.type = ? AND LOWER(c.name) = LOWER(t.category)
+					ORDER BY c.parent_id IS NOT NULL, c.id LIMIT 1
+				)) AS resolved_id
+				FROM %s t
+				WHERE t.user_id = ? AND (? = '' OR t.date >= ?) AND (? = '' OR t.date <= ?)
+			)
+			WHERE resolved_id IS NOT NULL
+			GROUP BY resolved_id
+		`, table), categoryType, userID, startDate, startDate, endDate, endDate)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var categoryID int
+			var s sum
+			if err := rows.Scan(&categoryID, &s.amount, &s.count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			sums[categoryID] = s
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var rollUp func(category Category) CategoryTotal
+	rollUp = func(category Category) CategoryTotal {
+		node := CategoryTotal{
+			CategoryID: category.ID,
+			Name:       category.Name,
+			Emoji:      category.Emoji,
+			ParentID:   category.ParentID,
+			Amount:     sums[category.ID].amount,
+			Count:      sums[category.ID].count,
+		}
+		node.Total = node.Amount
+		for _, child := range category.Children {
+			childTotal := rollUp(child)
+			node.Total += childTotal.Total
+			node.Count += childTotal.Count
+			node.Children = append(node.Children, childTotal)
+		}
+		node.Amount = math.Round(node.Amount*100) / 100
+		node.Total = math.Round(node.Total*100) / 100
+		return node
+	}
+
+	report := &CategoryReport{
+		UserID:     userID,
+		Type:       categoryType,
+		StartDate:  startDate,
+		EndDate:    endDate,
+		Categories: []CategoryTotal{},
+	}
+	for _, root := range buildCategoryTree(categories) {
+		node := rollUp(root)
+		report.Total += node.Total
+		report.Categories = append(report.Categories, node)
+	}
+	report.Total = math.Round(report.Total*100) / 100
+
+	// Categories with the most spending first
+	sort.SliceStable(report.Categories, func(i, j int) bool {
+		return report.Categories[i].Total > report.Categories[j].Total
+	})
+
+	return report, nil
+}
+
+// handleMigrateCategories links the old transactions to their categories once.
+// It is an admin action: without user_id it migrates every user.
+func handleMigrateCategories(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var migrateRequest struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&migrateRequest); err != nil && err != io.EOF {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	migrated, err := migrateCategoryIDs(migrateRequest.UserID)
+	if err != nil {
+		log.Printf("Error migrating categories: %v", err)
+		sendErrorResponse(w, "Error migrating categories", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, fmt.Sprintf("%d transactions linked to categories", migrated), map[string]int{"migrated": migrated})
+}
+
+// migrateCategoryIDs fills in category_id on the incomes and expenses that only store the name,
+// with the same rule used when writing them (common.ResolveCategoryID): the user's category with
+// that name or, if there is none, a new one that keeps it. An empty userID migrates every user.
+func migrateCategoryIDs(userID string) (int, error) {
+	migrated := 0
+
+	for categoryType, table := range transactionTables {
+		if !tableExists(db, table) {
+			continue
+		}
+
+		rows, err := db.Query(fmt.Sprintf(`
+			SELECT DISTINCT user_id, category FROM %s
+			WHERE category_id IS NULL AND category IS NOT NULL AND TRIM(category) != ''
+			  AND (? = '' OR user_id = ?)
+		`, table), userID, userID)
+		if err != nil {
+			return migrated, fmt.Errorf("error reading %s categories: %v", table, err)
+		}
+		type pending struct{ userID, name string }
+		var names []pending
+		for rows.Next() {
+			var p pending
+			if err := rows.Scan(&p.userID, &p.name); err != nil {
+				rows.Close()
+				return migrated, err
+			}
+			names = append(names, p)
+		}
+		rows.Close()
+
+		for _, p := range names {
+			categoryID, err := common.ResolveCategoryID(db, p.userID, categoryType, p.name)
+			if err != nil {
+				return migrated, err
+			}
+
+			result, err := db.Exec(fmt.Sprintf(`
+				UPDATE %s SET category_id = ? WHERE user_id = ? AND category = ? AND category_id IS NULL
+			`, table), categoryID, p.userID, p.name)
+			if err != nil {
+				return migrated, fmt.Errorf("error linking %s to category %q: %v", table, p.name, err)
+			}
+			affected, _ := result.RowsAffected()
+			migrated += int(affected)
+		}
+	}
+
+	return migrated, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"hero_budget_backend/common"
+)
+
+func setupCategoriesDB(t *testing.T) {
+	t.Helper()
+	testDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+	db = testDB
+
+	statements := []string{
+		`CREATE TABLE categories (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT NOT NULL, name TEXT NOT NULL,
+			type TEXT NOT NULL, emoji TEXT NOT NULL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+		`CREATE TABLE expenses (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, amount REAL, date TEXT,
+			category TEXT, payment_method TEXT, description TEXT, updated_at TIMESTAMP)`,
+		`CREATE TABLE incomes (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, amount REAL, date TEXT,
+			category TEXT, payment_method TEXT, description TEXT, updated_at TIMESTAMP)`,
+		`CREATE TABLE bills (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, name TEXT, amount REAL,
+			category TEXT, updated_at TIMESTAMP)`,
+		`CREATE TABLE category_budgets (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, category_id INTEGER,
+			period TEXT, amount REAL, updated_at TIMESTAMP)`,
+		`CREATE TABLE envelope_transfers (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT NOT NULL, month TEXT NOT NULL,
+			from_category_id INTEGER NOT NULL, to_category_id INTEGER NOT NULL, amount REAL NOT NULL, note TEXT)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Failed to create schema: %v", err)
+		}
+	}
+	if err := common.EnsureVersionColumns(db); err != nil {
+		t.Fatalf("Failed to add version columns: %v", err)
+	}
+	if err := ensureHierarchyColumns(db); err != nil {
+		t.Fatalf("Failed to add hierarchy columns: %v", err)
+	}
+	if err := common.EnsureDefaultCategoryTables(db); err != nil {
+		t.Fatalf("Failed to create default category tables: %v", err)
+	}
+}
+
+func addTestCategory(t *testing.T, name, categoryType string, parentID int) int {
+	t.Helper()
+	id, err := addCategory(Category{UserID: "1", Name: name, Type: categoryType, Emoji: "📁", ParentID: parentID})
+	if err != nil {
+		t.Fatalf("Failed to add category %s: %v", name, err)
+	}
+	return id
+}
+
+func postJSON(handler http.HandlerFunc, body interface{}, header ...string) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	request := httptest.NewRequest("POST", "/", bytes.NewBuffer(payload))
+	for i := 0; i+1 < len(header); i += 2 {
+		request.Header.Set(header[i], header[i+1])
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, request)
+	return rr
+}
+
+func parentOf(t *testing.T, categoryID int) int {
+	t.Helper()
+	var parentID int
+	if err := db.QueryRow(`SELECT COALESCE(parent_id, 0) FROM categories WHERE id = ?`, categoryID).Scan(&parentID); err != nil {
+		t.Fatalf("Failed to read category %d: %v", categoryID, err)
+	}
+	return parentID
+}
+
+func TestCategoryTreeNestsSubcategories(t *testing.T) {
+	setupCategoriesDB(t)
+
+	transport := addTestCategory(t, "Transport", "expense", 0)
+	addTestCategory(t, "Parking", "expense", transport)
+	addTestCategory(t, "Fuel", "expense", transport)
+	addTestCategory(t, "Food", "expense", 0)
+
+	categories, err := fetchCategories("1", "expense")
+	if err != nil {
+		t.Fatalf("Failed to fetch categories: %v", err)
+	}
+	tree := buildCategoryTree(categories)
+
+	if len(tree) != 2 || tree[0].Name != "Food" || tree[1].Name != "Transport" {
+		t.Fatalf("Expected Food and Transport as roots, got %+v", tree)
+	}
+	children := tree[1].Children
+	if len(children) != 2 || children[0].Name != "Fuel" || children[1].Name != "Parking" {
+		t.Errorf("Expected Fuel and Parking under Transport, got %+v", children)
+	}
+	if len(tree[0].Children) != 0 {
+		t.Errorf("Expected Food to have no subcategories, got %+v", tree[0].Children)
+	}
+
+	// A subcategory whose parent is filtered out is shown as a root
+	orphan := buildCategoryTree(categories[1:2])
+	if len(orphan) != 1 || orphan[0].Name != "Fuel" {
+		t.Errorf("Expected a subcategory without its parent to be a root, got %+v", orphan)
+	}
+}
+
+func TestMoveCategoryRejectsCycles(t *testing.T) {
+	setupCategoriesDB(t)
+
+	transport := addTestCategory(t, "Transport", "expense", 0)
+	fuel := addTestCategory(t, "Fuel", "expense", transport)
+	diesel := addTestCategory(t, "Diesel", "expense", fuel)
+	food := addTestCategory(t, "Food", "expense", 0)
+	salary := addTestCategory(t, "Salary", "income", 0)
+
+	rejected := []struct {
+		name     string
+		category int
+		parent   int
+	}{
+		{"under itself", transport, transport},
+		{"under its child", transport, fuel},
+		{"under its grandchild", transport, diesel},
+		{"under another type", fuel, salary},
+	}
+	for _, tc := range rejected {
+		rr := postJSON(handleMoveCategory, MoveCategoryRequest{UserID: "1", CategoryID: tc.category, ParentID: tc.parent})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected moving %s to fail, got %d: %s", tc.name, rr.Code, rr.Body.String())
+		}
+	}
+	if parentOf(t, transport) != 0 || parentOf(t, fuel) != transport {
+		t.Fatalf("Expected rejected moves to leave the tree unchanged")
+	}
+
+	// Fuel moves to Food with its subcategory
+	if rr := postJSON(handleMoveCategory, MoveCategoryRequest{UserID: "1", CategoryID: fuel, ParentID: food}); rr.Code != http.StatusOK {
+		t.Fatalf("Expected moving Fuel under Food to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if parentOf(t, fuel) != food || parentOf(t, diesel) != fuel {
+		t.Errorf("Expected Fuel under Food and Diesel still under Fuel")
+	}
+
+	// Now Transport can hang from Diesel, which is no longer its own
+	if rr := postJSON(handleMoveCategory, MoveCategoryRequest{UserID: "1", CategoryID: transport, ParentID: diesel}); rr.Code != http.StatusOK {
+		t.Errorf("Expected moving Transport under Diesel to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// parent_id 0 makes it a root again
+	if rr := postJSON(handleMoveCategory, MoveCategoryRequest{UserID: "1", CategoryID: transport}); rr.Code != http.StatusOK || parentOf(t, transport) != 0 {
+		t.Errorf("Expected Transport back at the root, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestCategoryReportRollsUpSubcategories(t *testing.T) {
+	setupCategoriesDB(t)
+
+	transport := addTestCategory(t, "Transport", "expense", 0)
+	fuel := addTestCategory(t, "Fuel", "expense", transport)
+	addTestCategory(t, "Parking", "expense", transport)
+	food := addTestCategory(t, "Food", "expense", 0)
+
+	expenses := []struct {
+		amount     float64
+		date       string
+		category   string
+		categoryID interface{}
+	}{
+		{40, "2025-03-02", "Fuel", fuel},
+		{12.5, "2025-03-05", "Fuel", fuel},
+		{10, "2025-03-06", "parking", nil}, // Stored with the name only
+		{5, "2025-03-07", "Transport", transport},
+		{20, "2025-03-08", "Food", food},
+		{99, "2025-03-09", "Mystery", nil}, // No category with that name
+		{30, "2025-04-01", "Food", food},   // Out of range
+	}
+	for _, e := range expenses {
+		mustExec(t, `INSERT INTO expenses (user_id, amount, date, category, category_id, payment_method) VALUES ('1', ?, ?, ?, ?, 'bank')`,
+			e.amount, e.date, e.category, e.categoryID)
+	}
+
+	report, err := buildCategoryReport("1", "expense", "2025-03-01", "2025-03-31")
+	if err != nil {
+		t.Fatalf("Failed to build report: %v", err)
+	}
+
+	if report.Total != 87.5 || len(report.Categories) != 2 {
+		t.Fatalf("Expected 87.50 across two roots, got %.2f in %+v", report.Total, report.Categories)
+	}
+	root := report.Categories[0]
+	if root.Name != "Transport" || root.Amount != 5 || root.Total != 67.5 || root.Count != 4 {
+		t.Errorf("Expected Transport first with 5 of its own and 67.50 in total, got %+v", root)
+	}
+	if len(root.Children) != 2 || root.Children[0].Total != 52.5 || root.Children[1].Total != 10 {
+		t.Errorf("Expected Fuel 52.50 and Parking 10 under Transport, got %+v", root.Children)
+	}
+	if report.Categories[1].Name != "Food" || report.Categories[1].Total != 20 {
+		t.Errorf("Expected Food with 20, got %+v", report.Categories[1])
+	}
+
+	// Reading the report neither links nor creates anything
+	var unlinked, categories int
+	db.QueryRow(`SELECT COUNT(*) FROM expenses WHERE category_id IS NULL`).Scan(&unlinked)
+	db.QueryRow(`SELECT COUNT(*) FROM categories`).Scan(&categories)
+	if unlinked != 2 || categories != 4 {
+		t.Errorf("Expected the report to write nothing, got %d unlinked expenses and %d categories", unlinked, categories)
+	}
+}
+
+func TestMigrateCategoriesIsAnAdminAction(t *testing.T) {
+	setupCategoriesDB(t)
+	t.Setenv(common.AdminTokenEnv, "secret")
+
+	food := addTestCategory(t, "Food", "expense", 0)
+	mustExec(t, `INSERT INTO expenses (user_id, amount, date, category, payment_method) VALUES ('1', 20, '2025-03-01', 'food', 'bank')`)
+	mustExec(t, `INSERT INTO expenses (user_id, amount, date, category, payment_method) VALUES ('2', 15, '2025-03-01', 'Gym', 'bank')`)
+	mustExec(t, `INSERT INTO incomes (user_id, amount, date, category, payment_method) VALUES ('1', 900, '2025-03-01', 'Salary', 'bank')`)
+
+	handler := common.RequireAdmin(handleMigrateCategories)
+	if rr := postJSON(handler, map[string]string{}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the migration to require the admin token, got %d", rr.Code)
+	}
+
+	rr := postJSON(handler, map[string]string{}, common.AdminTokenHeader, "secret")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the migration to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Data map[string]int `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	if response.Data["migrated"] != 3 {
+		t.Errorf("Expected 3 transactions linked for every user, got %d", response.Data["migrated"])
+	}
+
+	var foodID int
+	db.QueryRow(`SELECT category_id FROM expenses WHERE user_id = '1'`).Scan(&foodID)
+	if foodID != food {
+		t.Errorf("Expected the expense linked to Food (%d), got %d", food, foodID)
+	}
+	// Names without a category are kept by creating it
+	var gym, salary int
+	db.QueryRow(`SELECT COUNT(*) FROM categories WHERE user_id = '2' AND name = 'Gym' AND type = 'expense'`).Scan(&gym)
+	db.QueryRow(`SELECT COUNT(*) FROM categories WHERE user_id = '1' AND name = 'Salary' AND type = 'income'`).Scan(&salary)
+	if gym != 1 || salary != 1 {
+		t.Errorf("Expected Gym and Salary categories to be created, got %d and %d", gym, salary)
+	}
+}
+
+func mustExec(t *testing.T, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("Failed to run %q: %v", query, err)
+	}
+}
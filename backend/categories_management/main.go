@@ -12,6 +12,8 @@ import (
 	"strings"
 	"unicode/utf8"
 
+	"hero_budget_backend/common"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -22,15 +24,21 @@ type Category struct {
 	Name      string `json:"name"`
 	Type      string `json:"type"` // "income" o "expense"
 	Emoji     string `json:"emoji"`
+	ParentID  int    `json:"parent_id,omitempty"` // 0 for root categories
 	CreatedAt string `json:"created_at,omitempty"`
 	UpdatedAt string `json:"updated_at,omitempty"`
+	Version   int    `json:"version"`
+	ETag      string `json:"etag,omitempty"`
+
+	Children []Category `json:"children,omitempty"`
 }
 
 type AddCategoryRequest struct {
-	UserID string `json:"user_id"`
-	Name   string `json:"name"`
-	Type   string `json:"type"` // "income" o "expense"
-	Emoji  string `json:"emoji"`
+	UserID   string `json:"user_id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"` // "income" o "expense"
+	Emoji    string `json:"emoji"`
+	ParentID int    `json:"parent_id,omitempty"`
 }
 
 type UpdateCategoryRequest struct {
@@ -39,11 +47,13 @@ type UpdateCategoryRequest struct {
 	Name       string `json:"name,omitempty"`
 	Type       string `json:"type,omitempty"` // "income" o "expense"
 	Emoji      string `json:"emoji,omitempty"`
+	Version    int    `json:"version,omitempty"` // Optional precondition, same as If-Match
 }
 
 type DeleteCategoryRequest struct {
 	UserID     string `json:"user_id"`
 	CategoryID int    `json:"category_id"`
+	ReassignTo int    `json:"reassign_to,omitempty"` // Where its transactions go; "Uncategorized" by default
 }
 
 type ApiResponse struct {
@@ -128,16 +138,43 @@ func openDatabaseConnection() (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Row version for optimistic concurrency, also on the incomes, expenses
+	// and bills that merges reassign
+	if err := common.EnsureVersionColumns(db); err != nil {
+		return nil, err
+	}
+
+	// Category hierarchy and the reference from incomes and expenses
+	if err := ensureHierarchyColumns(db); err != nil {
+		return nil, err
+	}
+
+	// Columns and registry of the default categories
+	if err := common.EnsureDefaultCategoryTables(db); err != nil {
+		return nil, err
+	}
+
+	// Stored responses of requests retried with an Idempotency-Key
+	if err := common.EnsureIdempotencyTable(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
 
 func main() {
 	// Set up CORS middleware and routes
 	http.HandleFunc("/categories", corsMiddleware(handleFetchCategories))
-	http.HandleFunc("/categories/add", corsMiddleware(handleAddCategory))
-	http.HandleFunc("/categories/update", corsMiddleware(handleUpdateCategory))
-	http.HandleFunc("/categories/delete", corsMiddleware(handleDeleteCategory))
+	http.HandleFunc("/categories/add", corsMiddleware(common.WithIdempotency(db, handleAddCategory)))
+	http.HandleFunc("/categories/update", corsMiddleware(common.WithIdempotency(db, handleUpdateCategory)))
+	http.HandleFunc("/categories/delete", corsMiddleware(common.WithIdempotency(db, handleDeleteCategory)))
 	http.HandleFunc("/categories/fix-emojis", corsMiddleware(handleFixEmojis))
+	http.HandleFunc("/categories/move", corsMiddleware(common.WithIdempotency(db, handleMoveCategory)))
+	http.HandleFunc("/categories/merge", corsMiddleware(common.WithIdempotency(db, handleMergeCategories)))
+	http.HandleFunc("/categories/report", corsMiddleware(handleCategoryReport))
+	http.HandleFunc("/categories/migrate", common.RequireAdmin(handleMigrateCategories))
+	http.HandleFunc("/categories/reset-defaults", corsMiddleware(handleResetDefaultCategories))
+	http.HandleFunc("/categories/defaults/apply", common.RequireAdmin(handleApplyDefaultCategories))
 
 	port := 8096 // Puerto para el servicio de categorías
 	log.Printf("Categories Management service started on :%d", port)
@@ -149,7 +186,8 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// Set headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		// If it's OPTIONS, return with just the headers (preflight request)
 		if r.Method == "OPTIONS" {
@@ -177,6 +215,8 @@ func handleFetchCategories(w http.ResponseWriter, r *http.Request) {
 
 	// Get optional type filter
 	categoryType := r.URL.Query().Get("type") // "income", "expense", or empty for all
+	// flat=true returns the previous flat list instead of the tree
+	flat := r.URL.Query().Get("flat") == "true"
 
 	// Get categories from database
 	categories, err := fetchCategories(userID, categoryType)
@@ -186,6 +226,10 @@ func handleFetchCategories(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !flat {
+		categories = buildCategoryTree(categories)
+	}
+
 	// Return categories as JSON
 	sendSuccessResponse(w, "Categories fetched successfully", categories)
 }
@@ -229,12 +273,31 @@ func handleAddCategory(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// A subcategory must hang from a category of the same user and type
+	if addRequest.ParentID > 0 {
+		parent, err := fetchCategoryByID(addRequest.ParentID, addRequest.UserID)
+		if err == sql.ErrNoRows {
+			sendErrorResponse(w, "Parent category not found", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Error fetching parent category: %v", err)
+			sendErrorResponse(w, "Error fetching parent category", http.StatusInternalServerError)
+			return
+		}
+		if parent.Type != addRequest.Type {
+			sendErrorResponse(w, "Subcategory type must match its parent", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Create category object
 	category := Category{
-		UserID: addRequest.UserID,
-		Name:   addRequest.Name,
-		Type:   addRequest.Type,
-		Emoji:  addRequest.Emoji,
+		UserID:   addRequest.UserID,
+		Name:     addRequest.Name,
+		Type:     addRequest.Type,
+		Emoji:    addRequest.Emoji,
+		ParentID: addRequest.ParentID,
 	}
 
 	// Add category to database
@@ -289,6 +352,13 @@ func handleUpdateCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Optional precondition from If-Match or the version field
+	expectedVersion, hasPrecondition, err := common.ExpectedVersion(r, updateRequest.Version)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Fetch existing category
 	existingCategory, err := fetchCategoryByID(updateRequest.CategoryID, updateRequest.UserID)
 	if err != nil {
@@ -301,11 +371,21 @@ func handleUpdateCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if hasPrecondition && existingCategory.Version != expectedVersion {
+		sendConflictResponse(w, existingCategory)
+		return
+	}
+
 	// Update fields if provided
 	if updateRequest.Name != "" {
 		existingCategory.Name = updateRequest.Name
 	}
-	if updateRequest.Type != "" {
+	if updateRequest.Type != "" && updateRequest.Type != existingCategory.Type {
+		// The type is inherited within the hierarchy
+		if existingCategory.ParentID > 0 || hasChildren(existingCategory.ID) {
+			sendErrorResponse(w, "Cannot change the type of a category inside a hierarchy", http.StatusBadRequest)
+			return
+		}
 		existingCategory.Type = updateRequest.Type
 	}
 	if updateRequest.Emoji != "" {
@@ -313,7 +393,16 @@ func handleUpdateCategory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update category in database
-	err = updateCategory(*existingCategory)
+	err = updateCategory(*existingCategory, expectedVersion)
+	if err == common.ErrVersionConflict {
+		// Another request changed the category between the read and the write
+		if current, fetchErr := fetchCategoryByID(updateRequest.CategoryID, updateRequest.UserID); fetchErr == nil {
+			sendConflictResponse(w, current)
+			return
+		}
+		sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Printf("Error updating category: %v", err)
 		sendErrorResponse(w, "Error updating category", http.StatusInternalServerError)
@@ -331,6 +420,7 @@ func handleUpdateCategory(w http.ResponseWriter, r *http.Request) {
 	log.Printf("DEBUG - Emoji después de actualización: %s", updatedCategory.Emoji)
 
 	// Return success response with the updated category
+	w.Header().Set("ETag", updatedCategory.ETag)
 	sendSuccessResponse(w, "Category updated successfully", updatedCategory)
 }
 
@@ -359,8 +449,30 @@ func handleDeleteCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete category from database
-	err = deleteCategory(deleteRequest.CategoryID, deleteRequest.UserID)
+	if deleteRequest.ReassignTo == deleteRequest.CategoryID {
+		sendErrorResponse(w, "Cannot reassign a category to itself", http.StatusBadRequest)
+		return
+	}
+
+	// Validate source and target before rewriting the transactions
+	if deleteRequest.ReassignTo > 0 {
+		_, _, status, message := loadReassignmentPair(deleteRequest.UserID, deleteRequest.CategoryID, deleteRequest.ReassignTo)
+		if status != 0 {
+			sendErrorResponse(w, message, status)
+			return
+		}
+	}
+
+	// Delete category from database, moving its transactions to the target
+	counts, err := deleteCategory(deleteRequest.CategoryID, deleteRequest.UserID, deleteRequest.ReassignTo)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	if err == errCannotDeleteDefault {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		log.Printf("Error deleting category: %v", err)
 		sendErrorResponse(w, "Error deleting category", http.StatusInternalServerError)
@@ -368,7 +480,7 @@ func handleDeleteCategory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return success response
-	sendSuccessResponse(w, "Category deleted successfully", nil)
+	sendSuccessResponse(w, "Category deleted successfully", counts)
 }
 
 func handleFixEmojis(w http.ResponseWriter, r *http.Request) {
@@ -416,7 +528,7 @@ func handleFixEmojis(w http.ResponseWriter, r *http.Request) {
 
 		// Actualizar la categoría
 		_, err := db.Exec(
-			`UPDATE categories SET emoji = ? WHERE id = ? AND user_id = ?`,
+			`UPDATE categories SET emoji = ?, version = COALESCE(version, 1) + 1 WHERE id = ? AND user_id = ?`,
 			encodedEmoji, id, userId,
 		)
 
@@ -448,11 +560,11 @@ func fetchCategories(userID, categoryType string) ([]Category, error) {
 
 	if categoryType == "" {
 		// Fetch all categories for the user
-		query = `SELECT id, user_id, name, type, emoji, created_at, updated_at FROM categories WHERE user_id = ? ORDER BY name ASC`
+		query = `SELECT id, user_id, name, type, emoji, COALESCE(parent_id, 0), created_at, updated_at, COALESCE(version, 1) FROM categories WHERE user_id = ? ORDER BY name ASC`
 		args = []interface{}{userID}
 	} else {
 		// Fetch categories of specific type
-		query = `SELECT id, user_id, name, type, emoji, created_at, updated_at FROM categories WHERE user_id = ? AND type = ? ORDER BY name ASC`
+		query = `SELECT id, user_id, name, type, emoji, COALESCE(parent_id, 0), created_at, updated_at, COALESCE(version, 1) FROM categories WHERE user_id = ? AND type = ? ORDER BY name ASC`
 		args = []interface{}{userID, categoryType}
 	}
 
@@ -473,8 +585,10 @@ func fetchCategories(userID, categoryType string) ([]Category, error) {
 			&category.Name,
 			&category.Type,
 			&encodedEmoji, // Leer el emoji codificado
+			&category.ParentID,
 			&category.CreatedAt,
 			&category.UpdatedAt,
+			&category.Version,
 		)
 		if err != nil {
 			return nil, err
@@ -482,6 +596,7 @@ func fetchCategories(userID, categoryType string) ([]Category, error) {
 
 		// Decodificar el emoji antes de agregarlo al objeto Category
 		category.Emoji = decodeEmoji(encodedEmoji)
+		category.ETag = common.ETag(category.Version)
 
 		categories = append(categories, category)
 	}
@@ -494,7 +609,7 @@ func fetchCategoryByID(categoryID int, userID string) (*Category, error) {
 	var encodedEmoji string
 
 	err := db.QueryRow(
-		`SELECT id, user_id, name, type, emoji, created_at, updated_at FROM categories WHERE id = ? AND user_id = ?`,
+		`SELECT id, user_id, name, type, emoji, COALESCE(parent_id, 0), created_at, updated_at, COALESCE(version, 1) FROM categories WHERE id = ? AND user_id = ?`,
 		categoryID, userID,
 	).Scan(
 		&category.ID,
@@ -502,8 +617,10 @@ func fetchCategoryByID(categoryID int, userID string) (*Category, error) {
 		&category.Name,
 		&category.Type,
 		&encodedEmoji,
+		&category.ParentID,
 		&category.CreatedAt,
 		&category.UpdatedAt,
+		&category.Version,
 	)
 	if err != nil {
 		return nil, err
@@ -511,6 +628,7 @@ func fetchCategoryByID(categoryID int, userID string) (*Category, error) {
 
 	// Decodificar el emoji
 	category.Emoji = decodeEmoji(encodedEmoji)
+	category.ETag = common.ETag(category.Version)
 
 	return &category, nil
 }
@@ -519,9 +637,14 @@ func addCategory(category Category) (int, error) {
 	// Codificar el emoji antes de guardarlo
 	encodedEmoji := encodeEmoji(category.Emoji)
 
+	var parentID interface{}
+	if category.ParentID > 0 {
+		parentID = category.ParentID
+	}
+
 	result, err := db.Exec(
-		`INSERT INTO categories (user_id, name, type, emoji) VALUES (?, ?, ?, ?)`,
-		category.UserID, category.Name, category.Type, encodedEmoji,
+		`INSERT INTO categories (user_id, name, type, emoji, parent_id) VALUES (?, ?, ?, ?, ?)`,
+		category.UserID, category.Name, category.Type, encodedEmoji, parentID,
 	)
 	if err != nil {
 		return 0, err
@@ -535,23 +658,30 @@ func addCategory(category Category) (int, error) {
 	return int(id), nil
 }
 
-func updateCategory(category Category) error {
+// updateCategory overwrites the category and bumps its version. If expectedVersion is
+// greater than zero, it only applies while the stored version still matches.
+func updateCategory(category Category, expectedVersion int) error {
 	// Codificar el emoji antes de guardarlo
 	encodedEmoji := encodeEmoji(category.Emoji)
 
-	_, err := db.Exec(
-		`UPDATE categories SET name = ?, type = ?, emoji = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ?`,
-		category.Name, category.Type, encodedEmoji, category.ID, category.UserID,
+	result, err := db.Exec(
+		`UPDATE categories SET name = ?, type = ?, emoji = ?, version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+		 WHERE id = ? AND user_id = ? AND (? = 0 OR COALESCE(version, 1) = ?)`,
+		category.Name, category.Type, encodedEmoji, category.ID, category.UserID, expectedVersion, expectedVersion,
 	)
-	return err
-}
+	if err != nil {
+		return err
+	}
 
-func deleteCategory(categoryID int, userID string) error {
-	_, err := db.Exec(
-		`DELETE FROM categories WHERE id = ? AND user_id = ?`,
-		categoryID, userID,
-	)
-	return err
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 && expectedVersion > 0 {
+		return common.ErrVersionConflict
+	}
+
+	return nil
 }
 
 func sendSuccessResponse(w http.ResponseWriter, message string, data interface{}) {
@@ -563,6 +693,18 @@ func sendSuccessResponse(w http.ResponseWriter, message string, data interface{}
 	})
 }
 
+// sendConflictResponse returns 409 with the server's current copy
+func sendConflictResponse(w http.ResponseWriter, current *Category) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", current.ETag)
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(ApiResponse{
+		Success: false,
+		Message: "Category was modified by another request",
+		Data:    current,
+	})
+}
+
 func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// uncategorizedName is the default category that receives the transactions of a category
+// deleted without an explicit target
+const uncategorizedName = "Uncategorized"
+
+type MergeCategoriesRequest struct {
+	UserID   string `json:"user_id"`
+	SourceID int    `json:"source_id"` // Category that goes away
+	TargetID int    `json:"target_id"` // Category that receives its transactions
+}
+
+// ReassignmentCounts sums up the rows rewritten when a category is merged or deleted
+type ReassignmentCounts struct {
+	TargetID      int    `json:"target_id"`
+	TargetName    string `json:"target_name"`
+	Expenses      int    `json:"expenses"`
+	Incomes       int    `json:"incomes"`
+	Bills         int    `json:"bills"`
+	Budgets       int    `json:"budgets"`
+	Subcategories int    `json:"subcategories"`
+}
+
+func handleMergeCategories(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var mergeRequest MergeCategoriesRequest
+	if err := json.NewDecoder(r.Body).Decode(&mergeRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if mergeRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if mergeRequest.SourceID <= 0 || mergeRequest.TargetID <= 0 {
+		sendErrorResponse(w, "Valid source and target category IDs are required", http.StatusBadRequest)
+		return
+	}
+	if mergeRequest.SourceID == mergeRequest.TargetID {
+		sendErrorResponse(w, "Cannot merge a category into itself", http.StatusBadRequest)
+		return
+	}
+
+	source, target, status, message := loadReassignmentPair(mergeRequest.UserID, mergeRequest.SourceID, mergeRequest.TargetID)
+	if status != 0 {
+		sendErrorResponse(w, message, status)
+		return
+	}
+
+	counts, err := removeCategory(source, target, true)
+	if err != nil {
+		log.Printf("Error merging categories: %v", err)
+		sendErrorResponse(w, "Error merging categories", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, fmt.Sprintf("Category '%s' merged into '%s'", source.Name, target.Name), counts)
+}
+
+// loadReassignmentPair reads the source and the target and checks that they are compatible.
+// It returns a non-zero HTTP status if they are not.
+func loadReassignmentPair(userID string, sourceID, targetID int) (*Category, *Category, int, string) {
+	source, err := fetchCategoryByID(sourceID, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil, http.StatusNotFound, "Category not found"
+	}
+	if err != nil {
+		log.Printf("Error fetching category: %v", err)
+		return nil, nil, http.StatusInternalServerError, "Error fetching category"
+	}
+
+	target, err := fetchCategoryByID(targetID, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil, http.StatusBadRequest, "Target category not found"
+	}
+	if err != nil {
+		log.Printf("Error fetching target category: %v", err)
+		return nil, nil, http.StatusInternalServerError, "Error fetching target category"
+	}
+
+	if source.Type != target.Type {
+		return nil, nil, http.StatusBadRequest, "Source and target categories must have the same type"
+	}
+	return source, target, 0, ""
+}
+
+// deleteCategory deletes the category and reassigns its transactions to targetID, or to the
+// "Uncategorized" category of the same type if targetID is 0. Subcategories move up one level.
+func deleteCategory(categoryID int, userID string, targetID int) (*ReassignmentCounts, error) {
+	source, err := fetchCategoryByID(categoryID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *Category
+	if targetID > 0 {
+		target, err = fetchCategoryByID(targetID, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return removeCategory(source, target, false)
+}
+
+// removeCategory rewrites in a single transaction every income, expense, bill and budget
+// that points to source so that it points to target, and then deletes source.
+// With mergeChildren the subcategories move to target; otherwise they move up to source's parent.
+func removeCategory(source, target *Category, mergeChildren bool) (*ReassignmentCounts, error) {
+	// If the target is inside the source's subtree, it takes the source's place in the tree
+	// so that moving the subcategories does not create a cycle
+	targetInsideSource := false
+	if target != nil && mergeChildren {
+		inside, err := isDescendant(target.ID, source.ID, source.UserID)
+		if err != nil {
+			return nil, err
+		}
+		targetInsideSource = inside
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if target == nil {
+		target, err = ensureUncategorized(tx, source.UserID, source.Type)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving default category: %v", err)
+		}
+		if target.ID == source.ID {
+			return nil, errCannotDeleteDefault
+		}
+	}
+
+	counts := &ReassignmentCounts{TargetID: target.ID, TargetName: target.Name}
+
+	// Subcategories
+	newParent := nullableID(source.ParentID)
+	if mergeChildren {
+		newParent = target.ID
+		if targetInsideSource {
+			if _, err = tx.Exec(`UPDATE categories SET parent_id = ?, version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+				nullableID(source.ParentID), target.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	counts.Subcategories, err = execCount(tx, `
+		UPDATE categories SET parent_id = ?, version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE parent_id = ? AND user_id = ? AND id != ?
+	`, newParent, source.ID, source.UserID, target.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error moving subcategories: %v", err)
+	}
+
+	// Incomes and expenses: by category_id or, if they are not linked yet, by name
+	table := transactionTables[source.Type]
+	if tableExists(db, table) {
+		changed, err := execCount(tx, fmt.Sprintf(`
+			UPDATE %s SET category = ?, category_id = ?, version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+			WHERE user_id = ? AND (category_id = ? OR (category_id IS NULL AND LOWER(category) = LOWER(?)))
+		`, table), target.Name, target.ID, source.UserID, source.ID, source.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error reassigning %s: %v", table, err)
+		}
+		if source.Type == "income" {
+			counts.Incomes = changed
+		} else {
+			counts.Expenses = changed
+		}
+	}
+
+	// Bills only store the name of the expense category
+	if source.Type == "expense" && tableExists(db, "bills") {
+		counts.Bills, err = execCount(tx, `
+			UPDATE bills SET category = ?, version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+			WHERE user_id = ? AND LOWER(category) = LOWER(?)
+		`, target.Name, source.UserID, source.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error reassigning bills: %v", err)
+		}
+	}
+
+	// Category budgets: if the target already has a budget for the same period they are added up
+	if tableExists(db, "category_budgets") {
+		counts.Budgets, err = mergeCategoryBudgets(tx, source.UserID, source.ID, target.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error reassigning budgets: %v", err)
+		}
+	}
+
+	// Envelopes: the money assigned to the source moves to the target
+	if source.Type == "expense" && tableExists(db, "envelope_transfers") {
+		for _, column := range []string{"from_category_id", "to_category_id"} {
+			if _, err = tx.Exec(fmt.Sprintf(`UPDATE envelope_transfers SET %s = ? WHERE user_id = ? AND %s = ?`, column, column),
+				target.ID, source.UserID, source.ID); err != nil {
+				return nil, fmt.Errorf("error reassigning envelopes: %v", err)
+			}
+		}
+		// A move between source and target is cancelled out
+		if _, err = tx.Exec(`DELETE FROM envelope_transfers WHERE user_id = ? AND from_category_id = to_category_id`,
+			source.UserID); err != nil {
+			return nil, fmt.Errorf("error reassigning envelopes: %v", err)
+		}
+	}
+
+	if _, err = tx.Exec(`DELETE FROM categories WHERE id = ? AND user_id = ?`, source.ID, source.UserID); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func mergeCategoryBudgets(tx *sql.Tx, userID string, sourceID, targetID int) (int, error) {
+	merged, err := execCount(tx, `
+		UPDATE category_budgets
+		SET amount = amount + (
+			SELECT s.amount FROM category_budgets s
+			WHERE s.user_id = category_budgets.user_id AND s.category_id = ? AND s.period = category_budgets.period
+		), updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND category_id = ? AND EXISTS (
+			SELECT 1 FROM category_budgets s
+			WHERE s.user_id = category_budgets.user_id AND s.category_id = ? AND s.period = category_budgets.period
+		)
+	`, sourceID, userID, targetID, sourceID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tx.Exec(`
+		DELETE FROM category_budgets
+		WHERE user_id = ? AND category_id = ? AND period IN (
+			SELECT period FROM category_budgets WHERE user_id = ? AND category_id = ?
+		)
+	`, userID, sourceID, userID, targetID); err != nil {
+		return 0, err
+	}
+	moved, err := execCount(tx, `
+		UPDATE category_budgets SET category_id = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND category_id = ?
+	`, targetID, userID, sourceID)
+	return merged + moved, err
+}
+
+var errCannotDeleteDefault = fmt.Errorf("the default '%s' category needs an explicit reassignment target", uncategorizedName)
+
+// ensureUncategorized returns the root "Uncategorized" category of the given type, creating it if missing
+func ensureUncategorized(tx *sql.Tx, userID, categoryType string) (*Category, error) {
+	category := &Category{UserID: userID, Name: uncategorizedName, Type: categoryType}
+	err := tx.QueryRow(`
+		SELECT id, name FROM categories
+		WHERE user_id = ? AND type = ? AND LOWER(name) = LOWER(?) AND parent_id IS NULL
+		ORDER BY id LIMIT 1
+	`, userID, categoryType, uncategorizedName).Scan(&category.ID, &category.Name)
+	if err == nil {
+		return category, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	result, err := tx.Exec(`INSERT INTO categories (user_id, name, type, emoji) VALUES (?, ?, ?, ?)`,
+		userID, uncategorizedName, categoryType, encodeEmoji("📦"))
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	category.ID = int(id)
+	return category, nil
+}
+
+func execCount(tx *sql.Tx, query string, args ...interface{}) (int, error) {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
+
+// nullableID turns the 0 of root categories into NULL
+func nullableID(id int) interface{} {
+	if id > 0 {
+		return id
+	}
+	return nil
+}
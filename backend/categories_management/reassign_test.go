@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func reassignmentCounts(t *testing.T, handler http.HandlerFunc, body interface{}) ReassignmentCounts {
+	t.Helper()
+	rr := postJSON(handler, body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Data ReassignmentCounts `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return response.Data
+}
+
+func countCategoryRows(t *testing.T, query string, args ...interface{}) int {
+	t.Helper()
+	var count int
+	if err := db.QueryRow(query, args...).Scan(&count); err != nil {
+		t.Fatalf("Failed to run %q: %v", query, err)
+	}
+	return count
+}
+
+func TestMergeCategoryMovesEverythingToTarget(t *testing.T) {
+	setupCategoriesDB(t)
+
+	groceries := addTestCategory(t, "Groceries", "expense", 0)
+	snacks := addTestCategory(t, "Snacks", "expense", groceries)
+	food := addTestCategory(t, "Food", "expense", 0)
+
+	mustExec(t, `INSERT INTO expenses (user_id, amount, date, category, category_id) VALUES ('1', 30, '2025-03-01', 'Groceries', ?)`, groceries)
+	mustExec(t, `INSERT INTO expenses (user_id, amount, date, category, category_id) VALUES ('1', 20, '2025-03-02', 'Groceries', ?)`, groceries)
+	mustExec(t, `INSERT INTO expenses (user_id, amount, date, category) VALUES ('1', 10, '2025-03-03', 'groceries')`) // Sin enlazar
+	mustExec(t, `INSERT INTO expenses (user_id, amount, date, category, category_id) VALUES ('1', 5, '2025-03-04', 'Food', ?)`, food)
+	mustExec(t, `INSERT INTO expenses (user_id, amount, date, category) VALUES ('2', 7, '2025-03-04', 'Groceries')`) // Otro usuario
+	mustExec(t, `INSERT INTO bills (user_id, name, amount, category) VALUES ('1', 'Market', 80, 'Groceries')`)
+	mustExec(t, `INSERT INTO category_budgets (user_id, category_id, period, amount) VALUES ('1', ?, 'monthly', 100)`, groceries)
+	mustExec(t, `INSERT INTO category_budgets (user_id, category_id, period, amount) VALUES ('1', ?, 'monthly', 50)`, food)
+	mustExec(t, `INSERT INTO category_budgets (user_id, category_id, period, amount) VALUES ('1', ?, 'weekly', 20)`, groceries)
+	mustExec(t, `INSERT INTO envelope_transfers (user_id, month, from_category_id, to_category_id, amount) VALUES ('1', '2025-03', 0, ?, 200)`, groceries)
+	mustExec(t, `INSERT INTO envelope_transfers (user_id, month, from_category_id, to_category_id, amount) VALUES ('1', '2025-03', ?, ?, 40)`, groceries, food)
+
+	counts := reassignmentCounts(t, handleMergeCategories, MergeCategoriesRequest{UserID: "1", SourceID: groceries, TargetID: food})
+
+	want := ReassignmentCounts{TargetID: food, TargetName: "Food", Expenses: 3, Bills: 1, Budgets: 2, Subcategories: 1}
+	if counts != want {
+		t.Errorf("Expected %+v, got %+v", want, counts)
+	}
+
+	if n := countCategoryRows(t, `SELECT COUNT(*) FROM categories WHERE id = ?`, groceries); n != 0 {
+		t.Errorf("Expected Groceries to be deleted")
+	}
+	if parentOf(t, snacks) != food {
+		t.Errorf("Expected Snacks to move under Food")
+	}
+	if n := countCategoryRows(t, `SELECT COUNT(*) FROM expenses WHERE user_id = '1' AND category = 'Food' AND category_id = ?`, food); n != 4 {
+		t.Errorf("Expected every expense of user 1 in Food, got %d", n)
+	}
+	if n := countCategoryRows(t, `SELECT COUNT(*) FROM expenses WHERE user_id = '2' AND category = 'Groceries'`); n != 1 {
+		t.Errorf("Expected the other user's expense untouched")
+	}
+
+	// Budgets for the same period are added up; the others move to the target
+	var monthly, weekly float64
+	db.QueryRow(`SELECT amount FROM category_budgets WHERE category_id = ? AND period = 'monthly'`, food).Scan(&monthly)
+	db.QueryRow(`SELECT amount FROM category_budgets WHERE category_id = ? AND period = 'weekly'`, food).Scan(&weekly)
+	if monthly != 150 || weekly != 20 {
+		t.Errorf("Expected Food budgets of 150 monthly and 20 weekly, got %.2f and %.2f", monthly, weekly)
+	}
+	if n := countCategoryRows(t, `SELECT COUNT(*) FROM category_budgets WHERE category_id = ?`, groceries); n != 0 {
+		t.Errorf("Expected no budgets left on Groceries, got %d", n)
+	}
+
+	// The envelope money moves to the target and the move between the two disappears
+	if n := countCategoryRows(t, `SELECT COUNT(*) FROM envelope_transfers`); n != 1 {
+		t.Errorf("Expected only the assignment to remain, got %d envelope transfers", n)
+	}
+	if n := countCategoryRows(t, `SELECT COUNT(*) FROM envelope_transfers WHERE to_category_id = ? AND amount = 200`, food); n != 1 {
+		t.Errorf("Expected the assignment to point to Food")
+	}
+}
+
+func TestMergeIntoSubcategoryTakesTheSourcePlace(t *testing.T) {
+	setupCategoriesDB(t)
+
+	home := addTestCategory(t, "Home", "expense", 0)
+	transport := addTestCategory(t, "Transport", "expense", home)
+	fuel := addTestCategory(t, "Fuel", "expense", transport)
+	parking := addTestCategory(t, "Parking", "expense", transport)
+
+	counts := reassignmentCounts(t, handleMergeCategories, MergeCategoriesRequest{UserID: "1", SourceID: transport, TargetID: fuel})
+	if counts.Subcategories != 1 {
+		t.Errorf("Expected Parking to move, got %+v", counts)
+	}
+
+	// Fuel takes Transport's place in the tree instead of hanging from itself
+	if parentOf(t, fuel) != home || parentOf(t, parking) != fuel {
+		t.Errorf("Expected Fuel under Home and Parking under Fuel, got %d and %d", parentOf(t, fuel), parentOf(t, parking))
+	}
+}
+
+func TestDeleteCategoryFallsBackToUncategorized(t *testing.T) {
+	setupCategoriesDB(t)
+
+	transport := addTestCategory(t, "Transport", "expense", 0)
+	fuel := addTestCategory(t, "Fuel", "expense", transport)
+	diesel := addTestCategory(t, "Diesel", "expense", fuel)
+	salary := addTestCategory(t, "Salary", "income", 0)
+
+	mustExec(t, `INSERT INTO expenses (user_id, amount, date, category, category_id) VALUES ('1', 60, '2025-03-01', 'Fuel', ?)`, fuel)
+	mustExec(t, `INSERT INTO incomes (user_id, amount, date, category, category_id) VALUES ('1', 900, '2025-03-01', 'Salary', ?)`, salary)
+	mustExec(t, `INSERT INTO category_budgets (user_id, category_id, period, amount) VALUES ('1', ?, 'monthly', 80)`, fuel)
+
+	counts := reassignmentCounts(t, handleDeleteCategory, DeleteCategoryRequest{UserID: "1", CategoryID: fuel})
+
+	var uncategorized int
+	db.QueryRow(`SELECT id FROM categories WHERE name = ? AND type = 'expense' AND parent_id IS NULL`, uncategorizedName).Scan(&uncategorized)
+	if uncategorized == 0 {
+		t.Fatalf("Expected an %s expense category to be created", uncategorizedName)
+	}
+	want := ReassignmentCounts{TargetID: uncategorized, TargetName: uncategorizedName, Expenses: 1, Budgets: 1, Subcategories: 1}
+	if counts != want {
+		t.Errorf("Expected %+v, got %+v", want, counts)
+	}
+
+	// Subcategories move up to the deleted category's parent
+	if parentOf(t, diesel) != transport {
+		t.Errorf("Expected Diesel to move up to Transport")
+	}
+	if n := countCategoryRows(t, `SELECT COUNT(*) FROM expenses WHERE category = ? AND category_id = ?`, uncategorizedName, uncategorized); n != 1 {
+		t.Errorf("Expected the Fuel expense in %s", uncategorizedName)
+	}
+	if n := countCategoryRows(t, `SELECT COUNT(*) FROM incomes WHERE category_id = ?`, salary); n != 1 {
+		t.Errorf("Expected incomes to be untouched")
+	}
+
+	// A second delete reuses the same category
+	counts = reassignmentCounts(t, handleDeleteCategory, DeleteCategoryRequest{UserID: "1", CategoryID: diesel})
+	if counts.TargetID != uncategorized {
+		t.Errorf("Expected %s to be reused, got %+v", uncategorizedName, counts)
+	}
+
+	// The default category itself needs an explicit target
+	if rr := postJSON(handleDeleteCategory, DeleteCategoryRequest{UserID: "1", CategoryID: uncategorized}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected deleting %s without a target to fail, got %d", uncategorizedName, rr.Code)
+	}
+	counts = reassignmentCounts(t, handleDeleteCategory, DeleteCategoryRequest{UserID: "1", CategoryID: uncategorized, ReassignTo: transport})
+	if counts.TargetID != transport || counts.Expenses != 1 {
+		t.Errorf("Expected %s to move into Transport, got %+v", uncategorizedName, counts)
+	}
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+)
+
+// AdminTokenEnv es la variable de entorno con el token que protege los endpoints de administración
+const AdminTokenEnv = "HERO_BUDGET_ADMIN_TOKEN"
+
+// AdminTokenHeader es la cabecera en la que el cliente envía el token de administración
+const AdminTokenHeader = "X-Admin-Token"
+
+// RequireAdmin envuelve un handler para que solo responda si la petición trae el token de
+// administración. Si la variable de entorno no está definida los endpoints quedan deshabilitados.
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expected := os.Getenv(AdminTokenEnv)
+		if expected == "" {
+			log.Printf("Admin endpoint %s called but %s is not configured", r.URL.Path, AdminTokenEnv)
+			writeAdminError(w, http.StatusForbidden, "Admin endpoints are disabled")
+			return
+		}
+
+		token := r.Header.Get(AdminTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "Invalid admin token")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"message": message,
+	})
+}
@@ -2,29 +2,51 @@ package common
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 )
 
 // AddBill registra una factura y sus pagos mensuales
 func AddBill(db *sql.DB, userID, name string, amount float64, dueDate string, paymentDay, durationMonths int, paymentMethod, category, icon, regularity string) (int, error) {
-	if amount <= 0 || durationMonths < 1 || paymentDay < 1 || paymentDay > 28 || (paymentMethod != "cash" && paymentMethod != "bank") {
-		return 0, fmt.Errorf("invalid bill data")
+	var billID int
+	err := WithTx(db, func(tx *sql.Tx) error {
+		var err error
+		billID, err = AddBillTx(tx, userID, name, amount, dueDate, paymentDay, durationMonths, paymentMethod, category, icon, regularity)
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
+	return billID, nil
+}
 
-	tx, err := db.Begin()
-	if err != nil {
-		return 0, fmt.Errorf("error starting transaction: %v", err)
+// AddBillTx es AddBill dentro de una transacción abierta, para quien crea la factura junto
+// con otros registros (p. ej. un préstamo y sus cuotas). La factura sigue el calendario de
+// regularity (ver BillSchedule) y sus pagos se generan hasta BillHorizon; durationMonths 0
+// la deja sin fin.
+func AddBillTx(q DBTX, userID, name string, amount float64, dueDate string, paymentDay, durationMonths int, paymentMethod, category, icon, regularity string) (int, error) {
+	return AddAdjustedBillTx(q, userID, name, amount, dueDate, paymentDay, durationMonths, paymentMethod, category, icon, regularity, BusinessDayNone)
+}
+
+// AddAdjustedBillTx es AddBillTx con el ajuste de los vencimientos que caen en fin de semana
+// (BusinessDayFollowing, BusinessDayPreceding...)
+func AddAdjustedBillTx(q DBTX, userID, name string, amount float64, dueDate string, paymentDay, durationMonths int, paymentMethod, category, icon, regularity, adjustment string) (int, error) {
+	if amount <= 0 || (paymentMethod != "cash" && paymentMethod != "bank") {
+		return 0, fmt.Errorf("invalid bill data")
 	}
-	defer tx.Rollback()
 
 	startDate := dueDate // Asumimos que due_date es la fecha de inicio
+	if _, err := BillSchedule(startDate, paymentDay, durationMonths, regularity, adjustment); err != nil {
+		return 0, fmt.Errorf("invalid bill data: %v", err)
+	}
 
 	// Registrar factura
-	result, err := tx.Exec(`
-		INSERT INTO bills (user_id, name, amount, due_date, paid, overdue, overdue_days, recurring, category, icon, start_date, payment_day, duration_months, regularity, payment_method)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, userID, name, amount, dueDate, false, false, 0, true, category, icon, startDate, paymentDay, durationMonths, regularity, paymentMethod)
+	result, err := q.Exec(`
+		INSERT INTO bills (user_id, name, amount, due_date, paid, overdue, overdue_days, recurring, category, icon, start_date, payment_day, duration_months, regularity, payment_method, business_day_adjustment, scheduled)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+	`, userID, name, amount, dueDate, false, false, 0, true, category, icon, startDate, paymentDay, durationMonths, regularity, paymentMethod, adjustment)
 	if err != nil {
 		return 0, fmt.Errorf("error inserting bill: %v", err)
 	}
@@ -34,142 +56,135 @@ func AddBill(db *sql.DB, userID, name string, amount float64, dueDate string, pa
 		return 0, fmt.Errorf("error getting bill ID: %v", err)
 	}
 
-	// Calcular meses afectados
-	currentDate, err := time.Parse("2006-01-02", startDate)
-	if err != nil {
-		return 0, fmt.Errorf("invalid start date format: %v", err)
+	// El importe de cada pago queda reservado en su mes hasta que se paga
+	if err := ExpandBill(q, billID, BillHorizon(q, userID)); err != nil {
+		return 0, err
 	}
 
-	for i := 0; i < durationMonths; i++ {
-		monthDate := currentDate.AddDate(0, i, 0)
-		month := monthDate.Format("2006-01")
+	return int(billID), nil
+}
 
-		// Crear registro en bill_payments
-		_, err = tx.Exec(`
-			INSERT INTO bill_payments (bill_id, user_id, year_month, paid, payment_date, payment_method)
-			VALUES (?, ?, ?, ?, ?, ?)
-		`, billID, userID, month, false, nil, paymentMethod)
-		if err != nil {
-			return 0, fmt.Errorf("error creating bill payment record: %v", err)
-		}
+// Errores de MarkBillPaid que no se deben a la base de datos
+var (
+	ErrBillPaymentNotFound = errors.New("payment record not found")
+	ErrBillAlreadyPaid     = errors.New("bill for this month is already paid")
+)
 
-		// Crear o actualizar registro mensual
-		_, err = tx.Exec(`
-			INSERT OR IGNORE INTO monthly_cash_bank_balance (user_id, year_month)
-			VALUES (?, ?)
-		`, userID, month)
-		if err != nil {
-			return 0, fmt.Errorf("error creating monthly record: %v", err)
-		}
+// Las facturas de un extracto de tarjeta o de un préstamo se pagan desde su servicio, que además
+// actualiza lo pagado del extracto o la cuota. Sus compras o su capital ya cuentan por su cuenta.
+var (
+	ErrStatementBill = errors.New("bill belongs to a credit card statement, pay it through /credit-cards/statements/pay")
+	ErrLoanBill      = errors.New("bill belongs to a loan, pay it through /loans/pay")
+)
 
-		// Registrar el importe de la factura para este mes
-		if paymentMethod == "cash" {
-			_, err = tx.Exec(`
-				UPDATE monthly_cash_bank_balance
-				SET bill_cash_amount = bill_cash_amount + ?
-				WHERE user_id = ? AND year_month = ?
-			`, amount, userID, month)
-		} else {
-			_, err = tx.Exec(`
-				UPDATE monthly_cash_bank_balance
-				SET bill_bank_amount = bill_bank_amount + ?
-				WHERE user_id = ? AND year_month = ?
-			`, amount, userID, month)
+// CheckBillPayableDirectly devuelve ErrStatementBill o ErrLoanBill si la factura la generó un
+// extracto de tarjeta o un préstamo. Las tablas que todavía no ha creado su servicio se ignoran.
+func CheckBillPayableDirectly(q DBTX, billID int, userID string) error {
+	owners := []struct {
+		query string
+		err   error
+	}{
+		{`SELECT 1 FROM credit_card_statements WHERE bill_id = ? AND user_id = ?`, ErrStatementBill},
+		{`SELECT 1 FROM loans WHERE bill_id = ? AND user_id = ?`, ErrLoanBill},
+	}
+	for _, owner := range owners {
+		var found int
+		err := q.QueryRow(owner.query, billID, userID).Scan(&found)
+		if err == nil {
+			return owner.err
 		}
-		if err != nil {
-			return 0, fmt.Errorf("error updating bill amount for month %s: %v", month, err)
+		if err != sql.ErrNoRows && !strings.Contains(err.Error(), "no such table") {
+			return fmt.Errorf("error checking bill owner: %v", err)
 		}
 	}
-
-	if err = tx.Commit(); err != nil {
-		return 0, fmt.Errorf("error committing transaction: %v", err)
-	}
-
-	// Recalcular saldos en cascada desde el primer mes afectado
-	firstMonth := currentDate.Format("2006-01")
-	if err = UpdateCascadeBalances(db, userID, firstMonth); err != nil {
-		return int(billID), fmt.Errorf("error updating cascade balances: %v", err)
-	}
-
-	return int(billID), nil
+	return nil
 }
 
-// MarkBillPaid marca una factura como pagada para un mes específico
+// MarkBillPaid marca una factura como pagada para un mes específico. En facturas con
+// calendario yearMonth es la clave de la repetición (Occurrence.Key): el mes, o la fecha en
+// las semanales y diarias.
 func MarkBillPaid(db *sql.DB, billID int, userID, yearMonth string) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("error starting transaction: %v", err)
-	}
-	defer tx.Rollback()
+	return WithTx(db, func(tx *sql.Tx) error {
+		return MarkBillPaidTx(tx, billID, userID, yearMonth)
+	})
+}
 
-	// Obtener datos de la factura
-	var amount float64
-	var paymentMethod string
-	err = tx.QueryRow(`
-		SELECT amount, payment_method
-		FROM bills WHERE id = ? AND user_id = ?
-	`, billID, userID).Scan(&amount, &paymentMethod)
-	if err != nil {
-		return fmt.Errorf("bill not found: %v", err)
+// MarkBillPaidTx es MarkBillPaid dentro de una transacción abierta, para quien registra el
+// pago real en la misma transacción. El pago queda fechado hoy en la zona del usuario.
+func MarkBillPaidTx(q DBTX, billID int, userID, yearMonth string) error {
+	return MarkBillPaidOnTx(q, billID, userID, yearMonth, UserToday(q, userID), "")
+}
+
+// MarkBillPaidOnTx es MarkBillPaidTx con la fecha y la cuenta del pago. Con paymentMethod
+// vacío se conserva el método guardado en el pago del mes.
+func MarkBillPaidOnTx(q DBTX, billID int, userID, yearMonth, paymentDate, paymentMethod string) error {
+	// Las repeticiones que todavía no se han generado se pueden pagar por adelantado
+	if err := ensureBillOccurrence(q, int64(billID), userID, yearMonth); err != nil {
+		return err
 	}
 
-	// Verificar que el pago existe y no está pagado
+	// Verificar que la factura y el pago existen y no está pagado
+	var paymentID int64
 	var alreadyPaid bool
-	err = tx.QueryRow(`
-		SELECT paid FROM bill_payments 
-		WHERE bill_id = ? AND year_month = ?
-	`, billID, yearMonth).Scan(&alreadyPaid)
+	err := q.QueryRow(`
+		SELECT bp.id, bp.paid FROM bill_payments bp
+		JOIN bills b ON b.id = bp.bill_id
+		WHERE bp.bill_id = ? AND bp.year_month = ? AND b.user_id = ?
+	`, billID, yearMonth, userID).Scan(&paymentID, &alreadyPaid)
+	if err == sql.ErrNoRows {
+		return ErrBillPaymentNotFound
+	}
 	if err != nil {
-		return fmt.Errorf("payment record not found: %v", err)
+		return fmt.Errorf("error fetching bill payment: %v", err)
 	}
 	if alreadyPaid {
-		return fmt.Errorf("bill for this month is already paid")
+		return ErrBillAlreadyPaid
 	}
 
 	// Marcar pago como pagado
-	paymentDate := time.Now().Format("2006-01-02")
-	_, err = tx.Exec(`
+	_, err = q.Exec(`
 		UPDATE bill_payments
-		SET paid = 1, payment_date = ?
-		WHERE bill_id = ? AND year_month = ?
-	`, paymentDate, billID, yearMonth)
+		SET paid = 1, payment_date = ?, payment_method = COALESCE(NULLIF(?, ''), payment_method)
+		WHERE id = ?
+	`, paymentDate, paymentMethod, paymentID)
 	if err != nil {
 		return fmt.Errorf("error marking payment as paid: %v", err)
 	}
 
 	// IMPORTANTE: NO cambiar de bill_amount a expense_amount
-	// Solo restar el bill_amount para este mes específico
-	if paymentMethod == "cash" {
-		_, err = tx.Exec(`
-			UPDATE monthly_cash_bank_balance
-			SET bill_cash_amount = bill_cash_amount - ?
-			WHERE user_id = ? AND year_month = ?
-		`, amount, userID, yearMonth)
-	} else {
-		_, err = tx.Exec(`
-			UPDATE monthly_cash_bank_balance
-			SET bill_bank_amount = bill_bank_amount - ?
-			WHERE user_id = ? AND year_month = ?
-		`, amount, userID, yearMonth)
-	}
-	if err != nil {
+	// Solo liberar la reserva de este mes; la salida real la registra quien paga
+	if err = RemoveLedgerEntries(q, userID, LedgerSourceBillPayment, paymentID); err != nil {
 		return fmt.Errorf("error updating bill amount: %v", err)
 	}
 
-	// Verificar si todos los pagos están completados
-	var totalPayments, paidPayments int
-	err = tx.QueryRow(`
-		SELECT COUNT(*) as total, SUM(CASE WHEN paid = 1 THEN 1 ELSE 0 END) as paid_count
-		FROM bill_payments WHERE bill_id = ?
-	`, billID).Scan(&totalPayments, &paidPayments)
-	if err != nil {
+	// Verificar si todos los pagos están completados. Las facturas con calendario cuentan sus
+	// repeticiones; las demás, sus filas de pago y como mínimo su duración
+	var scheduled bool
+	if err := q.QueryRow(`SELECT COALESCE(scheduled, 0) FROM bills WHERE id = ?`, billID).Scan(&scheduled); err != nil {
 		return fmt.Errorf("error checking bill completion: %v", err)
 	}
+	var completed bool
+	if scheduled {
+		if completed, err = billCompleted(q, int64(billID)); err != nil {
+			return err
+		}
+	} else {
+		var totalPayments, paidPayments int
+		err = q.QueryRow(`
+			SELECT MAX(COUNT(*), COALESCE((SELECT duration_months FROM bills WHERE id = ?), 0)) as total,
+			       SUM(CASE WHEN paid = 1 THEN 1 ELSE 0 END) as paid_count
+			FROM bill_payments WHERE bill_id = ?
+		`, billID, billID).Scan(&totalPayments, &paidPayments)
+		if err != nil {
+			return fmt.Errorf("error checking bill completion: %v", err)
+		}
+		completed = totalPayments > 0 && paidPayments >= totalPayments
+	}
 
 	// Si todos los pagos están completados, marcar la factura como pagada
-	if totalPayments > 0 && paidPayments >= totalPayments {
-		_, err = tx.Exec(`
-			UPDATE bills SET paid = 1, updated_at = CURRENT_TIMESTAMP 
+	if completed {
+		_, err = q.Exec(`
+			UPDATE bills SET paid = 1, version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
 			WHERE id = ? AND user_id = ?
 		`, billID, userID)
 		if err != nil {
@@ -177,12 +192,14 @@ func MarkBillPaid(db *sql.DB, billID int, userID, yearMonth string) error {
 		}
 	}
 
-	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("error committing transaction: %v", err)
-	}
-
-	// Recalcular saldos en cascada
-	return UpdateCascadeBalances(db, userID, yearMonth)
+	return PublishEvent(q, EventBillPaid, userID, int64(billID), map[string]interface{}{
+		"bill_id":        billID,
+		"payment_id":     paymentID,
+		"year_month":     yearMonth,
+		"payment_date":   paymentDate,
+		"payment_method": paymentMethod,
+		"bill_completed": completed,
+	})
 }
 
 // GetMonthlyCashBankBalance obtiene el balance mensual para un usuario y mes específico
@@ -237,3 +254,70 @@ func GetMonthlyCashBankBalance(db *sql.DB, userID, yearMonth string) (map[string
 
 	return balance, nil
 }
+
+// ReserveBillPayments vuelve a proyectar en el libro los pagos de una factura: los pendientes
+// reservan lo que queda de su importe (el propio o el actual de la factura) con el método
+// actual en su vencimiento y los pagados no reservan nada
+func ReserveBillPayments(q DBTX, userID string, billID int64) error {
+	rows, err := q.Query(`
+		SELECT bp.id, bp.paid, `+BillPaymentDueDateSQL+`,
+		       COALESCE(bp.payment_method, b.payment_method, 'bank'), `+BillPaymentRemainingSQL+`
+		FROM bill_payments bp JOIN bills b ON b.id = bp.bill_id
+		WHERE bp.bill_id = ? AND b.user_id = ?
+	`, billID, userID)
+	if err != nil {
+		return fmt.Errorf("error fetching bill payments: %v", err)
+	}
+
+	var changes []LedgerChange
+	for rows.Next() {
+		var paid bool
+		var dateStr string
+		var entry LedgerEntry
+		change := LedgerChange{SourceType: LedgerSourceBillPayment}
+		if err := rows.Scan(&change.SourceID, &paid, &dateStr, &entry.PaymentMethod, &entry.Amount); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning bill payment: %v", err)
+		}
+		if date, err := time.Parse("2006-01-02", dateStr); err == nil && !paid {
+			entry.Date, entry.Kind = date, LedgerPendingBill
+			change.Entries = []LedgerEntry{entry}
+		}
+		changes = append(changes, change)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error fetching bill payments: %v", err)
+	}
+
+	return ApplyLedgerChanges(q, userID, changes...)
+}
+
+// ReleaseBillPayments quita del libro la factura y todos sus pagos, antes de borrarlos
+func ReleaseBillPayments(q DBTX, userID string, billID int64) error {
+	changes, err := BillLedgerRemovals(q, billID)
+	if err != nil {
+		return err
+	}
+	return ApplyLedgerChanges(q, userID, changes...)
+}
+
+// BillLedgerRemovals enumera los orígenes del libro de una factura: ella misma (facturas de
+// lotes) y cada uno de sus pagos mensuales
+func BillLedgerRemovals(q DBTX, billID int64) ([]LedgerChange, error) {
+	rows, err := q.Query(`SELECT id FROM bill_payments WHERE bill_id = ?`, billID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching bill payments: %v", err)
+	}
+	defer rows.Close()
+
+	changes := []LedgerChange{{SourceType: LedgerSourceBill, SourceID: billID}}
+	for rows.Next() {
+		var paymentID int64
+		if err := rows.Scan(&paymentID); err != nil {
+			return nil, fmt.Errorf("error scanning bill payment: %v", err)
+		}
+		changes = append(changes, LedgerChange{SourceType: LedgerSourceBillPayment, SourceID: paymentID})
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,366 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Estados de una fila en la auditoría de saldos
+const (
+	DriftMissing   = "missing"   // el periodo tiene movimientos pero no fila
+	DriftExtra     = "extra"     // la fila tiene movimientos que no existen en las tablas de origen
+	DriftDuplicate = "duplicate" // hay más de una fila para el mismo periodo
+	DriftDifferent = "different" // alguna columna no coincide con el valor recalculado
+)
+
+// balanceColumns son las columnas de las tablas *_cash_bank_balance que se recalculan a partir
+// del libro. Las doce primeras son flujos del periodo; el resto, saldos acumulados.
+var balanceColumns = []string{
+	"income_cash_amount", "income_bank_amount",
+	"expense_cash_amount", "expense_bank_amount",
+	"bill_cash_amount", "bill_bank_amount",
+	"card_payment_cash_amount", "card_payment_bank_amount",
+	"transfer_cash_amount", "transfer_bank_amount",
+	"adjustment_cash_amount", "adjustment_bank_amount",
+	"previous_cash_amount", "previous_bank_amount",
+	"cash_amount", "bank_amount",
+	"balance_cash_amount", "balance_bank_amount",
+	"total_previous_balance", "total_balance",
+}
+
+const flowColumnCount = 12
+
+// balanceTolerance es la diferencia que se considera redondeo y no una desviación
+const balanceTolerance = 0.005
+
+// BalanceDrift es una fila de una tabla de saldos que no coincide con la recalculada
+type BalanceDrift struct {
+	UserID  string        `json:"user_id"`
+	Table   string        `json:"table"`
+	Period  string        `json:"period"`
+	Status  string        `json:"status"`
+	Columns []ColumnDrift `json:"columns,omitempty"`
+}
+
+// ColumnDrift es el valor almacenado y el recalculado de una columna desviada
+type ColumnDrift struct {
+	Column     string  `json:"column"`
+	Stored     float64 `json:"stored"`
+	Recomputed float64 `json:"recomputed"`
+}
+
+// BalanceAuditReport es el resultado de AuditPeriodBalances
+type BalanceAuditReport struct {
+	Applied bool           `json:"applied"`
+	Users   int            `json:"users"`
+	Drifts  []BalanceDrift `json:"drifts"`
+}
+
+// AuditPeriodBalances recalcula las seis tablas *_cash_bank_balance usando solo las tablas de
+// origen (ingresos, gastos, pagos de facturas, cuotas, extractos y traspasos) y devuelve cada fila
+// cuyo valor almacenado difiere del recalculado. Con userID vacío revisa todos los usuarios.
+// Si apply es false no se modifica nada; si es true se corrigen las filas desviadas.
+func AuditPeriodBalances(db *sql.DB, userID string, apply bool) (BalanceAuditReport, error) {
+	report := BalanceAuditReport{Applied: apply, Drifts: []BalanceDrift{}}
+
+	users := []string{userID}
+	if userID == "" {
+		var err error
+		if users, err = balanceUsers(db); err != nil {
+			return report, err
+		}
+	}
+
+	for _, user := range users {
+		drifts, err := auditUserBalances(db, user, apply)
+		if err != nil {
+			return report, fmt.Errorf("error auditing balances of user %s: %v", user, err)
+		}
+		report.Users++
+		report.Drifts = append(report.Drifts, drifts...)
+	}
+	return report, nil
+}
+
+// auditUserBalances recarga el libro y proyecta dentro de una transacción que solo se
+// confirma en modo apply
+func auditUserBalances(db *sql.DB, userID string, apply bool) ([]BalanceDrift, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := reloadLedger(tx, userID); err != nil {
+		return nil, err
+	}
+	drifts, err := projectLedger(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if apply {
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("error committing transaction: %v", err)
+		}
+	}
+	return drifts, nil
+}
+
+// balanceUsers devuelve los usuarios con movimientos o con filas de saldo
+func balanceUsers(q DBTX) ([]string, error) {
+	tables := []string{"incomes", "expenses", "bill_payments", "loan_installments",
+		"credit_card_statements", "cash_bank_transactions", "balance_ledger"}
+	for _, pt := range PeriodTables {
+		tables = append(tables, pt.Table)
+	}
+
+	seen := map[string]bool{}
+	for _, table := range tables {
+		rows, err := q.Query(fmt.Sprintf(`SELECT DISTINCT user_id FROM %s`, table))
+		if err != nil {
+			if strings.Contains(err.Error(), "no such table") {
+				continue
+			}
+			return nil, fmt.Errorf("error reading users of %s: %v", table, err)
+		}
+		for rows.Next() {
+			var userID sql.NullString
+			if err := rows.Scan(&userID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning users of %s: %v", table, err)
+			}
+			if userID.Valid && userID.String != "" {
+				seen[userID.String] = true
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error reading users of %s: %v", table, err)
+		}
+	}
+
+	users := make([]string, 0, len(seen))
+	for userID := range seen {
+		users = append(users, userID)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// projectLedger recalcula las seis tablas del usuario a partir de su libro, corrige las filas
+// que no coinciden y devuelve cuáles eran
+func projectLedger(q DBTX, userID string) ([]BalanceDrift, error) {
+	settings, err := LoadPeriodSettings(q, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := loadLedgerEntries(q, `user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var drifts []BalanceDrift
+	for _, pt := range PeriodTables {
+		tableDrifts, err := projectTable(q, settings, pt, userID, entries)
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, tableDrifts...)
+	}
+	return drifts, nil
+}
+
+// storedBalanceRow es una fila tal como está guardada en una tabla de saldos
+type storedBalanceRow struct {
+	id     int64
+	period string
+	values []float64
+}
+
+// projectTable compara una tabla con la proyección de los asientos. Las filas sin movimientos
+// (p. ej. periodos cuyos asientos se borraron) se conservan con el saldo arrastrado.
+func projectTable(q DBTX, settings PeriodSettings, pt PeriodTable, userID string, entries []LedgerEntry) ([]BalanceDrift, error) {
+	flows := map[string]*periodFlows{}
+	dates := map[string]time.Time{}
+	for _, entry := range entries {
+		if !projectsInto(entry, pt) {
+			continue
+		}
+		periodID := settings.Identifier(entry.Date, pt.Period)
+		f, ok := flows[periodID]
+		if !ok {
+			f = &periodFlows{periodID: periodID}
+			flows[periodID] = f
+			dates[periodID] = entry.Date
+		}
+		addLedgerEntry(f, entry)
+	}
+
+	stored, duplicates, err := loadStoredBalanceRows(q, pt, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var drifts []BalanceDrift
+	for _, row := range duplicates {
+		drifts = append(drifts, BalanceDrift{UserID: userID, Table: pt.Table, Period: row.period, Status: DriftDuplicate})
+		if _, err := q.Exec(fmt.Sprintf(`DELETE FROM %s WHERE id = ?`, pt.Table), row.id); err != nil {
+			return nil, fmt.Errorf("error deleting duplicate %s row: %v", pt.Table, err)
+		}
+	}
+
+	var periods []string
+	for periodID := range flows {
+		periods = append(periods, periodID)
+	}
+	for periodID := range stored {
+		if _, ok := flows[periodID]; !ok {
+			periods = append(periods, periodID)
+		}
+	}
+	sort.Strings(periods)
+
+	var prevCash, prevBank float64
+	for _, periodID := range periods {
+		row, exists := stored[periodID]
+		f, hasFlows := flows[periodID]
+
+		if !hasFlows {
+			if hasNonZero(row.values[:flowColumnCount]) {
+				drifts = append(drifts, BalanceDrift{UserID: userID, Table: pt.Table, Period: periodID, Status: DriftExtra,
+					Columns: compareBalanceValues(row.values, make([]float64, len(balanceColumns)))})
+				if _, err := q.Exec(fmt.Sprintf(`DELETE FROM %s WHERE id = ?`, pt.Table), row.id); err != nil {
+					return nil, fmt.Errorf("error deleting %s row: %v", pt.Table, err)
+				}
+				continue
+			}
+			f = &periodFlows{periodID: periodID}
+		}
+
+		values := f.balanceValues(prevCash, prevBank)
+		netCash, netBank := f.net()
+		prevCash, prevBank = prevCash+netCash, prevBank+netBank
+
+		if !exists {
+			drifts = append(drifts, BalanceDrift{UserID: userID, Table: pt.Table, Period: periodID, Status: DriftMissing,
+				Columns: compareBalanceValues(make([]float64, len(balanceColumns)), values)})
+			if _, err := ensurePeriodRow(q, settings, pt, userID, dates[periodID]); err != nil {
+				return nil, err
+			}
+			if err := writeBalanceRow(q, pt, fmt.Sprintf(`user_id = ? AND %s = ?`, pt.Column), values, userID, periodID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		columns := compareBalanceValues(row.values, values)
+		if len(columns) == 0 {
+			continue
+		}
+		drifts = append(drifts, BalanceDrift{UserID: userID, Table: pt.Table, Period: periodID, Status: DriftDifferent, Columns: columns})
+		if err := writeBalanceRow(q, pt, `id = ?`, values, row.id); err != nil {
+			return nil, err
+		}
+	}
+
+	return drifts, nil
+}
+
+// balanceValues devuelve los valores de la fila del periodo en el orden de balanceColumns
+func (f periodFlows) balanceValues(prevCash, prevBank float64) []float64 {
+	netCash, netBank := f.net()
+	cash, bank := prevCash+netCash, prevBank+netBank
+	return []float64{
+		f.incomeCash, f.incomeBank,
+		f.expenseCash, f.expenseBank,
+		f.billCash, f.billBank,
+		f.cardCash, f.cardBank,
+		f.transferCash, f.transferBank,
+		f.adjustmentCash, f.adjustmentBank,
+		prevCash, prevBank,
+		cash, bank,
+		cash, bank,
+		prevCash + prevBank, cash + bank,
+	}
+}
+
+// loadStoredBalanceRows lee las filas del usuario por periodo. Si un periodo tiene varias filas
+// la primera se compara y las demás se devuelven como duplicadas.
+func loadStoredBalanceRows(q DBTX, pt PeriodTable, userID string) (map[string]storedBalanceRow, []storedBalanceRow, error) {
+	selects := make([]string, len(balanceColumns))
+	for i, column := range balanceColumns {
+		selects[i] = fmt.Sprintf("COALESCE(%s, 0)", column)
+	}
+
+	rows, err := q.Query(fmt.Sprintf(`
+		SELECT id, %s, %s FROM %s WHERE user_id = ? ORDER BY %s, id
+	`, pt.Column, strings.Join(selects, ", "), pt.Table, pt.Column), userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading %s: %v", pt.Table, err)
+	}
+	defer rows.Close()
+
+	stored := map[string]storedBalanceRow{}
+	var duplicates []storedBalanceRow
+	for rows.Next() {
+		row := storedBalanceRow{values: make([]float64, len(balanceColumns))}
+		dest := []interface{}{&row.id, &row.period}
+		for i := range row.values {
+			dest = append(dest, &row.values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, fmt.Errorf("error scanning %s: %v", pt.Table, err)
+		}
+		if _, ok := stored[row.period]; ok {
+			duplicates = append(duplicates, row)
+			continue
+		}
+		stored[row.period] = row
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error reading %s: %v", pt.Table, err)
+	}
+	return stored, duplicates, nil
+}
+
+func writeBalanceRow(q DBTX, pt PeriodTable, where string, values []float64, whereArgs ...interface{}) error {
+	sets := make([]string, len(balanceColumns))
+	args := make([]interface{}, 0, len(values)+len(whereArgs))
+	for i, column := range balanceColumns {
+		sets[i] = column + " = ?"
+		args = append(args, values[i])
+	}
+	args = append(args, whereArgs...)
+
+	_, err := q.Exec(fmt.Sprintf(`UPDATE %s SET %s, updated_at = CURRENT_TIMESTAMP WHERE %s`,
+		pt.Table, strings.Join(sets, ", "), where), args...)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", pt.Table, err)
+	}
+	return nil
+}
+
+func compareBalanceValues(stored, recomputed []float64) []ColumnDrift {
+	var columns []ColumnDrift
+	for i, column := range balanceColumns {
+		if math.Abs(stored[i]-recomputed[i]) > balanceTolerance {
+			columns = append(columns, ColumnDrift{Column: column, Stored: stored[i], Recomputed: recomputed[i]})
+		}
+	}
+	return columns
+}
+
+func hasNonZero(values []float64) bool {
+	for _, v := range values {
+		if math.Abs(v) > balanceTolerance {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditPeriodBalancesReportsAndRepairsDrift(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	insertMovement(t, db, "income", "1", 1000, "2025-01-10", "bank")
+	result, err := db.Exec(`INSERT INTO cash_bank_transactions (user_id, transaction_type, amount, date) VALUES (?, ?, ?, ?)`,
+		"1", TransferBankToCash, 300, "2025-02-03")
+	if err != nil {
+		t.Fatalf("Failed to insert transfer: %v", err)
+	}
+	transferID, _ := result.LastInsertId()
+	entries, err := TransferLedgerEntries(TransferBankToCash, time.Date(2025, 2, 3, 0, 0, 0, 0, time.UTC), 300)
+	if err != nil {
+		t.Fatalf("Failed to build transfer entries: %v", err)
+	}
+	if err := ReplaceLedgerEntries(db, "1", LedgerSourceTransfer, transferID, entries...); err != nil {
+		t.Fatalf("Failed to record transfer: %v", err)
+	}
+
+	report, err := AuditPeriodBalances(db, "1", false)
+	if err != nil {
+		t.Fatalf("Audit failed: %v", err)
+	}
+	if len(report.Drifts) != 0 {
+		t.Fatalf("Expected no drift after incremental updates, got %+v", report.Drifts)
+	}
+
+	// Desviaciones típicas: un saldo sobrescrito, una fila perdida y una fila huérfana
+	mustExec(t, db, `UPDATE monthly_cash_bank_balance SET bank_amount = 5 WHERE user_id = '1' AND year_month = '2025-02'`)
+	mustExec(t, db, `DELETE FROM daily_cash_bank_balance WHERE user_id = '1' AND date = '2025-01-10'`)
+	mustExec(t, db, `INSERT INTO monthly_cash_bank_balance (user_id, year_month, income_cash_amount) VALUES ('1', '2024-12', 50)`)
+
+	expected := map[string]string{
+		"monthly_cash_bank_balance 2025-02":  DriftDifferent,
+		"daily_cash_bank_balance 2025-01-10": DriftMissing,
+		"monthly_cash_bank_balance 2024-12":  DriftExtra,
+	}
+	checkDrifts := func(report BalanceAuditReport) {
+		t.Helper()
+		if len(report.Drifts) != len(expected) {
+			t.Fatalf("Expected %d drifts, got %+v", len(expected), report.Drifts)
+		}
+		for _, drift := range report.Drifts {
+			key := drift.Table + " " + drift.Period
+			if expected[key] != drift.Status {
+				t.Errorf("Unexpected drift %s: %s", key, drift.Status)
+			}
+			if drift.Status == DriftDifferent && (len(drift.Columns) != 1 || drift.Columns[0].Column != "bank_amount" ||
+				drift.Columns[0].Stored != 5 || drift.Columns[0].Recomputed != 700) {
+				t.Errorf("Unexpected columns for %s: %+v", key, drift.Columns)
+			}
+		}
+	}
+
+	report, err = AuditPeriodBalances(db, "", false)
+	if err != nil {
+		t.Fatalf("Dry-run audit failed: %v", err)
+	}
+	if report.Users != 1 {
+		t.Errorf("Expected 1 user audited, got %d", report.Users)
+	}
+	checkDrifts(report)
+
+	var bank float64
+	db.QueryRow(`SELECT bank_amount FROM monthly_cash_bank_balance WHERE user_id = '1' AND year_month = '2025-02'`).Scan(&bank)
+	if bank != 5 {
+		t.Errorf("Dry run must not repair rows, got bank_amount %.2f", bank)
+	}
+
+	report, err = AuditPeriodBalances(db, "1", true)
+	if err != nil {
+		t.Fatalf("Apply audit failed: %v", err)
+	}
+	checkDrifts(report)
+
+	report, err = AuditPeriodBalances(db, "1", false)
+	if err != nil {
+		t.Fatalf("Audit after repair failed: %v", err)
+	}
+	if len(report.Drifts) != 0 {
+		t.Errorf("Expected no drift after repair, got %+v", report.Drifts)
+	}
+
+	monthly := periodBalances(t, db, tableByPeriod("monthly"), "1")
+	expectBalance(t, monthly, "2025-02", 300, 700)
+	if _, ok := monthly["2024-12"]; ok {
+		t.Errorf("Expected the orphan row to be deleted")
+	}
+	expectBalance(t, periodBalances(t, db, tableByPeriod("daily"), "1"), "2025-01-10", 0, 1000)
+}
+
+func mustExec(t testing.TB, db DBTX, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("Failed to run %q: %v", query, err)
+	}
+}
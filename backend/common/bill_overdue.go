@@ -0,0 +1,315 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// UnpaidBillOccurrence es una repetición de una factura que todavía no se ha pagado
+type UnpaidBillOccurrence struct {
+	BillID        int
+	Name          string
+	Category      string
+	Icon          string
+	Recurring     bool
+	Key           string // year_month en bill_payments
+	DueDate       time.Time
+	Amount        float64 // Lo que queda por pagar
+	PaidAmount    float64 // Lo pagado en pagos parciales
+	PaymentMethod string
+	OverdueDays   int // Días desde el vencimiento, 0 si todavía no ha vencido
+}
+
+// Overdue indica si la repetición venció antes de hoy
+func (o UnpaidBillOccurrence) Overdue() bool {
+	return o.OverdueDays > 0
+}
+
+// unpaidBill es una factura sin pagar con lo necesario para fechar sus repeticiones
+type unpaidBill struct {
+	occurrence UnpaidBillOccurrence
+	scheduled  bool
+	schedule   Schedule
+	dueDate    string
+	startDate  string
+	paymentDay int
+}
+
+func loadUnpaidBills(q DBTX, userID string) ([]unpaidBill, error) {
+	rows, err := q.Query(`
+		SELECT id, name, amount, COALESCE(payment_method, 'bank'), COALESCE(category, ''), COALESCE(icon, ''),
+		       COALESCE(recurring, 0), COALESCE(scheduled, 0), COALESCE(due_date, ''),
+		       COALESCE(NULLIF(start_date, ''), due_date, ''), COALESCE(payment_day, 0),
+		       COALESCE(duration_months, 0), COALESCE(regularity, ''), COALESCE(business_day_adjustment, '')
+		FROM bills WHERE user_id = ? AND paid = 0
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching unpaid bills: %v", err)
+	}
+	defer rows.Close()
+
+	var bills []unpaidBill
+	for rows.Next() {
+		var bill unpaidBill
+		var regularity, adjustment string
+		var durationMonths int
+		o := &bill.occurrence
+		err := rows.Scan(&o.BillID, &o.Name, &o.Amount, &o.PaymentMethod, &o.Category, &o.Icon, &o.Recurring,
+			&bill.scheduled, &bill.dueDate, &bill.startDate, &bill.paymentDay, &durationMonths, &regularity, &adjustment)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning bill: %v", err)
+		}
+		if bill.scheduled {
+			if bill.schedule, err = BillSchedule(bill.startDate, bill.paymentDay, durationMonths, regularity, adjustment); err != nil {
+				log.Printf("Skipping bill %d with an invalid schedule: %v", o.BillID, err)
+				continue
+			}
+		}
+		bills = append(bills, bill)
+	}
+	return bills, rows.Err()
+}
+
+// billPaymentRow es una fila de bill_payments de una factura
+type billPaymentRow struct {
+	key           string
+	dueDate       string
+	paymentMethod string
+	paid          bool
+	amount        sql.NullFloat64 // Importe propio de la repetición
+	paidAmount    float64
+}
+
+func billPaymentRows(q DBTX, billID int) ([]billPaymentRow, error) {
+	rows, err := q.Query(`
+		SELECT year_month, COALESCE(due_date, ''), COALESCE(payment_method, ''), paid, amount, COALESCE(paid_amount, 0)
+		FROM bill_payments WHERE bill_id = ?
+	`, billID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching bill payments: %v", err)
+	}
+	defer rows.Close()
+
+	var payments []billPaymentRow
+	for rows.Next() {
+		var payment billPaymentRow
+		err := rows.Scan(&payment.key, &payment.dueDate, &payment.paymentMethod, &payment.paid, &payment.amount, &payment.paidAmount)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning bill payment: %v", err)
+		}
+		payments = append(payments, payment)
+	}
+	return payments, rows.Err()
+}
+
+// billPaymentDueDate devuelve el vencimiento guardado de un pago o, en los pagos creados antes
+// de guardarse, el día de pago de la factura dentro del mes del periodo (0 es el día de la
+// fecha de inicio y -1 el último del mes)
+func billPaymentDueDate(key, dueDate string, paymentDay int, startDate string) (time.Time, error) {
+	if dueDate != "" {
+		return time.Parse("2006-01-02", dueDate[:min(len(dueDate), 10)])
+	}
+	if len(key) == len("2006-01-02") {
+		return time.Parse("2006-01-02", key)
+	}
+
+	month, err := time.Parse("2006-01", key)
+	if err != nil {
+		return month, err
+	}
+	lastDay := month.AddDate(0, 1, -1).Day()
+	day := paymentDay
+	if day == 0 {
+		start, err := time.Parse("2006-01-02", startDate[:min(len(startDate), 10)])
+		if err != nil {
+			return start, err
+		}
+		day = start.Day()
+	}
+	if day < 0 || day > lastDay {
+		day = lastDay
+	}
+	return time.Date(month.Year(), month.Month(), day, 0, 0, 0, 0, time.UTC), nil
+}
+
+// occurrences devuelve las repeticiones sin pagar de la factura que vencen hasta until. Las
+// facturas con calendario las calculan con BillSchedule, así que incluyen las que todavía no
+// tienen fila. Las demás son sus filas de bill_payments sin pagar, como las reserva el libro,
+// o un único pago en due_date si no tienen ninguna (las de lotes). El importe de cada una es lo
+// que queda de su importe propio o del de la factura.
+func (b unpaidBill) occurrences(q DBTX, until time.Time) ([]UnpaidBillOccurrence, error) {
+	payments, err := billPaymentRows(q, b.occurrence.BillID)
+	if err != nil {
+		return nil, err
+	}
+	paid := map[string]bool{}
+	pending := map[string]billPaymentRow{}
+	for _, payment := range payments {
+		if payment.paid {
+			paid[payment.key] = true
+		} else {
+			pending[payment.key] = payment
+		}
+	}
+	occurrence := func(key string, due time.Time) UnpaidBillOccurrence {
+		o := b.occurrence
+		o.Key, o.DueDate = key, due
+		if payment, ok := pending[key]; ok {
+			if payment.paymentMethod != "" {
+				o.PaymentMethod = payment.paymentMethod
+			}
+			if payment.amount.Valid {
+				o.Amount = payment.amount.Float64
+			}
+			o.PaidAmount = payment.paidAmount
+			o.Amount = math.Max(o.Amount-o.PaidAmount, 0)
+		}
+		return o
+	}
+
+	var occurrences []UnpaidBillOccurrence
+	switch {
+	case b.scheduled:
+		for _, scheduled := range b.schedule.Occurrences(time.Time{}, until) {
+			if !paid[scheduled.Key] {
+				occurrences = append(occurrences, occurrence(scheduled.Key, scheduled.Date))
+			}
+		}
+	case len(payments) > 0:
+		for _, payment := range payments {
+			if payment.paid {
+				continue
+			}
+			due, err := billPaymentDueDate(payment.key, payment.dueDate, b.paymentDay, b.startDate)
+			if err != nil {
+				log.Printf("Skipping period %s of bill %d: %v", payment.key, b.occurrence.BillID, err)
+				continue
+			}
+			if !due.After(until) {
+				occurrences = append(occurrences, occurrence(payment.key, due))
+			}
+		}
+	default:
+		due, err := time.Parse("2006-01-02", b.dueDate[:min(len(b.dueDate), 10)])
+		if err != nil {
+			log.Printf("Skipping bill %d without a valid due date: %v", b.occurrence.BillID, err)
+			break
+		}
+		if !due.After(until) {
+			occurrences = append(occurrences, occurrence(due.Format("2006-01"), due))
+		}
+	}
+	return occurrences, nil
+}
+
+// UnpaidBillOccurrences devuelve las repeticiones sin pagar de las facturas del usuario que
+// vencen hasta until, ordenadas por vencimiento. today es el día del usuario con el que se
+// cuentan los días de retraso.
+func UnpaidBillOccurrences(q DBTX, userID string, today, until time.Time) ([]UnpaidBillOccurrence, error) {
+	bills, err := loadUnpaidBills(q, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var occurrences []UnpaidBillOccurrence
+	for _, bill := range bills {
+		billOccurrences, err := bill.occurrences(q, until)
+		if err != nil {
+			return nil, err
+		}
+		for _, occurrence := range billOccurrences {
+			if occurrence.DueDate.Before(today) {
+				occurrence.OverdueDays = int(today.Sub(occurrence.DueDate).Hours() / 24)
+			}
+			occurrences = append(occurrences, occurrence)
+		}
+	}
+
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].DueDate.Before(occurrences[j].DueDate)
+	})
+	return occurrences, nil
+}
+
+// RefreshBillOverdue recalcula bills.overdue y bills.overdue_days de las facturas del usuario
+// con su día de hoy: una factura está vencida si tiene alguna repetición sin pagar anterior a
+// hoy, y overdue_days cuenta desde la más antigua. Publica EventBillOverdue por cada factura
+// que pasa a estar vencida y devuelve cuántas son.
+func RefreshBillOverdue(q DBTX, userID string) (int, error) {
+	today, _ := time.Parse("2006-01-02", UserToday(q, userID))
+	overdue, err := UnpaidBillOccurrences(q, userID, today, today.AddDate(0, 0, -1))
+	if err != nil {
+		return 0, err
+	}
+	// Ordenadas por vencimiento: la primera de cada factura es la más antigua
+	oldest := map[int]UnpaidBillOccurrence{}
+	counts := map[int]int{}
+	for _, occurrence := range overdue {
+		if _, ok := oldest[occurrence.BillID]; !ok {
+			oldest[occurrence.BillID] = occurrence
+		}
+		counts[occurrence.BillID]++
+	}
+
+	type billFlags struct {
+		id          int
+		overdue     bool
+		overdueDays int
+	}
+	rows, err := q.Query(`
+		SELECT id, COALESCE(overdue, 0), COALESCE(overdue_days, 0) FROM bills
+		WHERE user_id = ? AND (paid = 0 OR overdue = 1)
+	`, userID)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching bills: %v", err)
+	}
+	var current []billFlags
+	for rows.Next() {
+		var flags billFlags
+		if err := rows.Scan(&flags.id, &flags.overdue, &flags.overdueDays); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning bill: %v", err)
+		}
+		current = append(current, flags)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error fetching bills: %v", err)
+	}
+
+	newlyOverdue := 0
+	for _, flags := range current {
+		occurrence, isOverdue := oldest[flags.id]
+		if isOverdue == flags.overdue && occurrence.OverdueDays == flags.overdueDays {
+			continue
+		}
+		// No cambia updated_at ni version: el retraso no es una edición del usuario
+		_, err := q.Exec(`UPDATE bills SET overdue = ?, overdue_days = ? WHERE id = ?`,
+			isOverdue, occurrence.OverdueDays, flags.id)
+		if err != nil {
+			return newlyOverdue, fmt.Errorf("error updating overdue bill %d: %v", flags.id, err)
+		}
+		if !isOverdue || flags.overdue {
+			continue
+		}
+
+		newlyOverdue++
+		err = PublishEvent(q, EventBillOverdue, userID, int64(flags.id), map[string]interface{}{
+			"name":                occurrence.Name,
+			"amount":              occurrence.Amount,
+			"year_month":          occurrence.Key,
+			"due_date":            occurrence.DueDate.Format("2006-01-02"),
+			"overdue_days":        occurrence.OverdueDays,
+			"overdue_occurrences": counts[flags.id],
+			"payment_method":      occurrence.PaymentMethod,
+		})
+		if err != nil {
+			return newlyOverdue, err
+		}
+	}
+	return newlyOverdue, nil
+}
@@ -0,0 +1,76 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshBillOverdue(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	// Factura semanal que empezó hace 15 días: vencieron las repeticiones de hace 15, 8 y 1 días
+	today, _ := time.Parse("2006-01-02", UserToday(db, "1"))
+	start := today.AddDate(0, 0, -15)
+	billID, err := AddBill(db, "1", "Cleaning", 25, start.Format("2006-01-02"), 0, 0, "cash", "home", "🧹", "weekly")
+	if err != nil {
+		t.Fatalf("Failed to add bill: %v", err)
+	}
+
+	for run := 0; run < 2; run++ {
+		newlyOverdue, err := RefreshBillOverdue(db, "1")
+		if err != nil {
+			t.Fatalf("Failed to refresh overdue bills: %v", err)
+		}
+		if want := 1 - run; newlyOverdue != want {
+			t.Errorf("Run %d: expected %d newly overdue bills, got %d", run, want, newlyOverdue)
+		}
+	}
+	var overdue bool
+	var overdueDays, version, events int
+	db.QueryRow(`SELECT overdue, overdue_days, version FROM bills WHERE id = ?`, billID).Scan(&overdue, &overdueDays, &version)
+	if !overdue || overdueDays != 15 || version != 1 {
+		t.Errorf("Expected the bill overdue by 15 days without a new version, got %v, %d, version %d", overdue, overdueDays, version)
+	}
+	db.QueryRow(`SELECT COUNT(*) FROM outbox WHERE event_type = ? AND aggregate_id = ?`, EventBillOverdue, billID).Scan(&events)
+	if events != 1 {
+		t.Errorf("Expected one BillOverdue event, got %d", events)
+	}
+
+	// Al pagar la más antigua cuenta la siguiente, y al pagar todas deja de estar vencida
+	if err := MarkBillPaid(db, billID, "1", start.Format("2006-01-02")); err != nil {
+		t.Fatalf("Failed to pay bill: %v", err)
+	}
+	RefreshBillOverdue(db, "1")
+	db.QueryRow(`SELECT overdue, overdue_days FROM bills WHERE id = ?`, billID).Scan(&overdue, &overdueDays)
+	if !overdue || overdueDays != 8 {
+		t.Errorf("Expected the bill overdue by 8 days, got %v, %d", overdue, overdueDays)
+	}
+	for _, days := range []int{8, 1} {
+		if err := MarkBillPaid(db, billID, "1", today.AddDate(0, 0, -days).Format("2006-01-02")); err != nil {
+			t.Fatalf("Failed to pay bill: %v", err)
+		}
+	}
+	RefreshBillOverdue(db, "1")
+	db.QueryRow(`SELECT overdue, overdue_days FROM bills WHERE id = ?`, billID).Scan(&overdue, &overdueDays)
+	if overdue || overdueDays != 0 {
+		t.Errorf("Expected the bill no longer overdue, got %v, %d", overdue, overdueDays)
+	}
+
+	// Una factura de lotes sin filas de pago cuenta una vez, en su vencimiento, como en el libro
+	batchDue := today.AddDate(0, 0, -10).Format("2006-01-02")
+	result, _ := db.Exec(`
+		INSERT INTO bills (user_id, name, amount, due_date, paid, overdue, overdue_days, recurring, category, icon,
+			start_date, payment_day, duration_months, regularity, payment_method)
+		VALUES ('1', 'Insurance', 300, ?, 0, 0, 0, 1, 'home', '🏠', ?, 0, 6, 'monthly', 'bank')
+	`, batchDue, batchDue)
+	batchID, _ := result.LastInsertId()
+
+	occurrences, err := UnpaidBillOccurrences(db, "1", today, today.AddDate(0, 0, 13))
+	if err != nil {
+		t.Fatalf("Failed to list unpaid occurrences: %v", err)
+	}
+	if len(occurrences) != 3 || occurrences[0].BillID != int(batchID) || occurrences[0].OverdueDays != 10 ||
+		occurrences[1].Overdue() || occurrences[1].DueDate != today.AddDate(0, 0, 6) {
+		t.Errorf("Expected the batch bill and the next two weekly occurrences, got %+v", occurrences)
+	}
+}
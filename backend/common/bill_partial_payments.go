@@ -0,0 +1,291 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// EnsureBillPaymentAmountColumns añade a bill_payments el importe de cada repetición y lo ya
+// pagado: amount sustituye al de la factura en esa repetición (la luz de cada mes) y NULL
+// mantiene el de la factura; paid_amount suma los pagos parciales. La repetición queda pagada
+// cuando paid_amount cubre su importe. Las tablas que todavía no ha creado bills_management
+// se ignoran.
+func EnsureBillPaymentAmountColumns(db *sql.DB) error {
+	columns := []string{
+		`ALTER TABLE bill_payments ADD COLUMN amount REAL`,
+		`ALTER TABLE bill_payments ADD COLUMN paid_amount REAL NOT NULL DEFAULT 0`,
+	}
+	for _, column := range columns {
+		_, err := db.Exec(column)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") && !strings.Contains(err.Error(), "no such table") {
+			return fmt.Errorf("error adding bill payment amount columns: %v", err)
+		}
+	}
+	return nil
+}
+
+// BillPaymentRemainingSQL es lo que queda por pagar de una fila bp de bill_payments unida a su
+// factura b, sin contar si está marcada como pagada
+const BillPaymentRemainingSQL = `MAX(COALESCE(bp.amount, b.amount) - COALESCE(bp.paid_amount, 0), 0)`
+
+// BillPaymentDueDateSQL es el vencimiento (YYYY-MM-DD) de una fila bp de bill_payments unida a su
+// factura b. Las filas anteriores a due_date vencen el día de pago de su mes.
+const BillPaymentDueDateSQL = `COALESCE(bp.due_date, bp.year_month || '-' || printf('%02d', COALESCE(NULLIF(b.payment_day, 0), 1)))`
+
+// ErrInvalidBillAmount es el error de un pago o importe de repetición no positivo
+var ErrInvalidBillAmount = errors.New("amount must be greater than 0")
+
+// ErrBillOverpayment es el error de un pago mayor que lo que queda por pagar de la repetición
+var ErrBillOverpayment = errors.New("amount exceeds what is left to pay")
+
+// BillOccurrencePayment es el estado de una repetición tras pagarla o cambiar su importe
+type BillOccurrencePayment struct {
+	PaymentID  int64
+	Amount     float64 // Lo pagado en este pago
+	AmountDue  float64 // Importe de la repetición
+	PaidAmount float64 // Suma de lo pagado
+	Paid       bool    // Lo pagado cubre el importe
+}
+
+// Remaining es lo que queda por pagar de la repetición
+func (p BillOccurrencePayment) Remaining() float64 {
+	if p.Paid {
+		return 0
+	}
+	return math.Max(p.AmountDue-p.PaidAmount, 0)
+}
+
+// billAmountCovered compara en céntimos para que 33.33 + 33.33 + 33.34 cubra 100
+func billAmountCovered(paid, due float64) bool {
+	return math.Round(paid*100) >= math.Round(due*100)
+}
+
+// loadBillOccurrencePayment lee el pago de una repetición, creándolo en las facturas con
+// calendario si todavía no se ha generado
+func loadBillOccurrencePayment(q DBTX, billID int, userID, key string) (BillOccurrencePayment, error) {
+	var payment BillOccurrencePayment
+	if err := ensureBillOccurrence(q, int64(billID), userID, key); err != nil {
+		return payment, err
+	}
+	err := q.QueryRow(`
+		SELECT bp.id, bp.paid, COALESCE(bp.amount, b.amount), COALESCE(bp.paid_amount, 0) FROM bill_payments bp
+		JOIN bills b ON b.id = bp.bill_id
+		WHERE bp.bill_id = ? AND bp.year_month = ? AND b.user_id = ?
+	`, billID, key, userID).Scan(&payment.PaymentID, &payment.Paid, &payment.AmountDue, &payment.PaidAmount)
+	if err == sql.ErrNoRows {
+		return payment, ErrBillPaymentNotFound
+	}
+	if err != nil {
+		return payment, fmt.Errorf("error fetching bill payment: %v", err)
+	}
+	if payment.Paid {
+		return payment, ErrBillAlreadyPaid
+	}
+	return payment, nil
+}
+
+// settleBillOccurrence marca la repetición como pagada si lo pagado cubre su importe; si no,
+// reserva en el libro lo que queda
+func settleBillOccurrence(q DBTX, billID int, userID, key, paymentDate, paymentMethod string, payment *BillOccurrencePayment) error {
+	if payment.PaidAmount > 0 && billAmountCovered(payment.PaidAmount, payment.AmountDue) {
+		payment.Paid = true
+		return MarkBillPaidOnTx(q, billID, userID, key, paymentDate, paymentMethod)
+	}
+	return ReserveBillPayments(q, userID, int64(billID))
+}
+
+// PayBillOccurrenceTx registra un pago de amount de la repetición key de la factura. Con amount
+// 0 se paga lo que queda; más de lo que queda devuelve ErrBillOverpayment. Cuando lo pagado
+// cubre el importe la repetición queda pagada como con MarkBillPaidOnTx; si no, sigue pendiente
+// y el libro reserva solo lo que falta. El gasto de cada pago lo registra quien paga.
+func PayBillOccurrenceTx(q DBTX, billID int, userID, key string, amount float64, paymentDate, paymentMethod string) (BillOccurrencePayment, error) {
+	if amount < 0 {
+		return BillOccurrencePayment{}, ErrInvalidBillAmount
+	}
+	payment, err := loadBillOccurrencePayment(q, billID, userID, key)
+	if err != nil {
+		return payment, err
+	}
+	if amount == 0 {
+		amount = payment.Remaining()
+	}
+	if math.Round(amount*100) > math.Round(payment.Remaining()*100) {
+		return payment, ErrBillOverpayment
+	}
+
+	payment.Amount = amount
+	payment.PaidAmount += amount
+	if _, err := q.Exec(`UPDATE bill_payments SET paid_amount = ? WHERE id = ?`, payment.PaidAmount, payment.PaymentID); err != nil {
+		return payment, fmt.Errorf("error recording bill payment: %v", err)
+	}
+	if err := settleBillOccurrence(q, billID, userID, key, paymentDate, paymentMethod, &payment); err != nil {
+		return payment, err
+	}
+	if payment.Paid {
+		return payment, nil
+	}
+
+	return payment, PublishEvent(q, EventBillPartiallyPaid, userID, int64(billID), map[string]interface{}{
+		"bill_id":        billID,
+		"payment_id":     payment.PaymentID,
+		"year_month":     key,
+		"amount":         amount,
+		"paid_amount":    payment.PaidAmount,
+		"amount_due":     payment.AmountDue,
+		"payment_date":   paymentDate,
+		"payment_method": paymentMethod,
+	})
+}
+
+// SetBillOccurrenceAmountTx cambia el importe de la repetición key de la factura; nil vuelve al
+// de la factura. Si lo ya pagado cubre el nuevo importe, la repetición queda pagada en today.
+func SetBillOccurrenceAmountTx(q DBTX, billID int, userID, key string, amount *float64, today string) (BillOccurrencePayment, error) {
+	if amount != nil && *amount <= 0 {
+		return BillOccurrencePayment{}, ErrInvalidBillAmount
+	}
+	payment, err := loadBillOccurrencePayment(q, billID, userID, key)
+	if err != nil {
+		return payment, err
+	}
+
+	if _, err := q.Exec(`UPDATE bill_payments SET amount = ? WHERE id = ?`, amount, payment.PaymentID); err != nil {
+		return payment, fmt.Errorf("error updating bill payment amount: %v", err)
+	}
+	if err := q.QueryRow(`SELECT amount FROM bills WHERE id = ?`, billID).Scan(&payment.AmountDue); err != nil {
+		return payment, fmt.Errorf("error fetching bill: %v", err)
+	}
+	if amount != nil {
+		payment.AmountDue = *amount
+	}
+	if err := settleBillOccurrence(q, billID, userID, key, today, "", &payment); err != nil {
+		return payment, err
+	}
+
+	return payment, PublishEvent(q, EventBillUpdated, userID, int64(billID), map[string]interface{}{
+		"bill_id":     billID,
+		"payment_id":  payment.PaymentID,
+		"year_month":  key,
+		"amount_due":  payment.AmountDue,
+		"paid_amount": payment.PaidAmount,
+		"paid":        payment.Paid,
+	})
+}
+
+// AdjustBillPaymentTx corrige lo pagado del pago paymentID de bill_payments cuando cambia el
+// gasto que lo registró (expenses.bill_payment_id): delta es la diferencia de importe. Subirlo es
+// otro pago de la repetición, con los mismos errores que PayBillOccurrenceTx; bajarlo o borrar el
+// gasto lo descuenta con ReverseBillPaymentTx.
+func AdjustBillPaymentTx(q DBTX, userID string, paymentID int64, delta float64, paymentDate, paymentMethod string) error {
+	if math.Round(delta*100) == 0 {
+		return nil
+	}
+	if delta < 0 {
+		return ReverseBillPaymentTx(q, userID, paymentID, -delta)
+	}
+
+	var billID int
+	var key string
+	err := q.QueryRow(`
+		SELECT bp.bill_id, bp.year_month FROM bill_payments bp
+		JOIN bills b ON b.id = bp.bill_id
+		WHERE bp.id = ? AND b.user_id = ?
+	`, paymentID, userID).Scan(&billID, &key)
+	if err == sql.ErrNoRows {
+		return ErrBillPaymentNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching bill payment: %v", err)
+	}
+	_, err = PayBillOccurrenceTx(q, billID, userID, key, delta, paymentDate, paymentMethod)
+	return err
+}
+
+// ReverseBillPaymentTx descuenta amount de lo pagado del pago paymentID de bill_payments, al
+// borrar o rebajar el gasto que lo registró. Si lo pagado deja de cubrir el importe, la repetición
+// y la factura vuelven a estar pendientes y el libro reserva lo que falta. Si la factura ya no
+// existe no hay nada que deshacer.
+func ReverseBillPaymentTx(q DBTX, userID string, paymentID int64, amount float64) error {
+	var billID int64
+	var key string
+	var wasPaid bool
+	var amountDue, paidAmount float64
+	err := q.QueryRow(`
+		SELECT bp.bill_id, bp.year_month, bp.paid, COALESCE(bp.amount, b.amount), COALESCE(bp.paid_amount, 0)
+		FROM bill_payments bp JOIN bills b ON b.id = bp.bill_id
+		WHERE bp.id = ? AND b.user_id = ?
+	`, paymentID, userID).Scan(&billID, &key, &wasPaid, &amountDue, &paidAmount)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching bill payment: %v", err)
+	}
+
+	paidAmount = math.Max(math.Round((paidAmount-amount)*100)/100, 0)
+	paid := paidAmount > 0 && billAmountCovered(paidAmount, amountDue)
+	_, err = q.Exec(`
+		UPDATE bill_payments SET paid_amount = ?, paid = ?, payment_date = CASE WHEN ? THEN payment_date END
+		WHERE id = ?
+	`, paidAmount, paid, paid, paymentID)
+	if err != nil {
+		return fmt.Errorf("error reversing bill payment: %v", err)
+	}
+	if wasPaid && !paid {
+		_, err = q.Exec(`
+			UPDATE bills SET paid = 0, version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ? AND user_id = ? AND paid = 1
+		`, billID, userID)
+		if err != nil {
+			return fmt.Errorf("error updating bill status: %v", err)
+		}
+	}
+	if err := ReserveBillPayments(q, userID, billID); err != nil {
+		return err
+	}
+	// Una repetición vencida que vuelve a estar pendiente vuelve a contar como vencida
+	if _, err := RefreshBillOverdue(q, userID); err != nil {
+		return err
+	}
+
+	return PublishEvent(q, EventBillUpdated, userID, billID, map[string]interface{}{
+		"bill_id":     billID,
+		"payment_id":  paymentID,
+		"year_month":  key,
+		"reversed":    amount,
+		"paid_amount": paidAmount,
+		"amount_due":  amountDue,
+		"paid":        paid,
+	})
+}
+
+// ReleaseDeletedExpenseTx deshace, antes de borrar el gasto expenseID, lo que registró fuera de
+// las tablas de saldos: lo pagado de la repetición de factura que pagó (bill_payment_id) y su
+// parte del extracto si es una compra con tarjeta, que devuelve ErrCardStatementPaid si el
+// extracto ya tiene pagos. Sin esas columnas todavía no hay gastos enlazados.
+func ReleaseDeletedExpenseTx(q DBTX, userID string, expenseID int64) error {
+	var amount float64
+	var date, paymentMethod string
+	var cardID, billPaymentID sql.NullInt64
+	err := q.QueryRow(`
+		SELECT amount, date, payment_method, credit_card_id, bill_payment_id FROM expenses WHERE id = ? AND user_id = ?
+	`, expenseID, userID).Scan(&amount, &date, &paymentMethod, &cardID, &billPaymentID)
+	if err == sql.ErrNoRows || (err != nil && strings.Contains(err.Error(), "no such column")) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching expense: %v", err)
+	}
+
+	if paymentMethod == PaymentMethodCreditCard && cardID.Valid {
+		if err := AdjustCardStatementTx(q, userID, cardID.Int64, date, -amount, -1); err != nil {
+			return err
+		}
+	}
+	if billPaymentID.Valid {
+		return ReverseBillPaymentTx(q, userID, billPaymentID.Int64, amount)
+	}
+	return nil
+}
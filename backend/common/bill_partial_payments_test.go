@@ -0,0 +1,202 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBillPartialPaymentsReserveWhatIsLeft(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	insertMovement(t, db, "income", "1", 1000, "2025-01-01", "bank")
+	billID, err := AddBill(db, "1", "Electricity", 100, "2025-01-10", 10, 2, "bank", "utilities", "💡", "monthly")
+	if err != nil {
+		t.Fatalf("Failed to add bill: %v", err)
+	}
+
+	// La factura de febrero llega por 130
+	amount := 130.0
+	if _, err := SetBillOccurrenceAmountTx(db, billID, "1", "2025-02", &amount, "2025-01-01"); err != nil {
+		t.Fatalf("Failed to set occurrence amount: %v", err)
+	}
+	expectBalance(t, periodBalances(t, db, tableByPeriod("monthly"), "1"), "2025-02", 0, 770)
+
+	// Enero se paga en dos veces, la segunda con importe 0 (lo que queda): cada pago es un
+	// gasto y la reserva baja lo mismo
+	for _, step := range []struct{ amount, spent, remaining float64 }{{40, 40, 60}, {0, 60, 0}} {
+		payment, err := PayBillOccurrenceTx(db, billID, "1", "2025-01", step.amount, "2025-01-12", "bank")
+		if err != nil {
+			t.Fatalf("Failed to pay bill: %v", err)
+		}
+		insertMovement(t, db, "expense", "1", step.spent, "2025-01-12", "bank")
+		if payment.Remaining() != step.remaining || payment.Paid != (step.remaining == 0) {
+			t.Errorf("Expected %.2f left to pay, got %+v", step.remaining, payment)
+		}
+		monthly := periodBalances(t, db, tableByPeriod("monthly"), "1")
+		expectBalance(t, monthly, "2025-01", 0, 900)
+		expectBalance(t, monthly, "2025-02", 0, 770)
+	}
+	if _, err := PayBillOccurrenceTx(db, billID, "1", "2025-01", 10, "2025-01-12", "bank"); err != ErrBillAlreadyPaid {
+		t.Errorf("Expected paying a paid occurrence to fail, got %v", err)
+	}
+
+	today, _ := time.Parse("2006-01-02", "2025-01-12")
+	occurrences, err := UnpaidBillOccurrences(db, "1", today, today.AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatalf("Failed to list unpaid occurrences: %v", err)
+	}
+	if len(occurrences) != 1 || occurrences[0].Key != "2025-02" || occurrences[0].Amount != 130 {
+		t.Errorf("Expected February with 130 due, got %+v", occurrences)
+	}
+
+	// Con 100 pagados de febrero, volver al importe de la factura la deja pagada
+	if _, err := PayBillOccurrenceTx(db, billID, "1", "2025-02", 100, "2025-02-10", "bank"); err != nil {
+		t.Fatalf("Failed to pay bill: %v", err)
+	}
+	insertMovement(t, db, "expense", "1", 100, "2025-02-10", "bank")
+	payment, err := SetBillOccurrenceAmountTx(db, billID, "1", "2025-02", nil, "2025-02-10")
+	if err != nil || !payment.Paid {
+		t.Fatalf("Expected February paid, got %+v, %v", payment, err)
+	}
+	var billPaid bool
+	db.QueryRow(`SELECT paid FROM bills WHERE id = ?`, billID).Scan(&billPaid)
+	if !billPaid {
+		t.Errorf("Expected the bill completed")
+	}
+	expectBalance(t, periodBalances(t, db, tableByPeriod("monthly"), "1"), "2025-02", 0, 800)
+
+	// Reconstruir el libro desde las tablas de origen da lo mismo
+	drifts, err := auditUserBalances(db, "1", false)
+	if err != nil || len(drifts) != 0 {
+		t.Errorf("Expected no drift after rebuilding the ledger, got %+v, %v", drifts, err)
+	}
+}
+
+func TestStatementAndLoanBillsAreNotPaidDirectly(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	var billIDs []int
+	for _, name := range []string{"Rent", "Visa statement", "Car loan"} {
+		billID, err := AddBill(db, "1", name, 100, "2025-01-10", 10, 1, "bank", "bills", "🧾", "monthly")
+		if err != nil {
+			t.Fatalf("Failed to add bill: %v", err)
+		}
+		billIDs = append(billIDs, billID)
+	}
+
+	// Sin las tablas de tarjetas y préstamos cualquier factura se paga directamente
+	if err := CheckBillPayableDirectly(db, billIDs[1], "1"); err != nil {
+		t.Fatalf("Expected no owner without the statement and loan tables, got %v", err)
+	}
+
+	mustExec(t, db, `CREATE TABLE credit_card_statements (id INTEGER PRIMARY KEY, user_id TEXT, bill_id INTEGER)`)
+	mustExec(t, db, `CREATE TABLE loans (id INTEGER PRIMARY KEY, user_id TEXT, bill_id INTEGER)`)
+	mustExec(t, db, `INSERT INTO credit_card_statements (user_id, bill_id) VALUES ('1', ?)`, billIDs[1])
+	mustExec(t, db, `INSERT INTO loans (user_id, bill_id) VALUES ('1', ?)`, billIDs[2])
+
+	for i, expected := range []error{nil, ErrStatementBill, ErrLoanBill} {
+		if err := CheckBillPayableDirectly(db, billIDs[i], "1"); err != expected {
+			t.Errorf("Bill %d: expected %v, got %v", billIDs[i], expected, err)
+		}
+	}
+	// Otro usuario no ve el extracto
+	if err := CheckBillPayableDirectly(db, billIDs[1], "2"); err != nil {
+		t.Errorf("Expected no owner for another user, got %v", err)
+	}
+}
+
+func TestBillOverpaymentIsRejected(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	billID, err := AddBill(db, "1", "Internet", 100, "2025-01-10", 10, 1, "bank", "utilities", "🌐", "monthly")
+	if err != nil {
+		t.Fatalf("Failed to add bill: %v", err)
+	}
+	if _, err := PayBillOccurrenceTx(db, billID, "1", "2025-01", 60, "2025-01-10", "bank"); err != nil {
+		t.Fatalf("Failed to pay bill: %v", err)
+	}
+
+	// Quedan 40: pagar 500 no cierra la repetición ni cambia lo pagado
+	if _, err := PayBillOccurrenceTx(db, billID, "1", "2025-01", 500, "2025-01-11", "bank"); err != ErrBillOverpayment {
+		t.Fatalf("Expected paying more than what is left to fail, got %v", err)
+	}
+	var paid bool
+	var paidAmount float64
+	db.QueryRow(`SELECT paid, paid_amount FROM bill_payments WHERE bill_id = ? AND year_month = '2025-01'`, billID).
+		Scan(&paid, &paidAmount)
+	if paid || paidAmount != 60 {
+		t.Errorf("Expected the occurrence to stay unpaid with 60 paid, got %v and %.2f", paid, paidAmount)
+	}
+
+	// Exactamente lo que queda sí se acepta
+	payment, err := PayBillOccurrenceTx(db, billID, "1", "2025-01", 40, "2025-01-11", "bank")
+	if err != nil || !payment.Paid {
+		t.Errorf("Expected paying the remaining 40 to settle the occurrence, got %+v, %v", payment, err)
+	}
+}
+
+func TestBillPaymentFollowsItsExpense(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	insertMovement(t, db, "income", "1", 1000, "2025-01-01", "bank")
+	billID, err := AddBill(db, "1", "Gym", 100, "2025-01-10", 10, 1, "bank", "sports", "🏋️", "monthly")
+	if err != nil {
+		t.Fatalf("Failed to add bill: %v", err)
+	}
+	if _, err := PayBillOccurrenceTx(db, billID, "1", "2025-01", 0, "2025-01-10", "bank"); err != nil {
+		t.Fatalf("Failed to pay bill: %v", err)
+	}
+	expenseID := insertMovement(t, db, "expense", "1", 100, "2025-01-10", "bank")
+	var paymentID int64
+	db.QueryRow(`SELECT id FROM bill_payments WHERE bill_id = ? AND year_month = '2025-01'`, billID).Scan(&paymentID)
+
+	expectState := func(step string, paidAmount float64, paid bool) {
+		t.Helper()
+		var storedAmount float64
+		var occurrencePaid, billPaid bool
+		db.QueryRow(`SELECT paid_amount, paid FROM bill_payments WHERE id = ?`, paymentID).Scan(&storedAmount, &occurrencePaid)
+		db.QueryRow(`SELECT paid FROM bills WHERE id = ?`, billID).Scan(&billPaid)
+		if storedAmount != paidAmount || occurrencePaid != paid || billPaid != paid {
+			t.Errorf("%s: expected %.2f paid (paid %v), got %.2f (occurrence %v, bill %v)",
+				step, paidAmount, paid, storedAmount, occurrencePaid, billPaid)
+		}
+		// Lo pagado más lo reservado es siempre el importe de la factura
+		expectBalance(t, periodBalances(t, db, tableByPeriod("monthly"), "1"), "2025-01", 0, 900)
+	}
+	expectState("paid", 100, true)
+
+	// Subir el gasto de una repetición pagada sería pagarla de más
+	if err := AdjustBillPaymentTx(db, "1", paymentID, 10, "2025-01-10", "bank"); err != ErrBillAlreadyPaid {
+		t.Errorf("Expected raising the expense of a paid occurrence to fail, got %v", err)
+	}
+
+	// Bajar el gasto a 70 deja pendientes 30, y subirlo de nuevo la vuelve a pagar
+	if err := AdjustBillPaymentTx(db, "1", paymentID, -30, "2025-01-10", "bank"); err != nil {
+		t.Fatalf("Failed to lower the bill payment: %v", err)
+	}
+	recordMovement(t, db, "expense", "1", expenseID, 70, "2025-01-10", "bank")
+	expectState("lowered", 70, false)
+	if err := AdjustBillPaymentTx(db, "1", paymentID, 30, "2025-01-12", "bank"); err != nil {
+		t.Fatalf("Failed to raise the bill payment: %v", err)
+	}
+	recordMovement(t, db, "expense", "1", expenseID, 100, "2025-01-10", "bank")
+	expectState("raised", 100, true)
+
+	// Borrar el gasto deja la repetición sin pagar y reservando todo su importe
+	mustExec(t, db, `ALTER TABLE expenses ADD COLUMN credit_card_id INTEGER`)
+	mustExec(t, db, `ALTER TABLE expenses ADD COLUMN bill_payment_id INTEGER`)
+	mustExec(t, db, `UPDATE expenses SET bill_payment_id = ? WHERE id = ?`, paymentID, expenseID)
+	if err := ReleaseDeletedExpenseTx(db, "1", expenseID); err != nil {
+		t.Fatalf("Failed to release the deleted expense: %v", err)
+	}
+	mustExec(t, db, `DELETE FROM expenses WHERE id = ?`, expenseID)
+	if err := RemoveLedgerEntries(db, "1", LedgerSourceExpense, expenseID); err != nil {
+		t.Fatalf("Failed to remove the expense: %v", err)
+	}
+	expectState("deleted", 0, false)
+
+	drifts, err := auditUserBalances(db, "1", false)
+	if err != nil || len(drifts) != 0 {
+		t.Errorf("Expected no drift after rebuilding the ledger, got %+v, %v", drifts, err)
+	}
+}
@@ -0,0 +1,227 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BillExpansionMonths es hasta cuántos meses por delante de hoy se crean los pagos pendientes
+// de las facturas con calendario. Más allá se crean según se acercan, al leer o pagar.
+const BillExpansionMonths = 3
+
+// EnsureBillScheduleColumns añade las columnas del calendario de facturas: bills.scheduled
+// marca las facturas cuyos pagos se generan con BillSchedule (las anteriores, las de lotes y
+// las de extractos conservan sus filas), bills.business_day_adjustment el ajuste a día hábil
+// y bill_payments.due_date la fecha de vencimiento de cada pago. Las tablas que todavía no ha
+// creado bills_management se ignoran.
+func EnsureBillScheduleColumns(db *sql.DB) error {
+	columns := []string{
+		`ALTER TABLE bills ADD COLUMN scheduled INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE bills ADD COLUMN business_day_adjustment TEXT`,
+		`ALTER TABLE bill_payments ADD COLUMN due_date TEXT`,
+	}
+	for _, column := range columns {
+		_, err := db.Exec(column)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") && !strings.Contains(err.Error(), "no such table") {
+			return fmt.Errorf("error adding bill schedule columns: %v", err)
+		}
+	}
+	return nil
+}
+
+// BillHorizon es la fecha hasta la que se crean los pagos de las facturas del usuario
+func BillHorizon(q DBTX, userID string) time.Time {
+	today, _ := time.Parse("2006-01-02", UserToday(q, userID))
+	return today.AddDate(0, BillExpansionMonths, 0)
+}
+
+// scheduledBill es lo que hace falta de una factura para generar sus pagos
+type scheduledBill struct {
+	id            int64
+	userID        string
+	amount        float64
+	paymentMethod string
+	scheduled     bool
+	schedule      Schedule
+}
+
+func loadScheduledBill(q DBTX, billID int64) (scheduledBill, error) {
+	bill := scheduledBill{id: billID}
+	var startDate, regularity, adjustment string
+	var paymentDay, durationMonths int
+	err := q.QueryRow(`
+		SELECT user_id, amount, COALESCE(payment_method, 'bank'), COALESCE(scheduled, 0),
+		       COALESCE(start_date, due_date), COALESCE(payment_day, 0), COALESCE(duration_months, 0),
+		       COALESCE(regularity, ''), COALESCE(business_day_adjustment, '')
+		FROM bills WHERE id = ?
+	`, billID).Scan(&bill.userID, &bill.amount, &bill.paymentMethod, &bill.scheduled,
+		&startDate, &paymentDay, &durationMonths, &regularity, &adjustment)
+	if err != nil {
+		return bill, err
+	}
+	if bill.scheduled {
+		if bill.schedule, err = BillSchedule(startDate, paymentDay, durationMonths, regularity, adjustment); err != nil {
+			return bill, fmt.Errorf("bill %d: %v", billID, err)
+		}
+	}
+	return bill, nil
+}
+
+// insertOccurrence crea el pago pendiente de una repetición si no existe. Con reserve, el
+// importe queda reservado en el libro como en AddBill.
+func (b scheduledBill) insertOccurrence(q DBTX, occurrence Occurrence, reserve bool) (*LedgerChange, error) {
+	result, err := q.Exec(`
+		INSERT OR IGNORE INTO bill_payments (bill_id, user_id, year_month, due_date, paid, payment_method)
+		VALUES (?, ?, ?, ?, 0, ?)
+	`, b.id, b.userID, occurrence.Key, occurrence.DateString(), b.paymentMethod)
+	if err != nil {
+		return nil, fmt.Errorf("error creating bill payment record: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 || !reserve {
+		return nil, nil
+	}
+	paymentID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("error getting bill payment ID: %v", err)
+	}
+	return &LedgerChange{
+		SourceType: LedgerSourceBillPayment,
+		SourceID:   paymentID,
+		Entries: []LedgerEntry{{
+			Date:          occurrence.Date,
+			Kind:          LedgerPendingBill,
+			PaymentMethod: b.paymentMethod,
+			Amount:        b.amount,
+		}},
+	}, nil
+}
+
+// ExpandBill crea los pagos pendientes de una factura con calendario que vencen hasta until y
+// reserva su importe. Los que ya existen no se tocan, así que puede llamarse las veces que haga falta.
+func ExpandBill(q DBTX, billID int64, until time.Time) error {
+	bill, err := loadScheduledBill(q, billID)
+	if err != nil {
+		return fmt.Errorf("error loading bill: %v", err)
+	}
+	if !bill.scheduled {
+		return nil
+	}
+
+	var changes []LedgerChange
+	for _, occurrence := range bill.schedule.Occurrences(time.Time{}, until) {
+		change, err := bill.insertOccurrence(q, occurrence, true)
+		if err != nil {
+			return err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	if err := ApplyLedgerChanges(q, bill.userID, changes...); err != nil {
+		return fmt.Errorf("error updating balances: %v", err)
+	}
+	return nil
+}
+
+// ExpandBillOccurrences hace ExpandBill con todas las facturas pendientes del usuario
+func ExpandBillOccurrences(q DBTX, userID string, until time.Time) error {
+	rows, err := q.Query(`SELECT id FROM bills WHERE user_id = ? AND scheduled = 1 AND paid = 0`, userID)
+	if err != nil {
+		return fmt.Errorf("error fetching scheduled bills: %v", err)
+	}
+	var billIDs []int64
+	for rows.Next() {
+		var billID int64
+		if err := rows.Scan(&billID); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning bill: %v", err)
+		}
+		billIDs = append(billIDs, billID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error fetching scheduled bills: %v", err)
+	}
+
+	for _, billID := range billIDs {
+		if err := ExpandBill(q, billID, until); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RescheduleBill vuelve a generar los pagos pendientes de una factura con calendario tras
+// cambiar su regla, fechas o importe. Los pagos ya hechos se conservan, y también los
+// pendientes con pagos parciales o con importe propio, que vuelven a reservar lo que les falta.
+func RescheduleBill(q DBTX, userID string, billID int64, until time.Time) error {
+	rows, err := q.Query(`SELECT id FROM bill_payments WHERE bill_id = ? AND paid = 0`, billID)
+	if err != nil {
+		return fmt.Errorf("error fetching bill payments: %v", err)
+	}
+	var changes []LedgerChange
+	for rows.Next() {
+		change := LedgerChange{SourceType: LedgerSourceBillPayment}
+		if err := rows.Scan(&change.SourceID); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning bill payment: %v", err)
+		}
+		changes = append(changes, change)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error fetching bill payments: %v", err)
+	}
+
+	if err := ApplyLedgerChanges(q, userID, changes...); err != nil {
+		return fmt.Errorf("error releasing bill reservations: %v", err)
+	}
+	_, err = q.Exec(`
+		DELETE FROM bill_payments WHERE bill_id = ? AND paid = 0 AND amount IS NULL AND COALESCE(paid_amount, 0) = 0
+	`, billID)
+	if err != nil {
+		return fmt.Errorf("error deleting pending bill payments: %v", err)
+	}
+	if err := ExpandBill(q, billID, until); err != nil {
+		return err
+	}
+	return ReserveBillPayments(q, userID, billID)
+}
+
+// ensureBillOccurrence crea sin reserva el pago de una repetición todavía no generada, para
+// poder pagarla por adelantado
+func ensureBillOccurrence(q DBTX, billID int64, userID, key string) error {
+	bill, err := loadScheduledBill(q, billID)
+	if err == sql.ErrNoRows || (err == nil && bill.userID != userID) {
+		return ErrBillPaymentNotFound
+	}
+	if err != nil || !bill.scheduled {
+		return err
+	}
+	occurrence, ok := bill.schedule.Find(key)
+	if !ok {
+		return nil
+	}
+	_, err = bill.insertOccurrence(q, occurrence, false)
+	return err
+}
+
+// billCompleted indica si una factura con calendario tiene pagadas todas sus repeticiones.
+// Una factura sin fin no se completa nunca.
+func billCompleted(q DBTX, billID int64) (bool, error) {
+	bill, err := loadScheduledBill(q, billID)
+	if err != nil {
+		return false, fmt.Errorf("error loading bill: %v", err)
+	}
+	occurrences, bounded := bill.schedule.All()
+	if !bounded {
+		return false, nil
+	}
+	var paid int
+	if err := q.QueryRow(`SELECT COUNT(*) FROM bill_payments WHERE bill_id = ? AND paid = 1`, billID).Scan(&paid); err != nil {
+		return false, fmt.Errorf("error checking bill completion: %v", err)
+	}
+	return paid >= len(occurrences), nil
+}
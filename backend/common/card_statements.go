@@ -0,0 +1,87 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Errores de las compras con tarjeta que no se deben a la base de datos
+var (
+	ErrCardCycleClosed   = errors.New("date falls in a credit card cycle whose statement is already closed")
+	ErrCardStatementPaid = errors.New("the credit card statement of this purchase already has payments")
+)
+
+// CheckCardPurchaseDate devuelve ErrCardCycleClosed si date (YYYY-MM-DD) cae en un ciclo de la
+// tarjeta con extracto ya generado: ese extracto no volvería a sumar la compra y el siguiente
+// solo cubre su propio ciclo
+func CheckCardPurchaseDate(q DBTX, cardID int64, date string) error {
+	var lastEnd sql.NullString
+	err := q.QueryRow(`SELECT MAX(period_end) FROM credit_card_statements WHERE card_id = ?`, cardID).Scan(&lastEnd)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return nil
+		}
+		return fmt.Errorf("error checking card statements: %v", err)
+	}
+	if lastEnd.Valid && date <= lastEnd.String {
+		return ErrCardCycleClosed
+	}
+	return nil
+}
+
+// AdjustCardStatementTx suma amountDelta al saldo del extracto de la tarjeta que cubre date y
+// countDelta a sus compras, para que editar o borrar una compra no lo deje desfasado. La factura
+// del extracto cambia de importe y vuelve a reservar lo pendiente. Si el ciclo sigue abierto no
+// hay nada que ajustar; si el extracto ya tiene pagos devuelve ErrCardStatementPaid.
+func AdjustCardStatementTx(q DBTX, userID string, cardID int64, date string, amountDelta float64, countDelta int) error {
+	var statementID int64
+	var balance, paidAmount float64
+	var billID sql.NullInt64
+	err := q.QueryRow(`
+		SELECT id, balance, paid_amount, bill_id FROM credit_card_statements
+		WHERE card_id = ? AND user_id = ? AND period_start <= ? AND period_end >= ?
+	`, cardID, userID, date, date).Scan(&statementID, &balance, &paidAmount, &billID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching card statement: %v", err)
+	}
+	if paidAmount > 0.005 {
+		return ErrCardStatementPaid
+	}
+
+	newBalance := math.Max(math.Round((balance+amountDelta)*100)/100, 0)
+	status := "open"
+	if newBalance <= 0 {
+		status = "paid"
+	}
+	_, err = q.Exec(`
+		UPDATE credit_card_statements
+		SET balance = ?, purchases_count = MAX(purchases_count + ?, 0), status = ?
+		WHERE id = ?
+	`, newBalance, countDelta, status, statementID)
+	if err != nil {
+		return fmt.Errorf("error adjusting card statement: %v", err)
+	}
+	if !billID.Valid {
+		return nil
+	}
+
+	// Sin saldo la factura del extracto queda cerrada y deja de reservar
+	_, err = q.Exec(`
+		UPDATE bills SET amount = ?, paid = ?, version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND user_id = ?
+	`, newBalance, status == "paid", billID.Int64, userID)
+	if err == nil {
+		_, err = q.Exec(`UPDATE bill_payments SET amount = CASE WHEN amount IS NULL THEN NULL ELSE ? END, paid = ? WHERE bill_id = ?`,
+			newBalance, status == "paid", billID.Int64)
+	}
+	if err != nil {
+		return fmt.Errorf("error adjusting statement bill: %v", err)
+	}
+	return ReserveBillPayments(q, userID, billID.Int64)
+}
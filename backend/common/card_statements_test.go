@@ -0,0 +1,100 @@
+package common
+
+import (
+	"testing"
+)
+
+// addCardStatement crea un extracto cerrado con su factura, como generateDueStatements en
+// cash_bank_management
+func addCardStatement(t *testing.T, db DBTX, userID string, cardID int64, start, end, due string, balance, paid float64) int64 {
+	t.Helper()
+	result, err := db.Exec(`INSERT INTO bills (user_id, name, amount, due_date, paid, overdue, overdue_days, recurring,
+		category, icon, start_date, payment_day, duration_months, regularity, payment_method)
+		VALUES (?, 'Visa statement', ?, ?, 0, 0, 0, 0, 'credit_card', '💳', ?, 10, 1, 'monthly', 'bank')`,
+		userID, balance, due, due)
+	if err != nil {
+		t.Fatalf("Failed to add statement bill: %v", err)
+	}
+	billID, _ := result.LastInsertId()
+	mustExec(t, db, `INSERT INTO bill_payments (bill_id, user_id, year_month, paid, payment_method) VALUES (?, ?, ?, 0, 'bank')`,
+		billID, userID, due[:7])
+	if err := ReserveBillPayments(db, userID, billID); err != nil {
+		t.Fatalf("Failed to reserve statement bill: %v", err)
+	}
+	mustExec(t, db, `INSERT INTO credit_card_statements (card_id, user_id, period_start, period_end, due_date,
+		purchases_count, balance, paid_amount, bill_id) VALUES (?, ?, ?, ?, ?, 2, ?, ?, ?)`,
+		cardID, userID, start, end, due, balance, paid, billID)
+	return billID
+}
+
+func TestAdjustCardStatementKeepsTheBillInStep(t *testing.T) {
+	db := setupLedgerDB(t)
+	if err := EnsureVersionColumns(db); err != nil {
+		t.Fatalf("Failed to add version columns: %v", err)
+	}
+	if err := EnsureBillPaymentAmountColumns(db); err != nil {
+		t.Fatalf("Failed to add bill payment amount columns: %v", err)
+	}
+	mustExec(t, db, `CREATE TABLE credit_card_statements (id INTEGER PRIMARY KEY AUTOINCREMENT, card_id INTEGER, user_id TEXT,
+		period_start TEXT, period_end TEXT, due_date TEXT, purchases_count INTEGER NOT NULL DEFAULT 0,
+		balance REAL NOT NULL DEFAULT 0, paid_amount REAL NOT NULL DEFAULT 0, status TEXT NOT NULL DEFAULT 'open',
+		bill_id INTEGER, paid_at TEXT)`)
+
+	insertMovement(t, db, "income", "1", 1000, "2025-01-01", "bank")
+	billID := addCardStatement(t, db, "1", 1, "2025-01-01", "2025-01-31", "2025-02-10", 150, 0)
+	expectBalance(t, periodBalances(t, db, tableByPeriod("monthly"), "1"), "2025-02", 0, 850)
+
+	// Las compras ya no pueden caer en el ciclo cerrado, sí en el siguiente y en otra tarjeta
+	for _, check := range []struct {
+		cardID int64
+		date   string
+		want   error
+	}{{1, "2025-01-31", ErrCardCycleClosed}, {1, "2024-12-20", ErrCardCycleClosed}, {1, "2025-02-01", nil}, {2, "2025-01-15", nil}} {
+		if err := CheckCardPurchaseDate(db, check.cardID, check.date); err != check.want {
+			t.Errorf("Card %d on %s: expected %v, got %v", check.cardID, check.date, check.want, err)
+		}
+	}
+
+	// Una compra del ciclo baja de 80 a 30: el extracto y su factura reservan 50 menos
+	if err := AdjustCardStatementTx(db, "1", 1, "2025-01-15", -50, 0); err != nil {
+		t.Fatalf("Failed to adjust statement: %v", err)
+	}
+	var balance float64
+	var count int
+	var status string
+	db.QueryRow(`SELECT balance, purchases_count, status FROM credit_card_statements WHERE bill_id = ?`, billID).Scan(&balance, &count, &status)
+	if balance != 100 || count != 2 || status != "open" {
+		t.Errorf("Expected an open statement of 100 with 2 purchases, got %.2f, %d, %s", balance, count, status)
+	}
+	expectBalance(t, periodBalances(t, db, tableByPeriod("monthly"), "1"), "2025-02", 0, 900)
+
+	// Una compra del ciclo abierto no toca el extracto
+	if err := AdjustCardStatementTx(db, "1", 1, "2025-02-05", -30, -1); err != nil {
+		t.Fatalf("Failed to adjust the open cycle: %v", err)
+	}
+
+	// Sin compras el extracto y su factura quedan cerrados y dejan de reservar
+	for _, amount := range []float64{-30, -70} {
+		if err := AdjustCardStatementTx(db, "1", 1, "2025-01-20", amount, -1); err != nil {
+			t.Fatalf("Failed to adjust statement: %v", err)
+		}
+	}
+	var billPaid bool
+	db.QueryRow(`SELECT balance, purchases_count, status FROM credit_card_statements WHERE bill_id = ?`, billID).Scan(&balance, &count, &status)
+	db.QueryRow(`SELECT paid FROM bills WHERE id = ?`, billID).Scan(&billPaid)
+	if balance != 0 || count != 0 || status != "paid" || !billPaid {
+		t.Errorf("Expected an empty statement with its bill closed, got %.2f, %d, %s, bill paid %v", balance, count, status, billPaid)
+	}
+	expectBalance(t, periodBalances(t, db, tableByPeriod("monthly"), "1"), "2025-02", 0, 1000)
+
+	drifts, err := auditUserBalances(db, "1", false)
+	if err != nil || len(drifts) != 0 {
+		t.Errorf("Expected no drift after rebuilding the ledger, got %+v, %v", drifts, err)
+	}
+
+	// Con pagos el extracto ya no cambia
+	addCardStatement(t, db, "1", 1, "2025-02-01", "2025-02-28", "2025-03-10", 200, 20)
+	if err := AdjustCardStatementTx(db, "1", 1, "2025-02-14", -10, 0); err != ErrCardStatementPaid {
+		t.Errorf("Expected a statement with payments to be locked, got %v", err)
+	}
+}
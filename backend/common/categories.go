@@ -0,0 +1,54 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// categoryEmojis es el emoji de las categorías que se crean al enlazar un movimiento cuyo nombre
+// no existe todavía
+var categoryEmojis = map[string]string{"expense": "🛒", "income": "💰"}
+
+// EnsureCategoryIDColumn añade category_id a la tabla de movimientos (incomes o expenses).
+// Los errores de columna duplicada se ignoran.
+func EnsureCategoryIDColumn(db *sql.DB, table string) error {
+	_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN category_id INTEGER`, table))
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return fmt.Errorf("error adding category_id to %s: %v", table, err)
+	}
+	return nil
+}
+
+// ResolveCategoryID devuelve la categoría del usuario con ese nombre y tipo, sin distinguir
+// mayúsculas y prefiriendo las raíz. Si no existe se crea con ese nombre, para que el movimiento
+// no se quede fuera de los informes. Un nombre vacío, o una base de datos sin categorías,
+// devuelve NULL.
+func ResolveCategoryID(q DBTX, userID, categoryType, name string) (sql.NullInt64, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return sql.NullInt64{}, nil
+	}
+
+	var categoryID int64
+	err := q.QueryRow(`
+		SELECT id FROM categories
+		WHERE user_id = ? AND type = ? AND LOWER(name) = LOWER(?)
+		ORDER BY parent_id IS NOT NULL, id LIMIT 1
+	`, userID, categoryType, name).Scan(&categoryID)
+	if err == sql.ErrNoRows {
+		var result sql.Result
+		result, err = q.Exec(`INSERT INTO categories (user_id, name, type, emoji) VALUES (?, ?, ?, ?)`,
+			userID, name, categoryType, encodeCategoryEmoji(categoryEmojis[categoryType]))
+		if err == nil {
+			categoryID, err = result.LastInsertId()
+		}
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "no such") {
+			return sql.NullInt64{}, nil
+		}
+		return sql.NullInt64{}, fmt.Errorf("error resolving category %q: %v", name, err)
+	}
+	return sql.NullInt64{Int64: categoryID, Valid: true}, nil
+}
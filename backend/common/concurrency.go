@@ -0,0 +1,56 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrVersionConflict indica que la fila cambió desde que el cliente la leyó
+var ErrVersionConflict = errors.New("version conflict: the record was modified by another request")
+
+// VersionedTables son las tablas cuyas filas llevan version para el control de concurrencia
+// optimista. Toda escritura que cambia una fila sube su versión (version = COALESCE(version, 1) + 1)
+// para que las ETag ya entregadas dejen de valer.
+var VersionedTables = []string{"incomes", "expenses", "bills", "categories"}
+
+// EnsureVersionColumns añade la columna version a las tablas versionadas. Las versiones
+// empiezan en 1; las tablas que todavía no ha creado su servicio se ignoran.
+func EnsureVersionColumns(db *sql.DB) error {
+	for _, table := range VersionedTables {
+		_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN version INTEGER NOT NULL DEFAULT 1`, table))
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") && !strings.Contains(err.Error(), "no such table") {
+			return fmt.Errorf("error adding version column to %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// ETag devuelve la etiqueta de entidad correspondiente a la versión de una fila
+func ETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// ExpectedVersion devuelve la versión que el cliente espera modificar. La cabecera If-Match
+// tiene prioridad sobre el campo version del cuerpo; ok es false si no hay precondición.
+func ExpectedVersion(r *http.Request, bodyVersion int) (version int, ok bool, err error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch != "" && ifMatch != "*" {
+		tag := strings.TrimPrefix(ifMatch, "W/")
+		tag = strings.Trim(tag, `"`)
+		version, err = strconv.Atoi(tag)
+		if err != nil || version <= 0 {
+			return 0, false, fmt.Errorf("invalid If-Match header: %s", ifMatch)
+		}
+		return version, true, nil
+	}
+
+	if bodyVersion > 0 {
+		return bodyVersion, true, nil
+	}
+
+	return 0, false, nil
+}
@@ -0,0 +1,371 @@
+package common
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultCategoriesDirEnv permite apuntar a otro directorio con los conjuntos de categorías
+const DefaultCategoriesDirEnv = "HERO_BUDGET_DEFAULT_CATEGORIES_DIR"
+
+// DefaultCategoriesLanguage es el idioma que se usa cuando no hay fichero para el locale del usuario
+const DefaultCategoriesLanguage = "en"
+
+// DefaultCategory es una categoría del conjunto por defecto. Key la identifica entre idiomas y versiones.
+type DefaultCategory struct {
+	Key   string `json:"key"`
+	Name  string `json:"name"`
+	Emoji string `json:"emoji"`
+}
+
+// DefaultCategorySet es el contenido de default_categories/<idioma>.json.
+// Version se incrementa cada vez que se publica un cambio en el conjunto.
+type DefaultCategorySet struct {
+	Version  int               `json:"version"`
+	Language string            `json:"language"`
+	Income   []DefaultCategory `json:"income"`
+	Expense  []DefaultCategory `json:"expense"`
+}
+
+// DefaultCategoriesResult resume lo que se ha hecho con las categorías por defecto de un usuario
+type DefaultCategoriesResult struct {
+	Language string `json:"language"`
+	Version  int    `json:"version"`
+	Added    int    `json:"added"`    // Categorías creadas
+	Linked   int    `json:"linked"`   // Categorías del usuario con el mismo nombre que pasan a ser la versión por defecto
+	Updated  int    `json:"updated"`  // Categorías no renombradas actualizadas al nuevo conjunto
+	Restored int    `json:"restored"` // Categorías renombradas devueltas a su nombre y emoji por defecto
+}
+
+// DefaultCategoriesUpdateSummary resume la publicación de un conjunto nuevo a todos los usuarios
+type DefaultCategoriesUpdateSummary struct {
+	Users   int `json:"users"`   // Usuarios actualizados
+	Skipped int `json:"skipped"` // Usuarios que ya tenían la última versión
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+}
+
+// DefaultCategoriesDir devuelve el directorio con los conjuntos por idioma. Los servicios se
+// ejecutan desde su propia carpeta, así que por defecto es ../default_categories.
+func DefaultCategoriesDir() string {
+	if dir := os.Getenv(DefaultCategoriesDirEnv); dir != "" {
+		return dir
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return filepath.Join("..", "default_categories")
+	}
+	return filepath.Join(cwd, "..", "default_categories")
+}
+
+// DefaultCategoryLanguage normaliza un locale ("es-ES", "pt_BR") a su código de idioma
+func DefaultCategoryLanguage(locale string) string {
+	lang := strings.ToLower(strings.TrimSpace(locale))
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+	if lang == "" {
+		return DefaultCategoriesLanguage
+	}
+	return lang
+}
+
+// LoadDefaultCategorySet lee el conjunto del idioma del locale, o el inglés si no existe
+func LoadDefaultCategorySet(locale string) (*DefaultCategorySet, error) {
+	dir := DefaultCategoriesDir()
+	lang := DefaultCategoryLanguage(locale)
+
+	data, err := os.ReadFile(filepath.Join(dir, lang+".json"))
+	if os.IsNotExist(err) && lang != DefaultCategoriesLanguage {
+		data, err = os.ReadFile(filepath.Join(dir, DefaultCategoriesLanguage+".json"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading default categories for '%s': %v", lang, err)
+	}
+
+	var set DefaultCategorySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("error parsing default categories for '%s': %v", lang, err)
+	}
+	return &set, nil
+}
+
+// EnsureDefaultCategoryTables prepara la tabla de categorías para los conjuntos por defecto.
+// default_name y default_emoji guardan lo que se sembró, para saber si el usuario lo ha cambiado;
+// user_default_categories recuerda qué claves se le dieron ya a cada usuario, para no volver a
+// crear las que haya borrado.
+func EnsureDefaultCategoryTables(q DBTX) error {
+	if _, err := q.Exec(`CREATE TABLE IF NOT EXISTS categories (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		emoji TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return err
+	}
+
+	// Se ignoran los errores de columna duplicada
+	q.Exec(`ALTER TABLE categories ADD COLUMN default_key TEXT`)
+	q.Exec(`ALTER TABLE categories ADD COLUMN default_name TEXT`)
+	q.Exec(`ALTER TABLE categories ADD COLUMN default_emoji TEXT`)
+	q.Exec(`ALTER TABLE categories ADD COLUMN version INTEGER NOT NULL DEFAULT 1`)
+
+	if _, err := q.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_categories_default_key
+		ON categories (user_id, type, default_key) WHERE default_key IS NOT NULL`); err != nil {
+		return err
+	}
+
+	_, err := q.Exec(`CREATE TABLE IF NOT EXISTS user_default_categories (
+		user_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		key TEXT NOT NULL,
+		language TEXT NOT NULL,
+		applied_version INTEGER NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, type, key)
+	)`)
+	return err
+}
+
+// SeedDefaultCategories crea las categorías por defecto de un usuario nuevo en su idioma.
+// Es idempotente: las categorías que ya existen con el mismo nombre se enlazan en lugar de duplicarse.
+func SeedDefaultCategories(db *sql.DB, userID, locale string) (*DefaultCategoriesResult, error) {
+	set, err := LoadDefaultCategorySet(locale)
+	if err != nil {
+		return nil, err
+	}
+	return applyDefaultCategorySetTx(db, userID, set, false)
+}
+
+// ResetDefaultCategories vuelve a crear las categorías por defecto que el usuario haya borrado y
+// devuelve su nombre y emoji originales a las que haya cambiado. Las categorías propias no se tocan.
+func ResetDefaultCategories(db *sql.DB, userID, locale string) (*DefaultCategoriesResult, error) {
+	set, err := LoadDefaultCategorySet(locale)
+	if err != nil {
+		return nil, err
+	}
+	return applyDefaultCategorySetTx(db, userID, set, true)
+}
+
+// ApplyDefaultCategoryUpdates publica los conjuntos actuales a los usuarios que ya recibieron una
+// versión anterior. Solo se actualizan las categorías que el usuario no ha renombrado, se añaden las
+// claves nuevas y no se recrean las que haya borrado.
+func ApplyDefaultCategoryUpdates(db *sql.DB) (*DefaultCategoriesUpdateSummary, error) {
+	if err := EnsureDefaultCategoryTables(db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT u.id, COALESCE(u.locale, '') FROM users u
+		WHERE EXISTS (SELECT 1 FROM user_default_categories d WHERE d.user_id = CAST(u.id AS TEXT))
+	`)
+	if err != nil {
+		return nil, err
+	}
+	type seededUser struct {
+		id     string
+		locale string
+	}
+	var users []seededUser
+	for rows.Next() {
+		var id int64
+		var locale string
+		if err := rows.Scan(&id, &locale); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, seededUser{strconv.FormatInt(id, 10), locale})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	summary := &DefaultCategoriesUpdateSummary{}
+	sets := map[string]*DefaultCategorySet{}
+	for _, user := range users {
+		lang := DefaultCategoryLanguage(user.locale)
+		set, ok := sets[lang]
+		if !ok {
+			if set, err = LoadDefaultCategorySet(user.locale); err != nil {
+				return summary, err
+			}
+			sets[lang] = set
+		}
+
+		var outdated int
+		if err := db.QueryRow(`
+			SELECT COUNT(*) FROM user_default_categories
+			WHERE user_id = ? AND (applied_version < ? OR language != ?)
+		`, user.id, set.Version, set.Language).Scan(&outdated); err != nil {
+			return summary, err
+		}
+		if outdated == 0 {
+			summary.Skipped++
+			continue
+		}
+
+		result, err := applyDefaultCategorySetTx(db, user.id, set, false)
+		if err != nil {
+			return summary, fmt.Errorf("error updating default categories for user %s: %v", user.id, err)
+		}
+		summary.Users++
+		summary.Added += result.Added + result.Linked
+		summary.Updated += result.Updated
+	}
+	return summary, nil
+}
+
+func applyDefaultCategorySetTx(db *sql.DB, userID string, set *DefaultCategorySet, reset bool) (*DefaultCategoriesResult, error) {
+	if err := EnsureDefaultCategoryTables(db); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := applyDefaultCategorySet(tx, userID, set, reset)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func applyDefaultCategorySet(q DBTX, userID string, set *DefaultCategorySet, reset bool) (*DefaultCategoriesResult, error) {
+	result := &DefaultCategoriesResult{Language: set.Language, Version: set.Version}
+
+	groups := []struct {
+		categoryType string
+		categories   []DefaultCategory
+	}{
+		{"income", set.Income},
+		{"expense", set.Expense},
+	}
+
+	for _, group := range groups {
+		for _, def := range group.categories {
+			if err := applyDefaultCategory(q, userID, group.categoryType, def, reset, result); err != nil {
+				return nil, fmt.Errorf("error applying default category '%s': %v", def.Key, err)
+			}
+			if _, err := q.Exec(`
+				INSERT INTO user_default_categories (user_id, type, key, language, applied_version, applied_at)
+				VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+				ON CONFLICT (user_id, type, key) DO UPDATE SET
+					language = excluded.language,
+					applied_version = excluded.applied_version,
+					applied_at = excluded.applied_at
+			`, userID, group.categoryType, def.Key, set.Language, set.Version); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func applyDefaultCategory(q DBTX, userID, categoryType string, def DefaultCategory, reset bool, result *DefaultCategoriesResult) error {
+	emoji := encodeCategoryEmoji(def.Emoji)
+
+	var id int
+	var name, currentEmoji, defaultName, defaultEmoji string
+	err := q.QueryRow(`
+		SELECT id, name, emoji, COALESCE(default_name, ''), COALESCE(default_emoji, '')
+		FROM categories WHERE user_id = ? AND type = ? AND default_key = ?
+	`, userID, categoryType, def.Key).Scan(&id, &name, &currentEmoji, &defaultName, &defaultEmoji)
+
+	if err == nil {
+		newName, newEmoji := name, currentEmoji
+		if reset || name == defaultName {
+			newName = def.Name
+		}
+		if reset || currentEmoji == defaultEmoji {
+			newEmoji = emoji
+		}
+		if _, err := q.Exec(`
+			UPDATE categories SET name = ?, emoji = ?, default_name = ?, default_emoji = ?,
+			    version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`, newName, newEmoji, def.Name, emoji, id); err != nil {
+			return err
+		}
+		if newName != name || newEmoji != currentEmoji {
+			if reset && (name != defaultName || currentEmoji != defaultEmoji) {
+				result.Restored++
+			} else {
+				result.Updated++
+			}
+		}
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	// Sin categoría enlazada: si ya se le dio esta clave, el usuario la borró y solo el reset la recrea
+	if !reset {
+		var applied int
+		err := q.QueryRow(`SELECT COUNT(*) FROM user_default_categories WHERE user_id = ? AND type = ? AND key = ?`,
+			userID, categoryType, def.Key).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			return nil
+		}
+	}
+
+	// Una categoría propia con el mismo nombre pasa a ser la versión por defecto. Se guarda el
+	// nombre y el emoji del conjunto, así que lo que el usuario eligió cuenta como personalizado.
+	err = q.QueryRow(`
+		SELECT id FROM categories
+		WHERE user_id = ? AND type = ? AND LOWER(name) = LOWER(?) AND default_key IS NULL
+		ORDER BY id LIMIT 1
+	`, userID, categoryType, def.Name).Scan(&id)
+	if err == nil {
+		_, err = q.Exec(`UPDATE categories SET default_key = ?, default_name = ?, default_emoji = ? WHERE id = ?`,
+			def.Key, def.Name, emoji, id)
+		if err == nil {
+			result.Linked++
+		}
+		return err
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	if _, err := q.Exec(`
+		INSERT INTO categories (user_id, name, type, emoji, default_key, default_name, default_emoji)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, userID, def.Name, categoryType, emoji, def.Key, def.Name, emoji); err != nil {
+		return err
+	}
+	result.Added++
+	return nil
+}
+
+// encodeCategoryEmoji guarda los emojis igual que categories_management: "BASE64:" + base64 del UTF-8
+func encodeCategoryEmoji(emoji string) string {
+	if emoji == "" {
+		return "📊"
+	}
+	for _, r := range emoji {
+		if r > 127 {
+			return "BASE64:" + base64.StdEncoding.EncodeToString([]byte(emoji))
+		}
+	}
+	return emoji
+}
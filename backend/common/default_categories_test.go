@@ -0,0 +1,235 @@
+package common
+
+import (
+	"database/sql"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Las copias de google_auth se regeneran también con go generate ./common
+//go:generate go test -run TestGoogleAuth -update
+
+var updateGoogleAuthCopy = flag.Bool("update", false, "regenerate the copies of common in google_auth")
+
+// googleAuthCopyPath es la copia de default_categories.go que usa google_auth, que es un módulo
+// aparte y no puede importar common
+const googleAuthCopyPath = "../google_auth/default_categories.go"
+
+// googleAuthCopy genera la copia de google_auth a partir de este paquete: el mismo código en
+// package main, más la interfaz DBTX que aquí vive en period_balance.go
+func googleAuthCopy(source string) string {
+	return `// Code generated from common/default_categories.go; DO NOT EDIT.
+// google_auth es un módulo aparte y no puede importar common. Para regenerarlo:
+//
+//	go test ./common -run TestGoogleAuthDefaultCategoriesCopy -update
+
+` + strings.Replace(source, "package common\n", "package main\n", 1) + `
+// DBTX es lo que tienen en común *sql.DB y *sql.Tx, como en common
+type DBTX interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+`
+}
+
+// checkGoogleAuthCopy compara la copia de google_auth con la que se genera ahora, y la
+// reescribe antes con -update
+func checkGoogleAuthCopy(t *testing.T, path, want, testName string) {
+	t.Helper()
+	if *updateGoogleAuthCopy {
+		if err := os.WriteFile(path, []byte(want), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	if string(got) != want {
+		t.Errorf("%s is out of date; regenerate it with go test ./common -run %s -update", path, testName)
+	}
+}
+
+func TestGoogleAuthDefaultCategoriesCopy(t *testing.T) {
+	source, err := os.ReadFile("default_categories.go")
+	if err != nil {
+		t.Fatalf("Failed to read default_categories.go: %v", err)
+	}
+	checkGoogleAuthCopy(t, googleAuthCopyPath, googleAuthCopy(string(source)), "TestGoogleAuthDefaultCategoriesCopy")
+}
+
+// google_auth también guarda la zona horaria del dispositivo al crear el usuario
+func TestGoogleAuthTimezoneCopy(t *testing.T) {
+	source, err := os.ReadFile("timezone.go")
+	if err != nil {
+		t.Fatalf("Failed to read timezone.go: %v", err)
+	}
+	want := `// Code generated from common/timezone.go; DO NOT EDIT.
+// google_auth es un módulo aparte y no puede importar common. Para regenerarlo:
+//
+//	go test ./common -run TestGoogleAuthTimezoneCopy -update
+
+` + strings.Replace(string(source), "package common\n", "package main\n", 1)
+	checkGoogleAuthCopy(t, "../google_auth/timezone.go", want, "TestGoogleAuthTimezoneCopy")
+}
+
+// setupDefaultCategoriesDB crea una base de datos con usuarios y un directorio de conjuntos
+// en inglés y español
+func setupDefaultCategoriesDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv(DefaultCategoriesDirEnv, dir)
+	writeDefaultCategorySet(t, "en", `{"version": 1, "language": "en",
+		"income": [{"key": "salary", "name": "Salary", "emoji": "💼"}],
+		"expense": [{"key": "food", "name": "Food", "emoji": "🍔"}, {"key": "transport", "name": "Transport", "emoji": "🚗"}]}`)
+	writeDefaultCategorySet(t, "es", `{"version": 1, "language": "es",
+		"income": [{"key": "salary", "name": "Salario", "emoji": "💼"}],
+		"expense": [{"key": "food", "name": "Comida", "emoji": "🍔"}, {"key": "transport", "name": "Transporte", "emoji": "🚗"}]}`)
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	mustExec(t, db, `CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, locale TEXT)`)
+	mustExec(t, db, `INSERT INTO users (locale) VALUES ('es-ES'), ('fr'), ('es')`)
+	if err := EnsureDefaultCategoryTables(db); err != nil {
+		t.Fatalf("Failed to create default category tables: %v", err)
+	}
+	return db
+}
+
+func writeDefaultCategorySet(t *testing.T, lang, content string) {
+	t.Helper()
+	path := filepath.Join(os.Getenv(DefaultCategoriesDirEnv), lang+".json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// userCategories devuelve "tipo/nombre" de las categorías del usuario, ordenadas
+func userCategories(t *testing.T, db *sql.DB, userID string) string {
+	t.Helper()
+	var names sql.NullString
+	err := db.QueryRow(`
+		SELECT GROUP_CONCAT(type || '/' || name, ', ') FROM (
+			SELECT type, name FROM categories WHERE user_id = ? ORDER BY type, name
+		)
+	`, userID).Scan(&names)
+	if err != nil {
+		t.Fatalf("Failed to read categories: %v", err)
+	}
+	return names.String
+}
+
+func TestSeedDefaultCategoriesInTheUserLanguage(t *testing.T) {
+	db := setupDefaultCategoriesDB(t)
+
+	// Una categoría propia con el nombre de una por defecto se enlaza en lugar de duplicarse
+	mustExec(t, db, `INSERT INTO categories (user_id, name, type, emoji) VALUES ('1', 'comida', 'expense', '🥗')`)
+
+	result, err := SeedDefaultCategories(db, "1", "es-ES")
+	if err != nil {
+		t.Fatalf("Failed to seed categories: %v", err)
+	}
+	if result.Language != "es" || result.Added != 2 || result.Linked != 1 {
+		t.Errorf("Expected 2 added and 1 linked in Spanish, got %+v", result)
+	}
+	if got := userCategories(t, db, "1"); got != "expense/Transporte, expense/comida, income/Salario" {
+		t.Errorf("Unexpected categories: %s", got)
+	}
+	var emoji string
+	db.QueryRow(`SELECT emoji FROM categories WHERE user_id = '1' AND name = 'Transporte'`).Scan(&emoji)
+	if emoji != encodeCategoryEmoji("🚗") {
+		t.Errorf("Expected the emoji stored as categories_management does, got %s", emoji)
+	}
+
+	// Sembrar otra vez no cambia nada
+	result, err = SeedDefaultCategories(db, "1", "es-ES")
+	if err != nil || result.Added+result.Linked+result.Updated != 0 {
+		t.Errorf("Expected seeding again to do nothing, got %+v, %v", result, err)
+	}
+
+	// Sin fichero para el idioma se usa el inglés
+	result, err = SeedDefaultCategories(db, "2", "fr")
+	if err != nil || result.Language != "en" || result.Added != 3 {
+		t.Errorf("Expected the English set for French, got %+v, %v", result, err)
+	}
+}
+
+func TestResetDefaultCategoriesRestoresRenamedAndDeleted(t *testing.T) {
+	db := setupDefaultCategoriesDB(t)
+	if _, err := SeedDefaultCategories(db, "1", "es"); err != nil {
+		t.Fatalf("Failed to seed categories: %v", err)
+	}
+
+	mustExec(t, db, `UPDATE categories SET name = 'Coche' WHERE user_id = '1' AND default_key = 'transport'`)
+	mustExec(t, db, `DELETE FROM categories WHERE user_id = '1' AND default_key = 'salary'`)
+	mustExec(t, db, `INSERT INTO categories (user_id, name, type, emoji) VALUES ('1', 'Gimnasio', 'expense', '🏋️')`)
+
+	// Sembrar no recrea lo borrado ni deshace el cambio de nombre
+	result, err := SeedDefaultCategories(db, "1", "es")
+	if err != nil || result.Added+result.Updated+result.Restored != 0 {
+		t.Errorf("Expected seeding to respect the user's changes, got %+v, %v", result, err)
+	}
+
+	result, err = ResetDefaultCategories(db, "1", "es")
+	if err != nil {
+		t.Fatalf("Failed to reset categories: %v", err)
+	}
+	if result.Added != 1 || result.Restored != 1 || result.Updated != 0 {
+		t.Errorf("Expected 1 added and 1 restored, got %+v", result)
+	}
+	// Las categorías propias no se tocan
+	if got := userCategories(t, db, "1"); got != "expense/Comida, expense/Gimnasio, expense/Transporte, income/Salario" {
+		t.Errorf("Unexpected categories after reset: %s", got)
+	}
+}
+
+func TestApplyDefaultCategoryUpdatesPublishesNewVersions(t *testing.T) {
+	db := setupDefaultCategoriesDB(t)
+	for _, user := range []struct{ id, locale string }{{"1", "es-ES"}, {"2", "fr"}} {
+		if _, err := SeedDefaultCategories(db, user.id, user.locale); err != nil {
+			t.Fatalf("Failed to seed categories: %v", err)
+		}
+	}
+	mustExec(t, db, `UPDATE categories SET name = 'Coche' WHERE user_id = '1' AND default_key = 'transport'`)
+	mustExec(t, db, `DELETE FROM categories WHERE user_id = '1' AND default_key = 'salary'`)
+
+	// Nueva versión del conjunto español: un nombre cambiado y una clave nueva
+	writeDefaultCategorySet(t, "es", `{"version": 2, "language": "es",
+		"income": [{"key": "salary", "name": "Nómina", "emoji": "💼"}],
+		"expense": [{"key": "food", "name": "Alimentación", "emoji": "🍔"},
+			{"key": "transport", "name": "Transporte público", "emoji": "🚌"},
+			{"key": "health", "name": "Salud", "emoji": "💊"}]}`)
+
+	summary, err := ApplyDefaultCategoryUpdates(db)
+	if err != nil {
+		t.Fatalf("Failed to apply updates: %v", err)
+	}
+	// El usuario 3 nunca recibió categorías y el 2 ya tiene la última versión en inglés
+	// Comida cambia de nombre y Coche solo de emoji, que el usuario no había cambiado
+	if summary.Users != 1 || summary.Skipped != 1 || summary.Added != 1 || summary.Updated != 2 {
+		t.Errorf("Expected one user updated with 1 added and 2 updated, got %+v", summary)
+	}
+	var emoji string
+	db.QueryRow(`SELECT emoji FROM categories WHERE user_id = '1' AND name = 'Coche'`).Scan(&emoji)
+	if emoji != encodeCategoryEmoji("🚌") {
+		t.Errorf("Expected the renamed category to get the new emoji, got %s", emoji)
+	}
+	// Solo cambia lo que el usuario no había tocado, y lo borrado no vuelve
+	if got := userCategories(t, db, "1"); got != "expense/Alimentación, expense/Coche, expense/Salud" {
+		t.Errorf("Unexpected categories after the update: %s", got)
+	}
+
+	// Publicar otra vez la misma versión no hace nada
+	summary, err = ApplyDefaultCategoryUpdates(db)
+	if err != nil || summary.Users != 0 || summary.Skipped != 2 {
+		t.Errorf("Expected every user to be up to date, got %+v, %v", summary, err)
+	}
+}
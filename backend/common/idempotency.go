@@ -0,0 +1,220 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IdempotencyHeader es la cabecera con la que el cliente identifica un reintento
+const IdempotencyHeader = "Idempotency-Key"
+
+// IdempotencyTTL es el tiempo durante el que se conserva la respuesta original
+const IdempotencyTTL = 24 * time.Hour
+
+// IdempotencyLease es lo que puede durar una reserva sin respuesta. Pasado ese tiempo se da por
+// abandonada (el proceso se cayó a mitad de la escritura) y un reintento puede volver a tomarla.
+const IdempotencyLease = 60 * time.Second
+
+// idempotencyTimeFormat es el formato de created_at y reserved_at, en UTC como CURRENT_TIMESTAMP
+const idempotencyTimeFormat = "2006-01-02 15:04:05"
+
+// EnsureIdempotencyTable crea la tabla donde se guardan las respuestas por usuario y clave
+func EnsureIdempotencyTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			user_id TEXT NOT NULL,
+			idempotency_key TEXT NOT NULL,
+			endpoint TEXT NOT NULL,
+			request_hash TEXT NOT NULL,
+			status_code INTEGER,
+			response_body TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			reserved_at TIMESTAMP,
+			PRIMARY KEY (user_id, idempotency_key)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	// Las tablas creadas antes de las reservas con plazo no tienen reserved_at
+	_, err = db.Exec(`ALTER TABLE idempotency_keys ADD COLUMN reserved_at TIMESTAMP`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return err
+	}
+	return nil
+}
+
+// idempotencyRecorder captura el estado y el cuerpo de la respuesta mientras se escribe al cliente
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// WithIdempotency envuelve un handler de escritura para que respete la cabecera Idempotency-Key.
+// La primera respuesta (estado y cuerpo) se guarda por usuario y clave durante 24 horas y los
+// reintentos la reciben sin volver a ejecutar la escritura. Reutilizar la clave con otro cuerpo
+// o en otro endpoint devuelve 422. Mientras la primera petición se ejecuta los reintentos reciben
+// 409; si no responde en IdempotencyLease la reserva caduca. Sin cabecera, el handler se ejecuta
+// con normalidad.
+func WithIdempotency(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyHeader)
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeIdempotencyError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// El user_id del cuerpo delimita el espacio de claves de cada usuario
+		var owner struct {
+			UserID string `json:"user_id"`
+		}
+		if err := json.Unmarshal(body, &owner); err != nil || owner.UserID == "" {
+			next(w, r)
+			return
+		}
+
+		sum := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(sum[:])
+
+		// Purga perezosa de claves caducadas de este usuario
+		now := time.Now().UTC()
+		cutoff := now.Add(-IdempotencyTTL).Format(idempotencyTimeFormat)
+		if _, err := db.Exec(`DELETE FROM idempotency_keys WHERE user_id = ? AND created_at < ?`, owner.UserID, cutoff); err != nil {
+			log.Printf("Error purging expired idempotency keys: %v", err)
+		}
+
+		var storedEndpoint, storedHash, storedBody sql.NullString
+		var storedStatus sql.NullInt64
+		err = db.QueryRow(`
+			SELECT endpoint, request_hash, status_code, response_body
+			FROM idempotency_keys
+			WHERE user_id = ? AND idempotency_key = ?
+		`, owner.UserID, key).Scan(&storedEndpoint, &storedHash, &storedStatus, &storedBody)
+
+		reserved := false
+		switch {
+		case err == nil:
+			if storedEndpoint.String != r.URL.Path {
+				writeIdempotencyError(w, http.StatusUnprocessableEntity,
+					"Idempotency-Key was already used with a different endpoint")
+				return
+			}
+			if storedHash.String != requestHash {
+				writeIdempotencyError(w, http.StatusUnprocessableEntity,
+					"Idempotency-Key was already used with a different request body")
+				return
+			}
+			if !storedStatus.Valid {
+				// Una reserva caducada se vuelve a tomar, una sola petición a la vez
+				result, err := db.Exec(`
+					UPDATE idempotency_keys SET reserved_at = ?
+					WHERE user_id = ? AND idempotency_key = ? AND status_code IS NULL
+						AND COALESCE(reserved_at, created_at) < ?
+				`, now.Format(idempotencyTimeFormat), owner.UserID, key, now.Add(-IdempotencyLease).Format(idempotencyTimeFormat))
+				if err == nil {
+					if affected, err := result.RowsAffected(); err == nil && affected == 1 {
+						log.Printf("Reclaiming abandoned idempotency key %s (user %s)", key, owner.UserID)
+						reserved = true
+						break
+					}
+				}
+				writeIdempotencyError(w, http.StatusConflict,
+					"A request with this Idempotency-Key is still being processed")
+				return
+			}
+			log.Printf("Replaying stored response for idempotency key %s (user %s)", key, owner.UserID)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(int(storedStatus.Int64))
+			w.Write([]byte(storedBody.String))
+			return
+		case err != sql.ErrNoRows:
+			log.Printf("Error looking up idempotency key: %v", err)
+			writeIdempotencyError(w, http.StatusInternalServerError, "Error checking Idempotency-Key")
+			return
+		}
+
+		// Reservar la clave antes de ejecutar la escritura para bloquear reintentos concurrentes
+		if !reserved {
+			_, err = db.Exec(`
+				INSERT INTO idempotency_keys (user_id, idempotency_key, endpoint, request_hash, created_at, reserved_at)
+				VALUES (?, ?, ?, ?, ?, ?)
+			`, owner.UserID, key, r.URL.Path, requestHash, now.Format(idempotencyTimeFormat), now.Format(idempotencyTimeFormat))
+			if err != nil {
+				writeIdempotencyError(w, http.StatusConflict,
+					"A request with this Idempotency-Key is still being processed")
+				return
+			}
+		}
+
+		release := func() {
+			if _, err := db.Exec(`DELETE FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ?`, owner.UserID, key); err != nil {
+				log.Printf("Error releasing idempotency key: %v", err)
+			}
+		}
+
+		// Si el handler entra en pánico la reserva se libera antes de propagarlo
+		defer func() {
+			if p := recover(); p != nil {
+				release()
+				panic(p)
+			}
+		}()
+
+		recorder := &idempotencyRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		// Los errores del servidor no se guardan para que el cliente pueda reintentar
+		if recorder.status == 0 || recorder.status >= http.StatusInternalServerError {
+			release()
+			return
+		}
+
+		_, err = db.Exec(`
+			UPDATE idempotency_keys SET status_code = ?, response_body = ?
+			WHERE user_id = ? AND idempotency_key = ?
+		`, recorder.status, recorder.body.String(), owner.UserID, key)
+		if err != nil {
+			log.Printf("Error storing idempotent response: %v", err)
+		}
+	}
+}
+
+func writeIdempotencyError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"message": message,
+	})
+}
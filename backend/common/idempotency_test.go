@@ -0,0 +1,172 @@
+package common
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestWithIdempotencyReplaysFirstResponse(t *testing.T) {
+	db := openTestDB(t)
+	if err := EnsureIdempotencyTable(db); err != nil {
+		t.Fatalf("Failed to create idempotency table: %v", err)
+	}
+
+	calls := 0
+	handler := WithIdempotency(db, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"success":true,"data":{"id":1}}`))
+	})
+
+	sendTo := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set(IdempotencyHeader, "retry-1")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	send := func(body string) *httptest.ResponseRecorder {
+		return sendTo("/expenses/add", body)
+	}
+
+	body := `{"user_id":"user-1","amount":10}`
+	first := send(body)
+	second := send(body)
+
+	if calls != 1 {
+		t.Fatalf("Expected handler to run once, ran %d times", calls)
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Errorf("Expected replay %d %q, got %d %q", first.Code, first.Body.String(), second.Code, second.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected replayed response to be flagged")
+	}
+
+	mismatch := send(`{"user_id":"user-1","amount":20}`)
+	if mismatch.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a different body, got %d", mismatch.Code)
+	}
+
+	// The same key and body on another endpoint must not replay the expense
+	otherEndpoint := sendTo("/incomes/add", body)
+	if otherEndpoint.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a different endpoint, got %d", otherEndpoint.Code)
+	}
+	if calls != 1 {
+		t.Errorf("Expected handler not to run for a mismatched request, ran %d times", calls)
+	}
+}
+
+func TestWithIdempotencyDoesNotStoreServerErrors(t *testing.T) {
+	db := openTestDB(t)
+	if err := EnsureIdempotencyTable(db); err != nil {
+		t.Fatalf("Failed to create idempotency table: %v", err)
+	}
+
+	calls := 0
+	handler := WithIdempotency(db, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/incomes/add", bytes.NewBufferString(`{"user_id":"user-1"}`))
+		req.Header.Set(IdempotencyHeader, "retry-2")
+		handler(httptest.NewRecorder(), req)
+	}
+
+	if calls != 2 {
+		t.Errorf("Expected failed request to be retried, handler ran %d times", calls)
+	}
+}
+
+func TestWithIdempotencyReclaimsAbandonedReservations(t *testing.T) {
+	db := openTestDB(t)
+	if err := EnsureIdempotencyTable(db); err != nil {
+		t.Fatalf("Failed to create idempotency table: %v", err)
+	}
+
+	var handler http.HandlerFunc
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/expenses/add", bytes.NewBufferString(`{"user_id":"user-1"}`))
+		req.Header.Set(IdempotencyHeader, "retry-3")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	calls := 0
+	var inFlight, reclaimed int
+	handler = WithIdempotency(db, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			// A retry while the first request is running waits for it
+			inFlight = send().Code
+			// Once the lease is over the reservation is taken as abandoned
+			stale := time.Now().Add(-2 * IdempotencyLease).UTC().Format(idempotencyTimeFormat)
+			if _, err := db.Exec(`UPDATE idempotency_keys SET reserved_at = ?`, stale); err != nil {
+				t.Errorf("Failed to age the reservation: %v", err)
+			}
+			reclaimed = send().Code
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	send()
+	if inFlight != http.StatusConflict {
+		t.Errorf("Expected 409 while the reservation is held, got %d", inFlight)
+	}
+	if reclaimed != http.StatusCreated || calls != 2 {
+		t.Errorf("Expected the abandoned reservation to be reclaimed, got %d after %d calls", reclaimed, calls)
+	}
+}
+
+func TestWithIdempotencyReleasesTheKeyOnPanic(t *testing.T) {
+	db := openTestDB(t)
+	if err := EnsureIdempotencyTable(db); err != nil {
+		t.Fatalf("Failed to create idempotency table: %v", err)
+	}
+
+	calls := 0
+	handler := WithIdempotency(db, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	send := func() (code int, recovered interface{}) {
+		defer func() { recovered = recover() }()
+		req := httptest.NewRequest(http.MethodPost, "/expenses/add", bytes.NewBufferString(`{"user_id":"user-1"}`))
+		req.Header.Set(IdempotencyHeader, "retry-4")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code, nil
+	}
+
+	if _, recovered := send(); recovered != "boom" {
+		t.Fatalf("Expected the panic to reach the caller, got %v", recovered)
+	}
+	if code, _ := send(); code != http.StatusCreated || calls != 2 {
+		t.Errorf("Expected the retry to run after the panic, got %d after %d calls", code, calls)
+	}
+}
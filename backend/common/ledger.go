@@ -0,0 +1,553 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Orígenes de los asientos del libro de saldos: la tabla de la que sale cada movimiento
+const (
+	LedgerSourceIncome          = "income"
+	LedgerSourceExpense         = "expense"
+	LedgerSourceBill            = "bill" // facturas sin calendario de pagos (las de lotes anteriores)
+	LedgerSourceBillPayment     = "bill_payment"
+	LedgerSourceLoanInstallment = "loan_installment"
+	LedgerSourceCardStatement   = "card_statement"
+	LedgerSourceTransfer        = "transfer"
+	LedgerSourceAdjustment      = "adjustment" // correcciones manuales del saldo de caja o banco
+)
+
+// Tipos de asiento. Cada uno se proyecta en la columna <tipo>_<método>_amount de las tablas
+// *_cash_bank_balance; las facturas pendientes reservan su importe en bill_* solo en la tabla mensual.
+// Los traspasos llevan signo: un asiento negativo en la cuenta de origen y otro positivo en la de destino.
+// Los ajustes también: la diferencia entre el saldo que indica el usuario y el calculado.
+const (
+	LedgerIncome      = "income"
+	LedgerExpense     = "expense"
+	LedgerBill        = "bill"
+	LedgerPendingBill = "pending_bill"
+	LedgerCardPayment = "card_payment"
+	LedgerTransfer    = "transfer"
+	LedgerAdjustment  = "adjustment"
+)
+
+// Tipos de cash_bank_transactions que son traspasos entre caja y banco
+const (
+	TransferCashToBank = "cash_to_bank"
+	TransferBankToCash = "bank_to_cash"
+)
+
+// Tipos de cash_bank_transactions que son ajustes manuales del saldo, con la diferencia con signo
+const (
+	AdjustmentCash = "cash_adjustment"
+	AdjustmentBank = "bank_adjustment"
+)
+
+// LedgerEntry es un movimiento de caja o banco del libro balance_ledger. Las seis tablas de
+// saldos por periodo son una proyección de estos asientos.
+type LedgerEntry struct {
+	SourceType    string
+	SourceID      int64
+	Date          time.Time
+	Kind          string
+	PaymentMethod string
+	Amount        float64
+}
+
+// LedgerChange sustituye todos los asientos de un origen por Entries; sin Entries lo borra
+type LedgerChange struct {
+	SourceType string
+	SourceID   int64
+	Entries    []LedgerEntry
+}
+
+// syncedSources son los orígenes que RebuildPeriodBalances vuelve a leer de sus tablas
+var syncedSources = []string{
+	LedgerSourceIncome, LedgerSourceExpense, LedgerSourceBillPayment,
+	LedgerSourceLoanInstallment, LedgerSourceCardStatement, LedgerSourceTransfer, LedgerSourceAdjustment,
+}
+
+// TransferLedgerEntries devuelve los dos asientos de un traspaso entre caja y banco
+func TransferLedgerEntries(transferType string, date time.Time, amount float64) ([]LedgerEntry, error) {
+	from, to := "cash", "bank"
+	switch transferType {
+	case TransferCashToBank:
+	case TransferBankToCash:
+		from, to = to, from
+	default:
+		return nil, fmt.Errorf("invalid transfer type: %s", transferType)
+	}
+	return []LedgerEntry{
+		{Date: date, Kind: LedgerTransfer, PaymentMethod: from, Amount: -amount},
+		{Date: date, Kind: LedgerTransfer, PaymentMethod: to, Amount: amount},
+	}, nil
+}
+
+// EnsureUserLedger carga el libro del usuario de las tablas de origen si todavía no se ha hecho,
+// para leer sus saldos antes de calcular un ajuste sobre ellos
+func EnsureUserLedger(q DBTX, userID string) error {
+	_, err := ensureUserLedger(q, userID)
+	return err
+}
+
+// EnsureLedgerTable crea el libro de saldos, el registro de usuarios ya sincronizados y las
+// columnas de saldo que necesita la proyección
+func EnsureLedgerTable(db *sql.DB) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS balance_ledger (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			source_type TEXT NOT NULL,
+			source_id INTEGER NOT NULL,
+			entry_date TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			payment_method TEXT NOT NULL,
+			amount REAL NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_balance_ledger_source ON balance_ledger(user_id, source_type, source_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_balance_ledger_date ON balance_ledger(user_id, entry_date)`,
+		`CREATE TABLE IF NOT EXISTS balance_ledger_users (
+			user_id TEXT PRIMARY KEY,
+			synced_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("error creating balance ledger: %v", err)
+		}
+	}
+	if err := EnsurePeriodBalanceColumns(db); err != nil {
+		return err
+	}
+	// El libro lee el vencimiento de cada pago de factura y lo que queda por pagar
+	if err := EnsureBillScheduleColumns(db); err != nil {
+		return err
+	}
+	if err := EnsureBillPaymentAmountColumns(db); err != nil {
+		return err
+	}
+	// Quien escribe en el libro también cambia filas versionadas (p. ej. marca facturas pagadas)
+	return EnsureVersionColumns(db)
+}
+
+// ApplyLedgerChanges registra los cambios de uno o varios orígenes y actualiza las seis tablas
+// en una sola pasada: resta los asientos anteriores, suma los nuevos y recalcula los saldos
+// acumulados desde la fecha más antigua afectada. Se llama dentro de la misma transacción que
+// escribe el movimiento en su tabla de origen cuando es posible.
+func ApplyLedgerChanges(q DBTX, userID string, changes ...LedgerChange) error {
+	// La primera vez el libro se carga de las tablas de origen. Sustituir asientos es idempotente,
+	// así que da igual que la carga incluya ya el cambio o no.
+	if _, err := ensureUserLedger(q, userID); err != nil {
+		return err
+	}
+
+	settings, err := LoadPeriodSettings(q, userID)
+	if err != nil {
+		return err
+	}
+
+	var earliest time.Time
+	touch := func(date time.Time) {
+		if earliest.IsZero() || date.Before(earliest) {
+			earliest = date
+		}
+	}
+
+	for _, change := range changes {
+		previous, err := loadLedgerEntries(q, `user_id = ? AND source_type = ? AND source_id = ?`,
+			userID, change.SourceType, change.SourceID)
+		if err != nil {
+			return err
+		}
+		for _, entry := range previous {
+			if err := applyLedgerEntry(q, settings, userID, entry, -1); err != nil {
+				return err
+			}
+			touch(entry.Date)
+		}
+		if len(previous) > 0 {
+			_, err := q.Exec(`DELETE FROM balance_ledger WHERE user_id = ? AND source_type = ? AND source_id = ?`,
+				userID, change.SourceType, change.SourceID)
+			if err != nil {
+				return fmt.Errorf("error deleting ledger entries: %v", err)
+			}
+		}
+
+		for _, entry := range change.Entries {
+			entry.SourceType, entry.SourceID = change.SourceType, change.SourceID
+			posted, err := postLedgerEntry(q, settings, userID, entry)
+			if err != nil {
+				return err
+			}
+			if posted {
+				touch(entry.Date)
+			}
+		}
+	}
+
+	if earliest.IsZero() {
+		return nil
+	}
+	return CascadePeriodBalances(q, userID, earliest)
+}
+
+// ReplaceLedgerEntries sustituye los asientos de un origen, p. ej. al editar un ingreso
+func ReplaceLedgerEntries(q DBTX, userID, sourceType string, sourceID int64, entries ...LedgerEntry) error {
+	return ApplyLedgerChanges(q, userID, LedgerChange{SourceType: sourceType, SourceID: sourceID, Entries: entries})
+}
+
+// RemoveLedgerEntries borra los asientos de un origen, p. ej. al borrar un gasto
+func RemoveLedgerEntries(q DBTX, userID, sourceType string, sourceID int64) error {
+	return ApplyLedgerChanges(q, userID, LedgerChange{SourceType: sourceType, SourceID: sourceID})
+}
+
+// PostLedgerEntries añade asientos sin tocar los anteriores del mismo origen, para orígenes que
+// acumulan varios movimientos (pagos parciales de un extracto de tarjeta). Se llama después de
+// escribir el movimiento en su tabla: si es el primer uso del libro, la carga inicial ya lo incluye.
+func PostLedgerEntries(q DBTX, userID string, entries ...LedgerEntry) error {
+	if synced, err := ensureUserLedger(q, userID); err != nil || synced {
+		return err
+	}
+
+	settings, err := LoadPeriodSettings(q, userID)
+	if err != nil {
+		return err
+	}
+
+	var earliest time.Time
+	for _, entry := range entries {
+		posted, err := postLedgerEntry(q, settings, userID, entry)
+		if err != nil {
+			return err
+		}
+		if posted && (earliest.IsZero() || entry.Date.Before(earliest)) {
+			earliest = entry.Date
+		}
+	}
+
+	if earliest.IsZero() {
+		return nil
+	}
+	return CascadePeriodBalances(q, userID, earliest)
+}
+
+// RebuildPeriodBalances vuelve a cargar el libro del usuario desde las tablas de origen y
+// reconstruye sus seis tablas *_cash_bank_balance, agrupadas según sus PeriodSettings.
+func RebuildPeriodBalances(q DBTX, userID string) error {
+	if err := reloadLedger(q, userID); err != nil {
+		return err
+	}
+	return ProjectLedger(q, userID)
+}
+
+// reloadLedger sustituye los asientos del usuario por los que se leen de las tablas de origen.
+// Fuentes: ingresos, gastos (salvo los de tarjeta de crédito), facturas pendientes (reservadas
+// en su mes, como hace AddBill), capital de cuotas de préstamo pagadas, pagos de extractos,
+// traspasos y ajustes manuales. Los asientos de orígenes sin tabla propia (facturas de lotes anteriores) se conservan.
+func reloadLedger(q DBTX, userID string) error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(syncedSources)), ", ")
+	args := []interface{}{userID}
+	for _, source := range syncedSources {
+		args = append(args, source)
+	}
+	_, err := q.Exec(`DELETE FROM balance_ledger WHERE user_id = ? AND source_type IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return fmt.Errorf("error clearing ledger: %v", err)
+	}
+
+	entries, err := loadSourceEntries(q, userID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := insertLedgerEntry(q, userID, entry); err != nil {
+			return err
+		}
+	}
+
+	_, err = q.Exec(`
+		INSERT INTO balance_ledger_users (user_id, synced_at) VALUES (?, CURRENT_TIMESTAMP)
+		ON CONFLICT (user_id) DO UPDATE SET synced_at = CURRENT_TIMESTAMP
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("error marking ledger as synced: %v", err)
+	}
+	return nil
+}
+
+// ProjectLedger recalcula las seis tablas del usuario a partir de su libro y corrige las filas
+// que no coinciden con el resultado
+func ProjectLedger(q DBTX, userID string) error {
+	_, err := projectLedger(q, userID)
+	return err
+}
+
+// ensureUserLedger carga el libro del usuario la primera vez que se usa. Devuelve true si lo
+// ha cargado, en cuyo caso sus tablas ya reflejan el estado actual de las tablas de origen.
+func ensureUserLedger(q DBTX, userID string) (bool, error) {
+	var exists int
+	err := q.QueryRow(`SELECT 1 FROM balance_ledger_users WHERE user_id = ?`, userID).Scan(&exists)
+	if err == nil {
+		return false, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, fmt.Errorf("error checking ledger state: %v", err)
+	}
+	return true, RebuildPeriodBalances(q, userID)
+}
+
+// validateLedgerEntry comprueba el asiento. Devuelve false para los que no mueven caja ni banco.
+func validateLedgerEntry(entry LedgerEntry) (bool, error) {
+	switch entry.Kind {
+	case LedgerIncome, LedgerExpense, LedgerBill, LedgerPendingBill, LedgerCardPayment, LedgerTransfer, LedgerAdjustment:
+	default:
+		return false, fmt.Errorf("invalid movement kind: %s", entry.Kind)
+	}
+	if entry.Kind == LedgerExpense && entry.PaymentMethod == PaymentMethodCreditCard {
+		// Las compras con tarjeta no mueven caja ni banco
+		return false, nil
+	}
+	if entry.PaymentMethod != "cash" && entry.PaymentMethod != "bank" {
+		return false, fmt.Errorf("invalid payment method: %s", entry.PaymentMethod)
+	}
+	if entry.Date.IsZero() {
+		return false, fmt.Errorf("ledger entry without date")
+	}
+	return entry.Amount != 0, nil
+}
+
+// postLedgerEntry guarda el asiento y lo suma a las seis tablas, sin recalcular saldos
+func postLedgerEntry(q DBTX, settings PeriodSettings, userID string, entry LedgerEntry) (bool, error) {
+	ok, err := validateLedgerEntry(entry)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := insertLedgerEntry(q, userID, entry); err != nil {
+		return false, err
+	}
+	return true, applyLedgerEntry(q, settings, userID, entry, 1)
+}
+
+func insertLedgerEntry(q DBTX, userID string, entry LedgerEntry) error {
+	_, err := q.Exec(`
+		INSERT INTO balance_ledger (user_id, source_type, source_id, entry_date, kind, payment_method, amount)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, userID, entry.SourceType, entry.SourceID, entry.Date.Format("2006-01-02"), entry.Kind,
+		entry.PaymentMethod, entry.Amount)
+	if err != nil {
+		return fmt.Errorf("error inserting ledger entry: %v", err)
+	}
+	return nil
+}
+
+// applyLedgerEntry suma sign*amount a la columna del asiento en el periodo que contiene su
+// fecha. No recalcula los saldos acumulados; para eso se llama después a CascadePeriodBalances.
+func applyLedgerEntry(q DBTX, settings PeriodSettings, userID string, entry LedgerEntry, sign float64) error {
+	column := fmt.Sprintf("%s_%s_amount", ledgerColumnKind(entry.Kind), entry.PaymentMethod)
+
+	for _, pt := range PeriodTables {
+		if !projectsInto(entry, pt) {
+			continue
+		}
+		periodID, err := ensurePeriodRow(q, settings, pt, userID, entry.Date)
+		if err != nil {
+			return err
+		}
+
+		_, err = q.Exec(fmt.Sprintf(`
+			UPDATE %s
+			SET %s = COALESCE(%s, 0) + ?, updated_at = CURRENT_TIMESTAMP
+			WHERE user_id = ? AND %s = ?
+		`, pt.Table, column, column, pt.Column), sign*entry.Amount, userID, periodID)
+		if err != nil {
+			return fmt.Errorf("error updating %s for period %s: %v", pt.Table, periodID, err)
+		}
+	}
+
+	return nil
+}
+
+// ensurePeriodRow crea la fila del periodo que contiene date si no existe y devuelve su identificador
+func ensurePeriodRow(q DBTX, settings PeriodSettings, pt PeriodTable, userID string, date time.Time) (string, error) {
+	periodID := settings.Identifier(date, pt.Period)
+
+	var err error
+	if pt.Period == "weekly" {
+		start, end := settings.Range("weekly", date)
+		_, err = q.Exec(`
+			INSERT OR IGNORE INTO weekly_cash_bank_balance (user_id, year_week, start_date, end_date)
+			VALUES (?, ?, ?, ?)
+		`, userID, periodID, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	} else {
+		_, err = q.Exec(fmt.Sprintf(`
+			INSERT OR IGNORE INTO %s (user_id, %s) VALUES (?, ?)
+		`, pt.Table, pt.Column), userID, periodID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error creating %s record: %v", pt.Table, err)
+	}
+	return periodID, nil
+}
+
+// projectsInto indica si el asiento se refleja en la tabla: las facturas pendientes solo se
+// reservan en la tabla mensual
+func projectsInto(entry LedgerEntry, pt PeriodTable) bool {
+	return entry.Kind != LedgerPendingBill || pt.Period == "monthly"
+}
+
+func ledgerColumnKind(kind string) string {
+	if kind == LedgerPendingBill {
+		return LedgerBill
+	}
+	return kind
+}
+
+func addLedgerEntry(f *periodFlows, entry LedgerEntry) {
+	cash := entry.PaymentMethod == "cash"
+	switch ledgerColumnKind(entry.Kind) {
+	case LedgerIncome:
+		if cash {
+			f.incomeCash += entry.Amount
+		} else {
+			f.incomeBank += entry.Amount
+		}
+	case LedgerExpense:
+		if cash {
+			f.expenseCash += entry.Amount
+		} else {
+			f.expenseBank += entry.Amount
+		}
+	case LedgerBill:
+		if cash {
+			f.billCash += entry.Amount
+		} else {
+			f.billBank += entry.Amount
+		}
+	case LedgerCardPayment:
+		if cash {
+			f.cardCash += entry.Amount
+		} else {
+			f.cardBank += entry.Amount
+		}
+	case LedgerTransfer:
+		if cash {
+			f.transferCash += entry.Amount
+		} else {
+			f.transferBank += entry.Amount
+		}
+	case LedgerAdjustment:
+		if cash {
+			f.adjustmentCash += entry.Amount
+		} else {
+			f.adjustmentBank += entry.Amount
+		}
+	}
+}
+
+// loadLedgerEntries lee los asientos que cumplen la condición, en orden de fecha
+func loadLedgerEntries(q DBTX, where string, args ...interface{}) ([]LedgerEntry, error) {
+	rows, err := q.Query(`
+		SELECT source_type, source_id, entry_date, kind, payment_method, amount
+		FROM balance_ledger WHERE `+where+`
+		ORDER BY entry_date, id
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ledger: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		var entry LedgerEntry
+		var dateStr string
+		if err := rows.Scan(&entry.SourceType, &entry.SourceID, &dateStr, &entry.Kind,
+			&entry.PaymentMethod, &entry.Amount); err != nil {
+			return nil, fmt.Errorf("error scanning ledger entry: %v", err)
+		}
+		if entry.Date, err = time.Parse("2006-01-02", dateStr); err != nil {
+			return nil, fmt.Errorf("invalid ledger date %q: %v", dateStr, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading ledger: %v", err)
+	}
+	return entries, nil
+}
+
+// loadSourceEntries lee todos los movimientos de caja y banco del usuario de sus tablas de
+// origen. Las tablas que todavía no ha creado su servicio se ignoran.
+func loadSourceEntries(q DBTX, userID string) ([]LedgerEntry, error) {
+	sources := []struct {
+		name  string
+		query string
+	}{
+		{"incomes", `SELECT 'income', id, date, 'income', payment_method, amount FROM incomes WHERE user_id = ?`},
+		{"expenses", `SELECT 'expense', id, date, 'expense', payment_method, amount FROM expenses
+			WHERE user_id = ? AND payment_method != '` + PaymentMethodCreditCard + `'`},
+		// Las facturas pagadas dejan de estar reservadas; su salida real es un gasto, una cuota o un
+		// extracto. De las pagadas en parte solo queda reservado lo que falta.
+		{"bill_payments", `SELECT 'bill_payment', bp.id, ` + BillPaymentDueDateSQL + `, 'pending_bill', COALESCE(bp.payment_method, b.payment_method, 'bank'), ` + BillPaymentRemainingSQL + `
+			FROM bill_payments bp JOIN bills b ON b.id = bp.bill_id
+			WHERE bp.user_id = ? AND bp.paid = 0`},
+		{"loan_installments", `SELECT 'loan_installment', li.id, li.paid_date, 'bill', l.payment_method, li.principal
+			FROM loan_installments li JOIN loans l ON l.id = li.loan_id
+			WHERE li.user_id = ? AND li.paid = 1 AND li.paid_date IS NOT NULL AND li.principal > 0`},
+		// El método del pago solo queda registrado en la factura del extracto
+		{"credit_card_statements", `SELECT 'card_statement', s.id, COALESCE(s.paid_at, s.due_date), 'card_payment',
+			COALESCE((SELECT payment_method FROM bill_payments WHERE bill_id = s.bill_id LIMIT 1), 'bank'), s.paid_amount
+			FROM credit_card_statements s
+			WHERE s.user_id = ? AND s.paid_amount > 0`},
+		// Cada traspaso sale de una cuenta y entra en la otra
+		{"cash_bank_transactions", `SELECT 'transfer', t.id, t.date, 'transfer', m.method,
+			CASE WHEN (t.transaction_type = '` + TransferCashToBank + `') = (m.method = 'cash') THEN -t.amount ELSE t.amount END
+			FROM cash_bank_transactions t CROSS JOIN (SELECT 'cash' AS method UNION ALL SELECT 'bank') m
+			WHERE t.user_id = ? AND t.transaction_type IN ('` + TransferCashToBank + `', '` + TransferBankToCash + `')`},
+		// Los ajustes manuales ya guardan la diferencia con signo
+		{"cash_bank_adjustments", `SELECT 'adjustment', id, date, 'adjustment',
+			CASE WHEN transaction_type = '` + AdjustmentCash + `' THEN 'cash' ELSE 'bank' END, amount
+			FROM cash_bank_transactions
+			WHERE user_id = ? AND transaction_type IN ('` + AdjustmentCash + `', '` + AdjustmentBank + `')`},
+	}
+
+	var entries []LedgerEntry
+	for _, source := range sources {
+		rows, err := q.Query(source.query, userID)
+		if err != nil {
+			if strings.Contains(err.Error(), "no such table") {
+				continue
+			}
+			return nil, fmt.Errorf("error reading %s: %v", source.name, err)
+		}
+		for rows.Next() {
+			var dateStr string
+			var entry LedgerEntry
+			if err := rows.Scan(&entry.SourceType, &entry.SourceID, &dateStr, &entry.Kind,
+				&entry.PaymentMethod, &entry.Amount); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning %s: %v", source.name, err)
+			}
+			if len(dateStr) > 10 {
+				dateStr = dateStr[:10]
+			}
+			date, err := time.Parse("2006-01-02", dateStr)
+			if err != nil {
+				// Fechas inválidas no pueden situarse en ningún periodo
+				continue
+			}
+			entry.Date = date
+			if ok, err := validateLedgerEntry(entry); err != nil || !ok {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", source.name, err)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,374 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// setupLedgerDB crea las tablas de origen y las seis tablas de saldos con las columnas que usa la proyección
+func setupLedgerDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db := openTestDB(t)
+
+	statements := []string{
+		`CREATE TABLE incomes (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, amount REAL, date TEXT,
+			payment_method TEXT, category TEXT, description TEXT)`,
+		`CREATE TABLE expenses (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, amount REAL, date TEXT,
+			payment_method TEXT, category TEXT, description TEXT)`,
+		`CREATE TABLE bills (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, name TEXT, amount REAL, due_date TEXT,
+			paid BOOLEAN, overdue BOOLEAN, overdue_days INTEGER, recurring BOOLEAN, category TEXT, icon TEXT,
+			start_date TEXT, payment_day INTEGER, duration_months INTEGER, regularity TEXT, payment_method TEXT,
+			updated_at TIMESTAMP)`,
+		`CREATE TABLE bill_payments (id INTEGER PRIMARY KEY AUTOINCREMENT, bill_id INTEGER, user_id TEXT,
+			year_month TEXT, paid BOOLEAN, payment_date TEXT, payment_method TEXT, UNIQUE(bill_id, year_month))`,
+		`CREATE TABLE cash_bank_transactions (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, transaction_type TEXT,
+			amount REAL, date TEXT)`,
+	}
+	for _, pt := range PeriodTables {
+		extra := ""
+		if pt.Period == "weekly" {
+			extra = "start_date TEXT NOT NULL, end_date TEXT NOT NULL,"
+		}
+		statements = append(statements, fmt.Sprintf(`CREATE TABLE %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT NOT NULL, %s TEXT NOT NULL, %s
+			income_cash_amount REAL DEFAULT 0, income_bank_amount REAL DEFAULT 0,
+			expense_cash_amount REAL DEFAULT 0, expense_bank_amount REAL DEFAULT 0,
+			bill_cash_amount REAL DEFAULT 0, bill_bank_amount REAL DEFAULT 0,
+			cash_amount REAL DEFAULT 0, bank_amount REAL DEFAULT 0,
+			previous_cash_amount REAL DEFAULT 0, previous_bank_amount REAL DEFAULT 0,
+			balance_cash_amount REAL DEFAULT 0, balance_bank_amount REAL DEFAULT 0,
+			total_previous_balance REAL DEFAULT 0, total_balance REAL DEFAULT 0,
+			updated_at TIMESTAMP, UNIQUE(user_id, %s))`, pt.Table, pt.Column, extra, pt.Column))
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Failed to create schema: %v", err)
+		}
+	}
+	if err := EnsurePeriodSettingsTable(db); err != nil {
+		t.Fatalf("Failed to create ledger: %v", err)
+	}
+	if err := EnsureOutboxTable(db); err != nil {
+		t.Fatalf("Failed to create outbox: %v", err)
+	}
+	return db
+}
+
+// insertMovement escribe un ingreso o gasto en su tabla y lo registra en el libro
+func insertMovement(t *testing.T, db *sql.DB, kind, userID string, amount float64, date, method string) int64 {
+	t.Helper()
+	result, err := db.Exec(fmt.Sprintf(`INSERT INTO %ss (user_id, amount, date, payment_method) VALUES (?, ?, ?, ?)`, kind),
+		userID, amount, date, method)
+	if err != nil {
+		t.Fatalf("Failed to insert %s: %v", kind, err)
+	}
+	id, _ := result.LastInsertId()
+	recordMovement(t, db, kind, userID, id, amount, date, method)
+	return id
+}
+
+func recordMovement(t *testing.T, db *sql.DB, kind, userID string, id int64, amount float64, date, method string) {
+	t.Helper()
+	parsed, _ := time.Parse("2006-01-02", date)
+	err := ReplaceLedgerEntries(db, userID, kind, id, LedgerEntry{Date: parsed, Kind: kind, PaymentMethod: method, Amount: amount})
+	if err != nil {
+		t.Fatalf("Failed to record %s %d: %v", kind, id, err)
+	}
+}
+
+// periodBalance es el saldo acumulado de caja y banco de un periodo
+type periodBalance struct{ cash, bank float64 }
+
+func periodBalances(t *testing.T, db *sql.DB, pt PeriodTable, userID string) map[string]periodBalance {
+	t.Helper()
+	rows, err := db.Query(fmt.Sprintf(`SELECT %s, balance_cash_amount, balance_bank_amount FROM %s WHERE user_id = ?`,
+		pt.Column, pt.Table), userID)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", pt.Table, err)
+	}
+	defer rows.Close()
+
+	balances := map[string]periodBalance{}
+	for rows.Next() {
+		var periodID string
+		var b periodBalance
+		if err := rows.Scan(&periodID, &b.cash, &b.bank); err != nil {
+			t.Fatalf("Failed to scan %s: %v", pt.Table, err)
+		}
+		balances[periodID] = b
+	}
+	return balances
+}
+
+func expectBalance(t *testing.T, balances map[string]periodBalance, periodID string, cash, bank float64) {
+	t.Helper()
+	got, ok := balances[periodID]
+	if !ok {
+		t.Fatalf("Expected period %s, got %v", periodID, balances)
+	}
+	if math.Abs(got.cash-cash) > 0.001 || math.Abs(got.bank-bank) > 0.001 {
+		t.Errorf("Period %s: expected cash %.2f bank %.2f, got cash %.2f bank %.2f", periodID, cash, bank, got.cash, got.bank)
+	}
+}
+
+func tableByPeriod(period string) PeriodTable {
+	for _, pt := range PeriodTables {
+		if pt.Period == period {
+			return pt
+		}
+	}
+	panic("unknown period " + period)
+}
+
+func TestLedgerProjectsEveryPeriodTable(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	insertMovement(t, db, "income", "1", 1000, "2025-01-10", "bank")
+	insertMovement(t, db, "expense", "1", 200, "2025-01-20", "cash")
+	insertMovement(t, db, "expense", "1", 50, "2025-03-05", "bank")
+	insertMovement(t, db, "expense", "1", 80, "2025-03-06", PaymentMethodCreditCard)
+
+	expectBalance(t, periodBalances(t, db, tableByPeriod("daily"), "1"), "2025-01-20", -200, 1000)
+	expectBalance(t, periodBalances(t, db, tableByPeriod("weekly"), "1"), "2025-10", -200, 950)
+
+	monthly := periodBalances(t, db, tableByPeriod("monthly"), "1")
+	expectBalance(t, monthly, "2025-01", -200, 1000)
+	expectBalance(t, monthly, "2025-03", -200, 950)
+	if _, ok := monthly["2025-02"]; ok {
+		t.Errorf("Expected no row for a month without movements")
+	}
+
+	expectBalance(t, periodBalances(t, db, tableByPeriod("quarterly"), "1"), "2025-Q1", -200, 950)
+	expectBalance(t, periodBalances(t, db, tableByPeriod("semiannual"), "1"), "2025-H1", -200, 950)
+	expectBalance(t, periodBalances(t, db, tableByPeriod("annual"), "1"), "2025", -200, 950)
+
+	var start, end string
+	err := db.QueryRow(`SELECT start_date, end_date FROM weekly_cash_bank_balance WHERE year_week = '2025-10'`).Scan(&start, &end)
+	if err != nil || start != "2025-03-03" || end != "2025-03-09" {
+		t.Errorf("Expected week 2025-10 from 2025-03-03 to 2025-03-09, got %q %q (%v)", start, end, err)
+	}
+}
+
+func TestLedgerReplaceAndRemove(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	insertMovement(t, db, "income", "1", 500, "2025-01-15", "cash")
+	expenseID := insertMovement(t, db, "expense", "1", 100, "2025-01-20", "cash")
+	insertMovement(t, db, "income", "1", 10, "2025-04-01", "cash")
+
+	// Mover el gasto a otro mes y cambiar su importe y método
+	if _, err := db.Exec(`UPDATE expenses SET amount = 40, date = '2025-03-01', payment_method = 'bank' WHERE id = ?`, expenseID); err != nil {
+		t.Fatalf("Failed to update expense: %v", err)
+	}
+	recordMovement(t, db, "expense", "1", expenseID, 40, "2025-03-01", "bank")
+
+	monthly := periodBalances(t, db, tableByPeriod("monthly"), "1")
+	expectBalance(t, monthly, "2025-01", 500, 0)
+	expectBalance(t, monthly, "2025-03", 500, -40)
+	expectBalance(t, monthly, "2025-04", 510, -40)
+
+	if err := RemoveLedgerEntries(db, "1", LedgerSourceExpense, expenseID); err != nil {
+		t.Fatalf("Failed to remove expense: %v", err)
+	}
+	monthly = periodBalances(t, db, tableByPeriod("monthly"), "1")
+	expectBalance(t, monthly, "2025-03", 500, 0)
+	expectBalance(t, monthly, "2025-04", 510, 0)
+
+	var entries int
+	db.QueryRow(`SELECT COUNT(*) FROM balance_ledger WHERE source_type = 'expense'`).Scan(&entries)
+	if entries != 0 {
+		t.Errorf("Expected removed expense to leave no ledger entries, got %d", entries)
+	}
+}
+
+func TestLedgerFirstUseLoadsExistingMovements(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	// Movimientos anteriores al libro, sin asientos
+	for _, m := range []struct {
+		table  string
+		amount float64
+		date   string
+	}{{"incomes", 300, "2024-12-01"}, {"expenses", 20, "2025-01-02"}, {"incomes", 40, "2025-01-03"}} {
+		if _, err := db.Exec(fmt.Sprintf(`INSERT INTO %s (user_id, amount, date, payment_method) VALUES ('1', ?, ?, 'bank')`, m.table),
+			m.amount, m.date); err != nil {
+			t.Fatalf("Failed to insert movement: %v", err)
+		}
+	}
+
+	// El primer cambio carga el libro, incluido el propio movimiento, sin contarlo dos veces
+	insertMovement(t, db, "expense", "1", 5, "2025-01-04", "bank")
+
+	monthly := periodBalances(t, db, tableByPeriod("monthly"), "1")
+	expectBalance(t, monthly, "2024-12", 0, 300)
+	expectBalance(t, monthly, "2025-01", 0, 315)
+
+	var entries int
+	db.QueryRow(`SELECT COUNT(*) FROM balance_ledger WHERE user_id = '1'`).Scan(&entries)
+	if entries != 4 {
+		t.Errorf("Expected 4 ledger entries, got %d", entries)
+	}
+}
+
+func TestLedgerBillReservationsStayMonthly(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	insertMovement(t, db, "income", "1", 1000, "2025-01-01", "bank")
+	billID, err := AddBill(db, "1", "Rent", 300, "2025-01-05", 5, 2, "bank", "housing", "🏠", "monthly")
+	if err != nil {
+		t.Fatalf("Failed to add bill: %v", err)
+	}
+
+	monthly := periodBalances(t, db, tableByPeriod("monthly"), "1")
+	expectBalance(t, monthly, "2025-01", 0, 700)
+	expectBalance(t, monthly, "2025-02", 0, 400)
+	// Las reservas no aparecen en las demás tablas
+	expectBalance(t, periodBalances(t, db, tableByPeriod("annual"), "1"), "2025", 0, 1000)
+
+	if err := MarkBillPaid(db, billID, "1", "2025-01"); err != nil {
+		t.Fatalf("Failed to mark bill paid: %v", err)
+	}
+	monthly = periodBalances(t, db, tableByPeriod("monthly"), "1")
+	expectBalance(t, monthly, "2025-01", 0, 1000)
+	expectBalance(t, monthly, "2025-02", 0, 700)
+
+	// Cambiar el importe de la factura cambia la reserva del mes pendiente
+	if _, err := db.Exec(`UPDATE bills SET amount = 250 WHERE id = ?`, billID); err != nil {
+		t.Fatalf("Failed to update bill: %v", err)
+	}
+	if err := ReserveBillPayments(db, "1", int64(billID)); err != nil {
+		t.Fatalf("Failed to reserve bill payments: %v", err)
+	}
+	expectBalance(t, periodBalances(t, db, tableByPeriod("monthly"), "1"), "2025-02", 0, 750)
+
+	if err := ReleaseBillPayments(db, "1", int64(billID)); err != nil {
+		t.Fatalf("Failed to release bill payments: %v", err)
+	}
+	expectBalance(t, periodBalances(t, db, tableByPeriod("monthly"), "1"), "2025-02", 0, 1000)
+}
+
+func TestLedgerIncrementalMatchesRebuild(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	methods := []string{"cash", "bank"}
+	var ids []int64
+	for i := 0; i < 40; i++ {
+		date := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, i*7%150).Format("2006-01-02")
+		kind := "income"
+		if i%3 != 0 {
+			kind = "expense"
+		}
+		ids = append(ids, insertMovement(t, db, kind, "1", float64(10+i), date, methods[i%2]))
+	}
+	// Editar y borrar algunos gastos fuera de orden
+	for i := 1; i < len(ids); i += 5 {
+		if i%3 == 0 {
+			continue
+		}
+		date := time.Date(2025, 2, 1+i%20, 0, 0, 0, 0, time.UTC).Format("2006-01-02")
+		db.Exec(`UPDATE expenses SET amount = 7, date = ?, payment_method = 'cash' WHERE id = ?`, date, ids[i])
+		recordMovement(t, db, "expense", "1", ids[i], 7, date, "cash")
+	}
+	for i := 2; i < len(ids); i += 7 {
+		if i%3 == 0 {
+			continue
+		}
+		db.Exec(`DELETE FROM expenses WHERE id = ?`, ids[i])
+		if err := RemoveLedgerEntries(db, "1", LedgerSourceExpense, ids[i]); err != nil {
+			t.Fatalf("Failed to remove expense: %v", err)
+		}
+	}
+
+	incremental := map[string]map[string]periodBalance{}
+	for _, pt := range PeriodTables {
+		incremental[pt.Table] = periodBalances(t, db, pt, "1")
+	}
+
+	if err := RebuildPeriodBalances(db, "1"); err != nil {
+		t.Fatalf("Failed to rebuild: %v", err)
+	}
+
+	for _, pt := range PeriodTables {
+		rebuilt := periodBalances(t, db, pt, "1")
+		for periodID, b := range rebuilt {
+			expectBalance(t, incremental[pt.Table], periodID, b.cash, b.bank)
+		}
+		// Los periodos que se quedan vacíos pueden conservar su fila, pero con el mismo saldo
+		for periodID, b := range incremental[pt.Table] {
+			if _, ok := rebuilt[periodID]; !ok && (b.cash != 0 || b.bank != 0) {
+				if previous := previousBalance(rebuilt, periodID); math.Abs(previous.cash-b.cash) > 0.001 || math.Abs(previous.bank-b.bank) > 0.001 {
+					t.Errorf("%s %s: incremental balance %v differs from rebuilt %v", pt.Table, periodID, b, previous)
+				}
+			}
+		}
+	}
+}
+
+// previousBalance devuelve el saldo del último periodo anterior a periodID
+func previousBalance(balances map[string]periodBalance, periodID string) periodBalance {
+	var best string
+	for id := range balances {
+		if id < periodID && id > best {
+			best = id
+		}
+	}
+	return balances[best]
+}
+
+func TestLedgerUsesCustomPeriods(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	if _, err := SavePeriodSettings(db, "1", PeriodSettings{MonthStartDay: 25, WeekStartDay: time.Sunday}); err != nil {
+		t.Fatalf("Failed to save settings: %v", err)
+	}
+	insertMovement(t, db, "income", "1", 100, "2025-01-24", "bank")
+	insertMovement(t, db, "income", "1", 50, "2025-01-25", "bank")
+
+	monthly := periodBalances(t, db, tableByPeriod("monthly"), "1")
+	expectBalance(t, monthly, "2025-01", 0, 100)
+	expectBalance(t, monthly, "2025-02", 0, 150)
+
+	var start string
+	db.QueryRow(`SELECT start_date FROM weekly_cash_bank_balance WHERE user_id = '1' ORDER BY year_week LIMIT 1`).Scan(&start)
+	if start != "2025-01-19" {
+		t.Errorf("Expected Sunday-based week starting 2025-01-19, got %q", start)
+	}
+}
+
+func TestLedgerAdjustmentsSurviveRebuild(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	insertMovement(t, db, "income", "1", 1000, "2025-01-01", "bank")
+
+	// El usuario corrige el saldo del banco a 950: se guarda la diferencia con signo
+	result, err := db.Exec(`INSERT INTO cash_bank_transactions (user_id, transaction_type, amount, date) VALUES ('1', ?, -50, '2025-01-10')`,
+		AdjustmentBank)
+	if err != nil {
+		t.Fatalf("Failed to insert adjustment: %v", err)
+	}
+	adjustmentID, _ := result.LastInsertId()
+	date, _ := time.Parse("2006-01-02", "2025-01-10")
+	err = ReplaceLedgerEntries(db, "1", LedgerSourceAdjustment, adjustmentID,
+		LedgerEntry{Date: date, Kind: LedgerAdjustment, PaymentMethod: "bank", Amount: -50})
+	if err != nil {
+		t.Fatalf("Failed to record adjustment: %v", err)
+	}
+	expectBalance(t, periodBalances(t, db, tableByPeriod("monthly"), "1"), "2025-01", 0, 950)
+
+	// La auditoría no lo ve como desviación y reconstruir no deshace la corrección
+	report, err := AuditPeriodBalances(db, "1", false)
+	if err != nil {
+		t.Fatalf("Failed to audit: %v", err)
+	}
+	if len(report.Drifts) != 0 {
+		t.Errorf("Expected no drift, got %+v", report.Drifts)
+	}
+	if err := RebuildPeriodBalances(db, "1"); err != nil {
+		t.Fatalf("Failed to rebuild: %v", err)
+	}
+	expectBalance(t, periodBalances(t, db, tableByPeriod("monthly"), "1"), "2025-01", 0, 950)
+	expectBalance(t, periodBalances(t, db, tableByPeriod("daily"), "1"), "2025-01-10", 0, 950)
+}
@@ -0,0 +1,239 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Eventos de dominio. Cada handler de escritura guarda el suyo en el outbox dentro de la misma
+// transacción que el cambio, así que un evento existe si y solo si el cambio se confirmó.
+// Los saldos por periodo no dependen de ellos: el libro se proyecta en esa misma transacción.
+const (
+	EventIncomeCreated       = "IncomeCreated"
+	EventIncomeUpdated       = "IncomeUpdated"
+	EventIncomeDeleted       = "IncomeDeleted"
+	EventExpenseCreated      = "ExpenseCreated"
+	EventExpenseUpdated      = "ExpenseUpdated"
+	EventExpenseDeleted      = "ExpenseDeleted"
+	EventBillCreated         = "BillCreated"
+	EventBillUpdated         = "BillUpdated"
+	EventBillDeleted         = "BillDeleted"
+	EventBillPaid            = "BillPaid"
+	EventBillPartiallyPaid   = "BillPartiallyPaid" // Pago parcial de una repetición que sigue pendiente
+	EventBillOverdue         = "BillOverdue"       // Alguna repetición de la factura venció sin pagar
+	EventTransferMade        = "TransferMade"
+	EventCashBankAdjusted    = "CashBankAdjusted"
+	EventCardStatementClosed = "CardStatementClosed"
+	EventCardStatementPaid   = "CardStatementPaid"
+	EventLoanCreated         = "LoanCreated"
+	EventLoanInstallmentPaid = "LoanInstallmentPaid"
+	EventEnvelopeAssigned    = "EnvelopeAssigned" // Dinero asignado a un sobre o devuelto a "ready to assign"
+	EventEnvelopeMoved       = "EnvelopeMoved"    // Dinero movido de un sobre a otro
+)
+
+// DomainEvent es una fila del outbox tal como la reciben los suscriptores
+type DomainEvent struct {
+	ID          int64           `json:"id"`
+	Type        string          `json:"type"`
+	UserID      string          `json:"user_id"`
+	AggregateID int64           `json:"aggregate_id"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	CreatedAt   string          `json:"created_at"`
+}
+
+// EnsureOutboxTable crea el outbox y la tabla con la posición de cada suscriptor
+func EnsureOutboxTable(db *sql.DB) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS outbox (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event_type TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			aggregate_id INTEGER NOT NULL DEFAULT 0,
+			payload TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS outbox_subscribers (
+			subscriber TEXT PRIMARY KEY,
+			last_event_id INTEGER NOT NULL DEFAULT 0,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("error creating outbox: %v", err)
+		}
+	}
+	return nil
+}
+
+// PublishEvent escribe un evento en el outbox. Debe llamarse con la transacción que hace el
+// cambio; payload se guarda como JSON.
+func PublishEvent(q DBTX, eventType, userID string, aggregateID int64, payload interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return fmt.Errorf("error encoding %s event: %v", eventType, err)
+		}
+	}
+	_, err := q.Exec(`
+		INSERT INTO outbox (event_type, user_id, aggregate_id, payload) VALUES (?, ?, ?, ?)
+	`, eventType, userID, aggregateID, string(body))
+	if err != nil {
+		return fmt.Errorf("error writing %s event: %v", eventType, err)
+	}
+	return nil
+}
+
+// EventHandler procesa un evento. Si devuelve error el evento se vuelve a entregar en la
+// siguiente pasada, así que debe poder ejecutarse más de una vez.
+type EventHandler func(event DomainEvent) error
+
+type subscription struct {
+	name    string
+	types   map[string]bool
+	handler EventHandler
+}
+
+func (s subscription) wants(eventType string) bool {
+	return len(s.types) == 0 || s.types[eventType]
+}
+
+// Dispatcher entrega los eventos del outbox a los suscriptores registrados en el proceso.
+// Cada suscriptor avanza su propia posición en outbox_subscribers, de modo que uno lento o
+// caído no retrasa a los demás. La entrega es al menos una vez; cada suscriptor debe
+// registrarse en un único servicio.
+type Dispatcher struct {
+	db            *sql.DB
+	subscriptions []subscription
+
+	Interval    time.Duration // espera entre pasadas
+	BatchSize   int           // eventos leídos por suscriptor y pasada
+	MaxAttempts int           // intentos antes de dar un evento por perdido
+}
+
+// NewDispatcher crea un dispatcher sin suscriptores
+func NewDispatcher(db *sql.DB) *Dispatcher {
+	return &Dispatcher{db: db, Interval: 2 * time.Second, BatchSize: 100, MaxAttempts: 5}
+}
+
+// Subscribe registra un suscriptor para los tipos indicados, o para todos si no se indica ninguno
+func (d *Dispatcher) Subscribe(name string, handler EventHandler, eventTypes ...string) {
+	types := map[string]bool{}
+	for _, eventType := range eventTypes {
+		types[eventType] = true
+	}
+	d.subscriptions = append(d.subscriptions, subscription{name: name, types: types, handler: handler})
+}
+
+// Run entrega eventos cada Interval hasta que se cancela ctx
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		if err := d.DispatchPending(); err != nil {
+			log.Printf("Error dispatching outbox events: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DispatchPending hace una pasada: entrega a cada suscriptor hasta BatchSize eventos nuevos.
+// Un suscriptor que falla no impide la entrega a los demás; los errores se devuelven juntos.
+func (d *Dispatcher) DispatchPending() error {
+	var errs []error
+	for _, sub := range d.subscriptions {
+		if err := d.deliver(sub); err != nil {
+			log.Printf("Error delivering outbox events to subscriber %s: %v", sub.name, err)
+			errs = append(errs, fmt.Errorf("subscriber %s: %v", sub.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *Dispatcher) deliver(sub subscription) error {
+	_, err := d.db.Exec(`INSERT OR IGNORE INTO outbox_subscribers (subscriber) VALUES (?)`, sub.name)
+	if err != nil {
+		return fmt.Errorf("error registering subscriber: %v", err)
+	}
+	var lastID int64
+	var attempts int
+	err = d.db.QueryRow(`SELECT last_event_id, attempts FROM outbox_subscribers WHERE subscriber = ?`,
+		sub.name).Scan(&lastID, &attempts)
+	if err != nil {
+		return fmt.Errorf("error reading subscriber position: %v", err)
+	}
+
+	events, err := loadOutboxEvents(d.db, lastID, d.BatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		if sub.wants(event.Type) {
+			if handlerErr := sub.handler(event); handlerErr != nil {
+				attempts++
+				if attempts < d.MaxAttempts {
+					// Se reintenta en la próxima pasada sin pasar al siguiente evento
+					return d.savePosition(sub.name, lastID, attempts, handlerErr.Error())
+				}
+				log.Printf("Giving up on event %d (%s) for subscriber %s after %d attempts: %v",
+					event.ID, event.Type, sub.name, attempts, handlerErr)
+			}
+		}
+		lastID, attempts = event.ID, 0
+		if err := d.savePosition(sub.name, lastID, 0, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) savePosition(subscriber string, lastID int64, attempts int, lastError string) error {
+	_, err := d.db.Exec(`
+		UPDATE outbox_subscribers
+		SET last_event_id = ?, attempts = ?, last_error = NULLIF(?, ''), updated_at = CURRENT_TIMESTAMP
+		WHERE subscriber = ?
+	`, lastID, attempts, lastError, subscriber)
+	if err != nil {
+		return fmt.Errorf("error saving subscriber position: %v", err)
+	}
+	return nil
+}
+
+// loadOutboxEvents lee hasta limit eventos posteriores a afterID, en orden
+func loadOutboxEvents(q DBTX, afterID int64, limit int) ([]DomainEvent, error) {
+	rows, err := q.Query(`
+		SELECT id, event_type, user_id, aggregate_id, COALESCE(payload, ''), created_at
+		FROM outbox WHERE id > ? ORDER BY id LIMIT ?
+	`, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox: %v", err)
+	}
+	defer rows.Close()
+
+	var events []DomainEvent
+	for rows.Next() {
+		var event DomainEvent
+		var payload string
+		if err := rows.Scan(&event.ID, &event.Type, &event.UserID, &event.AggregateID, &payload, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning outbox event: %v", err)
+		}
+		if payload != "" {
+			event.Payload = json.RawMessage(payload)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
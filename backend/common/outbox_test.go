@@ -0,0 +1,114 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestOutboxDeliversCommittedEventsToSubscribers(t *testing.T) {
+	db := openTestDB(t)
+	if err := EnsureOutboxTable(db); err != nil {
+		t.Fatalf("Failed to create outbox: %v", err)
+	}
+
+	// Un evento escrito en una transacción que se deshace no llega a existir
+	err := WithTx(db, func(tx *sql.Tx) error {
+		if err := PublishEvent(tx, EventIncomeCreated, "user-1", 1, map[string]float64{"amount": 10}); err != nil {
+			return err
+		}
+		return errors.New("write failed")
+	})
+	if err == nil {
+		t.Fatalf("Expected the transaction to fail")
+	}
+	for _, event := range []struct {
+		eventType string
+		id        int64
+	}{{EventIncomeCreated, 2}, {EventTransferMade, 3}, {EventExpenseDeleted, 4}} {
+		if err := PublishEvent(db, event.eventType, "user-1", event.id, nil); err != nil {
+			t.Fatalf("Failed to publish %s: %v", event.eventType, err)
+		}
+	}
+
+	dispatcher := NewDispatcher(db)
+	dispatcher.MaxAttempts = 2
+	var budget, all []string
+	failures := 1
+	dispatcher.Subscribe("budget", func(event DomainEvent) error {
+		budget = append(budget, event.Type)
+		return nil
+	}, EventIncomeCreated, EventExpenseDeleted)
+	dispatcher.Subscribe("webhooks", func(event DomainEvent) error {
+		if event.Type == EventTransferMade && failures > 0 {
+			failures--
+			return errors.New("endpoint unavailable")
+		}
+		all = append(all, event.Type)
+		return nil
+	})
+
+	// Primera pasada: budget recibe solo sus tipos; webhooks se detiene en el evento que falla
+	if err := dispatcher.DispatchPending(); err != nil {
+		t.Fatalf("Dispatch failed: %v", err)
+	}
+	if len(budget) != 2 || budget[0] != EventIncomeCreated || budget[1] != EventExpenseDeleted {
+		t.Errorf("Expected budget to receive IncomeCreated and ExpenseDeleted, got %v", budget)
+	}
+	if len(all) != 1 {
+		t.Errorf("Expected webhooks to stop at the failing event, got %v", all)
+	}
+
+	// Segunda pasada: el evento se reintenta y la entrega continúa; budget no recibe nada nuevo
+	if err := dispatcher.DispatchPending(); err != nil {
+		t.Fatalf("Dispatch failed: %v", err)
+	}
+	if len(all) != 3 || all[1] != EventTransferMade {
+		t.Errorf("Expected webhooks to retry and receive every event, got %v", all)
+	}
+	if len(budget) != 2 {
+		t.Errorf("Expected no duplicate deliveries to budget, got %v", budget)
+	}
+
+	var lastID, latestID int64
+	var attempts int
+	if err := db.QueryRow(`SELECT last_event_id, attempts, (SELECT MAX(id) FROM outbox) FROM outbox_subscribers
+		WHERE subscriber = 'webhooks'`).Scan(&lastID, &attempts, &latestID); err != nil {
+		t.Fatalf("Failed to read subscriber position: %v", err)
+	}
+	if lastID != latestID || attempts != 0 {
+		t.Errorf("Expected webhooks at event %d with no pending attempts, got %d and %d", latestID, lastID, attempts)
+	}
+}
+
+func TestOutboxKeepsDeliveringAfterASubscriberFails(t *testing.T) {
+	db := openTestDB(t)
+	if err := EnsureOutboxTable(db); err != nil {
+		t.Fatalf("Failed to create outbox: %v", err)
+	}
+	if err := PublishEvent(db, EventExpenseCreated, "user-1", 1, nil); err != nil {
+		t.Fatalf("Failed to publish event: %v", err)
+	}
+	// La posición de "ledger" no se puede guardar, como si la base de datos fallara solo para él
+	mustExec(t, db, `CREATE TRIGGER broken_subscriber BEFORE INSERT ON outbox_subscribers
+		WHEN NEW.subscriber = 'ledger' BEGIN SELECT RAISE(ABORT, 'disk I/O error'); END`)
+
+	dispatcher := NewDispatcher(db)
+	var delivered []string
+	for _, name := range []string{"ledger", "budget", "webhooks"} {
+		name := name
+		dispatcher.Subscribe(name, func(event DomainEvent) error {
+			delivered = append(delivered, name)
+			return nil
+		})
+	}
+
+	err := dispatcher.DispatchPending()
+	if err == nil || !strings.Contains(err.Error(), "subscriber ledger") {
+		t.Errorf("Expected the ledger failure to be returned, got %v", err)
+	}
+	if len(delivered) != 2 || delivered[0] != "budget" || delivered[1] != "webhooks" {
+		t.Errorf("Expected the other subscribers to receive the event, got %v", delivered)
+	}
+}
@@ -0,0 +1,157 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DBTX es el subconjunto de métodos que comparten *sql.DB y *sql.Tx,
+// para que las funciones de saldo puedan ejecutarse dentro o fuera de una transacción
+type DBTX interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// PeriodTable describe una de las tablas *_cash_bank_balance y su columna de periodo
+type PeriodTable struct {
+	Period string
+	Table  string
+	Column string
+}
+
+// PeriodTables enumera las seis tablas de saldos por periodo en orden de granularidad
+var PeriodTables = []PeriodTable{
+	{"daily", "daily_cash_bank_balance", "date"},
+	{"weekly", "weekly_cash_bank_balance", "year_week"},
+	{"monthly", "monthly_cash_bank_balance", "year_month"},
+	{"quarterly", "quarterly_cash_bank_balance", "year_quarter"},
+	{"semiannual", "semiannual_cash_bank_balance", "year_half"},
+	{"annual", "annual_cash_bank_balance", "year"},
+}
+
+// PeriodIdentifier devuelve el identificador de periodo con el formato almacenado en la base de datos,
+// con meses naturales y semanas ISO. Para un usuario concreto se usa PeriodSettings.Identifier.
+func PeriodIdentifier(date time.Time, period string) string {
+	return DefaultPeriodSettings.Identifier(date, period)
+}
+
+// PaymentMethodCreditCard identifica los gastos pagados con tarjeta de crédito. Cuentan como
+// gasto al realizarse, pero no afectan a caja ni banco hasta que se paga el extracto.
+const PaymentMethodCreditCard = "credit_card"
+
+// EnsurePeriodBalanceColumns añade a las seis tablas las columnas de flujo que no existían
+// en el esquema original (pagos de extractos de tarjeta, traspasos y ajustes), y a la semanal sus
+// fechas, que no todos los servicios crean
+func EnsurePeriodBalanceColumns(db *sql.DB) error {
+	for _, pt := range PeriodTables {
+		columns := []string{
+			"card_payment_cash_amount REAL DEFAULT 0", "card_payment_bank_amount REAL DEFAULT 0",
+			"transfer_cash_amount REAL DEFAULT 0", "transfer_bank_amount REAL DEFAULT 0",
+			"adjustment_cash_amount REAL DEFAULT 0", "adjustment_bank_amount REAL DEFAULT 0",
+		}
+		if pt.Period == "weekly" {
+			columns = append(columns, "start_date TEXT", "end_date TEXT")
+		}
+		for _, column := range columns {
+			_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s`, pt.Table, column))
+			if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+				return fmt.Errorf("error adding %s to %s: %v", column, pt.Table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CascadePeriodBalances recalcula los saldos acumulados de las seis tablas desde el
+// periodo que contiene from, partiendo del último periodo anterior existente. Solo se
+// escriben las filas cuyo saldo cambia.
+func CascadePeriodBalances(q DBTX, userID string, from time.Time) error {
+	settings, err := LoadPeriodSettings(q, userID)
+	if err != nil {
+		return err
+	}
+	for _, pt := range PeriodTables {
+		if err := cascadeTable(q, pt, userID, settings.Identifier(from, pt.Period)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// periodFlows son los movimientos de un periodo con los que se calcula su saldo.
+// Los traspasos son netos: negativos en la cuenta de origen y positivos en la de destino.
+// Los ajustes son la suma con signo de las correcciones manuales.
+type periodFlows struct {
+	periodID                       string
+	incomeCash, incomeBank         float64
+	expenseCash, expenseBank       float64
+	billCash, billBank             float64
+	cardCash, cardBank             float64
+	transferCash, transferBank     float64
+	adjustmentCash, adjustmentBank float64
+}
+
+// net devuelve la variación de caja y banco del periodo
+func (f periodFlows) net() (cash, bank float64) {
+	cash = f.incomeCash - f.expenseCash - f.billCash - f.cardCash + f.transferCash + f.adjustmentCash
+	bank = f.incomeBank - f.expenseBank - f.billBank - f.cardBank + f.transferBank + f.adjustmentBank
+	return cash, bank
+}
+
+// netCashFlow y netBankFlow son la variación de caja y banco de un periodo en SQL, igual que periodFlows.net
+const (
+	netCashFlow = `COALESCE(income_cash_amount, 0) - COALESCE(expense_cash_amount, 0) - COALESCE(bill_cash_amount, 0)
+		- COALESCE(card_payment_cash_amount, 0) + COALESCE(transfer_cash_amount, 0) + COALESCE(adjustment_cash_amount, 0)`
+	netBankFlow = `COALESCE(income_bank_amount, 0) - COALESCE(expense_bank_amount, 0) - COALESCE(bill_bank_amount, 0)
+		- COALESCE(card_payment_bank_amount, 0) + COALESCE(transfer_bank_amount, 0) + COALESCE(adjustment_bank_amount, 0)`
+)
+
+// cascadeTable recalcula los saldos desde startPeriod con una sola sentencia: el saldo de cada
+// periodo es el del último periodo anterior a startPeriod más la suma acumulada (función de
+// ventana) de las variaciones, y UPDATE ... FROM solo toca las filas cuyo saldo almacenado
+// difiere. Así, mover un gasto dentro del mismo periodo no reescribe nada y llevarlo dos años
+// atrás cuesta una sentencia por tabla en lugar de una por periodo.
+func cascadeTable(q DBTX, pt PeriodTable, userID, startPeriod string) error {
+	_, err := q.Exec(fmt.Sprintf(`
+		UPDATE %[1]s
+		SET cash_amount = r.balance_cash,
+		    bank_amount = r.balance_bank,
+		    previous_cash_amount = r.previous_cash,
+		    previous_bank_amount = r.previous_bank,
+		    balance_cash_amount = r.balance_cash,
+		    balance_bank_amount = r.balance_bank,
+		    total_balance = r.balance_cash + r.balance_bank,
+		    total_previous_balance = r.previous_cash + r.previous_bank,
+		    updated_at = CURRENT_TIMESTAMP
+		FROM (
+			SELECT id,
+			       opening.cash + COALESCE(SUM(net_cash) OVER before, 0) AS previous_cash,
+			       opening.bank + COALESCE(SUM(net_bank) OVER before, 0) AS previous_bank,
+			       opening.cash + SUM(net_cash) OVER running AS balance_cash,
+			       opening.bank + SUM(net_bank) OVER running AS balance_bank
+			FROM (
+				SELECT id, %[2]s AS period_id, %[3]s AS net_cash, %[4]s AS net_bank
+				FROM %[1]s
+				WHERE user_id = ? AND %[2]s >= ?
+			)
+			CROSS JOIN (
+				SELECT COALESCE((SELECT balance_cash_amount FROM %[1]s WHERE user_id = ? AND %[2]s < ? ORDER BY %[2]s DESC LIMIT 1), 0) AS cash,
+				       COALESCE((SELECT balance_bank_amount FROM %[1]s WHERE user_id = ? AND %[2]s < ? ORDER BY %[2]s DESC LIMIT 1), 0) AS bank
+			) AS opening
+			WINDOW running AS (ORDER BY period_id ROWS UNBOUNDED PRECEDING),
+			       before AS (ORDER BY period_id ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING)
+		) AS r
+		WHERE %[1]s.id = r.id
+		  AND (%[1]s.balance_cash_amount IS NOT r.balance_cash OR %[1]s.balance_bank_amount IS NOT r.balance_bank
+		       OR %[1]s.previous_cash_amount IS NOT r.previous_cash OR %[1]s.previous_bank_amount IS NOT r.previous_bank
+		       OR %[1]s.cash_amount IS NOT r.balance_cash OR %[1]s.bank_amount IS NOT r.balance_bank)
+	`, pt.Table, pt.Column, netCashFlow, netBankFlow),
+		userID, startPeriod, userID, startPeriod, userID, startPeriod)
+	if err != nil {
+		return fmt.Errorf("error updating %s balances from %s: %v", pt.Period, startPeriod, err)
+	}
+	return nil
+}
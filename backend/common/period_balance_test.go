@@ -0,0 +1,247 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// historyYears es la antigüedad de los datos del usuario de los benchmarks
+const historyYears = 5
+
+// seedBalanceHistory da al usuario un gasto en efectivo diario, un ingreso mensual por banco y
+// un ajuste manual de caja y otro de banco cada trimestre durante historyYears años hasta today,
+// y proyecta el libro en las seis tablas
+func seedBalanceHistory(tb testing.TB, db *sql.DB, userID string, today time.Time) {
+	tb.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		tb.Fatalf("Failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for day := today.AddDate(-historyYears, 0, 0); !day.After(today); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		mustExec(tb, tx, `INSERT INTO expenses (user_id, amount, date, payment_method) VALUES (?, ?, ?, 'cash')`,
+			userID, float64(5+day.Day()%7), date)
+		if day.Day() == 1 {
+			mustExec(tb, tx, `INSERT INTO incomes (user_id, amount, date, payment_method) VALUES (?, 2500, ?, 'bank')`,
+				userID, date)
+		}
+		if day.Day() == 15 && day.Month()%3 == 0 {
+			mustExec(tb, tx, `INSERT INTO cash_bank_transactions (user_id, transaction_type, amount, date) VALUES (?, ?, 30, ?)`,
+				userID, AdjustmentCash, date)
+			mustExec(tb, tx, `INSERT INTO cash_bank_transactions (user_id, transaction_type, amount, date) VALUES (?, ?, -45, ?)`,
+				userID, AdjustmentBank, date)
+		}
+	}
+	if err := RebuildPeriodBalances(tx, userID); err != nil {
+		tb.Fatalf("Failed to rebuild balances: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		tb.Fatalf("Failed to commit history: %v", err)
+	}
+}
+
+// cascadeRowByRow es el recálculo anterior a cascadeTable, que se conserva como referencia:
+// lee todos los periodos desde startPeriod y reescribe cada fila con su propio UPDATE
+func cascadeRowByRow(q DBTX, userID string, from time.Time) error {
+	settings, err := LoadPeriodSettings(q, userID)
+	if err != nil {
+		return err
+	}
+	for _, pt := range PeriodTables {
+		startPeriod := settings.Identifier(from, pt.Period)
+
+		var prevCash, prevBank float64
+		err := q.QueryRow(fmt.Sprintf(`
+			SELECT COALESCE(balance_cash_amount, 0), COALESCE(balance_bank_amount, 0)
+			FROM %s WHERE user_id = ? AND %s < ? ORDER BY %s DESC LIMIT 1
+		`, pt.Table, pt.Column, pt.Column), userID, startPeriod).Scan(&prevCash, &prevBank)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		rows, err := q.Query(fmt.Sprintf(`
+			SELECT %s,
+			       COALESCE(income_cash_amount, 0), COALESCE(income_bank_amount, 0),
+			       COALESCE(expense_cash_amount, 0), COALESCE(expense_bank_amount, 0),
+			       COALESCE(bill_cash_amount, 0), COALESCE(bill_bank_amount, 0),
+			       COALESCE(card_payment_cash_amount, 0), COALESCE(card_payment_bank_amount, 0),
+			       COALESCE(transfer_cash_amount, 0), COALESCE(transfer_bank_amount, 0),
+			       COALESCE(adjustment_cash_amount, 0), COALESCE(adjustment_bank_amount, 0)
+			FROM %s WHERE user_id = ? AND %s >= ? ORDER BY %s ASC
+		`, pt.Column, pt.Table, pt.Column, pt.Column), userID, startPeriod)
+		if err != nil {
+			return err
+		}
+		var periods []periodFlows
+		for rows.Next() {
+			var f periodFlows
+			if err := rows.Scan(&f.periodID, &f.incomeCash, &f.incomeBank, &f.expenseCash, &f.expenseBank,
+				&f.billCash, &f.billBank, &f.cardCash, &f.cardBank, &f.transferCash, &f.transferBank,
+				&f.adjustmentCash, &f.adjustmentBank); err != nil {
+				rows.Close()
+				return err
+			}
+			periods = append(periods, f)
+		}
+		rows.Close()
+
+		for _, f := range periods {
+			netCash, netBank := f.net()
+			cash, bank := prevCash+netCash, prevBank+netBank
+			_, err := q.Exec(fmt.Sprintf(`
+				UPDATE %s
+				SET cash_amount = ?, bank_amount = ?, previous_cash_amount = ?, previous_bank_amount = ?,
+				    balance_cash_amount = ?, balance_bank_amount = ?, total_balance = ?, total_previous_balance = ?,
+				    updated_at = CURRENT_TIMESTAMP
+				WHERE user_id = ? AND %s = ?
+			`, pt.Table, pt.Column), cash, bank, prevCash, prevBank, cash, bank,
+				cash+bank, prevCash+prevBank, userID, f.periodID)
+			if err != nil {
+				return err
+			}
+			prevCash, prevBank = cash, bank
+		}
+	}
+	return nil
+}
+
+// storedBalances lee todas las columnas de saldo de las seis tablas del usuario
+func storedBalances(tb testing.TB, db *sql.DB, userID string) map[string][]float64 {
+	tb.Helper()
+	balances := map[string][]float64{}
+	for _, pt := range PeriodTables {
+		rows, err := db.Query(fmt.Sprintf(`
+			SELECT %s, previous_cash_amount, previous_bank_amount, balance_cash_amount, balance_bank_amount,
+			       cash_amount, bank_amount, total_previous_balance, total_balance
+			FROM %s WHERE user_id = ?
+		`, pt.Column, pt.Table), userID)
+		if err != nil {
+			tb.Fatalf("Failed to read %s: %v", pt.Table, err)
+		}
+		for rows.Next() {
+			var periodID string
+			values := make([]float64, 8)
+			if err := rows.Scan(&periodID, &values[0], &values[1], &values[2], &values[3],
+				&values[4], &values[5], &values[6], &values[7]); err != nil {
+				tb.Fatalf("Failed to scan %s: %v", pt.Table, err)
+			}
+			balances[pt.Table+"/"+periodID] = values
+		}
+		rows.Close()
+	}
+	return balances
+}
+
+func TestCascadeMatchesRowByRow(t *testing.T) {
+	db := setupLedgerDB(t)
+	today := time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC)
+	seedBalanceHistory(t, db, "user-1", today)
+
+	// Un gasto con dos años de antigüedad cambia el saldo de todos los periodos posteriores
+	backdated := today.AddDate(-2, 0, 0)
+	expenseID := insertMovement(t, db, "expense", "user-1", 120, backdated.Format("2006-01-02"), "cash")
+	incremental := storedBalances(t, db, "user-1")
+
+	// La referencia fila a fila sobre las mismas variaciones da el mismo resultado
+	for _, pt := range PeriodTables {
+		mustExec(t, db, fmt.Sprintf(`UPDATE %s SET balance_cash_amount = 0, balance_bank_amount = 0 WHERE user_id = ?`,
+			pt.Table), "user-1")
+	}
+	if err := cascadeRowByRow(db, "user-1", today.AddDate(-historyYears, 0, 0)); err != nil {
+		t.Fatalf("Reference cascade failed: %v", err)
+	}
+	reference := storedBalances(t, db, "user-1")
+	if len(reference) != len(incremental) {
+		t.Fatalf("Expected %d periods, got %d", len(reference), len(incremental))
+	}
+	for period, want := range reference {
+		got := incremental[period]
+		for i := range want {
+			if math.Abs(got[i]-want[i]) > balanceTolerance {
+				t.Fatalf("Period %s: expected %v, got %v", period, want, got)
+			}
+		}
+	}
+
+	// Mover el gasto al día siguiente solo cambia esos dos días; los posteriores no se reescriben
+	mustExec(t, db, `UPDATE daily_cash_bank_balance SET updated_at = NULL WHERE user_id = ?`, "user-1")
+	recordMovement(t, db, "expense", "user-1", expenseID, 120, backdated.AddDate(0, 0, 1).Format("2006-01-02"), "cash")
+	var rewritten int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM daily_cash_bank_balance WHERE user_id = ? AND updated_at IS NOT NULL`,
+		"user-1").Scan(&rewritten); err != nil {
+		t.Fatalf("Failed to count rewritten rows: %v", err)
+	}
+	if rewritten != 2 {
+		t.Errorf("Expected only the two affected days to be written, got %d rows", rewritten)
+	}
+}
+
+// benchmarkBackdatedCascade mide el recálculo tras sumar y restar alternativamente un gasto
+// con dos años de antigüedad a un usuario con cinco años de datos
+func benchmarkBackdatedCascade(b *testing.B, cascade func(q DBTX, userID string, from time.Time) error) {
+	db := setupLedgerDB(b)
+	today := time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC)
+	seedBalanceHistory(b, db, "user-1", today)
+	settings, err := LoadPeriodSettings(db, "user-1")
+	if err != nil {
+		b.Fatalf("Failed to load settings: %v", err)
+	}
+	entry := LedgerEntry{Date: today.AddDate(-2, 0, 0), Kind: LedgerExpense, PaymentMethod: "cash", Amount: 120}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sign := 1.0
+		if i%2 == 1 {
+			sign = -1
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			b.Fatalf("Failed to start transaction: %v", err)
+		}
+		if err := applyLedgerEntry(tx, settings, "user-1", entry, sign); err != nil {
+			b.Fatalf("Failed to apply entry: %v", err)
+		}
+		if err := cascade(tx, "user-1", entry.Date); err != nil {
+			b.Fatalf("Cascade failed: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatalf("Failed to commit: %v", err)
+		}
+	}
+}
+
+func BenchmarkBackdatedCascade(b *testing.B) {
+	b.Run("row_by_row", func(b *testing.B) { benchmarkBackdatedCascade(b, cascadeRowByRow) })
+	b.Run("set_based", func(b *testing.B) { benchmarkBackdatedCascade(b, CascadePeriodBalances) })
+}
+
+// BenchmarkCascadeWithoutChanges mide el recálculo desde hace dos años cuando ningún saldo
+// cambia (p. ej. se edita la descripción de un gasto): la versión por conjuntos no escribe filas
+func BenchmarkCascadeWithoutChanges(b *testing.B) {
+	cascades := []struct {
+		name    string
+		cascade func(q DBTX, userID string, from time.Time) error
+	}{
+		{"row_by_row", cascadeRowByRow},
+		{"set_based", CascadePeriodBalances},
+	}
+	for _, c := range cascades {
+		b.Run(c.name, func(b *testing.B) {
+			db := setupLedgerDB(b)
+			today := time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC)
+			seedBalanceHistory(b, db, "user-1", today)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.cascade(db, "user-1", today.AddDate(-2, 0, 0)); err != nil {
+					b.Fatalf("Cascade failed: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PeriodSettings define cómo agrupa un usuario sus movimientos en periodos.
+// Con MonthStartDay = 25 el "mes" va del 25 al 24 del mes siguiente y se etiqueta con el
+// mes en el que termina (del 25 de enero al 24 de febrero es "2025-02"). Trimestres,
+// semestres y años se construyen a partir de esos meses.
+// Las semanas empiezan en WeekStartDay y se identifican con la semana ISO de su lunes.
+type PeriodSettings struct {
+	MonthStartDay int          `json:"month_start_day"`
+	WeekStartDay  time.Weekday `json:"week_start_day"` // 0 = domingo, 1 = lunes
+}
+
+// DefaultPeriodSettings son meses naturales y semanas ISO, el comportamiento original
+var DefaultPeriodSettings = PeriodSettings{MonthStartDay: 1, WeekStartDay: time.Monday}
+
+// MaxMonthStartDay evita ciclos que no existen en febrero
+const MaxMonthStartDay = 28
+
+// Validate comprueba que los valores están dentro de rango
+func (s PeriodSettings) Validate() error {
+	if s.MonthStartDay < 1 || s.MonthStartDay > MaxMonthStartDay {
+		return fmt.Errorf("month_start_day must be between 1 and %d", MaxMonthStartDay)
+	}
+	if s.WeekStartDay < time.Sunday || s.WeekStartDay > time.Saturday {
+		return fmt.Errorf("week_start_day must be between 0 (Sunday) and 6 (Saturday)")
+	}
+	return nil
+}
+
+// IsDefault indica si el usuario usa meses naturales y semanas de lunes a domingo
+func (s PeriodSettings) IsDefault() bool {
+	return s == DefaultPeriodSettings
+}
+
+// monthLabel devuelve el día 1 del mes con el que se etiqueta el ciclo que contiene date
+func (s PeriodSettings) monthLabel(date time.Time) time.Time {
+	label := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if s.MonthStartDay > 1 && date.Day() >= s.MonthStartDay {
+		label = label.AddDate(0, 1, 0)
+	}
+	return label
+}
+
+// cycleStart devuelve el primer día del ciclo etiquetado con el mes de label
+func (s PeriodSettings) cycleStart(label time.Time) time.Time {
+	start := time.Date(label.Year(), label.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if s.MonthStartDay > 1 {
+		start = time.Date(label.Year(), label.Month()-1, s.MonthStartDay, 0, 0, 0, 0, time.UTC)
+	}
+	return start
+}
+
+// WeekStart devuelve el primer día de la semana que contiene date
+func (s PeriodSettings) WeekStart(date time.Time) time.Time {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	offset := (int(day.Weekday()) - int(s.WeekStartDay) + 7) % 7
+	return day.AddDate(0, 0, -offset)
+}
+
+// Identifier devuelve el identificador del periodo que contiene date con el formato
+// almacenado en las tablas *_cash_bank_balance
+func (s PeriodSettings) Identifier(date time.Time, period string) string {
+	label := s.monthLabel(date)
+
+	switch period {
+	case "daily":
+		return date.Format("2006-01-02")
+	case "weekly":
+		// El lunes de la semana decide su número ISO
+		start := s.WeekStart(date)
+		monday := start.AddDate(0, 0, (int(time.Monday)-int(start.Weekday())+7)%7)
+		year, week := monday.ISOWeek()
+		return fmt.Sprintf("%d-%02d", year, week)
+	case "monthly":
+		return label.Format("2006-01")
+	case "quarterly":
+		quarter := (int(label.Month())-1)/3 + 1
+		return fmt.Sprintf("%d-Q%d", label.Year(), quarter)
+	case "semiannual":
+		half := (int(label.Month())-1)/6 + 1
+		return fmt.Sprintf("%d-H%d", label.Year(), half)
+	case "annual":
+		return label.Format("2006")
+	default:
+		return label.Format("2006-01")
+	}
+}
+
+// Range devuelve el primer y el último día (ambos incluidos) del periodo que contiene date
+func (s PeriodSettings) Range(period string, date time.Time) (time.Time, time.Time) {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	label := s.monthLabel(day)
+
+	var firstMonth time.Time
+	months := 1
+	switch period {
+	case "daily":
+		return day, day
+	case "weekly":
+		start := s.WeekStart(day)
+		return start, start.AddDate(0, 0, 6)
+	case "quarterly":
+		firstMonth = time.Date(label.Year(), time.Month((int(label.Month())-1)/3*3+1), 1, 0, 0, 0, 0, time.UTC)
+		months = 3
+	case "semiannual":
+		firstMonth = time.Date(label.Year(), time.Month((int(label.Month())-1)/6*6+1), 1, 0, 0, 0, 0, time.UTC)
+		months = 6
+	case "annual":
+		firstMonth = time.Date(label.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+		months = 12
+	default:
+		firstMonth = label
+	}
+
+	start := s.cycleStart(firstMonth)
+	end := s.cycleStart(firstMonth.AddDate(0, months, 0)).AddDate(0, 0, -1)
+	return start, end
+}
+
+// EnsurePeriodSettingsTable crea la tabla de ajustes de periodo y el libro de saldos
+// que necesita RebuildPeriodBalances
+func EnsurePeriodSettingsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_period_settings (
+			user_id TEXT PRIMARY KEY,
+			month_start_day INTEGER NOT NULL DEFAULT 1,
+			week_start_day INTEGER NOT NULL DEFAULT 1,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating user_period_settings table: %v", err)
+	}
+	return EnsureLedgerTable(db)
+}
+
+// LoadPeriodSettings devuelve los ajustes del usuario, o los de por defecto si no tiene
+func LoadPeriodSettings(q DBTX, userID string) (PeriodSettings, error) {
+	settings := DefaultPeriodSettings
+	var weekStart int
+	err := q.QueryRow(`
+		SELECT month_start_day, week_start_day FROM user_period_settings WHERE user_id = ?
+	`, userID).Scan(&settings.MonthStartDay, &weekStart)
+	if err == sql.ErrNoRows || (err != nil && strings.Contains(err.Error(), "no such table")) {
+		return DefaultPeriodSettings, nil
+	}
+	if err != nil {
+		return DefaultPeriodSettings, fmt.Errorf("error fetching period settings: %v", err)
+	}
+	settings.WeekStartDay = time.Weekday(weekStart)
+	return settings, nil
+}
+
+// SavePeriodSettings guarda los ajustes del usuario. Devuelve si han cambiado, en cuyo caso
+// hay que reconstruir sus saldos con RebuildPeriodBalances.
+func SavePeriodSettings(q DBTX, userID string, settings PeriodSettings) (bool, error) {
+	if err := settings.Validate(); err != nil {
+		return false, err
+	}
+	current, err := LoadPeriodSettings(q, userID)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = q.Exec(`
+		INSERT INTO user_period_settings (user_id, month_start_day, week_start_day, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (user_id) DO UPDATE SET
+			month_start_day = excluded.month_start_day,
+			week_start_day = excluded.week_start_day,
+			updated_at = CURRENT_TIMESTAMP
+	`, userID, settings.MonthStartDay, int(settings.WeekStartDay))
+	if err != nil {
+		return false, fmt.Errorf("error saving period settings: %v", err)
+	}
+	return current != settings, nil
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func parseDay(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+func TestPeriodSettingsIdentifier(t *testing.T) {
+	payday := PeriodSettings{MonthStartDay: 25, WeekStartDay: time.Monday}
+	sunday := PeriodSettings{MonthStartDay: 1, WeekStartDay: time.Sunday}
+
+	tests := []struct {
+		name     string
+		settings PeriodSettings
+		date     string
+		period   string
+		want     string
+	}{
+		{"natural month", DefaultPeriodSettings, "2025-01-31", "monthly", "2025-01"},
+		{"day before the cycle starts", payday, "2025-01-24", "monthly", "2025-01"},
+		{"first day of the cycle", payday, "2025-01-25", "monthly", "2025-02"},
+		{"cycle crossing the year", payday, "2024-12-25", "monthly", "2025-01"},
+		{"quarter of a crossing cycle", payday, "2024-12-25", "quarterly", "2025-Q1"},
+		{"year of a crossing cycle", payday, "2024-12-26", "annual", "2025"},
+		{"daily ignores the cycle", payday, "2025-01-25", "daily", "2025-01-25"},
+		{"ISO week", DefaultPeriodSettings, "2025-01-05", "weekly", "2025-01"},
+		{"Sunday starts a new week", sunday, "2025-01-05", "weekly", "2025-02"},
+		{"Saturday ends the week", sunday, "2025-01-04", "weekly", "2025-01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.Identifier(parseDay(tt.date), tt.period); got != tt.want {
+				t.Errorf("Identifier(%s, %s) = %s, want %s", tt.date, tt.period, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeriodSettingsRange(t *testing.T) {
+	payday := PeriodSettings{MonthStartDay: 25, WeekStartDay: time.Monday}
+	sunday := PeriodSettings{MonthStartDay: 1, WeekStartDay: time.Sunday}
+
+	tests := []struct {
+		name      string
+		settings  PeriodSettings
+		period    string
+		date      string
+		wantStart string
+		wantEnd   string
+	}{
+		{"natural month", DefaultPeriodSettings, "monthly", "2025-02-10", "2025-02-01", "2025-02-28"},
+		{"cycle from the 25th", payday, "monthly", "2025-02-10", "2025-01-25", "2025-02-24"},
+		{"first day of the cycle", payday, "monthly", "2025-01-25", "2025-01-25", "2025-02-24"},
+		{"quarter of cycles", payday, "quarterly", "2025-02-10", "2024-12-25", "2025-03-24"},
+		{"year of cycles", payday, "annual", "2025-06-01", "2024-12-25", "2025-12-24"},
+		{"week from Sunday", sunday, "weekly", "2025-01-08", "2025-01-05", "2025-01-11"},
+		{"Sunday is its own week start", sunday, "weekly", "2025-01-05", "2025-01-05", "2025-01-11"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := tt.settings.Range(tt.period, parseDay(tt.date))
+			if start.Format("2006-01-02") != tt.wantStart || end.Format("2006-01-02") != tt.wantEnd {
+				t.Errorf("Range(%s, %s) = %s..%s, want %s..%s", tt.period, tt.date,
+					start.Format("2006-01-02"), end.Format("2006-01-02"), tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+
+	// Cada día del ciclo tiene el identificador del rango
+	start, end := payday.Range("monthly", parseDay("2025-02-10"))
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		if got := payday.Identifier(day, "monthly"); got != "2025-02" {
+			t.Errorf("Expected %s to be in 2025-02, got %s", day.Format("2006-01-02"), got)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frecuencias de una regla de recurrencia, con los nombres de RRULE (RFC 5545)
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+)
+
+// Ajustes de una fecha que cae en fin de semana
+const (
+	BusinessDayNone              = ""
+	BusinessDayFollowing         = "following"          // al lunes siguiente
+	BusinessDayPreceding         = "preceding"          // al viernes anterior
+	BusinessDayModifiedFollowing = "modified_following" // al lunes siguiente salvo que cambie de mes
+)
+
+// LastDayOfMonth como día de pago indica el último día de cada mes
+const LastDayOfMonth = -1
+
+// regularityPresets traduce las periodicidades que guarda bills.regularity a una regla
+var regularityPresets = map[string]Recurrence{
+	"daily":      {Freq: FreqDaily, Interval: 1},
+	"weekly":     {Freq: FreqWeekly, Interval: 1},
+	"biweekly":   {Freq: FreqWeekly, Interval: 2},
+	"monthly":    {Freq: FreqMonthly, Interval: 1},
+	"bimonthly":  {Freq: FreqMonthly, Interval: 2},
+	"quarterly":  {Freq: FreqMonthly, Interval: 3},
+	"semiannual": {Freq: FreqMonthly, Interval: 6},
+	"annual":     {Freq: FreqYearly, Interval: 1},
+	"yearly":     {Freq: FreqYearly, Interval: 1},
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+// Recurrence es el subconjunto de RRULE que admiten las facturas: FREQ, INTERVAL, COUNT,
+// UNTIL, BYMONTHDAY (un solo día, -1 para el último) y BYDAY (solo semanal)
+type Recurrence struct {
+	Freq       string
+	Interval   int
+	Count      int            // 0 = sin límite de repeticiones
+	Until      time.Time      // cero = sin fecha final
+	ByMonthDay int            // 0 = el día de la fecha de inicio
+	ByDay      []time.Weekday // vacío = el día de la semana de la fecha de inicio
+}
+
+// ParseRecurrence interpreta bills.regularity: uno de los nombres de regularityPresets o una
+// regla "RRULE:FREQ=...;..." (el prefijo es opcional). Vacío equivale a "monthly".
+func ParseRecurrence(regularity string) (Recurrence, error) {
+	value := strings.TrimSpace(regularity)
+	if value == "" {
+		value = "monthly"
+	}
+	if preset, ok := regularityPresets[strings.ToLower(value)]; ok {
+		return preset, nil
+	}
+
+	rule := Recurrence{Interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.ToUpper(value), "RRULE:"), ";") {
+		if part == "" {
+			continue
+		}
+		name, arg, ok := strings.Cut(part, "=")
+		if !ok {
+			return Recurrence{}, fmt.Errorf("invalid recurrence %q: %q", regularity, part)
+		}
+		var err error
+		switch name {
+		case "FREQ":
+			rule.Freq = arg
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(arg)
+			if err == nil && rule.Interval < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(arg)
+			if err == nil && rule.Count < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "UNTIL":
+			rule.Until, err = parseRuleDate(arg)
+		case "BYMONTHDAY":
+			rule.ByMonthDay, err = strconv.Atoi(arg)
+			if err == nil && (rule.ByMonthDay == 0 || rule.ByMonthDay < LastDayOfMonth || rule.ByMonthDay > 31) {
+				err = fmt.Errorf("must be between 1 and 31, or -1")
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(arg, ",") {
+				weekday, ok := rruleWeekdays[day]
+				if !ok {
+					err = fmt.Errorf("unknown day %q", day)
+					break
+				}
+				rule.ByDay = append(rule.ByDay, weekday)
+			}
+		case "WKST":
+			// Las semanas empiezan siempre en lunes
+		default:
+			err = fmt.Errorf("not supported")
+		}
+		if err != nil {
+			return Recurrence{}, fmt.Errorf("invalid recurrence %q: %s: %v", regularity, name, err)
+		}
+	}
+
+	switch rule.Freq {
+	case FreqDaily, FreqMonthly, FreqYearly:
+		if len(rule.ByDay) > 0 {
+			return Recurrence{}, fmt.Errorf("invalid recurrence %q: BYDAY is only supported with FREQ=WEEKLY", regularity)
+		}
+	case FreqWeekly:
+	default:
+		return Recurrence{}, fmt.Errorf("invalid recurrence %q: unknown FREQ %q", regularity, rule.Freq)
+	}
+	return rule, nil
+}
+
+func parseRuleDate(value string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102", "2006-01-02"} {
+		if date, err := time.Parse(layout, value); err == nil {
+			return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// Bounded indica si la regla termina por sí misma
+func (r Recurrence) Bounded() bool {
+	return r.Count > 0 || !r.Until.IsZero()
+}
+
+// monthBased indica si hay como mucho una repetición por mes, que entonces se identifica por
+// el mes (YYYY-MM) como hasta ahora
+func (r Recurrence) monthBased() bool {
+	return r.Freq == FreqMonthly || r.Freq == FreqYearly
+}
+
+// ValidBusinessDayAdjustment comprueba un valor de bills.business_day_adjustment
+func ValidBusinessDayAdjustment(adjustment string) bool {
+	switch adjustment {
+	case BusinessDayNone, BusinessDayFollowing, BusinessDayPreceding, BusinessDayModifiedFollowing:
+		return true
+	}
+	return false
+}
+
+// AdjustBusinessDay mueve una fecha de sábado o domingo al día hábil que indica adjustment
+func AdjustBusinessDay(date time.Time, adjustment string) time.Time {
+	if date.Weekday() != time.Saturday && date.Weekday() != time.Sunday {
+		return date
+	}
+	forward := date.AddDate(0, 0, 2)
+	if date.Weekday() == time.Sunday {
+		forward = date.AddDate(0, 0, 1)
+	}
+	backward := date.AddDate(0, 0, -1)
+	if date.Weekday() == time.Sunday {
+		backward = date.AddDate(0, 0, -2)
+	}
+
+	switch adjustment {
+	case BusinessDayFollowing:
+		return forward
+	case BusinessDayPreceding:
+		return backward
+	case BusinessDayModifiedFollowing:
+		if forward.Month() != date.Month() {
+			return backward
+		}
+		return forward
+	}
+	return date
+}
+
+// Occurrence es una repetición de un calendario
+type Occurrence struct {
+	Index   int       // posición desde la primera, empezando en 0
+	Key     string    // YYYY-MM si la regla es mensual o anual, YYYY-MM-DD (fecha nominal) si no
+	Nominal time.Time // fecha según la regla
+	Date    time.Time // fecha de vencimiento tras el ajuste a día hábil
+}
+
+// DateString es la fecha de vencimiento en formato YYYY-MM-DD
+func (o Occurrence) DateString() string {
+	return o.Date.Format("2006-01-02")
+}
+
+// Schedule es el calendario de una factura. Las repeticiones no se guardan: se calculan
+// bajo demanda dentro de una ventana, así que un calendario puede no terminar nunca.
+type Schedule struct {
+	Start      time.Time
+	Rule       Recurrence
+	Adjustment string
+	End        time.Time // primera fecha nominal excluida; cero = sin fin salvo COUNT o UNTIL
+}
+
+// OpenEnded indica si el calendario no termina nunca
+func (s Schedule) OpenEnded() bool {
+	return s.End.IsZero() && !s.Rule.Bounded()
+}
+
+// BillSchedule construye el calendario de una factura a partir de sus columnas. paymentDay
+// 0 toma el día de startDate y LastDayOfMonth el último de cada mes; los días que no
+// existen en un mes se llevan al último. durationMonths 0 deja la factura sin fin.
+func BillSchedule(startDate string, paymentDay, durationMonths int, regularity, adjustment string) (Schedule, error) {
+	start, err := time.Parse("2006-01-02", startDate[:min(len(startDate), 10)])
+	if err != nil {
+		return Schedule{}, fmt.Errorf("invalid start date %q", startDate)
+	}
+	rule, err := ParseRecurrence(regularity)
+	if err != nil {
+		return Schedule{}, err
+	}
+	if paymentDay < LastDayOfMonth || paymentDay > 31 {
+		return Schedule{}, fmt.Errorf("invalid payment day %d", paymentDay)
+	}
+	if durationMonths < 0 {
+		return Schedule{}, fmt.Errorf("invalid duration %d", durationMonths)
+	}
+	if !ValidBusinessDayAdjustment(adjustment) {
+		return Schedule{}, fmt.Errorf("invalid business day adjustment %q", adjustment)
+	}
+	if rule.ByMonthDay == 0 && rule.monthBased() {
+		rule.ByMonthDay = paymentDay
+	}
+
+	schedule := Schedule{Start: start, Rule: rule, Adjustment: adjustment}
+	if durationMonths > 0 {
+		// La duración cuenta meses completos desde el mes de inicio
+		schedule.End = time.Date(start.Year(), start.Month()+time.Month(durationMonths), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return schedule, nil
+}
+
+// nominal devuelve las fechas del paso step de la regla: una, o las de BYDAY en esa semana
+// (ninguna si todas son anteriores a la fecha de inicio)
+func (s Schedule) nominal(step int) []time.Time {
+	rule := s.Rule
+	switch rule.Freq {
+	case FreqDaily:
+		return []time.Time{s.Start.AddDate(0, 0, step*rule.Interval)}
+	case FreqWeekly:
+		if len(rule.ByDay) == 0 {
+			return []time.Time{s.Start.AddDate(0, 0, 7*step*rule.Interval)}
+		}
+		// Semana de lunes a domingo que contiene la fecha de inicio, avanzada step intervalos
+		monday := s.Start.AddDate(0, 0, -((int(s.Start.Weekday())+6)%7)+7*step*rule.Interval)
+		var dates []time.Time
+		for offset := 0; offset < 7; offset++ {
+			day := monday.AddDate(0, 0, offset)
+			for _, weekday := range rule.ByDay {
+				if day.Weekday() == weekday && !day.Before(s.Start) {
+					dates = append(dates, day)
+				}
+			}
+		}
+		return dates
+	default:
+		months := step * rule.Interval
+		if rule.Freq == FreqYearly {
+			months *= 12
+		}
+		first := time.Date(s.Start.Year(), s.Start.Month()+time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+		lastDay := first.AddDate(0, 1, -1).Day()
+		day := rule.ByMonthDay
+		if day == 0 {
+			day = s.Start.Day()
+		}
+		if day == LastDayOfMonth || day > lastDay {
+			day = lastDay
+		}
+		return []time.Time{first.AddDate(0, 0, day-1)}
+	}
+}
+
+// Walk recorre las repeticiones en orden hasta que fn devuelve false o el calendario termina
+func (s Schedule) Walk(fn func(Occurrence) bool) {
+	index := 0
+	for step := 0; ; step++ {
+		for _, date := range s.nominal(step) {
+			if (!s.End.IsZero() && !date.Before(s.End)) ||
+				(!s.Rule.Until.IsZero() && date.After(s.Rule.Until)) ||
+				(s.Rule.Count > 0 && index >= s.Rule.Count) {
+				return
+			}
+			occurrence := Occurrence{Index: index, Nominal: date, Date: AdjustBusinessDay(date, s.Adjustment)}
+			if s.Rule.monthBased() {
+				occurrence.Key = date.Format("2006-01")
+			} else {
+				occurrence.Key = date.Format("2006-01-02")
+			}
+			if !fn(occurrence) {
+				return
+			}
+			index++
+		}
+	}
+}
+
+// Occurrences devuelve las repeticiones que vencen entre from y to, ambos incluidos
+func (s Schedule) Occurrences(from, to time.Time) []Occurrence {
+	var occurrences []Occurrence
+	// El ajuste mueve una fecha como mucho dos días, así que basta con mirar hasta to + 3
+	limit := to.AddDate(0, 0, 3)
+	s.Walk(func(o Occurrence) bool {
+		if o.Nominal.After(limit) {
+			return false
+		}
+		if !o.Date.Before(from) && !o.Date.After(to) {
+			occurrences = append(occurrences, o)
+		}
+		return true
+	})
+	return occurrences
+}
+
+// All devuelve todas las repeticiones de un calendario que termina, o false si no termina
+func (s Schedule) All() ([]Occurrence, bool) {
+	if s.OpenEnded() {
+		return nil, false
+	}
+	var occurrences []Occurrence
+	s.Walk(func(o Occurrence) bool {
+		occurrences = append(occurrences, o)
+		return true
+	})
+	return occurrences, true
+}
+
+// Find devuelve la repetición con la clave indicada
+func (s Schedule) Find(key string) (Occurrence, bool) {
+	layout := "2006-01-02"
+	if s.Rule.monthBased() {
+		layout = "2006-01"
+	}
+	date, err := time.Parse(layout, key)
+	if err != nil || len(key) != len(layout) {
+		return Occurrence{}, false
+	}
+	limit := date.AddDate(0, 1, 0)
+
+	var found Occurrence
+	ok := false
+	s.Walk(func(o Occurrence) bool {
+		if o.Key == key {
+			found, ok = o, true
+		}
+		return !ok && o.Nominal.Before(limit)
+	})
+	return found, ok
+}
+
+// Next devuelve la primera repetición que vence en after o más tarde
+func (s Schedule) Next(after time.Time) (Occurrence, bool) {
+	var found Occurrence
+	ok := false
+	s.Walk(func(o Occurrence) bool {
+		if !o.Date.Before(after) {
+			found, ok = o, true
+		}
+		return !ok
+	})
+	return found, ok
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func occurrenceDates(occurrences []Occurrence) string {
+	var dates []string
+	for _, o := range occurrences {
+		dates = append(dates, o.DateString())
+	}
+	return strings.Join(dates, " ")
+}
+
+func TestBillScheduleOccurrences(t *testing.T) {
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name       string
+		start      string
+		paymentDay int
+		months     int
+		regularity string
+		adjustment string
+		want       string
+	}{
+		{"monthly bounded by duration", "2025-01-05", 5, 3, "monthly", "", "2025-01-05 2025-02-05 2025-03-05"},
+		{"last day of month", "2025-01-31", LastDayOfMonth, 3, "monthly", "", "2025-01-31 2025-02-28 2025-03-31"},
+		{"day 31 capped in short months", "2025-03-31", 31, 2, "monthly", "", "2025-03-31 2025-04-30"},
+		{"quarterly", "2025-02-10", 10, 12, "quarterly", "", "2025-02-10 2025-05-10 2025-08-10 2025-11-10"},
+		{"annual", "2024-02-29", 29, 0, "annual", "", "2025-02-28"},
+		{"biweekly", "2025-11-03", 0, 2, "biweekly", "", "2025-11-03 2025-11-17 2025-12-01 2025-12-15 2025-12-29"},
+		{"rrule weekly by day with count", "2025-12-03", 0, 0, "RRULE:FREQ=WEEKLY;BYDAY=MO,FR;COUNT=4", "",
+			"2025-12-05 2025-12-08 2025-12-12 2025-12-15"},
+		{"rrule until", "2025-10-15", 0, 0, "FREQ=MONTHLY;BYMONTHDAY=-1;UNTIL=20251201", "", "2025-10-31 2025-11-30"},
+		// 2025-05-31 y 2025-08-31 son sábado y domingo; el siguiente día hábil ya es de otro mes
+		{"following", "2025-05-31", 31, 4, "monthly", BusinessDayFollowing, "2025-06-02 2025-06-30 2025-07-31 2025-09-01"},
+		{"modified following", "2025-05-31", 31, 4, "monthly", BusinessDayModifiedFollowing, "2025-05-30 2025-06-30 2025-07-31 2025-08-29"},
+	}
+	for _, c := range cases {
+		schedule, err := BillSchedule(c.start, c.paymentDay, c.months, c.regularity, c.adjustment)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := occurrenceDates(schedule.Occurrences(from, to)); got != c.want {
+			t.Errorf("%s: expected %s, got %s", c.name, c.want, got)
+		}
+	}
+
+	// Una factura sin fin se puede recorrer en cualquier ventana
+	schedule, _ := BillSchedule("2020-01-15", 15, 0, "weekly", "")
+	if _, bounded := schedule.All(); bounded {
+		t.Errorf("Expected an open-ended schedule")
+	}
+	next, ok := schedule.Next(time.Date(2040, 6, 1, 0, 0, 0, 0, time.UTC))
+	if !ok || next.DateString() != "2040-06-06" || next.Key != "2040-06-06" {
+		t.Errorf("Expected the next weekly occurrence on 2040-06-06, got %+v", next)
+	}
+
+	for _, regularity := range []string{"fortnightly", "FREQ=HOURLY", "FREQ=MONTHLY;BYDAY=MO", "FREQ=WEEKLY;COUNT=0"} {
+		if _, err := ParseRecurrence(regularity); err == nil {
+			t.Errorf("Expected %q to be rejected", regularity)
+		}
+	}
+}
+
+func TestBillOccurrencesExpandLazily(t *testing.T) {
+	db := setupLedgerDB(t)
+
+	// Factura mensual sin fin: solo se generan los pagos hasta el horizonte
+	billID, err := AddBill(db, "1", "Internet", 40, "2025-01-31", LastDayOfMonth, 0, "bank", "utilities", "🌐", "monthly")
+	if err != nil {
+		t.Fatalf("Failed to add bill: %v", err)
+	}
+	horizon := BillHorizon(db, "1")
+	var count int
+	var lastDue string
+	db.QueryRow(`SELECT COUNT(*), MAX(due_date) FROM bill_payments WHERE bill_id = ?`, billID).Scan(&count, &lastDue)
+	if lastDue > horizon.Format("2006-01-02") || count == 0 {
+		t.Fatalf("Expected payments up to %s, got %d ending %s", horizon.Format("2006-01-02"), count, lastDue)
+	}
+
+	// Volver a expandir no duplica pagos ni reservas
+	if err := ExpandBillOccurrences(db, "1", horizon); err != nil {
+		t.Fatalf("Failed to expand bills: %v", err)
+	}
+	var again, reserved int
+	db.QueryRow(`SELECT COUNT(*) FROM bill_payments WHERE bill_id = ?`, billID).Scan(&again)
+	db.QueryRow(`SELECT COUNT(*) FROM balance_ledger WHERE source_type = ? AND kind = ?`,
+		LedgerSourceBillPayment, LedgerPendingBill).Scan(&reserved)
+	if again != count || reserved != count {
+		t.Errorf("Expected %d payments and reservations, got %d and %d", count, again, reserved)
+	}
+
+	// Una repetición fuera del horizonte se puede pagar por adelantado y no se vuelve a reservar
+	ahead := horizon.AddDate(1, 0, 0).Format("2006-01")
+	if err := MarkBillPaid(db, billID, "1", ahead); err != nil {
+		t.Fatalf("Failed to pay ahead: %v", err)
+	}
+	if err := MarkBillPaid(db, billID, "1", "1999-01"); err != ErrBillPaymentNotFound {
+		t.Errorf("Expected a period outside the schedule to be rejected, got %v", err)
+	}
+	if err := ExpandBillOccurrences(db, "1", horizon.AddDate(2, 0, 0)); err != nil {
+		t.Fatalf("Failed to expand bills: %v", err)
+	}
+	var paid bool
+	db.QueryRow(`SELECT paid FROM bill_payments WHERE bill_id = ? AND year_month = ?`, billID, ahead).Scan(&paid)
+	if !paid {
+		t.Errorf("Expected the payment made ahead to stay paid")
+	}
+	db.QueryRow(`SELECT paid FROM bills WHERE id = ?`, billID).Scan(&paid)
+	if paid {
+		t.Errorf("Expected an open-ended bill never to be completed")
+	}
+}
@@ -0,0 +1,76 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EnsureUserTimezoneColumn añade a users la zona horaria IANA del dispositivo (p. ej. "America/Mexico_City")
+func EnsureUserTimezoneColumn(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE users ADD COLUMN timezone TEXT`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return fmt.Errorf("error adding timezone column to users: %v", err)
+	}
+	return nil
+}
+
+// NormalizeTimezone valida un nombre de zona IANA y lo devuelve sin espacios
+func NormalizeTimezone(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "Local" {
+		return "", fmt.Errorf("invalid time zone: %q", name)
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return "", fmt.Errorf("invalid time zone: %q", name)
+	}
+	return name, nil
+}
+
+// SetUserTimezone guarda la zona horaria del usuario
+func SetUserTimezone(q DBTX, userID, name string) error {
+	name, err := NormalizeTimezone(name)
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec(`UPDATE users SET timezone = ? WHERE id = ?`, name, userID); err != nil {
+		return fmt.Errorf("error saving time zone: %v", err)
+	}
+	return nil
+}
+
+// UserLocation devuelve la zona horaria del usuario. Sin zona guardada (usuarios anteriores o
+// sin columna todavía) se mantiene la del servidor, como hasta ahora.
+func UserLocation(q DBTX, userID string) *time.Location {
+	var name sql.NullString
+	if err := q.QueryRow(`SELECT timezone FROM users WHERE id = ?`, userID).Scan(&name); err != nil || !name.Valid {
+		return time.Local
+	}
+	location, err := time.LoadLocation(name.String)
+	if err != nil || name.String == "" {
+		return time.Local
+	}
+	return location
+}
+
+// UserNow es la hora actual en la zona del usuario
+func UserNow(q DBTX, userID string) time.Time {
+	return time.Now().In(UserLocation(q, userID))
+}
+
+// UserToday es la fecha de hoy (YYYY-MM-DD) para el usuario; es la fecha por defecto de sus movimientos
+func UserToday(q DBTX, userID string) string {
+	return UserDate(q, userID, time.Now())
+}
+
+// UserDate es el día de calendario (YYYY-MM-DD) del usuario en el instante t, que puede no
+// coincidir con el de UTC: las 05:30 UTC son todavía el día anterior en México
+func UserDate(q DBTX, userID string, t time.Time) string {
+	return t.In(UserLocation(q, userID)).Format("2006-01-02")
+}
+
+// DateOnly descarta la hora y la zona: las fechas de movimientos son días de calendario del usuario
+func DateOnly(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupTimezoneDB crea una tabla users con un usuario en México y otro sin zona guardada
+func setupTimezoneDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	mustExec(t, db, `CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)`)
+	mustExec(t, db, `INSERT INTO users (name) VALUES ('mexico'), ('legacy')`)
+	if err := EnsureUserTimezoneColumn(db); err != nil {
+		t.Fatalf("Failed to add timezone column: %v", err)
+	}
+	// Añadir la columna otra vez no falla
+	if err := EnsureUserTimezoneColumn(db); err != nil {
+		t.Fatalf("Expected adding the column twice to be ignored, got %v", err)
+	}
+	if err := SetUserTimezone(db, "1", " America/Mexico_City "); err != nil {
+		t.Fatalf("Failed to save time zone: %v", err)
+	}
+	return db
+}
+
+func TestUserDateUsesTheUserTimezone(t *testing.T) {
+	db := setupTimezoneDB(t)
+
+	// Las 23:30 del 9 de marzo en Ciudad de México son ya el 10 en UTC
+	instant := time.Date(2025, 3, 10, 5, 30, 0, 0, time.UTC)
+	if got := UserDate(db, "1", instant); got != "2025-03-09" {
+		t.Errorf("Expected the Mexico user to still be on 2025-03-09, got %s", got)
+	}
+	if got := instant.Format("2006-01-02"); got != "2025-03-10" {
+		t.Fatalf("Expected the UTC date to be 2025-03-10, got %s", got)
+	}
+	if got := UserLocation(db, "1").String(); got != "America/Mexico_City" {
+		t.Errorf("Expected the stored time zone to be trimmed, got %q", got)
+	}
+}
+
+func TestUserLocationFallsBackToServerTime(t *testing.T) {
+	db := setupTimezoneDB(t)
+	instant := time.Date(2025, 3, 10, 5, 30, 0, 0, time.UTC)
+	serverDate := instant.In(time.Local).Format("2006-01-02")
+
+	// Sin zona guardada, usuario inexistente o zona ilegible: se usa la del servidor
+	mustExec(t, db, `INSERT INTO users (name, timezone) VALUES ('broken', 'Mars/Olympus')`)
+	for _, userID := range []string{"2", "3", "99"} {
+		if location := UserLocation(db, userID); location != time.Local {
+			t.Errorf("User %s: expected the server time zone, got %s", userID, location)
+		}
+		if got := UserDate(db, userID, instant); got != serverDate {
+			t.Errorf("User %s: expected %s, got %s", userID, serverDate, got)
+		}
+	}
+
+	// Tampoco falla antes de que exista la columna
+	legacy, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "legacy.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	defer legacy.Close()
+	mustExec(t, legacy, `CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)`)
+	if location := UserLocation(legacy, "1"); location != time.Local {
+		t.Errorf("Expected the server time zone without a timezone column, got %s", location)
+	}
+}
+
+func TestSetUserTimezoneRejectsInvalidNames(t *testing.T) {
+	db := setupTimezoneDB(t)
+	for _, name := range []string{"", "  ", "Local", "Mars/Olympus"} {
+		if err := SetUserTimezone(db, "2", name); err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+	if location := UserLocation(db, "2"); location != time.Local {
+		t.Errorf("Expected a rejected time zone not to be saved, got %s", location)
+	}
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Estados de conciliación de ingresos y gastos
+const (
+	StatusPending    = "pending"
+	StatusCleared    = "cleared"
+	StatusReconciled = "reconciled"
+)
+
+// ErrTransactionLocked indica que la transacción pertenece a una conciliación finalizada
+var ErrTransactionLocked = errors.New("transaction is reconciled and can no longer be modified")
+
+// EnsureTransactionStatusColumns añade la columna status a incomes y expenses si aún no existe
+func EnsureTransactionStatusColumns(db *sql.DB) error {
+	for _, table := range []string{"incomes", "expenses"} {
+		var name string
+		err := db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name=?`, table).Scan(&name)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN status TEXT NOT NULL DEFAULT '%s'`, table, StatusPending))
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return fmt.Errorf("error adding status column to %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// CheckNotReconciled devuelve ErrTransactionLocked si el ingreso o gasto ya está conciliado.
+// transactionType es "income" o "expense"; cualquier otro tipo no se bloquea.
+func CheckNotReconciled(q DBTX, transactionType string, transactionID int, userID string) error {
+	var table string
+	switch strings.ToLower(transactionType) {
+	case "income":
+		table = "incomes"
+	case "expense":
+		table = "expenses"
+	default:
+		return nil
+	}
+
+	var status string
+	err := q.QueryRow(fmt.Sprintf(`SELECT COALESCE(status, '%s') FROM %s WHERE id = ? AND user_id = ?`, StatusPending, table),
+		transactionID, userID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		// Sin columna status todavía no puede haber filas conciliadas
+		if strings.Contains(err.Error(), "no such column") {
+			return nil
+		}
+		return err
+	}
+
+	if status == StatusReconciled {
+		return ErrTransactionLocked
+	}
+	return nil
+}
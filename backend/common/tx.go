@@ -0,0 +1,95 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// RetryPolicy define cuántas veces se repite una transacción que encuentra la base de datos
+// bloqueada y cuánto se espera entre intentos
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// TxRetryPolicy es la política de WithTx. Los servicios comparten users.db desde procesos
+// distintos, así que una escritura puede encontrar el fichero bloqueado por otro servicio.
+var TxRetryPolicy = RetryPolicy{Attempts: 6, BaseDelay: 25 * time.Millisecond, MaxDelay: time.Second}
+
+// delay devuelve la espera antes del intento attempt (1 es el primer reintento): exponencial,
+// limitada a MaxDelay y con una parte aleatoria para que los procesos no reintenten a la vez
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay << (attempt - 1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// WithTx ejecuta fn en una transacción: la confirma si fn no devuelve error y la deshace en caso
+// contrario, de modo que la escritura del movimiento y todas sus proyecciones de saldo se aplican
+// juntas o no se aplica ninguna. Si SQLite responde que la base de datos está bloqueada, la
+// transacción completa se repite según TxRetryPolicy; fn debe poder ejecutarse más de una vez.
+func WithTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	policy := TxRetryPolicy
+	var err error
+	for attempt := 0; attempt < policy.Attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(policy.delay(attempt))
+		}
+		if err = runTx(db, fn); err == nil || !IsLockError(err) {
+			return err
+		}
+		log.Printf("Database locked (attempt %d of %d): %v", attempt+1, policy.Attempts, err)
+	}
+	return err
+}
+
+func runTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// IsLockError indica si el error se debe a que otra conexión tiene bloqueada la base de datos
+// (SQLITE_BUSY o SQLITE_LOCKED). Muchas funciones envuelven los errores con %v, por lo que
+// también se reconoce el mensaje.
+func IsLockError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	message := err.Error()
+	return strings.Contains(message, "database is locked") || strings.Contains(message, "database table is locked")
+}
+
+// TxErrorStatus devuelve el código HTTP para un error de WithTx: 503 si la base de datos
+// siguió bloqueada tras todos los reintentos, 500 en otro caso
+func TxErrorStatus(err error) int {
+	if IsLockError(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
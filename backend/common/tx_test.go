@@ -0,0 +1,74 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestWithTxRetriesLockErrorsAndRollsBack(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec(`CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)`); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	previous := TxRetryPolicy
+	TxRetryPolicy = RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	t.Cleanup(func() { TxRetryPolicy = previous })
+
+	countItems := func() int {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM items`).Scan(&n); err != nil {
+			t.Fatalf("Failed to count items: %v", err)
+		}
+		return n
+	}
+
+	// Bloqueo en el primer intento: lo escrito se deshace y el segundo intento confirma
+	calls := 0
+	err := WithTx(db, func(tx *sql.Tx) error {
+		calls++
+		if _, err := tx.Exec(`INSERT INTO items (name) VALUES ('a')`); err != nil {
+			return err
+		}
+		if calls == 1 {
+			return sqlite3.Error{Code: sqlite3.ErrBusy}
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("Expected success on second attempt, got err=%v after %d calls", err, calls)
+	}
+	if n := countItems(); n != 1 {
+		t.Errorf("Expected 1 item after retry, got %d", n)
+	}
+
+	// Bloqueo persistente: se agotan los intentos y el error se traduce a 503
+	calls = 0
+	err = WithTx(db, func(tx *sql.Tx) error {
+		calls++
+		return errors.New("error updating balances: database is locked")
+	})
+	if calls != 3 || !IsLockError(err) || TxErrorStatus(err) != 503 {
+		t.Errorf("Expected 3 attempts ending in a lock error, got %d attempts and %v", calls, err)
+	}
+
+	// Cualquier otro error no se reintenta y deshace la transacción
+	calls = 0
+	err = WithTx(db, func(tx *sql.Tx) error {
+		calls++
+		if _, err := tx.Exec(`INSERT INTO items (name) VALUES ('b')`); err != nil {
+			return err
+		}
+		return ErrVersionConflict
+	})
+	if calls != 1 || err != ErrVersionConflict || TxErrorStatus(err) != 500 {
+		t.Errorf("Expected a single attempt returning ErrVersionConflict, got %d attempts and %v", calls, err)
+	}
+	if n := countItems(); n != 1 {
+		t.Errorf("Expected failed transaction to be rolled back, got %d items", n)
+	}
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Variables de entorno de los webhooks salientes: lista de URLs separadas por comas y el
+// secreto con el que se firma cada envío
+const (
+	WebhookURLsEnv   = "HERO_BUDGET_WEBHOOK_URLS"
+	WebhookSecretEnv = "HERO_BUDGET_WEBHOOK_SECRET"
+)
+
+// Cabeceras de cada envío: el tipo de evento y la firma HMAC-SHA256 del cuerpo en hexadecimal
+const (
+	WebhookEventHeader     = "X-Hero-Budget-Event"
+	WebhookSignatureHeader = "X-Hero-Budget-Signature"
+)
+
+// WebhookURLs devuelve las URLs configuradas en WebhookURLsEnv
+func WebhookURLs() []string {
+	var urls []string
+	for _, url := range strings.Split(os.Getenv(WebhookURLsEnv), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// WebhookHandler devuelve un suscriptor que envía cada evento como JSON por POST a todas las
+// URLs. Cualquier respuesta que no sea 2xx cuenta como fallo y el evento se reintenta.
+func WebhookHandler(urls []string, secret string) EventHandler {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(event DomainEvent) error {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("error encoding event: %v", err)
+		}
+		for _, url := range urls {
+			req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+			if err != nil {
+				return fmt.Errorf("invalid webhook URL %s: %v", url, err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(WebhookEventHeader, event.Type)
+			if secret != "" {
+				mac := hmac.New(sha256.New, []byte(secret))
+				mac.Write(body)
+				req.Header.Set(WebhookSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return fmt.Errorf("error calling webhook %s: %v", url, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				return fmt.Errorf("webhook %s returned %d", url, resp.StatusCode)
+			}
+		}
+		return nil
+	}
+}
@@ -8,7 +8,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"time"
+
+	"hero_budget_backend/common"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -349,7 +350,7 @@ func fetchDashboardData(userID, period string) (DashboardData, error) {
 	dashboardData.Period = period
 
 	// Get current date
-	now := time.Now()
+	now := common.UserNow(db, userID)
 	dashboardData.Date = now.Format("2006-01-02")
 
 	// Get budget overview
@@ -423,39 +424,11 @@ func fetchBudgetOverview(userID, period string) (BudgetOverview, error) {
 
 	// Calculate the total income for the period
 	// Fetch total income from incomes table for the specified period
-	var startDate, endDate string
-	now := time.Now()
-
-	switch period {
-	case "daily":
-		startDate = now.Format("2006-01-02")
-		endDate = now.Format("2006-01-02")
-	case "weekly":
-		// Start of the week (Monday)
-		startDate = now.AddDate(0, 0, -int(now.Weekday())+1).Format("2006-01-02")
-		// End of the week (Sunday)
-		endDate = now.AddDate(0, 0, 7-int(now.Weekday())).Format("2006-01-02")
-	case "monthly":
-		// Start of the month
-		startDate = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
-		// End of the month
-		endDate = time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
-	case "quarterly":
-		quarter := (int(now.Month())-1)/3 + 1
-		startDate = time.Date(now.Year(), time.Month((quarter-1)*3+1), 1, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
-		endDate = time.Date(now.Year(), time.Month(quarter*3+1), 0, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
-	case "semiannual":
-		halfYear := (int(now.Month())-1)/6 + 1
-		startDate = time.Date(now.Year(), time.Month((halfYear-1)*6+1), 1, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
-		endDate = time.Date(now.Year(), time.Month(halfYear*6+1), 0, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
-	case "annual":
-		startDate = time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
-		endDate = time.Date(now.Year(), 12, 31, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
-	default:
-		// Default to monthly if period is not recognized
-		startDate = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
-		endDate = time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
-	}
+	// Current period in the user's time zone, following their month and week start
+	now := common.UserNow(db, userID)
+	settings, _ := common.LoadPeriodSettings(db, userID)
+	periodStart, periodEnd := settings.Range(period, now)
+	startDate, endDate := periodStart.Format("2006-01-02"), periodEnd.Format("2006-01-02")
 
 	// Get total income for the period
 	var totalIncome float64
@@ -486,10 +459,8 @@ func fetchBudgetOverview(userID, period string) (BudgetOverview, error) {
 	case "weekly":
 		daysInPeriod = 7
 	case "monthly":
-		// Calculate actual days in the current month
-		year, month, _ := time.Now().Date()
-		lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, time.Now().Location())
-		daysInPeriod = lastDay.Day()
+		// Calculate actual days in the user's current month
+		daysInPeriod = int(periodEnd.Sub(periodStart).Hours()/24) + 1
 	case "quarterly":
 		daysInPeriod = 90
 	case "semiannual":
@@ -504,7 +475,8 @@ func fetchBudgetOverview(userID, period string) (BudgetOverview, error) {
 
 	// Determine high spending warning
 	// For example, if spent more than 50% of budget in first third of period
-	currentDay := time.Now().Day()
+	// Day number within the current period
+	currentDay := int(common.DateOnly(now).Sub(periodStart).Hours()/24) + 1
 	if period == "monthly" && currentDay <= 10 && budgetOverview.ExpensePercent > 50 {
 		budgetOverview.HighSpending = true
 	}
@@ -573,7 +545,7 @@ func fetchCashBankDistribution(userID string) (CashBank, error) {
 
 	if err == sql.ErrNoRows {
 		// Return default values if no data found
-		cashBank.Month = time.Now().Format("January 2006")
+		cashBank.Month = common.UserNow(db, userID).Format("January 2006")
 		cashBank.CashAmount = 0
 		cashBank.CashPercent = 0
 		cashBank.BankAmount = 0
@@ -620,7 +592,7 @@ func fetchUpcomingBills(userID string) ([]Bill, error) {
 	var bills []Bill
 
 	// Get the current date
-	currentDate := time.Now().Format("2006-01-02")
+	currentDate := common.UserToday(db, userID)
 
 	// Query bills that are not paid and due in the future, or recurring bills (but still not paid)
 	rows, err := db.Query(`
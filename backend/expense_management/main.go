@@ -9,11 +9,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
+	"hero_budget_backend/common"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -28,6 +28,11 @@ type Expense struct {
 	Description   string  `json:"description,omitempty"`
 	CreatedAt     string  `json:"created_at,omitempty"`
 	UpdatedAt     string  `json:"updated_at,omitempty"`
+	Version       int     `json:"version"`
+	ETag          string  `json:"etag,omitempty"`
+	Status        string  `json:"status"`                    // "pending", "cleared" o "reconciled"
+	CreditCardID  int64   `json:"credit_card_id,omitempty"`  // Card of a credit card purchase
+	BillPaymentID int64   `json:"bill_payment_id,omitempty"` // Bill occurrence this expense paid
 }
 
 type AddExpenseRequest struct {
@@ -47,6 +52,7 @@ type UpdateExpenseRequest struct {
 	Category      string  `json:"category,omitempty"`
 	PaymentMethod string  `json:"payment_method,omitempty"`
 	Description   string  `json:"description,omitempty"`
+	Version       int     `json:"version,omitempty"` // Optional precondition, same as If-Match
 }
 
 type DeleteExpenseRequest struct {
@@ -91,6 +97,26 @@ func init() {
 	// Create tables if they don't exist
 	createTablesIfNotExist()
 
+	// Table used to replay responses of retried requests
+	if err := common.EnsureIdempotencyTable(db); err != nil {
+		log.Fatalf("Failed to create idempotency_keys table: %v", err)
+	}
+
+	// Ledger from which the period balance tables are projected
+	if err := common.EnsureLedgerTable(db); err != nil {
+		log.Fatalf("Failed to create balance ledger: %v", err)
+	}
+
+	// Domain events written in the same transaction as each change
+	if err := common.EnsureOutboxTable(db); err != nil {
+		log.Fatalf("Failed to create outbox: %v", err)
+	}
+
+	// Each expense keeps a reference to its category
+	if err := common.EnsureCategoryIDColumn(db, "expenses"); err != nil {
+		log.Fatalf("Failed to add category_id to expenses: %v", err)
+	}
+
 	// Add cash_amount and bank_amount columns to all balance tables if needed
 	addCashBankColumnsToAllTables()
 
@@ -425,6 +451,20 @@ func createTablesIfNotExist() {
 	alterTableSafely("annual_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
 	alterTableSafely("annual_balance", "total_previous_balance", "REAL NOT NULL DEFAULT 0")
 	alterTableSafely("annual_balance", "total_balance", "REAL NOT NULL DEFAULT 0")
+
+	// Row version used for optimistic concurrency on updates
+	alterTableSafely("expenses", "version", "INTEGER NOT NULL DEFAULT 1")
+
+	// Card of the purchases made through cash_bank_management's /credit-cards/purchase
+	alterTableSafely("expenses", "credit_card_id", "INTEGER")
+
+	// Bill occurrence paid by the expenses that bills_management creates
+	alterTableSafely("expenses", "bill_payment_id", "INTEGER")
+
+	// Reconciliation status (pending, cleared, reconciled)
+	if err := common.EnsureTransactionStatusColumns(db); err != nil {
+		log.Printf("Error adding status columns: %v", err)
+	}
 }
 
 // Helper function to safely alter a table by adding a column if it doesn't exist
@@ -450,9 +490,9 @@ func alterTableSafely(tableName, columnName, columnType string) {
 func main() {
 	// Set up CORS middleware and routes
 	http.HandleFunc("/expenses", corsMiddleware(handleFetchExpenses))
-	http.HandleFunc("/expenses/add", corsMiddleware(handleAddExpense))
-	http.HandleFunc("/expenses/update", corsMiddleware(handleUpdateExpense))
-	http.HandleFunc("/expenses/delete", corsMiddleware(handleDeleteExpense))
+	http.HandleFunc("/expenses/add", corsMiddleware(common.WithIdempotency(db, handleAddExpense)))
+	http.HandleFunc("/expenses/update", corsMiddleware(common.WithIdempotency(db, handleUpdateExpense)))
+	http.HandleFunc("/expenses/delete", corsMiddleware(common.WithIdempotency(db, handleDeleteExpense)))
 
 	port := 8094 // Puerto para el servicio de gastos
 	log.Printf("Expense Management service started on :%d", port)
@@ -464,7 +504,8 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// Set headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		// If it's OPTIONS, return with just the headers (preflight request)
 		if r.Method == "OPTIONS" {
@@ -529,8 +570,8 @@ func handleAddExpense(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if expense.Date == "" {
-		// Default to current date if not provided
-		expense.Date = time.Now().Format("2006-01-02")
+		// Default to the user's current date if not provided
+		expense.Date = common.UserToday(db, expense.UserID)
 	}
 
 	if expense.Category == "" {
@@ -547,34 +588,32 @@ func handleAddExpense(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Adding expense: UserID=%s, Amount=%.2f, Date=%s, Category=%s, PaymentMethod=%s",
 		expense.UserID, expense.Amount, expense.Date, expense.Category, expense.PaymentMethod)
 
-	// Add the expense to the database
-	expenseID, err := addExpense(expense)
-	if err != nil {
-		log.Printf("Error adding expense: %v", err)
-		sendErrorResponse(w, "Failed to add expense", http.StatusInternalServerError)
-		return
-	}
-
-	// Set the ID of the newly added expense
-	expense.ID = expenseID
+	// Add the expense and update every balance in one transaction
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		expenseID, err := addExpense(tx, expense)
+		if err != nil {
+			return fmt.Errorf("error adding expense: %v", err)
+		}
 
-	// Update balance based on payment method
-	// Need to pass a negative amount since this is an expense (reduces balance)
-	if err := updateBalance(expense.UserID, -expense.Amount, expense.PaymentMethod); err != nil {
-		log.Printf("Error updating balance: %v", err)
-		// Don't fail the entire request, just log the error
-	}
+		// Set the ID of the newly added expense
+		expense.ID = expenseID
 
-	// Actualizar los balances por periodos
-	if err := updateTimeBalances(expense.UserID, expense.Amount, expense.Date); err != nil {
-		log.Printf("Error updating time balances: %v", err)
-		// Don't fail the entire request, just log the error
-	}
+		// Update balance based on payment method
+		// Need to pass a negative amount since this is an expense (reduces balance)
+		if err := updateBalance(tx, expense.UserID, -expense.Amount, expense.PaymentMethod); err != nil {
+			return fmt.Errorf("error updating balance: %v", err)
+		}
 
-	// Recalcular todos los balances para asegurar que previous_xxx_amount y balance_xxx_amount se actualicen en cascada
-	if err := recalculateAllBalances(expense.UserID, expense.Date); err != nil {
-		log.Printf("Error recalculating balances: %v", err)
-		// Continue despite the error
+		// Update the period balances
+		if err := recordExpenseLedger(tx, expense); err != nil {
+			return fmt.Errorf("error updating time balances: %v", err)
+		}
+		return common.PublishEvent(tx, common.EventExpenseCreated, expense.UserID, int64(expense.ID), expense)
+	})
+	if err != nil {
+		log.Printf("Error adding expense: %v", err)
+		sendErrorResponse(w, "Failed to add expense", common.TxErrorStatus(err))
+		return
 	}
 
 	// Return success response
@@ -606,14 +645,45 @@ func handleUpdateExpense(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Optional precondition from If-Match or the version field
+	expectedVersion, hasPrecondition, err := common.ExpectedVersion(r, updateRequest.Version)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Fetch the expense to update
-	origExpense, err := fetchExpenseByID(updateRequest.ExpenseID, updateRequest.UserID)
+	origExpense, err := fetchExpenseByID(db, updateRequest.ExpenseID, updateRequest.UserID)
 	if err != nil {
 		log.Printf("Error fetching expense: %v", err)
 		sendErrorResponse(w, "Expense not found", http.StatusNotFound)
 		return
 	}
 
+	// Reconciled expenses are locked against edits
+	if origExpense.Status == common.StatusReconciled {
+		sendErrorResponse(w, common.ErrTransactionLocked.Error(), http.StatusLocked)
+		return
+	}
+
+	if hasPrecondition && origExpense.Version != expectedVersion {
+		sendConflictResponse(w, origExpense)
+		return
+	}
+
+	// Card purchases are paid with their card statement, so they cannot become cash or bank
+	// expenses or the other way round
+	if updateRequest.PaymentMethod != "" && updateRequest.PaymentMethod != origExpense.PaymentMethod {
+		if isCardPurchase(*origExpense) || updateRequest.PaymentMethod == common.PaymentMethodCreditCard {
+			sendErrorResponse(w, "Payment method cannot change to or from credit_card", http.StatusBadRequest)
+			return
+		}
+		if updateRequest.PaymentMethod != "cash" && updateRequest.PaymentMethod != "bank" {
+			sendErrorResponse(w, "Valid payment method (cash or bank) is required", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Calculate the difference in amount for balance update
 	amountDifference := 0.0
 	if updateRequest.Amount > 0 {
@@ -629,6 +699,8 @@ func handleUpdateExpense(w http.ResponseWriter, r *http.Request) {
 		Category:      updateRequest.Category,
 		PaymentMethod: updateRequest.PaymentMethod,
 		Description:   updateRequest.Description,
+		CreditCardID:  origExpense.CreditCardID,
+		BillPaymentID: origExpense.BillPaymentID,
 	}
 
 	// If fields are not provided, use original values
@@ -652,49 +724,74 @@ func handleUpdateExpense(w http.ResponseWriter, r *http.Request) {
 		expense.Description = origExpense.Description
 	}
 
-	// Update expense in database
-	err = updateExpense(expense)
-	if err != nil {
-		log.Printf("Error updating expense: %v", err)
-		sendErrorResponse(w, "Error updating expense", http.StatusInternalServerError)
-		return
-	}
-
 	// Check if amount, date, or payment method changed
 	amountChanged := updateRequest.Amount > 0 && origExpense.Amount != expense.Amount
 	dateChanged := updateRequest.Date != "" && origExpense.Date != expense.Date
 	paymentMethodChanged := updateRequest.PaymentMethod != "" && origExpense.PaymentMethod != expense.PaymentMethod
 
-	// Update user's balance if amount changed
-	if amountDifference != 0 {
-		err = updateBalance(expense.UserID, amountDifference, expense.PaymentMethod)
-		if err != nil {
-			log.Printf("Error updating balance: %v", err)
-			// Continue since the expense was already updated
+	// Update the expense and its balances in one transaction
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		if err := updateExpense(tx, expense, expectedVersion); err != nil {
+			return err
+		}
+
+		// Card purchases do not touch cash or bank; their statement changes instead
+		if isCardPurchase(expense) {
+			if err := adjustCardStatement(tx, *origExpense, expense); err != nil {
+				return err
+			}
+			return common.PublishEvent(tx, common.EventExpenseUpdated, expense.UserID, int64(expense.ID), expense)
 		}
-	}
 
-	// Update time balances if necessary
-	if amountChanged || dateChanged || paymentMethodChanged {
-		// First remove the old expense from time balances
-		if err := updateTimeBalances(expense.UserID, -origExpense.Amount, origExpense.Date); err != nil {
-			log.Printf("Error removing old expense from time balances: %v", err)
+		// The bill occurrence this expense paid follows its amount
+		if expense.BillPaymentID > 0 && amountChanged {
+			err := common.AdjustBillPaymentTx(tx, expense.UserID, expense.BillPaymentID, expense.Amount-origExpense.Amount,
+				expense.Date, expense.PaymentMethod)
+			if err != nil {
+				return err
+			}
 		}
 
-		// Then add the new expense to time balances
-		if err := updateTimeBalances(expense.UserID, expense.Amount, expense.Date); err != nil {
-			log.Printf("Error adding new expense to time balances: %v", err)
+		// Update user's balance if amount changed
+		if amountDifference != 0 {
+			if err := updateBalance(tx, expense.UserID, amountDifference, expense.PaymentMethod); err != nil {
+				return fmt.Errorf("error updating balance: %v", err)
+			}
 		}
 
-		// Recalcular todos los balances para asegurar que previous_xxx_amount y balance_xxx_amount se actualicen en cascada
-		if err := recalculateAllBalances(expense.UserID, expense.Date); err != nil {
-			log.Printf("Error recalculating balances: %v", err)
-			// Continue despite the error
+		// Update time balances if necessary; the ledger replaces the old entry with the new one
+		if amountChanged || dateChanged || paymentMethodChanged {
+			if err := recordExpenseLedger(tx, expense); err != nil {
+				return fmt.Errorf("error updating time balances: %v", err)
+			}
+		}
+		return common.PublishEvent(tx, common.EventExpenseUpdated, expense.UserID, int64(expense.ID), expense)
+	})
+	if err == common.ErrVersionConflict {
+		// Another request won the race between our read and our write
+		if current, fetchErr := fetchExpenseByID(db, expense.ID, expense.UserID); fetchErr == nil {
+			sendConflictResponse(w, current)
+			return
 		}
+		sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err == common.ErrCardCycleClosed || err == common.ErrCardStatementPaid {
+		sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err == common.ErrBillAlreadyPaid || err == common.ErrBillOverpayment {
+		sendErrorResponse(w, "Amount exceeds what is left to pay of the bill this expense paid", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating expense: %v", err)
+		sendErrorResponse(w, "Error updating expense", common.TxErrorStatus(err))
+		return
 	}
 
 	// Fetch the updated expense
-	updatedExpense, err := fetchExpenseByID(expense.ID, expense.UserID)
+	updatedExpense, err := fetchExpenseByID(db, expense.ID, expense.UserID)
 	if err != nil {
 		log.Printf("Error fetching updated expense: %v", err)
 		// Return the updated expense without timestamps
@@ -703,6 +800,7 @@ func handleUpdateExpense(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return the updated expense
+	w.Header().Set("ETag", updatedExpense.ETag)
 	sendSuccessResponse(w, "Expense updated successfully", updatedExpense)
 }
 
@@ -732,38 +830,54 @@ func handleDeleteExpense(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch the expense to delete
-	expense, err := fetchExpenseByID(deleteRequest.ExpenseID, deleteRequest.UserID)
+	expense, err := fetchExpenseByID(db, deleteRequest.ExpenseID, deleteRequest.UserID)
 	if err != nil {
 		log.Printf("Error fetching expense: %v", err)
 		sendErrorResponse(w, "Expense not found", http.StatusNotFound)
 		return
 	}
 
-	// Delete expense from database
-	err = deleteExpense(deleteRequest.ExpenseID, deleteRequest.UserID)
-	if err != nil {
-		log.Printf("Error deleting expense: %v", err)
-		sendErrorResponse(w, "Error deleting expense", http.StatusInternalServerError)
+	// Reconciled expenses are locked against deletion
+	if expense.Status == common.StatusReconciled {
+		sendErrorResponse(w, common.ErrTransactionLocked.Error(), http.StatusLocked)
 		return
 	}
 
-	// Update user's balance (add the amount back)
-	err = updateBalance(deleteRequest.UserID, expense.Amount, expense.PaymentMethod)
-	if err != nil {
-		log.Printf("Error updating balance: %v", err)
-		// Continue since the expense was already deleted
-	}
+	// Delete the expense and undo its balances in one transaction
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		// A card purchase leaves its statement, and a bill payment stops paying its bill
+		if err := common.ReleaseDeletedExpenseTx(tx, deleteRequest.UserID, int64(deleteRequest.ExpenseID)); err != nil {
+			return err
+		}
 
-	// Remove expense from time balances
-	if err := updateTimeBalances(deleteRequest.UserID, -expense.Amount, expense.Date); err != nil {
-		log.Printf("Error removing expense from time balances: %v", err)
-		// Continue despite the error
-	}
+		if err := deleteExpense(tx, deleteRequest.ExpenseID, deleteRequest.UserID); err != nil {
+			return fmt.Errorf("error deleting expense: %v", err)
+		}
 
-	// Recalcular todos los balances para asegurar que previous_xxx_amount y balance_xxx_amount se actualicen en cascada
-	if err := recalculateAllBalances(deleteRequest.UserID, expense.Date); err != nil {
-		log.Printf("Error recalculating balances: %v", err)
-		// Continue despite the error
+		// Card purchases never touched cash or bank
+		if isCardPurchase(*expense) {
+			return common.PublishEvent(tx, common.EventExpenseDeleted, deleteRequest.UserID, int64(expense.ID), expense)
+		}
+
+		// Update user's balance (add the amount back)
+		if err := updateBalance(tx, deleteRequest.UserID, expense.Amount, expense.PaymentMethod); err != nil {
+			return fmt.Errorf("error updating balance: %v", err)
+		}
+
+		// Remove expense from time balances
+		if err := common.RemoveLedgerEntries(tx, deleteRequest.UserID, common.LedgerSourceExpense, int64(expense.ID)); err != nil {
+			return fmt.Errorf("error removing expense from time balances: %v", err)
+		}
+		return common.PublishEvent(tx, common.EventExpenseDeleted, deleteRequest.UserID, int64(expense.ID), expense)
+	})
+	if err == common.ErrCardStatementPaid {
+		sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting expense: %v", err)
+		sendErrorResponse(w, "Error deleting expense", common.TxErrorStatus(err))
+		return
 	}
 
 	// Return success
@@ -773,7 +887,8 @@ func handleDeleteExpense(w http.ResponseWriter, r *http.Request) {
 func fetchExpenses(userID string) ([]Expense, error) {
 	// SQL query to fetch all expenses for a user, ordered by most recent
 	query := `
-		SELECT id, user_id, amount, date, category, payment_method, description, created_at, updated_at
+		SELECT id, user_id, amount, date, category, payment_method, description, created_at, updated_at, COALESCE(version, 1), COALESCE(status, 'pending'),
+		       COALESCE(credit_card_id, 0), COALESCE(bill_payment_id, 0)
 		FROM expenses
 		WHERE user_id = ?
 		ORDER BY date DESC, id DESC
@@ -799,25 +914,31 @@ func fetchExpenses(userID string) ([]Expense, error) {
 			&expense.Description,
 			&expense.CreatedAt,
 			&expense.UpdatedAt,
+			&expense.Version,
+			&expense.Status,
+			&expense.CreditCardID,
+			&expense.BillPaymentID,
 		)
 		if err != nil {
 			return nil, err
 		}
+		expense.ETag = common.ETag(expense.Version)
 		expenses = append(expenses, expense)
 	}
 
 	return expenses, nil
 }
 
-func fetchExpenseByID(expenseID int, userID string) (*Expense, error) {
+func fetchExpenseByID(q common.DBTX, expenseID int, userID string) (*Expense, error) {
 	// SQL query to fetch a specific expense by ID and user ID
 	query := `
-		SELECT id, user_id, amount, date, category, payment_method, description, created_at, updated_at
+		SELECT id, user_id, amount, date, category, payment_method, description, created_at, updated_at, COALESCE(version, 1), COALESCE(status, 'pending'),
+		       COALESCE(credit_card_id, 0), COALESCE(bill_payment_id, 0)
 		FROM expenses
 		WHERE id = ? AND user_id = ?
 	`
 
-	row := db.QueryRow(query, expenseID, userID)
+	row := q.QueryRow(query, expenseID, userID)
 
 	var expense Expense
 	err := row.Scan(
@@ -830,27 +951,39 @@ func fetchExpenseByID(expenseID int, userID string) (*Expense, error) {
 		&expense.Description,
 		&expense.CreatedAt,
 		&expense.UpdatedAt,
+		&expense.Version,
+		&expense.Status,
+		&expense.CreditCardID,
+		&expense.BillPaymentID,
 	)
 	if err != nil {
 		return nil, err
 	}
+	expense.ETag = common.ETag(expense.Version)
 
 	return &expense, nil
 }
 
-func addExpense(expense Expense) (int, error) {
+func addExpense(q common.DBTX, expense Expense) (int, error) {
+	// Link the expense to its category so reports can group it by ID
+	categoryID, err := common.ResolveCategoryID(q, expense.UserID, "expense", expense.Category)
+	if err != nil {
+		return 0, err
+	}
+
 	// SQL query to insert a new expense
 	query := `
-		INSERT INTO expenses (user_id, amount, date, category, payment_method, description)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO expenses (user_id, amount, date, category, category_id, payment_method, description)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := db.Exec(
+	result, err := q.Exec(
 		query,
 		expense.UserID,
 		expense.Amount,
 		expense.Date,
 		expense.Category,
+		categoryID,
 		expense.PaymentMethod,
 		expense.Description,
 	)
@@ -867,39 +1000,58 @@ func addExpense(expense Expense) (int, error) {
 	return int(id), nil
 }
 
-func updateExpense(expense Expense) error {
+// updateExpense overwrites an expense and bumps its version. When expectedVersion is
+// greater than zero the write only applies if the stored version still matches.
+func updateExpense(q common.DBTX, expense Expense, expectedVersion int) error {
+	categoryID, err := common.ResolveCategoryID(q, expense.UserID, "expense", expense.Category)
+	if err != nil {
+		return err
+	}
+
 	// SQL query to update an existing expense
 	query := `
 		UPDATE expenses
-		SET amount = ?, date = ?, category = ?, payment_method = ?, description = ?, updated_at = CURRENT_TIMESTAMP
-		WHERE id = ? AND user_id = ?
+		SET amount = ?, date = ?, category = ?, category_id = ?, payment_method = ?, description = ?,
+		    version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND user_id = ? AND (? = 0 OR COALESCE(version, 1) = ?)
 	`
 
-	_, err := db.Exec(
+	result, err := q.Exec(
 		query,
 		expense.Amount,
 		expense.Date,
 		expense.Category,
+		categoryID,
 		expense.PaymentMethod,
 		expense.Description,
 		expense.ID,
 		expense.UserID,
+		expectedVersion,
+		expectedVersion,
 	)
 	if err != nil {
 		return err
 	}
 
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 && expectedVersion > 0 {
+		return common.ErrVersionConflict
+	}
+
 	return nil
 }
 
-func deleteExpense(expenseID int, userID string) error {
+func deleteExpense(q common.DBTX, expenseID int, userID string) error {
 	// SQL query to delete an expense
 	query := `
 		DELETE FROM expenses
 		WHERE id = ? AND user_id = ?
 	`
 
-	_, err := db.Exec(query, expenseID, userID)
+	_, err := q.Exec(query, expenseID, userID)
 	if err != nil {
 		return err
 	}
@@ -907,7 +1059,25 @@ func deleteExpense(expenseID int, userID string) error {
 	return nil
 }
 
-func updateBalance(userID string, amount float64, paymentMethod string) error {
+// isCardPurchase reports whether the expense was made with a credit card. Its money only
+// leaves the bank when the card statement is paid.
+func isCardPurchase(expense Expense) bool {
+	return expense.PaymentMethod == common.PaymentMethodCreditCard
+}
+
+// adjustCardStatement keeps the statement of an edited card purchase in step. A purchase
+// cannot move into a cycle whose statement is already closed.
+func adjustCardStatement(q common.DBTX, orig, updated Expense) error {
+	if updated.Date == orig.Date {
+		return common.AdjustCardStatementTx(q, orig.UserID, orig.CreditCardID, orig.Date, updated.Amount-orig.Amount, 0)
+	}
+	if err := common.CheckCardPurchaseDate(q, orig.CreditCardID, updated.Date); err != nil {
+		return err
+	}
+	return common.AdjustCardStatementTx(q, orig.UserID, orig.CreditCardID, orig.Date, -orig.Amount, -1)
+}
+
+func updateBalance(q common.DBTX, userID string, amount float64, paymentMethod string) error {
 	log.Printf("updateBalance called with userID: %s, amount: %.2f, paymentMethod: %s", userID, amount, paymentMethod)
 
 	// SQL query to check if user exists in the balances table
@@ -918,7 +1088,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 	`
 
 	var count int
-	err := db.QueryRow(checkQuery, userID).Scan(&count)
+	err := q.QueryRow(checkQuery, userID).Scan(&count)
 	if err != nil {
 		log.Printf("Error checking balances table: %v", err)
 		return err
@@ -943,7 +1113,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 		}
 
 		log.Printf("Inserting new balance record with cash: %.2f, bank: %.2f", cashAmount, bankAmount)
-		_, err = db.Exec(query, userID, cashAmount, bankAmount)
+		_, err = q.Exec(query, userID, cashAmount, bankAmount)
 	} else {
 		// Update existing balance
 		if paymentMethod == "cash" {
@@ -961,7 +1131,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 		}
 
 		log.Printf("Updating existing balance with amount: %.2f for method: %s", amount, paymentMethod)
-		_, err = db.Exec(query, amount, userID)
+		_, err = q.Exec(query, amount, userID)
 	}
 
 	if err != nil {
@@ -972,7 +1142,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 	}
 
 	// Get current month in format YYYY-MM
-	currentMonth := time.Now().Format("2006-01")
+	currentMonth := common.UserNow(q, userID).Format("2006-01")
 	log.Printf("Processing cash_bank for month: %s", currentMonth)
 
 	// Fetch current cash-bank distribution
@@ -990,7 +1160,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 		WHERE user_id = ? AND month = ?
 	`
 	var exists bool
-	err = db.QueryRow(cashBankCheckQuery, userID, currentMonth).Scan(&exists)
+	err = q.QueryRow(cashBankCheckQuery, userID, currentMonth).Scan(&exists)
 	if err != nil && err != sql.ErrNoRows {
 		log.Printf("Error checking cash_bank: %v", err)
 		return err
@@ -1006,7 +1176,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 			FROM cash_bank
 			WHERE user_id = ? AND month = ?
 		`
-		err := db.QueryRow(getQuery, userID, currentMonth).Scan(
+		err := q.QueryRow(getQuery, userID, currentMonth).Scan(
 			&distribution.CashAmount,
 			&distribution.BankAmount,
 			&distribution.MonthlyTotal,
@@ -1047,7 +1217,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 			SET cash_amount = ?, cash_percent = ?, bank_amount = ?, bank_percent = ?, monthly_total = ?, updated_at = CURRENT_TIMESTAMP
 			WHERE user_id = ? AND month = ?
 		`
-		_, err = db.Exec(
+		_, err = q.Exec(
 			updateQuery,
 			distribution.CashAmount,
 			cashPercent,
@@ -1092,7 +1262,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 			INSERT INTO cash_bank (user_id, month, cash_amount, cash_percent, bank_amount, bank_percent, monthly_total)
 			VALUES (?, ?, ?, ?, ?, ?, ?)
 		`
-		_, err = db.Exec(
+		_, err = q.Exec(
 			insertQuery,
 			userID,
 			currentMonth,
@@ -1120,12 +1290,12 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 
 	log.Printf("Recording transaction - type: %s, amount: %.2f", transactionType, transactionAmount)
 
-	_, err = db.Exec(
+	_, err = q.Exec(
 		transactionQuery,
 		userID,
 		transactionType,
 		transactionAmount,
-		time.Now().Format("2006-01-02"),
+		common.UserToday(q, userID),
 	)
 	if err != nil {
 		log.Printf("Error recording cash_bank_transaction: %v", err)
@@ -1148,1578 +1318,75 @@ func sendSuccessResponse(w http.ResponseWriter, message string, data interface{}
 	json.NewEncoder(w).Encode(response)
 }
 
-func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+// sendConflictResponse returns 409 with the current server copy of a stale update
+func sendConflictResponse(w http.ResponseWriter, current *Expense) {
 	response := ApiResponse{
 		Success: false,
-		Message: message,
+		Message: "Expense was modified by another request",
+		Data:    current,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
+	w.Header().Set("ETag", current.ETag)
+	w.WriteHeader(http.StatusConflict)
 	json.NewEncoder(w).Encode(response)
 }
 
-// Función para actualizar los balances por periodos al añadir un gasto
-func updateTimeBalances(userID string, amount float64, dateStr string) error {
-	// Parse la fecha del gasto
-	date, err := time.Parse("2006-01-02", dateStr)
-	if err != nil {
-		return fmt.Errorf("error parsing date: %v", err)
-	}
-
-	// Obtener la información del gasto para determinar si fue cash o bank
-	var paymentMethod string
-	err = db.QueryRow(`
-		SELECT payment_method FROM expenses
-		WHERE user_id = ? AND date = ? AND amount = ?
-		ORDER BY created_at DESC LIMIT 1
-	`, userID, dateStr, amount).Scan(&paymentMethod)
-
-	if err != nil && err != sql.ErrNoRows {
-		return fmt.Errorf("error fetching payment method: %v", err)
-	}
-
-	if err == sql.ErrNoRows {
-		// Si no se encuentra, asumimos bank por defecto
-		paymentMethod = "bank"
-	}
-
-	// Calculamos los montos de cash y bank según el método de pago
-	var cashAmount, bankAmount float64
-	if paymentMethod == "cash" {
-		cashAmount = amount
-		bankAmount = 0
-	} else {
-		cashAmount = 0
-		bankAmount = amount
-	}
-
-	// Actualizar balance diario
-	if err := updateDailyBalance(userID, 0, amount, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating daily balance: %v", err)
-	}
-
-	// Actualizar balance semanal
-	if err := updateWeeklyBalance(userID, 0, amount, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating weekly balance: %v", err)
-	}
-
-	// Actualizar balance mensual
-	if err := updateMonthlyBalance(userID, 0, amount, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating monthly balance: %v", err)
-	}
-
-	// Actualizar balance trimestral
-	if err := updateQuarterlyBalance(userID, 0, amount, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating quarterly balance: %v", err)
-	}
-
-	// Actualizar balance semestral
-	if err := updateSemiannualBalance(userID, 0, amount, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating semiannual balance: %v", err)
-	}
-
-	// Actualizar balance anual
-	if err := updateAnnualBalance(userID, 0, amount, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating annual balance: %v", err)
-	}
-
-	return nil
-}
-
-func updateDailyBalance(userID string, incomeAmount, expenseAmount, billsAmount, cashAmount, bankAmount float64, date time.Time) error {
-	dateStr := date.Format("2006-01-02")
-
-	// Obtener el balance del día anterior para calcular el balance previo
-	prevDate := date.AddDate(0, 0, -1)
-	prevDateStr := prevDate.Format("2006-01-02")
-
-	var previousBalance float64
-	var prevCashAmount, prevBankAmount float64
-
-	// Buscar el balance del día anterior
-	err := db.QueryRow(`
-		SELECT balance, cash_amount, bank_amount FROM daily_balance 
-		WHERE user_id = ? AND date = ?
-	`, userID, prevDateStr).Scan(&previousBalance, &prevCashAmount, &prevBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-	// Si no existe registro del día anterior, el balance previo es 0
-	if err == sql.ErrNoRows {
-		previousBalance = 0
-		prevCashAmount = 0
-		prevBankAmount = 0
-	}
-
-	// Calcular el balance como el balance previo + ingresos - gastos - facturas
-	balance := previousBalance + incomeAmount - expenseAmount - billsAmount
-
-	// Verificar si ya existe un registro para esta fecha
-	var exists bool
-	var existingCash, existingBank float64
-	var existingIncome, existingExpense, existingBills float64
-	err = db.QueryRow(`
-		SELECT 1, cash_amount, bank_amount, income_amount, expense_amount, bills_amount FROM daily_balance
-		WHERE user_id = ? AND date = ?
-	`, userID, dateStr).Scan(&exists, &existingCash, &existingBank, &existingIncome, &existingExpense, &existingBills)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, insertar uno nuevo
-		// Los montos de efectivo y banco deben acumularse del período anterior
-		totalCashAmount := prevCashAmount + cashAmount
-		totalBankAmount := prevBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO daily_balance (user_id, date, income_amount, expense_amount, bills_amount, cash_amount, bank_amount, balance, previous_balance, previous_cash_amount, previous_bank_amount)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, dateStr, incomeAmount, expenseAmount, billsAmount, totalCashAmount, totalBankAmount, balance, previousBalance, prevCashAmount, prevBankAmount)
-	} else {
-		// Actualizar registro existente
-		// Calculamos los nuevos totales sumando los valores existentes
-		newIncome := existingIncome + incomeAmount
-		newExpense := existingExpense + expenseAmount
-		newBills := existingBills + billsAmount
-
-		// Actualizar los montos de cash y bank sumando los nuevos valores a los existentes
-		newCashAmount := existingCash + cashAmount
-		newBankAmount := existingBank + bankAmount
-
-		// Recalcular el balance
-		balance := previousBalance + newIncome - newExpense - newBills
-
-		_, err = db.Exec(`
-			UPDATE daily_balance
-			SET income_amount = ?,
-				expense_amount = ?,
-				bills_amount = ?,
-				cash_amount = ?,
-				bank_amount = ?,
-				previous_balance = ?,
-				balance = ?,
-				previous_cash_amount = ?,
-				previous_bank_amount = ?,
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND date = ?
-		`, newIncome, newExpense, newBills, newCashAmount, newBankAmount, previousBalance, balance, existingCash, existingBank, prevCashAmount, prevBankAmount, userID, dateStr)
-	}
-
-	if err != nil {
-		return err
+func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+	response := ApiResponse{
+		Success: false,
+		Message: message,
 	}
 
-	// Actualizar todos los días posteriores en cascada
-	return updateSubsequentDailyBalances(userID, date.AddDate(0, 0, 1))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
 }
 
-// Función para actualizar días posteriores en cascada
-func updateSubsequentDailyBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a un año para evitar bucles infinitos
-	endDate := startDate.AddDate(1, 0, 0)
-	currentDate := startDate
-
-	for currentDate.Before(endDate) {
-		currentDateStr := currentDate.Format("2006-01-02")
-
-		// Verificar si existe un registro para esta fecha
-		var exists bool
-		var incomeAmount, expenseAmount, billsAmount, cashAmount, bankAmount float64
-		err := db.QueryRow(`
-			SELECT 1, income_amount, expense_amount, bills_amount, cash_amount, bank_amount FROM daily_balance
-			WHERE user_id = ? AND date = ?
-		`, userID, currentDateStr).Scan(&exists, &incomeAmount, &expenseAmount, &billsAmount, &cashAmount, &bankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// No hay más registros para actualizar
-			break
-		}
-
-		// Obtener el balance del día anterior
-		prevDate := currentDate.AddDate(0, 0, -1)
-		prevDateStr := prevDate.Format("2006-01-02")
-
-		var previousBalance float64
-		var prevCashAmount, prevBankAmount float64
-		err = db.QueryRow(`
-			SELECT balance, cash_amount, bank_amount FROM daily_balance 
-			WHERE user_id = ? AND date = ?
-		`, userID, prevDateStr).Scan(&previousBalance, &prevCashAmount, &prevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			previousBalance = 0
-			prevCashAmount = 0
-			prevBankAmount = 0
-		}
-
-		// Actualizar el balance con el nuevo balance previo
-		balance := previousBalance + incomeAmount - expenseAmount - billsAmount
-
-		// CAMBIO EN LA LÓGICA: Siempre acumulamos los valores del día anterior
-		// independientemente de si hay transacciones en este día o no
-		hasTransactions := incomeAmount != 0 || expenseAmount != 0 || billsAmount != 0
-
-		// Inicializar con los valores del día anterior
-		newCashAmount := prevCashAmount
-		newBankAmount := prevBankAmount
+// Add cash_amount and bank_amount columns to all balance tables if they don't exist
+func addCashBankColumnsToAllTables() {
+	alterTableSafely("daily_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("daily_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("daily_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("daily_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
 
-		// Si hay transacciones propias en este día, las sumamos a lo heredado
-		if hasTransactions {
-			// Agregamos las transacciones propias de este día
-			newCashAmount += cashAmount
-			newBankAmount += bankAmount
-		}
+	alterTableSafely("weekly_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("weekly_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("weekly_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("weekly_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
 
-		_, err = db.Exec(`
-			UPDATE daily_balance
-			SET previous_balance = ?,
-				balance = ?,
-				cash_amount = ?,
-				bank_amount = ?,
-				previous_cash_amount = ?,
-				previous_bank_amount = ?,
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND date = ?
-		`, previousBalance, balance, newCashAmount, newBankAmount, prevCashAmount, prevBankAmount, userID, currentDateStr)
+	alterTableSafely("monthly_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("monthly_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("monthly_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("monthly_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
 
-		if err != nil {
-			return err
-		}
+	alterTableSafely("quarterly_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("quarterly_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("quarterly_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("quarterly_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
 
-		// Pasar al siguiente día
-		currentDate = currentDate.AddDate(0, 0, 1)
-	}
+	alterTableSafely("semiannual_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("semiannual_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("semiannual_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("semiannual_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
 
-	return nil
+	alterTableSafely("annual_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("annual_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("annual_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
+	alterTableSafely("annual_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
 }
 
-func updateWeeklyBalance(userID string, incomeAmount, expenseAmount, billsAmount, cashAmount, bankAmount float64, date time.Time) error {
-	// Calcular el año e ISO semana
-	year, week := date.ISOWeek()
-	yearWeek := fmt.Sprintf("%d-W%02d", year, week)
-
-	// Calcular fecha de inicio y fin de la semana
-	// El día 0 de una semana es domingo, necesitamos ajustar para obtener lunes (día 1)
-	dayOfWeek := int(date.Weekday())
-	if dayOfWeek == 0 {
-		dayOfWeek = 7 // Convertir domingo (0) a 7 para restar correctamente
-	}
-	startDate := date.AddDate(0, 0, -(dayOfWeek - 1))
-	endDate := startDate.AddDate(0, 0, 6)
-
-	startDateStr := startDate.Format("2006-01-02")
-	endDateStr := endDate.Format("2006-01-02")
-
-	// Calcular la semana anterior
-	prevWeekStart := startDate.AddDate(0, 0, -7)
-	prevYearWeek := fmt.Sprintf("%d-W%02d", prevWeekStart.Year(), func() int {
-		year, week := prevWeekStart.ISOWeek()
-		if prevWeekStart.Year() != year {
-			// Ajustar para casos especiales al final/inicio de año
-			return 53 // Última semana del año anterior
-		}
-		return week
-	}())
-
-	var previousBalance float64
-	var prevCashAmount, prevBankAmount float64
-
-	// Buscar el balance de la semana anterior
-	err := db.QueryRow(`
-		SELECT balance, cash_amount, bank_amount FROM weekly_balance 
-		WHERE user_id = ? AND year_week = ?
-	`, userID, prevYearWeek).Scan(&previousBalance, &prevCashAmount, &prevBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-	// Si no existe registro de la semana anterior, el balance previo es 0
-	if err == sql.ErrNoRows {
-		previousBalance = 0
-		prevCashAmount = 0
-		prevBankAmount = 0
-	}
-
-	// Calcular el balance como: balance previo + ingresos - gastos - facturas
-	balance := previousBalance + incomeAmount - expenseAmount - billsAmount
-
-	// Verificar si ya existe un registro para esta semana
-	var exists bool
-	var existingCash, existingBank float64
-	var existingIncome, existingExpense, existingBills float64
-	err = db.QueryRow(`
-		SELECT 1, cash_amount, bank_amount, income_amount, expense_amount, bills_amount FROM weekly_balance
-		WHERE user_id = ? AND year_week = ?
-	`, userID, yearWeek).Scan(&exists, &existingCash, &existingBank, &existingIncome, &existingExpense, &existingBills)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, insertar uno nuevo
-		// Los montos de efectivo y banco deben acumularse del período anterior
-		totalCashAmount := prevCashAmount + cashAmount
-		totalBankAmount := prevBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO weekly_balance (user_id, year_week, start_date, end_date, income_amount, expense_amount, bills_amount, cash_amount, bank_amount, balance, previous_balance, previous_cash_amount, previous_bank_amount)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, yearWeek, startDateStr, endDateStr, incomeAmount, expenseAmount, billsAmount, totalCashAmount, totalBankAmount, balance, previousBalance, prevCashAmount, prevBankAmount)
-	} else {
-		// Actualizar registro existente
-		// Actualizar los montos sumando los nuevos valores
-		newIncome := existingIncome + incomeAmount
-		newExpense := existingExpense + expenseAmount
-		newBills := existingBills + billsAmount
-
-		// Actualizar los montos de cash y bank sumando los nuevos valores a los existentes
-		newCashAmount := existingCash + cashAmount
-		newBankAmount := existingBank + bankAmount
-
-		// Recalcular el balance
-		balance := previousBalance + newIncome - newExpense - newBills
-
-		_, err = db.Exec(`
-			UPDATE weekly_balance
-			SET income_amount = ?,
-				expense_amount = ?,
-				bills_amount = ?,
-				cash_amount = ?,
-				bank_amount = ?,
-				previous_balance = ?,
-				balance = ?,
-				previous_cash_amount = ?,
-				previous_bank_amount = ?,
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_week = ?
-		`, newIncome, newExpense, newBills, newCashAmount, newBankAmount, previousBalance, balance, existingCash, existingBank, prevCashAmount, prevBankAmount, userID, yearWeek)
-	}
-
+// recordExpenseLedger registers the expense in the balance ledger, replacing its previous
+// entry; the ledger updates the six period balance tables
+func recordExpenseLedger(q common.DBTX, expense Expense) error {
+	date, err := time.Parse("2006-01-02", expense.Date)
 	if err != nil {
-		return err
+		return fmt.Errorf("error parsing date: %v", err)
 	}
-
-	// Actualizar todas las semanas posteriores en cascada
-	return updateSubsequentWeeklyBalances(userID, startDate.AddDate(0, 0, 7))
-}
-
-// Función para actualizar semanas posteriores en cascada
-func updateSubsequentWeeklyBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a un año para evitar bucles infinitos
-	endDate := startDate.AddDate(1, 0, 0)
-	currentDate := startDate
-
-	for currentDate.Before(endDate) {
-		year, week := currentDate.ISOWeek()
-		currentYearWeek := fmt.Sprintf("%d-W%02d", year, week)
-
-		// Verificar si existe un registro para esta semana
-		var exists bool
-		var incomeAmount, expenseAmount, billsAmount, cashAmount, bankAmount float64
-		err := db.QueryRow(`
-			SELECT 1, income_amount, expense_amount, bills_amount, cash_amount, bank_amount FROM weekly_balance
-			WHERE user_id = ? AND year_week = ?
-		`, userID, currentYearWeek).Scan(&exists, &incomeAmount, &expenseAmount, &billsAmount, &cashAmount, &bankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// No hay más registros para actualizar
-			break
-		}
-
-		// Obtener el balance de la semana anterior
-		prevWeekStart := currentDate.AddDate(0, 0, -7)
-		prevYear, prevWeek := prevWeekStart.ISOWeek()
-		prevYearWeek := fmt.Sprintf("%d-W%02d", prevYear, prevWeek)
-
-		var previousBalance float64
-		var prevCashAmount, prevBankAmount float64
-		err = db.QueryRow(`
-			SELECT balance, cash_amount, bank_amount FROM weekly_balance 
-			WHERE user_id = ? AND year_week = ?
-		`, userID, prevYearWeek).Scan(&previousBalance, &prevCashAmount, &prevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			previousBalance = 0
-			prevCashAmount = 0
-			prevBankAmount = 0
-		}
-
-		// Actualizar el balance con el nuevo balance previo
-		balance := previousBalance + incomeAmount - expenseAmount - billsAmount
-
-		// CAMBIO EN LA LÓGICA: Siempre acumulamos los valores de la semana anterior
-		// independientemente de si hay transacciones en esta semana o no
-		hasTransactions := incomeAmount != 0 || expenseAmount != 0 || billsAmount != 0
-
-		// Inicializar con los valores de la semana anterior
-		newCashAmount := prevCashAmount
-		newBankAmount := prevBankAmount
-
-		// Si hay transacciones propias en esta semana, las sumamos a lo heredado
-		if hasTransactions {
-			// Agregamos las transacciones propias de esta semana
-			newCashAmount += cashAmount
-			newBankAmount += bankAmount
-		}
-
-		// Calcular los valores de balance para cash y bank
-		balanceCashAmount := prevCashAmount + cashAmount
-		balanceBankAmount := prevBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			UPDATE weekly_balance
-			SET previous_balance = ?,
-				balance = ?,
-				cash_amount = ?,
-				bank_amount = ?,
-                previous_cash_amount = ?,
-                previous_bank_amount = ?,
-                balance_cash_amount = ?,
-                balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_week = ?
-		`, previousBalance, balance, newCashAmount, newBankAmount, prevCashAmount, prevBankAmount, balanceCashAmount, balanceBankAmount, userID, currentYearWeek)
-
-		if err != nil {
-			return err
-		}
-
-		// Pasar a la siguiente semana
-		currentDate = currentDate.AddDate(0, 0, 7)
-	}
-
-	return nil
-}
-
-func updateMonthlyBalance(userID string, incomeAmount, expenseAmount, billsAmount, cashAmount, bankAmount float64, date time.Time) error {
-	// Calcular el año y mes
-	yearMonth := date.Format("2006-01")
-
-	// Calcular el mes anterior
-	prevMonth := date.AddDate(0, -1, 0)
-	prevYearMonth := prevMonth.Format("2006-01")
-
-	var prevCashAmount, prevBankAmount float64
-
-	// Buscar los valores del mes anterior
-	err := db.QueryRow(`
-		SELECT cash_amount, bank_amount FROM monthly_cash_bank_balance 
-		WHERE user_id = ? AND year_month = ?
-	`, userID, prevYearMonth).Scan(&prevCashAmount, &prevBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-	// Si no existe registro del mes anterior, el balance previo es 0
-	if err == sql.ErrNoRows {
-		// Si no hay un mes inmediatamente anterior, buscar el último mes anterior disponible
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM monthly_cash_bank_balance 
-			WHERE user_id = ? AND year_month < ?
-			ORDER BY year_month DESC LIMIT 1
-		`, userID, yearMonth).Scan(&prevCashAmount, &prevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		// Si no se encuentra ningún mes anterior, ambos valores son 0
-		if err == sql.ErrNoRows {
-			prevCashAmount = 0
-			prevBankAmount = 0
-		}
-	}
-
-	// Verificar si ya existe un registro para este mes
-	var exists bool
-	var existingIncomeCash, existingIncomeBank float64
-	var existingExpenseCash, existingExpenseBank float64
-	var existingBillCash, existingBillBank float64
-	var existingCashAmount, existingBankAmount float64
-	err = db.QueryRow(`
-		SELECT 1, income_cash_amount, income_bank_amount, 
-		expense_cash_amount, expense_bank_amount, 
-		bill_cash_amount, bill_bank_amount,
-		cash_amount, bank_amount
-		FROM monthly_cash_bank_balance
-		WHERE user_id = ? AND year_month = ?
-	`, userID, yearMonth).Scan(&exists, &existingIncomeCash, &existingIncomeBank, &existingExpenseCash, &existingExpenseBank, &existingBillCash, &existingBillBank, &existingCashAmount, &existingBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, crear uno nuevo
-		// Los montos de efectivo y banco deben acumularse del período anterior
-		totalCashAmount := prevCashAmount - cashAmount
-		totalBankAmount := prevBankAmount - bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO monthly_cash_bank_balance (
-				user_id, year_month,
-				income_cash_amount, income_bank_amount, 
-				expense_cash_amount, expense_bank_amount, 
-				bill_cash_amount, bill_bank_amount, 
-				cash_amount, previous_cash_amount,
-				bank_amount, previous_bank_amount,
-				balance_cash_amount, balance_bank_amount
-			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, yearMonth,
-			0, 0,
-			cashAmount, bankAmount,
-			0, 0,
-			totalCashAmount, prevCashAmount,
-			totalBankAmount, prevBankAmount,
-			totalCashAmount, totalBankAmount)
-	} else {
-		// Actualizar registro existente
-		// Calculamos los nuevos totales sumando los valores existentes
-
-		// Actualizar los montos de cash y bank restando los nuevos gastos a los existentes
-		newCashAmount := existingCashAmount - cashAmount
-		newBankAmount := existingBankAmount - bankAmount
-
-		_, err = db.Exec(`
-			UPDATE monthly_cash_bank_balance SET
-				expense_cash_amount = expense_cash_amount + ?,
-				expense_bank_amount = expense_bank_amount + ?,
-				cash_amount = ?,
-				bank_amount = ?,
-				previous_cash_amount = ?,
-				previous_bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_month = ?
-		`, cashAmount, bankAmount,
-			newCashAmount, newBankAmount,
-			prevCashAmount, prevBankAmount,
-			newCashAmount, newBankAmount,
-			userID, yearMonth)
-	}
-
-	if err != nil {
-		return err
-	}
-
-	// Actualizar meses posteriores para ajustar los balances en cascada
-	return updateSubsequentMonthlyBalances(userID, date.AddDate(0, 1, 0))
-}
-
-func updateQuarterlyBalance(userID string, incomeAmount, expenseAmount, billsAmount, cashAmount, bankAmount float64, date time.Time) error {
-	// Calcular el trimestre (1-4)
-	quarter := (int(date.Month())-1)/3 + 1
-	yearQuarter := fmt.Sprintf("%d-Q%d", date.Year(), quarter)
-
-	// Calcular fecha de inicio y fin del trimestre
-	startMonth := (quarter-1)*3 + 1
-	startDate := time.Date(date.Year(), time.Month(startMonth), 1, 0, 0, 0, 0, date.Location())
-	endDate := startDate.AddDate(0, 3, -1)
-
-	startDateStr := startDate.Format("2006-01-02")
-	endDateStr := endDate.Format("2006-01-02")
-
-	// Calcular el trimestre anterior
-	prevQuarterDate := startDate.AddDate(0, -3, 0)
-	prevQuarter := (int(prevQuarterDate.Month())-1)/3 + 1
-	prevYearQuarter := fmt.Sprintf("%d-Q%d", prevQuarterDate.Year(), prevQuarter)
-
-	var previousBalance float64
-	var prevCashAmount, prevBankAmount float64
-
-	// Buscar el balance del trimestre anterior
-	err := db.QueryRow(`
-		SELECT balance, cash_amount, bank_amount FROM quarterly_balance 
-		WHERE user_id = ? AND year_quarter = ?
-	`, userID, prevYearQuarter).Scan(&previousBalance, &prevCashAmount, &prevBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-	// Si no existe registro del trimestre anterior, el balance previo es 0
-	if err == sql.ErrNoRows {
-		previousBalance = 0
-		prevCashAmount = 0
-		prevBankAmount = 0
-	}
-
-	// Calcular el balance actual
-	balance := previousBalance + incomeAmount - expenseAmount - billsAmount
-
-	// Verificar si ya existe un registro para este trimestre
-	var exists bool
-	var existingCash, existingBank float64
-	var existingIncome, existingExpense, existingBills float64
-	err = db.QueryRow(`
-		SELECT 1, cash_amount, bank_amount, income_amount, expense_amount, bills_amount FROM quarterly_balance
-		WHERE user_id = ? AND year_quarter = ?
-	`, userID, yearQuarter).Scan(&exists, &existingCash, &existingBank, &existingIncome, &existingExpense, &existingBills)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, insertar uno nuevo
-		// Los montos de efectivo y banco deben acumularse del período anterior
-		totalCashAmount := prevCashAmount + cashAmount
-		totalBankAmount := prevBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO quarterly_balance (user_id, year_quarter, start_date, end_date, income_amount, expense_amount, bills_amount, cash_amount, bank_amount, balance, previous_balance, previous_cash_amount, previous_bank_amount)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, yearQuarter, startDateStr, endDateStr, incomeAmount, expenseAmount, billsAmount, totalCashAmount, totalBankAmount, balance, previousBalance, prevCashAmount, prevBankAmount)
-	} else {
-		// Actualizar registro existente
-		// Calculamos los nuevos totales sumando los valores existentes
-		newIncome := existingIncome + incomeAmount
-		newExpense := existingExpense + expenseAmount
-		newBills := existingBills + billsAmount
-
-		// Actualizar los montos de cash y bank sumando los nuevos valores a los existentes
-		newCashAmount := existingCash + cashAmount
-		newBankAmount := existingBank + bankAmount
-
-		// Recalcular el balance
-		balance := previousBalance + newIncome - newExpense - newBills
-
-		_, err = db.Exec(`
-			UPDATE quarterly_balance
-			SET income_amount = ?,
-				expense_amount = ?,
-				bills_amount = ?,
-				cash_amount = ?,
-				bank_amount = ?,
-				previous_balance = ?,
-				balance = ?,
-				previous_cash_amount = ?,
-				previous_bank_amount = ?,
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_quarter = ?
-		`, newIncome, newExpense, newBills, newCashAmount, newBankAmount, previousBalance, balance, existingCash, existingBank, prevCashAmount, prevBankAmount, userID, yearQuarter)
-	}
-
-	if err != nil {
-		return err
-	}
-
-	// Actualizar todos los trimestres posteriores en cascada
-	nextQuarterDate := startDate.AddDate(0, 3, 0)
-	return updateSubsequentQuarterlyBalances(userID, nextQuarterDate)
-}
-
-func updateSemiannualBalance(userID string, incomeAmount, expenseAmount, billsAmount, cashAmount, bankAmount float64, date time.Time) error {
-	// Calcular el semestre (1-2)
-	half := (int(date.Month())-1)/6 + 1
-	yearHalf := fmt.Sprintf("%d-H%d", date.Year(), half)
-
-	// Calcular fecha de inicio y fin del semestre
-	startMonth := (half-1)*6 + 1
-	startDate := time.Date(date.Year(), time.Month(startMonth), 1, 0, 0, 0, 0, date.Location())
-	endDate := startDate.AddDate(0, 6, -1)
-
-	startDateStr := startDate.Format("2006-01-02")
-	endDateStr := endDate.Format("2006-01-02")
-
-	// Calcular el semestre anterior
-	prevHalfDate := startDate.AddDate(0, -6, 0)
-	prevHalf := (int(prevHalfDate.Month())-1)/6 + 1
-	prevYearHalf := fmt.Sprintf("%d-H%d", prevHalfDate.Year(), prevHalf)
-
-	var previousBalance float64
-	var prevCashAmount, prevBankAmount float64
-
-	// Buscar el balance del semestre anterior
-	err := db.QueryRow(`
-		SELECT balance, cash_amount, bank_amount FROM semiannual_balance 
-		WHERE user_id = ? AND year_half = ?
-	`, userID, prevYearHalf).Scan(&previousBalance, &prevCashAmount, &prevBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-	// Si no existe registro del semestre anterior, el balance previo es 0
-	if err == sql.ErrNoRows {
-		previousBalance = 0
-		prevCashAmount = 0
-		prevBankAmount = 0
-	}
-
-	// Calcular el balance actual
-	balance := previousBalance + incomeAmount - expenseAmount - billsAmount
-
-	// Verificar si ya existe un registro para este semestre
-	var exists bool
-	var existingCash, existingBank float64
-	var existingIncome, existingExpense, existingBills float64
-	err = db.QueryRow(`
-		SELECT 1, cash_amount, bank_amount, income_amount, expense_amount, bills_amount FROM semiannual_balance
-		WHERE user_id = ? AND year_half = ?
-	`, userID, yearHalf).Scan(&exists, &existingCash, &existingBank, &existingIncome, &existingExpense, &existingBills)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, insertar uno nuevo
-		// Los montos de efectivo y banco deben acumularse del período anterior
-		totalCashAmount := prevCashAmount + cashAmount
-		totalBankAmount := prevBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO semiannual_balance (user_id, year_half, start_date, end_date, income_amount, expense_amount, bills_amount, cash_amount, bank_amount, balance, previous_balance, previous_cash_amount, previous_bank_amount)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, yearHalf, startDateStr, endDateStr, incomeAmount, expenseAmount, billsAmount, totalCashAmount, totalBankAmount, balance, previousBalance, prevCashAmount, prevBankAmount)
-	} else {
-		// Actualizar registro existente
-		// Calculamos los nuevos totales sumando los valores existentes
-		newIncome := existingIncome + incomeAmount
-		newExpense := existingExpense + expenseAmount
-		newBills := existingBills + billsAmount
-
-		// Actualizar los montos de cash y bank sumando los nuevos valores a los existentes
-		newCashAmount := existingCash + cashAmount
-		newBankAmount := existingBank + bankAmount
-
-		// Recalcular el balance
-		balance := previousBalance + newIncome - newExpense - newBills
-
-		_, err = db.Exec(`
-			UPDATE semiannual_balance
-			SET income_amount = ?,
-				expense_amount = ?,
-				bills_amount = ?,
-				cash_amount = ?,
-				bank_amount = ?,
-				previous_balance = ?,
-				balance = ?,
-				previous_cash_amount = ?,
-				previous_bank_amount = ?,
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_half = ?
-		`, newIncome, newExpense, newBills, newCashAmount, newBankAmount, previousBalance, balance, existingCash, existingBank, prevCashAmount, prevBankAmount, userID, yearHalf)
-	}
-
-	if err != nil {
-		return err
-	}
-
-	// Actualizar todos los semestres posteriores en cascada
-	nextHalfDate := startDate.AddDate(0, 6, 0)
-	return updateSubsequentSemiannualBalances(userID, nextHalfDate)
-}
-
-func updateAnnualBalance(userID string, incomeAmount, expenseAmount, billsAmount, cashAmount, bankAmount float64, date time.Time) error {
-	// Calcular el año
-	year := strconv.Itoa(date.Year())
-
-	// Calcular el año anterior
-	prevYear := strconv.Itoa(date.Year() - 1)
-
-	var previousBalance float64
-	var prevCashAmount, prevBankAmount float64
-
-	// Buscar el balance del año anterior
-	err := db.QueryRow(`
-		SELECT balance, cash_amount, bank_amount FROM annual_balance 
-		WHERE user_id = ? AND year = ?
-	`, userID, prevYear).Scan(&previousBalance, &prevCashAmount, &prevBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-	// Si no existe registro del año anterior, el balance previo es 0
-	if err == sql.ErrNoRows {
-		previousBalance = 0
-		prevCashAmount = 0
-		prevBankAmount = 0
-	}
-
-	// Calcular el balance actual
-	balance := previousBalance + incomeAmount - expenseAmount - billsAmount
-
-	// Verificar si ya existe un registro para este año
-	var exists bool
-	var existingCash, existingBank float64
-	var existingIncome, existingExpense, existingBills float64
-	err = db.QueryRow(`
-		SELECT 1, cash_amount, bank_amount, income_amount, expense_amount, bills_amount FROM annual_balance
-		WHERE user_id = ? AND year = ?
-	`, userID, year).Scan(&exists, &existingCash, &existingBank, &existingIncome, &existingExpense, &existingBills)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, insertar uno nuevo
-		// Los montos de efectivo y banco deben acumularse del período anterior
-		totalCashAmount := prevCashAmount + cashAmount
-		totalBankAmount := prevBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO annual_balance (user_id, year, income_amount, expense_amount, bills_amount, cash_amount, bank_amount, balance, previous_balance, previous_cash_amount, previous_bank_amount)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, year, incomeAmount, expenseAmount, billsAmount, totalCashAmount, totalBankAmount, balance, previousBalance, prevCashAmount, prevBankAmount)
-	} else {
-		// Actualizar registro existente
-		// Calculamos los nuevos totales sumando los valores existentes
-		newIncome := existingIncome + incomeAmount
-		newExpense := existingExpense + expenseAmount
-		newBills := existingBills + billsAmount
-
-		// Actualizar los montos de cash y bank sumando los nuevos valores a los existentes
-		newCashAmount := existingCash + cashAmount
-		newBankAmount := existingBank + bankAmount
-
-		// Recalcular el balance
-		balance := previousBalance + newIncome - newExpense - newBills
-
-		_, err = db.Exec(`
-			UPDATE annual_balance
-			SET income_amount = ?,
-				expense_amount = ?,
-				bills_amount = ?,
-				cash_amount = ?,
-				bank_amount = ?,
-				previous_balance = ?,
-				balance = ?,
-				previous_cash_amount = ?,
-				previous_bank_amount = ?,
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year = ?
-		`, newIncome, newExpense, newBills, newCashAmount, newBankAmount, previousBalance, balance, existingCash, existingBank, prevCashAmount, prevBankAmount, userID, year)
-	}
-
-	if err != nil {
-		return err
-	}
-
-	// Actualizar años posteriores en cascada
-	nextYear := date.AddDate(1, 0, 0)
-	return updateSubsequentAnnualBalances(userID, nextYear)
-}
-
-// Add cash_amount and bank_amount columns to all balance tables if they don't exist
-func addCashBankColumnsToAllTables() {
-	alterTableSafely("daily_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("daily_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("daily_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("daily_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
-
-	alterTableSafely("weekly_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("weekly_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("weekly_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("weekly_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
-
-	alterTableSafely("monthly_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("monthly_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("monthly_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("monthly_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
-
-	alterTableSafely("quarterly_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("quarterly_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("quarterly_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("quarterly_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
-
-	alterTableSafely("semiannual_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("semiannual_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("semiannual_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("semiannual_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
-
-	alterTableSafely("annual_balance", "cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("annual_balance", "bank_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("annual_balance", "previous_cash_amount", "REAL NOT NULL DEFAULT 0")
-	alterTableSafely("annual_balance", "previous_bank_amount", "REAL NOT NULL DEFAULT 0")
-}
-
-// Función para actualizar trimestres posteriores en cascada
-func updateSubsequentQuarterlyBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a 5 años para evitar bucles infinitos
-	// Variable currentDate no se usa, la eliminamos
-
-	// Mantener un registro de los trimestres procesados
-	processedQuarters := make(map[string]struct{})
-
-	// Encontrar el trimestre anterior al trimestre de inicio para saber el valor de partida
-	var lastPrevCashAmount, lastPrevBankAmount float64
-
-	// Calcular el trimestre anterior
-	quarter := (int(startDate.Month()) - 1) / 3
-	year := startDate.Year()
-	var prevYear, prevQuarter int
-	if quarter == 0 {
-		prevYear = year - 1
-		prevQuarter = 3 // Q4 del año anterior
-	} else {
-		prevYear = year
-		prevQuarter = quarter - 1
-	}
-	prevToStartYearQuarter := fmt.Sprintf("%d-Q%d", prevYear, prevQuarter+1)
-
-	err := db.QueryRow(`
-		SELECT cash_amount, bank_amount FROM quarterly_cash_bank_balance 
-		WHERE user_id = ? AND year_quarter = ?
-	`, userID, prevToStartYearQuarter).Scan(&lastPrevCashAmount, &lastPrevBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// Si no hay un trimestre inmediatamente anterior, buscar el último trimestre anterior disponible
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM quarterly_cash_bank_balance 
-			WHERE user_id = ? AND year_quarter < ?
-			ORDER BY year_quarter DESC LIMIT 1
-		`, userID, fmt.Sprintf("%d-Q%d", year, quarter+1)).Scan(&lastPrevCashAmount, &lastPrevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		// Si no se encuentra ningún trimestre anterior, usar valores en cero
-		if err == sql.ErrNoRows {
-			lastPrevCashAmount = 0
-			lastPrevBankAmount = 0
-		}
-	}
-
-	// Obtener todos los trimestres existentes desde la fecha de inicio
-	rows, err := db.Query(`
-		SELECT year_quarter FROM quarterly_cash_bank_balance
-		WHERE user_id = ? AND year_quarter >= ?
-		ORDER BY year_quarter ASC
-	`, userID, fmt.Sprintf("%d-Q%d", year, quarter+1))
-
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	var existingQuarters []string
-	for rows.Next() {
-		var yearQuarter string
-		if err := rows.Scan(&yearQuarter); err != nil {
-			return err
-		}
-		existingQuarters = append(existingQuarters, yearQuarter)
-	}
-
-	// Si no hay trimestres existentes, no hay nada que procesar
-	if len(existingQuarters) == 0 {
-		return nil
-	}
-
-	// Determinar el último trimestre que necesitamos procesar
-	lastQuarterStr := existingQuarters[len(existingQuarters)-1]
-	quarterRegex := regexp.MustCompile(`(\d+)-Q(\d+)`)
-	matches := quarterRegex.FindStringSubmatch(lastQuarterStr)
-	if len(matches) != 3 {
-		return fmt.Errorf("invalid quarter format: %s", lastQuarterStr)
-	}
-	lastYear, _ := strconv.Atoi(matches[1])
-	lastQuarter, _ := strconv.Atoi(matches[2])
-	lastQuarter-- // Convertir de Q1-Q4 a 0-3
-
-	// Crear un mapa para acceso rápido a los trimestres existentes
-	existingQuartersMap := make(map[string]bool)
-	for _, q := range existingQuarters {
-		existingQuartersMap[q] = true
-	}
-
-	// Variables para mantener los valores acumulados
-	currentCashAmount := lastPrevCashAmount
-	currentBankAmount := lastPrevBankAmount
-
-	// Iterar trimestre por trimestre desde la fecha de inicio hasta el último trimestre existente
-	currentYear := year
-	currentQuarter := quarter
-
-	for {
-		// Avanzar al trimestre siguiente (ya que estamos empezando desde el anterior a startDate)
-		if currentQuarter == 3 {
-			currentYear++
-			currentQuarter = 0
-		} else {
-			currentQuarter++
-		}
-
-		currentYearQuarter := fmt.Sprintf("%d-Q%d", currentYear, currentQuarter+1)
-
-		// Si hemos superado el último trimestre, salimos
-		lastYearQuarter := fmt.Sprintf("%d-Q%d", lastYear, lastQuarter+1)
-		if compareQuarters(currentYearQuarter, lastYearQuarter) > 0 {
-			break
-		}
-
-		if existingQuartersMap[currentYearQuarter] {
-			// Si el trimestre existe, actualizarlo con los valores correctos
-			var incomeCashAmount, incomeBankAmount float64
-			var expenseCashAmount, expenseBankAmount float64
-			var billCashAmount, billBankAmount float64
-
-			err := db.QueryRow(`
-				SELECT income_cash_amount, income_bank_amount,
-				       expense_cash_amount, expense_bank_amount,
-				       bill_cash_amount, bill_bank_amount
-				FROM quarterly_cash_bank_balance
-				WHERE user_id = ? AND year_quarter = ?
-			`, userID, currentYearQuarter).Scan(
-				&incomeCashAmount, &incomeBankAmount,
-				&expenseCashAmount, &expenseBankAmount,
-				&billCashAmount, &billBankAmount)
-
-			if err != nil {
-				return err
-			}
-
-			// Calcular nuevos montos considerando los ingresos, gastos y facturas del trimestre actual
-			prevCashAmount := currentCashAmount
-			prevBankAmount := currentBankAmount
-
-			// Actualizar los balances con el nuevo balance previo y las transacciones del trimestre
-			currentCashAmount = prevCashAmount + incomeCashAmount - expenseCashAmount - billCashAmount
-			currentBankAmount = prevBankAmount + incomeBankAmount - expenseBankAmount - billBankAmount
-
-			// Actualizar el registro
-			_, err = db.Exec(`
-				UPDATE quarterly_cash_bank_balance
-				SET cash_amount = ?,
-				    bank_amount = ?,
-				    previous_cash_amount = ?,
-				    previous_bank_amount = ?,
-				    balance_cash_amount = ?,
-				    balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				    updated_at = CURRENT_TIMESTAMP
-				WHERE user_id = ? AND year_quarter = ?
-			`, currentCashAmount, currentBankAmount,
-				prevCashAmount, prevBankAmount,
-				currentCashAmount, currentBankAmount,
-				userID, currentYearQuarter)
-
-			if err != nil {
-				return err
-			}
-		} else {
-			// Si el trimestre no existe, crear un registro para él con valores en 0 para ingresos/gastos/facturas
-			// pero con los valores correctos basados en el trimestre anterior
-			prevCashAmount := currentCashAmount
-			prevBankAmount := currentBankAmount
-
-			// Los montos no cambian ya que no hay transacciones
-			// Sin embargo, creamos el registro para mantener la continuidad
-			_, err = db.Exec(`
-				INSERT INTO quarterly_cash_bank_balance (
-					user_id, year_quarter,
-					income_cash_amount, income_bank_amount,
-					expense_cash_amount, expense_bank_amount,
-					bill_cash_amount, bill_bank_amount,
-					cash_amount, previous_cash_amount,
-					bank_amount, previous_bank_amount,
-					balance_cash_amount, balance_bank_amount
-				) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-			`, userID, currentYearQuarter,
-				0, 0,
-				0, 0,
-				0, 0,
-				prevCashAmount, prevCashAmount,
-				prevBankAmount, prevBankAmount,
-				prevCashAmount, prevBankAmount)
-
-			if err != nil {
-				// Si el error es por duplicado, ignorarlo
-				if !strings.Contains(err.Error(), "UNIQUE constraint failed") {
-					return err
-				}
-			}
-		}
-
-		// Marcar este trimestre como procesado
-		processedQuarters[currentYearQuarter] = struct{}{}
-	}
-
-	return nil
-}
-
-// Función auxiliar para comparar trimestres
-func compareQuarters(q1, q2 string) int {
-	q1Parts := strings.Split(q1, "-Q")
-	q2Parts := strings.Split(q2, "-Q")
-
-	if len(q1Parts) != 2 || len(q2Parts) != 2 {
-		return 0 // Error formato
-	}
-
-	year1, _ := strconv.Atoi(q1Parts[0])
-	quarter1, _ := strconv.Atoi(q1Parts[1])
-	year2, _ := strconv.Atoi(q2Parts[0])
-	quarter2, _ := strconv.Atoi(q2Parts[1])
-
-	if year1 != year2 {
-		return year1 - year2
-	}
-	return quarter1 - quarter2
-}
-
-// Función para actualizar semestres posteriores en cascada
-func updateSubsequentSemiannualBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a 5 años para evitar bucles infinitos
-	endDate := startDate.AddDate(5, 0, 0)
-	currentDate := startDate
-
-	for currentDate.Before(endDate) {
-		// Determinar el semestre actual
-		half := (int(currentDate.Month())-1)/6 + 1
-		currentYearHalf := fmt.Sprintf("%d-H%d", currentDate.Year(), half)
-
-		// Verificar si existe un registro para este semestre
-		var exists bool
-		var incomeAmount, expenseAmount, billsAmount, cashAmount, bankAmount float64
-		err := db.QueryRow(`
-			SELECT 1, income_amount, expense_amount, bills_amount, cash_amount, bank_amount FROM semiannual_balance
-			WHERE user_id = ? AND year_half = ?
-		`, userID, currentYearHalf).Scan(&exists, &incomeAmount, &expenseAmount, &billsAmount, &cashAmount, &bankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// No hay más registros para actualizar
-			break
-		}
-
-		// Obtener el balance del semestre anterior
-		prevHalfDate := currentDate.AddDate(0, -6, 0)
-		prevHalf := (int(prevHalfDate.Month())-1)/6 + 1
-		prevYearHalf := fmt.Sprintf("%d-H%d", prevHalfDate.Year(), prevHalf)
-
-		var previousBalance float64
-		var prevCashAmount, prevBankAmount float64
-		err = db.QueryRow(`
-			SELECT balance, cash_amount, bank_amount FROM semiannual_balance 
-			WHERE user_id = ? AND year_half = ?
-		`, userID, prevYearHalf).Scan(&previousBalance, &prevCashAmount, &prevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			previousBalance = 0
-			prevCashAmount = 0
-			prevBankAmount = 0
-		}
-
-		// Actualizar el balance con el nuevo balance previo
-		balance := previousBalance + incomeAmount - expenseAmount - billsAmount
-
-		// CAMBIO EN LA LÓGICA: Siempre acumulamos los valores del semestre anterior
-		// independientemente de si hay transacciones en este semestre o no
-		hasTransactions := incomeAmount != 0 || expenseAmount != 0 || billsAmount != 0
-
-		// Inicializar con los valores del semestre anterior
-		newCashAmount := prevCashAmount
-		newBankAmount := prevBankAmount
-
-		// Si hay transacciones propias en este semestre, las sumamos a lo heredado
-		if hasTransactions {
-			// Agregamos las transacciones propias de este semestre
-			newCashAmount += cashAmount
-			newBankAmount += bankAmount
-		}
-
-		_, err = db.Exec(`
-			UPDATE semiannual_balance
-			SET previous_balance = ?,
-				balance = ?,
-				cash_amount = ?,
-				bank_amount = ?,
-				previous_cash_amount = ?,
-				previous_bank_amount = ?,
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_half = ?
-		`, previousBalance, balance, newCashAmount, newBankAmount, prevCashAmount, prevBankAmount, userID, currentYearHalf)
-
-		if err != nil {
-			return err
-		}
-
-		// Pasar al siguiente semestre
-		currentDate = currentDate.AddDate(0, 6, 0)
-	}
-
-	return nil
-}
-
-// Función para actualizar años posteriores en cascada
-func updateSubsequentAnnualBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a 5 años para evitar bucles infinitos
-	endDate := startDate.AddDate(5, 0, 0)
-	currentDate := startDate
-
-	for currentDate.Before(endDate) {
-		currentYear := currentDate.Format("2006")
-
-		// Verificar si existe un registro para este año
-		var exists bool
-		var incomeAmount, expenseAmount, billsAmount, cashAmount, bankAmount float64
-		err := db.QueryRow(`
-			SELECT 1, income_amount, expense_amount, bills_amount, cash_amount, bank_amount FROM annual_balance
-			WHERE user_id = ? AND year = ?
-		`, userID, currentYear).Scan(&exists, &incomeAmount, &expenseAmount, &billsAmount, &cashAmount, &bankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// No hay más registros para actualizar
-			break
-		}
-
-		// Obtener el balance del año anterior
-		prevYear := currentDate.AddDate(-1, 0, 0)
-		prevYearStr := prevYear.Format("2006")
-
-		var previousBalance float64
-		var prevCashAmount, prevBankAmount float64
-		err = db.QueryRow(`
-			SELECT balance, cash_amount, bank_amount FROM annual_balance 
-			WHERE user_id = ? AND year = ?
-		`, userID, prevYearStr).Scan(&previousBalance, &prevCashAmount, &prevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			previousBalance = 0
-			prevCashAmount = 0
-			prevBankAmount = 0
-		}
-
-		// Actualizar el balance con el nuevo balance previo
-		balance := previousBalance + incomeAmount - expenseAmount - billsAmount
-
-		// CAMBIO EN LA LÓGICA: Siempre acumulamos los valores del año anterior
-		hasTransactions := incomeAmount != 0 || expenseAmount != 0 || billsAmount != 0
-
-		// Inicializar con los valores del año anterior
-		newCashAmount := prevCashAmount
-		newBankAmount := prevBankAmount
-
-		// Si hay transacciones propias en este año, las sumamos a lo heredado
-		if hasTransactions {
-			// Agregamos las transacciones propias de este año
-			newCashAmount += cashAmount
-			newBankAmount += bankAmount
-		}
-
-		// Calcular los valores de balance para cash y bank
-		balanceCashAmount := prevCashAmount + cashAmount
-		balanceBankAmount := prevBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			UPDATE annual_balance
-			SET previous_balance = ?,
-				balance = ?,
-				cash_amount = ?,
-				bank_amount = ?,
-				previous_cash_amount = ?,
-				previous_bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year = ?
-		`, previousBalance, balance, newCashAmount, newBankAmount, prevCashAmount, prevBankAmount, balanceCashAmount, balanceBankAmount, userID, currentYear)
-
-		if err != nil {
-			return err
-		}
-
-		// Pasar al siguiente año
-		currentDate = currentDate.AddDate(1, 0, 0)
-	}
-
-	return nil
-}
-
-// Nueva función para recalcular todos los balances en cascada
-func recalculateAllBalances(userID string, dateStr string) error {
-	// Parse la fecha de la transacción
-	date, err := time.Parse("2006-01-02", dateStr)
-	if err != nil {
-		return fmt.Errorf("error parsing date: %v", err)
-	}
-
-	// Recalcular balances diarios en cascada desde la fecha de la transacción
-	if err := updateSubsequentDailyBalances(userID, date); err != nil {
-		return fmt.Errorf("error updating daily balances: %v", err)
-	}
-
-	// Calcular el inicio de la semana que contiene la fecha
-	dayOfWeek := int(date.Weekday())
-	if dayOfWeek == 0 {
-		dayOfWeek = 7 // Convertir domingo (0) a 7
-	}
-	startOfWeek := date.AddDate(0, 0, -(dayOfWeek - 1))
-
-	// Recalcular balances semanales en cascada desde la semana que contiene la transacción
-	if err := updateSubsequentWeeklyBalances(userID, startOfWeek); err != nil {
-		return fmt.Errorf("error updating weekly balances: %v", err)
-	}
-
-	// Calcular el inicio del mes que contiene la fecha
-	startOfMonth := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
-
-	// Recalcular balances mensuales en cascada desde el mes que contiene la transacción
-	if err := updateSubsequentMonthlyBalances(userID, startOfMonth); err != nil {
-		return fmt.Errorf("error updating monthly balances: %v", err)
-	}
-
-	// Calcular el inicio del trimestre que contiene la fecha
-	quarter := (int(date.Month()) - 1) / 3
-	startOfQuarter := time.Date(date.Year(), time.Month(quarter*3+1), 1, 0, 0, 0, 0, time.UTC)
-
-	// Recalcular balances trimestrales en cascada desde el trimestre que contiene la transacción
-	if err := updateSubsequentQuarterlyBalances(userID, startOfQuarter); err != nil {
-		return fmt.Errorf("error updating quarterly balances: %v", err)
-	}
-
-	// Calcular el inicio del semestre que contiene la fecha
-	halfYear := (int(date.Month()) - 1) / 6
-	startOfHalfYear := time.Date(date.Year(), time.Month(halfYear*6+1), 1, 0, 0, 0, 0, time.UTC)
-
-	// Recalcular balances semestrales en cascada desde el semestre que contiene la transacción
-	if err := updateSubsequentSemiannualBalances(userID, startOfHalfYear); err != nil {
-		return fmt.Errorf("error updating semiannual balances: %v", err)
-	}
-
-	// Calcular el inicio del año que contiene la fecha
-	startOfYear := time.Date(date.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
-
-	// Recalcular balances anuales en cascada desde el año que contiene la transacción
-	if err := updateSubsequentAnnualBalances(userID, startOfYear); err != nil {
-		return fmt.Errorf("error updating annual balances: %v", err)
-	}
-
-	return nil
-}
-
-// Función para actualizar meses posteriores en cascada
-func updateSubsequentMonthlyBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a 5 años para evitar bucles infinitos
-	currentDate := startDate
-
-	// Mantener un registro de los meses procesados
-	processedMonths := make(map[string]struct{})
-
-	// Encontrar el mes anterior al mes de inicio para saber el valor de partida
-	var lastPrevCashAmount, lastPrevBankAmount float64
-	prevToStartDate := startDate.AddDate(0, -1, 0)
-	prevToStartYearMonth := prevToStartDate.Format("2006-01")
-
-	err := db.QueryRow(`
-		SELECT cash_amount, bank_amount FROM monthly_cash_bank_balance 
-		WHERE user_id = ? AND year_month = ?
-	`, userID, prevToStartYearMonth).Scan(&lastPrevCashAmount, &lastPrevBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// Si no hay un mes inmediatamente anterior, buscar el último mes anterior disponible
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM monthly_cash_bank_balance 
-			WHERE user_id = ? AND year_month < ?
-			ORDER BY year_month DESC LIMIT 1
-		`, userID, startDate.Format("2006-01")).Scan(&lastPrevCashAmount, &lastPrevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		// Si no se encuentra ningún mes anterior, usar valores en cero
-		if err == sql.ErrNoRows {
-			lastPrevCashAmount = 0
-			lastPrevBankAmount = 0
-		}
-	}
-
-	// Obtener todos los meses existentes desde la fecha de inicio hasta 5 años después
-	rows, err := db.Query(`
-		SELECT year_month FROM monthly_cash_bank_balance
-		WHERE user_id = ? AND year_month >= ?
-		ORDER BY year_month ASC
-	`, userID, startDate.Format("2006-01"))
-
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	var existingMonths []string
-	for rows.Next() {
-		var yearMonth string
-		if err := rows.Scan(&yearMonth); err != nil {
-			return err
-		}
-		existingMonths = append(existingMonths, yearMonth)
-	}
-
-	// Si no hay meses existentes, no hay nada que procesar
-	if len(existingMonths) == 0 {
-		return nil
-	}
-
-	// Determinar el último mes que necesitamos procesar
-	lastMonthStr := existingMonths[len(existingMonths)-1]
-	lastMonthParts := strings.Split(lastMonthStr, "-")
-	if len(lastMonthParts) != 2 {
-		return fmt.Errorf("invalid month format: %s", lastMonthStr)
-	}
-	lastYear, _ := strconv.Atoi(lastMonthParts[0])
-	lastMonth, _ := strconv.Atoi(lastMonthParts[1])
-	lastDate := time.Date(lastYear, time.Month(lastMonth), 1, 0, 0, 0, 0, time.UTC)
-
-	// Crear un mapa para acceso rápido a los meses existentes
-	existingMonthsMap := make(map[string]bool)
-	for _, m := range existingMonths {
-		existingMonthsMap[m] = true
-	}
-
-	// Variables para mantener los valores acumulados
-	currentCashAmount := lastPrevCashAmount
-	currentBankAmount := lastPrevBankAmount
-
-	// Iterar mes por mes desde la fecha de inicio hasta el último mes existente
-	for currentDate.Before(lastDate.AddDate(0, 1, 0)) {
-		currentYearMonth := currentDate.Format("2006-01")
-
-		if existingMonthsMap[currentYearMonth] {
-			// Si el mes existe, actualizarlo con los valores correctos
-			var incomeCashAmount, incomeBankAmount float64
-			var expenseCashAmount, expenseBankAmount float64
-			var billCashAmount, billBankAmount float64
-
-			err := db.QueryRow(`
-				SELECT income_cash_amount, income_bank_amount,
-				       expense_cash_amount, expense_bank_amount,
-				       bill_cash_amount, bill_bank_amount
-				FROM monthly_cash_bank_balance
-				WHERE user_id = ? AND year_month = ?
-			`, userID, currentYearMonth).Scan(
-				&incomeCashAmount, &incomeBankAmount,
-				&expenseCashAmount, &expenseBankAmount,
-				&billCashAmount, &billBankAmount)
-
-			if err != nil {
-				return err
-			}
-
-			// Calcular nuevos montos considerando los ingresos, gastos y facturas del mes actual
-			prevCashAmount := currentCashAmount
-			prevBankAmount := currentBankAmount
-
-			// Actualizar los balances con el nuevo balance previo y las transacciones del mes
-			currentCashAmount = prevCashAmount + incomeCashAmount - expenseCashAmount - billCashAmount
-			currentBankAmount = prevBankAmount + incomeBankAmount - expenseBankAmount - billBankAmount
-
-			// Actualizar el registro
-			_, err = db.Exec(`
-				UPDATE monthly_cash_bank_balance
-				SET cash_amount = ?,
-				    bank_amount = ?,
-				    previous_cash_amount = ?,
-				    previous_bank_amount = ?,
-				    balance_cash_amount = ?,
-				    balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				    updated_at = CURRENT_TIMESTAMP
-				WHERE user_id = ? AND year_month = ?
-			`, currentCashAmount, currentBankAmount,
-				prevCashAmount, prevBankAmount,
-				currentCashAmount, currentBankAmount,
-				userID, currentYearMonth)
-
-			if err != nil {
-				return err
-			}
-		} else {
-			// Si el mes no existe, crear un registro para él con valores en 0 para ingresos/gastos/facturas
-			// pero con los valores correctos basados en el mes anterior
-			prevCashAmount := currentCashAmount
-			prevBankAmount := currentBankAmount
-
-			// Los montos no cambian ya que no hay transacciones
-			// Sin embargo, creamos el registro para mantener la continuidad
-			_, err = db.Exec(`
-				INSERT INTO monthly_cash_bank_balance (
-					user_id, year_month,
-					income_cash_amount, income_bank_amount,
-					expense_cash_amount, expense_bank_amount,
-					bill_cash_amount, bill_bank_amount,
-					cash_amount, previous_cash_amount,
-					bank_amount, previous_bank_amount,
-					balance_cash_amount, balance_bank_amount
-				) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-			`, userID, currentYearMonth,
-				0, 0,
-				0, 0,
-				0, 0,
-				prevCashAmount, prevCashAmount,
-				prevBankAmount, prevBankAmount,
-				prevCashAmount, prevBankAmount)
-
-			if err != nil {
-				// Si el error es por duplicado, ignorarlo
-				if !strings.Contains(err.Error(), "UNIQUE constraint failed") {
-					return err
-				}
-			}
-		}
-
-		// Marcar este mes como procesado
-		processedMonths[currentYearMonth] = struct{}{}
-
-		// Avanzar al mes siguiente
-		currentDate = currentDate.AddDate(0, 1, 0)
-	}
-
-	return nil
+	return common.ReplaceLedgerEntries(q, expense.UserID, common.LedgerSourceExpense, int64(expense.ID), common.LedgerEntry{
+		Date:          date,
+		Kind:          common.LedgerExpense,
+		PaymentMethod: expense.PaymentMethod,
+		Amount:        expense.Amount,
+	})
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -36,6 +37,7 @@ type User struct {
 	FamilyName    string    `json:"family_name"`
 	Picture       string    `json:"picture"`
 	Locale        string    `json:"locale"`
+	Timezone      string    `json:"timezone,omitempty"`
 	VerifiedEmail bool      `json:"verified_email"`
 	CreatedAt     time.Time `json:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at"`
@@ -67,6 +69,11 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// IANA time zone of the device (timezone.go is generated from common)
+	if err := EnsureUserTimezoneColumn(db); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func main() {
@@ -87,6 +94,7 @@ func handleGoogleAuth(w http.ResponseWriter, r *http.Request) {
 		IDToken      string `json:"idToken"`
 		AccessToken  string `json:"accessToken"`
 		DeviceLocale string `json:"deviceLocale"`
+		DeviceTZ     string `json:"deviceTimezone"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
@@ -125,6 +133,15 @@ func handleGoogleAuth(w http.ResponseWriter, r *http.Request) {
 		log.Printf("No locale available, defaulting to en-US for user %s", user.Email)
 	}
 
+	// Device time zone, used by the other services for dates and periods
+	if data.DeviceTZ != "" {
+		if timezone, err := NormalizeTimezone(data.DeviceTZ); err == nil {
+			user.Timezone = timezone
+		} else {
+			log.Printf("Ignoring device time zone for user %s: %v", user.Email, err)
+		}
+	}
+
 	// Debug: Verify the locale is set correctly before database operations
 	log.Printf("Final locale value before DB operations: '%s'", user.Locale)
 
@@ -151,10 +168,10 @@ func handleGoogleAuth(w http.ResponseWriter, r *http.Request) {
 		result, err := db.Exec(`
 			INSERT INTO users (
 				google_id, email, name, given_name, family_name, 
-				picture, locale, verified_email
-			) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				picture, locale, verified_email, timezone
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))`,
 			user.GoogleID, user.Email, user.Name, user.GivenName,
-			user.FamilyName, user.Picture, user.Locale, user.VerifiedEmail,
+			user.FamilyName, user.Picture, user.Locale, user.VerifiedEmail, user.Timezone,
 		)
 		if err != nil {
 			log.Printf("Failed to create user: %v", err)
@@ -165,6 +182,13 @@ func handleGoogleAuth(w http.ResponseWriter, r *http.Request) {
 		userID, _ := result.LastInsertId()
 		user.ID = int(userID)
 		log.Printf("Created new user with ID: %d, locale: '%s'", user.ID, user.Locale)
+
+		// Default categories in the user's language (default_categories.go is generated from common)
+		if seeded, err := SeedDefaultCategories(db, strconv.Itoa(user.ID), user.Locale); err != nil {
+			log.Printf("Warning: failed to seed default categories: %v", err)
+		} else {
+			log.Printf("Seeded %d default categories for user %d", seeded.Added+seeded.Linked, user.ID)
+		}
 	} else if err != nil {
 		log.Printf("Database error: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -175,10 +199,11 @@ func handleGoogleAuth(w http.ResponseWriter, r *http.Request) {
 		_, err = db.Exec(`
 			UPDATE users SET 
 				email = ?, name = ?, given_name = ?, family_name = ?,
-				picture = ?, locale = ?, verified_email = ?, updated_at = CURRENT_TIMESTAMP
+				picture = ?, locale = ?, verified_email = ?, timezone = COALESCE(NULLIF(?, ''), timezone),
+				updated_at = CURRENT_TIMESTAMP
 			WHERE google_id = ?`,
 			user.Email, user.Name, user.GivenName, user.FamilyName,
-			user.Picture, user.Locale, user.VerifiedEmail, user.GoogleID,
+			user.Picture, user.Locale, user.VerifiedEmail, user.Timezone, user.GoogleID,
 		)
 		if err != nil {
 			log.Printf("Failed to update user: %v", err)
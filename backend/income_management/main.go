@@ -8,10 +8,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
+	"hero_budget_backend/common"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -26,6 +27,9 @@ type Income struct {
 	Description   string  `json:"description,omitempty"`
 	CreatedAt     string  `json:"created_at,omitempty"`
 	UpdatedAt     string  `json:"updated_at,omitempty"`
+	Version       int     `json:"version"`
+	ETag          string  `json:"etag,omitempty"`
+	Status        string  `json:"status"` // "pending", "cleared" o "reconciled"
 }
 
 type AddIncomeRequest struct {
@@ -45,6 +49,7 @@ type UpdateIncomeRequest struct {
 	Category      string  `json:"category,omitempty"`
 	PaymentMethod string  `json:"payment_method,omitempty"`
 	Description   string  `json:"description,omitempty"`
+	Version       int     `json:"version,omitempty"` // Optional precondition, same as If-Match
 }
 
 type DeleteIncomeRequest struct {
@@ -89,6 +94,26 @@ func init() {
 	// Create tables if they don't exist
 	createTablesIfNotExist()
 
+	// Table used to replay responses of retried requests
+	if err := common.EnsureIdempotencyTable(db); err != nil {
+		log.Fatalf("Failed to create idempotency_keys table: %v", err)
+	}
+
+	// Ledger from which the period balance tables are projected
+	if err := common.EnsureLedgerTable(db); err != nil {
+		log.Fatalf("Failed to create balance ledger: %v", err)
+	}
+
+	// Domain events written in the same transaction as each change
+	if err := common.EnsureOutboxTable(db); err != nil {
+		log.Fatalf("Failed to create outbox: %v", err)
+	}
+
+	// Each income keeps a reference to its category
+	if err := common.EnsureCategoryIDColumn(db, "incomes"); err != nil {
+		log.Fatalf("Failed to add category_id to incomes: %v", err)
+	}
+
 	// Función para añadir columnas de forma segura a una tabla existente
 	alterTableSafely := func(tableName, columnName, columnType string) {
 		// Comprobar si la columna ya existe
@@ -218,6 +243,18 @@ func init() {
 	// Ejecutar las verificaciones y añadir columnas faltantes
 	ensureRequiredColumns()
 
+	// Row version for optimistic concurrency on updates
+	// (alterTableSafely forces DEFAULT 0, and versions must start at 1)
+	if _, err := db.Exec(`ALTER TABLE incomes ADD COLUMN version INTEGER NOT NULL DEFAULT 1`); err != nil &&
+		!strings.Contains(err.Error(), "duplicate column") {
+		log.Printf("Error adding column version to incomes: %v", err)
+	}
+
+	// Reconciliation status (pending, cleared, reconciled)
+	if err := common.EnsureTransactionStatusColumns(db); err != nil {
+		log.Printf("Error adding status columns: %v", err)
+	}
+
 	log.Println("Database connection established successfully")
 }
 
@@ -652,9 +689,9 @@ func createTablesIfNotExist() {
 func main() {
 	// Set up CORS middleware and routes
 	http.HandleFunc("/incomes", corsMiddleware(handleFetchIncomes))
-	http.HandleFunc("/incomes/add", corsMiddleware(handleAddIncome))
-	http.HandleFunc("/incomes/update", corsMiddleware(handleUpdateIncome))
-	http.HandleFunc("/incomes/delete", corsMiddleware(handleDeleteIncome))
+	http.HandleFunc("/incomes/add", corsMiddleware(common.WithIdempotency(db, handleAddIncome)))
+	http.HandleFunc("/incomes/update", corsMiddleware(common.WithIdempotency(db, handleUpdateIncome)))
+	http.HandleFunc("/incomes/delete", corsMiddleware(common.WithIdempotency(db, handleDeleteIncome)))
 
 	port := 8093 // Nuevo puerto para el servicio de ingresos
 	log.Printf("Income Management service started on :%d", port)
@@ -666,7 +703,8 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// Set headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		// If it's OPTIONS, return with just the headers (preflight request)
 		if r.Method == "OPTIONS" {
@@ -730,8 +768,8 @@ func handleAddIncome(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if addRequest.Date == "" {
-		// Use current date if not provided
-		addRequest.Date = time.Now().Format("2006-01-02")
+		// Use the user's current date if not provided
+		addRequest.Date = common.UserToday(db, addRequest.UserID)
 	}
 
 	if addRequest.Category == "" {
@@ -754,33 +792,31 @@ func handleAddIncome(w http.ResponseWriter, r *http.Request) {
 		Description:   addRequest.Description,
 	}
 
-	// Add the income to the database
-	incomeID, err := addIncome(income)
-	if err != nil {
-		log.Printf("Error adding income: %v", err)
-		sendErrorResponse(w, "Error adding income", http.StatusInternalServerError)
-		return
-	}
-
-	// Set the ID of the newly added income
-	income.ID = incomeID
+	// Add the income and update every balance in one transaction
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		incomeID, err := addIncome(tx, income)
+		if err != nil {
+			return fmt.Errorf("error adding income: %v", err)
+		}
 
-	// Update cash or bank balance based on payment method
-	if err := updateBalance(income.UserID, income.Amount, income.PaymentMethod); err != nil {
-		log.Printf("Error updating balance: %v", err)
-		// Don't fail the entire request, just log the error
-	}
+		// Set the ID of the newly added income
+		income.ID = incomeID
 
-	// Actualizar los balances por periodos
-	if err := updateTimeBalances(income.UserID, income.Amount, income.Date); err != nil {
-		log.Printf("Error updating time balances: %v", err)
-		// Don't fail the entire request, just log the error
-	}
+		// Update cash or bank balance based on payment method
+		if err := updateBalance(tx, income.UserID, income.Amount, income.PaymentMethod); err != nil {
+			return fmt.Errorf("error updating balance: %v", err)
+		}
 
-	// Recalcular todos los balances en cascada
-	if err := recalculateAllBalances(income.UserID, income.Date); err != nil {
-		log.Printf("Error recalculating balances: %v", err)
-		// Don't fail the entire request, just log the error
+		// Update the period balances
+		if err := recordIncomeLedger(tx, income); err != nil {
+			return fmt.Errorf("error updating time balances: %v", err)
+		}
+		return common.PublishEvent(tx, common.EventIncomeCreated, income.UserID, int64(income.ID), income)
+	})
+	if err != nil {
+		log.Printf("Error adding income: %v", err)
+		sendErrorResponse(w, "Error adding income", common.TxErrorStatus(err))
+		return
 	}
 
 	// Return success response
@@ -812,8 +848,15 @@ func handleUpdateIncome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Optional precondition from If-Match or the version field
+	expectedVersion, hasPrecondition, err := common.ExpectedVersion(r, updateRequest.Version)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Check if the income exists
-	oldIncome, err := fetchIncomeByID(updateRequest.IncomeID, updateRequest.UserID)
+	oldIncome, err := fetchIncomeByID(db, updateRequest.IncomeID, updateRequest.UserID)
 	if err != nil {
 		log.Printf("Error fetching income: %v", err)
 		sendErrorResponse(w, "Error fetching income", http.StatusInternalServerError)
@@ -825,10 +868,20 @@ func handleUpdateIncome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Reconciled incomes are locked against edits
+	if oldIncome.Status == common.StatusReconciled {
+		sendErrorResponse(w, common.ErrTransactionLocked.Error(), http.StatusLocked)
+		return
+	}
+
+	if hasPrecondition && oldIncome.Version != expectedVersion {
+		sendConflictResponse(w, oldIncome)
+		return
+	}
+
 	// Keep track of the old payment method and amount for balance adjustment
 	oldAmount := oldIncome.Amount
 	oldPaymentMethod := oldIncome.PaymentMethod
-	oldDate := oldIncome.Date
 
 	// Update the income with the provided values
 	if updateRequest.Amount > 0 {
@@ -855,39 +908,50 @@ func handleUpdateIncome(w http.ResponseWriter, r *http.Request) {
 		oldIncome.Description = updateRequest.Description
 	}
 
-	// Update the income in the database
-	err = updateIncome(*oldIncome)
-	if err != nil {
-		log.Printf("Error updating income: %v", err)
-		sendErrorResponse(w, "Error updating income", http.StatusInternalServerError)
-		return
-	}
-
-	// Adjust balances if amount or payment method changed
-	if oldAmount != oldIncome.Amount || oldPaymentMethod != oldIncome.PaymentMethod {
-		// Remove the old amount from the old payment method
-		if err := updateBalance(oldIncome.UserID, -oldAmount, oldPaymentMethod); err != nil {
-			log.Printf("Error updating old balance: %v", err)
+	// Update the income and its balances in one transaction
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		if err := updateIncome(tx, *oldIncome, expectedVersion); err != nil {
+			return err
 		}
 
-		// Add the new amount to the new payment method
-		if err := updateBalance(oldIncome.UserID, oldIncome.Amount, oldIncome.PaymentMethod); err != nil {
-			log.Printf("Error updating new balance: %v", err)
-		}
-	}
+		// Adjust balances if amount or payment method changed
+		if oldAmount != oldIncome.Amount || oldPaymentMethod != oldIncome.PaymentMethod {
+			// Remove the old amount from the old payment method
+			if err := updateBalance(tx, oldIncome.UserID, -oldAmount, oldPaymentMethod); err != nil {
+				return fmt.Errorf("error updating old balance: %v", err)
+			}
 
-	// Recalcular todos los balances para la fecha antigua y la nueva, si cambió
-	if err := recalculateAllBalances(oldIncome.UserID, oldDate); err != nil {
-		log.Printf("Error recalculating balances for old date: %v", err)
-	}
+			// Add the new amount to the new payment method
+			if err := updateBalance(tx, oldIncome.UserID, oldIncome.Amount, oldIncome.PaymentMethod); err != nil {
+				return fmt.Errorf("error updating new balance: %v", err)
+			}
+		}
 
-	if oldDate != oldIncome.Date {
-		if err := recalculateAllBalances(oldIncome.UserID, oldIncome.Date); err != nil {
-			log.Printf("Error recalculating balances for new date: %v", err)
+		// The ledger replaces the previous entry, with its date, with the new one
+		if err := recordIncomeLedger(tx, *oldIncome); err != nil {
+			return fmt.Errorf("error updating time balances: %v", err)
+		}
+		return common.PublishEvent(tx, common.EventIncomeUpdated, oldIncome.UserID, int64(oldIncome.ID), oldIncome)
+	})
+	if err == common.ErrVersionConflict {
+		// Another request won the race between our read and our write
+		if current, fetchErr := fetchIncomeByID(db, oldIncome.ID, oldIncome.UserID); fetchErr == nil && current != nil {
+			sendConflictResponse(w, current)
+			return
 		}
+		sendErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating income: %v", err)
+		sendErrorResponse(w, "Error updating income", common.TxErrorStatus(err))
+		return
 	}
 
-	// Return success response
+	// Return success response with the new version
+	oldIncome.Version++
+	oldIncome.ETag = common.ETag(oldIncome.Version)
+	w.Header().Set("ETag", oldIncome.ETag)
 	sendSuccessResponse(w, "Income updated successfully", oldIncome)
 }
 
@@ -917,7 +981,7 @@ func handleDeleteIncome(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if the income exists and get its details for balance adjustment
-	income, err := fetchIncomeByID(deleteRequest.IncomeID, deleteRequest.UserID)
+	income, err := fetchIncomeByID(db, deleteRequest.IncomeID, deleteRequest.UserID)
 	if err != nil {
 		log.Printf("Error fetching income: %v", err)
 		sendErrorResponse(w, "Error fetching income", http.StatusInternalServerError)
@@ -929,27 +993,33 @@ func handleDeleteIncome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Guardar la fecha antes de eliminar
-	incomeDate := income.Date
-
-	// Delete the income from the database
-	err = deleteIncome(deleteRequest.IncomeID, deleteRequest.UserID)
-	if err != nil {
-		log.Printf("Error deleting income: %v", err)
-		sendErrorResponse(w, "Error deleting income", http.StatusInternalServerError)
+	// Reconciled incomes are locked against deletion
+	if income.Status == common.StatusReconciled {
+		sendErrorResponse(w, common.ErrTransactionLocked.Error(), http.StatusLocked)
 		return
 	}
 
-	// Adjust the balance (subtract the amount)
-	if err := updateBalance(income.UserID, -income.Amount, income.PaymentMethod); err != nil {
-		log.Printf("Error updating balance: %v", err)
-		// Don't fail the entire request, just log the error
-	}
+	// Delete the income and undo its balances in one transaction
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		if err := deleteIncome(tx, deleteRequest.IncomeID, deleteRequest.UserID); err != nil {
+			return fmt.Errorf("error deleting income: %v", err)
+		}
+
+		// Adjust the balance (subtract the amount)
+		if err := updateBalance(tx, income.UserID, -income.Amount, income.PaymentMethod); err != nil {
+			return fmt.Errorf("error updating balance: %v", err)
+		}
 
-	// Recalcular todos los balances en cascada
-	if err := recalculateAllBalances(income.UserID, incomeDate); err != nil {
-		log.Printf("Error recalculating balances: %v", err)
-		// Don't fail the entire request, just log the error
+		// Remove the income from the period balances
+		if err := common.RemoveLedgerEntries(tx, income.UserID, common.LedgerSourceIncome, int64(income.ID)); err != nil {
+			return fmt.Errorf("error updating time balances: %v", err)
+		}
+		return common.PublishEvent(tx, common.EventIncomeDeleted, income.UserID, int64(income.ID), income)
+	})
+	if err != nil {
+		log.Printf("Error deleting income: %v", err)
+		sendErrorResponse(w, "Error deleting income", common.TxErrorStatus(err))
+		return
 	}
 
 	// Return success response
@@ -959,7 +1029,7 @@ func handleDeleteIncome(w http.ResponseWriter, r *http.Request) {
 func fetchIncomes(userID string) ([]Income, error) {
 	// Query to get all incomes for the given user
 	query := `
-		SELECT id, user_id, amount, date, category, payment_method, description, created_at, updated_at
+		SELECT id, user_id, amount, date, category, payment_method, description, created_at, updated_at, COALESCE(version, 1), COALESCE(status, 'pending')
 		FROM incomes
 		WHERE user_id = ?
 		ORDER BY date DESC
@@ -985,9 +1055,12 @@ func fetchIncomes(userID string) ([]Income, error) {
 			&income.Description,
 			&income.CreatedAt,
 			&income.UpdatedAt,
+			&income.Version,
+			&income.Status,
 		); err != nil {
 			return nil, err
 		}
+		income.ETag = common.ETag(income.Version)
 
 		incomes = append(incomes, income)
 	}
@@ -999,16 +1072,16 @@ func fetchIncomes(userID string) ([]Income, error) {
 	return incomes, nil
 }
 
-func fetchIncomeByID(incomeID int, userID string) (*Income, error) {
+func fetchIncomeByID(q common.DBTX, incomeID int, userID string) (*Income, error) {
 	// Query to get a specific income
 	query := `
-		SELECT id, user_id, amount, date, category, payment_method, description, created_at, updated_at
+		SELECT id, user_id, amount, date, category, payment_method, description, created_at, updated_at, COALESCE(version, 1), COALESCE(status, 'pending')
 		FROM incomes
 		WHERE id = ? AND user_id = ?
 	`
 
 	var income Income
-	err := db.QueryRow(query, incomeID, userID).Scan(
+	err := q.QueryRow(query, incomeID, userID).Scan(
 		&income.ID,
 		&income.UserID,
 		&income.Amount,
@@ -1018,6 +1091,8 @@ func fetchIncomeByID(incomeID int, userID string) (*Income, error) {
 		&income.Description,
 		&income.CreatedAt,
 		&income.UpdatedAt,
+		&income.Version,
+		&income.Status,
 	)
 
 	if err == sql.ErrNoRows {
@@ -1025,24 +1100,32 @@ func fetchIncomeByID(incomeID int, userID string) (*Income, error) {
 	} else if err != nil {
 		return nil, err
 	}
+	income.ETag = common.ETag(income.Version)
 
 	return &income, nil
 }
 
-func addIncome(income Income) (int, error) {
+func addIncome(q common.DBTX, income Income) (int, error) {
+	// Link the income to its category so reports can group it by ID
+	categoryID, err := common.ResolveCategoryID(q, income.UserID, "income", income.Category)
+	if err != nil {
+		return 0, err
+	}
+
 	// Insert income into the database
 	query := `
 		INSERT INTO incomes (
-			user_id, amount, date, category, payment_method, description
-		) VALUES (?, ?, ?, ?, ?, ?)
+			user_id, amount, date, category, category_id, payment_method, description
+		) VALUES (?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := db.Exec(
+	result, err := q.Exec(
 		query,
 		income.UserID,
 		income.Amount,
 		income.Date,
 		income.Category,
+		categoryID,
 		income.PaymentMethod,
 		income.Description,
 	)
@@ -1060,42 +1143,64 @@ func addIncome(income Income) (int, error) {
 	return int(id), nil
 }
 
-func updateIncome(income Income) error {
+// updateIncome overwrites an income and bumps its version. When expectedVersion is
+// greater than zero the write only applies if the stored version still matches.
+func updateIncome(q common.DBTX, income Income, expectedVersion int) error {
+	categoryID, err := common.ResolveCategoryID(q, income.UserID, "income", income.Category)
+	if err != nil {
+		return err
+	}
+
 	// Update income in the database
 	query := `
 		UPDATE incomes
-		SET amount = ?, date = ?, category = ?, payment_method = ?, description = ?, updated_at = CURRENT_TIMESTAMP
-		WHERE id = ? AND user_id = ?
+		SET amount = ?, date = ?, category = ?, category_id = ?, payment_method = ?, description = ?,
+		    version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND user_id = ? AND (? = 0 OR COALESCE(version, 1) = ?)
 	`
 
-	_, err := db.Exec(
+	result, err := q.Exec(
 		query,
 		income.Amount,
 		income.Date,
 		income.Category,
+		categoryID,
 		income.PaymentMethod,
 		income.Description,
 		income.ID,
 		income.UserID,
+		expectedVersion,
+		expectedVersion,
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 && expectedVersion > 0 {
+		return common.ErrVersionConflict
+	}
+
+	return nil
 }
 
-func deleteIncome(incomeID int, userID string) error {
+func deleteIncome(q common.DBTX, incomeID int, userID string) error {
 	// Delete income from the database
 	query := `
 		DELETE FROM incomes
 		WHERE id = ? AND user_id = ?
 	`
 
-	_, err := db.Exec(query, incomeID, userID)
+	_, err := q.Exec(query, incomeID, userID)
 	return err
 }
 
-func updateBalance(userID string, amount float64, paymentMethod string) error {
+func updateBalance(q common.DBTX, userID string, amount float64, paymentMethod string) error {
 	// Get current month in format YYYY-MM
-	currentMonth := time.Now().Format("2006-01")
+	currentMonth := common.UserNow(q, userID).Format("2006-01")
 
 	// Fetch current cash-bank distribution
 	var distribution struct {
@@ -1112,7 +1217,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 		WHERE user_id = ? AND month = ?
 	`
 	var exists bool
-	err := db.QueryRow(checkQuery, userID, currentMonth).Scan(&exists)
+	err := q.QueryRow(checkQuery, userID, currentMonth).Scan(&exists)
 	if err != nil && err != sql.ErrNoRows {
 		return err
 	}
@@ -1126,7 +1231,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 			FROM cash_bank
 			WHERE user_id = ? AND month = ?
 		`
-		err := db.QueryRow(getQuery, userID, currentMonth).Scan(
+		err := q.QueryRow(getQuery, userID, currentMonth).Scan(
 			&distribution.CashAmount,
 			&distribution.BankAmount,
 			&distribution.MonthlyTotal,
@@ -1157,7 +1262,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 			SET cash_amount = ?, cash_percent = ?, bank_amount = ?, bank_percent = ?, monthly_total = ?, updated_at = CURRENT_TIMESTAMP
 			WHERE user_id = ? AND month = ?
 		`
-		_, err = db.Exec(
+		_, err = q.Exec(
 			updateQuery,
 			distribution.CashAmount,
 			cashPercent,
@@ -1194,7 +1299,7 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 			INSERT INTO cash_bank (user_id, month, cash_amount, cash_percent, bank_amount, bank_percent, monthly_total)
 			VALUES (?, ?, ?, ?, ?, ?, ?)
 		`
-		_, err = db.Exec(
+		_, err = q.Exec(
 			insertQuery,
 			userID,
 			currentMonth,
@@ -1217,12 +1322,12 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 			VALUES (?, ?, ?, ?)
 		`
 		transactionType := "income_" + paymentMethod
-		_, err = db.Exec(
+		_, err = q.Exec(
 			transactionQuery,
 			userID,
 			transactionType,
 			amount,
-			time.Now().Format("2006-01-02"),
+			common.UserToday(q, userID),
 		)
 		if err != nil {
 			return err
@@ -1232,1580 +1337,52 @@ func updateBalance(userID string, amount float64, paymentMethod string) error {
 	return nil
 }
 
-// Función para actualizar los balances por periodos al añadir un ingreso
-func updateTimeBalances(userID string, amount float64, dateStr string) error {
-	// Parse la fecha del ingreso
-	date, err := time.Parse("2006-01-02", dateStr)
-	if err != nil {
-		return fmt.Errorf("error parsing date: %v", err)
-	}
-
-	// Obtener la información del ingreso para determinar si fue cash o bank
-	var paymentMethod string
-	err = db.QueryRow(`
-		SELECT payment_method FROM incomes
-		WHERE user_id = ? AND date = ? AND amount = ?
-		ORDER BY created_at DESC LIMIT 1
-	`, userID, dateStr, amount).Scan(&paymentMethod)
-
-	if err != nil && err != sql.ErrNoRows {
-		return fmt.Errorf("error fetching payment method: %v", err)
-	}
-
-	if err == sql.ErrNoRows {
-		// Si no se encuentra, asumimos bank por defecto
-		paymentMethod = "bank"
-	}
-
-	// Calculamos los montos de cash y bank según el método de pago
-	var cashAmount, bankAmount float64
-	if paymentMethod == "cash" {
-		cashAmount = amount
-		bankAmount = 0
-	} else {
-		cashAmount = 0
-		bankAmount = amount
-	}
-
-	// Actualizar balance diario con las nuevas tablas
-	if err := updateDailyBalance(userID, amount, 0, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating daily balance: %v", err)
-	}
-
-	// Actualizar balance semanal con las nuevas tablas
-	if err := updateWeeklyBalance(userID, amount, 0, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating weekly balance: %v", err)
-	}
-
-	// Actualizar balance mensual con las nuevas tablas
-	if err := updateMonthlyBalance(userID, amount, 0, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating monthly balance: %v", err)
-	}
-
-	// Actualizar balance trimestral con las nuevas tablas
-	if err := updateQuarterlyBalance(userID, amount, 0, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating quarterly balance: %v", err)
-	}
-
-	// Actualizar balance semestral con las nuevas tablas
-	if err := updateSemiannualBalance(userID, amount, 0, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating semiannual balance: %v", err)
-	}
-
-	// Actualizar balance anual con las nuevas tablas
-	if err := updateAnnualBalance(userID, amount, 0, 0, cashAmount, bankAmount, date); err != nil {
-		log.Printf("Error updating annual balance: %v", err)
+func sendSuccessResponse(w http.ResponseWriter, message string, data interface{}) {
+	response := ApiResponse{
+		Success: true,
+		Message: message,
+		Data:    data,
 	}
-
-	return nil
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
 }
 
-func updateDailyBalance(userID string, incomeAmount, expenseAmount, billsAmount float64, cashAmount, bankAmount float64, date time.Time) error {
-	// Formatear la fecha YYYY-MM-DD
-	dateStr := date.Format("2006-01-02")
-
-	// Calcular el día anterior
-	prevDay := date.AddDate(0, 0, -1)
-	prevDateStr := prevDay.Format("2006-01-02")
-
-	var previousCashAmount, previousBankAmount float64
-	var exists bool
-
-	// Buscar registro del día anterior
-	err := db.QueryRow(`
-		SELECT cash_amount, bank_amount
-		FROM daily_cash_bank_balance 
-		WHERE user_id = ? AND date = ?
-	`, userID, prevDateStr).Scan(&previousCashAmount, &previousBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	// Si no existe registro del día anterior, buscar el último día anterior con registro
-	if err == sql.ErrNoRows {
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM daily_cash_bank_balance 
-			WHERE user_id = ? AND date < ?
-			ORDER BY date DESC LIMIT 1
-		`, userID, dateStr).Scan(&previousCashAmount, &previousBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		// Si no se encuentra ningún día anterior, ambos valores son 0
-		if err == sql.ErrNoRows {
-			previousCashAmount = 0
-			previousBankAmount = 0
-		}
-	}
-
-	// Verificar si ya existe un registro para esta fecha
-	var existingIncomeBank, existingIncomeCash float64
-	var existingExpenseBank, existingExpenseCash float64
-	var existingBillBank, existingBillCash float64
-	var existingCashAmount, existingBankAmount float64
-	err = db.QueryRow(`
-		SELECT 1, income_cash_amount, income_bank_amount, expense_cash_amount, expense_bank_amount, bill_cash_amount, bill_bank_amount, cash_amount, bank_amount
-		FROM daily_cash_bank_balance
-		WHERE user_id = ? AND date = ?
-	`, userID, dateStr).Scan(&exists, &existingIncomeCash, &existingIncomeBank, &existingExpenseCash, &existingExpenseBank, &existingBillCash, &existingBillBank, &existingCashAmount, &existingBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, crear uno nuevo
-		// Calcular los nuevos montos en efectivo y banco
-		newCashAmount := previousCashAmount + cashAmount
-		newBankAmount := previousBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO daily_cash_bank_balance (
-				user_id, date, 
-				income_cash_amount, income_bank_amount, 
-				expense_cash_amount, expense_bank_amount, 
-				bill_cash_amount, bill_bank_amount, 
-				cash_amount, previous_cash_amount,
-				bank_amount, previous_bank_amount,
-				balance_cash_amount, balance_bank_amount
-			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, dateStr,
-			cashAmount, bankAmount,
-			0, 0,
-			0, 0,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount)
-	} else {
-		// Actualizar registro existente
-		// IMPORTANTE: Mantener los valores actuales y sumar el nuevo ingreso
-		newCashAmount := existingCashAmount + cashAmount
-		newBankAmount := existingBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			UPDATE daily_cash_bank_balance SET
-				income_cash_amount = income_cash_amount + ?,
-				income_bank_amount = income_bank_amount + ?,
-				cash_amount = ?,
-				previous_cash_amount = ?,
-				bank_amount = ?,
-				previous_bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				total_balance = (balance_cash_amount + balance_bank_amount),
-				total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND date = ?
-		`, cashAmount, bankAmount,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount,
-			userID, dateStr)
-	}
-
-	if err != nil {
-		return err
+// sendConflictResponse returns 409 with the current server copy of a stale update
+func sendConflictResponse(w http.ResponseWriter, current *Income) {
+	response := ApiResponse{
+		Success: false,
+		Message: "Income was modified by another request",
+		Data:    current,
 	}
 
-	// Actualizar días posteriores en cascada
-	return updateSubsequentDailyBalances(userID, date.AddDate(0, 0, 1))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", current.ETag)
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(response)
 }
 
-// Nueva función para actualizar días posteriores en cascada
-func updateSubsequentDailyBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a 365 días para evitar bucles infinitos
-	endDate := startDate.AddDate(0, 0, 365)
-	currentDate := startDate
-
-	for currentDate.Before(endDate) {
-		currentDateStr := currentDate.Format("2006-01-02")
-
-		// Verificar si existe un registro para esta fecha
-		var exists bool
-		var incomeCashAmount, incomeBankAmount float64
-		var expenseCashAmount, expenseBankAmount float64
-		var billCashAmount, billBankAmount float64
-		err := db.QueryRow(`
-			SELECT 1, income_cash_amount, income_bank_amount, 
-			expense_cash_amount, expense_bank_amount, 
-			bill_cash_amount, bill_bank_amount 
-			FROM daily_cash_bank_balance
-			WHERE user_id = ? AND date = ?
-		`, userID, currentDateStr).Scan(&exists, &incomeCashAmount, &incomeBankAmount, &expenseCashAmount, &expenseBankAmount, &billCashAmount, &billBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// No hay más registros para actualizar
-			break
-		}
-
-		// Obtener los valores del día anterior
-		prevDate := currentDate.AddDate(0, 0, -1)
-		prevDateStr := prevDate.Format("2006-01-02")
-
-		var prevCashAmount, prevBankAmount float64
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM daily_cash_bank_balance 
-			WHERE user_id = ? AND date = ?
-		`, userID, prevDateStr).Scan(&prevCashAmount, &prevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// Si no hay un día inmediatamente anterior, buscar el último día anterior disponible
-			err = db.QueryRow(`
-				SELECT cash_amount, bank_amount FROM daily_cash_bank_balance 
-				WHERE user_id = ? AND date < ?
-				ORDER BY date DESC LIMIT 1
-			`, userID, currentDateStr).Scan(&prevCashAmount, &prevBankAmount)
-
-			if err != nil && err != sql.ErrNoRows {
-				return err
-			}
-
-			// Si no se encuentra ningún día anterior, usar valores en cero
-			if err == sql.ErrNoRows {
-				prevCashAmount = 0
-				prevBankAmount = 0
-			}
-		}
-
-		// Calcular nuevos montos para cash y bank considerando los ingresos, gastos y facturas del día actual
-		newCashAmount := prevCashAmount + incomeCashAmount - expenseCashAmount - billCashAmount
-		newBankAmount := prevBankAmount + incomeBankAmount - expenseBankAmount - billBankAmount
-
-		// Actualizar todos los campos
-		_, err = db.Exec(`
-			UPDATE daily_cash_bank_balance
-			SET previous_cash_amount = ?,
-				cash_amount = ?,
-				previous_bank_amount = ?,
-				bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				total_balance = (balance_cash_amount + balance_bank_amount),
-				total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND date = ?
-		`, prevCashAmount, newCashAmount, prevBankAmount, newBankAmount, newCashAmount, newBankAmount, userID, currentDateStr)
-
-		if err != nil {
-			return err
-		}
-
-		// Pasar al siguiente día
-		currentDate = currentDate.AddDate(0, 0, 1)
+func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+	response := ApiResponse{
+		Success: false,
+		Message: message,
 	}
-
-	return nil
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
 }
 
-func updateWeeklyBalance(userID string, incomeAmount, expenseAmount, billsAmount float64, cashAmount, bankAmount float64, date time.Time) error {
-	// Calcular el número de semana y su rango de fechas
-	year, week := date.ISOWeek()
-	yearWeek := fmt.Sprintf("%d-%02d", year, week)
-
-	// Calcular el inicio y fin de la semana
-	dayOfWeek := int(date.Weekday())
-	if dayOfWeek == 0 {
-		dayOfWeek = 7 // Convertir domingo (0) a 7
-	}
-	startOfWeek := date.AddDate(0, 0, -(dayOfWeek - 1))
-	endOfWeek := startOfWeek.AddDate(0, 0, 6)
-	startDateStr := startOfWeek.Format("2006-01-02")
-	endDateStr := endOfWeek.Format("2006-01-02")
-
-	// Calcular la semana anterior
-	prevWeek := startOfWeek.AddDate(0, 0, -7)
-	prevYear, prevWeekNum := prevWeek.ISOWeek()
-	prevYearWeek := fmt.Sprintf("%d-%02d", prevYear, prevWeekNum)
-
-	var previousCashAmount, previousBankAmount float64
-
-	// Buscar el balance de la semana anterior
-	err := db.QueryRow(`
-		SELECT cash_amount, bank_amount FROM weekly_cash_bank_balance 
-		WHERE user_id = ? AND year_week = ?
-	`, userID, prevYearWeek).Scan(&previousCashAmount, &previousBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	// Si no existe registro de la semana anterior, buscar la última semana anterior disponible
-	if err == sql.ErrNoRows {
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM weekly_cash_bank_balance 
-			WHERE user_id = ? AND year_week < ?
-			ORDER BY year_week DESC LIMIT 1
-		`, userID, yearWeek).Scan(&previousCashAmount, &previousBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		// Si no se encuentra ninguna semana anterior, ambos valores son 0
-		if err == sql.ErrNoRows {
-			previousCashAmount = 0
-			previousBankAmount = 0
-		}
-	}
-
-	// Verificar si ya existe un registro para esta semana
-	var exists bool
-	var existingIncomeCash, existingIncomeBank float64
-	var existingExpenseCash, existingExpenseBank float64
-	var existingBillCash, existingBillBank float64
-	var existingCashAmount, existingBankAmount float64
-	err = db.QueryRow(`
-		SELECT 1, income_cash_amount, income_bank_amount, 
-			expense_cash_amount, expense_bank_amount, 
-			bill_cash_amount, bill_bank_amount,
-			cash_amount, bank_amount
-		FROM weekly_cash_bank_balance
-		WHERE user_id = ? AND year_week = ?
-	`, userID, yearWeek).Scan(&exists, &existingIncomeCash, &existingIncomeBank, &existingExpenseCash, &existingExpenseBank, &existingBillCash, &existingBillBank, &existingCashAmount, &existingBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, crear uno nuevo
-		// Calcular los nuevos montos en efectivo y banco
-		newCashAmount := previousCashAmount + cashAmount
-		newBankAmount := previousBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO weekly_cash_bank_balance (
-				user_id, year_week, start_date, end_date,
-				income_cash_amount, income_bank_amount, 
-				expense_cash_amount, expense_bank_amount, 
-				bill_cash_amount, bill_bank_amount, 
-				cash_amount, previous_cash_amount,
-				bank_amount, previous_bank_amount,
-				balance_cash_amount, balance_bank_amount
-			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, yearWeek, startDateStr, endDateStr,
-			cashAmount, bankAmount,
-			0, 0,
-			0, 0,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount)
-	} else {
-		// Actualizar registro existente
-		// IMPORTANTE: Mantener los valores actuales y sumar el nuevo ingreso
-		newCashAmount := existingCashAmount + cashAmount
-		newBankAmount := existingBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			UPDATE weekly_cash_bank_balance SET
-				income_cash_amount = income_cash_amount + ?,
-				income_bank_amount = income_bank_amount + ?,
-				cash_amount = ?,
-				previous_cash_amount = ?,
-				bank_amount = ?,
-				previous_bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				total_balance = (balance_cash_amount + balance_bank_amount),
-				total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_week = ?
-		`, cashAmount, bankAmount,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount,
-			userID, yearWeek)
-	}
-
+// recordIncomeLedger records the income in the balance ledger, replacing its previous
+// entry; the ledger updates the six period balance tables
+func recordIncomeLedger(q common.DBTX, income Income) error {
+	date, err := time.Parse("2006-01-02", income.Date)
 	if err != nil {
-		return err
-	}
-
-	// Calcular la siguiente semana
-	nextWeek := startOfWeek.AddDate(0, 0, 7)
-
-	// Actualizar semanas posteriores en cascada
-	return updateSubsequentWeeklyBalances(userID, nextWeek)
-}
-
-// Nueva función para actualizar semanas posteriores en cascada
-func updateSubsequentWeeklyBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a un año para evitar bucles infinitos
-	endDate := startDate.AddDate(1, 0, 0)
-	currentDate := startDate
-
-	for currentDate.Before(endDate) {
-		// Calcular el año y semana actual
-		year, week := currentDate.ISOWeek()
-		currentYearWeek := fmt.Sprintf("%d-%02d", year, week)
-
-		// Verificar si existe un registro para esta semana
-		var exists bool
-		var incomeCashAmount, incomeBankAmount float64
-		var expenseCashAmount, expenseBankAmount float64
-		var billCashAmount, billBankAmount float64
-		err := db.QueryRow(`
-			SELECT 1, income_cash_amount, income_bank_amount, 
-			expense_cash_amount, expense_bank_amount, 
-			bill_cash_amount, bill_bank_amount 
-			FROM weekly_cash_bank_balance
-			WHERE user_id = ? AND year_week = ?
-		`, userID, currentYearWeek).Scan(&exists, &incomeCashAmount, &incomeBankAmount, &expenseCashAmount, &expenseBankAmount, &billCashAmount, &billBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// No hay más registros para actualizar
-			break
-		}
-
-		// Obtener los valores de la semana anterior
-		prevWeek := currentDate.AddDate(0, 0, -7)
-		prevYear, prevWeekNum := prevWeek.ISOWeek()
-		prevYearWeek := fmt.Sprintf("%d-%02d", prevYear, prevWeekNum)
-
-		var prevCashAmount, prevBankAmount float64
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM weekly_cash_bank_balance 
-			WHERE user_id = ? AND year_week = ?
-		`, userID, prevYearWeek).Scan(&prevCashAmount, &prevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// Si no hay una semana inmediatamente anterior, buscar la última semana anterior disponible
-			err = db.QueryRow(`
-				SELECT cash_amount, bank_amount FROM weekly_cash_bank_balance 
-				WHERE user_id = ? AND year_week < ?
-				ORDER BY year_week DESC LIMIT 1
-			`, userID, currentYearWeek).Scan(&prevCashAmount, &prevBankAmount)
-
-			if err != nil && err != sql.ErrNoRows {
-				return err
-			}
-
-			// Si no se encuentra ninguna semana anterior, usar valores en cero
-			if err == sql.ErrNoRows {
-				prevCashAmount = 0
-				prevBankAmount = 0
-			}
-		}
-
-		// Calcular nuevos montos para cash y bank considerando los ingresos, gastos y facturas de la semana actual
-		newCashAmount := prevCashAmount + incomeCashAmount - expenseCashAmount - billCashAmount
-		newBankAmount := prevBankAmount + incomeBankAmount - expenseBankAmount - billBankAmount
-
-		// Actualizar todos los campos
-		_, err = db.Exec(`
-			UPDATE weekly_cash_bank_balance
-			SET previous_cash_amount = ?,
-				cash_amount = ?,
-				previous_bank_amount = ?,
-				bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				total_balance = (balance_cash_amount + balance_bank_amount),
-				total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_week = ?
-		`, prevCashAmount, newCashAmount, prevBankAmount, newBankAmount, newCashAmount, newBankAmount, userID, currentYearWeek)
-
-		if err != nil {
-			return err
-		}
-
-		// Pasar a la siguiente semana
-		currentDate = currentDate.AddDate(0, 0, 7)
-	}
-
-	return nil
-}
-
-func updateMonthlyBalance(userID string, incomeAmount, expenseAmount, billsAmount float64, cashAmount, bankAmount float64, date time.Time) error {
-	// Calcular el año y mes
-	yearMonth := date.Format("2006-01")
-
-	// Calcular el mes anterior
-	prevMonth := date.AddDate(0, -1, 0)
-	prevYearMonth := prevMonth.Format("2006-01")
-
-	var previousCashAmount, previousBankAmount float64
-
-	// Buscar los valores del mes anterior
-	err := db.QueryRow(`
-		SELECT cash_amount, bank_amount FROM monthly_cash_bank_balance 
-		WHERE user_id = ? AND year_month = ?
-	`, userID, prevYearMonth).Scan(&previousCashAmount, &previousBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
+		return fmt.Errorf("error parsing date: %v", err)
 	}
-
-	// Si no existe registro del mes anterior, buscar el último mes anterior disponible
-	if err == sql.ErrNoRows {
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM monthly_cash_bank_balance 
-			WHERE user_id = ? AND year_month < ?
-			ORDER BY year_month DESC LIMIT 1
-		`, userID, yearMonth).Scan(&previousCashAmount, &previousBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		// Si no se encuentra ningún mes anterior, ambos valores son 0
-		if err == sql.ErrNoRows {
-			previousCashAmount = 0
-			previousBankAmount = 0
-		}
-	}
-
-	// Verificar si ya existe un registro para este mes
-	var exists bool
-	var existingIncomeCash, existingIncomeBank float64
-	var existingExpenseCash, existingExpenseBank float64
-	var existingBillCash, existingBillBank float64
-	var existingCashAmount, existingBankAmount float64
-	err = db.QueryRow(`
-		SELECT 1, income_cash_amount, income_bank_amount, 
-		expense_cash_amount, expense_bank_amount, 
-		bill_cash_amount, bill_bank_amount,
-		cash_amount, bank_amount
-		FROM monthly_cash_bank_balance
-		WHERE user_id = ? AND year_month = ?
-	`, userID, yearMonth).Scan(&exists, &existingIncomeCash, &existingIncomeBank, &existingExpenseCash, &existingExpenseBank, &existingBillCash, &existingBillBank, &existingCashAmount, &existingBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, crear uno nuevo
-		// Calcular los nuevos montos en efectivo y banco
-		newCashAmount := previousCashAmount + cashAmount
-		newBankAmount := previousBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO monthly_cash_bank_balance (
-				user_id, year_month,
-				income_cash_amount, income_bank_amount, 
-				expense_cash_amount, expense_bank_amount, 
-				bill_cash_amount, bill_bank_amount, 
-				cash_amount, previous_cash_amount,
-				bank_amount, previous_bank_amount,
-				balance_cash_amount, balance_bank_amount
-			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, yearMonth,
-			cashAmount, bankAmount,
-			0, 0,
-			0, 0,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount)
-	} else {
-		// Actualizar registro existente
-		// IMPORTANTE: Mantener los valores actuales y sumar el nuevo ingreso
-		newCashAmount := existingCashAmount + cashAmount
-		newBankAmount := existingBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			UPDATE monthly_cash_bank_balance SET
-				income_cash_amount = income_cash_amount + ?,
-				income_bank_amount = income_bank_amount + ?,
-				cash_amount = ?,
-				previous_cash_amount = ?,
-				bank_amount = ?,
-				previous_bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_month = ?
-		`, cashAmount, bankAmount,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount,
-			userID, yearMonth)
-	}
-
-	if err != nil {
-		return err
-	}
-
-	// Actualizar meses posteriores en cascada
-	return updateSubsequentMonthlyBalances(userID, date.AddDate(0, 1, 0))
-}
-
-// Nueva función para actualizar meses posteriores en cascada
-func updateSubsequentMonthlyBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a 5 años para evitar bucles infinitos
-	currentDate := startDate
-
-	// Mantener un registro de los meses procesados
-	processedMonths := make(map[string]struct{})
-
-	// Encontrar el mes anterior al mes de inicio para saber el valor de partida
-	var lastPrevCashAmount, lastPrevBankAmount float64
-	prevToStartDate := startDate.AddDate(0, -1, 0)
-	prevToStartYearMonth := prevToStartDate.Format("2006-01")
-
-	err := db.QueryRow(`
-		SELECT cash_amount, bank_amount FROM monthly_cash_bank_balance 
-		WHERE user_id = ? AND year_month = ?
-	`, userID, prevToStartYearMonth).Scan(&lastPrevCashAmount, &lastPrevBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// Si no hay un mes inmediatamente anterior, buscar el último mes anterior disponible
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM monthly_cash_bank_balance 
-			WHERE user_id = ? AND year_month < ?
-			ORDER BY year_month DESC LIMIT 1
-		`, userID, startDate.Format("2006-01")).Scan(&lastPrevCashAmount, &lastPrevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		// Si no se encuentra ningún mes anterior, usar valores en cero
-		if err == sql.ErrNoRows {
-			lastPrevCashAmount = 0
-			lastPrevBankAmount = 0
-		}
-	}
-
-	// Obtener todos los meses existentes desde la fecha de inicio hasta 5 años después
-	rows, err := db.Query(`
-		SELECT year_month FROM monthly_cash_bank_balance
-		WHERE user_id = ? AND year_month >= ?
-		ORDER BY year_month ASC
-	`, userID, startDate.Format("2006-01"))
-
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	var existingMonths []string
-	for rows.Next() {
-		var yearMonth string
-		if err := rows.Scan(&yearMonth); err != nil {
-			return err
-		}
-		existingMonths = append(existingMonths, yearMonth)
-	}
-
-	// Si no hay meses existentes, no hay nada que procesar
-	if len(existingMonths) == 0 {
-		return nil
-	}
-
-	// Determinar el último mes que necesitamos procesar
-	lastMonthStr := existingMonths[len(existingMonths)-1]
-	lastMonthParts := strings.Split(lastMonthStr, "-")
-	if len(lastMonthParts) != 2 {
-		return fmt.Errorf("invalid month format: %s", lastMonthStr)
-	}
-	lastYear, _ := strconv.Atoi(lastMonthParts[0])
-	lastMonth, _ := strconv.Atoi(lastMonthParts[1])
-	lastDate := time.Date(lastYear, time.Month(lastMonth), 1, 0, 0, 0, 0, time.UTC)
-
-	// Crear un mapa para acceso rápido a los meses existentes
-	existingMonthsMap := make(map[string]bool)
-	for _, m := range existingMonths {
-		existingMonthsMap[m] = true
-	}
-
-	// Variables para mantener los valores acumulados
-	currentCashAmount := lastPrevCashAmount
-	currentBankAmount := lastPrevBankAmount
-
-	// Iterar mes por mes desde la fecha de inicio hasta el último mes existente
-	for currentDate.Before(lastDate.AddDate(0, 1, 0)) {
-		currentYearMonth := currentDate.Format("2006-01")
-
-		if existingMonthsMap[currentYearMonth] {
-			// Si el mes existe, actualizarlo con los valores correctos
-			var incomeCashAmount, incomeBankAmount float64
-			var expenseCashAmount, expenseBankAmount float64
-			var billCashAmount, billBankAmount float64
-
-			err := db.QueryRow(`
-				SELECT income_cash_amount, income_bank_amount, 
-				expense_cash_amount, expense_bank_amount, 
-				bill_cash_amount, bill_bank_amount 
-				FROM monthly_cash_bank_balance
-				WHERE user_id = ? AND year_month = ?
-			`, userID, currentYearMonth).Scan(&incomeCashAmount, &incomeBankAmount, &expenseCashAmount, &expenseBankAmount, &billCashAmount, &billBankAmount)
-
-			if err != nil {
-				return err
-			}
-
-			// Calcular nuevos montos considerando los ingresos, gastos y facturas del mes actual
-			prevCashAmount := currentCashAmount
-			prevBankAmount := currentBankAmount
-
-			currentCashAmount = prevCashAmount + incomeCashAmount - expenseCashAmount - billCashAmount
-			currentBankAmount = prevBankAmount + incomeBankAmount - expenseBankAmount - billBankAmount
-
-			// Actualizar el registro
-			_, err = db.Exec(`
-				UPDATE monthly_cash_bank_balance
-				SET previous_cash_amount = ?,
-					cash_amount = ?,
-					previous_bank_amount = ?,
-					bank_amount = ?,
-					balance_cash_amount = ?,
-					balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-					updated_at = CURRENT_TIMESTAMP
-				WHERE user_id = ? AND year_month = ?
-			`, prevCashAmount, currentCashAmount, prevBankAmount, currentBankAmount, currentCashAmount, currentBankAmount, userID, currentYearMonth)
-
-			if err != nil {
-				return err
-			}
-		} else {
-			// Si el mes no existe, crear un registro para él con valores en 0 para ingresos/gastos/facturas
-			// pero con los valores correctos de previous_amount basados en el mes anterior
-			prevCashAmount := currentCashAmount
-			prevBankAmount := currentBankAmount
-
-			// Los montos acumulados no cambian ya que no hay transacciones
-			// Sin embargo, creamos el registro para mantener la continuidad
-			_, err = db.Exec(`
-				INSERT INTO monthly_cash_bank_balance (
-					user_id, year_month,
-					income_cash_amount, income_bank_amount, 
-					expense_cash_amount, expense_bank_amount, 
-					bill_cash_amount, bill_bank_amount, 
-					cash_amount, previous_cash_amount,
-					bank_amount, previous_bank_amount,
-					balance_cash_amount, balance_bank_amount
-				) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-			`, userID, currentYearMonth,
-				0, 0,
-				0, 0,
-				0, 0,
-				prevCashAmount, prevCashAmount,
-				prevBankAmount, prevBankAmount,
-				prevCashAmount, prevBankAmount)
-
-			if err != nil {
-				// Si el error es por duplicado, ignorarlo
-				if !strings.Contains(err.Error(), "UNIQUE constraint failed") {
-					return err
-				}
-			}
-		}
-
-		// Marcar este mes como procesado
-		processedMonths[currentYearMonth] = struct{}{}
-
-		// Avanzar al mes siguiente
-		currentDate = currentDate.AddDate(0, 1, 0)
-	}
-
-	return nil
-}
-
-func updateQuarterlyBalance(userID string, incomeAmount, expenseAmount, billsAmount float64, cashAmount, bankAmount float64, date time.Time) error {
-	// Calcular el trimestre
-	quarter := (int(date.Month()) - 1) / 3
-	year := date.Year()
-	yearQuarter := fmt.Sprintf("%d-Q%d", year, quarter+1)
-
-	// Calcular el trimestre anterior
-	var prevYear, prevQuarter int
-	if quarter == 0 {
-		prevYear = year - 1
-		prevQuarter = 3 // Q4 del año anterior
-	} else {
-		prevYear = year
-		prevQuarter = quarter - 1
-	}
-	prevYearQuarter := fmt.Sprintf("%d-Q%d", prevYear, prevQuarter+1)
-
-	var previousCashAmount, previousBankAmount float64
-
-	// Buscar los valores del trimestre anterior
-	err := db.QueryRow(`
-		SELECT cash_amount, bank_amount FROM quarterly_cash_bank_balance 
-		WHERE user_id = ? AND year_quarter = ?
-	`, userID, prevYearQuarter).Scan(&previousCashAmount, &previousBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	// Si no existe registro del trimestre anterior, buscar el último trimestre anterior disponible
-	if err == sql.ErrNoRows {
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM quarterly_cash_bank_balance 
-			WHERE user_id = ? AND year_quarter < ?
-			ORDER BY year_quarter DESC LIMIT 1
-		`, userID, yearQuarter).Scan(&previousCashAmount, &previousBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		// Si no se encuentra ningún trimestre anterior, ambos valores son 0
-		if err == sql.ErrNoRows {
-			previousCashAmount = 0
-			previousBankAmount = 0
-		}
-	}
-
-	// Verificar si ya existe un registro para este trimestre
-	var exists bool
-	var existingIncomeCash, existingIncomeBank float64
-	var existingExpenseCash, existingExpenseBank float64
-	var existingBillCash, existingBillBank float64
-	var existingCashAmount, existingBankAmount float64
-	err = db.QueryRow(`
-		SELECT 1, income_cash_amount, income_bank_amount, 
-		expense_cash_amount, expense_bank_amount, 
-		bill_cash_amount, bill_bank_amount,
-		cash_amount, bank_amount
-		FROM quarterly_cash_bank_balance
-		WHERE user_id = ? AND year_quarter = ?
-	`, userID, yearQuarter).Scan(&exists, &existingIncomeCash, &existingIncomeBank, &existingExpenseCash, &existingExpenseBank, &existingBillCash, &existingBillBank, &existingCashAmount, &existingBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, crear uno nuevo
-		// Calcular los nuevos montos en efectivo y banco
-		newCashAmount := previousCashAmount + cashAmount
-		newBankAmount := previousBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO quarterly_cash_bank_balance (
-				user_id, year_quarter,
-				income_cash_amount, income_bank_amount, 
-				expense_cash_amount, expense_bank_amount, 
-				bill_cash_amount, bill_bank_amount, 
-				cash_amount, previous_cash_amount,
-				bank_amount, previous_bank_amount,
-				balance_cash_amount, balance_bank_amount
-			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, yearQuarter,
-			cashAmount, bankAmount,
-			0, 0,
-			0, 0,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount)
-	} else {
-		// Actualizar registro existente
-		// IMPORTANTE: Mantener los valores actuales y sumar el nuevo ingreso
-		newCashAmount := existingCashAmount + cashAmount
-		newBankAmount := existingBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			UPDATE quarterly_cash_bank_balance SET
-				income_cash_amount = income_cash_amount + ?,
-				income_bank_amount = income_bank_amount + ?,
-				cash_amount = ?,
-				previous_cash_amount = ?,
-				bank_amount = ?,
-				previous_bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_quarter = ?
-		`, cashAmount, bankAmount,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount,
-			userID, yearQuarter)
-	}
-
-	if err != nil {
-		return err
-	}
-
-	// Calcular el trimestre siguiente
-	var nextYear, nextQuarter int
-	if quarter == 3 {
-		nextYear = year + 1
-		nextQuarter = 0
-	} else {
-		nextYear = year
-		nextQuarter = quarter + 1
-	}
-	nextDate := time.Date(nextYear, time.Month(nextQuarter*3+1), 1, 0, 0, 0, 0, time.UTC)
-
-	// Actualizar trimestres posteriores en cascada
-	return updateSubsequentQuarterlyBalances(userID, nextDate)
-}
-
-// Nueva función para actualizar años posteriores en cascada
-func updateSubsequentAnnualBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a 20 años para evitar bucles infinitos
-	endDate := startDate.AddDate(20, 0, 0)
-	currentDate := startDate
-
-	for currentDate.Before(endDate) {
-		currentYear := strconv.Itoa(currentDate.Year())
-
-		// Verificar si existe un registro para este año
-		var exists bool
-		var incomeCashAmount, incomeBankAmount float64
-		var expenseCashAmount, expenseBankAmount float64
-		var billCashAmount, billBankAmount float64
-		err := db.QueryRow(`
-			SELECT 1, income_cash_amount, income_bank_amount, 
-			expense_cash_amount, expense_bank_amount, 
-			bill_cash_amount, bill_bank_amount 
-			FROM annual_cash_bank_balance
-			WHERE user_id = ? AND year = ?
-		`, userID, currentYear).Scan(&exists, &incomeCashAmount, &incomeBankAmount, &expenseCashAmount, &expenseBankAmount, &billCashAmount, &billBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// No hay más registros para actualizar
-			break
-		}
-
-		// Obtener el balance del año anterior
-		prevYear := strconv.Itoa(currentDate.Year() - 1)
-
-		var prevCashAmount, prevBankAmount float64
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM annual_cash_bank_balance 
-			WHERE user_id = ? AND year = ?
-		`, userID, prevYear).Scan(&prevCashAmount, &prevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// Si no hay un año inmediatamente anterior, buscar el último año anterior disponible
-			err = db.QueryRow(`
-				SELECT cash_amount, bank_amount FROM annual_cash_bank_balance 
-				WHERE user_id = ? AND year < ?
-				ORDER BY year DESC LIMIT 1
-			`, userID, currentYear).Scan(&prevCashAmount, &prevBankAmount)
-
-			if err != nil && err != sql.ErrNoRows {
-				return err
-			}
-
-			// Si no se encuentra ningún año anterior, usar valores en cero
-			if err == sql.ErrNoRows {
-				prevCashAmount = 0
-				prevBankAmount = 0
-			}
-		}
-
-		// Calcular nuevos montos para cash y bank considerando los ingresos, gastos y facturas del año actual
-		newCashAmount := prevCashAmount + incomeCashAmount - expenseCashAmount - billCashAmount
-		newBankAmount := prevBankAmount + incomeBankAmount - expenseBankAmount - billBankAmount
-
-		// Actualizar todos los campos
-		_, err = db.Exec(`
-			UPDATE annual_cash_bank_balance
-			SET previous_cash_amount = ?,
-				cash_amount = ?,
-				previous_bank_amount = ?,
-				bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year = ?
-		`, prevCashAmount, newCashAmount, prevBankAmount, newBankAmount, newCashAmount, newBankAmount, userID, currentYear)
-
-		if err != nil {
-			return err
-		}
-
-		// Pasar al siguiente año
-		currentDate = currentDate.AddDate(1, 0, 0)
-	}
-
-	return nil
-}
-
-// Función para recalcular todos los balances en cascada
-func recalculateAllBalances(userID string, dateStr string) error {
-	// Parse la fecha de la transacción
-	date, err := time.Parse("2006-01-02", dateStr)
-	if err != nil {
-		return fmt.Errorf("error parsing date: %v", err)
-	}
-
-	// Recalcular balances diarios en cascada desde la fecha de la transacción
-	if err := updateSubsequentDailyBalances(userID, date); err != nil {
-		return fmt.Errorf("error updating daily balances: %v", err)
-	}
-
-	// Calcular el inicio de la semana que contiene la fecha
-	dayOfWeek := int(date.Weekday())
-	if dayOfWeek == 0 {
-		dayOfWeek = 7 // Convertir domingo (0) a 7
-	}
-	startOfWeek := date.AddDate(0, 0, -(dayOfWeek - 1))
-
-	// Recalcular balances semanales en cascada desde la semana que contiene la transacción
-	if err := updateSubsequentWeeklyBalances(userID, startOfWeek); err != nil {
-		return fmt.Errorf("error updating weekly balances: %v", err)
-	}
-
-	// Calcular el inicio del mes que contiene la fecha
-	startOfMonth := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
-
-	// Recalcular balances mensuales en cascada desde el mes que contiene la transacción
-	if err := updateSubsequentMonthlyBalances(userID, startOfMonth); err != nil {
-		return fmt.Errorf("error updating monthly balances: %v", err)
-	}
-
-	// Calcular el inicio del trimestre que contiene la fecha
-	quarter := (int(date.Month()) - 1) / 3
-	startOfQuarter := time.Date(date.Year(), time.Month(quarter*3+1), 1, 0, 0, 0, 0, time.UTC)
-
-	// Recalcular balances trimestrales en cascada desde el trimestre que contiene la transacción
-	if err := updateSubsequentQuarterlyBalances(userID, startOfQuarter); err != nil {
-		return fmt.Errorf("error updating quarterly balances: %v", err)
-	}
-
-	// Calcular el inicio del semestre que contiene la fecha
-	halfYear := (int(date.Month()) - 1) / 6
-	startOfHalfYear := time.Date(date.Year(), time.Month(halfYear*6+1), 1, 0, 0, 0, 0, time.UTC)
-
-	// Recalcular balances semestrales en cascada desde el semestre que contiene la transacción
-	if err := updateSubsequentSemiannualBalances(userID, startOfHalfYear); err != nil {
-		return fmt.Errorf("error updating semiannual balances: %v", err)
-	}
-
-	// Calcular el inicio del año que contiene la fecha
-	startOfYear := time.Date(date.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
-
-	// Recalcular balances anuales en cascada desde el año que contiene la transacción
-	if err := updateSubsequentAnnualBalances(userID, startOfYear); err != nil {
-		return fmt.Errorf("error updating annual balances: %v", err)
-	}
-
-	return nil
-}
-
-func sendSuccessResponse(w http.ResponseWriter, message string, data interface{}) {
-	response := ApiResponse{
-		Success: true,
-		Message: message,
-		Data:    data,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
-}
-
-func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
-	response := ApiResponse{
-		Success: false,
-		Message: message,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(response)
-}
-
-// Nueva función para actualizar trimestres posteriores en cascada
-func updateSubsequentQuarterlyBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a 5 años para evitar bucles infinitos
-	endDate := startDate.AddDate(5, 0, 0)
-	currentDate := startDate
-
-	for currentDate.Before(endDate) {
-		// Calcular el trimestre actual
-		quarter := (int(currentDate.Month()) - 1) / 3
-		year := currentDate.Year()
-		currentYearQuarter := fmt.Sprintf("%d-Q%d", year, quarter+1)
-
-		// Verificar si existe un registro para este trimestre
-		var exists bool
-		var incomeCashAmount, incomeBankAmount float64
-		var expenseCashAmount, expenseBankAmount float64
-		var billCashAmount, billBankAmount float64
-		err := db.QueryRow(`
-			SELECT 1, income_cash_amount, income_bank_amount, 
-			expense_cash_amount, expense_bank_amount, 
-			bill_cash_amount, bill_bank_amount 
-			FROM quarterly_cash_bank_balance
-			WHERE user_id = ? AND year_quarter = ?
-		`, userID, currentYearQuarter).Scan(&exists, &incomeCashAmount, &incomeBankAmount, &expenseCashAmount, &expenseBankAmount, &billCashAmount, &billBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// No hay más registros para actualizar
-			break
-		}
-
-		// Calcular el trimestre anterior
-		var prevYear, prevQuarter int
-		if quarter == 0 {
-			prevYear = year - 1
-			prevQuarter = 3 // Q4 del año anterior
-		} else {
-			prevYear = year
-			prevQuarter = quarter - 1
-		}
-		prevYearQuarter := fmt.Sprintf("%d-Q%d", prevYear, prevQuarter+1)
-
-		var prevCashAmount, prevBankAmount float64
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM quarterly_cash_bank_balance 
-			WHERE user_id = ? AND year_quarter = ?
-		`, userID, prevYearQuarter).Scan(&prevCashAmount, &prevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// Si no hay un trimestre inmediatamente anterior, buscar el último trimestre anterior disponible
-			err = db.QueryRow(`
-				SELECT cash_amount, bank_amount FROM quarterly_cash_bank_balance 
-				WHERE user_id = ? AND year_quarter < ?
-				ORDER BY year_quarter DESC LIMIT 1
-			`, userID, currentYearQuarter).Scan(&prevCashAmount, &prevBankAmount)
-
-			if err != nil && err != sql.ErrNoRows {
-				return err
-			}
-
-			// Si no se encuentra ningún trimestre anterior, usar valores en cero
-			if err == sql.ErrNoRows {
-				prevCashAmount = 0
-				prevBankAmount = 0
-			}
-		}
-
-		// Calcular nuevos montos para cash y bank considerando los ingresos, gastos y facturas del trimestre actual
-		newCashAmount := prevCashAmount + incomeCashAmount - expenseCashAmount - billCashAmount
-		newBankAmount := prevBankAmount + incomeBankAmount - expenseBankAmount - billBankAmount
-
-		// Actualizar todos los campos
-		_, err = db.Exec(`
-			UPDATE quarterly_cash_bank_balance
-			SET previous_cash_amount = ?,
-				cash_amount = ?,
-				previous_bank_amount = ?,
-				bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_quarter = ?
-		`, prevCashAmount, newCashAmount, prevBankAmount, newBankAmount, newCashAmount, newBankAmount, userID, currentYearQuarter)
-
-		if err != nil {
-			return err
-		}
-
-		// Avanzar al siguiente trimestre
-		if quarter == 3 {
-			// Si estamos en Q4, pasar al Q1 del siguiente año
-			currentDate = time.Date(year+1, 1, 1, 0, 0, 0, 0, time.UTC)
-		} else {
-			// Avanzar al siguiente trimestre del mismo año
-			currentDate = time.Date(year, time.Month((quarter+1)*3+1), 1, 0, 0, 0, 0, time.UTC)
-		}
-	}
-
-	return nil
-}
-
-func updateSemiannualBalance(userID string, incomeAmount, expenseAmount, billsAmount float64, cashAmount, bankAmount float64, date time.Time) error {
-	// Calcular el semestre
-	halfYear := (int(date.Month()) - 1) / 6
-	year := date.Year()
-	yearHalf := fmt.Sprintf("%d-H%d", year, halfYear+1)
-
-	// Calcular el semestre anterior
-	var prevYear, prevHalf int
-	if halfYear == 0 {
-		prevYear = year - 1
-		prevHalf = 1 // H2 del año anterior
-	} else {
-		prevYear = year
-		prevHalf = 0 // H1 del mismo año
-	}
-	prevYearHalf := fmt.Sprintf("%d-H%d", prevYear, prevHalf+1)
-
-	var previousCashAmount, previousBankAmount float64
-
-	// Buscar los valores del semestre anterior
-	err := db.QueryRow(`
-		SELECT cash_amount, bank_amount FROM semiannual_cash_bank_balance 
-		WHERE user_id = ? AND year_half = ?
-	`, userID, prevYearHalf).Scan(&previousCashAmount, &previousBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	// Si no existe registro del semestre anterior, buscar el último semestre anterior disponible
-	if err == sql.ErrNoRows {
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM semiannual_cash_bank_balance 
-			WHERE user_id = ? AND year_half < ?
-			ORDER BY year_half DESC LIMIT 1
-		`, userID, yearHalf).Scan(&previousCashAmount, &previousBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		// Si no se encuentra ningún semestre anterior, ambos valores son 0
-		if err == sql.ErrNoRows {
-			previousCashAmount = 0
-			previousBankAmount = 0
-		}
-	}
-
-	// Verificar si ya existe un registro para este semestre
-	var exists bool
-	var existingIncomeCash, existingIncomeBank float64
-	var existingExpenseCash, existingExpenseBank float64
-	var existingBillCash, existingBillBank float64
-	var existingCashAmount, existingBankAmount float64
-	err = db.QueryRow(`
-		SELECT 1, income_cash_amount, income_bank_amount, 
-		expense_cash_amount, expense_bank_amount, 
-		bill_cash_amount, bill_bank_amount,
-		cash_amount, bank_amount
-		FROM semiannual_cash_bank_balance
-		WHERE user_id = ? AND year_half = ?
-	`, userID, yearHalf).Scan(&exists, &existingIncomeCash, &existingIncomeBank, &existingExpenseCash, &existingExpenseBank, &existingBillCash, &existingBillBank, &existingCashAmount, &existingBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, crear uno nuevo
-		// Calcular los nuevos montos en efectivo y banco
-		newCashAmount := previousCashAmount + cashAmount
-		newBankAmount := previousBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO semiannual_cash_bank_balance (
-				user_id, year_half,
-				income_cash_amount, income_bank_amount, 
-				expense_cash_amount, expense_bank_amount, 
-				bill_cash_amount, bill_bank_amount, 
-				cash_amount, previous_cash_amount,
-				bank_amount, previous_bank_amount,
-				balance_cash_amount, balance_bank_amount
-			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, yearHalf,
-			cashAmount, bankAmount,
-			0, 0,
-			0, 0,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount)
-	} else {
-		// Actualizar registro existente
-		// IMPORTANTE: Mantener los valores actuales y sumar el nuevo ingreso
-		newCashAmount := existingCashAmount + cashAmount
-		newBankAmount := existingBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			UPDATE semiannual_cash_bank_balance SET
-				income_cash_amount = income_cash_amount + ?,
-				income_bank_amount = income_bank_amount + ?,
-				cash_amount = ?,
-				previous_cash_amount = ?,
-				bank_amount = ?,
-				previous_bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_half = ?
-		`, cashAmount, bankAmount,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount,
-			userID, yearHalf)
-	}
-
-	if err != nil {
-		return err
-	}
-
-	// Calcular el semestre siguiente
-	var nextYear, nextHalf int
-	if halfYear == 1 {
-		nextYear = year + 1
-		nextHalf = 0
-	} else {
-		nextYear = year
-		nextHalf = 1
-	}
-	nextDate := time.Date(nextYear, time.Month(nextHalf*6+1), 1, 0, 0, 0, 0, time.UTC)
-
-	// Actualizar semestres posteriores en cascada
-	return updateSubsequentSemiannualBalances(userID, nextDate)
-}
-
-// Nueva función para actualizar semestres posteriores en cascada
-func updateSubsequentSemiannualBalances(userID string, startDate time.Time) error {
-	// Limitar el proceso a 5 años para evitar bucles infinitos
-	endDate := startDate.AddDate(5, 0, 0)
-	currentDate := startDate
-
-	for currentDate.Before(endDate) {
-		// Determinar el semestre actual
-		half := (int(currentDate.Month())-1)/6 + 1
-		currentYearHalf := fmt.Sprintf("%d-H%d", currentDate.Year(), half)
-
-		// Verificar si existe un registro para este semestre
-		var exists bool
-		var incomeCashAmount, incomeBankAmount float64
-		var expenseCashAmount, expenseBankAmount float64
-		var billCashAmount, billBankAmount float64
-		err := db.QueryRow(`
-			SELECT 1, income_cash_amount, income_bank_amount, 
-			expense_cash_amount, expense_bank_amount, 
-			bill_cash_amount, bill_bank_amount 
-			FROM semiannual_cash_bank_balance
-			WHERE user_id = ? AND year_half = ?
-		`, userID, currentYearHalf).Scan(&exists, &incomeCashAmount, &incomeBankAmount, &expenseCashAmount, &expenseBankAmount, &billCashAmount, &billBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// No hay más registros para actualizar
-			break
-		}
-
-		// Obtener el balance del semestre anterior
-		prevHalfDate := currentDate.AddDate(0, -6, 0)
-		prevHalf := (int(prevHalfDate.Month())-1)/6 + 1
-		prevYearHalf := fmt.Sprintf("%d-H%d", prevHalfDate.Year(), prevHalf)
-
-		var prevCashAmount, prevBankAmount float64
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM semiannual_cash_bank_balance 
-			WHERE user_id = ? AND year_half = ?
-		`, userID, prevYearHalf).Scan(&prevCashAmount, &prevBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		if err == sql.ErrNoRows {
-			// Si no hay un semestre inmediatamente anterior, buscar el último semestre anterior disponible
-			err = db.QueryRow(`
-				SELECT cash_amount, bank_amount FROM semiannual_cash_bank_balance 
-				WHERE user_id = ? AND year_half < ?
-				ORDER BY year_half DESC LIMIT 1
-			`, userID, currentYearHalf).Scan(&prevCashAmount, &prevBankAmount)
-
-			if err != nil && err != sql.ErrNoRows {
-				return err
-			}
-
-			// Si no se encuentra ningún semestre anterior, usar valores en cero
-			if err == sql.ErrNoRows {
-				prevCashAmount = 0
-				prevBankAmount = 0
-			}
-		}
-
-		// Calcular nuevos montos para cash y bank considerando los ingresos, gastos y facturas del semestre actual
-		newCashAmount := prevCashAmount + incomeCashAmount - expenseCashAmount - billCashAmount
-		newBankAmount := prevBankAmount + incomeBankAmount - expenseBankAmount - billBankAmount
-
-		// Actualizar todos los campos
-		_, err = db.Exec(`
-			UPDATE semiannual_cash_bank_balance
-			SET previous_cash_amount = ?,
-				cash_amount = ?,
-				previous_bank_amount = ?,
-				bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year_half = ?
-		`, prevCashAmount, newCashAmount, prevBankAmount, newBankAmount, newCashAmount, newBankAmount, userID, currentYearHalf)
-
-		if err != nil {
-			return err
-		}
-
-		// Pasar al siguiente semestre
-		currentDate = currentDate.AddDate(0, 6, 0)
-	}
-
-	return nil
-}
-
-func updateAnnualBalance(userID string, incomeAmount, expenseAmount, billsAmount float64, cashAmount, bankAmount float64, date time.Time) error {
-	// Calcular el año
-	year := strconv.Itoa(date.Year())
-
-	// Calcular el año anterior
-	prevYear := strconv.Itoa(date.Year() - 1)
-
-	var previousCashAmount, previousBankAmount float64
-
-	// Buscar los valores del año anterior
-	err := db.QueryRow(`
-		SELECT cash_amount, bank_amount FROM annual_cash_bank_balance 
-		WHERE user_id = ? AND year = ?
-	`, userID, prevYear).Scan(&previousCashAmount, &previousBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	// Si no existe registro del año anterior, buscar el último año anterior disponible
-	if err == sql.ErrNoRows {
-		err = db.QueryRow(`
-			SELECT cash_amount, bank_amount FROM annual_cash_bank_balance 
-			WHERE user_id = ? AND year < ?
-			ORDER BY year DESC LIMIT 1
-		`, userID, year).Scan(&previousCashAmount, &previousBankAmount)
-
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-
-		// Si no se encuentra ningún año anterior, ambos valores son 0
-		if err == sql.ErrNoRows {
-			previousCashAmount = 0
-			previousBankAmount = 0
-		}
-	}
-
-	// Verificar si ya existe un registro para este año
-	var exists bool
-	var existingIncomeCash, existingIncomeBank float64
-	var existingExpenseCash, existingExpenseBank float64
-	var existingBillCash, existingBillBank float64
-	var existingCashAmount, existingBankAmount float64
-	err = db.QueryRow(`
-		SELECT 1, income_cash_amount, income_bank_amount, 
-		expense_cash_amount, expense_bank_amount, 
-		bill_cash_amount, bill_bank_amount,
-		cash_amount, bank_amount
-		FROM annual_cash_bank_balance
-		WHERE user_id = ? AND year = ?
-	`, userID, year).Scan(&exists, &existingIncomeCash, &existingIncomeBank, &existingExpenseCash, &existingExpenseBank, &existingBillCash, &existingBillBank, &existingCashAmount, &existingBankAmount)
-
-	if err != nil && err != sql.ErrNoRows {
-		return err
-	}
-
-	if err == sql.ErrNoRows {
-		// No existe registro, crear uno nuevo
-		// Calcular los nuevos montos en efectivo y banco
-		newCashAmount := previousCashAmount + cashAmount
-		newBankAmount := previousBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			INSERT INTO annual_cash_bank_balance (
-				user_id, year,
-				income_cash_amount, income_bank_amount, 
-				expense_cash_amount, expense_bank_amount, 
-				bill_cash_amount, bill_bank_amount, 
-				cash_amount, previous_cash_amount,
-				bank_amount, previous_bank_amount,
-				balance_cash_amount, balance_bank_amount
-			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, year,
-			cashAmount, bankAmount,
-			0, 0,
-			0, 0,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount)
-	} else {
-		// Actualizar registro existente
-		// IMPORTANTE: Mantener los valores actuales y sumar el nuevo ingreso
-		newCashAmount := existingCashAmount + cashAmount
-		newBankAmount := existingBankAmount + bankAmount
-
-		_, err = db.Exec(`
-			UPDATE annual_cash_bank_balance SET
-				income_cash_amount = income_cash_amount + ?,
-				income_bank_amount = income_bank_amount + ?,
-				cash_amount = ?,
-				previous_cash_amount = ?,
-				bank_amount = ?,
-				previous_bank_amount = ?,
-				balance_cash_amount = ?,
-				balance_bank_amount = ?,
-			total_balance = (balance_cash_amount + balance_bank_amount),
-			total_previous_balance = (previous_cash_amount + previous_bank_amount),
-				updated_at = CURRENT_TIMESTAMP
-			WHERE user_id = ? AND year = ?
-		`, cashAmount, bankAmount,
-			newCashAmount, previousCashAmount,
-			newBankAmount, previousBankAmount,
-			newCashAmount, newBankAmount,
-			userID, year)
-	}
-
-	if err != nil {
-		return err
-	}
-
-	// Actualizar años posteriores en cascada
-	nextYear := date.Year() + 1
-	nextYearDate := time.Date(nextYear, 1, 1, 0, 0, 0, 0, date.Location())
-	return updateSubsequentAnnualBalances(userID, nextYearDate)
+	return common.ReplaceLedgerEntries(q, income.UserID, common.LedgerSourceIncome, int64(income.ID), common.LedgerEntry{
+		Date:          date,
+		Kind:          common.LedgerIncome,
+		PaymentMethod: income.PaymentMethod,
+		Amount:        income.Amount,
+	})
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Installment is one row of an amortization schedule
+type Installment struct {
+	Number           int     `json:"number"`
+	DueDate          string  `json:"due_date"`
+	Payment          float64 `json:"payment"`
+	Interest         float64 `json:"interest"`
+	Principal        float64 `json:"principal"`
+	RemainingBalance float64 `json:"remaining_balance"`
+	Paid             bool    `json:"paid"`
+	PaidDate         string  `json:"paid_date,omitempty"`
+}
+
+func roundCents(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+// monthlyPayment returns the fixed installment of a French (annuity) amortization
+func monthlyPayment(principal, annualRate float64, termMonths int) float64 {
+	if termMonths <= 0 {
+		return 0
+	}
+	rate := annualRate / 100 / 12
+	if rate == 0 {
+		return roundCents(principal / float64(termMonths))
+	}
+	return roundCents(principal * rate / (1 - math.Pow(1+rate, -float64(termMonths))))
+}
+
+// firstDueDate returns the first installment date: one month after the loan starts,
+// on a payment day that exists in every month
+func firstDueDate(startDate time.Time) time.Time {
+	day := startDate.Day()
+	if day > 28 {
+		day = 28
+	}
+	next := time.Date(startDate.Year(), startDate.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, 0)
+	return next.AddDate(0, 0, day-1)
+}
+
+// buildSchedule generates the amortization schedule. The last installment absorbs the
+// rounding so that the remaining balance always ends at zero.
+func buildSchedule(principal, annualRate float64, termMonths int, firstDue time.Time) []Installment {
+	payment := monthlyPayment(principal, annualRate, termMonths)
+	rate := annualRate / 100 / 12
+
+	schedule := make([]Installment, 0, termMonths)
+	balance := principal
+	for i := 1; i <= termMonths && balance > 0; i++ {
+		interest := roundCents(balance * rate)
+		principalPart := roundCents(payment - interest)
+		if i == termMonths || principalPart > balance {
+			principalPart = roundCents(balance)
+		}
+		balance = roundCents(balance - principalPart)
+
+		schedule = append(schedule, Installment{
+			Number:           i,
+			DueDate:          firstDue.AddDate(0, i-1, 0).Format("2006-01-02"),
+			Payment:          roundCents(interest + principalPart),
+			Interest:         interest,
+			Principal:        principalPart,
+			RemainingBalance: balance,
+		})
+	}
+	return schedule
+}
+
+// EarlyRepaymentSimulation compares the current schedule with the one resulting from
+// an extra principal payment made right after installment AfterInstallment
+type EarlyRepaymentSimulation struct {
+	LoanID               int           `json:"loan_id"`
+	Amount               float64       `json:"amount"`
+	Mode                 string        `json:"mode"` // "reduce_term" or "reduce_payment"
+	AfterInstallment     int           `json:"after_installment"`
+	BalanceBefore        float64       `json:"balance_before"`
+	BalanceAfter         float64       `json:"balance_after"`
+	CurrentPayment       float64       `json:"current_payment"`
+	NewPayment           float64       `json:"new_payment"`
+	CurrentRemainingTerm int           `json:"current_remaining_term"`
+	NewRemainingTerm     int           `json:"new_remaining_term"`
+	CurrentInterest      float64       `json:"current_interest"`
+	NewInterest          float64       `json:"new_interest"`
+	InterestSaved        float64       `json:"interest_saved"`
+	Schedule             []Installment `json:"schedule"`
+}
+
+// simulateEarlyRepayment rebuilds the rest of the schedule after an extra payment.
+// reduce_payment keeps the term and lowers the installment; reduce_term keeps the
+// installment and pays the loan off sooner.
+func simulateEarlyRepayment(schedule []Installment, annualRate, amount float64, afterInstallment int, mode string) EarlyRepaymentSimulation {
+	sim := EarlyRepaymentSimulation{Amount: amount, Mode: mode, AfterInstallment: afterInstallment}
+	if len(schedule) == 0 {
+		return sim
+	}
+
+	remaining := schedule[afterInstallment:]
+	sim.CurrentRemainingTerm = len(remaining)
+	sim.CurrentPayment = schedule[0].Payment
+	for _, inst := range remaining {
+		sim.CurrentInterest += inst.Interest
+	}
+	sim.CurrentInterest = roundCents(sim.CurrentInterest)
+
+	if afterInstallment == 0 {
+		sim.BalanceBefore = roundCents(schedule[0].RemainingBalance + schedule[0].Principal)
+	} else {
+		sim.BalanceBefore = schedule[afterInstallment-1].RemainingBalance
+	}
+	sim.BalanceAfter = roundCents(math.Max(sim.BalanceBefore-amount, 0))
+	if sim.BalanceAfter == 0 || len(remaining) == 0 {
+		sim.InterestSaved = sim.CurrentInterest
+		return sim
+	}
+
+	nextDue, _ := time.Parse("2006-01-02", remaining[0].DueDate)
+	var newSchedule []Installment
+	if mode == "reduce_payment" {
+		newSchedule = buildSchedule(sim.BalanceAfter, annualRate, len(remaining), nextDue)
+	} else {
+		newSchedule = scheduleWithPayment(sim.BalanceAfter, annualRate, sim.CurrentPayment, nextDue)
+	}
+
+	for i := range newSchedule {
+		newSchedule[i].Number += afterInstallment
+		sim.NewInterest += newSchedule[i].Interest
+	}
+	sim.NewInterest = roundCents(sim.NewInterest)
+	sim.NewRemainingTerm = len(newSchedule)
+	if len(newSchedule) > 0 {
+		sim.NewPayment = newSchedule[0].Payment
+	}
+	sim.InterestSaved = roundCents(sim.CurrentInterest - sim.NewInterest)
+	sim.Schedule = newSchedule
+	return sim
+}
+
+// scheduleWithPayment amortizes balance with a fixed payment until it is paid off
+func scheduleWithPayment(balance, annualRate, payment float64, firstDue time.Time) []Installment {
+	rate := annualRate / 100 / 12
+	var schedule []Installment
+	for i := 1; balance > 0; i++ {
+		interest := roundCents(balance * rate)
+		principalPart := roundCents(payment - interest)
+		if principalPart <= 0 {
+			// The payment does not even cover the interest
+			break
+		}
+		if principalPart > balance {
+			principalPart = balance
+		}
+		balance = roundCents(balance - principalPart)
+
+		schedule = append(schedule, Installment{
+			Number:           i,
+			DueDate:          firstDue.AddDate(0, i-1, 0).Format("2006-01-02"),
+			Payment:          roundCents(interest + principalPart),
+			Interest:         interest,
+			Principal:        principalPart,
+			RemainingBalance: balance,
+		})
+	}
+	return schedule
+}
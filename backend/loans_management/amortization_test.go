@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildScheduleAmortizesPrincipal(t *testing.T) {
+	firstDue := time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC)
+	schedule := buildSchedule(100000, 3, 360, firstDue)
+
+	if len(schedule) != 360 {
+		t.Fatalf("Expected 360 installments, got %d", len(schedule))
+	}
+	if schedule[0].Payment != 421.60 {
+		t.Errorf("Expected monthly payment 421.60, got %.2f", schedule[0].Payment)
+	}
+	if schedule[0].Interest != 250 {
+		t.Errorf("Expected first interest 250.00, got %.2f", schedule[0].Interest)
+	}
+
+	var principal float64
+	for _, inst := range schedule {
+		principal += inst.Principal
+	}
+	if roundCents(principal) != 100000 {
+		t.Errorf("Expected principal parts to add up to 100000, got %.2f", principal)
+	}
+	if last := schedule[len(schedule)-1]; last.RemainingBalance != 0 || last.DueDate != "2054-01-15" {
+		t.Errorf("Expected last installment on 2054-01-15 with zero balance, got %s / %.2f", last.DueDate, last.RemainingBalance)
+	}
+}
+
+func TestZeroRateSchedule(t *testing.T) {
+	schedule := buildSchedule(1000, 0, 3, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if schedule[0].Payment != 333.33 || schedule[2].Payment != 333.34 || schedule[2].Interest != 0 {
+		t.Errorf("Unexpected zero rate schedule: %+v", schedule)
+	}
+}
+
+func TestSimulateEarlyRepayment(t *testing.T) {
+	schedule := buildSchedule(20000, 6, 60, time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC))
+
+	reduceTerm := simulateEarlyRepayment(schedule, 6, 5000, 12, "reduce_term")
+	if reduceTerm.NewRemainingTerm >= reduceTerm.CurrentRemainingTerm {
+		t.Errorf("Expected a shorter term, got %d vs %d", reduceTerm.NewRemainingTerm, reduceTerm.CurrentRemainingTerm)
+	}
+	if reduceTerm.InterestSaved <= 0 {
+		t.Errorf("Expected interest savings, got %.2f", reduceTerm.InterestSaved)
+	}
+
+	reducePayment := simulateEarlyRepayment(schedule, 6, 5000, 12, "reduce_payment")
+	if reducePayment.NewRemainingTerm != 48 || reducePayment.NewPayment >= reducePayment.CurrentPayment {
+		t.Errorf("Expected same term with a lower payment, got %d months of %.2f", reducePayment.NewRemainingTerm, reducePayment.NewPayment)
+	}
+	if reduceTerm.InterestSaved <= reducePayment.InterestSaved {
+		t.Errorf("Expected reducing the term to save more interest (%.2f vs %.2f)", reduceTerm.InterestSaved, reducePayment.InterestSaved)
+	}
+
+	payOff := simulateEarlyRepayment(schedule, 6, 50000, 12, "reduce_term")
+	if payOff.BalanceAfter != 0 || payOff.InterestSaved != payOff.CurrentInterest {
+		t.Errorf("Expected a full payoff to save all remaining interest, got %+v", payOff)
+	}
+}
+
+func TestFirstDueDateClampsPaymentDay(t *testing.T) {
+	due := firstDueDate(time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC))
+	if due.Format("2006-01-02") != "2024-02-28" {
+		t.Errorf("Expected 2024-02-28, got %s", due.Format("2006-01-02"))
+	}
+}
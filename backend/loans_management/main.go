@@ -0,0 +1,727 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"hero_budget_backend/common"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Loan is a mortgage, car loan or personal loan. Its installments are created as a
+// recurring bill; each payment is split into interest (an expense) and principal
+// (a reduction of the debt).
+type Loan struct {
+	ID               int           `json:"id"`
+	UserID           string        `json:"user_id"`
+	Name             string        `json:"name"`
+	LoanType         string        `json:"loan_type"` // "mortgage", "car", "personal"
+	Principal        float64       `json:"principal"`
+	AnnualRate       float64       `json:"annual_rate"`
+	TermMonths       int           `json:"term_months"`
+	StartDate        string        `json:"start_date"`
+	PaymentMethod    string        `json:"payment_method"`
+	MonthlyPayment   float64       `json:"monthly_payment"`
+	BillID           int           `json:"bill_id"`
+	RemainingBalance float64       `json:"remaining_balance"`
+	PaidInstallments int           `json:"paid_installments"`
+	Schedule         []Installment `json:"schedule,omitempty"`
+	CreatedAt        string        `json:"created_at"`
+}
+
+type AddLoanRequest struct {
+	UserID        string  `json:"user_id"`
+	Name          string  `json:"name"`
+	LoanType      string  `json:"loan_type"`
+	Principal     float64 `json:"principal"`
+	AnnualRate    float64 `json:"annual_rate"`
+	TermMonths    int     `json:"term_months"`
+	StartDate     string  `json:"start_date"`
+	PaymentMethod string  `json:"payment_method"`
+	Icon          string  `json:"icon,omitempty"`
+}
+
+type PayInstallmentRequest struct {
+	UserID        string `json:"user_id"`
+	LoanID        int    `json:"loan_id"`
+	Number        int    `json:"number,omitempty"` // Defaults to the oldest unpaid installment
+	Date          string `json:"date,omitempty"`
+	PaymentMethod string `json:"payment_method,omitempty"`
+}
+
+// LoanBalance is the state of the debt on a given date
+type LoanBalance struct {
+	LoanID                int     `json:"loan_id"`
+	Date                  string  `json:"date"`
+	RemainingBalance      float64 `json:"remaining_balance"`
+	PrincipalPaid         float64 `json:"principal_paid"`
+	InterestPaid          float64 `json:"interest_paid"`
+	PaidInstallments      int     `json:"paid_installments"`
+	RemainingInstallments int     `json:"remaining_installments"`
+	RemainingInterest     float64 `json:"remaining_interest"`
+	NextDueDate           string  `json:"next_due_date,omitempty"`
+}
+
+type ApiResponse struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+var db *sql.DB
+
+var validLoanTypes = map[string]bool{"mortgage": true, "car": true, "personal": true}
+
+func init() {
+	var err error
+
+	// Get the current working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Failed to get current directory: %v", err)
+	}
+
+	// Construct absolute path to the database file
+	dbPath := filepath.Join(cwd, "..", "google_auth", "users.db")
+	log.Printf("Using database at: %s", dbPath)
+
+	// Open the database connection
+	db, err = sql.Open("sqlite3", dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	// Test the connection
+	if err = db.Ping(); err != nil {
+		log.Fatalf("Failed to ping database: %v", err)
+	}
+
+	createTablesIfNotExist()
+
+	if err := common.EnsureIdempotencyTable(db); err != nil {
+		log.Fatalf("Failed to create idempotency_keys table: %v", err)
+	}
+
+	// Ledger from which the period balance tables are projected
+	if err := common.EnsureLedgerTable(db); err != nil {
+		log.Fatalf("Failed to create balance ledger: %v", err)
+	}
+
+	// Domain events written in the same transaction as each change
+	if err := common.EnsureOutboxTable(db); err != nil {
+		log.Fatalf("Failed to create outbox: %v", err)
+	}
+
+	log.Println("Loans Management - Database connection established successfully")
+}
+
+func createTablesIfNotExist() {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS loans (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			loan_type TEXT NOT NULL DEFAULT 'personal',
+			principal REAL NOT NULL,
+			annual_rate REAL NOT NULL DEFAULT 0,
+			term_months INTEGER NOT NULL,
+			start_date TEXT NOT NULL,
+			payment_method TEXT NOT NULL DEFAULT 'bank',
+			monthly_payment REAL NOT NULL,
+			bill_id INTEGER,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create loans table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS loan_installments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			loan_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			number INTEGER NOT NULL,
+			due_date TEXT NOT NULL,
+			payment REAL NOT NULL,
+			interest REAL NOT NULL,
+			principal REAL NOT NULL,
+			remaining_balance REAL NOT NULL,
+			paid BOOLEAN NOT NULL DEFAULT 0,
+			paid_date TEXT,
+			expense_id INTEGER,
+			UNIQUE(loan_id, number),
+			FOREIGN KEY (loan_id) REFERENCES loans (id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create loan_installments table: %v", err)
+	}
+
+	// Interest payments are stored as expenses linked to the loan's bill
+	if _, err := db.Exec(`ALTER TABLE expenses ADD COLUMN bill_id INTEGER`); err != nil {
+		log.Printf("Note: bill_id column not added to expenses: %v", err)
+	}
+	if err := common.EnsureCategoryIDColumn(db, "expenses"); err != nil {
+		log.Printf("Note: category_id column not added to expenses: %v", err)
+	}
+}
+
+func main() {
+	http.HandleFunc("/loans", corsMiddleware(handleFetchLoans))
+	http.HandleFunc("/loans/add", corsMiddleware(common.WithIdempotency(db, handleAddLoan)))
+	http.HandleFunc("/loans/schedule", corsMiddleware(handleFetchSchedule))
+	http.HandleFunc("/loans/pay", corsMiddleware(common.WithIdempotency(db, handlePayInstallment)))
+	http.HandleFunc("/loans/balance", corsMiddleware(handleLoanBalance))
+	http.HandleFunc("/loans/simulate-early-repayment", corsMiddleware(handleSimulateEarlyRepayment))
+	http.HandleFunc("/health", corsMiddleware(handleHealth))
+
+	port := 8099
+	log.Printf("Loans Management service started on :%d", port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+}
+
+func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	sendSuccessResponse(w, "Loans Management service is running", nil)
+}
+
+func handleFetchLoans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id FROM loans WHERE user_id = ? ORDER BY start_date DESC, id DESC
+	`, userID)
+	if err != nil {
+		log.Printf("Error fetching loans: %v", err)
+		sendErrorResponse(w, "Error fetching loans", http.StatusInternalServerError)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	loans := []Loan{}
+	for _, id := range ids {
+		loan, err := fetchLoan(id, userID, false)
+		if err != nil {
+			log.Printf("Error fetching loan %d: %v", id, err)
+			continue
+		}
+		loans = append(loans, *loan)
+	}
+
+	sendSuccessResponse(w, "Loans fetched successfully", loans)
+}
+
+func handleAddLoan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var addRequest AddLoanRequest
+	if err := json.NewDecoder(r.Body).Decode(&addRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if addRequest.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if addRequest.Name == "" {
+		sendErrorResponse(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if addRequest.Principal <= 0 {
+		sendErrorResponse(w, "Principal must be greater than 0", http.StatusBadRequest)
+		return
+	}
+	if addRequest.AnnualRate < 0 {
+		sendErrorResponse(w, "Annual rate cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if addRequest.TermMonths < 1 {
+		sendErrorResponse(w, "Term must be at least 1 month", http.StatusBadRequest)
+		return
+	}
+	if addRequest.LoanType == "" {
+		addRequest.LoanType = "personal"
+	}
+	if !validLoanTypes[addRequest.LoanType] {
+		sendErrorResponse(w, "Loan type must be 'mortgage', 'car' or 'personal'", http.StatusBadRequest)
+		return
+	}
+	if addRequest.PaymentMethod == "" {
+		addRequest.PaymentMethod = "bank"
+	}
+	if addRequest.PaymentMethod != "cash" && addRequest.PaymentMethod != "bank" {
+		sendErrorResponse(w, "Payment method must be 'cash' or 'bank'", http.StatusBadRequest)
+		return
+	}
+	if addRequest.StartDate == "" {
+		addRequest.StartDate = common.UserToday(db, addRequest.UserID)
+	}
+	startDate, err := time.Parse("2006-01-02", addRequest.StartDate)
+	if err != nil {
+		sendErrorResponse(w, "Invalid start date format. Use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if addRequest.Icon == "" {
+		addRequest.Icon = "🏦"
+	}
+
+	firstDue := firstDueDate(startDate)
+	schedule := buildSchedule(addRequest.Principal, addRequest.AnnualRate, addRequest.TermMonths, firstDue)
+	payment := monthlyPayment(addRequest.Principal, addRequest.AnnualRate, addRequest.TermMonths)
+
+	// The installments are regular bills, so they show up in upcoming bills and balances.
+	// The bill, the loan and its schedule are created together or not at all.
+	var loanID int64
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		billID, err := common.AddBillTx(tx, addRequest.UserID, addRequest.Name, payment, firstDue.Format("2006-01-02"),
+			firstDue.Day(), len(schedule), addRequest.PaymentMethod, "Loan", addRequest.Icon, "monthly")
+		if err != nil {
+			return fmt.Errorf("error creating loan bill: %w", err)
+		}
+
+		result, err := tx.Exec(`
+			INSERT INTO loans (user_id, name, loan_type, principal, annual_rate, term_months, start_date, payment_method, monthly_payment, bill_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, addRequest.UserID, addRequest.Name, addRequest.LoanType, addRequest.Principal, addRequest.AnnualRate,
+			addRequest.TermMonths, addRequest.StartDate, addRequest.PaymentMethod, payment, billID)
+		if err != nil {
+			return fmt.Errorf("error inserting loan: %w", err)
+		}
+		loanID, _ = result.LastInsertId()
+
+		for _, inst := range schedule {
+			_, err = tx.Exec(`
+				INSERT INTO loan_installments (loan_id, user_id, number, due_date, payment, interest, principal, remaining_balance)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			`, loanID, addRequest.UserID, inst.Number, inst.DueDate, inst.Payment, inst.Interest, inst.Principal, inst.RemainingBalance)
+			if err != nil {
+				return fmt.Errorf("error inserting installment %d: %w", inst.Number, err)
+			}
+		}
+		return common.PublishEvent(tx, common.EventLoanCreated, addRequest.UserID, loanID, addRequest)
+	})
+	if err != nil {
+		log.Printf("Error adding loan: %v", err)
+		sendErrorResponse(w, "Error adding loan", common.TxErrorStatus(err))
+		return
+	}
+
+	loan, err := fetchLoan(int(loanID), addRequest.UserID, true)
+	if err != nil {
+		log.Printf("Error fetching new loan: %v", err)
+		sendErrorResponse(w, "Loan added but could not be fetched", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Loan added successfully", loan)
+}
+
+func handleFetchSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	loanID, _ := strconv.Atoi(r.URL.Query().Get("loan_id"))
+	if userID == "" || loanID <= 0 {
+		sendErrorResponse(w, "User ID and loan ID are required", http.StatusBadRequest)
+		return
+	}
+
+	loan, err := fetchLoan(loanID, userID, true)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Loan not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching loan: %v", err)
+		sendErrorResponse(w, "Error fetching loan", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Schedule fetched successfully", loan)
+}
+
+// errInstallmentAlreadyPaid is returned when another request paid the installment after it
+// was loaded
+var errInstallmentAlreadyPaid = errors.New("installment is already paid")
+
+func handlePayInstallment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payRequest PayInstallmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&payRequest); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if payRequest.UserID == "" || payRequest.LoanID <= 0 {
+		sendErrorResponse(w, "User ID and loan ID are required", http.StatusBadRequest)
+		return
+	}
+	if payRequest.Date == "" {
+		payRequest.Date = common.UserToday(db, payRequest.UserID)
+	}
+	paymentDate, err := time.Parse("2006-01-02", payRequest.Date)
+	if err != nil {
+		sendErrorResponse(w, "Invalid date format. Use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	loan, err := fetchLoan(payRequest.LoanID, payRequest.UserID, true)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Loan not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching loan: %v", err)
+		sendErrorResponse(w, "Error fetching loan", http.StatusInternalServerError)
+		return
+	}
+	if payRequest.PaymentMethod == "" {
+		payRequest.PaymentMethod = loan.PaymentMethod
+	}
+	if payRequest.PaymentMethod != "cash" && payRequest.PaymentMethod != "bank" {
+		sendErrorResponse(w, "Payment method must be 'cash' or 'bank'", http.StatusBadRequest)
+		return
+	}
+
+	var installment *Installment
+	for i := range loan.Schedule {
+		inst := &loan.Schedule[i]
+		if (payRequest.Number == 0 && !inst.Paid) || inst.Number == payRequest.Number {
+			installment = inst
+			break
+		}
+	}
+	if installment == nil {
+		sendErrorResponse(w, "No pending installment found", http.StatusNotFound)
+		return
+	}
+	if installment.Paid {
+		sendErrorResponse(w, "Installment is already paid", http.StatusConflict)
+		return
+	}
+
+	yearMonth := installment.DueDate[:7]
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		// Claim the installment first: a double submit or a retry that lost the race must not
+		// record the interest or the principal a second time
+		var installmentID int64
+		err := tx.QueryRow(`
+			SELECT id FROM loan_installments WHERE loan_id = ? AND number = ? AND user_id = ?
+		`, loan.ID, installment.Number, payRequest.UserID).Scan(&installmentID)
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec(`
+			UPDATE loan_installments SET paid = 1, paid_date = ?
+			WHERE id = ? AND paid = 0
+		`, payRequest.Date, installmentID)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return errInstallmentAlreadyPaid
+		}
+
+		// Release the amount reserved by the bill for this month; the real outflow is
+		// registered below on the payment date
+		if loan.BillID > 0 {
+			err := common.MarkBillPaidTx(tx, loan.BillID, payRequest.UserID, yearMonth)
+			if err == common.ErrBillPaymentNotFound || err == common.ErrBillAlreadyPaid {
+				log.Printf("Loan bill %d for %s: %v", loan.BillID, yearMonth, err)
+			} else if err != nil {
+				return err
+			}
+		}
+
+		// Interest is an expense; principal only reduces the debt but still leaves the account
+		var expenseID sql.NullInt64
+		var changes []common.LedgerChange
+		if installment.Interest > 0 {
+			categoryID, err := common.ResolveCategoryID(tx, payRequest.UserID, "expense", "Loan interest")
+			if err != nil {
+				return err
+			}
+			result, err := tx.Exec(`
+				INSERT INTO expenses (user_id, amount, date, category, category_id, payment_method, description, bill_id)
+				VALUES (?, ?, ?, 'Loan interest', ?, ?, ?, ?)
+			`, payRequest.UserID, installment.Interest, payRequest.Date, categoryID, payRequest.PaymentMethod,
+				fmt.Sprintf("%s - installment %d interest", loan.Name, installment.Number), loan.BillID)
+			if err != nil {
+				return err
+			}
+			id, _ := result.LastInsertId()
+			expenseID = sql.NullInt64{Int64: id, Valid: true}
+			changes = append(changes, common.LedgerChange{
+				SourceType: common.LedgerSourceExpense,
+				SourceID:   id,
+				Entries: []common.LedgerEntry{{
+					Date: paymentDate, Kind: common.LedgerExpense, PaymentMethod: payRequest.PaymentMethod, Amount: installment.Interest,
+				}},
+			})
+		}
+
+		if _, err := tx.Exec(`UPDATE loan_installments SET expense_id = ? WHERE id = ?`, expenseID, installmentID); err != nil {
+			return err
+		}
+		if installment.Principal > 0 {
+			changes = append(changes, common.LedgerChange{
+				SourceType: common.LedgerSourceLoanInstallment,
+				SourceID:   installmentID,
+				Entries: []common.LedgerEntry{{
+					Date: paymentDate, Kind: common.LedgerBill, PaymentMethod: payRequest.PaymentMethod, Amount: installment.Principal,
+				}},
+			})
+		}
+		if err := common.ApplyLedgerChanges(tx, payRequest.UserID, changes...); err != nil {
+			return err
+		}
+		return common.PublishEvent(tx, common.EventLoanInstallmentPaid, payRequest.UserID, installmentID, map[string]interface{}{
+			"loan_id":   loan.ID,
+			"number":    installment.Number,
+			"date":      payRequest.Date,
+			"interest":  installment.Interest,
+			"principal": installment.Principal,
+		})
+	})
+	if err == errInstallmentAlreadyPaid {
+		sendErrorResponse(w, "Installment is already paid", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error paying installment: %v", err)
+		sendErrorResponse(w, "Error paying installment", common.TxErrorStatus(err))
+		return
+	}
+
+	installment.Paid = true
+	installment.PaidDate = payRequest.Date
+	sendSuccessResponse(w, "Installment paid successfully", installment)
+}
+
+func handleLoanBalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	loanID, _ := strconv.Atoi(r.URL.Query().Get("loan_id"))
+	if userID == "" || loanID <= 0 {
+		sendErrorResponse(w, "User ID and loan ID are required", http.StatusBadRequest)
+		return
+	}
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = common.UserToday(db, userID)
+	}
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		sendErrorResponse(w, "Invalid date format. Use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	loan, err := fetchLoan(loanID, userID, true)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Loan not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching loan: %v", err)
+		sendErrorResponse(w, "Error fetching loan", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccessResponse(w, "Loan balance fetched successfully", loanBalanceAt(loan, date))
+}
+
+// loanBalanceAt counts the installments paid on or before date
+func loanBalanceAt(loan *Loan, date string) LoanBalance {
+	balance := LoanBalance{LoanID: loan.ID, Date: date, RemainingBalance: loan.Principal}
+	for _, inst := range loan.Schedule {
+		if inst.Paid && inst.PaidDate <= date {
+			balance.PrincipalPaid += inst.Principal
+			balance.InterestPaid += inst.Interest
+			balance.PaidInstallments++
+			continue
+		}
+		balance.RemainingInstallments++
+		balance.RemainingInterest += inst.Interest
+		if balance.NextDueDate == "" {
+			balance.NextDueDate = inst.DueDate
+		}
+	}
+	balance.PrincipalPaid = roundCents(balance.PrincipalPaid)
+	balance.InterestPaid = roundCents(balance.InterestPaid)
+	balance.RemainingInterest = roundCents(balance.RemainingInterest)
+	balance.RemainingBalance = roundCents(loan.Principal - balance.PrincipalPaid)
+	return balance
+}
+
+func handleSimulateEarlyRepayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	userID := query.Get("user_id")
+	loanID, _ := strconv.Atoi(query.Get("loan_id"))
+	amount, _ := strconv.ParseFloat(query.Get("amount"), 64)
+	if userID == "" || loanID <= 0 {
+		sendErrorResponse(w, "User ID and loan ID are required", http.StatusBadRequest)
+		return
+	}
+	if amount <= 0 {
+		sendErrorResponse(w, "Amount must be greater than 0", http.StatusBadRequest)
+		return
+	}
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = "reduce_term"
+	}
+	if mode != "reduce_term" && mode != "reduce_payment" {
+		sendErrorResponse(w, "Mode must be 'reduce_term' or 'reduce_payment'", http.StatusBadRequest)
+		return
+	}
+
+	loan, err := fetchLoan(loanID, userID, true)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Loan not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching loan: %v", err)
+		sendErrorResponse(w, "Error fetching loan", http.StatusInternalServerError)
+		return
+	}
+
+	// By default the extra payment is made after the last paid installment
+	afterInstallment := loan.PaidInstallments
+	if value := query.Get("after_installment"); value != "" {
+		afterInstallment, err = strconv.Atoi(value)
+		if err != nil || afterInstallment < 0 || afterInstallment > len(loan.Schedule) {
+			sendErrorResponse(w, "Invalid after_installment", http.StatusBadRequest)
+			return
+		}
+	}
+
+	simulation := simulateEarlyRepayment(loan.Schedule, loan.AnnualRate, amount, afterInstallment, mode)
+	simulation.LoanID = loan.ID
+	sendSuccessResponse(w, "Early repayment simulated successfully", simulation)
+}
+
+// fetchLoan loads a loan and, if withSchedule is set, its installments
+func fetchLoan(loanID int, userID string, withSchedule bool) (*Loan, error) {
+	var loan Loan
+	var billID sql.NullInt64
+	err := db.QueryRow(`
+		SELECT id, user_id, name, loan_type, principal, annual_rate, term_months, start_date,
+		       payment_method, monthly_payment, bill_id, COALESCE(created_at, '')
+		FROM loans WHERE id = ? AND user_id = ?
+	`, loanID, userID).Scan(&loan.ID, &loan.UserID, &loan.Name, &loan.LoanType, &loan.Principal,
+		&loan.AnnualRate, &loan.TermMonths, &loan.StartDate, &loan.PaymentMethod, &loan.MonthlyPayment,
+		&billID, &loan.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	loan.BillID = int(billID.Int64)
+
+	rows, err := db.Query(`
+		SELECT number, due_date, payment, interest, principal, remaining_balance, paid, COALESCE(paid_date, '')
+		FROM loan_installments WHERE loan_id = ? ORDER BY number
+	`, loanID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var principalPaid float64
+	for rows.Next() {
+		var inst Installment
+		if err := rows.Scan(&inst.Number, &inst.DueDate, &inst.Payment, &inst.Interest, &inst.Principal,
+			&inst.RemainingBalance, &inst.Paid, &inst.PaidDate); err != nil {
+			return nil, err
+		}
+		if inst.Paid {
+			loan.PaidInstallments++
+			principalPaid += inst.Principal
+		}
+		if withSchedule {
+			loan.Schedule = append(loan.Schedule, inst)
+		}
+	}
+	loan.RemainingBalance = roundCents(loan.Principal - principalPaid)
+
+	return &loan, rows.Err()
+}
+
+func sendSuccessResponse(w http.ResponseWriter, message string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ApiResponse{
+		Success: true,
+		Message: message,
+		Data:    data,
+	})
+}
+
+func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ApiResponse{
+		Success: false,
+		Message: message,
+	})
+}
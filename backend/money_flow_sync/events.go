@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+
+	"hero_budget_backend/common"
+)
+
+// budgetEvents are the domain events after which the user's budget figures can change
+var budgetEvents = []string{
+	common.EventIncomeCreated, common.EventIncomeUpdated, common.EventIncomeDeleted,
+	common.EventExpenseCreated, common.EventExpenseUpdated, common.EventExpenseDeleted,
+	common.EventBillCreated, common.EventBillUpdated, common.EventBillDeleted, common.EventBillPaid,
+	common.EventCardStatementClosed, common.EventLoanCreated, common.EventLoanInstallmentPaid,
+}
+
+// ledgerEvents are the domain events written together with a change to the user's cash and bank ledger
+var ledgerEvents = []string{
+	common.EventIncomeCreated, common.EventIncomeUpdated, common.EventIncomeDeleted,
+	common.EventExpenseCreated, common.EventExpenseUpdated, common.EventExpenseDeleted,
+	common.EventBillCreated, common.EventBillUpdated, common.EventBillDeleted,
+	common.EventBillPaid, common.EventBillPartiallyPaid,
+	common.EventTransferMade, common.EventCashBankAdjusted, common.EventCardStatementPaid,
+	common.EventLoanCreated, common.EventLoanInstallmentPaid,
+}
+
+// startEventDispatcher delivers outbox events to the subscribers hosted by this service:
+// the budget sync, the balance projector, and outgoing webhooks when HERO_BUDGET_WEBHOOK_URLS
+// is set. Bill notifications subscribe from bill_reminders, which owns the email settings.
+func startEventDispatcher(ctx context.Context) {
+	dispatcher := common.NewDispatcher(db)
+	dispatcher.Subscribe("budget_sync", syncBudgetForEvent, budgetEvents...)
+	dispatcher.Subscribe("balance_projector", projectBalancesForEvent, ledgerEvents...)
+
+	if urls := common.WebhookURLs(); len(urls) > 0 {
+		dispatcher.Subscribe("webhooks", common.WebhookHandler(urls, os.Getenv(common.WebhookSecretEnv)))
+		log.Printf("Delivering domain events to %d webhook(s)", len(urls))
+	}
+
+	go dispatcher.Run(ctx)
+}
+
+// syncBudgetForEvent refreshes every budget period the user has, so the budget table stays
+// current without the client calling /money-flow/sync after each change
+func syncBudgetForEvent(event common.DomainEvent) error {
+	periods, err := budgetPeriods(event.UserID)
+	if err != nil {
+		return err
+	}
+	for _, period := range periods {
+		if _, err := syncMoneyFlow(event.UserID, period); err != nil {
+			return fmt.Errorf("error syncing %s budget after %s: %v", period, event.Type, err)
+		}
+	}
+	return nil
+}
+
+// projectBalancesForEvent checks the user's period balances against the source tables and
+// repairs any drift. Writers already project the ledger in their own transaction, so this
+// only finds something when a row was changed outside the services, e.g. by a script.
+func projectBalancesForEvent(event common.DomainEvent) error {
+	report, err := common.AuditPeriodBalances(db, event.UserID, true)
+	if err != nil {
+		return fmt.Errorf("error projecting balances after %s: %v", event.Type, err)
+	}
+	if len(report.Drifts) > 0 {
+		log.Printf("Repaired %d period balance rows of user %s after %s", len(report.Drifts), event.UserID, event.Type)
+	}
+	return nil
+}
+
+// budgetPeriods returns the periods with a budget row for the user, or monthly if there are none
+func budgetPeriods(userID string) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT period FROM budget WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading budget periods: %v", err)
+	}
+	defer rows.Close()
+
+	var periods []string
+	for rows.Next() {
+		var period sql.NullString
+		if err := rows.Scan(&period); err != nil {
+			return nil, fmt.Errorf("error scanning budget period: %v", err)
+		}
+		if period.Valid && period.String != "" {
+			periods = append(periods, period.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(periods) == 0 {
+		periods = []string{"monthly"}
+	}
+	return periods, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"path/filepath"
 	"time"
 
+	"hero_budget_backend/common"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -73,6 +76,16 @@ func init() {
 		log.Fatalf("Failed to ping database: %v", err)
 	}
 
+	// Events written by the other services alongside each change
+	if err = common.EnsureOutboxTable(db); err != nil {
+		log.Fatalf("Failed to create outbox: %v", err)
+	}
+
+	// Bill payments created while syncing reserve their amount in the ledger
+	if err = common.EnsureLedgerTable(db); err != nil {
+		log.Fatalf("Failed to create balance ledger: %v", err)
+	}
+
 	log.Println("Database connection established successfully")
 }
 
@@ -81,6 +94,9 @@ func main() {
 	http.HandleFunc("/money-flow/sync", corsMiddleware(handleSyncMoneyFlow))
 	http.HandleFunc("/money-flow/data", corsMiddleware(handleGetMoneyFlowData))
 
+	// Keep the budget in sync as transactions change
+	startEventDispatcher(context.Background())
+
 	port := 8097 // Puerto para el servicio de sincronización de money flow
 	log.Printf("Money Flow Sync service started on :%d", port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
@@ -177,11 +193,15 @@ func syncMoneyFlow(userID, period string) (*BudgetData, error) {
 	log.Printf("Syncing money flow for user %s with period %s", userID, period)
 
 	// Get date range for the period
-	startDate, endDate := getDateRangeForPeriod(period)
+	settings, err := common.LoadPeriodSettings(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	startDate, endDate := getDateRangeForPeriod(settings, common.UserNow(db, userID), period)
 	log.Printf("Date range: %s to %s", startDate, endDate)
 
 	// Get remaining amount from previous period
-	previousPeriod, fromPrevious := getPreviousPeriodData(userID, period)
+	previousPeriod, fromPrevious := getPreviousPeriodData(settings, userID, period)
 	log.Printf("Previous period: %s, fromPrevious: %.2f", previousPeriod, fromPrevious)
 
 	// Get total income for the period
@@ -222,7 +242,7 @@ func syncMoneyFlow(userID, period string) (*BudgetData, error) {
 	budget := &BudgetData{
 		UserID:          userID,
 		Period:          period,
-		Date:            time.Now().Format("2006-01-02"),
+		Date:            common.UserToday(db, userID),
 		TotalAmount:     totalAmount,
 		RemainingAmount: remainingAmount,
 		SpentAmount:     spentAmount,
@@ -248,60 +268,23 @@ func syncMoneyFlow(userID, period string) (*BudgetData, error) {
 	return budget, nil
 }
 
-func getDateRangeForPeriod(period string) (string, string) {
-	now := time.Now()
-
-	switch period {
-	case "daily":
-		// Current day
-		return now.Format("2006-01-02"), now.Format("2006-01-02")
-	case "weekly":
-		// Start of the week (Monday)
-		startDate := now.AddDate(0, 0, -int(now.Weekday())+1)
-		if now.Weekday() == 0 { // If today is Sunday
-			startDate = now.AddDate(0, 0, -6) // Go back to previous Monday
-		}
-		// End of the week (Sunday)
-		endDate := startDate.AddDate(0, 0, 6)
-		return startDate.Format("2006-01-02"), endDate.Format("2006-01-02")
-	case "monthly":
-		// Start of the month
-		startDate := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
-		// End of the month
-		endDate := time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, now.Location())
-		return startDate.Format("2006-01-02"), endDate.Format("2006-01-02")
-	case "quarterly":
-		quarter := (int(now.Month())-1)/3 + 1
-		startDate := time.Date(now.Year(), time.Month((quarter-1)*3+1), 1, 0, 0, 0, 0, now.Location())
-		endDate := time.Date(now.Year(), time.Month(quarter*3+1), 0, 0, 0, 0, 0, now.Location())
-		return startDate.Format("2006-01-02"), endDate.Format("2006-01-02")
-	case "semiannual":
-		halfYear := (int(now.Month())-1)/6 + 1
-		startDate := time.Date(now.Year(), time.Month((halfYear-1)*6+1), 1, 0, 0, 0, 0, now.Location())
-		endDate := time.Date(now.Year(), time.Month(halfYear*6+1), 0, 0, 0, 0, 0, now.Location())
-		return startDate.Format("2006-01-02"), endDate.Format("2006-01-02")
-	case "annual":
-		startDate := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location())
-		endDate := time.Date(now.Year(), 12, 31, 0, 0, 0, 0, now.Location())
-		return startDate.Format("2006-01-02"), endDate.Format("2006-01-02")
-	default:
-		// Default to monthly if period is not recognized
-		startDate := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
-		endDate := time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, now.Location())
-		return startDate.Format("2006-01-02"), endDate.Format("2006-01-02")
-	}
+// getDateRangeForPeriod returns the current period following the user's month and week start,
+// taking today as the date in their time zone
+func getDateRangeForPeriod(settings common.PeriodSettings, now time.Time, period string) (string, string) {
+	startDate, endDate := settings.Range(period, now)
+	return startDate.Format("2006-01-02"), endDate.Format("2006-01-02")
 }
 
-func getPreviousPeriodData(userID, currentPeriod string) (string, float64) {
+func getPreviousPeriodData(settings common.PeriodSettings, userID, currentPeriod string) (string, float64) {
 	// Para el cálculo del flujo de dinero, necesitamos el previous_amount del MES ACTUAL
 	// no del mes anterior. Esto es porque previous_amount ya contiene el balance heredado.
 
-	now := time.Now()
+	now := common.UserNow(db, userID)
 
 	switch currentPeriod {
 	case "monthly":
 		// Obtener el año-mes actual
-		currentYearMonth := now.Format("2006-01")
+		currentYearMonth := settings.Identifier(now, "monthly")
 
 		log.Printf("🔍 DEBUG: Looking for previous_amounts for user %s, month %s", userID, currentYearMonth)
 
@@ -331,7 +314,7 @@ func getPreviousPeriodData(userID, currentPeriod string) (string, float64) {
 
 	case "daily":
 		// Para períodos diarios, también buscamos en monthly_cash_bank_balance
-		currentYearMonth := now.Format("2006-01")
+		currentYearMonth := settings.Identifier(now, "monthly")
 
 		log.Printf("🔍 DEBUG: Looking for previous_amounts (daily) for user %s, month %s", userID, currentYearMonth)
 
@@ -358,7 +341,7 @@ func getPreviousPeriodData(userID, currentPeriod string) (string, float64) {
 
 	case "weekly":
 		// Para períodos semanales, también buscamos en monthly_cash_bank_balance del mes actual
-		currentYearMonth := now.Format("2006-01")
+		currentYearMonth := settings.Identifier(now, "monthly")
 
 		log.Printf("🔍 DEBUG: Looking for previous_amounts (weekly) for user %s, month %s", userID, currentYearMonth)
 
@@ -426,34 +409,40 @@ func getUpcomingBillsAmount(userID, startDate, endDate string) (float64, error)
 	// Para calcular las facturas pendientes, necesitamos consultar la tabla bill_payments
 	// y obtener las facturas que NO han sido pagadas en el período actual
 
-	// Convertir las fechas del período al formato year_month para consultar bill_payments
-	startTime, err := time.Parse("2006-01-02", startDate)
+	// Scheduled bills create their payments as they come closer; make sure the period's exist
+	endTime, err := time.Parse("2006-01-02", endDate)
 	if err != nil {
-		return 0, fmt.Errorf("error parsing start date: %v", err)
+		return 0, fmt.Errorf("error parsing end date: %v", err)
+	}
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		return common.ExpandBillOccurrences(tx, userID, endTime)
+	})
+	if err != nil {
+		log.Printf("Error expanding bill payments: %v", err)
 	}
 
-	// Para períodos mensuales, usar el año-mes del startDate
-	yearMonth := startTime.Format("2006-01")
-
-	// Consultar bill_payments para obtener facturas NO pagadas del mes actual
+	// Query bill_payments for what is left to pay on the UNPAID bills due within the period,
+	// with each payment's own amount and net of partial payments. It filters by due date and not
+	// by calendar month: with months starting on the 25th, the period from January 25 to
+	// February 24 does not include the bills due from January 1 to 24.
 	query := `
-		SELECT COALESCE(SUM(b.amount), 0)
+		SELECT COALESCE(SUM(` + common.BillPaymentRemainingSQL + `), 0)
 		FROM bills b
 		INNER JOIN bill_payments bp ON b.id = bp.bill_id
 		WHERE bp.user_id = ? 
-		AND bp.year_month = ? 
+		AND ` + common.BillPaymentDueDateSQL + ` BETWEEN ? AND ?
 		AND bp.paid = 0
 	`
 
 	var upcomingAmount float64
-	err = db.QueryRow(query, userID, yearMonth).Scan(&upcomingAmount)
+	err = db.QueryRow(query, userID, startDate, endDate).Scan(&upcomingAmount)
 	if err != nil {
 		log.Printf("Error getting upcoming bills amount from bill_payments: %v", err)
 		// Fallback a la lógica original si falla la nueva consulta
 		return getUpcomingBillsAmountFallback(userID, startDate, endDate)
 	}
 
-	log.Printf("📋 Found upcoming bills for %s: amount=%.2f", yearMonth, upcomingAmount)
+	log.Printf("📋 Found upcoming bills for %s to %s: amount=%.2f", startDate, endDate, upcomingAmount)
 	return upcomingAmount, nil
 }
 
@@ -16,6 +16,8 @@ import (
 	"strings"
 	"time"
 
+	"hero_budget_backend/common"
+
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/nfnt/resize"
 )
@@ -91,6 +93,10 @@ func init() {
 	}
 
 	log.Println("Database connection established successfully")
+
+	if err = common.EnsurePeriodSettingsTable(db); err != nil {
+		log.Fatalf("Failed to prepare period settings: %v", err)
+	}
 }
 
 func main() {
@@ -101,6 +107,7 @@ func main() {
 	http.HandleFunc("/profile/test-image-update", corsMiddleware(handleTestImageUpdate))
 	http.HandleFunc("/update/locale", corsMiddleware(handleLocaleUpdate))
 	http.HandleFunc("/profile/delete-account", corsMiddleware(handleDeleteAccount))
+	http.HandleFunc("/profile/period-settings", corsMiddleware(handlePeriodSettings))
 
 	port := 8092 // Asignamos el puerto 8092 para el servicio de profile_management
 	log.Printf("Profile Management service started on :%d", port)
@@ -603,6 +610,9 @@ func handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
 		"incomes",
 		"savings",
 		"balances",
+		"user_period_settings",
+		"balance_ledger",
+		"balance_ledger_users",
 		"users",
 	}
 
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+// PeriodSettingsRequest saves the month start day (1-28) and the week start day (0 Sunday - 6 Saturday)
+type PeriodSettingsRequest struct {
+	UserID        string        `json:"user_id"`
+	MonthStartDay int           `json:"month_start_day"`
+	WeekStartDay  *time.Weekday `json:"week_start_day"`
+}
+
+// PeriodSettingsResponse returns the settings and whether the balances were rebuilt
+type PeriodSettingsResponse struct {
+	UserID string `json:"user_id"`
+	common.PeriodSettings
+	Rebuilt bool `json:"rebuilt"`
+}
+
+// handlePeriodSettings reads (GET ?user_id=) or changes (POST) how the user's periods are
+// grouped. A change rebuilds all of their *_cash_bank_balance tables.
+func handlePeriodSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		userID := r.URL.Query().Get("user_id")
+		if userID == "" {
+			http.Error(w, "user_id is required", http.StatusBadRequest)
+			return
+		}
+
+		settings, err := common.LoadPeriodSettings(db, userID)
+		if err != nil {
+			log.Printf("Error fetching period settings: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ApiResponse{
+			Success: true,
+			Data:    PeriodSettingsResponse{UserID: userID, PeriodSettings: settings},
+		})
+
+	case "POST":
+		var req PeriodSettingsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("Invalid request body: %v", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.UserID == "" {
+			http.Error(w, "user_id is required", http.StatusBadRequest)
+			return
+		}
+
+		settings, err := common.LoadPeriodSettings(db, req.UserID)
+		if err != nil {
+			log.Printf("Error fetching period settings: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		// Fields that are not sent keep their value
+		if req.MonthStartDay != 0 {
+			settings.MonthStartDay = req.MonthStartDay
+		}
+		if req.WeekStartDay != nil {
+			settings.WeekStartDay = *req.WeekStartDay
+		}
+		if err := settings.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The settings and the rebuild go in the same transaction
+		var changed bool
+		err = common.WithTx(db, func(tx *sql.Tx) error {
+			var err error
+			changed, err = common.SavePeriodSettings(tx, req.UserID, settings)
+			if err == nil && changed {
+				err = common.RebuildPeriodBalances(tx, req.UserID)
+			}
+			return err
+		})
+		if err != nil {
+			log.Printf("Error updating period settings for user %s: %v", req.UserID, err)
+			http.Error(w, "Failed to update period settings", common.TxErrorStatus(err))
+			return
+		}
+
+		log.Printf("Period settings updated for user %s: month starts on %d, week on %s (rebuilt: %v)",
+			req.UserID, settings.MonthStartDay, settings.WeekStartDay, changed)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ApiResponse{
+			Success: true,
+			Message: "Period settings updated successfully",
+			Data:    PeriodSettingsResponse{UserID: req.UserID, PeriodSettings: settings, Rebuilt: changed},
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
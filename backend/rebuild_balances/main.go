@@ -0,0 +1,62 @@
+// Command rebuild_balances recomputes the daily, weekly, monthly, quarterly, semiannual and
+// annual cash/bank balance tables from the raw incomes, expenses, bill payments and transfers,
+// and prints every stored row that differs from the recomputed one.
+//
+// Usage:
+//
+//	go run ./rebuild_balances [-user ID] [-apply] [-db path]
+//
+// Without -user every user is checked. Without -apply nothing is written (dry run).
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"hero_budget_backend/common"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func main() {
+	userID := flag.String("user", "", "user to check; all users when empty")
+	apply := flag.Bool("apply", false, "repair the drifted rows instead of only reporting them")
+	dbPath := flag.String("db", filepath.Join("..", "google_auth", "users.db"), "path to the SQLite database")
+	flag.Parse()
+
+	db, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if err := common.EnsurePeriodSettingsTable(db); err != nil {
+		log.Fatalf("Failed to prepare balance tables: %v", err)
+	}
+
+	report, err := common.AuditPeriodBalances(db, *userID, *apply)
+	if err != nil {
+		log.Fatalf("Failed to rebuild balances: %v", err)
+	}
+
+	for _, drift := range report.Drifts {
+		fmt.Printf("user=%s table=%s period=%s status=%s\n", drift.UserID, drift.Table, drift.Period, drift.Status)
+		for _, column := range drift.Columns {
+			fmt.Printf("    %-26s stored=%.2f recomputed=%.2f\n", column.Column, column.Stored, column.Recomputed)
+		}
+	}
+
+	action := "found (dry run, use -apply to repair)"
+	if report.Applied {
+		action = "repaired"
+	}
+	fmt.Printf("%d users checked, %d drifted rows %s\n", report.Users, len(report.Drifts), action)
+
+	if len(report.Drifts) > 0 && !report.Applied {
+		os.Exit(1)
+	}
+}
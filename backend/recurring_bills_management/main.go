@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"hero_budget_backend/common"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Template is a recurring income or expense, e.g. a salary on the last working day of the
+// month or a gym fee every 1st. Its occurrences follow the same recurrence rules as bills
+// (see common.BillSchedule) and are posted by the scheduler.
+type Template struct {
+	ID                    int     `json:"id"`
+	UserID                string  `json:"user_id"`
+	Type                  string  `json:"type"` // "income" or "expense"
+	Name                  string  `json:"name"`
+	Amount                float64 `json:"amount"`
+	Category              string  `json:"category"`
+	PaymentMethod         string  `json:"payment_method"`
+	Description           string  `json:"description"`
+	StartDate             string  `json:"start_date"`
+	PaymentDay            int     `json:"payment_day"`     // -1 for the last day of the month
+	DurationMonths        int     `json:"duration_months"` // 0 repeats until the template is deleted
+	Regularity            string  `json:"regularity"`      // Preset (weekly ... annual) or an RRULE
+	BusinessDayAdjustment string  `json:"business_day_adjustment"`
+	PostingMode           string  `json:"posting_mode"` // "auto", "confirm", or "" for the user's preference
+	Active                bool    `json:"active"`
+	GeneratedThrough      string  `json:"generated_through,omitempty"`
+	NextDate              string  `json:"next_date,omitempty"`
+	CreatedAt             string  `json:"created_at"`
+	UpdatedAt             string  `json:"updated_at"`
+}
+
+// Occurrence is one date of a template once the scheduler has reached it, or once the user
+// skipped it in advance
+type Occurrence struct {
+	ID            int64   `json:"id"`
+	TemplateID    int     `json:"template_id"`
+	UserID        string  `json:"user_id"`
+	Key           string  `json:"occurrence_key"`
+	DueDate       string  `json:"due_date"`
+	Type          string  `json:"type"`
+	Name          string  `json:"name"`
+	Amount        float64 `json:"amount"`
+	PaymentMethod string  `json:"payment_method"`
+	Status        string  `json:"status"`
+	TransactionID int64   `json:"transaction_id,omitempty"`
+	PostedAt      string  `json:"posted_at,omitempty"`
+}
+
+type ApiResponse struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Posting modes: auto-post each occurrence on its date or queue it until the user confirms it
+const (
+	PostingAuto    = "auto"
+	PostingConfirm = "confirm"
+)
+
+// Occurrence statuses. "scheduled" is only reported for dates the scheduler has not reached.
+const (
+	StatusScheduled = "scheduled"
+	StatusQueued    = "queued"
+	StatusPosted    = "posted"
+	StatusSkipped   = "skipped"
+)
+
+var db *sql.DB
+
+func init() {
+	var err error
+
+	// Get the current working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Failed to get current directory: %v", err)
+	}
+
+	// Construct absolute path to the database file
+	dbPath := filepath.Join(cwd, "..", "google_auth", "users.db")
+	log.Printf("Using database at: %s", dbPath)
+
+	// Open the database connection
+	db, err = sql.Open("sqlite3", dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	// Test the connection
+	if err = db.Ping(); err != nil {
+		log.Fatalf("Failed to ping database: %v", err)
+	}
+
+	if err := createTablesIfNotExist(db); err != nil {
+		log.Fatalf("Failed to create recurring tables: %v", err)
+	}
+
+	if err := common.EnsureIdempotencyTable(db); err != nil {
+		log.Fatalf("Failed to create idempotency_keys table: %v", err)
+	}
+
+	// Ledger from which the period balance tables are projected
+	if err := common.EnsureLedgerTable(db); err != nil {
+		log.Fatalf("Failed to create balance ledger: %v", err)
+	}
+
+	// Domain events written in the same transaction as each change
+	if err := common.EnsureOutboxTable(db); err != nil {
+		log.Fatalf("Failed to create outbox: %v", err)
+	}
+
+	log.Println("Recurring Bills Management - Database connection established successfully")
+}
+
+func createTablesIfNotExist(db *sql.DB) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS recurring_templates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			name TEXT NOT NULL,
+			amount REAL NOT NULL,
+			category TEXT NOT NULL,
+			payment_method TEXT NOT NULL DEFAULT 'bank',
+			description TEXT NOT NULL DEFAULT '',
+			start_date TEXT NOT NULL,
+			payment_day INTEGER NOT NULL DEFAULT 0,
+			duration_months INTEGER NOT NULL DEFAULT 0,
+			regularity TEXT NOT NULL DEFAULT 'monthly',
+			business_day_adjustment TEXT NOT NULL DEFAULT '',
+			posting_mode TEXT NOT NULL DEFAULT '',
+			active BOOLEAN NOT NULL DEFAULT 1,
+			generated_through TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		// One row per template and date: the unique key is what keeps a catch-up run, a retry
+		// or a second instance from posting the same occurrence twice
+		`CREATE TABLE IF NOT EXISTS recurring_occurrences (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			template_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			occurrence_key TEXT NOT NULL,
+			due_date TEXT NOT NULL,
+			amount REAL NOT NULL,
+			payment_method TEXT NOT NULL,
+			status TEXT NOT NULL,
+			transaction_id INTEGER,
+			posted_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(template_id, occurrence_key),
+			FOREIGN KEY (template_id) REFERENCES recurring_templates (id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_recurring_occurrences_user_status ON recurring_occurrences(user_id, status)`,
+		`CREATE TABLE IF NOT EXISTS recurring_preferences (
+			user_id TEXT PRIMARY KEY,
+			posting_mode TEXT NOT NULL DEFAULT 'auto',
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	http.HandleFunc("/recurring", corsMiddleware(handleFetchTemplates))
+	http.HandleFunc("/recurring/add", corsMiddleware(common.WithIdempotency(db, handleAddTemplate)))
+	http.HandleFunc("/recurring/update", corsMiddleware(common.WithIdempotency(db, handleUpdateTemplate)))
+	http.HandleFunc("/recurring/delete", corsMiddleware(common.WithIdempotency(db, handleDeleteTemplate)))
+	http.HandleFunc("/recurring/occurrences", corsMiddleware(handleFetchOccurrences))
+	http.HandleFunc("/recurring/confirm", corsMiddleware(common.WithIdempotency(db, handleConfirmOccurrence)))
+	http.HandleFunc("/recurring/skip", corsMiddleware(common.WithIdempotency(db, handleSkipOccurrence)))
+	http.HandleFunc("/recurring/preferences", corsMiddleware(handlePreferences))
+	http.HandleFunc("/health", corsMiddleware(handleHealth))
+
+	// Catches up on start, then posts occurrences as their dates arrive
+	go runScheduler(context.Background(), schedulerInterval)
+
+	port := 8100
+	log.Printf("Recurring Bills Management service started on :%d", port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+}
+
+func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	sendSuccessResponse(w, "Recurring Bills Management service is running", nil)
+}
+
+func sendSuccessResponse(w http.ResponseWriter, message string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ApiResponse{
+		Success: true,
+		Message: message,
+		Data:    data,
+	})
+}
+
+func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ApiResponse{
+		Success: false,
+		Message: message,
+	})
+}
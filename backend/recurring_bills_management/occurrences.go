@@ -0,0 +1,377 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+// How many days ahead the occurrences endpoint lists scheduled dates by default
+const defaultUpcomingDays = 30
+
+var (
+	errOccurrencePosted        = errors.New("occurrence has already been posted")
+	errOccurrenceNotInSchedule = errors.New("date is not an occurrence of the template")
+)
+
+type ConfirmOccurrenceRequest struct {
+	UserID        string  `json:"user_id"`
+	OccurrenceID  int64   `json:"occurrence_id"`
+	Amount        float64 `json:"amount"`         // Optional, the template amount otherwise
+	Date          string  `json:"date"`           // Optional, the occurrence date otherwise
+	PaymentMethod string  `json:"payment_method"` // Optional, the template method otherwise
+}
+
+// SkipOccurrenceRequest identifies the occurrence either by ID, once the scheduler has
+// created it, or by template and occurrence key to skip a date in advance
+type SkipOccurrenceRequest struct {
+	UserID        string `json:"user_id"`
+	OccurrenceID  int64  `json:"occurrence_id"`
+	TemplateID    int    `json:"template_id"`
+	OccurrenceKey string `json:"occurrence_key"`
+}
+
+type Preferences struct {
+	UserID      string `json:"user_id"`
+	PostingMode string `json:"posting_mode"`
+}
+
+// fetchOccurrence loads an occurrence together with the type and name of its template
+func fetchOccurrence(q common.DBTX, occurrenceID int64, userID string) (Occurrence, error) {
+	var o Occurrence
+	err := q.QueryRow(`
+		SELECT o.id, o.template_id, o.user_id, o.occurrence_key, o.due_date, t.type, t.name, o.amount,
+		       o.payment_method, o.status, COALESCE(o.transaction_id, 0), COALESCE(o.posted_at, '')
+		FROM recurring_occurrences o
+		JOIN recurring_templates t ON t.id = o.template_id
+		WHERE o.id = ? AND o.user_id = ?
+	`, occurrenceID, userID).Scan(&o.ID, &o.TemplateID, &o.UserID, &o.Key, &o.DueDate, &o.Type, &o.Name,
+		&o.Amount, &o.PaymentMethod, &o.Status, &o.TransactionID, &o.PostedAt)
+	return o, err
+}
+
+// handleFetchOccurrences lists the occurrences the scheduler has created, optionally filtered
+// by status or template, followed by the dates still to come in the next `days` days
+func handleFetchOccurrences(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	templateID, _ := strconv.Atoi(r.URL.Query().Get("template_id"))
+	days := defaultUpcomingDays
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			sendErrorResponse(w, "Days must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+
+	query := `
+		SELECT o.id, o.template_id, o.user_id, o.occurrence_key, o.due_date, t.type, t.name, o.amount,
+		       o.payment_method, o.status, COALESCE(o.transaction_id, 0), COALESCE(o.posted_at, '')
+		FROM recurring_occurrences o
+		JOIN recurring_templates t ON t.id = o.template_id
+		WHERE o.user_id = ?`
+	args := []interface{}{userID}
+	if status != "" && status != StatusScheduled {
+		query += ` AND o.status = ?`
+		args = append(args, status)
+	}
+	if templateID > 0 {
+		query += ` AND o.template_id = ?`
+		args = append(args, templateID)
+	}
+
+	occurrences := []Occurrence{}
+	stored := make(map[string]bool)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error fetching occurrences: %v", err)
+		sendErrorResponse(w, "Error fetching occurrences", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o Occurrence
+		if err := rows.Scan(&o.ID, &o.TemplateID, &o.UserID, &o.Key, &o.DueDate, &o.Type, &o.Name, &o.Amount,
+			&o.PaymentMethod, &o.Status, &o.TransactionID, &o.PostedAt); err != nil {
+			log.Printf("Error scanning occurrence: %v", err)
+			sendErrorResponse(w, "Error fetching occurrences", http.StatusInternalServerError)
+			return
+		}
+		stored[fmt.Sprintf("%d/%s", o.TemplateID, o.Key)] = true
+		if status != StatusScheduled {
+			occurrences = append(occurrences, o)
+		}
+	}
+
+	// Dates the scheduler has not reached yet are computed, not stored
+	if status == "" || status == StatusScheduled {
+		templates, err := fetchTemplates(db, userID, true)
+		if err != nil {
+			log.Printf("Error fetching recurring templates: %v", err)
+			sendErrorResponse(w, "Error fetching occurrences", http.StatusInternalServerError)
+			return
+		}
+		today, _ := time.Parse("2006-01-02", common.UserToday(db, userID))
+		for _, template := range templates {
+			if templateID > 0 && template.ID != templateID {
+				continue
+			}
+			schedule, err := templateSchedule(template)
+			if err != nil {
+				continue
+			}
+			for _, occurrence := range schedule.Occurrences(today, today.AddDate(0, 0, days)) {
+				if stored[fmt.Sprintf("%d/%s", template.ID, occurrence.Key)] {
+					continue
+				}
+				occurrences = append(occurrences, Occurrence{
+					TemplateID:    template.ID,
+					UserID:        userID,
+					Key:           occurrence.Key,
+					DueDate:       occurrence.DateString(),
+					Type:          template.Type,
+					Name:          template.Name,
+					Amount:        template.Amount,
+					PaymentMethod: template.PaymentMethod,
+					Status:        StatusScheduled,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].DueDate < occurrences[j].DueDate
+	})
+
+	sendSuccessResponse(w, "Occurrences fetched successfully", occurrences)
+}
+
+// handleConfirmOccurrence posts a queued occurrence, optionally with a different amount,
+// date or payment method than the template
+func handleConfirmOccurrence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ConfirmOccurrenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" || req.OccurrenceID <= 0 {
+		sendErrorResponse(w, "User ID and occurrence ID are required", http.StatusBadRequest)
+		return
+	}
+	if req.Amount < 0 {
+		sendErrorResponse(w, "Amount must be greater than 0", http.StatusBadRequest)
+		return
+	}
+	if req.Date != "" {
+		if _, err := time.Parse("2006-01-02", req.Date); err != nil {
+			sendErrorResponse(w, "Date must be in YYYY-MM-DD format", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.PaymentMethod != "" && req.PaymentMethod != "cash" && req.PaymentMethod != "bank" {
+		sendErrorResponse(w, "Payment method must be 'cash' or 'bank'", http.StatusBadRequest)
+		return
+	}
+
+	var occurrence Occurrence
+	err := common.WithTx(db, func(tx *sql.Tx) error {
+		var err error
+		occurrence, err = fetchOccurrence(tx, req.OccurrenceID, req.UserID)
+		if err != nil {
+			return err
+		}
+		template, err := fetchTemplateByID(tx, occurrence.TemplateID, req.UserID)
+		if err != nil {
+			return err
+		}
+
+		date, amount, paymentMethod := occurrence.DueDate, occurrence.Amount, occurrence.PaymentMethod
+		if req.Date != "" {
+			date = req.Date
+		}
+		if req.Amount > 0 {
+			amount = req.Amount
+		}
+		if req.PaymentMethod != "" {
+			paymentMethod = req.PaymentMethod
+		}
+		if _, err := postOccurrence(tx, template, occurrence.ID, date, amount, paymentMethod); err != nil {
+			return err
+		}
+		occurrence, err = fetchOccurrence(tx, req.OccurrenceID, req.UserID)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Occurrence not found", http.StatusNotFound)
+		return
+	}
+	if err == errOccurrenceNotQueued {
+		sendErrorResponse(w, "Occurrence has already been posted or skipped", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error confirming occurrence: %v", err)
+		sendErrorResponse(w, "Error confirming occurrence", common.TxErrorStatus(err))
+		return
+	}
+
+	sendSuccessResponse(w, "Occurrence posted successfully", occurrence)
+}
+
+// handleSkipOccurrence skips a single date of a template, whether it is queued for
+// confirmation or still to come. Posted occurrences have to be deleted as transactions instead.
+func handleSkipOccurrence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SkipOccurrenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if req.OccurrenceID <= 0 && (req.TemplateID <= 0 || req.OccurrenceKey == "") {
+		sendErrorResponse(w, "Occurrence ID, or template ID and occurrence key, are required", http.StatusBadRequest)
+		return
+	}
+
+	var occurrence Occurrence
+	err := common.WithTx(db, func(tx *sql.Tx) error {
+		occurrenceID := req.OccurrenceID
+		if occurrenceID <= 0 {
+			template, err := fetchTemplateByID(tx, req.TemplateID, req.UserID)
+			if err != nil {
+				return err
+			}
+			schedule, err := templateSchedule(template)
+			if err != nil {
+				return err
+			}
+			scheduled, ok := schedule.Find(req.OccurrenceKey)
+			if !ok {
+				return errOccurrenceNotInSchedule
+			}
+
+			// A date ahead of the scheduler gets its row now, so the scheduler leaves it alone
+			_, err = tx.Exec(`
+				INSERT OR IGNORE INTO recurring_occurrences
+					(template_id, user_id, occurrence_key, due_date, amount, payment_method, status)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+			`, template.ID, template.UserID, scheduled.Key, scheduled.DateString(), template.Amount,
+				template.PaymentMethod, StatusSkipped)
+			if err != nil {
+				return fmt.Errorf("error creating occurrence: %v", err)
+			}
+			err = tx.QueryRow(`SELECT id FROM recurring_occurrences WHERE template_id = ? AND occurrence_key = ?`,
+				template.ID, scheduled.Key).Scan(&occurrenceID)
+			if err != nil {
+				return fmt.Errorf("error fetching occurrence: %v", err)
+			}
+		}
+
+		var err error
+		occurrence, err = fetchOccurrence(tx, occurrenceID, req.UserID)
+		if err != nil {
+			return err
+		}
+		if occurrence.Status == StatusPosted {
+			return errOccurrencePosted
+		}
+		if _, err := tx.Exec(`UPDATE recurring_occurrences SET status = ? WHERE id = ?`, StatusSkipped, occurrence.ID); err != nil {
+			return fmt.Errorf("error skipping occurrence: %v", err)
+		}
+		occurrence.Status = StatusSkipped
+		return nil
+	})
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Occurrence not found", http.StatusNotFound)
+		return
+	}
+	if err == errOccurrenceNotInSchedule {
+		sendErrorResponse(w, "Occurrence key is not a date of the template", http.StatusBadRequest)
+		return
+	}
+	if err == errOccurrencePosted {
+		sendErrorResponse(w, "Occurrence has already been posted", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error skipping occurrence: %v", err)
+		sendErrorResponse(w, "Error skipping occurrence", common.TxErrorStatus(err))
+		return
+	}
+
+	sendSuccessResponse(w, "Occurrence skipped successfully", occurrence)
+}
+
+// handlePreferences reads (GET) or sets (POST) whether the user's templates without their own
+// posting mode are auto-posted or queued for confirmation
+func handlePreferences(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		userID := r.URL.Query().Get("user_id")
+		if userID == "" {
+			sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+			return
+		}
+		mode, err := userPostingMode(db, userID)
+		if err != nil {
+			log.Printf("Error fetching preferences: %v", err)
+			sendErrorResponse(w, "Error fetching preferences", http.StatusInternalServerError)
+			return
+		}
+		sendSuccessResponse(w, "Preferences fetched successfully", Preferences{UserID: userID, PostingMode: mode})
+
+	case "POST":
+		var req Preferences
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.UserID == "" {
+			sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+			return
+		}
+		if req.PostingMode != PostingAuto && req.PostingMode != PostingConfirm {
+			sendErrorResponse(w, "Posting mode must be 'auto' or 'confirm'", http.StatusBadRequest)
+			return
+		}
+		_, err := db.Exec(`
+			INSERT INTO recurring_preferences (user_id, posting_mode) VALUES (?, ?)
+			ON CONFLICT(user_id) DO UPDATE SET posting_mode = excluded.posting_mode, updated_at = CURRENT_TIMESTAMP
+		`, req.UserID, req.PostingMode)
+		if err != nil {
+			log.Printf("Error saving preferences: %v", err)
+			sendErrorResponse(w, "Error saving preferences", http.StatusInternalServerError)
+			return
+		}
+		sendSuccessResponse(w, "Preferences saved successfully", req)
+
+	default:
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
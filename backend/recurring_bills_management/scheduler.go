@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+// How often the scheduler looks for occurrences whose date has arrived
+const schedulerInterval = 15 * time.Minute
+
+// errOccurrenceNotQueued is returned when an occurrence was already posted or skipped
+var errOccurrenceNotQueued = errors.New("occurrence is not waiting for confirmation")
+
+// runScheduler generates due occurrences every interval until ctx is cancelled. The first
+// pass runs immediately, so occurrences missed while the service was down are caught up on start.
+func runScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := runDueOccurrences(db); err != nil {
+			log.Printf("Error running recurring scheduler: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runDueOccurrences generates the due occurrences of every active template, each template in
+// its own transaction so that one failing template does not hold back the others
+func runDueOccurrences(db *sql.DB) error {
+	templates, err := fetchTemplates(db, "", true)
+	if err != nil {
+		return err
+	}
+
+	for _, template := range templates {
+		var generated int
+		err := common.WithTx(db, func(tx *sql.Tx) error {
+			today, _ := time.Parse("2006-01-02", common.UserToday(tx, template.UserID))
+			var err error
+			generated, err = generateOccurrences(tx, template, today)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error generating occurrences of recurring template %d: %v", template.ID, err)
+			continue
+		}
+		if generated > 0 {
+			log.Printf("Recurring template %d: generated %d occurrences", template.ID, generated)
+		}
+	}
+	return nil
+}
+
+// generateOccurrences creates every occurrence of the template due on or before today that
+// has no row yet, posting it or queueing it for confirmation, and records how far it got.
+// Dates since generated_through are looked at again, but an occurrence that already has a
+// row (posted, queued or skipped) is never touched, so re-running it cannot post twice.
+func generateOccurrences(q common.DBTX, template Template, today time.Time) (int, error) {
+	schedule, err := templateSchedule(template)
+	if err != nil {
+		return 0, err
+	}
+	var from time.Time
+	if template.GeneratedThrough != "" {
+		from, _ = time.Parse("2006-01-02", template.GeneratedThrough)
+	}
+	mode, err := effectivePostingMode(q, template)
+	if err != nil {
+		return 0, err
+	}
+
+	generated := 0
+	for _, occurrence := range schedule.Occurrences(from, today) {
+		result, err := q.Exec(`
+			INSERT OR IGNORE INTO recurring_occurrences
+				(template_id, user_id, occurrence_key, due_date, amount, payment_method, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, template.ID, template.UserID, occurrence.Key, occurrence.DateString(), template.Amount,
+			template.PaymentMethod, StatusQueued)
+		if err != nil {
+			return generated, fmt.Errorf("error creating occurrence %s: %v", occurrence.Key, err)
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			continue
+		}
+		generated++
+
+		if mode == PostingAuto {
+			occurrenceID, err := result.LastInsertId()
+			if err != nil {
+				return generated, fmt.Errorf("error getting occurrence ID: %v", err)
+			}
+			if _, err := postOccurrence(q, template, occurrenceID, occurrence.DateString(), template.Amount, template.PaymentMethod); err != nil {
+				return generated, err
+			}
+		}
+	}
+
+	_, err = q.Exec(`UPDATE recurring_templates SET generated_through = ? WHERE id = ?`,
+		today.Format("2006-01-02"), template.ID)
+	if err != nil {
+		return generated, fmt.Errorf("error saving scheduler position: %v", err)
+	}
+	return generated, nil
+}
+
+// postOccurrence turns a queued occurrence into an income or expense and updates the
+// balances. The status change comes first and only applies to a queued row, so two requests
+// confirming the same occurrence cannot both post it.
+func postOccurrence(q common.DBTX, template Template, occurrenceID int64, date string, amount float64, paymentMethod string) (int64, error) {
+	entryDate, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 0, fmt.Errorf("invalid occurrence date %q", date)
+	}
+
+	result, err := q.Exec(`
+		UPDATE recurring_occurrences
+		SET status = ?, due_date = ?, amount = ?, payment_method = ?, posted_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = ?
+	`, StatusPosted, date, amount, paymentMethod, occurrenceID, StatusQueued)
+	if err != nil {
+		return 0, fmt.Errorf("error updating occurrence: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return 0, errOccurrenceNotQueued
+	}
+
+	table, source, kind, event := "incomes", common.LedgerSourceIncome, common.LedgerIncome, common.EventIncomeCreated
+	if template.Type == "expense" {
+		table, source, kind, event = "expenses", common.LedgerSourceExpense, common.LedgerExpense, common.EventExpenseCreated
+	}
+	description := template.Description
+	if description == "" {
+		description = template.Name
+	}
+
+	result, err = q.Exec(fmt.Sprintf(`
+		INSERT INTO %s (user_id, amount, date, category, payment_method, description)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, table), template.UserID, amount, date, template.Category, paymentMethod, description)
+	if err != nil {
+		return 0, fmt.Errorf("error creating %s: %v", template.Type, err)
+	}
+	transactionID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error getting %s ID: %v", template.Type, err)
+	}
+	if _, err := q.Exec(`UPDATE recurring_occurrences SET transaction_id = ? WHERE id = ?`, transactionID, occurrenceID); err != nil {
+		return 0, fmt.Errorf("error linking occurrence: %v", err)
+	}
+
+	err = common.ReplaceLedgerEntries(q, template.UserID, source, transactionID, common.LedgerEntry{
+		Date: entryDate, Kind: kind, PaymentMethod: paymentMethod, Amount: amount,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error updating balances: %v", err)
+	}
+
+	return transactionID, common.PublishEvent(q, event, template.UserID, transactionID, map[string]interface{}{
+		"amount":                amount,
+		"date":                  date,
+		"category":              template.Category,
+		"payment_method":        paymentMethod,
+		"description":           description,
+		"recurring_template_id": template.ID,
+		"occurrence_id":         occurrenceID,
+	})
+}
+
+// templateSchedule builds the recurrence of a template
+func templateSchedule(template Template) (common.Schedule, error) {
+	return common.BillSchedule(template.StartDate, template.PaymentDay, template.DurationMonths,
+		template.Regularity, template.BusinessDayAdjustment)
+}
+
+// effectivePostingMode is the template's posting mode, or the user's preference when the
+// template has none. Users without a preference get their occurrences auto-posted.
+func effectivePostingMode(q common.DBTX, template Template) (string, error) {
+	if template.PostingMode != "" {
+		return template.PostingMode, nil
+	}
+	return userPostingMode(q, template.UserID)
+}
+
+func userPostingMode(q common.DBTX, userID string) (string, error) {
+	var mode string
+	err := q.QueryRow(`SELECT posting_mode FROM recurring_preferences WHERE user_id = ?`, userID).Scan(&mode)
+	if err == sql.ErrNoRows {
+		return PostingAuto, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error fetching posting preference: %v", err)
+	}
+	return mode, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+func setupSchedulerDB(t *testing.T) *sql.DB {
+	t.Helper()
+	testDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+
+	var statements []string
+	for _, table := range []string{"incomes", "expenses"} {
+		statements = append(statements, fmt.Sprintf(`CREATE TABLE %s (id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT, amount REAL, date TEXT, category TEXT, payment_method TEXT, description TEXT)`, table))
+	}
+	for _, pt := range common.PeriodTables {
+		extra := ""
+		if pt.Period == "weekly" {
+			extra = "start_date TEXT NOT NULL, end_date TEXT NOT NULL,"
+		}
+		statements = append(statements, fmt.Sprintf(`CREATE TABLE %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT NOT NULL, %s TEXT NOT NULL, %s
+			income_cash_amount REAL DEFAULT 0, income_bank_amount REAL DEFAULT 0,
+			expense_cash_amount REAL DEFAULT 0, expense_bank_amount REAL DEFAULT 0,
+			bill_cash_amount REAL DEFAULT 0, bill_bank_amount REAL DEFAULT 0,
+			cash_amount REAL DEFAULT 0, bank_amount REAL DEFAULT 0,
+			previous_cash_amount REAL DEFAULT 0, previous_bank_amount REAL DEFAULT 0,
+			balance_cash_amount REAL DEFAULT 0, balance_bank_amount REAL DEFAULT 0,
+			total_previous_balance REAL DEFAULT 0, total_balance REAL DEFAULT 0,
+			updated_at TIMESTAMP, UNIQUE(user_id, %s))`, pt.Table, pt.Column, extra, pt.Column))
+	}
+	for _, statement := range statements {
+		if _, err := testDB.Exec(statement); err != nil {
+			t.Fatalf("Failed to create schema: %v", err)
+		}
+	}
+	if err := createTablesIfNotExist(testDB); err != nil {
+		t.Fatalf("Failed to create recurring tables: %v", err)
+	}
+	if err := common.EnsurePeriodSettingsTable(testDB); err != nil {
+		t.Fatalf("Failed to create ledger: %v", err)
+	}
+	if err := common.EnsureOutboxTable(testDB); err != nil {
+		t.Fatalf("Failed to create outbox: %v", err)
+	}
+	return testDB
+}
+
+func addTestTemplate(t *testing.T, testDB *sql.DB, postingMode string) Template {
+	t.Helper()
+	result, err := testDB.Exec(`
+		INSERT INTO recurring_templates (user_id, type, name, amount, category, payment_method, start_date,
+			payment_day, regularity, posting_mode)
+		VALUES ('1', 'expense', 'Gym', 30, 'Sports', 'bank', '2025-01-31', -1, 'monthly', ?)
+	`, postingMode)
+	if err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	template, err := fetchTemplateByID(testDB, int(id), "1")
+	if err != nil {
+		t.Fatalf("Failed to fetch template: %v", err)
+	}
+	return template
+}
+
+// runUntil runs the scheduler for the template as if today were the given date
+func runUntil(t *testing.T, testDB *sql.DB, templateID int, today string) int {
+	t.Helper()
+	date, _ := time.Parse("2006-01-02", today)
+	var generated int
+	err := common.WithTx(testDB, func(tx *sql.Tx) error {
+		template, err := fetchTemplateByID(tx, templateID, "1")
+		if err != nil {
+			return err
+		}
+		generated, err = generateOccurrences(tx, template, date)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to run scheduler: %v", err)
+	}
+	return generated
+}
+
+func TestSchedulerCatchesUpWithoutDoublePosting(t *testing.T) {
+	db = setupSchedulerDB(t)
+	template := addTestTemplate(t, db, PostingAuto)
+
+	// After downtime every missed month is posted once, on its own date
+	if generated := runUntil(t, db, template.ID, "2025-04-15"); generated != 3 {
+		t.Fatalf("Expected 3 occurrences, got %d", generated)
+	}
+	if generated := runUntil(t, db, template.ID, "2025-04-15"); generated != 0 {
+		t.Errorf("Expected a second run to generate nothing, got %d", generated)
+	}
+	var dates string
+	db.QueryRow(`SELECT GROUP_CONCAT(date, ' ') FROM (SELECT date FROM expenses ORDER BY date)`).Scan(&dates)
+	if dates != "2025-01-31 2025-02-28 2025-03-31" {
+		t.Errorf("Expected expenses on the last day of each month, got %s", dates)
+	}
+	var ledgerTotal float64
+	db.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM balance_ledger WHERE source_type = ?`, common.LedgerSourceExpense).Scan(&ledgerTotal)
+	if ledgerTotal != 90 {
+		t.Errorf("Expected 90 in the ledger, got %.2f", ledgerTotal)
+	}
+
+	// A date skipped in advance is not posted when it arrives
+	body, _ := json.Marshal(SkipOccurrenceRequest{UserID: "1", TemplateID: template.ID, OccurrenceKey: "2025-04"})
+	rr := httptest.NewRecorder()
+	handleSkipOccurrence(rr, httptest.NewRequest("POST", "/recurring/skip", bytes.NewBuffer(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the skip to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	runUntil(t, db, template.ID, "2025-05-31")
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM expenses`).Scan(&count)
+	if count != 4 {
+		t.Errorf("Expected April to be skipped and May posted, got %d expenses", count)
+	}
+
+	// Posted occurrences cannot be skipped
+	body, _ = json.Marshal(SkipOccurrenceRequest{UserID: "1", TemplateID: template.ID, OccurrenceKey: "2025-05"})
+	rr = httptest.NewRecorder()
+	handleSkipOccurrence(rr, httptest.NewRequest("POST", "/recurring/skip", bytes.NewBuffer(body)))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 skipping a posted occurrence, got %d", rr.Code)
+	}
+}
+
+func TestSchedulerQueuesOccurrencesForConfirmation(t *testing.T) {
+	db = setupSchedulerDB(t)
+	template := addTestTemplate(t, db, PostingConfirm)
+
+	runUntil(t, db, template.ID, "2025-02-28")
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM expenses`).Scan(&count)
+	if count != 0 {
+		t.Fatalf("Expected nothing posted before confirmation, got %d expenses", count)
+	}
+
+	var occurrenceID int64
+	db.QueryRow(`SELECT id FROM recurring_occurrences WHERE occurrence_key = '2025-01' AND status = ?`, StatusQueued).Scan(&occurrenceID)
+	confirm := func() int {
+		body, _ := json.Marshal(ConfirmOccurrenceRequest{UserID: "1", OccurrenceID: occurrenceID, Amount: 35})
+		rr := httptest.NewRecorder()
+		handleConfirmOccurrence(rr, httptest.NewRequest("POST", "/recurring/confirm", bytes.NewBuffer(body)))
+		return rr.Code
+	}
+	if code := confirm(); code != http.StatusOK {
+		t.Fatalf("Expected the confirmation to succeed, got %d", code)
+	}
+	if code := confirm(); code != http.StatusConflict {
+		t.Errorf("Expected 409 confirming twice, got %d", code)
+	}
+	var amount float64
+	db.QueryRow(`SELECT COUNT(*), SUM(amount) FROM expenses`).Scan(&count, &amount)
+	if count != 1 || amount != 35 {
+		t.Errorf("Expected one expense of 35, got %d totalling %.2f", count, amount)
+	}
+}
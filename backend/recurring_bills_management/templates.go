@@ -0,0 +1,422 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+type AddTemplateRequest struct {
+	UserID                string  `json:"user_id"`
+	Type                  string  `json:"type"`
+	Name                  string  `json:"name"`
+	Amount                float64 `json:"amount"`
+	Category              string  `json:"category"`
+	PaymentMethod         string  `json:"payment_method"`
+	Description           string  `json:"description"`
+	StartDate             string  `json:"start_date"`
+	PaymentDay            int     `json:"payment_day"`
+	DurationMonths        int     `json:"duration_months"`
+	Regularity            string  `json:"regularity"`
+	BusinessDayAdjustment string  `json:"business_day_adjustment"`
+	PostingMode           string  `json:"posting_mode"`
+	// Backfill posts the occurrences between a past start date and today. Without it the
+	// template starts with today's occurrence, so back-dating a salary does not post years of it.
+	Backfill bool `json:"backfill"`
+}
+
+type UpdateTemplateRequest struct {
+	UserID                string  `json:"user_id"`
+	TemplateID            int     `json:"template_id"`
+	Name                  string  `json:"name"`
+	Amount                float64 `json:"amount"`
+	Category              string  `json:"category"`
+	PaymentMethod         string  `json:"payment_method"`
+	Description           *string `json:"description"`
+	StartDate             string  `json:"start_date"`
+	PaymentDay            int     `json:"payment_day"`
+	DurationMonths        int     `json:"duration_months"`
+	OpenEnded             bool    `json:"open_ended"`
+	Regularity            string  `json:"regularity"`
+	BusinessDayAdjustment *string `json:"business_day_adjustment"`
+	PostingMode           *string `json:"posting_mode"`
+	Active                *bool   `json:"active"`
+}
+
+type DeleteTemplateRequest struct {
+	UserID     string `json:"user_id"`
+	TemplateID int    `json:"template_id"`
+}
+
+const templateColumns = `
+	id, user_id, type, name, amount, category, payment_method, description, start_date,
+	payment_day, duration_months, regularity, business_day_adjustment, posting_mode, active,
+	COALESCE(generated_through, ''), created_at, updated_at`
+
+func scanTemplate(row interface{ Scan(...interface{}) error }) (Template, error) {
+	var t Template
+	err := row.Scan(&t.ID, &t.UserID, &t.Type, &t.Name, &t.Amount, &t.Category, &t.PaymentMethod,
+		&t.Description, &t.StartDate, &t.PaymentDay, &t.DurationMonths, &t.Regularity,
+		&t.BusinessDayAdjustment, &t.PostingMode, &t.Active, &t.GeneratedThrough, &t.CreatedAt, &t.UpdatedAt)
+	return t, err
+}
+
+// fetchTemplates returns the templates of a user, or of every user when userID is empty
+func fetchTemplates(q common.DBTX, userID string, activeOnly bool) ([]Template, error) {
+	query := `SELECT ` + templateColumns + ` FROM recurring_templates WHERE 1 = 1`
+	var args []interface{}
+	if userID != "" {
+		query += ` AND user_id = ?`
+		args = append(args, userID)
+	}
+	if activeOnly {
+		query += ` AND active = 1`
+	}
+	rows, err := q.Query(query+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching recurring templates: %v", err)
+	}
+	defer rows.Close()
+
+	templates := []Template{}
+	for rows.Next() {
+		template, err := scanTemplate(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning recurring template: %v", err)
+		}
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+func fetchTemplateByID(q common.DBTX, templateID int, userID string) (Template, error) {
+	return scanTemplate(q.QueryRow(`SELECT `+templateColumns+` FROM recurring_templates WHERE id = ? AND user_id = ?`,
+		templateID, userID))
+}
+
+// validateTemplate checks the fields shared by add and update, including that the schedule parses
+func validateTemplate(t Template) error {
+	if t.Type != "income" && t.Type != "expense" {
+		return fmt.Errorf("Type must be 'income' or 'expense'")
+	}
+	if t.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+	if t.Amount <= 0 {
+		return fmt.Errorf("Amount must be greater than 0")
+	}
+	if t.Category == "" {
+		return fmt.Errorf("Category is required")
+	}
+	if t.PaymentMethod != "cash" && t.PaymentMethod != "bank" {
+		return fmt.Errorf("Payment method must be 'cash' or 'bank'")
+	}
+	if t.PostingMode != "" && t.PostingMode != PostingAuto && t.PostingMode != PostingConfirm {
+		return fmt.Errorf("Posting mode must be 'auto' or 'confirm'")
+	}
+	if _, err := templateSchedule(t); err != nil {
+		return fmt.Errorf("Invalid schedule: %v", err)
+	}
+	return nil
+}
+
+// withNextDate fills in the first date after today the template will post on
+func withNextDate(q common.DBTX, template Template) Template {
+	if !template.Active {
+		return template
+	}
+	schedule, err := templateSchedule(template)
+	if err != nil {
+		return template
+	}
+	today, _ := time.Parse("2006-01-02", common.UserToday(q, template.UserID))
+	if next, ok := schedule.Next(today); ok {
+		template.NextDate = next.DateString()
+	}
+	return template
+}
+
+func handleFetchTemplates(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	templates, err := fetchTemplates(db, userID, false)
+	if err != nil {
+		log.Printf("Error fetching recurring templates: %v", err)
+		sendErrorResponse(w, "Error fetching recurring templates", http.StatusInternalServerError)
+		return
+	}
+	for i := range templates {
+		templates[i] = withNextDate(db, templates[i])
+	}
+
+	sendSuccessResponse(w, "Recurring templates fetched successfully", templates)
+}
+
+func handleAddTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AddTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	today, _ := time.Parse("2006-01-02", common.UserToday(db, req.UserID))
+	template := Template{
+		UserID:                req.UserID,
+		Type:                  req.Type,
+		Name:                  req.Name,
+		Amount:                req.Amount,
+		Category:              req.Category,
+		PaymentMethod:         req.PaymentMethod,
+		Description:           req.Description,
+		StartDate:             req.StartDate,
+		PaymentDay:            req.PaymentDay,
+		DurationMonths:        req.DurationMonths,
+		Regularity:            req.Regularity,
+		BusinessDayAdjustment: req.BusinessDayAdjustment,
+		PostingMode:           req.PostingMode,
+		Active:                true,
+	}
+	if template.PaymentMethod == "" {
+		template.PaymentMethod = "bank"
+	}
+	if template.StartDate == "" {
+		template.StartDate = today.Format("2006-01-02")
+	}
+	if template.Regularity == "" {
+		template.Regularity = "monthly"
+	}
+	if template.DurationMonths < 0 {
+		sendErrorResponse(w, "Duration months cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if err := validateTemplate(template); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Occurrences before today are left out unless a backfill was asked for; the scheduler
+	// looks at generated_through inclusively, so today's occurrence is still posted
+	var generatedThrough interface{}
+	if !req.Backfill && template.StartDate < today.Format("2006-01-02") {
+		generatedThrough = today.Format("2006-01-02")
+	}
+
+	err := common.WithTx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(`
+			INSERT INTO recurring_templates (user_id, type, name, amount, category, payment_method, description,
+				start_date, payment_day, duration_months, regularity, business_day_adjustment, posting_mode,
+				generated_through)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, template.UserID, template.Type, template.Name, template.Amount, template.Category,
+			template.PaymentMethod, template.Description, template.StartDate, template.PaymentDay,
+			template.DurationMonths, template.Regularity, template.BusinessDayAdjustment,
+			template.PostingMode, generatedThrough)
+		if err != nil {
+			return fmt.Errorf("error creating recurring template: %v", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("error getting recurring template ID: %v", err)
+		}
+
+		// Anything already due is posted or queued right away instead of on the next tick
+		template, err = fetchTemplateByID(tx, int(id), template.UserID)
+		if err != nil {
+			return err
+		}
+		if _, err := generateOccurrences(tx, template, today); err != nil {
+			return err
+		}
+		template, err = fetchTemplateByID(tx, int(id), template.UserID)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error adding recurring template: %v", err)
+		sendErrorResponse(w, "Error adding recurring template", common.TxErrorStatus(err))
+		return
+	}
+
+	sendSuccessResponse(w, "Recurring template added successfully", withNextDate(db, template))
+}
+
+func handleUpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req UpdateTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	if req.TemplateID <= 0 {
+		sendErrorResponse(w, "Valid template ID is required", http.StatusBadRequest)
+		return
+	}
+
+	template, err := fetchTemplateByID(db, req.TemplateID, req.UserID)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, "Recurring template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching recurring template: %v", err)
+		sendErrorResponse(w, "Error fetching recurring template", http.StatusInternalServerError)
+		return
+	}
+	wasActive := template.Active
+
+	// Only overwrite the fields provided in the request
+	if req.Name != "" {
+		template.Name = req.Name
+	}
+	if req.Amount > 0 {
+		template.Amount = req.Amount
+	}
+	if req.Category != "" {
+		template.Category = req.Category
+	}
+	if req.PaymentMethod != "" {
+		template.PaymentMethod = req.PaymentMethod
+	}
+	if req.Description != nil {
+		template.Description = *req.Description
+	}
+	if req.StartDate != "" {
+		template.StartDate = req.StartDate
+	}
+	if req.PaymentDay != 0 {
+		template.PaymentDay = req.PaymentDay
+	}
+	if req.DurationMonths > 0 {
+		template.DurationMonths = req.DurationMonths
+	}
+	if req.OpenEnded {
+		template.DurationMonths = 0
+	}
+	if req.Regularity != "" {
+		template.Regularity = req.Regularity
+	}
+	if req.BusinessDayAdjustment != nil {
+		template.BusinessDayAdjustment = *req.BusinessDayAdjustment
+	}
+	if req.PostingMode != nil {
+		template.PostingMode = *req.PostingMode
+	}
+	if req.Active != nil {
+		template.Active = *req.Active
+	}
+	if err := validateTemplate(template); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Resuming a paused template does not post the dates it was paused for
+	today, _ := time.Parse("2006-01-02", common.UserToday(db, template.UserID))
+	if template.Active && !wasActive {
+		template.GeneratedThrough = today.Format("2006-01-02")
+	}
+
+	err = common.WithTx(db, func(tx *sql.Tx) error {
+		// Changes apply to occurrences from now on: posted and queued ones keep their values
+		_, err := tx.Exec(`
+			UPDATE recurring_templates
+			SET name = ?, amount = ?, category = ?, payment_method = ?, description = ?, start_date = ?,
+				payment_day = ?, duration_months = ?, regularity = ?, business_day_adjustment = ?,
+				posting_mode = ?, active = ?, generated_through = NULLIF(?, ''), updated_at = CURRENT_TIMESTAMP
+			WHERE id = ? AND user_id = ?
+		`, template.Name, template.Amount, template.Category, template.PaymentMethod, template.Description,
+			template.StartDate, template.PaymentDay, template.DurationMonths, template.Regularity,
+			template.BusinessDayAdjustment, template.PostingMode, template.Active, template.GeneratedThrough,
+			template.ID, template.UserID)
+		if err != nil {
+			return fmt.Errorf("error updating recurring template: %v", err)
+		}
+
+		if template.Active {
+			if _, err := generateOccurrences(tx, template, today); err != nil {
+				return err
+			}
+		}
+		template, err = fetchTemplateByID(tx, template.ID, template.UserID)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error updating recurring template: %v", err)
+		sendErrorResponse(w, "Error updating recurring template", common.TxErrorStatus(err))
+		return
+	}
+
+	sendSuccessResponse(w, "Recurring template updated successfully", withNextDate(db, template))
+}
+
+// handleDeleteTemplate removes a template and its occurrences. Incomes and expenses it already
+// posted are ordinary transactions and stay.
+func handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req DeleteTemplateRequest
+	if r.Method == "DELETE" {
+		req.UserID = r.URL.Query().Get("user_id")
+		req.TemplateID, _ = strconv.Atoi(r.URL.Query().Get("template_id"))
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" || req.TemplateID <= 0 {
+		sendErrorResponse(w, "User ID and template ID are required", http.StatusBadRequest)
+		return
+	}
+
+	var deleted int64
+	err := common.WithTx(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM recurring_occurrences WHERE template_id = ? AND user_id = ?`,
+			req.TemplateID, req.UserID); err != nil {
+			return fmt.Errorf("error deleting occurrences: %v", err)
+		}
+		result, err := tx.Exec(`DELETE FROM recurring_templates WHERE id = ? AND user_id = ?`, req.TemplateID, req.UserID)
+		if err != nil {
+			return fmt.Errorf("error deleting recurring template: %v", err)
+		}
+		deleted, _ = result.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error deleting recurring template: %v", err)
+		sendErrorResponse(w, "Error deleting recurring template", common.TxErrorStatus(err))
+		return
+	}
+	if deleted == 0 {
+		sendErrorResponse(w, "Recurring template not found", http.StatusNotFound)
+		return
+	}
+
+	sendSuccessResponse(w, "Recurring template deleted successfully", nil)
+}
@@ -7,8 +7,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
+	"hero_budget_backend/common"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -34,6 +37,7 @@ type User struct {
 type SignInRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Timezone string `json:"timezone,omitempty"` // IANA time zone of the device, e.g. "America/Mexico_City"
 }
 
 type SignInResponse struct {
@@ -66,6 +70,10 @@ func init() {
 		log.Fatalf("Failed to ping database: %v", err)
 	}
 
+	if err = common.EnsureUserTimezoneColumn(db); err != nil {
+		log.Fatalf("Failed to add timezone column: %v", err)
+	}
+
 	log.Println("Database connection established successfully")
 }
 
@@ -209,6 +217,13 @@ func handleSignIn(w http.ResponseWriter, r *http.Request) {
 		// Continue anyway, not critical
 	}
 
+	// Keep the user's time zone in sync with the device they sign in from
+	if req.Timezone != "" {
+		if err := common.SetUserTimezone(db, strconv.Itoa(user.ID), req.Timezone); err != nil {
+			log.Printf("Failed to update time zone for user %d: %v", user.ID, err)
+		}
+	}
+
 	// Check if email is verified
 	if !user.VerifiedEmail {
 		w.Header().Set("Content-Type", "application/json")
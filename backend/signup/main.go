@@ -21,6 +21,8 @@ import (
 
 	"text/template"
 
+	"hero_budget_backend/common"
+
 	"github.com/chai2010/webp"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/nfnt/resize"
@@ -104,6 +106,7 @@ type SignupRequest struct {
 	FamilyName    string `json:"family_name"`
 	PictureBase64 string `json:"picture_base64,omitempty"` // Base64 encoded image
 	Locale        string `json:"locale"`
+	Timezone      string `json:"timezone,omitempty"` // IANA time zone of the device
 	VerifiedEmail bool   `json:"verified_email"`
 }
 
@@ -344,6 +347,10 @@ func init() {
 		}
 	}
 
+	if err = common.EnsureUserTimezoneColumn(db); err != nil {
+		log.Fatalf("Failed to add timezone column: %v", err)
+	}
+
 	log.Println("Database connection established successfully")
 }
 
@@ -768,6 +775,20 @@ func handleSignup(w http.ResponseWriter, r *http.Request) {
 	userID, _ := result.LastInsertId()
 	log.Printf("User created with ID: %d", userID)
 
+	// Device time zone, used for default dates and current periods
+	if req.Timezone != "" {
+		if err := common.SetUserTimezone(db, fmt.Sprintf("%d", userID), req.Timezone); err != nil {
+			log.Printf("Warning: Failed to save time zone: %v", err)
+		}
+	}
+
+	// Default categories in the user's language
+	if seeded, err := common.SeedDefaultCategories(db, fmt.Sprintf("%d", userID), req.Locale); err != nil {
+		log.Printf("Warning: Failed to seed default categories: %v", err)
+	} else {
+		log.Printf("Seeded %d default categories (%s) for user %d", seeded.Added, seeded.Language, userID)
+	}
+
 	// Send verification email
 	if smtpHost != "smtp.example.com" { // Only send if SMTP is configured
 		// Log name for debugging
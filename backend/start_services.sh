@@ -25,6 +25,9 @@ TRANSACTION_DELETE_PORT=8095
 CATEGORIES_MANAGEMENT_PORT=8096
 MONEY_FLOW_SYNC_PORT=8097
 BUDGET_OVERVIEW_FETCH_PORT=8098
+LOANS_MANAGEMENT_PORT=8099
+RECURRING_BILLS_MANAGEMENT_PORT=8100
+BILL_REMINDERS_PORT=8101
 
 # Function to get service port by name
 get_port() {
@@ -47,6 +50,9 @@ get_port() {
     "categories_management") echo $CATEGORIES_MANAGEMENT_PORT ;;
     "money_flow_sync") echo $MONEY_FLOW_SYNC_PORT ;;
     "budget_overview_fetch") echo $BUDGET_OVERVIEW_FETCH_PORT ;;
+    "loans_management") echo $LOANS_MANAGEMENT_PORT ;;
+    "recurring_bills_management") echo $RECURRING_BILLS_MANAGEMENT_PORT ;;
+    "bill_reminders") echo $BILL_REMINDERS_PORT ;;
     *) echo "" ;;
   esac
 }
@@ -71,6 +77,9 @@ services=(
   "categories_management"
   "money_flow_sync"
   "budget_overview_fetch"
+  "loans_management"
+  "recurring_bills_management"
+  "bill_reminders"
 )
 
 # Check for selected services
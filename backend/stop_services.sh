@@ -25,6 +25,9 @@ TRANSACTION_DELETE_PORT=8095
 CATEGORIES_MANAGEMENT_PORT=8096
 MONEY_FLOW_SYNC_PORT=8097
 BUDGET_OVERVIEW_FETCH_PORT=8098
+LOANS_MANAGEMENT_PORT=8099
+RECURRING_BILLS_MANAGEMENT_PORT=8100
+BILL_REMINDERS_PORT=8101
 
 # Service directories
 services=(
@@ -46,6 +49,9 @@ services=(
     "categories_management"
     "money_flow_sync"
     "budget_overview_fetch"
+    "loans_management"
+  "recurring_bills_management"
+  "bill_reminders"
 )
 
 # Output header
@@ -53,7 +59,7 @@ echo -e "${GREEN}Stopping Hero Budget backend services...${NC}"
 echo
 
 # Kill processes by port (more reliable)
-for port in $AUTH_SERVICE_PORT $SIGNUP_SERVICE_PORT $LANGUAGE_SERVICE_PORT $SIGNIN_SERVICE_PORT $FETCH_DASHBOARD_PORT $RESET_PASSWORD_PORT $DASHBOARD_DATA_PORT $BUDGET_MANAGEMENT_PORT $SAVINGS_MANAGEMENT_PORT $CASH_BANK_MANAGEMENT_PORT $BILLS_MANAGEMENT_PORT $PROFILE_MANAGEMENT_PORT $INCOME_MANAGEMENT_PORT $EXPENSE_MANAGEMENT_PORT $TRANSACTION_DELETE_PORT $CATEGORIES_MANAGEMENT_PORT $MONEY_FLOW_SYNC_PORT $BUDGET_OVERVIEW_FETCH_PORT; do
+for port in $AUTH_SERVICE_PORT $SIGNUP_SERVICE_PORT $LANGUAGE_SERVICE_PORT $SIGNIN_SERVICE_PORT $FETCH_DASHBOARD_PORT $RESET_PASSWORD_PORT $DASHBOARD_DATA_PORT $BUDGET_MANAGEMENT_PORT $SAVINGS_MANAGEMENT_PORT $CASH_BANK_MANAGEMENT_PORT $BILLS_MANAGEMENT_PORT $PROFILE_MANAGEMENT_PORT $INCOME_MANAGEMENT_PORT $EXPENSE_MANAGEMENT_PORT $TRANSACTION_DELETE_PORT $CATEGORIES_MANAGEMENT_PORT $MONEY_FLOW_SYNC_PORT $BUDGET_OVERVIEW_FETCH_PORT $LOANS_MANAGEMENT_PORT $RECURRING_BILLS_MANAGEMENT_PORT $BILL_REMINDERS_PORT; do
     # Find and kill process using this port
     PID=$(lsof -i :$port -t 2>/dev/null)
     if [ -n "$PID" ]; then
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"hero_budget_backend/common"
+)
+
+// Batch request structure: a list of mixed create/update/delete operations
+// applied atomically for a single user
+type BatchRequest struct {
+	UserID     string           `json:"user_id"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation describes a single create, update or delete of an income, expense or bill.
+// Date is the transaction date for incomes/expenses and the due date for bills. Updates and
+// deletes may carry the version the client last saw; if the row has changed since, the batch
+// fails with 409 like a single update with If-Match.
+type BatchOperation struct {
+	Op              string  `json:"op"`
+	Type            string  `json:"type"`
+	ID              int     `json:"id,omitempty"`
+	ExpectedVersion int     `json:"expected_version,omitempty"`
+	Amount          float64 `json:"amount,omitempty"`
+	Date            string  `json:"date,omitempty"`
+	Category        string  `json:"category,omitempty"`
+	PaymentMethod   string  `json:"payment_method,omitempty"`
+	Description     string  `json:"description,omitempty"`
+	Name            string  `json:"name,omitempty"`
+	Icon            string  `json:"icon,omitempty"`
+	DurationMonths  int     `json:"duration_months,omitempty"` // 0 leaves a new bill without an end
+	Regularity      string  `json:"regularity,omitempty"`
+	// Moves bill due dates that fall on a weekend: "following", "preceding" or "modified_following"
+	BusinessDayAdjustment *string `json:"business_day_adjustment,omitempty"`
+}
+
+// BatchItemResult reports the outcome of one operation, in request order
+type BatchItemResult struct {
+	Index   int    `json:"index"`
+	Op      string `json:"op"`
+	Type    string `json:"type"`
+	ID      int    `json:"id,omitempty"`
+	Version int    `json:"version,omitempty"` // New version of a created or updated row
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+}
+
+// Maximum number of operations accepted in a single batch
+const maxBatchOperations = 500
+
+func handleBatchTransactions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var batchRequest BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&batchRequest); err != nil {
+		log.Printf("Error decoding batch request body: %v", err)
+		writeJSON(w, http.StatusBadRequest, ApiResponse{Success: false, Message: "Invalid request format"})
+		return
+	}
+
+	if batchRequest.UserID == "" {
+		writeJSON(w, http.StatusBadRequest, ApiResponse{Success: false, Message: "Missing required field: user_id"})
+		return
+	}
+	if len(batchRequest.Operations) == 0 {
+		writeJSON(w, http.StatusBadRequest, ApiResponse{Success: false, Message: "Batch must contain at least one operation"})
+		return
+	}
+	if len(batchRequest.Operations) > maxBatchOperations {
+		writeJSON(w, http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Message: fmt.Sprintf("Batch cannot contain more than %d operations", maxBatchOperations),
+		})
+		return
+	}
+
+	// Validate every operation before touching the database
+	results := make([]BatchItemResult, len(batchRequest.Operations))
+	valid := true
+	for i := range batchRequest.Operations {
+		op := &batchRequest.Operations[i]
+		normalizeBatchOperation(op)
+		results[i] = BatchItemResult{Index: i, Op: op.Op, Type: op.Type, ID: op.ID, Success: true}
+		if err := validateBatchOperation(op); err != nil {
+			results[i].Success = false
+			results[i].Message = err.Error()
+			valid = false
+		}
+	}
+	if !valid {
+		writeJSON(w, http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Message: "Batch validation failed, no changes were applied",
+			Data:    results,
+		})
+		return
+	}
+
+	log.Printf("Applying batch of %d operations for user %s", len(batchRequest.Operations), batchRequest.UserID)
+
+	status, err := applyBatch(batchRequest.UserID, batchRequest.Operations, results)
+	if err != nil {
+		log.Printf("Error applying batch for user %s: %v", batchRequest.UserID, err)
+		for i := range results {
+			if results[i].Success {
+				results[i].Success = false
+				results[i].Message = "Not applied, batch was rolled back"
+			}
+		}
+		writeJSON(w, status, ApiResponse{
+			Success: false,
+			Message: "Batch failed, no changes were applied",
+			Data:    results,
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResponse{
+		Success: true,
+		Message: fmt.Sprintf("%d operations applied successfully", len(results)),
+		Data:    results,
+	})
+}
+
+func normalizeBatchOperation(op *BatchOperation) {
+	op.Op = strings.ToLower(strings.TrimSpace(op.Op))
+	op.Type = strings.ToLower(strings.TrimSpace(op.Type))
+	op.PaymentMethod = strings.ToLower(strings.TrimSpace(op.PaymentMethod))
+	if op.Type == "bill" {
+		if op.PaymentMethod == "" {
+			op.PaymentMethod = "bank"
+		}
+		// Updates keep the stored rule and duration unless the operation carries new ones
+		if op.Regularity == "" && op.Op == "create" {
+			op.Regularity = "monthly"
+		}
+		if op.Icon == "" {
+			op.Icon = "💳"
+		}
+		if op.Category == "" {
+			op.Category = "general"
+		}
+	}
+}
+
+// validateBatchOperation checks the shape of an operation without querying the database
+func validateBatchOperation(op *BatchOperation) error {
+	switch op.Type {
+	case "income", "expense", "bill":
+	default:
+		return fmt.Errorf("unsupported transaction type: %q", op.Type)
+	}
+
+	switch op.Op {
+	case "create", "update":
+		if op.Op == "update" && op.ID <= 0 {
+			return fmt.Errorf("id is required for update")
+		}
+		if op.Amount <= 0 {
+			return fmt.Errorf("amount must be greater than zero")
+		}
+		if _, err := time.Parse("2006-01-02", op.Date); err != nil {
+			return fmt.Errorf("date must use the YYYY-MM-DD format")
+		}
+		if op.PaymentMethod != "cash" && op.PaymentMethod != "bank" {
+			return fmt.Errorf("payment_method must be 'cash' or 'bank'")
+		}
+		if op.Type == "bill" {
+			if strings.TrimSpace(op.Name) == "" {
+				return fmt.Errorf("name is required for bills")
+			}
+			regularity := op.Regularity
+			if regularity == "" {
+				regularity = "monthly"
+			}
+			if op.DurationMonths < 0 {
+				return fmt.Errorf("duration_months must not be negative")
+			}
+			adjustment := common.BusinessDayNone
+			if op.BusinessDayAdjustment != nil {
+				adjustment = *op.BusinessDayAdjustment
+			}
+			_, err := common.BillSchedule(op.Date, billPaymentDay(op.Date), op.DurationMonths, regularity, adjustment)
+			if err != nil {
+				return fmt.Errorf("invalid bill schedule: %v", err)
+			}
+		} else if strings.TrimSpace(op.Category) == "" {
+			return fmt.Errorf("category is required")
+		}
+	case "delete":
+		if op.ID <= 0 {
+			return fmt.Errorf("id is required for delete")
+		}
+	default:
+		return fmt.Errorf("unsupported operation: %q", op.Op)
+	}
+
+	if op.ExpectedVersion < 0 || (op.ExpectedVersion > 0 && op.Op == "create") {
+		return fmt.Errorf("expected_version must be a positive version of an existing row")
+	}
+	return nil
+}
+
+// batchLedgerSources maps a batch transaction type to its ledger source
+var batchLedgerSources = map[string]string{
+	"income":  common.LedgerSourceIncome,
+	"expense": common.LedgerSourceExpense,
+	"bill":    common.LedgerSourceBill,
+}
+
+// batchEvents maps a batch transaction type and operation to its domain event
+var batchEvents = map[string]map[string]string{
+	"income":  {"create": common.EventIncomeCreated, "update": common.EventIncomeUpdated, "delete": common.EventIncomeDeleted},
+	"expense": {"create": common.EventExpenseCreated, "update": common.EventExpenseUpdated, "delete": common.EventExpenseDeleted},
+	"bill":    {"create": common.EventBillCreated, "update": common.EventBillUpdated, "delete": common.EventBillDeleted},
+}
+
+// applyBatch runs every operation in one transaction, then updates the ledger and cascades
+// balances once from the earliest affected date. On error it returns the HTTP status to report.
+func applyBatch(userID string, operations []BatchOperation, results []BatchItemResult) (int, error) {
+	status := http.StatusOK
+	validated := append([]BatchItemResult(nil), results...)
+	err := common.WithTx(db, func(tx *sql.Tx) error {
+		// Every attempt starts from the validated results, so a retry that succeeds does not
+		// report the failures of the attempt that hit the lock
+		copy(results, validated)
+		var err error
+		status, err = applyBatchTx(tx, userID, operations, results)
+		return err
+	})
+	if err != nil && (status == http.StatusOK || common.IsLockError(err)) {
+		status = common.TxErrorStatus(err)
+	}
+	return status, err
+}
+
+// applyBatchTx applies the operations inside tx; WithTx repeats it if the database is locked
+func applyBatchTx(tx *sql.Tx, userID string, operations []BatchOperation, results []BatchItemResult) (int, error) {
+	var changes []common.LedgerChange
+
+	for i, op := range operations {
+		version := 1
+		if op.Op != "create" {
+			details, err := getTransactionDetailsTx(tx, op.ID, op.Type, userID)
+			if err != nil {
+				results[i].Success = false
+				if err == sql.ErrNoRows {
+					results[i].Message = "Transaction not found or access denied"
+					return http.StatusNotFound, fmt.Errorf("operation %d: %s %d not found", i, op.Type, op.ID)
+				}
+				results[i].Message = "Failed to load transaction"
+				return http.StatusInternalServerError, fmt.Errorf("operation %d: %v", i, err)
+			}
+			if op.ExpectedVersion > 0 && details.Version != op.ExpectedVersion {
+				results[i].Success = false
+				results[i].Version = details.Version
+				results[i].Message = common.ErrVersionConflict.Error()
+				return http.StatusConflict, fmt.Errorf("operation %d: %s %d is at version %d, expected %d",
+					i, op.Type, op.ID, details.Version, op.ExpectedVersion)
+			}
+			version = details.Version + 1
+
+			// Reconciled incomes and expenses are locked
+			if err := common.CheckNotReconciled(tx, op.Type, op.ID, userID); err != nil {
+				results[i].Success = false
+				results[i].Message = err.Error()
+				if err == common.ErrTransactionLocked {
+					return http.StatusLocked, fmt.Errorf("operation %d: %v", i, err)
+				}
+				return http.StatusInternalServerError, fmt.Errorf("operation %d: %v", i, err)
+			}
+		}
+
+		// A deleted row drops its ledger entries, and those of a bill's monthly payments
+		if op.Op == "delete" {
+			removals, err := ledgerRemovals(tx, op.ID, op.Type)
+			if err != nil {
+				results[i].Success = false
+				results[i].Message = "Failed to update balances"
+				return http.StatusInternalServerError, fmt.Errorf("operation %d: %v", i, err)
+			}
+			changes = append(changes, removals...)
+		}
+
+		id, err := applyBatchOperation(tx, userID, op)
+		if err != nil {
+			results[i].Success = false
+			results[i].Message = fmt.Sprintf("Failed to %s %s", op.Op, op.Type)
+			return http.StatusInternalServerError, fmt.Errorf("operation %d: %v", i, err)
+		}
+		results[i].ID = id
+		if op.Op != "delete" {
+			results[i].Version = version
+		}
+
+		op.ID = id
+		if err := common.PublishEvent(tx, batchEvents[op.Type][op.Op], userID, int64(id), op); err != nil {
+			results[i].Success = false
+			results[i].Message = "Failed to record event"
+			return http.StatusInternalServerError, fmt.Errorf("operation %d: %v", i, err)
+		}
+
+		// The new version of the row replaces the ledger entry of the previous one. Bills with
+		// monthly payments are already reserved month by month through those payments.
+		if op.Op != "delete" && !(op.Type == "bill" && hasBillPayments(tx, id)) {
+			date, _ := time.Parse("2006-01-02", op.Date)
+			changes = append(changes, common.LedgerChange{
+				SourceType: batchLedgerSources[op.Type],
+				SourceID:   int64(id),
+				Entries: []common.LedgerEntry{{
+					Date: date, Kind: op.Type, PaymentMethod: op.PaymentMethod, Amount: op.Amount,
+				}},
+			})
+		}
+
+		results[i].Message = fmt.Sprintf("%s %sd", op.Type, op.Op)
+	}
+
+	// Balances are projected and cascaded once for the whole batch
+	if err := common.ApplyLedgerChanges(tx, userID, changes...); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error updating balances: %v", err)
+	}
+
+	return http.StatusOK, nil
+}
+
+// applyBatchOperation writes a single row change and returns the affected row id
+func applyBatchOperation(tx *sql.Tx, userID string, op BatchOperation) (int, error) {
+	switch op.Op {
+	case "create":
+		var result sql.Result
+		var err error
+		switch op.Type {
+		case "income", "expense":
+			// Incomes and expenses are linked to their category as in income and expense management
+			var categoryID sql.NullInt64
+			if categoryID, err = common.ResolveCategoryID(tx, userID, op.Type, op.Category); err != nil {
+				return 0, err
+			}
+			result, err = tx.Exec(fmt.Sprintf(`
+				INSERT INTO %s (user_id, amount, date, category, category_id, payment_method, description)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+			`, op.Type+"s"), userID, op.Amount, op.Date, op.Category, categoryID, op.PaymentMethod, op.Description)
+		case "bill":
+			// Bills get the same payments and reservations as those added through bills_management
+			adjustment := common.BusinessDayNone
+			if op.BusinessDayAdjustment != nil {
+				adjustment = *op.BusinessDayAdjustment
+			}
+			return common.AddAdjustedBillTx(tx, userID, op.Name, op.Amount, op.Date, billPaymentDay(op.Date),
+				op.DurationMonths, op.PaymentMethod, op.Category, op.Icon, op.Regularity, adjustment)
+		}
+		if err != nil {
+			return 0, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		return int(id), nil
+
+	case "update":
+		var result sql.Result
+		var err error
+		switch op.Type {
+		case "income", "expense":
+			var categoryID sql.NullInt64
+			if categoryID, err = common.ResolveCategoryID(tx, userID, op.Type, op.Category); err != nil {
+				return 0, err
+			}
+			result, err = tx.Exec(fmt.Sprintf(`
+				UPDATE %s
+				SET amount = ?, date = ?, category = ?, category_id = ?, payment_method = ?, description = ?,
+				    version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+				WHERE id = ? AND user_id = ?
+			`, op.Type+"s"), op.Amount, op.Date, op.Category, categoryID, op.PaymentMethod, op.Description, op.ID, userID)
+		case "bill":
+			// The due date is where the schedule starts, as when the bill was created
+			result, err = tx.Exec(`
+				UPDATE bills
+				SET name = ?, amount = ?, due_date = ?, start_date = ?, payment_day = ?, category = ?, icon = ?,
+				    payment_method = ?, duration_months = CASE WHEN ? > 0 THEN ? ELSE duration_months END,
+				    regularity = COALESCE(NULLIF(?, ''), regularity),
+				    business_day_adjustment = CASE WHEN ? THEN ? ELSE business_day_adjustment END,
+				    version = COALESCE(version, 1) + 1, updated_at = CURRENT_TIMESTAMP
+				WHERE id = ? AND user_id = ?
+			`, op.Name, op.Amount, op.Date, op.Date, billPaymentDay(op.Date), op.Category, op.Icon, op.PaymentMethod,
+				op.DurationMonths, op.DurationMonths, op.Regularity,
+				op.BusinessDayAdjustment != nil, op.BusinessDayAdjustment, op.ID, userID)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			return 0, fmt.Errorf("no %s found with ID %d for user %s", op.Type, op.ID, userID)
+		}
+		if op.Type == "bill" {
+			if err := rescheduleBatchBill(tx, userID, op.ID); err != nil {
+				return 0, err
+			}
+		}
+		return op.ID, nil
+
+	case "delete":
+		if err := deleteTransactionTx(tx, op.ID, op.Type, userID); err != nil {
+			return 0, err
+		}
+		return op.ID, nil
+	}
+
+	return 0, fmt.Errorf("unsupported operation: %s", op.Op)
+}
+
+// hasBillPayments reports whether the bill has a schedule of monthly payments
+func hasBillPayments(q common.DBTX, billID int) bool {
+	var count int
+	err := q.QueryRow(`SELECT COUNT(*) FROM bill_payments WHERE bill_id = ?`, billID).Scan(&count)
+	return err == nil && count > 0
+}
+
+// rescheduleBatchBill moves the pending payments of an updated bill to its new schedule, amount
+// and method, like an update through bills_management. Bills from older batches without payments
+// keep their single ledger entry, which applyBatchTx replaces.
+func rescheduleBatchBill(tx *sql.Tx, userID string, billID int) error {
+	var scheduled bool
+	if err := tx.QueryRow(`SELECT COALESCE(scheduled, 0) FROM bills WHERE id = ? AND user_id = ?`, billID, userID).Scan(&scheduled); err != nil {
+		return err
+	}
+	if scheduled {
+		return common.RescheduleBill(tx, userID, int64(billID), common.BillHorizon(tx, userID))
+	}
+	if hasBillPayments(tx, billID) {
+		return common.ReserveBillPayments(tx, userID, int64(billID))
+	}
+	return nil
+}
+
+// billPaymentDay derives the payment day from a due date. A due date on the last day of a month
+// after the 28th is a month-end bill; other days that do not exist in a month fall on its last day.
+func billPaymentDay(dueDate string) int {
+	date, err := time.Parse("2006-01-02", dueDate)
+	if err != nil {
+		return 1
+	}
+	if date.Day() > 28 && date.AddDate(0, 0, 1).Day() == 1 {
+		return common.LastDayOfMonth
+	}
+	return date.Day()
+}
+
+func writeJSON(w http.ResponseWriter, status int, response ApiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"hero_budget_backend/common"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// setupBatchDB replaces the global db with an empty database holding the tables the batch writes
+func setupBatchDB(t *testing.T) {
+	t.Helper()
+	testDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+	db = testDB
+
+	statements := []string{
+		`CREATE TABLE incomes (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, amount REAL, date TEXT,
+			category TEXT, payment_method TEXT, description TEXT, created_at TIMESTAMP, updated_at TIMESTAMP)`,
+		`CREATE TABLE expenses (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, amount REAL, date TEXT,
+			category TEXT, payment_method TEXT, description TEXT, created_at TIMESTAMP, updated_at TIMESTAMP)`,
+		`CREATE TABLE bills (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, name TEXT, amount REAL, due_date TEXT,
+			paid BOOLEAN DEFAULT 0, overdue BOOLEAN DEFAULT 0, overdue_days INTEGER DEFAULT 0, recurring BOOLEAN DEFAULT 0,
+			category TEXT, icon TEXT, start_date TEXT, payment_day INTEGER, duration_months INTEGER, regularity TEXT,
+			payment_method TEXT, updated_at TIMESTAMP)`,
+		`CREATE TABLE bill_payments (id INTEGER PRIMARY KEY AUTOINCREMENT, bill_id INTEGER, user_id TEXT,
+			year_month TEXT, paid BOOLEAN DEFAULT 0, payment_date TEXT, payment_method TEXT, UNIQUE(bill_id, year_month))`,
+		`CREATE TABLE categories (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT NOT NULL, name TEXT NOT NULL,
+			type TEXT NOT NULL, emoji TEXT NOT NULL, parent_id INTEGER)`,
+	}
+	for _, pt := range common.PeriodTables {
+		statements = append(statements, fmt.Sprintf(`CREATE TABLE %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT NOT NULL, %s TEXT NOT NULL,
+			income_cash_amount REAL DEFAULT 0, income_bank_amount REAL DEFAULT 0,
+			expense_cash_amount REAL DEFAULT 0, expense_bank_amount REAL DEFAULT 0,
+			bill_cash_amount REAL DEFAULT 0, bill_bank_amount REAL DEFAULT 0,
+			cash_amount REAL DEFAULT 0, bank_amount REAL DEFAULT 0,
+			previous_cash_amount REAL DEFAULT 0, previous_bank_amount REAL DEFAULT 0,
+			balance_cash_amount REAL DEFAULT 0, balance_bank_amount REAL DEFAULT 0,
+			total_previous_balance REAL DEFAULT 0, total_balance REAL DEFAULT 0,
+			updated_at TIMESTAMP, UNIQUE(user_id, %s))`, pt.Table, pt.Column, pt.Column))
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Failed to create schema: %v", err)
+		}
+	}
+
+	ensure := []func(*sql.DB) error{
+		common.EnsureLedgerTable, common.EnsureOutboxTable, common.EnsurePeriodSettingsTable,
+		common.EnsureTransactionStatusColumns,
+	}
+	for _, fn := range ensure {
+		if err := fn(db); err != nil {
+			t.Fatalf("Failed to create schema: %v", err)
+		}
+	}
+	for _, table := range []string{"incomes", "expenses"} {
+		if err := common.EnsureCategoryIDColumn(db, table); err != nil {
+			t.Fatalf("Failed to create schema: %v", err)
+		}
+	}
+}
+
+func postBatch(t *testing.T, request BatchRequest) (int, []BatchItemResult) {
+	t.Helper()
+	payload, _ := json.Marshal(request)
+	rr := httptest.NewRecorder()
+	handleBatchTransactions(rr, httptest.NewRequest("POST", "/transactions/batch", bytes.NewBuffer(payload)))
+
+	var response struct {
+		Data []BatchItemResult `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	return rr.Code, response.Data
+}
+
+func countRows(t *testing.T, query string) int {
+	t.Helper()
+	var count int
+	if err := db.QueryRow(query).Scan(&count); err != nil {
+		t.Fatalf("Failed to count rows: %v", err)
+	}
+	return count
+}
+
+func TestBatchBillsGetTheirSchedule(t *testing.T) {
+	setupBatchDB(t)
+
+	status, results := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{
+		{Op: "create", Type: "income", Amount: 1000, Date: "2025-01-01", Category: "Salary", PaymentMethod: "bank"},
+		{Op: "create", Type: "bill", Name: "Rent", Amount: 300, Date: "2025-01-15", DurationMonths: 3},
+	}})
+	if status != http.StatusOK || len(results) != 2 {
+		t.Fatalf("Expected the batch to succeed, got %d: %+v", status, results)
+	}
+
+	// Like bills added through bills_management: scheduled, one payment per month reserved in its month
+	var scheduled bool
+	db.QueryRow(`SELECT scheduled FROM bills WHERE id = ?`, results[1].ID).Scan(&scheduled)
+	if !scheduled {
+		t.Errorf("Expected the batch bill to be scheduled")
+	}
+	if count := countRows(t, `SELECT COUNT(*) FROM bill_payments`); count != 3 {
+		t.Errorf("Expected 3 bill payments, got %d", count)
+	}
+	if count := countRows(t, `SELECT COUNT(*) FROM balance_ledger WHERE source_type = 'bill'`); count != 0 {
+		t.Errorf("Expected no single bill entry in the ledger, got %d", count)
+	}
+	var reserved, balance float64
+	db.QueryRow(`SELECT bill_bank_amount, balance_bank_amount FROM monthly_cash_bank_balance WHERE year_month = '2025-03'`).
+		Scan(&reserved, &balance)
+	if reserved != 300 || balance != 100 {
+		t.Errorf("Expected 300 reserved in March and 100 left, got %.2f and %.2f", reserved, balance)
+	}
+}
+
+func TestBatchRollsBackWhenAnOperationFails(t *testing.T) {
+	setupBatchDB(t)
+
+	status, results := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{
+		{Op: "create", Type: "income", Amount: 1000, Date: "2025-01-01", Category: "Salary", PaymentMethod: "bank"},
+		{Op: "create", Type: "bill", Name: "Rent", Amount: 300, Date: "2025-01-15", DurationMonths: 3},
+		{Op: "update", Type: "expense", ID: 999, Amount: 20, Date: "2025-01-02", Category: "Food", PaymentMethod: "cash"},
+	}})
+	if status != http.StatusNotFound {
+		t.Fatalf("Expected the missing expense to fail the batch with 404, got %d", status)
+	}
+	if len(results) != 3 || results[0].Success || results[1].Success || results[2].Success {
+		t.Errorf("Expected every operation reported as not applied, got %+v", results)
+	}
+
+	for _, table := range []string{"incomes", "bills", "bill_payments", "balance_ledger", "monthly_cash_bank_balance", "outbox"} {
+		if count := countRows(t, `SELECT COUNT(*) FROM `+table); count != 0 {
+			t.Errorf("Expected the rollback to leave %s empty, got %d rows", table, count)
+		}
+	}
+}
+
+func TestBatchUpdatesCheckAndBumpVersions(t *testing.T) {
+	setupBatchDB(t)
+
+	expense := BatchOperation{Op: "create", Type: "expense", Amount: 20, Date: "2025-01-02", Category: "Food", PaymentMethod: "cash"}
+	_, results := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{expense}})
+	if len(results) != 1 || results[0].Version != 1 {
+		t.Fatalf("Expected the expense created at version 1, got %+v", results)
+	}
+
+	update := expense
+	update.Op, update.ID, update.Amount, update.ExpectedVersion = "update", results[0].ID, 25, 1
+	status, results := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{update}})
+	if status != http.StatusOK || results[0].Version != 2 {
+		t.Fatalf("Expected the update to move the expense to version 2, got %d: %+v", status, results)
+	}
+
+	// A second device still holding version 1 must not overwrite the first one's change
+	update.Amount = 30
+	status, results = postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{update}})
+	if status != http.StatusConflict || results[0].Version != 2 {
+		t.Errorf("Expected 409 with the current version 2, got %d: %+v", status, results)
+	}
+	var amount float64
+	db.QueryRow(`SELECT amount FROM expenses WHERE id = ?`, update.ID).Scan(&amount)
+	if amount != 25 {
+		t.Errorf("Expected the stale update to leave 25, got %.2f", amount)
+	}
+}
+
+func TestBatchRetryReportsOnlyTheLastAttempt(t *testing.T) {
+	setupBatchDB(t)
+	// A single connection that fails at once when another one holds the write lock
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`PRAGMA busy_timeout = 0`); err != nil {
+		t.Fatalf("Failed to set busy timeout: %v", err)
+	}
+
+	expense := BatchOperation{Op: "create", Type: "expense", Amount: 20, Date: "2025-01-02", Category: "Food", PaymentMethod: "cash"}
+	_, results := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{expense}})
+	if len(results) != 1 || !results[0].Success {
+		t.Fatalf("Expected the expense to be created, got %+v", results)
+	}
+
+	previous := common.TxRetryPolicy
+	common.TxRetryPolicy = common.RetryPolicy{Attempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	t.Cleanup(func() { common.TxRetryPolicy = previous })
+
+	// Another process holds the write lock while the first attempt runs and releases it before the retry
+	var path string
+	db.QueryRow(`SELECT file FROM pragma_database_list WHERE name = 'main'`).Scan(&path)
+	other, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open second connection: %v", err)
+	}
+	defer other.Close()
+	lock, err := other.Begin()
+	if err == nil {
+		_, err = lock.Exec(`INSERT INTO incomes (user_id, amount, date) VALUES ('2', 1, '2025-01-01')`)
+	}
+	if err != nil {
+		t.Fatalf("Failed to take the write lock: %v", err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		lock.Rollback()
+	}()
+
+	update := expense
+	update.Op, update.ID, update.Amount = "update", results[0].ID, 25
+	status, results := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{update}})
+	if status != http.StatusOK || len(results) != 1 || !results[0].Success || results[0].Message != "expense updated" {
+		t.Errorf("Expected the retried update reported as applied, got %d: %+v", status, results)
+	}
+}
+
+func TestBatchBillUpdatesMoveTheSchedule(t *testing.T) {
+	setupBatchDB(t)
+
+	bill := BatchOperation{Op: "create", Type: "bill", Name: "Rent", Amount: 300, Date: "2025-01-15", DurationMonths: 3}
+	_, results := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{
+		{Op: "create", Type: "income", Amount: 1000, Date: "2025-01-01", Category: "Salary", PaymentMethod: "bank"},
+		bill,
+	}})
+	if len(results) != 2 || !results[1].Success {
+		t.Fatalf("Expected the bill to be created, got %+v", results)
+	}
+
+	// A new amount without a duration keeps the three payments and reserves the new amount
+	update := BatchOperation{Op: "update", Type: "bill", ID: results[1].ID, Name: "Rent", Amount: 400, Date: "2025-01-15"}
+	status, results := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{update}})
+	if status != http.StatusOK {
+		t.Fatalf("Expected the update to succeed, got %d: %+v", status, results)
+	}
+
+	var duration int
+	var regularity string
+	db.QueryRow(`SELECT duration_months, regularity FROM bills WHERE id = ?`, update.ID).Scan(&duration, &regularity)
+	if duration != 3 || regularity != "monthly" {
+		t.Errorf("Expected the bill to keep 3 monthly payments, got %d %s", duration, regularity)
+	}
+	if count := countRows(t, `SELECT COUNT(*) FROM bill_payments WHERE paid = 0`); count != 3 {
+		t.Errorf("Expected 3 pending payments, got %d", count)
+	}
+	var reserved, balance float64
+	db.QueryRow(`SELECT bill_bank_amount, balance_bank_amount FROM monthly_cash_bank_balance WHERE year_month = '2025-03'`).
+		Scan(&reserved, &balance)
+	if reserved != 400 || balance != -200 {
+		t.Errorf("Expected 400 reserved in March and -200 left, got %.2f and %.2f", reserved, balance)
+	}
+}
+
+func TestBatchBillsKeepMonthEndAndBusinessDays(t *testing.T) {
+	setupBatchDB(t)
+
+	// Due on the 31st, moved off weekends and without an end
+	following := common.BusinessDayFollowing
+	status, results := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{
+		{Op: "create", Type: "bill", Name: "Rent", Amount: 300, Date: "2025-01-31", BusinessDayAdjustment: &following},
+	}})
+	if status != http.StatusOK || len(results) != 1 {
+		t.Fatalf("Expected the batch to succeed, got %d: %+v", status, results)
+	}
+	billID := results[0].ID
+
+	var paymentDay, duration int
+	var adjustment string
+	db.QueryRow(`SELECT payment_day, duration_months, business_day_adjustment FROM bills WHERE id = ?`, billID).
+		Scan(&paymentDay, &duration, &adjustment)
+	if paymentDay != common.LastDayOfMonth || duration != 0 || adjustment != common.BusinessDayFollowing {
+		t.Errorf("Expected an open-ended month-end bill moved to the following business day, got day %d, %d months, %q",
+			paymentDay, duration, adjustment)
+	}
+	dueDate := func(yearMonth string) string {
+		var due string
+		db.QueryRow(`SELECT due_date FROM bill_payments WHERE bill_id = ? AND year_month = ?`, billID, yearMonth).Scan(&due)
+		return due
+	}
+	// The 31st of May 2025 is a Saturday
+	for yearMonth, want := range map[string]string{"2025-02": "2025-02-28", "2025-04": "2025-04-30", "2025-05": "2025-06-02"} {
+		if got := dueDate(yearMonth); got != want {
+			t.Errorf("Expected the %s payment due on %s, got %s", yearMonth, want, got)
+		}
+	}
+	if count := countRows(t, `SELECT COUNT(*) FROM bill_payments`); count <= 12 {
+		t.Errorf("Expected payments beyond the first year of an open-ended bill, got %d", count)
+	}
+
+	// An update can drop the adjustment; an unknown one is rejected
+	none := common.BusinessDayNone
+	update := BatchOperation{Op: "update", Type: "bill", ID: billID, Name: "Rent", Amount: 300, Date: "2025-01-31", BusinessDayAdjustment: &none}
+	if status, results := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{update}}); status != http.StatusOK {
+		t.Fatalf("Expected the update to succeed, got %d: %+v", status, results)
+	}
+	if got := dueDate("2025-05"); got != "2025-05-31" {
+		t.Errorf("Expected the May payment back on 2025-05-31, got %s", got)
+	}
+	unknown := "sometimes"
+	update.BusinessDayAdjustment = &unknown
+	if status, _ := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{update}}); status != http.StatusBadRequest {
+		t.Errorf("Expected an unknown business day adjustment to be rejected, got %d", status)
+	}
+}
+
+func TestBatchLinksIncomesAndExpensesToCategories(t *testing.T) {
+	setupBatchDB(t)
+
+	db.Exec(`INSERT INTO categories (user_id, name, type, emoji) VALUES ('1', 'Food', 'expense', '🍔')`)
+	status, results := postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{
+		{Op: "create", Type: "expense", Amount: 20, Date: "2025-01-02", Category: "food", PaymentMethod: "cash"},
+		{Op: "create", Type: "income", Amount: 1000, Date: "2025-01-01", Category: "Salary", PaymentMethod: "bank"},
+	}})
+	if status != http.StatusOK || len(results) != 2 {
+		t.Fatalf("Expected the batch to succeed, got %d: %+v", status, results)
+	}
+
+	// The existing category is reused regardless of case; a new name gets its own category
+	if count := countRows(t, `SELECT COUNT(*) FROM expenses e JOIN categories c ON c.id = e.category_id WHERE c.name = 'Food'`); count != 1 {
+		t.Errorf("Expected the expense linked to Food, got %d", count)
+	}
+	if count := countRows(t, `SELECT COUNT(*) FROM incomes i JOIN categories c ON c.id = i.category_id WHERE c.name = 'Salary' AND c.type = 'income'`); count != 1 {
+		t.Errorf("Expected the income linked to a new Salary category, got %d", count)
+	}
+
+	// Changing the category on update moves the link too
+	status, _ = postBatch(t, BatchRequest{UserID: "1", Operations: []BatchOperation{
+		{Op: "update", Type: "expense", ID: results[0].ID, Amount: 20, Date: "2025-01-02", Category: "Rent", PaymentMethod: "cash"},
+	}})
+	if status != http.StatusOK {
+		t.Fatalf("Expected the update to succeed, got %d", status)
+	}
+	if count := countRows(t, `SELECT COUNT(*) FROM expenses e JOIN categories c ON c.id = e.category_id WHERE c.name = 'Rent'`); count != 1 {
+		t.Errorf("Expected the updated expense linked to Rent, got %d", count)
+	}
+}